@@ -0,0 +1,132 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Allocation budgets for a round trip through the server, including the
+// handful of allocations made by the fake kernel itself. See
+// fusetesting.CheckAllocBudget.
+const (
+	readFileAllocBudget  = 14
+	writeFileAllocBudget = 15
+)
+
+// A file system whose reads and writes do no work, so that any allocations
+// are the server's.
+type nopFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *nopFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.BytesRead = len(op.Dst)
+	return nil
+}
+
+func (fs *nopFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+// A request for a read or write round trip through a nopFS.
+type roundTrip struct {
+	opcode uint32
+	body   [][]byte
+}
+
+func readRoundTrip() roundTrip {
+	in := fusekernel.ReadIn{Fh: 1, Size: 4096}
+	return roundTrip{
+		opcode: fusekernel.OpRead,
+		body: [][]byte{
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+		},
+	}
+}
+
+func writeRoundTrip() roundTrip {
+	in := fusekernel.WriteIn{Fh: 1, Size: 4096}
+	return roundTrip{
+		opcode: fusekernel.OpWrite,
+		body: [][]byte{
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			make([]byte, in.Size),
+		},
+	}
+}
+
+func newNopKernel(tb testing.TB) *fusetesting.FakeKernel {
+	return newFakeKernel(
+		tb,
+		fuseutil.NewFileSystemServer(&nopFS{}),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+}
+
+func (rt roundTrip) run(tb testing.TB, k *fusetesting.FakeKernel) {
+	r, err := k.Call(rt.opcode, 2, rt.body...)
+	if err != nil || r.Error != 0 {
+		tb.Fatalf("Call(%d): %v, %v", rt.opcode, err, r.Error)
+	}
+}
+
+func TestAllocBudget_ReadFile(t *testing.T) {
+	k := newNopKernel(t)
+
+	rt := readRoundTrip()
+	fusetesting.CheckAllocBudget(t, "ReadFile", readFileAllocBudget, func() {
+		rt.run(t, k)
+	})
+}
+
+func TestAllocBudget_WriteFile(t *testing.T) {
+	k := newNopKernel(t)
+
+	rt := writeRoundTrip()
+	fusetesting.CheckAllocBudget(t, "WriteFile", writeFileAllocBudget, func() {
+		rt.run(t, k)
+	})
+}
+
+func benchmarkRoundTrip(b *testing.B, rt roundTrip) {
+	k := newNopKernel(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		rt.run(b, k)
+	}
+}
+
+func BenchmarkReadFileRoundTrip(b *testing.B) {
+	benchmarkRoundTrip(b, readRoundTrip())
+}
+
+func BenchmarkWriteFileRoundTrip(b *testing.B) {
+	benchmarkRoundTrip(b, writeRoundTrip())
+}
@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A forget fanned out from a batch for cfg.SplitBatchForgets, waiting to be
+// returned by ReadOp.
+type splitForget struct {
+	// A copy of the batch's header, made to look like that of a forget for the
+	// entry's inode.
+	header fusekernel.InHeader
+
+	op       *fuseops.ForgetInodeOp
+	readTime time.Time
+}
+
+// Release the message that a batch of forgets arrived in, and queue a
+// ForgetInodeOp for each of its entries.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) splitBatchForget(
+	inMsg *buffer.InMessage,
+	outMsg *buffer.OutMessage,
+	op *fuseops.BatchForgetOp,
+	readTime time.Time) {
+	h := *inMsg.Header()
+	h.Opcode = fusekernel.OpForget
+
+	// The kernel expects no reply, and the entries have been copied out of the
+	// message.
+	c.putOutMessage(outMsg)
+	c.putInMessage(inMsg)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range op.Entries {
+		f := splitForget{
+			header: h,
+			op: &fuseops.ForgetInodeOp{
+				Inode:     e.Inode,
+				N:         e.N,
+				OpContext: op.OpContext,
+			},
+			readTime: readTime,
+		}
+
+		f.header.Nodeid = uint64(e.Inode)
+		c.splitForgets = append(c.splitForgets, f)
+	}
+}
+
+// Return the next queued forget from a batch, along with a context with
+// which to reply to it, or false if there are none.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) nextSplitForget() (context.Context, interface{}, bool) {
+	c.mu.Lock()
+	if len(c.splitForgets) == 0 {
+		c.mu.Unlock()
+		return nil, nil, false
+	}
+
+	f := c.splitForgets[0]
+	c.splitForgets[0] = splitForget{}
+	c.splitForgets = c.splitForgets[1:]
+	c.mu.Unlock()
+
+	// Forgets share the batch's request ID, but beginOp records nothing under
+	// it for them.
+	ctx := c.beginOp(f.header.Opcode, f.header.Unique, opState{
+		outMsg:      c.getOutMessage(),
+		op:          f.op,
+		readTime:    f.readTime,
+		inodeData:   c.inodeData,
+		batchHeader: &f.header,
+	})
+
+	return ctx, f.op, true
+}
@@ -0,0 +1,49 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bazilfs adapts file systems written against bazil.org/fuse/fs to
+// the fuseutil.FileSystem interface, so that they can be served by this
+// library without being rewritten first:
+//
+//	fs, err := bazilfs.NewFileSystem(myBazilFS)
+//	if err != nil {
+//		// ...
+//	}
+//
+//	server := fuseutil.NewFileSystemServer(fs)
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+//
+// The adapter keeps the table of nodes and handles that bazil's fs.Server
+// would otherwise keep, and translates each op into the request that bazil
+// would have passed to the corresponding Node or Handle method. This allows a
+// file system to be migrated incrementally: it can be served through the
+// adapter first, and then have a fuseutil.FileSystem that embeds the adapter
+// take over individual ops from it as they are rewritten against fuseops.
+//
+// Some differences from bazil's own server are unavoidable:
+//
+//   - Requests carry only the fields that fuseops exposes. In particular
+//     Header.Gid and Header.Conn are always zero, and CreateRequest.Flags is
+//     always O_RDWR|O_CREAT since CreateFileOp doesn't carry the open flags.
+//
+//   - The inode numbers that nodes report in fuse.Attr.Inode are ignored; the
+//     kernel sees the IDs that the adapter assigns to nodes instead. Dirents
+//     returned by ReadDirAll keep their inode numbers.
+//
+//   - Like bazil's server, the adapter uses nodes as map keys, so they must be
+//     comparable. Pointers are the usual choice.
+//
+//   - Requests that have no equivalent in fuseops, such as access(2) checks,
+//     interrupts, and file locks, are never delivered.
+package bazilfs
@@ -0,0 +1,1195 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazilfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	bfs "bazil.org/fuse/fs"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The defaults that bazil's server applies before asking a node for its
+// attributes or looking up a child.
+const (
+	attrValidTime  = 1 * time.Minute
+	entryValidTime = 1 * time.Minute
+)
+
+// Reported as the times of nodes that don't set them, as bazil does.
+var startTime = time.Now()
+
+// NewFileSystem returns a file system that serves the supplied bazil file
+// system, calling its Root method once up front. See the package
+// documentation for details.
+func NewFileSystem(fsys bfs.FS) (fuseutil.FileSystem, error) {
+	root, err := fsys.Root()
+	if err != nil {
+		return nil, fmt.Errorf("Root: %w", err)
+	}
+
+	fs := &fileSystem{
+		fs:         fsys,
+		inodes:     make(map[fuseops.InodeID]*inode),
+		ids:        make(map[bfs.Node]fuseops.InodeID),
+		nextInode:  fuseops.RootInodeID + 1,
+		nextHandle: 1,
+	}
+
+	// The kernel never forgets the root, so it starts out with a lookup that is
+	// never returned.
+	fs.inodes[fuseops.RootInodeID] = &inode{node: root, lookups: 1}
+	fs.ids[root] = fuseops.RootInodeID
+
+	return fs, nil
+}
+
+// A node that the kernel knows about.
+type inode struct {
+	node bfs.Node
+
+	// The number of lookups the kernel hasn't yet forgotten.
+	lookups uint64
+}
+
+// A handle opened on a node, attached to the op that opened it as its
+// HandleData.
+type handle struct {
+	h     bfs.Handle
+	inode fuseops.InodeID
+
+	mu sync.Mutex
+
+	// The results of HandleReadAller.ReadAll and HandleReadDirAller.ReadDirAll,
+	// cached as bazil does, or nil if not yet read.
+	//
+	// GUARDED_BY(mu)
+	data    []byte
+	dirents []fuse.Dirent
+}
+
+type fileSystem struct {
+	fuseutil.NotImplementedFileSystem
+
+	fs bfs.FS
+
+	mu sync.Mutex
+
+	// The nodes that the kernel knows about, by ID and by identity.
+	//
+	// INVARIANT: For each k, v in inodes, ids[v.node] == k
+	// INVARIANT: len(ids) == len(inodes)
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inode
+	ids    map[bfs.Node]fuseops.InodeID
+
+	// The next inode and handle IDs to hand out. IDs aren't reused.
+	//
+	// GUARDED_BY(mu)
+	nextInode  fuseops.InodeID
+	nextHandle fuseops.HandleID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Convert an error returned by the bazil file system to one that package fuse
+// understands. bazil's fuse.Errno is a distinct type from syscall.Errno.
+func convertError(err error) error {
+	var errno fuse.ErrorNumber
+	if errors.As(err, &errno) {
+		return syscall.Errno(errno.Errno())
+	}
+
+	return err
+}
+
+func header(oc *fuseops.OpContext, inode fuseops.InodeID) fuse.Header {
+	return fuse.Header{
+		Node: fuse.NodeID(inode),
+		Uid:  oc.Uid,
+		Gid:  oc.Gid,
+		Pid:  oc.Pid,
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) node(id fuseops.InodeID) (bfs.Node, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	in, ok := fs.inodes[id]
+	if !ok {
+		return nil, syscall.ESTALE
+	}
+
+	return in.node, nil
+}
+
+// Find the handle attached to an op as its HandleData.
+func handleFor(data interface{}) (*handle, error) {
+	h, ok := data.(*handle)
+	if !ok {
+		return nil, syscall.ESTALE
+	}
+
+	return h, nil
+}
+
+// Mint a handle for a node, returning its ID.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) newHandle(
+	h bfs.Handle,
+	inode fuseops.InodeID) (fuseops.HandleID, *handle) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id := fs.nextHandle
+	fs.nextHandle++
+
+	return id, &handle{h: h, inode: inode}
+}
+
+// Fill in attributes for a node the way bazil's server does, applying its
+// defaults unless the node implements NodeGetattrer.
+func nodeAttr(
+	ctx context.Context,
+	hdr fuse.Header,
+	n bfs.Node) (attr fuse.Attr, err error) {
+	if g, ok := n.(bfs.NodeGetattrer); ok {
+		var resp fuse.GetattrResponse
+		err = g.Getattr(ctx, &fuse.GetattrRequest{Header: hdr}, &resp)
+		attr = resp.Attr
+		return
+	}
+
+	attr = fuse.Attr{
+		Valid:  attrValidTime,
+		Nlink:  1,
+		Atime:  startTime,
+		Mtime:  startTime,
+		Ctime:  startTime,
+		Crtime: startTime,
+	}
+
+	err = n.Attr(ctx, &attr)
+	return
+}
+
+func convertAttr(attr *fuse.Attr) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:   attr.Size,
+		Nlink:  attr.Nlink,
+		Mode:   attr.Mode,
+		Rdev:   attr.Rdev,
+		Atime:  attr.Atime,
+		Mtime:  attr.Mtime,
+		Ctime:  attr.Ctime,
+		Crtime: attr.Crtime,
+		Uid:    attr.Uid,
+		Gid:    attr.Gid,
+	}
+}
+
+// Record a lookup of the supplied node returned by an entry op, and fill in
+// the entry for it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) saveLookup(
+	ctx context.Context,
+	hdr fuse.Header,
+	n bfs.Node,
+	resp *fuse.LookupResponse,
+	e *fuseops.ChildInodeEntry) error {
+	attr, err := nodeAttr(ctx, hdr, n)
+	if err != nil {
+		return convertError(err)
+	}
+
+	fs.mu.Lock()
+	id, ok := fs.ids[n]
+	if !ok {
+		id = fs.nextInode
+		fs.nextInode++
+		fs.ids[n] = id
+		fs.inodes[id] = &inode{node: n}
+	}
+
+	fs.inodes[id].lookups++
+	fs.mu.Unlock()
+
+	now := time.Now()
+	e.Child = id
+	e.Generation = fuseops.GenerationNumber(resp.Generation)
+	e.Attributes = convertAttr(&attr)
+	e.AttributesExpiration = now.Add(attr.Valid)
+	e.EntryExpiration = now.Add(resp.EntryValid)
+
+	return nil
+}
+
+// Drop n lookups of the supplied inode, telling the node once the kernel has
+// forgotten it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) forget(id fuseops.InodeID, n uint64) {
+	fs.mu.Lock()
+	in, ok := fs.inodes[id]
+	if !ok || id == fuseops.RootInodeID {
+		fs.mu.Unlock()
+		return
+	}
+
+	if n < in.lookups {
+		in.lookups -= n
+		fs.mu.Unlock()
+		return
+	}
+
+	delete(fs.inodes, id)
+	delete(fs.ids, in.node)
+	fs.mu.Unlock()
+
+	if f, ok := in.node.(bfs.NodeForgetter); ok {
+		f.Forget()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// File system
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	s, ok := fs.fs.(bfs.FSStatfser)
+	if !ok {
+		return nil
+	}
+
+	req := &fuse.StatfsRequest{
+		Header: fuse.Header{Node: fuse.NodeID(fuseops.RootInodeID)},
+	}
+
+	var resp fuse.StatfsResponse
+	if err := s.Statfs(ctx, req, &resp); err != nil {
+		return convertError(err)
+	}
+
+	op.BlockSize = resp.Frsize
+	if op.BlockSize == 0 {
+		op.BlockSize = resp.Bsize
+	}
+
+	op.Blocks = resp.Blocks
+	op.BlocksFree = resp.Bfree
+	op.BlocksAvailable = resp.Bavail
+	op.IoSize = resp.Bsize
+	op.Inodes = resp.Files
+	op.InodesFree = resp.Ffree
+
+	return nil
+}
+
+func (fs *fileSystem) Destroy() {
+	if d, ok := fs.fs.(bfs.FSDestroyer); ok {
+		d.Destroy()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	resp := &fuse.LookupResponse{EntryValid: entryValidTime}
+
+	var child bfs.Node
+	switch p := parent.(type) {
+	case bfs.NodeStringLookuper:
+		child, err = p.Lookup(ctx, op.Name)
+
+	case bfs.NodeRequestLookuper:
+		req := &fuse.LookupRequest{Header: hdr, Name: op.Name}
+		child, err = p.Lookup(ctx, req, resp)
+
+	default:
+		return syscall.ENOENT
+	}
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	return fs.saveLookup(ctx, hdr, child, resp, &op.Entry)
+}
+
+func (fs *fileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	attr, err := nodeAttr(ctx, header(&op.OpContext, op.Inode), n)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Attributes = convertAttr(&attr)
+	op.AttributesExpiration = time.Now().Add(attr.Valid)
+
+	return nil
+}
+
+func (fs *fileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	hdr := header(&op.OpContext, op.Inode)
+	if s, ok := n.(bfs.NodeSetattrer); ok {
+		req := &fuse.SetattrRequest{Header: hdr}
+		if op.Handle != nil {
+			req.Valid |= fuse.SetattrHandle
+			req.Handle = fuse.HandleID(*op.Handle)
+		}
+
+		if op.Size != nil {
+			req.Valid |= fuse.SetattrSize
+			req.Size = *op.Size
+		}
+
+		if op.Mode != nil {
+			req.Valid |= fuse.SetattrMode
+			req.Mode = *op.Mode
+		}
+
+		if op.Uid != nil {
+			req.Valid |= fuse.SetattrUid
+			req.Uid = *op.Uid
+		}
+
+		if op.Gid != nil {
+			req.Valid |= fuse.SetattrGid
+			req.Gid = *op.Gid
+		}
+
+		if op.Atime != nil {
+			req.Valid |= fuse.SetattrAtime
+			req.Atime = *op.Atime
+		}
+
+		if op.Mtime != nil {
+			req.Valid |= fuse.SetattrMtime
+			req.Mtime = *op.Mtime
+		}
+
+		var resp fuse.SetattrResponse
+		if err := s.Setattr(ctx, req, &resp); err != nil {
+			return convertError(err)
+		}
+	}
+
+	// Like bazil's server, respond with the node's attributes as they are now
+	// rather than trusting the response.
+	attr, err := nodeAttr(ctx, hdr, n)
+	if err != nil {
+		return convertError(err)
+	}
+
+	op.Attributes = convertAttr(&attr)
+	op.AttributesExpiration = time.Now().Add(attr.Valid)
+
+	return nil
+}
+
+func (fs *fileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// As with bazil's server, nodes without their own checks allow everything.
+	a, ok := n.(bfs.NodeAccesser)
+	if !ok {
+		return nil
+	}
+
+	err = a.Access(ctx, &fuse.AccessRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Mask:   op.Mask,
+	})
+
+	return convertError(err)
+}
+
+func (fs *fileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.forget(op.Inode, op.N)
+	return nil
+}
+
+func (fs *fileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.forget(e.Inode, e.N)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	m, ok := parent.(bfs.NodeMkdirer)
+	if !ok {
+		return syscall.EPERM
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	child, err := m.Mkdir(ctx, &fuse.MkdirRequest{
+		Header: hdr,
+		Name:   op.Name,
+		Mode:   op.Mode,
+	})
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	resp := &fuse.LookupResponse{EntryValid: entryValidTime}
+	return fs.saveLookup(ctx, hdr, child, resp, &op.Entry)
+}
+
+func (fs *fileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	m, ok := parent.(bfs.NodeMknoder)
+	if !ok {
+		return syscall.EIO
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	child, err := m.Mknod(ctx, &fuse.MknodRequest{
+		Header: hdr,
+		Name:   op.Name,
+		Mode:   op.Mode,
+		Rdev:   op.Rdev,
+	})
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	resp := &fuse.LookupResponse{EntryValid: entryValidTime}
+	return fs.saveLookup(ctx, hdr, child, resp, &op.Entry)
+}
+
+func (fs *fileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	// As with bazil's server, returning ENOSYS here would make the kernel fall
+	// back to mknod and open.
+	c, ok := parent.(bfs.NodeCreater)
+	if !ok {
+		return syscall.EPERM
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	req := &fuse.CreateRequest{
+		Header: hdr,
+		Name:   op.Name,
+		Flags:  fuse.OpenReadWrite | fuse.OpenCreate,
+		Mode:   op.Mode,
+	}
+
+	resp := &fuse.CreateResponse{}
+	resp.EntryValid = entryValidTime
+
+	child, h, err := c.Create(ctx, req, resp)
+	if err != nil {
+		return convertError(err)
+	}
+
+	err = fs.saveLookup(ctx, hdr, child, &resp.LookupResponse, &op.Entry)
+	if err != nil {
+		return err
+	}
+
+	op.UseDirectIO = resp.Flags&fuse.OpenDirectIO != 0
+	op.NonSeekable = resp.Flags&fuse.OpenNonSeekable != 0
+	op.Handle, op.HandleData = fs.newHandle(h, op.Entry.Child)
+	return nil
+}
+
+func (fs *fileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	s, ok := parent.(bfs.NodeSymlinker)
+	if !ok {
+		return syscall.EIO
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	child, err := s.Symlink(ctx, &fuse.SymlinkRequest{
+		Header:  hdr,
+		NewName: op.Name,
+		Target:  op.Target,
+	})
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	resp := &fuse.LookupResponse{EntryValid: entryValidTime}
+	return fs.saveLookup(ctx, hdr, child, resp, &op.Entry)
+}
+
+func (fs *fileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	parent, err := fs.node(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	old, err := fs.node(op.Target)
+	if err != nil {
+		return err
+	}
+
+	l, ok := parent.(bfs.NodeLinker)
+	if !ok {
+		return syscall.EIO
+	}
+
+	hdr := header(&op.OpContext, op.Parent)
+	child, err := l.Link(ctx, &fuse.LinkRequest{
+		Header:  hdr,
+		OldNode: fuse.NodeID(op.Target),
+		NewName: op.Name,
+	}, old)
+
+	if err != nil {
+		return convertError(err)
+	}
+
+	resp := &fuse.LookupResponse{EntryValid: entryValidTime}
+	return fs.saveLookup(ctx, hdr, child, resp, &op.Entry)
+}
+
+func (fs *fileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	parent, err := fs.node(op.OldParent)
+	if err != nil {
+		return err
+	}
+
+	newDir, err := fs.node(op.NewParent)
+	if err != nil {
+		return err
+	}
+
+	r, ok := parent.(bfs.NodeRenamer)
+	if !ok {
+		return syscall.EIO
+	}
+
+	err = r.Rename(ctx, &fuse.RenameRequest{
+		Header:  header(&op.OpContext, op.OldParent),
+		NewDir:  fuse.NodeID(op.NewParent),
+		OldName: op.OldName,
+		NewName: op.NewName,
+	}, newDir)
+
+	return convertError(err)
+}
+
+// Remove a child with NodeRemover, for both RmDirOp and UnlinkOp.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) remove(
+	ctx context.Context,
+	oc *fuseops.OpContext,
+	parentID fuseops.InodeID,
+	name string,
+	dir bool) error {
+	parent, err := fs.node(parentID)
+	if err != nil {
+		return err
+	}
+
+	r, ok := parent.(bfs.NodeRemover)
+	if !ok {
+		return syscall.EIO
+	}
+
+	err = r.Remove(ctx, &fuse.RemoveRequest{
+		Header: header(oc, parentID),
+		Name:   name,
+		Dir:    dir,
+	})
+
+	return convertError(err)
+}
+
+func (fs *fileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return fs.remove(ctx, &op.OpContext, op.Parent, op.Name, true)
+}
+
+func (fs *fileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fs.remove(ctx, &op.OpContext, op.Parent, op.Name, false)
+}
+
+func (fs *fileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	r, ok := n.(bfs.NodeReadlinker)
+	if !ok {
+		return syscall.EIO
+	}
+
+	op.Target, err = r.Readlink(ctx, &fuse.ReadlinkRequest{
+		Header: header(&op.OpContext, op.Inode),
+	})
+
+	return convertError(err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handles
+////////////////////////////////////////////////////////////////////////
+
+// Open a node with NodeOpener, or use the node itself as its handle if it
+// doesn't implement it.
+func open(
+	ctx context.Context,
+	n bfs.Node,
+	req *fuse.OpenRequest) (bfs.Handle, fuse.OpenResponseFlags, error) {
+	o, ok := n.(bfs.NodeOpener)
+	if !ok {
+		return n, 0, nil
+	}
+
+	var resp fuse.OpenResponse
+	h, err := o.Open(ctx, req, &resp)
+	if err != nil {
+		return nil, 0, convertError(err)
+	}
+
+	return h, resp.Flags, nil
+}
+
+func (fs *fileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	h, flags, err := open(ctx, n, &fuse.OpenRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Dir:    true,
+		Flags:  fuse.OpenReadOnly | fuse.OpenDirectory,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	op.KeepCache = flags&fuse.OpenKeepCache != 0
+	op.Handle, op.HandleData = fs.newHandle(h, op.Inode)
+
+	return nil
+}
+
+func (fs *fileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	r, ok := h.h.(bfs.HandleReadDirAller)
+	if !ok {
+		return syscall.EIO
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Like bazil's server, treat reading from the start as a rewinddir(3) and
+	// refresh the entries.
+	if op.Offset == 0 || h.dirents == nil {
+		dirents, err := r.ReadDirAll(ctx)
+		if err != nil {
+			return convertError(err)
+		}
+
+		if dirents == nil {
+			dirents = []fuse.Dirent{}
+		}
+
+		h.dirents = dirents
+	}
+
+	list := func(
+		offset fuseops.DirOffset,
+		emit func(fuseutil.Dirent) bool) error {
+		for i := int(offset); i < len(h.dirents); i++ {
+			d := h.dirents[i]
+			if d.Inode == 0 {
+				d.Inode = bfs.GenerateDynamicInode(uint64(h.inode), d.Name)
+			}
+
+			if !emit(fuseutil.Dirent{
+				Offset: fuseops.DirOffset(i + 1),
+				Inode:  fuseops.InodeID(d.Inode),
+				Name:   d.Name,
+				Type:   fuseutil.DirentType(d.Type),
+			}) {
+				break
+			}
+		}
+
+		return nil
+	}
+
+	return fuseutil.ServeReadDir(op, list)
+}
+
+func (fs *fileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	// As with bazil's server, directories that can't be sync'd tell the kernel
+	// to stop asking.
+	s, ok := n.(bfs.NodeFsyncer)
+	if !ok {
+		return syscall.ENOSYS
+	}
+
+	req := &fuse.FsyncRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Handle: fuse.HandleID(op.Handle),
+		Dir:    true,
+	}
+
+	if op.DataSync {
+		req.Flags = 1
+	}
+
+	return convertError(s.Fsync(ctx, req))
+}
+
+func (fs *fileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	return h.release(ctx, &op.OpContext, op.Handle, true)
+}
+
+func (fs *fileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	h, flags, err := open(ctx, n, &fuse.OpenRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Flags:  fuse.OpenFlags(op.OpenFlags),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	op.UseDirectIO = flags&fuse.OpenDirectIO != 0
+	op.KeepPageCache = flags&fuse.OpenKeepCache != 0
+	op.NonSeekable = flags&fuse.OpenNonSeekable != 0
+	op.Handle, op.HandleData = fs.newHandle(h, op.Inode)
+
+	return nil
+}
+
+func (fs *fileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	if r, ok := h.h.(bfs.HandleReadAller); ok {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		if h.data == nil {
+			data, err := r.ReadAll(ctx)
+			if err != nil {
+				return convertError(err)
+			}
+
+			if data == nil {
+				data = []byte{}
+			}
+
+			h.data = data
+		}
+
+		return fuseutil.ServeReadAt(op, bytes.NewReader(h.data))
+	}
+
+	r, ok := h.h.(bfs.HandleReader)
+	if !ok {
+		return syscall.EIO
+	}
+
+	// Let the handle read straight into the destination buffer where there is
+	// one, as bazil's handles expect to append to resp.Data.
+	resp := &fuse.ReadResponse{}
+	if op.Dst != nil {
+		resp.Data = op.Dst[:0]
+	} else {
+		resp.Data = make([]byte, 0, op.Size)
+	}
+
+	req := &fuse.ReadRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Handle: fuse.HandleID(op.Handle),
+		Offset: op.Offset,
+		Size:   int(op.Size),
+	}
+
+	if err := r.Read(ctx, req, resp); err != nil {
+		return convertError(err)
+	}
+
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, resp.Data)
+	} else {
+		op.Data = [][]byte{resp.Data}
+		op.BytesRead = len(resp.Data)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	w, ok := h.h.(bfs.HandleWriter)
+	if !ok {
+		return syscall.EIO
+	}
+
+	data := op.Data
+	if data == nil && op.Reader != nil {
+		if data, err = io.ReadAll(op.Reader); err != nil {
+			return fmt.Errorf("ReadAll: %w", err)
+		}
+
+		if op.Release != nil {
+			op.Release()
+		}
+	}
+
+	req := &fuse.WriteRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Handle: fuse.HandleID(op.Handle),
+		Offset: op.Offset,
+		Data:   data,
+	}
+
+	var resp fuse.WriteResponse
+	if err := w.Write(ctx, req, &resp); err != nil {
+		return convertError(err)
+	}
+
+	op.BytesWritten = resp.Size
+	return nil
+}
+
+func (fs *fileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	s, ok := n.(bfs.NodeFsyncer)
+	if !ok {
+		return syscall.EIO
+	}
+
+	req := &fuse.FsyncRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Handle: fuse.HandleID(op.Handle),
+	}
+
+	if op.DataSync {
+		req.Flags = 1
+	}
+
+	return convertError(s.Fsync(ctx, req))
+}
+
+func (fs *fileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	f, ok := h.h.(bfs.HandleFlusher)
+	if !ok {
+		return nil
+	}
+
+	err = f.Flush(ctx, &fuse.FlushRequest{
+		Header:    header(&op.OpContext, op.Inode),
+		Handle:    fuse.HandleID(op.Handle),
+		LockOwner: op.LockOwner,
+	})
+
+	return convertError(err)
+}
+
+func (fs *fileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	h, err := handleFor(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	return h.release(ctx, &op.OpContext, op.Handle, false)
+}
+
+func (h *handle) release(
+	ctx context.Context,
+	oc *fuseops.OpContext,
+	id fuseops.HandleID,
+	dir bool) error {
+	r, ok := h.h.(bfs.HandleReleaser)
+	if !ok {
+		return nil
+	}
+
+	err := r.Release(ctx, &fuse.ReleaseRequest{
+		Header: header(oc, h.inode),
+		Dir:    dir,
+		Handle: fuse.HandleID(id),
+	})
+
+	return convertError(err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+// Copy an attribute value or list into an op's destination buffer, or report
+// its size if the buffer is empty.
+func serveXattr(dst []byte, value []byte) (int, error) {
+	if len(dst) == 0 {
+		return len(value), nil
+	}
+
+	if len(value) > len(dst) {
+		return len(value), syscall.ERANGE
+	}
+
+	return copy(dst, value), nil
+}
+
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	g, ok := n.(bfs.NodeGetxattrer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	req := &fuse.GetxattrRequest{
+		Header:   header(&op.OpContext, op.Inode),
+		Size:     uint32(len(op.Dst)),
+		Name:     op.Name,
+		Position: op.Position,
+	}
+
+	var resp fuse.GetxattrResponse
+	if err := g.Getxattr(ctx, req, &resp); err != nil {
+		return convertError(err)
+	}
+
+	op.BytesRead, err = serveXattr(op.Dst, resp.Xattr)
+	return err
+}
+
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	l, ok := n.(bfs.NodeListxattrer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	req := &fuse.ListxattrRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Size:   uint32(len(op.Dst)),
+	}
+
+	var resp fuse.ListxattrResponse
+	if err := l.Listxattr(ctx, req, &resp); err != nil {
+		return convertError(err)
+	}
+
+	op.BytesRead, err = serveXattr(op.Dst, resp.Xattr)
+	return err
+}
+
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	s, ok := n.(bfs.NodeSetxattrer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	err = s.Setxattr(ctx, &fuse.SetxattrRequest{
+		Header:   header(&op.OpContext, op.Inode),
+		Flags:    op.Flags,
+		Position: op.Position,
+		Name:     op.Name,
+		Xattr:    op.Value,
+	})
+
+	return convertError(err)
+}
+
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	n, err := fs.node(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	r, ok := n.(bfs.NodeRemovexattrer)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	err = r.Removexattr(ctx, &fuse.RemovexattrRequest{
+		Header: header(&op.OpContext, op.Inode),
+		Name:   op.Name,
+	})
+
+	return convertError(err)
+}
@@ -0,0 +1,201 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bazilfs_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"bazil.org/fuse"
+	bfs "bazil.org/fuse/fs"
+	"github.com/jacobsa/fuse/bazilfs"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A bazil file system with a single file, "hello".
+type helloFS struct {
+	file *helloFile
+}
+
+func (fs *helloFS) Root() (bfs.Node, error) {
+	return &helloDir{file: fs.file}, nil
+}
+
+type helloDir struct {
+	file *helloFile
+}
+
+func (d *helloDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *helloDir) Lookup(ctx context.Context, name string) (bfs.Node, error) {
+	if name == "hello" {
+		return d.file, nil
+	}
+
+	return nil, fuse.ENOENT
+}
+
+func (d *helloDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	return []fuse.Dirent{{Name: "hello", Type: fuse.DT_File}}, nil
+}
+
+const helloContents = "Hello, world!"
+
+type helloFile struct {
+	forgotten bool
+}
+
+func (f *helloFile) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	a.Size = uint64(len(helloContents))
+	return nil
+}
+
+func (f *helloFile) ReadAll(ctx context.Context) ([]byte, error) {
+	return []byte(helloContents), nil
+}
+
+func (f *helloFile) Forget() {
+	f.forgotten = true
+}
+
+func TestFileSystem(t *testing.T) {
+	ctx := context.Background()
+	file := &helloFile{}
+	fs, err := bazilfs.NewFileSystem(&helloFS{file: file})
+	if err != nil {
+		t.Fatalf("NewFileSystem: %v", err)
+	}
+
+	// Looking up the file twice yields the same inode both times.
+	var child fuseops.InodeID
+	for i := 0; i < 2; i++ {
+		op := &fuseops.LookUpInodeOp{Parent: fuseops.RootInodeID, Name: "hello"}
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+
+		if child != 0 && op.Entry.Child != child {
+			t.Errorf("got inode %d, then %d", child, op.Entry.Child)
+		}
+
+		child = op.Entry.Child
+		if op.Entry.Attributes.Size != uint64(len(helloContents)) {
+			t.Errorf("got size %d", op.Entry.Attributes.Size)
+		}
+
+		if op.Entry.Attributes.Nlink != 1 {
+			t.Errorf("got nlink %d, want bazil's default of 1", op.Entry.Attributes.Nlink)
+		}
+	}
+
+	if child == fuseops.RootInodeID {
+		t.Errorf("child has the root's inode ID")
+	}
+
+	// bazil's errnos come through as syscall.Errno.
+	err = fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "missing",
+	})
+
+	if err != syscall.ENOENT {
+		t.Errorf("got error %v for missing name, want ENOENT", err)
+	}
+
+	// Read the file through a handle.
+	openOp := &fuseops.OpenFileOp{Inode: child}
+	if err := fs.OpenFile(ctx, openOp); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:      child,
+		Handle:     openOp.Handle,
+		HandleData: openOp.HandleData,
+		Offset:     7,
+		Size:       100,
+		Dst:        make([]byte, 100),
+	}
+
+	if err := fs.ReadFile(ctx, readOp); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(readOp.Dst[:readOp.BytesRead]); got != "world!" {
+		t.Errorf("read %q", got)
+	}
+
+	err = fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+		Handle:     openOp.Handle,
+		HandleData: openOp.HandleData,
+	})
+
+	if err != nil {
+		t.Errorf("ReleaseFileHandle: %v", err)
+	}
+
+	// Read the directory, whose entry has a dynamic inode number.
+	openDirOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	if err := fs.OpenDir(ctx, openDirOp); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDirOp := &fuseops.ReadDirOp{
+		Inode:      fuseops.RootInodeID,
+		Handle:     openDirOp.Handle,
+		HandleData: openDirOp.HandleData,
+		Dst:        make([]byte, 1024),
+	}
+
+	if err := fs.ReadDir(ctx, readDirOp); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var want [64]byte
+	n := fuseutil.WriteDirent(want[:], fuseutil.Dirent{
+		Offset: 1,
+		Inode:  fuseops.InodeID(bfs.GenerateDynamicInode(1, "hello")),
+		Name:   "hello",
+		Type:   fuseutil.DT_File,
+	})
+
+	if got := readDirOp.Dst[:readDirOp.BytesRead]; string(got) != string(want[:n]) {
+		t.Errorf("got dirents %v, want %v", got, want[:n])
+	}
+
+	// The node is told once the kernel forgets both lookups, and its inode ID
+	// goes stale.
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: child, N: 1})
+	if file.forgotten {
+		t.Errorf("forgotten after one of two lookups")
+	}
+
+	fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: child, N: 1})
+	if !file.forgotten {
+		t.Errorf("not forgotten after both lookups")
+	}
+
+	err = fs.GetInodeAttributes(ctx, &fuseops.GetInodeAttributesOp{Inode: child})
+	if err != syscall.ESTALE {
+		t.Errorf("got error %v for forgotten inode, want ESTALE", err)
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/jacobsa/fuse/bazilfs
+
+go 1.20
+
+require (
+	bazil.org/fuse v0.0.0-20200117225306-7b5117fecadc
+	github.com/jacobsa/fuse v0.0.0
+)
+
+require (
+	github.com/jacobsa/oglematchers v0.0.0-20150720000706-141901ea67cd // indirect
+	github.com/jacobsa/timeutil v0.0.0-20170205232429-577e5acbbcf6 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+)
+
+replace github.com/jacobsa/fuse => ../
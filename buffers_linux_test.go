@@ -0,0 +1,291 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system that records the page offsets of the buffers it is handed.
+type alignmentFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu          sync.Mutex
+	readOffset  uintptr
+	writeOffset uintptr
+}
+
+func (fs *alignmentFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.readOffset = uintptr(unsafe.Pointer(&op.Dst[0])) % uintptr(os.Getpagesize())
+	op.BytesRead = copy(op.Dst, "taco")
+	return nil
+}
+
+func (fs *alignmentFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.writeOffset = uintptr(unsafe.Pointer(&op.Data[0])) % uintptr(os.Getpagesize())
+	return nil
+}
+
+func TestAlignBuffers(t *testing.T) {
+	fs := &alignmentFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{AlignBuffers: true},
+		&fusetesting.FakeKernelConfig{})
+
+	// Several of each, so that messages come from the freelist too.
+	for i := 0; i < 3; i++ {
+		read := fusekernel.ReadIn{Fh: 1, Size: 4096}
+		r, err := k.Call(
+			fusekernel.OpRead,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&read)), unsafe.Sizeof(read)))
+
+		if err != nil || r.Error != 0 || string(r.Body) != "taco" {
+			t.Fatalf("Read: %v, %v, %q", err, r.Error, r.Body)
+		}
+
+		write := fusekernel.WriteIn{Fh: 1, Size: 4}
+		r, err = k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&write)), unsafe.Sizeof(write)),
+			[]byte("taco"))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Write: %v, %v", err, r.Error)
+		}
+
+		fs.mu.Lock()
+		if fs.readOffset != 0 || fs.writeOffset != 0 {
+			t.Errorf("Unaligned buffers: read at %d, write at %d", fs.readOffset, fs.writeOffset)
+		}
+		fs.mu.Unlock()
+	}
+}
+
+// A file system that replies to reads with a slice per byte of its contents.
+type slicesFS struct {
+	fuseutil.NotImplementedFileSystem
+	contents []byte
+}
+
+func (fs *slicesFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	for i := range fs.contents {
+		op.Data = append(op.Data, fs.contents[i:i+1])
+	}
+
+	op.BytesRead = len(fs.contents)
+	return nil
+}
+
+func TestVectoredReplies(t *testing.T) {
+	// More slices than writev accepts at once.
+	fs := &slicesFS{contents: []byte(strings.Repeat("taco", 1000))}
+
+	// The slices are sent whether or not the file system was handed a buffer.
+	for _, vectored := range []bool{false, true} {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{
+				UseVectoredRead:   vectored,
+				ValidateResponses: true,
+			},
+			&fusetesting.FakeKernelConfig{})
+
+		read := fusekernel.ReadIn{Fh: 1, Size: 8192}
+		r, err := k.Call(
+			fusekernel.OpRead,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&read)), unsafe.Sizeof(read)))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("vectored %v: Read: %v, %v", vectored, err, r.Error)
+		}
+
+		if !bytes.Equal(r.Body, fs.contents) {
+			t.Errorf("vectored %v: read %d bytes, want %d", vectored, len(r.Body), len(fs.contents))
+		}
+	}
+}
+
+// A message provider that never reuses messages, and records which are in
+// use.
+type countingProvider struct {
+	mu  sync.Mutex
+	in  map[*fuse.InMessage]bool  // GUARDED_BY(mu)
+	out map[*fuse.OutMessage]bool // GUARDED_BY(mu)
+	put map[*fuse.InMessage]bool  // GUARDED_BY(mu)
+}
+
+func (p *countingProvider) GetInMessage() *fuse.InMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := fuse.NewInMessage()
+	p.in[m] = true
+	return m
+}
+
+func (p *countingProvider) PutInMessage(m *fuse.InMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.in, m)
+	p.put[m] = true
+}
+
+func (p *countingProvider) GetOutMessage() *fuse.OutMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m := fuse.NewOutMessage()
+	p.out[m] = true
+	return m
+}
+
+func (p *countingProvider) PutOutMessage(m *fuse.OutMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.out, m)
+}
+
+// A file system that keeps the data of writes without copying it.
+type keepingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	msgs []*fuse.InMessage
+	data [][]byte
+}
+
+func (fs *keepingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.msgs = append(fs.msgs, fuse.RequestMessage(ctx))
+	fs.data = append(fs.data, op.Data)
+	return nil
+}
+
+func TestMessageProvider(t *testing.T) {
+	p := &countingProvider{
+		in:  make(map[*fuse.InMessage]bool),
+		out: make(map[*fuse.OutMessage]bool),
+		put: make(map[*fuse.InMessage]bool),
+	}
+
+	fs := &keepingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{MessageProvider: p},
+		&fusetesting.FakeKernelConfig{})
+
+	for _, data := range []string{"taco", "burrito"} {
+		in := fusekernel.WriteIn{Fh: 1, Size: uint32(len(data))}
+		r, err := k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			[]byte(data))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+	}
+
+	// Messages are put back after the reply is sent, so may not have been
+	// yet. All but the one being read into should be.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		p.mu.Lock()
+		done := len(p.in) <= 1 && len(p.out) == 0
+		p.mu.Unlock()
+
+		if done {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// The messages were handed back, but as they weren't reused, the data is
+	// intact.
+	for i, m := range fs.msgs {
+		if !p.put[m] {
+			t.Errorf("Message %d not put back", i)
+		}
+	}
+
+	if len(fs.data) != 2 || string(fs.data[0]) != "taco" || string(fs.data[1]) != "burrito" {
+		t.Errorf("Kept data %q", fs.data)
+	}
+
+	if len(p.in) > 1 {
+		t.Errorf("%d messages in use", len(p.in))
+	}
+
+	if len(p.out) != 0 {
+		t.Errorf("%d replies outstanding", len(p.out))
+	}
+}
+
+func TestMessagesAreOpaque(t *testing.T) {
+	// A provider can only create messages and pass them around; the methods
+	// that a connection uses to fill them in aren't part of the API.
+	for _, m := range []interface{}{fuse.NewInMessage(), fuse.NewOutMessage()} {
+		if n := reflect.TypeOf(m).NumMethod(); n != 0 {
+			t.Errorf("%T has %d methods", m, n)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+////////////////////////////////////////////////////////////////////////
+// Framing
+////////////////////////////////////////////////////////////////////////
+
+// A request read by the daemon from /dev/fuse.
+type request struct {
+	header fusekernel.InHeader
+	body   []byte
+}
+
+// A reply or notification written by the daemon to /dev/fuse.
+type reply struct {
+	header fusekernel.OutHeader
+	body   []byte
+}
+
+const outHeaderSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+
+// Split a stream of requests into messages, using the length in each header.
+func splitRequests(data []byte) (reqs []request, err error) {
+	for off := 0; off < len(data); {
+		if len(data)-off < fusekernel.InHeaderSize {
+			return reqs, fmt.Errorf("Truncated request header at offset %d", off)
+		}
+
+		var r request
+		copyStruct(unsafe.Pointer(&r.header), unsafe.Sizeof(r.header), data[off:])
+
+		n := int(r.header.Len)
+		if n < fusekernel.InHeaderSize || n > len(data)-off {
+			return reqs, fmt.Errorf("Bad request length %d at offset %d", n, off)
+		}
+
+		r.body = data[off+fusekernel.InHeaderSize : off+n]
+		reqs = append(reqs, r)
+		off += n
+	}
+
+	return reqs, nil
+}
+
+// Split a stream of replies into messages, using the length in each header.
+func splitReplies(data []byte) (replies []reply, err error) {
+	for off := 0; off < len(data); {
+		if len(data)-off < outHeaderSize {
+			return replies, fmt.Errorf("Truncated reply header at offset %d", off)
+		}
+
+		var r reply
+		copyStruct(unsafe.Pointer(&r.header), unsafe.Sizeof(r.header), data[off:])
+
+		n := int(r.header.Len)
+		if n < outHeaderSize || n > len(data)-off {
+			return replies, fmt.Errorf("Bad reply length %d at offset %d", n, off)
+		}
+
+		r.body = data[off+outHeaderSize : off+n]
+		replies = append(replies, r)
+		off += n
+	}
+
+	return replies, nil
+}
+
+// Copy the prefix of b into the struct of the given size at p, leaving any
+// fields that b is too short to cover zeroed. Return the rest of b.
+func copyStruct(p unsafe.Pointer, size uintptr, b []byte) []byte {
+	n := copy(unsafe.Slice((*byte)(p), size), b)
+	return b[n:]
+}
+
+////////////////////////////////////////////////////////////////////////
+// Op names
+////////////////////////////////////////////////////////////////////////
+
+var opNames = map[uint32]string{
+	fusekernel.OpLookup:        "LOOKUP",
+	fusekernel.OpForget:        "FORGET",
+	fusekernel.OpGetattr:       "GETATTR",
+	fusekernel.OpSetattr:       "SETATTR",
+	fusekernel.OpReadlink:      "READLINK",
+	fusekernel.OpSymlink:       "SYMLINK",
+	fusekernel.OpMknod:         "MKNOD",
+	fusekernel.OpMkdir:         "MKDIR",
+	fusekernel.OpUnlink:        "UNLINK",
+	fusekernel.OpRmdir:         "RMDIR",
+	fusekernel.OpRename:        "RENAME",
+	fusekernel.OpLink:          "LINK",
+	fusekernel.OpOpen:          "OPEN",
+	fusekernel.OpRead:          "READ",
+	fusekernel.OpWrite:         "WRITE",
+	fusekernel.OpStatfs:        "STATFS",
+	fusekernel.OpRelease:       "RELEASE",
+	fusekernel.OpFsync:         "FSYNC",
+	fusekernel.OpSetxattr:      "SETXATTR",
+	fusekernel.OpGetxattr:      "GETXATTR",
+	fusekernel.OpListxattr:     "LISTXATTR",
+	fusekernel.OpRemovexattr:   "REMOVEXATTR",
+	fusekernel.OpFlush:         "FLUSH",
+	fusekernel.OpInit:          "INIT",
+	fusekernel.OpOpendir:       "OPENDIR",
+	fusekernel.OpReaddir:       "READDIR",
+	fusekernel.OpReleasedir:    "RELEASEDIR",
+	fusekernel.OpFsyncdir:      "FSYNCDIR",
+	fusekernel.OpGetlk:         "GETLK",
+	fusekernel.OpSetlk:         "SETLK",
+	fusekernel.OpSetlkw:        "SETLKW",
+	fusekernel.OpAccess:        "ACCESS",
+	fusekernel.OpCreate:        "CREATE",
+	fusekernel.OpInterrupt:     "INTERRUPT",
+	fusekernel.OpBmap:          "BMAP",
+	fusekernel.OpDestroy:       "DESTROY",
+	fusekernel.OpIoctl:         "IOCTL",
+	fusekernel.OpPoll:          "POLL",
+	fusekernel.OpNotifyReply:   "NOTIFY_REPLY",
+	fusekernel.OpBatchForget:   "BATCH_FORGET",
+	fusekernel.OpFallocate:     "FALLOCATE",
+	fusekernel.OpReaddirplus:   "READDIRPLUS",
+	fusekernel.OpLseek:         "LSEEK",
+	fusekernel.OpCopyFileRange: "COPY_FILE_RANGE",
+	fusekernel.OpSetupMapping:  "SETUPMAPPING",
+	fusekernel.OpRemoveMapping: "REMOVEMAPPING",
+	fusekernel.OpSyncFS:        "SYNCFS",
+}
+
+func opName(opcode uint32) string {
+	if name, ok := opNames[opcode]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("OPCODE_%d", opcode)
+}
+
+var notifyNames = map[int32]string{
+	fusekernel.NotifyCodePoll:       "NOTIFY_POLL",
+	fusekernel.NotifyCodeInvalInode: "NOTIFY_INVAL_INODE",
+	fusekernel.NotifyCodeInvalEntry: "NOTIFY_INVAL_ENTRY",
+	fusekernel.NotifyCodeStore:      "NOTIFY_STORE",
+	fusekernel.NotifyCodeRetrieve:   "NOTIFY_RETRIEVE",
+	fusekernel.NotifyCodeDelete:     "NOTIFY_DELETE",
+}
+
+////////////////////////////////////////////////////////////////////////
+// Decoding
+////////////////////////////////////////////////////////////////////////
+
+// A decoder turns messages into human-readable descriptions. Struct sizes in
+// some messages depend on the protocol version, which the decoder learns
+// from the init handshake.
+type decoder struct {
+	protocol fusekernel.Protocol
+}
+
+func newDecoder() *decoder {
+	return &decoder{
+		protocol: fusekernel.Protocol{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: fusekernel.ProtoVersionMaxMinor,
+		},
+	}
+}
+
+// Describe a struct of the given size at p, filled from the front of b, and
+// return the rest of b.
+func describeStruct(
+	w *strings.Builder,
+	label string,
+	v interface{},
+	p unsafe.Pointer,
+	size uintptr,
+	b []byte) []byte {
+	rest := copyStruct(p, size, b)
+	fmt.Fprintf(w, " %s=%+v", label, reflect.ValueOf(v).Elem())
+
+	if uintptr(len(b)) < size {
+		fmt.Fprintf(w, " <short %s: %d of %d bytes>", label, len(b), size)
+	}
+
+	return rest
+}
+
+// Split b into the NUL-terminated strings it contains, plus any trailing
+// bytes that are not terminated.
+func cStrings(b []byte) (strs []string, rest []byte) {
+	for {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return strs, b
+		}
+
+		strs = append(strs, string(b[:i]))
+		b = b[i+1:]
+	}
+}
+
+func describeNames(w *strings.Builder, labels []string, b []byte) {
+	strs, rest := cStrings(b)
+	for i, s := range strs {
+		label := "name"
+		if i < len(labels) {
+			label = labels[i]
+		}
+
+		fmt.Fprintf(w, " %s=%q", label, s)
+	}
+
+	if len(rest) > 0 {
+		fmt.Fprintf(w, " trailing=%q", rest)
+	}
+}
+
+func describeData(w *strings.Builder, b []byte) {
+	const maxShown = 32
+	if len(b) > maxShown {
+		fmt.Fprintf(w, " data=%q... (%d bytes)", b[:maxShown], len(b))
+		return
+	}
+
+	fmt.Fprintf(w, " data=%q", b)
+}
+
+// Describe a request, learning the protocol version from it if it's an init
+// request.
+func (d *decoder) describeRequest(r request) string {
+	var w strings.Builder
+	h := &r.header
+	fmt.Fprintf(
+		&w,
+		"[%d] %s node=%d uid=%d gid=%d pid=%d",
+		h.Unique,
+		opName(h.Opcode),
+		h.Nodeid,
+		h.Uid,
+		h.Gid,
+		h.Pid)
+
+	b := r.body
+	switch h.Opcode {
+	case fusekernel.OpLookup, fusekernel.OpUnlink, fusekernel.OpRmdir,
+		fusekernel.OpRemovexattr:
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpForget:
+		var in fusekernel.ForgetIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpBatchForget:
+		var in fusekernel.BatchForgetCountIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		for i := uint32(0); i < in.Count && len(b) > 0; i++ {
+			var e fusekernel.BatchForgetEntryIn
+			b = describeStruct(&w, "entry", &e, unsafe.Pointer(&e), unsafe.Sizeof(e), b)
+		}
+
+	case fusekernel.OpGetattr:
+		var in fusekernel.GetattrIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpSetattr:
+		var in fusekernel.SetattrIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpSymlink:
+		describeNames(&w, []string{"name", "target"}, b)
+
+	case fusekernel.OpMknod:
+		var in fusekernel.MknodIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.MknodInSize(d.protocol), b)
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpMkdir:
+		var in fusekernel.MkdirIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.MkdirInSize(d.protocol), b)
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpRename:
+		var in fusekernel.RenameIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		describeNames(&w, []string{"old", "new"}, b)
+
+	case fusekernel.OpLink:
+		var in fusekernel.LinkIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpOpen, fusekernel.OpOpendir:
+		var in fusekernel.OpenIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpRead, fusekernel.OpReaddir, fusekernel.OpReaddirplus:
+		var in fusekernel.ReadIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.ReadInSize(d.protocol), b)
+
+	case fusekernel.OpWrite:
+		var in fusekernel.WriteIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.WriteInSize(d.protocol), b)
+		describeData(&w, b)
+
+	case fusekernel.OpRelease, fusekernel.OpReleasedir:
+		var in fusekernel.ReleaseIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
+		var in fusekernel.FsyncIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpSetxattr:
+		var in fusekernel.SetxattrIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			fmt.Fprintf(&w, " name=%q", b[:i])
+			b = b[i+1:]
+		}
+
+		describeData(&w, b)
+
+	case fusekernel.OpGetxattr:
+		var in fusekernel.GetxattrIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpListxattr:
+		var in fusekernel.ListxattrIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpFlush:
+		var in fusekernel.FlushIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpInit:
+		var in fusekernel.InitIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		fmt.Fprintf(&w, " flags=%v", fusekernel.InitFlags(in.Flags))
+
+		d.protocol = fusekernel.Protocol{Major: in.Major, Minor: in.Minor}
+		max := fusekernel.Protocol{
+			Major: fusekernel.ProtoVersionMaxMajor,
+			Minor: fusekernel.ProtoVersionMaxMinor,
+		}
+
+		if max.LT(d.protocol) {
+			d.protocol = max
+		}
+
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		var in fusekernel.LkIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.LkInSize(d.protocol), b)
+
+	case fusekernel.OpAccess:
+		var in fusekernel.AccessIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpCreate:
+		var in fusekernel.CreateIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), fusekernel.CreateInSize(d.protocol), b)
+		describeNames(&w, nil, b)
+
+	case fusekernel.OpInterrupt:
+		var in fusekernel.InterruptIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpBmap:
+		var in fusekernel.BmapIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpFallocate:
+		var in fusekernel.FallocateIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpLseek:
+		var in fusekernel.LseekIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpIoctl:
+		var in fusekernel.IoctlIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		if len(b) > 0 {
+			describeData(&w, b)
+		}
+
+	case fusekernel.OpPoll:
+		var in fusekernel.PollIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpNotifyReply:
+		var in fusekernel.NotifyRetrieveIn
+		b = describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+		if len(b) > 0 {
+			describeData(&w, b)
+		}
+
+	case fusekernel.OpCopyFileRange:
+		var in fusekernel.CopyFileRangeIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	case fusekernel.OpSyncFS:
+		var in fusekernel.SyncFSIn
+		describeStruct(&w, "in", &in, unsafe.Pointer(&in), unsafe.Sizeof(in), b)
+
+	default:
+		if len(b) > 0 {
+			describeData(&w, b)
+		}
+	}
+
+	return w.String()
+}
+
+// Describe a reply to a request with the given opcode, or a notification if
+// the reply's unique ID is zero. opcode is zero if the request isn't known.
+func (d *decoder) describeReply(opcode uint32, r reply) string {
+	var w strings.Builder
+	h := &r.header
+
+	if h.Unique == 0 {
+		name, ok := notifyNames[h.Error]
+		if !ok {
+			name = fmt.Sprintf("NOTIFY_%d", h.Error)
+		}
+
+		fmt.Fprintf(&w, "[0] %s", name)
+		describeData(&w, r.body)
+		return w.String()
+	}
+
+	fmt.Fprintf(&w, "[%d] -> %s", h.Unique, opName(opcode))
+	if h.Error != 0 {
+		errno := syscall.Errno(-h.Error)
+		fmt.Fprintf(&w, " error=%d (%v)", -h.Error, errno)
+		if len(r.body) > 0 {
+			fmt.Fprintf(&w, " unexpected body of %d bytes", len(r.body))
+		}
+
+		return w.String()
+	}
+
+	b := r.body
+	switch opcode {
+	case fusekernel.OpLookup, fusekernel.OpMkdir, fusekernel.OpMknod,
+		fusekernel.OpSymlink, fusekernel.OpLink:
+		var out fusekernel.EntryOut
+		describeStruct(&w, "entry", &out, unsafe.Pointer(&out), fusekernel.EntryOutSize(d.protocol), b)
+
+	case fusekernel.OpGetattr, fusekernel.OpSetattr:
+		var out fusekernel.AttrOut
+		describeStruct(&w, "attr", &out, unsafe.Pointer(&out), fusekernel.AttrOutSize(d.protocol), b)
+
+	case fusekernel.OpCreate:
+		var entry fusekernel.EntryOut
+		var open fusekernel.OpenOut
+		b = describeStruct(&w, "entry", &entry, unsafe.Pointer(&entry), fusekernel.EntryOutSize(d.protocol), b)
+		describeStruct(&w, "open", &open, unsafe.Pointer(&open), unsafe.Sizeof(open), b)
+
+	case fusekernel.OpOpen, fusekernel.OpOpendir:
+		var out fusekernel.OpenOut
+		describeStruct(&w, "open", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpWrite, fusekernel.OpCopyFileRange:
+		var out fusekernel.WriteOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpLseek:
+		var out fusekernel.LseekOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpIoctl:
+		var out fusekernel.IoctlOut
+		b = describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+		if out.Flags&fusekernel.IoctlRetry == 0 {
+			if len(b) > 0 {
+				describeData(&w, b)
+			}
+
+			break
+		}
+
+		// The regions to retry with follow, those to copy in first.
+		for len(b) > 0 {
+			var iov fusekernel.IoctlIovec
+			b = describeStruct(&w, "iov", &iov, unsafe.Pointer(&iov), unsafe.Sizeof(iov), b)
+		}
+
+	case fusekernel.OpPoll:
+		var out fusekernel.PollOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpStatfs:
+		var out fusekernel.StatfsOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpInit:
+		var out fusekernel.InitOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+		fmt.Fprintf(&w, " flags=%v", fusekernel.InitFlags(out.Flags))
+
+		// The server's reply settles the version.
+		if out.Major != 0 {
+			d.protocol = fusekernel.Protocol{Major: out.Major, Minor: out.Minor}
+		}
+
+	case fusekernel.OpReaddir:
+		describeDirents(&w, b)
+
+	case fusekernel.OpReaddirplus:
+		describeDirentsPlus(&w, b)
+
+	case fusekernel.OpGetxattr, fusekernel.OpListxattr:
+		// A size query is answered with a struct, a read with the data. We
+		// can't tell which without the request, so guess from the length.
+		if len(b) == int(unsafe.Sizeof(fusekernel.GetxattrOut{})) {
+			var out fusekernel.GetxattrOut
+			describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+		} else {
+			describeData(&w, b)
+		}
+
+	case fusekernel.OpGetlk:
+		var out fusekernel.LkOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	case fusekernel.OpBmap:
+		var out fusekernel.BmapOut
+		describeStruct(&w, "out", &out, unsafe.Pointer(&out), unsafe.Sizeof(out), b)
+
+	default:
+		if len(b) > 0 {
+			describeData(&w, b)
+		}
+	}
+
+	return w.String()
+}
+
+func describeDirentsPlus(w *strings.Builder, b []byte) {
+	for len(b) > 0 {
+		var d fusekernel.DirentPlus
+		if len(b) < fusekernel.DirentPlusSize {
+			fmt.Fprintf(w, " trailing=%q", b)
+			return
+		}
+
+		copyStruct(unsafe.Pointer(&d), uintptr(fusekernel.DirentPlusSize), b)
+		end := fusekernel.DirentPlusSize + int(d.Dirent.Namelen)
+		if end > len(b) {
+			fmt.Fprintf(w, " <dirent name overruns buffer: %+v>", d.Dirent)
+			return
+		}
+
+		fmt.Fprintf(
+			w,
+			"\n    ino=%d off=%d type=%d name=%q nodeid=%d mode=%#o size=%d",
+			d.Dirent.Ino,
+			d.Dirent.Off,
+			d.Dirent.Type,
+			b[fusekernel.DirentPlusSize:end],
+			d.Entry.Nodeid,
+			d.Entry.Attr.Mode,
+			d.Entry.Attr.Size)
+
+		// Records are padded to a multiple of 8 bytes.
+		padded := (end + 7) &^ 7
+		if padded > len(b) {
+			padded = len(b)
+		}
+
+		b = b[padded:]
+	}
+}
+
+func describeDirents(w *strings.Builder, b []byte) {
+	for len(b) > 0 {
+		var d fusekernel.Dirent
+		if len(b) < fusekernel.DirentSize {
+			fmt.Fprintf(w, " trailing=%q", b)
+			return
+		}
+
+		copyStruct(unsafe.Pointer(&d), fusekernel.DirentSize, b)
+		end := fusekernel.DirentSize + int(d.Namelen)
+		if end > len(b) {
+			fmt.Fprintf(w, " <dirent name overruns buffer: %+v>", d)
+			return
+		}
+
+		fmt.Fprintf(
+			w,
+			"\n    ino=%d off=%d type=%d name=%q",
+			d.Ino,
+			d.Off,
+			d.Type,
+			b[fusekernel.DirentSize:end])
+
+		// Records are padded to a multiple of 8 bytes.
+		padded := (end + 7) &^ 7
+		if padded > len(b) {
+			padded = len(b)
+		}
+
+		b = b[padded:]
+	}
+}
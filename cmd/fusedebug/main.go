@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// fusedebug decodes recorded /dev/fuse traffic and prints each message with
+// its fields named, so that protocol problems can be debugged without reading
+// hexdumps against the structs in fuse_kernel.h.
+//
+// Usage:
+//
+//	fusedebug [--replies FILE] [--hex] REQUESTS
+//
+// REQUESTS holds the bytes read by a daemon from /dev/fuse, and the optional
+// replies file the bytes it wrote, each as the messages concatenated in
+// order. Either may be "-" for stdin. With --hex, the files instead contain
+// the bytes as hex digits, as printed by `xxd -p` or extracted from an strace
+// log; whitespace is ignored.
+//
+// Each request is printed followed by its reply, if one was found. Replies
+// with no matching request, including notifications, are printed at the end.
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var fReplies = flag.String(
+	"replies",
+	"",
+	"A file containing the replies written by the daemon.")
+
+var fHex = flag.Bool(
+	"hex",
+	false,
+	"Read input files as hex digits rather than raw bytes.")
+
+func readInput(name string) ([]byte, error) {
+	var data []byte
+	var err error
+
+	if name == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !*fHex {
+		return data, nil
+	}
+
+	digits := strings.Join(strings.Fields(string(data)), "")
+	data, err = hex.DecodeString(digits)
+	if err != nil {
+		return nil, fmt.Errorf("Decoding hex from %s: %v", name, err)
+	}
+
+	return data, nil
+}
+
+// Print the decoded requests and replies to w. A framing error in either
+// stream is reported after printing everything before it.
+func run(w io.Writer, reqData []byte, replyData []byte) error {
+	reqs, reqErr := splitRequests(reqData)
+	replies, replyErr := splitReplies(replyData)
+
+	// Index the replies by request.
+	byUnique := make(map[uint64]int)
+	for i, r := range replies {
+		if r.header.Unique != 0 {
+			byUnique[r.header.Unique] = i
+		}
+	}
+
+	d := newDecoder()
+	printed := make([]bool, len(replies))
+	for _, req := range reqs {
+		fmt.Fprintln(w, d.describeRequest(req))
+
+		if i, ok := byUnique[req.header.Unique]; ok && !printed[i] {
+			fmt.Fprintln(w, d.describeReply(req.header.Opcode, replies[i]))
+			printed[i] = true
+		}
+	}
+
+	for i, r := range replies {
+		if !printed[i] {
+			fmt.Fprintln(w, d.describeReply(0, r))
+		}
+	}
+
+	if reqErr != nil {
+		return fmt.Errorf("Requests: %v", reqErr)
+	}
+
+	if replyErr != nil {
+		return fmt.Errorf("Replies: %v", replyErr)
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: fusedebug [--replies FILE] [--hex] REQUESTS")
+		os.Exit(2)
+	}
+
+	reqData, err := readInput(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	var replyData []byte
+	if *fReplies != "" {
+		replyData, err = readInput(*fReplies)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := run(os.Stdout, reqData, replyData); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func structBytes(p unsafe.Pointer, size uintptr) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(p), size)...)
+}
+
+func appendRequest(
+	stream []byte,
+	opcode uint32,
+	unique uint64,
+	nodeID uint64,
+	body ...[]byte) []byte {
+	h := fusekernel.InHeader{
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeID,
+		Uid:    1000,
+		Len:    uint32(fusekernel.InHeaderSize),
+	}
+
+	for _, b := range body {
+		h.Len += uint32(len(b))
+	}
+
+	stream = append(stream, structBytes(unsafe.Pointer(&h), unsafe.Sizeof(h))...)
+	for _, b := range body {
+		stream = append(stream, b...)
+	}
+
+	return stream
+}
+
+// The error field is negated for errors, and holds the code for
+// notifications.
+func appendReply(stream []byte, unique uint64, errorField int32, body []byte) []byte {
+	h := fusekernel.OutHeader{
+		Len:    uint32(outHeaderSize + len(body)),
+		Error:  errorField,
+		Unique: unique,
+	}
+
+	stream = append(stream, structBytes(unsafe.Pointer(&h), unsafe.Sizeof(h))...)
+	return append(stream, body...)
+}
+
+func TestDecode(t *testing.T) {
+	var reqs, replies []byte
+
+	// An init handshake at 7.12, where mkdir_in is 8 bytes and entry_out 120.
+	initIn := fusekernel.InitIn{Major: 7, Minor: 12}
+	reqs = appendRequest(reqs, fusekernel.OpInit, 1, 0, structBytes(unsafe.Pointer(&initIn), unsafe.Sizeof(initIn)))
+
+	initOut := fusekernel.InitOut{Major: 7, Minor: 12, MaxWrite: 4096}
+	replies = appendReply(replies, 1, 0, structBytes(unsafe.Pointer(&initOut), unsafe.Sizeof(initOut)))
+
+	// A failed lookup.
+	reqs = appendRequest(reqs, fusekernel.OpLookup, 2, 1, []byte("foo\x00"))
+	replies = appendReply(replies, 2, -int32(syscall.ENOENT), nil)
+
+	// A successful mkdir.
+	mkdirIn := fusekernel.MkdirIn{Mode: 0755}
+	reqs = appendRequest(reqs, fusekernel.OpMkdir, 3, 1, structBytes(unsafe.Pointer(&mkdirIn), 8), []byte("dir\x00"))
+
+	entryOut := fusekernel.EntryOut{Nodeid: 17}
+	replies = appendReply(replies, 3, 0, structBytes(unsafe.Pointer(&entryOut), fusekernel.EntryOutSize(fusekernel.Protocol{Major: 7, Minor: 12})))
+
+	// A notification and a reply to something we didn't see.
+	replies = appendReply(replies, 0, fusekernel.NotifyCodeInvalEntry, []byte("x"))
+	replies = appendReply(replies, 99, -int32(syscall.EIO), nil)
+
+	var out bytes.Buffer
+	if err := run(&out, reqs, replies); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"[1] INIT node=0 uid=1000",
+		"Minor:12",
+		"[1] -> INIT out={Major:7 Minor:12",
+		"MaxWrite:4096",
+		`[2] LOOKUP node=1 uid=1000 gid=0 pid=0 name="foo"`,
+		"[2] -> LOOKUP error=2 (no such file or directory)",
+		`[3] MKDIR node=1 uid=1000 gid=0 pid=0 in={Mode:493 Umask:0} name="dir"`,
+		"[3] -> MKDIR entry={Nodeid:17",
+		"[0] NOTIFY_INVAL_ENTRY",
+		"[99] -> OPCODE_0 error=5",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Output doesn't contain %q:\n%s", want, got)
+		}
+	}
+
+	// Truncated input should be reported, after decoding what we can.
+	out.Reset()
+	err := run(&out, reqs[:len(reqs)-1], nil)
+	if err == nil || !strings.Contains(err.Error(), "Bad request length") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	if !strings.Contains(out.String(), "LOOKUP") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
@@ -16,6 +16,7 @@ package fuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -23,12 +24,15 @@ import (
 	"path"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/freelist"
 	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/fuse/internal/uring"
 )
 
 type contextKeyType uint64
@@ -53,9 +57,14 @@ var contextKey interface{} = contextKeyType(0)
 //   - (https://tinyurl.com/ywhfcfte) Don't read ahead at all if that field is
 //     zero.
 //
-// Reading a page at a time is a drag. Ask for a larger size.
+// Reading a page at a time is a drag. Ask for a larger size unless
+// MountConfig.MaxReadahead says otherwise.
 const maxReadahead = 1 << 20
 
+// The number of pages per request that kernels fall back to when the limit
+// isn't negotiated (FUSE_DEFAULT_MAX_PAGES_PER_REQ).
+const defaultMaxPages = 32
+
 // Connection represents a connection to the fuse kernel process. It is used to
 // receive and reply to requests from the kernel.
 type Connection struct {
@@ -68,13 +77,107 @@ type Connection struct {
 	dev      *os.File
 	protocol fusekernel.Protocol
 
+	// With cfg.DeviceQueues, the clones of dev that requests are also read
+	// from, the ops that their readers and dev's hand to ReadOp, and a channel
+	// closed to tell the readers to stop. Set up once, after Init.
+	queues     []*os.File
+	queuedOps  chan queuedOp
+	stopQueues chan struct{}
+
+	// With cfg.UseIOUring, the ring through which requests are read and
+	// replies written, if it could be set up.
+	ring *uring.Ring
+
+	// Whether the kernel agreed during init to stop opening files and
+	// directories once an open fails with ENOSYS.
+	noOpen    bool
+	noOpendir bool
+
+	// Whether the kernel agreed during init to choose between READDIR and
+	// READDIRPLUS for each read.
+	readDirPlusAuto bool
+
+	// The largest number of pages that the kernel puts in a request, as
+	// negotiated during init, or zero before then.
+	maxPages int
+
+	// Entry invalidations that cfg.EntryInvalidationGroup has yet to send on
+	// this connection, which must be sent before the device is closed.
+	groupNotifications sync.WaitGroup
+
+	// The expiration times handed to the kernel, if cfg.Clock is set.
+	expirations *expirationTracker
+
+	// Calls to cfg.UnknownOpHandler and raw op handlers that have yet to
+	// reply.
+	rawOpsInFlight sync.WaitGroup
+
+	// The number of malformed messages ignored, for
+	// cfg.TolerateProtocolErrors.
+	protocolErrors atomic.Uint64
+
+	// Set once splicing messages for cfg.SpliceWrites has turned out not to
+	// work.
+	spliceUnsupported atomic.Bool
+
+	// Cumulative statistics, for MountedFileSystem.Stats.
+	stats *connectionStats
+
+	// Recent requests and replies, if cfg.OpJournalSize is positive.
+	journal *opJournal
+
+	// Lookup counts and attached values, if cfg.TrackInodeData is set.
+	inodeData *inodeDataTracker
+
 	mu sync.Mutex
 
 	// A map from fuse "unique" request ID (*not* the op ID for logging used
-	// above) to a function that cancel's its associated context.
+	// above) to the op's context and a function that cancels it.
+	//
+	// GUARDED_BY(mu)
+	cancelFuncs map[uint64]opCancel
+
+	// Set while MountedFileSystem.Shutdown waits for the ops in flight, the
+	// entries in cancelFuncs, to be responded to, along with a channel that is
+	// closed once there are none left, or nil if it already has been.
+	//
+	// GUARDED_BY(mu)
+	draining bool
+	drained  chan struct{}
+
+	// The handler set with SetInterruptHandler, if any.
+	//
+	// GUARDED_BY(mu)
+	interruptHandler InterruptHandler
+
+	// Handlers set with SetRawOpHandler, by opcode.
+	//
+	// GUARDED_BY(mu)
+	rawOpHandlers map[uint32]RawOpHandler
+
+	// Values attached to open handles by the file system, for
+	// attachHandleData.
+	//
+	// GUARDED_BY(mu)
+	handleData map[handleDataKey]interface{}
+
+	// The error that ended ReadOp, if any.
+	//
+	// GUARDED_BY(mu)
+	readErr error
+
+	// Forgets fanned out from batches for cfg.SplitBatchForgets, in the order
+	// that ReadOp is to return them.
+	//
+	// GUARDED_BY(mu)
+	splitForgets []splitForget
+
+	// Calls to Notifier.Retrieve waiting for the kernel to reply, keyed by
+	// the ID sent in the notification, and the last such ID handed out.
 	//
 	// GUARDED_BY(mu)
-	cancelFuncs map[uint64]func()
+	retrievals    map[uint64]*retrieval
+	lastRetrieval uint64
 
 	// Freelists, serviced by freelists.go.
 	inMessages  freelist.Freelist // GUARDED_BY(mu)
@@ -87,6 +190,50 @@ type opState struct {
 	inMsg  *buffer.InMessage
 	outMsg *buffer.OutMessage
 	op     interface{}
+
+	// For writes with cfg.StreamWrites or cfg.SpliceWrites, the payload, which
+	// owns inMsg.
+	payload *writePayload
+
+	// When the request was read from the kernel.
+	readTime time.Time
+
+	// When the request was read according to cfg.Clock, against which the file
+	// system sets expirations. The same as readTime without a clock.
+	clockTime time.Time
+
+	// The connection's inode data, for InodeData.
+	inodeData *inodeDataTracker
+
+	// For a forget fanned out from a batch for cfg.SplitBatchForgets, or a
+	// reply made by timeOutOp, the header to reply with, in place of inMsg,
+	// which is nil.
+	batchHeader *fusekernel.InHeader
+
+	// The device that the request was read from, to which the kernel expects
+	// the reply.
+	dev *os.File
+
+	// With cfg.OpTimeout, the op's timer, shared by every copy of the state.
+	timeout *opTimeout
+
+	// Set for the reply made by timeOutOp, which must leave the op's own
+	// buffers and callback alone.
+	timedOut bool
+}
+
+// Return the header of the op's request, which remains valid after a
+// streamed write's payload has been released.
+func (s *opState) header() *fusekernel.InHeader {
+	if s.payload != nil {
+		return &s.payload.header
+	}
+
+	if s.batchHeader != nil {
+		return s.batchHeader
+	}
+
+	return s.inMsg.Header()
 }
 
 // Create a connection wrapping the supplied file descriptor connected to the
@@ -103,13 +250,35 @@ func newConnection(
 		debugLogger: debugLogger,
 		errorLogger: errorLogger,
 		dev:         dev,
-		cancelFuncs: make(map[uint64]func()),
+		cancelFuncs: make(map[uint64]opCancel),
+		stats:       newConnectionStats(),
+		journal:     newOpJournal(cfg.OpJournalSize),
+	}
+
+	if cfg.Clock != nil {
+		c.expirations = newExpirationTracker(cfg.Clock)
+	}
+
+	if cfg.TrackInodeData {
+		c.inodeData = newInodeDataTracker()
+	}
+
+	if cfg.EntryInvalidationGroup != nil {
+		cfg.EntryInvalidationGroup.add(c)
+	}
+
+	if cfg.UseIOUring {
+		c.setUpRing()
 	}
 
 	// Initialize.
 	if err := c.Init(); err != nil {
 		c.close()
-		return nil, fmt.Errorf("Init: %v", err)
+		return nil, fmt.Errorf("Init: %w", err)
+	}
+
+	if cfg.DeviceQueues > 1 {
+		c.startQueues()
 	}
 
 	return c, nil
@@ -153,11 +322,20 @@ func (c *Connection) Init() error {
 	cacheSymlinks := initOp.Flags&fusekernel.InitCacheSymlinks > 0
 	noOpenSupport := initOp.Flags&fusekernel.InitNoOpenSupport > 0
 	noOpendirSupport := initOp.Flags&fusekernel.InitNoOpendirSupport > 0
+	parallelDirOps := initOp.Flags&fusekernel.InitParallelDirOps > 0
+	asyncDIO := initOp.Flags&fusekernel.InitAsyncDIO > 0
+	posixLocks := initOp.Flags&fusekernel.InitPosixLocks > 0
+	atomicTrunc := initOp.Flags&fusekernel.InitAtomicTrunc > 0
+	writebackCache := initOp.Flags&fusekernel.InitWritebackCache > 0
+	flockLocks := initOp.Flags&fusekernel.InitFlockLocks > 0
+	readDirPlus := initOp.Flags&fusekernel.InitDoReaddirplus > 0
+	readDirPlusAuto := initOp.Flags&fusekernel.InitReaddirplusAuto > 0
+	maxPages := initOp.Flags&fusekernel.InitMaxPages > 0
 
 	// Respond to the init op.
 	initOp.Library = c.protocol
-	initOp.MaxReadahead = maxReadahead
-	initOp.MaxWrite = buffer.MaxWriteSize
+	initOp.MaxReadahead = c.cfg.maxReadahead()
+	initOp.MaxWrite = c.cfg.maxWriteSize()
 
 	initOp.Flags = 0
 
@@ -168,12 +346,23 @@ func (c *Connection) Init() error {
 		initOp.Flags |= fusekernel.InitAsyncRead
 	}
 
-	// kernel 4.20 increases the max from 32 -> 256
-	initOp.Flags |= fusekernel.InitMaxPages
-	initOp.MaxPages = 256
+	// Allow the kernel to send direct IO requests concurrently (protocol >= 7.22):
+	if c.cfg.EnableAsyncDirectIO && asyncDIO {
+		initOp.Flags |= fusekernel.InitAsyncDIO
+	}
 
-	// Enable writeback caching if the user hasn't asked us not to.
-	if !c.cfg.DisableWritebackCaching {
+	// Kernels before 4.20 put at most 32 pages in a request, and later ones
+	// accept a larger limit, by default up to 256 pages.
+	c.maxPages = defaultMaxPages
+	if maxPages {
+		initOp.Flags |= fusekernel.InitMaxPages
+		initOp.MaxPages = c.cfg.maxPages()
+		c.maxPages = int(initOp.MaxPages)
+	}
+
+	// Enable writeback caching if the user hasn't asked us not to
+	// (Linux >= 3.15).
+	if !c.cfg.DisableWritebackCaching && writebackCache {
 		initOp.Flags |= fusekernel.InitWritebackCache
 	}
 
@@ -187,23 +376,52 @@ func (c *Connection) Init() error {
 	// OpenFile calls at all (Linux >= 3.16):
 	if c.cfg.EnableNoOpenSupport && noOpenSupport {
 		initOp.Flags |= fusekernel.InitNoOpenSupport
+		c.noOpen = true
 	}
 
 	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
 	// OpenDir calls at all (Linux >= 5.1):
 	if c.cfg.EnableNoOpendirSupport && noOpendirSupport {
 		initOp.Flags |= fusekernel.InitNoOpendirSupport
+		c.noOpendir = true
 	}
 
-	// Tell the Kernel to allow sending parallel lookup and readdir operations.
-	if c.cfg.EnableParallelDirOps {
+	// Tell the Kernel to allow sending parallel lookup and readdir operations
+	// (Linux >= 4.7):
+	if c.cfg.EnableParallelDirOps && parallelDirOps {
 		initOp.Flags |= fusekernel.InitParallelDirOps
 	}
 
-	if c.cfg.EnableAtomicTrunc {
+	// Tell the kernel to pass O_TRUNC on to OpenFile rather than truncating
+	// with a separate SetInodeAttributes:
+	if c.cfg.EnableAtomicTrunc && atomicTrunc {
 		initOp.Flags |= fusekernel.InitAtomicTrunc
 	}
 
+	// Allow ioctls on directories as well as files:
+	initOp.Flags |= fusekernel.InitHasIoctlDir
+
+	// Tell the kernel to send POSIX locks to us rather than handling them
+	// locally:
+	if c.cfg.EnablePosixLocks && posixLocks {
+		initOp.Flags |= fusekernel.InitPosixLocks
+	}
+
+	// Likewise for flock locks:
+	if c.cfg.EnableFlockLocks && flockLocks {
+		initOp.Flags |= fusekernel.InitFlockLocks
+	}
+
+	// Let the kernel read directories along with the attributes of their
+	// entries, choosing for itself when that is worthwhile if it can:
+	if c.cfg.EnableReadDirPlus && readDirPlus {
+		initOp.Flags |= fusekernel.InitDoReaddirplus
+		if readDirPlusAuto {
+			initOp.Flags |= fusekernel.InitReaddirplusAuto
+			c.readDirPlusAuto = true
+		}
+	}
+
 	return c.Reply(ctx, nil)
 }
 
@@ -241,10 +459,18 @@ func (c *Connection) debugLog(
 	c.debugLogger.Println(msg)
 }
 
+// The context of an op that has yet to be responded to, and the function
+// that cancels it.
+type opCancel struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) recordCancelFunc(
 	fuseID uint64,
-	f func()) {
+	ctx context.Context,
+	f context.CancelCauseFunc) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -252,18 +478,24 @@ func (c *Connection) recordCancelFunc(
 		panic(fmt.Sprintf("Already have cancel func for request %v", fuseID))
 	}
 
-	c.cancelFuncs[fuseID] = f
+	c.cancelFuncs[fuseID] = opCancel{ctx, f}
 }
 
 // Set up state for an op that is about to be returned to the user, given its
-// underlying fuse opcode and request ID.
+// underlying fuse opcode and request ID, and the state to stuff into its
+// context.
 //
 // Return a context that should be used for the op.
 //
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) beginOp(
 	opCode uint32,
-	fuseID uint64) context.Context {
+	fuseID uint64,
+	state opState) context.Context {
+	if c.cfg.MetricsCollector != nil {
+		c.cfg.MetricsCollector.OpStarted(opName(state.op))
+	}
+
 	// Start with the parent context.
 	ctx := c.cfg.OpContext
 
@@ -276,12 +508,23 @@ func (c *Connection) beginOp(
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	if opCode != fusekernel.OpForget {
-		var cancel func()
-		ctx, cancel = context.WithCancel(ctx)
-		c.recordCancelFunc(fuseID, cancel)
+		if c.cfg.OpTimeout > 0 && opCanTimeOut(opCode) {
+			state.timeout = &opTimeout{}
+		}
+
+		var cancel context.CancelCauseFunc
+		ctx, cancel = context.WithCancelCause(ctx)
+		ctx = context.WithValue(ctx, contextKey, state)
+		c.recordCancelFunc(fuseID, ctx, cancel)
+
+		if state.timeout != nil {
+			c.startOpTimeout(ctx, state)
+		}
+
+		return ctx
 	}
 
-	return ctx
+	return context.WithValue(ctx, contextKey, state)
 }
 
 // Clean up all state associated with an op to which the user has responded,
@@ -303,21 +546,63 @@ func (c *Connection) finishOp(
 	// Special case: we don't do this for Forget requests. See the note in
 	// beginOp above.
 	if opCode != fusekernel.OpForget {
-		cancel, ok := c.cancelFuncs[fuseID]
+		oc, ok := c.cancelFuncs[fuseID]
 		if !ok {
 			panic(fmt.Sprintf("Unknown request ID in finishOp: %v", fuseID))
 		}
 
-		cancel()
+		oc.cancel(nil)
 		delete(c.cancelFuncs, fuseID)
 	}
+
+	if c.drained != nil && len(c.cancelFuncs) == 0 {
+		close(c.drained)
+		c.drained = nil
+	}
 }
 
+// Start turning away new ops, returning a channel that is closed once the ops
+// already in flight have been responded to.
+//
 // LOCKS_EXCLUDED(c.mu)
-func (c *Connection) handleInterrupt(fuseID uint64) {
+func (c *Connection) beginDrain() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	drained := make(chan struct{})
+	c.draining = true
+	c.drained = drained
+
+	if len(c.cancelFuncs) == 0 {
+		close(c.drained)
+		c.drained = nil
+	}
+
+	return drained
+}
+
+// Go back to handing new ops to the user, after a shutdown that didn't
+// happen.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) endDrain() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	c.draining = false
+	c.drained = nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) isDraining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.draining
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) handleInterrupt(fuseID uint64) {
 	// NOTE(jacobsa): fuse.txt in the Linux kernel documentation
 	// (https://tinyurl.com/2r4ajuwd) defines the kernel <-> userspace protocol
 	// for interrupts.
@@ -332,24 +617,62 @@ func (c *Connection) handleInterrupt(fuseID uint64) {
 	//
 	// Cf. https://github.com/osxfuse/osxfuse/issues/208
 	// Cf. http://comments.gmane.org/gmane.comp.file-systems.fuse.devel/14675
-	cancel, ok := c.cancelFuncs[fuseID]
+	c.mu.Lock()
+	oc, ok := c.cancelFuncs[fuseID]
+	h := c.interruptHandler
+	c.mu.Unlock()
+
 	if !ok {
 		return
 	}
 
-	cancel()
+	// Tell the handler first, so that it has seen the interrupt by the time
+	// anything waiting on the context replies.
+	if h != nil {
+		state := oc.ctx.Value(contextKey).(opState)
+		h(oc.ctx, state.op)
+	}
+
+	oc.cancel(syscall.EINTR)
 }
 
-// Read the next message from the kernel. The message must later be destroyed
-// using destroyInMessage.
-func (c *Connection) readMessage() (*buffer.InMessage, error) {
+// Cancel the context of every op that has been read but not yet responded
+// to, because the connection to the kernel has gone away and nobody is left
+// waiting for the responses.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) cancelAllOps() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The entries are left in place for finishOp, since the ops must still be
+	// responded to.
+	for _, oc := range c.cancelFuncs {
+		oc.cancel(syscall.ENODEV)
+	}
+}
+
+// Read the next message from the kernel on the supplied device. The message
+// must later be destroyed using destroyInMessage.
+func (c *Connection) readMessage(dev *os.File) (*buffer.InMessage, error) {
 	// Allocate a message.
 	m := c.getInMessage()
 
 	// Loop past transient errors.
 	for {
 		// Attempt a read.
-		err := m.Init(c.dev)
+		var err error
+		if c.cfg.SpliceWrites && !c.spliceUnsupported.Load() {
+			err = m.InitSplice(int(dev.Fd()), c.cfg.maxMessageSize(), int(fusekernel.WriteInSize(c.protocol)))
+			if errors.Is(err, buffer.ErrSpliceUnsupported) {
+				c.logError("Reading messages without splice", err)
+
+				c.spliceUnsupported.Store(true)
+				continue
+			}
+		} else {
+			err = m.Init(c.deviceReader(dev))
+		}
 
 		// Special cases:
 		//
@@ -378,10 +701,17 @@ func (c *Connection) readMessage() (*buffer.InMessage, error) {
 	}
 }
 
-// Write the supplied message to the kernel.
-func (c *Connection) writeMessage(msg []byte) error {
+// Write the supplied message to the kernel on the supplied device.
+func (c *Connection) writeMessage(dev *os.File, msg []byte) error {
 	// Avoid the retry loop in os.File.Write.
-	n, err := syscall.Write(int(c.dev.Fd()), msg)
+	var n int
+	var err error
+	if c.ring != nil {
+		n, err = c.ring.Writev(int(dev.Fd()), [][]byte{msg})
+	} else {
+		n, err = syscall.Write(int(dev.Fd()), msg)
+	}
+
 	if err != nil {
 		return err
 	}
@@ -395,30 +725,146 @@ func (c *Connection) writeMessage(msg []byte) error {
 
 // ReadOp consumes the next op from the kernel process, returning the op and a
 // context that should be used for work related to the op. It returns io.EOF if
-// the kernel has closed the connection.
+// the kernel has closed the connection. Other errors wrap ErrProtocol if the
+// kernel sent a malformed message, or the syscall.Errno with which reading
+// failed. Once it has returned an error, the server should stop reading and
+// return from ServeOps; MountedFileSystem.Join reports the error.
+//
+// The context is cancelled once the op has been responded to, if the kernel
+// interrupts the op (e.g. because the process making the system call received
+// a signal), or when the connection is lost because the file system was
+// unmounted or the connection aborted. When the op is interrupted,
+// context.Cause returns syscall.EINTR, and replying with an error wrapping
+// context.Canceled, such as the context's own error, fails the op with EINTR;
+// see also SetInterruptHandler. When the op outlives MountConfig.OpTimeout,
+// context.Cause returns syscall.ETIMEDOUT and the op has been failed already.
+// When the connection is lost, context.Cause
+// returns syscall.ENODEV, the kernel has already failed any system call
+// waiting on the op (with ECONNABORTED or ENOTCONN, for an abort), and Reply
+// returns an error because there is nobody left to reply to. The op must be
+// replied to regardless, and ServeOps must not return until every op it has
+// read has been replied to, since the connection is closed once it does.
 //
 // If err != nil, the user is responsible for later calling c.Reply with the
 // returned context.
 //
 // This function delivers ops in exactly the order they are received from
-// /dev/fuse. It must not be called multiple times concurrently.
+// /dev/fuse, or from each of its clones with MountConfig.DeviceQueues. It must
+// not be called multiple times concurrently.
 //
 // LOCKS_EXCLUDED(c.mu)
-func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
+func (c *Connection) ReadOp() (_ context.Context, op interface{}, err error) {
+	defer func() {
+		if err != nil {
+			c.setReadErr(err)
+		}
+	}()
+
+	if c.queuedOps != nil {
+		q := <-c.queuedOps
+		return q.ctx, q.op, q.err
+	}
+
+	return c.readOp(c.dev)
+}
+
+// Read the next op for ReadOp from the supplied device.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) readOp(dev *os.File) (_ context.Context, op interface{}, err error) {
 	// Keep going until we find a request we know how to convert.
 	for {
+		// Hand out what remains of a batch of forgets before reading more.
+		if ctx, op, ok := c.nextSplitForget(); ok {
+			return ctx, op, nil
+		}
+
 		// Read the next message from the kernel.
-		inMsg, err := c.readMessage()
+		inMsg, err := c.readMessage(dev)
+		if err == io.EOF {
+			c.cancelAllOps()
+		}
+
+		if errors.Is(err, buffer.ErrMalformed) {
+			// We can't trust the header of a message with bad framing enough to
+			// reply to it.
+			if c.cfg.TolerateProtocolErrors {
+				c.protocolError(err)
+				continue
+			}
+
+			err = fmt.Errorf("%w: readMessage: %v", ErrProtocol, err)
+		}
+
 		if err != nil {
 			return nil, nil, err
 		}
 
+		readTime := time.Now()
+		clockTime := readTime
+		if c.cfg.Clock != nil {
+			clockTime = c.cfg.Clock.Now()
+		}
+
+		if c.cfg.MapCredentials != nil {
+			h := inMsg.Header()
+			h.Uid, h.Gid = c.cfg.MapCredentials(h.Uid, h.Gid)
+		}
+
+		if c.journal != nil {
+			h := inMsg.Header()
+			c.journal.add(OpJournalEntry{
+				Time:   readTime,
+				Unique: h.Unique,
+				OpCode: h.Opcode,
+				Inode:  fuseops.InodeID(h.Nodeid),
+			})
+		}
+
+		// Special case: hand replies to retrieve notifications to the
+		// Notifier.Retrieve call waiting for them.
+		if inMsg.Header().Opcode == fusekernel.OpNotifyReply {
+			c.finishRetrieve(inMsg)
+			continue
+		}
+
+		// Special case: hand requests with a raw handler to it, rather than
+		// converting them.
+		if h := c.rawOpHandler(inMsg.Header().Opcode); h != nil {
+			if err := inMsg.FillPayload(); err != nil {
+				c.putInMessage(inMsg)
+				return nil, nil, err
+			}
+
+			c.serveRawOp(h, dev, inMsg, readTime, clockTime)
+			continue
+		}
+
+		// Reject anything suspicious, if configured to.
+		if c.cfg.StrictProtocolValidation {
+			if err := validateInMessage(inMsg, c.protocol); err != nil {
+				c.protocolError(fmt.Errorf("%w: validateInMessage: %v", ErrProtocol, err))
+				c.replyMalformed(dev, inMsg)
+				c.putInMessage(inMsg)
+				continue
+			}
+		}
+
 		// Convert the message to an op.
 		outMsg := c.getOutMessage()
-		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol)
+		op, err = convertInMessage(&c.cfg, inMsg, outMsg, c.protocol, readTime)
 		if err != nil {
 			c.putOutMessage(outMsg)
-			return nil, nil, fmt.Errorf("convertInMessage: %v", err)
+			err = fmt.Errorf("%w: convertInMessage: %v", ErrProtocol, err)
+
+			if c.cfg.TolerateProtocolErrors {
+				c.protocolError(err)
+				c.replyMalformed(dev, inMsg)
+				c.putInMessage(inMsg)
+				continue
+			}
+
+			return nil, nil, err
 		}
 
 		// Choose an ID for this operation for the purposes of logging, and log it.
@@ -426,21 +872,119 @@ func (c *Connection) ReadOp() (_ context.Context, op interface{}, _ error) {
 			c.debugLog(inMsg.Header().Unique, 1, "<- %s", describeRequest(op))
 		}
 
+		if c.cfg.Logger != nil && c.cfg.Logger.Enabled(LogDebug) {
+			h := inMsg.Header()
+			c.log(
+				LogDebug,
+				"Request",
+				LogField{LogKeyOpID, h.Unique},
+				LogField{LogKeyOp, opName(op)},
+				LogField{LogKeyInode, fuseops.InodeID(h.Nodeid)},
+				LogField{LogKeyDetail, describeRequest(op)})
+		}
+
+		// Special case: fan batches of forgets out, if configured to.
+		if batch, ok := op.(*fuseops.BatchForgetOp); ok && c.cfg.SplitBatchForgets {
+			c.splitBatchForget(inMsg, outMsg, batch, readTime)
+			continue
+		}
+
 		// Special case: handle interrupt requests inline.
 		if interruptOp, ok := op.(*interruptOp); ok {
 			c.handleInterrupt(interruptOp.FuseID)
 			continue
 		}
 
+		c.attachHandleData(op)
+		c.setReadDirAdaptive(op)
+
+		// Hand over the payloads of writes as streams, if configured.
+		var payload *writePayload
+		if w, ok := op.(*fuseops.WriteFileOp); ok && (c.cfg.StreamWrites || c.cfg.SpliceWrites) {
+			payload = c.streamWrite(inMsg, w)
+		}
+
 		// Set up a context that remembers information about this op.
-		ctx := c.beginOp(inMsg.Header().Opcode, inMsg.Header().Unique)
-		ctx = context.WithValue(ctx, contextKey, opState{inMsg, outMsg, op})
+		ctx := c.beginOp(
+			inMsg.Header().Opcode,
+			inMsg.Header().Unique,
+			opState{
+				inMsg:     inMsg,
+				outMsg:    outMsg,
+				op:        op,
+				payload:   payload,
+				readTime:  readTime,
+				clockTime: clockTime,
+				inodeData: c.inodeData,
+				dev:       dev,
+			})
+
+		// Special case: while shutting down, turn away new ops rather than
+		// handing them to the user, failing them as they would fail once the
+		// file system is unmounted. Forgets need no reply, and are cheap.
+		switch op.(type) {
+		case *fuseops.ForgetInodeOp, *fuseops.BatchForgetOp:
+
+		default:
+			if c.isDraining() {
+				c.Reply(ctx, syscall.ENOTCONN)
+				continue
+			}
+		}
+
+		// Special case: hand unknown ops to the configured handler, if any,
+		// rather than to the user.
+		if unknown, ok := op.(*unknownOp); ok && c.cfg.UnknownOpHandler != nil {
+			c.rawOpsInFlight.Add(1)
+			go c.handleUnknownOp(ctx, unknown, outMsg)
+			continue
+		}
 
 		// Return the op to the user.
 		return ctx, op, nil
 	}
 }
 
+// Record the error that ended ReadOp, logging it if it's unexpected.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) setReadErr(err error) {
+	c.mu.Lock()
+	if c.readErr == nil {
+		c.readErr = err
+	}
+
+	c.failRetrievals()
+	c.mu.Unlock()
+
+	if err != io.EOF {
+		c.logError("ReadOp", err)
+	}
+}
+
+// Return the error with which MountedFileSystem.Join should report why
+// serving the file system mounted on dir stopped, or nil if it was unmounted
+// cleanly.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) serveError(dir string) error {
+	c.mu.Lock()
+	err := c.readErr
+	c.mu.Unlock()
+
+	if err != io.EOF {
+		return err
+	}
+
+	// The kernel hangs up the same way whether the file system was unmounted
+	// or the connection aborted, but an aborted mount is still there.
+	if connectionAborted(dir) {
+		return ErrConnectionAborted
+	}
+
+	return nil
+}
+
 // Skip errors that happen as a matter of course, since they spook users.
 func (c *Connection) shouldLogError(
 	op interface{},
@@ -450,8 +994,8 @@ func (c *Connection) shouldLogError(
 		return false
 	}
 
-	// We can't log if there's nothing to log to.
-	if c.errorLogger == nil {
+	// ENOSYS is how the file system opts out of ops the kernel can do without.
+	if err == syscall.ENOSYS && KernelCachesENOSYS(op) {
 		return false
 	}
 
@@ -464,7 +1008,12 @@ func (c *Connection) shouldLogError(
 			return false
 		}
 	case *fuseops.GetXattrOp, *fuseops.ListXattrOp:
-		if err == syscall.ENOSYS || err == syscall.ENODATA || err == syscall.ERANGE {
+		if err == syscall.ENODATA || err == syscall.ERANGE {
+			return false
+		}
+	case *fuseops.AccessOp:
+		// Denying access is the point of the op.
+		if err == syscall.EACCES {
 			return false
 		}
 	case *unknownOp:
@@ -472,6 +1021,11 @@ func (c *Connection) shouldLogError(
 		if err == syscall.ENOSYS {
 			return false
 		}
+	case *fuseops.OpenFileOp, *fuseops.OpenDirOp:
+		// This is how the file system asks the kernel to stop sending opens.
+		if err == syscall.ENOSYS && c.opDeclined(op) {
+			return false
+		}
 	}
 
 	return true
@@ -492,26 +1046,81 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 		panic(fmt.Sprintf("Reply called with invalid context: %#v", ctx))
 	}
 
-	op := state.op
-	inMsg := state.inMsg
-	outMsg := state.outMsg
-	fuseID := inMsg.Header().Unique
+	// If the op timed out, the kernel has had its reply already.
+	if t := state.timeout; t != nil {
+		t.timer.Stop()
+		if !t.replied.CompareAndSwap(false, true) {
+			c.releaseOp(state)
+			return nil
+		}
+	}
 
-	defer func() {
-		// Invoke any callbacks set by the FUSE server after the response to the kernel is
-		// complete and before the inMessage and outMessage memory buffers have been freed.
-		callback := c.callbackForOp(op)
+	return c.reply(ctx, state, opErr)
+}
+
+// Invoke any callback set by the file system for the op, now that the kernel
+// has had the reply, then free the op's buffers.
+func (c *Connection) releaseOp(state opState) {
+	if !state.timedOut {
+		callback := c.callbackForOp(state.op)
 		if callback != nil {
 			callback()
 		}
+	}
 
-		// Make sure we destroy the messages when we're done.
-		c.putInMessage(inMsg)
-		c.putOutMessage(outMsg)
-	}()
+	if state.payload != nil {
+		state.payload.release()
+	} else if state.inMsg != nil {
+		c.putInMessage(state.inMsg)
+	}
+	c.putOutMessage(state.outMsg)
+}
+
+// Reply to the op with the supplied state, on behalf of Reply or timeOutOp.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) reply(ctx context.Context, state opState, opErr error) error {
+	op := state.op
+	outMsg := state.outMsg
+	header := state.header()
+	fuseID := header.Unique
+
+	// Make sure we destroy the messages when we're done.
+	defer c.releaseOp(state)
 
 	// Clean up state for this op.
-	c.finishOp(inMsg.Header().Opcode, inMsg.Header().Unique)
+	c.finishOp(header.Opcode, header.Unique)
+
+	// A file system that gives up on an interrupted op by returning its
+	// context's error fails it with EINTR, as the kernel expects.
+	if errors.Is(opErr, context.Canceled) && context.Cause(ctx) == syscall.EINTR {
+		opErr = syscall.EINTR
+	}
+
+	// A file system that doesn't need opens fails them with ENOSYS. Unless the
+	// kernel agreed to stop sending them, make that a successful open with a
+	// zero handle instead, and likewise the corresponding release.
+	if opErr == syscall.ENOSYS && c.opDeclined(op) && !c.kernelSkipsOpens(op) {
+		opErr = nil
+	}
+
+	// Catch file system bugs that would otherwise produce a malformed reply, if
+	// configured to.
+	if opErr == nil && c.cfg.ValidateResponses {
+		if err := validateResponse(op, state.clockTime); err != nil {
+			if c.errorLogger != nil {
+				c.errorLogger.Printf("%T: invalid response: %v", op, err)
+			}
+
+			c.log(LogError, "Invalid response", opFields(state, LogField{LogKeyError, err})...)
+
+			opErr = syscall.EIO
+		}
+	}
+
+	c.stats.record(op, opErr)
+	c.updateHandleData(op, opErr)
+	c.inodeData.record(op, opErr)
 
 	// Debug logging
 	if c.debugLogger != nil {
@@ -523,12 +1132,56 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 	}
 
 	// Error logging
-	if c.shouldLogError(op, opErr) {
+	shouldLogError := c.shouldLogError(op, opErr)
+	if shouldLogError && c.errorLogger != nil {
 		c.errorLogger.Printf("%T error: %v", op, opErr)
 	}
 
+	// Structured logging, of errors as errors unless they're expected.
+	if c.cfg.Logger != nil {
+		level := LogDebug
+		if shouldLogError {
+			level = LogError
+		}
+
+		if c.cfg.Logger.Enabled(level) {
+			fields := opFields(state, durationField(state.readTime))
+			if opErr == nil {
+				fields = append(fields, LogField{LogKeyDetail, describeResponse(op)})
+			} else {
+				fields = append(fields, LogField{LogKeyError, opErr})
+			}
+
+			c.log(level, "Reply", fields...)
+		}
+	}
+
+	if opErr == nil && c.expirations != nil {
+		c.expirations.record(op)
+	}
+
 	// Send the reply to the kernel, if one is required.
-	noResponse := c.kernelResponse(outMsg, inMsg.Header().Unique, op, opErr)
+	noResponse := c.kernelResponse(outMsg, header.Unique, op, opErr)
+
+	if c.cfg.MetricsCollector != nil {
+		m := opMetrics(op, syscall.Errno(-outMsg.OutHeader().Error))
+		m.Latency = time.Since(state.readTime)
+		c.cfg.MetricsCollector.OpFinished(m)
+	}
+
+	if c.journal != nil {
+		now := time.Now()
+		c.journal.add(OpJournalEntry{
+			Time:    now,
+			Reply:   true,
+			Unique:  header.Unique,
+			OpCode:  header.Opcode,
+			Inode:   fuseops.InodeID(header.Nodeid),
+			Op:      opName(op),
+			Errno:   syscall.Errno(-outMsg.OutHeader().Error),
+			Latency: now.Sub(state.readTime),
+		})
+	}
 
 	if !noResponse {
 		var err error
@@ -538,23 +1191,72 @@ func (c *Connection) Reply(ctx context.Context, opErr error) error {
 				writeLock.Lock()
 				defer writeLock.Unlock()
 			}
-			_, err = writev(int(c.dev.Fd()), outMsg.Sglist)
+			_, err = c.writev(state.dev, outMsg.Sglist)
 		} else {
-			err = c.writeMessage(outMsg.OutHeaderBytes())
+			err = c.writeMessage(state.dev, outMsg.OutHeaderBytes())
 		}
 		if err != nil {
 			writeErrMsg := fmt.Sprintf("writeMessage: %v %v", err, outMsg.OutHeaderBytes())
 			if c.errorLogger != nil {
 				c.errorLogger.Print(writeErrMsg)
 			}
+
+			c.log(LogError, "Writing reply", opFields(state, LogField{LogKeyError, err})...)
 			return fmt.Errorf(writeErrMsg)
 		}
 		outMsg.Sglist = nil
 	}
 
+	// Now that the kernel has seen the reply, it is safe to tell it to
+	// invalidate entries in the directories the op locked.
+	if opErr == nil && c.cfg.EntryInvalidationGroup != nil {
+		c.cfg.EntryInvalidationGroup.opSucceeded(c, op)
+	}
+
 	return nil
 }
 
+// Whether the op is an open or release that the file system has said it
+// doesn't need, via MountConfig.EnableNoOpenSupport or
+// EnableNoOpendirSupport.
+func (c *Connection) opDeclined(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.OpenFileOp, *fuseops.ReleaseFileHandleOp:
+		return c.cfg.EnableNoOpenSupport
+
+	case *fuseops.OpenDirOp, *fuseops.ReleaseDirHandleOp:
+		return c.cfg.EnableNoOpendirSupport
+	}
+
+	return false
+}
+
+// Tell the file system whether the kernel chose the supplied op, if it reads
+// a directory, over the other variant.
+func (c *Connection) setReadDirAdaptive(op interface{}) {
+	switch o := op.(type) {
+	case *fuseops.ReadDirOp:
+		o.Adaptive = c.readDirPlusAuto
+
+	case *fuseops.ReadDirPlusOp:
+		o.Adaptive = c.readDirPlusAuto
+	}
+}
+
+// Whether the kernel stops sending opens like the supplied op once one fails
+// with ENOSYS.
+func (c *Connection) kernelSkipsOpens(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.OpenFileOp:
+		return c.noOpen
+
+	case *fuseops.OpenDirOp:
+		return c.noOpendir
+	}
+
+	return false
+}
+
 func (c *Connection) callbackForOp(op interface{}) func() {
 	switch o := op.(type) {
 	case *fuseops.ReadFileOp:
@@ -570,6 +1272,21 @@ func (c *Connection) callbackForOp(op interface{}) func() {
 func (c *Connection) close() error {
 	// Posix doesn't say that close can be called concurrently with read or
 	// write, but luckily we exclude the possibility of a race by requiring the
-	// user to respond to all ops first.
+	// user to respond to all ops first. The ops we handed to
+	// cfg.UnknownOpHandler and raw op handlers ourselves are our
+	// responsibility.
+	c.rawOpsInFlight.Wait()
+
+	if c.cfg.EntryInvalidationGroup != nil {
+		c.cfg.EntryInvalidationGroup.remove(c)
+		c.groupNotifications.Wait()
+	}
+
+	c.closeQueues()
+
+	if c.ring != nil {
+		c.ring.Close()
+	}
+
 	return c.dev.Close()
 }
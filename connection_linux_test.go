@@ -0,0 +1,677 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestOpTimes(t *testing.T) {
+	fs := &recordingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	before := time.Now()
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	after := time.Now()
+
+	op, ok := fs.last().(*fuseops.LookUpInodeOp)
+	if !ok {
+		t.Fatalf("Unexpected op: %#v", fs.last())
+	}
+
+	oc := op.OpContext
+	if oc.ReadTime.Before(before) || oc.DispatchTime.Before(oc.ReadTime) || oc.DispatchTime.After(after) {
+		t.Errorf("Unexpected times: %v, %v not within [%v, %v]", oc.ReadTime, oc.DispatchTime, before, after)
+	}
+
+	if oc.QueueLatency() != oc.DispatchTime.Sub(oc.ReadTime) {
+		t.Errorf("QueueLatency: %v", oc.QueueLatency())
+	}
+}
+
+func TestMapCredentials(t *testing.T) {
+	fs := &recordingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			MapCredentials: func(uid, gid uint32) (uint32, uint32) {
+				return uid + 1, gid + 1
+			},
+		},
+		&fusetesting.FakeKernelConfig{Uid: 1000, Gid: 1000})
+
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if op, ok := fs.last().(*fuseops.LookUpInodeOp); !ok || op.OpContext.Uid != 1001 {
+		t.Errorf("Unexpected op: %#v", fs.last())
+	}
+}
+
+func TestStats(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	readIn := fusekernel.ReadIn{Fh: 1, Size: 4096}
+	writeIn := fusekernel.WriteIn{Fh: 1, Size: 6}
+	requests := []struct {
+		opcode uint32
+		body   [][]byte
+	}{
+		{fusekernel.OpLookup, [][]byte{nameBytes("foo")}},
+		{fusekernel.OpLookup, [][]byte{nameBytes("bar")}},
+		{fusekernel.OpRmdir, [][]byte{nameBytes("baz")}},
+		{
+			fusekernel.OpRead,
+			[][]byte{unsafe.Slice((*byte)(unsafe.Pointer(&readIn)), unsafe.Sizeof(readIn))},
+		},
+		{
+			fusekernel.OpWrite,
+			[][]byte{
+				unsafe.Slice((*byte)(unsafe.Pointer(&writeIn)), unsafe.Sizeof(writeIn)),
+				[]byte("tacos!"),
+			},
+		},
+	}
+
+	for _, r := range requests {
+		if _, err := k.Call(r.opcode, 1, r.body...); err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	}
+
+	st := k.MountedFileSystem().Stats()
+
+	wantOps := map[string]uint64{
+		"init":        1,
+		"LookUpInode": 2,
+		"RmDir":       1,
+		"ReadFile":    1,
+		"WriteFile":   1,
+	}
+
+	if !reflect.DeepEqual(st.Ops, wantOps) {
+		t.Errorf("Ops: got %v, want %v", st.Ops, wantOps)
+	}
+
+	wantErrors := map[string]uint64{"RmDir": 1}
+	if !reflect.DeepEqual(st.Errors, wantErrors) {
+		t.Errorf("Errors: got %v, want %v", st.Errors, wantErrors)
+	}
+
+	if st.BytesRead != 4 || st.BytesWritten != 6 {
+		t.Errorf("Got %d bytes read and %d written", st.BytesRead, st.BytesWritten)
+	}
+
+	if st.Uptime < 0 || st.MountTime.After(time.Now()) {
+		t.Errorf("Unexpected times: %v, %v", st.MountTime, st.Uptime)
+	}
+}
+
+// A fuse.MetricsCollector that records what it's told.
+type recordingCollector struct {
+	mu       sync.Mutex
+	started  []string
+	finished []fuse.OpMetrics
+}
+
+func (c *recordingCollector) OpStarted(op string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.started = append(c.started, op)
+}
+
+func (c *recordingCollector) OpFinished(m fuse.OpMetrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished = append(c.finished, m)
+}
+
+func TestMetricsCollector(t *testing.T) {
+	c := &recordingCollector{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{MetricsCollector: c},
+		&fusetesting.FakeKernelConfig{})
+
+	writeIn := fusekernel.WriteIn{Fh: 1, Size: 6}
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if _, err := k.Call(fusekernel.OpRmdir, 1, nameBytes("bar")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	_, err := k.Call(
+		fusekernel.OpWrite,
+		1,
+		unsafe.Slice((*byte)(unsafe.Pointer(&writeIn)), unsafe.Sizeof(writeIn)),
+		[]byte("tacos!"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wantStarted := []string{"init", "LookUpInode", "RmDir", "WriteFile"}
+	if !reflect.DeepEqual(c.started, wantStarted) {
+		t.Errorf("Started: got %v, want %v", c.started, wantStarted)
+	}
+
+	if len(c.finished) != len(wantStarted) {
+		t.Fatalf("Got %d finished ops, want %d", len(c.finished), len(wantStarted))
+	}
+
+	for i, m := range c.finished {
+		if m.Op != wantStarted[i] {
+			t.Errorf("Op %d: got %q, want %q", i, m.Op, wantStarted[i])
+		}
+
+		if m.Latency < 0 {
+			t.Errorf("Op %d: negative latency %v", i, m.Latency)
+		}
+	}
+
+	if got := c.finished[2].Errno; got != syscall.ENOSYS {
+		t.Errorf("RmDir errno: got %v, want ENOSYS", got)
+	}
+
+	if got := c.finished[3].BytesWritten; got != 6 {
+		t.Errorf("BytesWritten: got %d, want 6", got)
+	}
+}
+
+func TestOpJournal(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{OpJournalSize: 4},
+		&fusetesting.FakeKernelConfig{})
+
+	// The init request and reply are pushed out by these.
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if _, err := k.Call(fusekernel.OpRmdir, 2, nameBytes("bar")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	type entry struct {
+		reply  bool
+		opCode uint32
+		inode  fuseops.InodeID
+		op     string
+		errno  syscall.Errno
+	}
+
+	want := []entry{
+		{false, fusekernel.OpLookup, 1, "", 0},
+		{true, fusekernel.OpLookup, 1, "LookUpInode", 0},
+		{false, fusekernel.OpRmdir, 2, "", 0},
+		{true, fusekernel.OpRmdir, 2, "RmDir", syscall.ENOSYS},
+	}
+
+	journal := k.MountedFileSystem().OpJournal()
+	if len(journal) != len(want) {
+		t.Fatalf("Got %d entries, want %d: %v", len(journal), len(want), journal)
+	}
+
+	for i, e := range journal {
+		got := entry{e.Reply, e.OpCode, e.Inode, e.Op, e.Errno}
+		if got != want[i] {
+			t.Errorf("Entry %d: got %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	if journal[0].Unique != journal[1].Unique ||
+		journal[2].Unique != journal[3].Unique ||
+		journal[0].Unique == journal[2].Unique {
+		t.Errorf("Replies don't match requests: %v", journal)
+	}
+
+	if journal[1].Latency < 0 || journal[1].Time.Before(journal[0].Time) {
+		t.Errorf("Unexpected times: %v", journal)
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	calls := make(chan context.Context, 100)
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{
+			Maintenance: func(ctx context.Context) {
+				calls <- ctx
+			},
+			MaintenanceInterval: time.Millisecond,
+		},
+		&fusetesting.FakeKernelConfig{})
+
+	ctx := <-calls
+	<-calls
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if ctx.Err() == nil {
+		t.Error("Context not cancelled after unmounting")
+	}
+
+	// Nothing is called after Join returns.
+	for len(calls) > 0 {
+		<-calls
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	if len(calls) != 0 {
+		t.Errorf("%d calls after unmounting", len(calls))
+	}
+}
+
+// A file system whose reads block until they are interrupted, and which
+// records the interrupts it is told about.
+type interruptFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	reading chan struct{}
+
+	mu          sync.Mutex
+	interrupted []interface{}
+	cause       error
+}
+
+func (fs *interruptFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.reading <- struct{}{}
+	<-ctx.Done()
+
+	fs.mu.Lock()
+	fs.cause = context.Cause(ctx)
+	fs.mu.Unlock()
+
+	return ctx.Err()
+}
+
+func (fs *interruptFS) OpInterrupted(
+	ctx context.Context,
+	op interface{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.interrupted = append(fs.interrupted, op)
+}
+
+func TestInterruptBlockedRead(t *testing.T) {
+	fs := &interruptFS{reading: make(chan struct{}, 1)}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{},
+		&fusetesting.FakeKernelConfig{})
+
+	in := fusekernel.ReadIn{Fh: 1, Size: 4096}
+	unique, err := k.Start(
+		fusekernel.OpRead,
+		2,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// Interrupt the read once it is blocked. Returning the context's error
+	// fails it with EINTR.
+	<-fs.reading
+	if err := k.Interrupt(unique); err != nil {
+		t.Fatalf("Interrupt: %v", err)
+	}
+
+	r, err := k.Wait(unique)
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+
+	if r.Error != syscall.EINTR {
+		t.Errorf("Got error %v, want EINTR", r.Error)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.cause != syscall.EINTR {
+		t.Errorf("Got cancellation cause %v", fs.cause)
+	}
+
+	if len(fs.interrupted) != 1 {
+		t.Fatalf("Got interrupts %v", fs.interrupted)
+	}
+
+	if op, ok := fs.interrupted[0].(*fuseops.ReadFileOp); !ok || op.Handle != 1 {
+		t.Errorf("Interrupted op: %#v", fs.interrupted[0])
+	}
+}
+
+// A file system whose reads wait for their context to be cancelled, then
+// succeed.
+type slowReadFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// Closed once the reply to a read has been dealt with.
+	replied chan struct{}
+
+	mu    sync.Mutex
+	cause error
+}
+
+func (fs *slowReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	op.Callback = func() { close(fs.replied) }
+	<-ctx.Done()
+
+	fs.mu.Lock()
+	fs.cause = context.Cause(ctx)
+	fs.mu.Unlock()
+
+	return nil
+}
+
+func TestOpTimeout(t *testing.T) {
+	fs := &slowReadFS{replied: make(chan struct{})}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			OpTimeout:      10 * time.Millisecond,
+			OpTimeoutErrno: syscall.ETIMEDOUT,
+		},
+		&fusetesting.FakeKernelConfig{})
+
+	in := fusekernel.ReadIn{Fh: 1, Size: 4096}
+	r, err := k.Call(
+		fusekernel.OpRead,
+		2,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != syscall.ETIMEDOUT {
+		t.Errorf("Got error %v, want ETIMEDOUT", r.Error)
+	}
+
+	// The file system's own reply is dropped, rather than reaching the kernel
+	// ahead of the reply to the next request.
+	<-fs.replied
+	r, err = k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != syscall.ENOSYS {
+		t.Errorf("Got error %v, want ENOSYS", r.Error)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.cause != syscall.ETIMEDOUT {
+		t.Errorf("Got cancellation cause %v", fs.cause)
+	}
+
+	if got := k.MountedFileSystem().Stats().Errors["ReadFile"]; got != 1 {
+		t.Errorf("Got %d ReadFile errors, want 1", got)
+	}
+}
+
+func TestOpTimeoutNotReached(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{OpTimeout: 10 * time.Millisecond},
+		&fusetesting.FakeKernelConfig{})
+
+	if _, err := k.GetAttributes(1); err != nil {
+		t.Fatalf("GetAttributes: %v", err)
+	}
+
+	// Nothing more is sent once the timer would have fired.
+	time.Sleep(20 * time.Millisecond)
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// A file system whose lookups take a while, then succeed.
+type slowLookUpFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *slowLookUpFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	time.Sleep(30 * time.Millisecond)
+	op.Entry.Child = 17
+	return nil
+}
+
+func TestOpTimeoutExemptsLookUps(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&slowLookUpFS{}),
+		&fuse.MountConfig{OpTimeout: 10 * time.Millisecond},
+		&fusetesting.FakeKernelConfig{})
+
+	// The kernel gets the inode, so it can forget it later.
+	r, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != 0 {
+		t.Errorf("Got error %v", r.Error)
+	}
+}
+
+// A file system whose reads block until released.
+type blockingReadFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingReadFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.reading <- struct{}{}
+	<-fs.release
+	return nil
+}
+
+func TestShutdown(t *testing.T) {
+	fs := &blockingReadFS{
+		reading: make(chan struct{}, 1),
+		release: make(chan struct{}),
+	}
+
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{},
+		&fusetesting.FakeKernelConfig{})
+
+	getattr := func() syscall.Errno {
+		var in fusekernel.GetattrIn
+		r, err := k.Call(
+			fusekernel.OpGetattr,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		return r.Error
+	}
+
+	// Wait for new ops to be turned away, once the shutdown has begun.
+	awaitDraining := func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for getattr() != syscall.ENOTCONN {
+			if time.Now().After(deadline) {
+				t.Fatalf("New ops still being served")
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	in := fusekernel.ReadIn{Fh: 1, Size: 4096}
+	readBody := structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in)))
+
+	// A shutdown that times out while a read is in flight goes back to
+	// serving new ops.
+	unique, err := k.Start(fusekernel.OpRead, 2, readBody)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	<-fs.reading
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = k.MountedFileSystem().Shutdown(ctx)
+	cancel()
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown: %v", err)
+	}
+
+	if errno := getattr(); errno != syscall.ENOSYS {
+		t.Errorf("Getattr after timing out: %v", errno)
+	}
+
+	fs.release <- struct{}{}
+	if r, err := k.Wait(unique); err != nil || r.Error != 0 {
+		t.Fatalf("Wait: %v, %v", err, r.Error)
+	}
+
+	// A shutdown that isn't cut short lets the read in flight finish, and
+	// then waits for the file system to be unmounted.
+	unique, err = k.Start(fusekernel.OpRead, 2, readBody)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	<-fs.reading
+
+	done := make(chan error, 1)
+	go func() {
+		done <- k.MountedFileSystem().Shutdown(context.Background())
+	}()
+
+	awaitDraining()
+
+	fs.release <- struct{}{}
+	if r, err := k.Wait(unique); err != nil || r.Error != 0 {
+		t.Fatalf("Wait: %v, %v", err, r.Error)
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before unmounting: %v", err)
+
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestDeviceQueuesWithoutClone(t *testing.T) {
+	// The fake kernel's socket can't be cloned, so the connection carries on
+	// reading from it alone.
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		&fuse.MountConfig{DeviceQueues: 4},
+		&fusetesting.FakeKernelConfig{})
+
+	var in fusekernel.GetattrIn
+	r, err := k.Call(
+		fusekernel.OpGetattr,
+		1,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != syscall.ENOSYS {
+		t.Errorf("Error: %v, want ENOSYS", r.Error)
+	}
+}
+
+func TestIOUring(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&nopFS{}),
+		&fuse.MountConfig{UseIOUring: true},
+		&fusetesting.FakeKernelConfig{})
+
+	// Requests are read and replies written through the ring, or the device
+	// directly where io_uring is unavailable; either way they round trip.
+	for i := 0; i < 10; i++ {
+		readRoundTrip().run(t, k)
+		writeRoundTrip().run(t, k)
+	}
+}
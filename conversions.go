@@ -26,6 +26,7 @@ import (
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/direntplus"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
@@ -41,7 +42,8 @@ func convertInMessage(
 	config *MountConfig,
 	inMsg *buffer.InMessage,
 	outMsg *buffer.OutMessage,
-	protocol fusekernel.Protocol) (o interface{}, err error) {
+	protocol fusekernel.Protocol,
+	readTime time.Time) (o interface{}, err error) {
 	switch inMsg.Header().Opcode {
 	case fusekernel.OpLookup:
 		buf := inMsg.ConsumeBytes(inMsg.Len())
@@ -54,9 +56,11 @@ func convertInMessage(
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(buf[:n-1]),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -64,9 +68,11 @@ func convertInMessage(
 		o = &fuseops.GetInodeAttributesOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -80,9 +86,11 @@ func convertInMessage(
 		to := &fuseops.SetInodeAttributesOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 		o = to
@@ -120,6 +128,25 @@ func convertInMessage(
 			to.Handle = &t
 		}
 
+	case fusekernel.OpAccess:
+		type input fusekernel.AccessIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpAccess")
+		}
+
+		o = &fuseops.AccessOp{
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			Mask:  in.Mask,
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
 	case fusekernel.OpForget:
 		type input fusekernel.ForgetIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -131,9 +158,11 @@ func convertInMessage(
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			N:     in.Nlookup,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -161,9 +190,11 @@ func convertInMessage(
 		o = &fuseops.BatchForgetOp{
 			Entries: entries,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -192,9 +223,11 @@ func convertInMessage(
 			// ensure that os.ModeDir is set.
 			Mode: ConvertFileMode(in.Mode) | os.ModeDir,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -217,9 +250,11 @@ func convertInMessage(
 			Mode:   ConvertFileMode(in.Mode),
 			Rdev:   in.Rdev,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -241,9 +276,11 @@ func convertInMessage(
 			Name:   string(name),
 			Mode:   ConvertFileMode(in.Mode),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -264,9 +301,11 @@ func convertInMessage(
 			Name:   string(newName),
 			Target: string(target),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -310,9 +349,11 @@ func convertInMessage(
 			NewParent: fuseops.InodeID(in.Newdir),
 			NewName:   string(newName),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -327,9 +368,11 @@ func convertInMessage(
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(buf[:n-1]),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -344,9 +387,11 @@ func convertInMessage(
 			Parent: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:   string(buf[:n-1]),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -361,9 +406,11 @@ func convertInMessage(
 			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
 			OpenFlags: fusekernel.OpenFlags(in.Flags),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -371,9 +418,11 @@ func convertInMessage(
 		o = &fuseops.OpenDirOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -389,9 +438,11 @@ func convertInMessage(
 			Offset: int64(in.Offset),
 			Size:   int64(in.Size),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 		if !config.UseVectoredRead {
@@ -412,9 +463,11 @@ func convertInMessage(
 			Handle: fuseops.HandleID(in.Fh),
 			Offset: fuseops.DirOffset(in.Offset),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 		o = to
@@ -430,6 +483,34 @@ func convertInMessage(
 		sh.Len = readSize
 		sh.Cap = readSize
 
+	case fusekernel.OpReaddirplus:
+		in := (*fusekernel.ReadIn)(inMsg.Consume(fusekernel.ReadInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpReaddirplus")
+		}
+
+		to := &fuseops.ReadDirPlusOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: fuseops.DirOffset(in.Offset),
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+		o = to
+
+		readSize := int(in.Size)
+		p := outMsg.Grow(readSize)
+		if p == nil {
+			return nil, fmt.Errorf("Can't grow for %d-byte read", readSize)
+		}
+
+		to.Dst = unsafe.Slice((*byte)(p), readSize)
+
 	case fusekernel.OpRelease:
 		type input fusekernel.ReleaseIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
@@ -438,11 +519,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.ReleaseFileHandleOp{
-			Handle: fuseops.HandleID(in.Fh),
+			Handle:       fuseops.HandleID(in.Fh),
+			UnlockFlocks: in.ReleaseFlags&fusekernel.ReleaseFlockUnlock != 0,
+			LockOwner:    in.LockOwner,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -456,9 +541,11 @@ func convertInMessage(
 		o = &fuseops.ReleaseDirHandleOp{
 			Handle: fuseops.HandleID(in.Fh),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -469,36 +556,75 @@ func convertInMessage(
 		}
 
 		buf := inMsg.ConsumeBytes(inMsg.Len())
-		if len(buf) < int(in.Size) {
+		if len(buf)+inMsg.PayloadLen() < int(in.Size) {
 			return nil, errors.New("Corrupt OpWrite")
 		}
 
-		o = &fuseops.WriteFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
-			Data:   buf,
-			Offset: int64(in.Offset),
+		// Data left in the pipe it was spliced into is streamed from there.
+		var data []byte
+		if inMsg.PayloadLen() == 0 {
+			data = buf[:in.Size]
+		}
+
+		writeOp := &fuseops.WriteFileOp{
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			Data:      data,
+			Size:      int64(in.Size),
+			Offset:    int64(in.Offset),
+			Writeback: fusekernel.WriteFlags(in.WriteFlags)&fusekernel.WriteCache != 0,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
-	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
+		if protocol.HasReadWriteFlags() {
+			writeOp.OpenFlags = fusekernel.OpenFlags(in.Flags)
+		}
+
+		o = writeOp
+
+	case fusekernel.OpFsync:
 		type input fusekernel.FsyncIn
 		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
 		if in == nil {
-			return nil, errors.New("Corrupt OpFsync/OpFsyncdir")
+			return nil, errors.New("Corrupt OpFsync")
 		}
 
 		o = &fuseops.SyncFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			DataSync: in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpFsyncdir:
+		type input fusekernel.FsyncIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpFsyncdir")
+		}
+
+		o = &fuseops.SyncDirOp{
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			DataSync: in.FsyncFlags&fusekernel.FsyncFdatasync != 0,
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -510,8 +636,11 @@ func convertInMessage(
 		}
 
 		o = &fuseops.SyncFSOp{
-			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
-			OpContext: fuseops.OpContext{Pid: inMsg.Header().Pid},
+			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
+			OpContext: fuseops.OpContext{
+				Pid:      inMsg.Header().Pid,
+				ReadTime: readTime,
+			},
 		}
 
 	case fusekernel.OpFlush:
@@ -522,12 +651,15 @@ func convertInMessage(
 		}
 
 		o = &fuseops.FlushFileOp{
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
-			Handle: fuseops.HandleID(in.Fh),
+			Inode:     fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:    fuseops.HandleID(in.Fh),
+			LockOwner: in.LockOwner,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -535,9 +667,11 @@ func convertInMessage(
 		o = &fuseops.ReadSymlinkOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -590,9 +724,11 @@ func convertInMessage(
 			Name:   string(name),
 			Target: fuseops.InodeID(in.Oldnodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -607,9 +743,11 @@ func convertInMessage(
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			Name:  string(buf[:n-1]),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
@@ -628,12 +766,15 @@ func convertInMessage(
 		name = name[:i]
 
 		to := &fuseops.GetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Position: in.GetPosition(),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 		o = to
@@ -663,9 +804,11 @@ func convertInMessage(
 		to := &fuseops.ListXattrOp{
 			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 		o = to
@@ -688,27 +831,27 @@ func convertInMessage(
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
+		// The payload is "name\x00value", where the value may be empty.
 		payload := inMsg.ConsumeBytes(inMsg.Len())
-		// payload should be "name\x00value"
-		if len(payload) < 3 {
-			return nil, errors.New("Corrupt OpSetxattr")
-		}
 		i := bytes.IndexByte(payload, '\x00')
-		if i < 0 {
+		if i < 0 || uint64(len(payload)-i-1) < uint64(in.Size) {
 			return nil, errors.New("Corrupt OpSetxattr")
 		}
 
-		name, value := payload[:i], payload[i+1:len(payload)]
+		name, value := payload[:i], payload[i+1:i+1+int(in.Size)]
 
 		o = &fuseops.SetXattrOp{
-			Inode: fuseops.InodeID(inMsg.Header().Nodeid),
-			Name:  string(name),
-			Value: value,
-			Flags: in.Flags,
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Name:     string(name),
+			Value:    value,
+			Flags:    in.Flags,
+			Position: in.GetPosition(),
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 	case fusekernel.OpFallocate:
@@ -725,16 +868,182 @@ func convertInMessage(
 			Length: in.Length,
 			Mode:   in.Mode,
 			OpContext: fuseops.OpContext{
-				FuseID: inMsg.Header().Unique,
-				Pid:    inMsg.Header().Pid,
-				Uid:    inMsg.Header().Uid,
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpLseek:
+		type input fusekernel.LseekIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpLseek")
+		}
+
+		o = &fuseops.SeekOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Offset: int64(in.Offset),
+			Whence: int(in.Whence),
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpCopyFileRange:
+		type input fusekernel.CopyFileRangeIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpCopyFileRange")
+		}
+
+		o = &fuseops.CopyFileRangeOp{
+			SrcInode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			SrcHandle: fuseops.HandleID(in.FhIn),
+			SrcOffset: in.OffIn,
+			DstInode:  fuseops.InodeID(in.NodeidOut),
+			DstHandle: fuseops.HandleID(in.FhOut),
+			DstOffset: in.OffOut,
+			Length:    in.Len,
+			Flags:     in.Flags,
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpGetlk:
+		type input fusekernel.LkIn
+		in := (*input)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, errors.New("Corrupt OpGetlk")
+		}
+
+		o = &fuseops.GetLockOp{
+			Inode:    fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:   fuseops.HandleID(in.Fh),
+			Owner:    in.Owner,
+			Lock:     fuseops.FileLock(in.Lk),
+			Conflict: fuseops.FileLock{Type: syscall.F_UNLCK},
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		type input fusekernel.LkIn
+		in := (*input)(inMsg.Consume(fusekernel.LkInSize(protocol)))
+		if in == nil {
+			return nil, fmt.Errorf("Corrupt opcode %d", inMsg.Header().Opcode)
+		}
+
+		// flock(2) is sent as a lock on the whole file, flagged as such.
+		if in.LkFlags&fusekernel.LkFlock != 0 {
+			o = &fuseops.FlockOp{
+				Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+				Handle: fuseops.HandleID(in.Fh),
+				Owner:  in.Owner,
+				Type:   in.Lk.Type,
+				Wait:   inMsg.Header().Opcode == fusekernel.OpSetlkw,
+				OpContext: fuseops.OpContext{
+					FuseID:   inMsg.Header().Unique,
+					Pid:      inMsg.Header().Pid,
+					Uid:      inMsg.Header().Uid,
+					Gid:      inMsg.Header().Gid,
+					ReadTime: readTime,
+				},
+			}
+
+			break
+		}
+
+		o = &fuseops.SetLockOp{
+			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle: fuseops.HandleID(in.Fh),
+			Owner:  in.Owner,
+			Lock:   fuseops.FileLock(in.Lk),
+			Wait:   inMsg.Header().Opcode == fusekernel.OpSetlkw,
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpIoctl:
+		type input fusekernel.IoctlIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpIoctl")
+		}
+
+		data := inMsg.ConsumeBytes(uintptr(in.InSize))
+		if len(data) < int(in.InSize) {
+			return nil, errors.New("Corrupt OpIoctl: not enough data")
+		}
+
+		o = &fuseops.IoctlOp{
+			Inode:        fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:       fuseops.HandleID(in.Fh),
+			Dir:          in.Flags&fusekernel.IoctlDir != 0,
+			Cmd:          in.Cmd,
+			Arg:          in.Arg,
+			Compat:       in.Flags&(fusekernel.IoctlCompat|fusekernel.IoctlCompatX32) != 0,
+			Unrestricted: in.Flags&fusekernel.IoctlUnrestricted != 0,
+			Input:        data,
+			OutputSize:   int(in.OutSize),
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
+			},
+		}
+
+	case fusekernel.OpPoll:
+		type input fusekernel.PollIn
+		in := (*input)(inMsg.Consume(unsafe.Sizeof(input{})))
+		if in == nil {
+			return nil, errors.New("Corrupt OpPoll")
+		}
+
+		o = &fuseops.PollOp{
+			Inode:          fuseops.InodeID(inMsg.Header().Nodeid),
+			Handle:         fuseops.HandleID(in.Fh),
+			Events:         in.Events,
+			ScheduleNotify: in.Flags&fusekernel.PollScheduleNotify != 0,
+			PollHandle:     in.Kh,
+			OpContext: fuseops.OpContext{
+				FuseID:   inMsg.Header().Unique,
+				Pid:      inMsg.Header().Pid,
+				Uid:      inMsg.Header().Uid,
+				Gid:      inMsg.Header().Gid,
+				ReadTime: readTime,
 			},
 		}
 
 	default:
 		o = &unknownOp{
-			OpCode: inMsg.Header().Opcode,
-			Inode:  fuseops.InodeID(inMsg.Header().Nodeid),
+			OpCode:  inMsg.Header().Opcode,
+			Inode:   fuseops.InodeID(inMsg.Header().Nodeid),
+			Payload: inMsg.ConsumeBytes(inMsg.Len()),
 		}
 	}
 
@@ -774,10 +1083,7 @@ func (c *Connection) kernelResponse(
 		handled := false
 
 		if !handled {
-			m.OutHeader().Error = -int32(syscall.EIO)
-			if errno, ok := opErr.(syscall.Errno); ok {
-				m.OutHeader().Error = -int32(errno)
-			}
+			m.OutHeader().Error = -int32(c.errnoForError(op, opErr))
 
 			// Special case: for some types, convertInMessage grew the message in order
 			// to obtain a destination buffer. Make sure that we shrink back to just
@@ -797,6 +1103,26 @@ func (c *Connection) kernelResponse(
 	return false
 }
 
+// Choose the errno with which to fail the op, given the non-nil error the
+// user replied with.
+func (c *Connection) errnoForError(op interface{}, err error) syscall.Errno {
+	if errno, ok := err.(syscall.Errno); ok {
+		return errno
+	}
+
+	if c.cfg.MapError != nil {
+		if errno := c.cfg.MapError(op, err); errno != 0 {
+			return errno
+		}
+	}
+
+	if errno := StandardErrno(err); errno != 0 {
+		return errno
+	}
+
+	return syscall.EIO
+}
+
 // Like kernelResponse, but assumes the user replied with a nil error to the
 // op.
 func (c *Connection) kernelResponseForOp(
@@ -807,50 +1133,61 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.LookUpInodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convertChildInodeEntry(&o.Entry, c.now(), out)
 
 	case *fuseops.GetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
 		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
+			o.AttributesExpiration,
+			c.now())
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
 	case *fuseops.SetInodeAttributesOp:
 		size := int(fusekernel.AttrOutSize(c.protocol))
 		out := (*fusekernel.AttrOut)(m.Grow(size))
 		out.AttrValid, out.AttrValidNsec = convertExpirationTime(
-			o.AttributesExpiration)
+			o.AttributesExpiration,
+			c.now())
 		convertAttributes(o.Inode, &o.Attributes, &out.Attr)
 
+	case *fuseops.AccessOp:
+		// Empty response
+
 	case *fuseops.MkDirOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convertChildInodeEntry(&o.Entry, c.now(), out)
 
 	case *fuseops.MkNodeOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convertChildInodeEntry(&o.Entry, c.now(), out)
 
 	case *fuseops.CreateFileOp:
 		eSize := int(fusekernel.EntryOutSize(c.protocol))
 
 		e := (*fusekernel.EntryOut)(m.Grow(eSize))
-		convertChildInodeEntry(&o.Entry, e)
+		convertChildInodeEntry(&o.Entry, c.now(), e)
 
 		oo := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		oo.Fh = uint64(o.Handle)
+		oo.OpenFlags = uint32(c.openFileFlags(
+			false,
+			o.UseDirectIO,
+			o.NonSeekable,
+			o.Stream,
+			o.ParallelDirectWrites))
 
 	case *fuseops.CreateSymlinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convertChildInodeEntry(&o.Entry, c.now(), out)
 
 	case *fuseops.CreateLinkOp:
 		size := int(fusekernel.EntryOutSize(c.protocol))
 		out := (*fusekernel.EntryOut)(m.Grow(size))
-		convertChildInodeEntry(&o.Entry, out)
+		convertChildInodeEntry(&o.Entry, c.now(), out)
 
 	case *fuseops.RenameOp:
 		// Empty response
@@ -879,32 +1216,53 @@ func (c *Connection) kernelResponseForOp(
 		// much the user read.
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
+	case *fuseops.ReadDirPlusOp:
+		// As for ReadDirOp, except that the children's entries were left by
+		// fuseutil.WriteDirentPlus for us to convert.
+		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
+
+		now := c.now()
+		forEachDirentPlus(o.Dst[:o.BytesRead], func(d *fusekernel.DirentPlus, name string) {
+			if d.Entry.Nodeid == 0 {
+				return
+			}
+
+			e := decodeDirentPlusEntry(d)
+			d.Entry = fusekernel.EntryOut{}
+			convertChildInodeEntry(&e, now, &d.Entry)
+		})
+
+	case *fuseops.SyncDirOp:
+		// Empty response
+
 	case *fuseops.ReleaseDirHandleOp:
 		// Empty response
 
 	case *fuseops.OpenFileOp:
 		out := (*fusekernel.OpenOut)(m.Grow(int(unsafe.Sizeof(fusekernel.OpenOut{}))))
 		out.Fh = uint64(o.Handle)
-
-		if o.KeepPageCache {
-			out.OpenFlags |= uint32(fusekernel.OpenKeepCache)
-		}
-
-		if o.UseDirectIO {
-			out.OpenFlags |= uint32(fusekernel.OpenDirectIO)
-		}
+		out.OpenFlags = uint32(c.openFileFlags(
+			o.KeepPageCache,
+			o.UseDirectIO,
+			o.NonSeekable,
+			o.Stream,
+			o.ParallelDirectWrites))
 
 	case *fuseops.ReadFileOp:
-		if o.Dst != nil {
-			m.Append(o.Dst)
-		} else {
+		// Data is sent as is, even if the file system was handed Dst.
+		if o.Data != nil {
 			m.Append(o.Data...)
+		} else {
+			m.Append(o.Dst)
 		}
 		m.ShrinkTo(buffer.OutMessageHeaderSize + o.BytesRead)
 
 	case *fuseops.WriteFileOp:
 		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
-		out.Size = uint32(len(o.Data))
+		out.Size = uint32(o.Size)
+		if o.BytesWritten > 0 && int64(o.BytesWritten) < o.Size {
+			out.Size = uint32(o.BytesWritten)
+		}
 
 	case *fuseops.SyncFileOp:
 		// Empty response
@@ -981,6 +1339,59 @@ func (c *Connection) kernelResponseForOp(
 	case *fuseops.FallocateOp:
 		// Empty response
 
+	case *fuseops.SeekOp:
+		out := (*fusekernel.LseekOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LseekOut{}))))
+		out.Offset = uint64(o.ResultOffset)
+
+	case *fuseops.CopyFileRangeOp:
+		n := o.BytesCopied
+		if n > o.Length {
+			n = o.Length
+		}
+
+		out := (*fusekernel.WriteOut)(m.Grow(int(unsafe.Sizeof(fusekernel.WriteOut{}))))
+		out.Size = uint32(n)
+
+	case *fuseops.GetLockOp:
+		out := (*fusekernel.LkOut)(m.Grow(int(unsafe.Sizeof(fusekernel.LkOut{}))))
+		out.Lk = fusekernel.FileLock(o.Conflict)
+
+	case *fuseops.SetLockOp:
+		// Empty response
+
+	case *fuseops.FlockOp:
+		// Empty response
+
+	case *fuseops.IoctlOp:
+		out := (*fusekernel.IoctlOut)(m.Grow(int(unsafe.Sizeof(fusekernel.IoctlOut{}))))
+		if o.Retry {
+			out.Flags = fusekernel.IoctlRetry
+			out.InIovs = uint32(len(o.RetryInput))
+			out.OutIovs = uint32(len(o.RetryOutput))
+			for _, iovs := range [][]fuseops.IoctlIovec{o.RetryInput, o.RetryOutput} {
+				if len(iovs) != 0 {
+					size := len(iovs) * int(unsafe.Sizeof(iovs[0]))
+					m.Append(unsafe.Slice((*byte)(unsafe.Pointer(&iovs[0])), size))
+				}
+			}
+
+			break
+		}
+
+		out.Result = o.Result
+		output := o.Output
+		if len(output) > o.OutputSize {
+			output = output[:o.OutputSize]
+		}
+
+		if len(output) != 0 {
+			m.Append(output)
+		}
+
+	case *fuseops.PollOp:
+		out := (*fusekernel.PollOut)(m.Grow(int(unsafe.Sizeof(fusekernel.PollOut{}))))
+		out.Revents = o.Revents
+
 	case *fuseops.SyncFSOp:
 		// Empty response
 
@@ -998,6 +1409,10 @@ func (c *Connection) kernelResponseForOp(
 		out.TimeGran = 1
 		out.MaxPages = o.MaxPages
 
+	case *unknownOp:
+		// The response was written by MountConfig.UnknownOpHandler or a raw op
+		// handler.
+
 	default:
 		panic(fmt.Sprintf("Unexpected op: %#v", op))
 	}
@@ -1005,6 +1420,40 @@ func (c *Connection) kernelResponseForOp(
 	return
 }
 
+// Return the flags with which to reply to an open or create, for the
+// per-handle choices that the file system made.
+func (c *Connection) openFileFlags(
+	keepPageCache bool,
+	useDirectIO bool,
+	nonSeekable bool,
+	stream bool,
+	parallelDirectWrites bool) fusekernel.OpenResponseFlags {
+	var flags fusekernel.OpenResponseFlags
+	if keepPageCache {
+		flags |= fusekernel.OpenKeepCache
+	}
+
+	if useDirectIO || c.cfg.UseDirectIO {
+		flags |= fusekernel.OpenDirectIO
+	}
+
+	// Kernels that don't know about streams treat the flag as unset, so fall
+	// back to the nearest thing they do know about.
+	if (nonSeekable || stream) && c.protocol.HasOpenNonSeekable() {
+		flags |= fusekernel.OpenNonSeekable
+	}
+
+	if stream {
+		flags |= fusekernel.OpenStream
+	}
+
+	if parallelDirectWrites {
+		flags |= fusekernel.OpenParallelDirectWrites
+	}
+
+	return flags
+}
+
 ////////////////////////////////////////////////////////////////////////
 // General conversions
 ////////////////////////////////////////////////////////////////////////
@@ -1035,20 +1484,22 @@ func convertAttributes(
 	// Set the mode.
 	out.Mode = ConvertGoMode(in.Mode)
 
-	if out.Mode&(syscall.S_IFCHR|syscall.S_IFBLK) != 0 {
+	// Only device nodes have device numbers.
+	switch out.Mode & syscall.S_IFMT {
+	case syscall.S_IFCHR, syscall.S_IFBLK:
 		out.Rdev = in.Rdev
 	}
 }
 
 // Convert an absolute cache expiration time to a relative time from now for
 // consumption by the fuse kernel module.
-func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
+func convertExpirationTime(t time.Time, now time.Time) (secs uint64, nsecs uint32) {
 	// Fuse represents durations as unsigned 64-bit counts of seconds and 32-bit
 	// counts of nanoseconds (https://tinyurl.com/4muvkr6k). So negative
 	// durations are right out. There is no need to cap the positive magnitude,
 	// because 2^64 seconds is well longer than the 2^63 ns range of
 	// time.Duration.
-	d := t.Sub(time.Now())
+	d := t.Sub(now)
 	if d > 0 {
 		secs = uint64(d / time.Second)
 		nsecs = uint32((d % time.Second) / time.Nanosecond)
@@ -1059,15 +1510,44 @@ func convertExpirationTime(t time.Time) (secs uint64, nsecs uint32) {
 
 func convertChildInodeEntry(
 	in *fuseops.ChildInodeEntry,
+	now time.Time,
 	out *fusekernel.EntryOut) {
 	out.Nodeid = uint64(in.Child)
 	out.Generation = uint64(in.Generation)
-	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration)
-	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration)
+	out.EntryValid, out.EntryValidNsec = convertExpirationTime(in.EntryExpiration, now)
+	out.AttrValid, out.AttrValidNsec = convertExpirationTime(in.AttributesExpiration, now)
 
 	convertAttributes(in.Child, &in.Attributes, &out.Attr)
 }
 
+// Call f for each of the entries that fuseutil.WriteDirentPlus wrote to the
+// start of b, in order, along with its name.
+func forEachDirentPlus(b []byte, f func(d *fusekernel.DirentPlus, name string)) {
+	for len(b) >= fusekernel.DirentPlusSize {
+		d := (*fusekernel.DirentPlus)(unsafe.Pointer(&b[0]))
+		end := fusekernel.DirentPlusSize + int(d.Dirent.Namelen)
+		if end > len(b) {
+			return
+		}
+
+		f(d, string(b[fusekernel.DirentPlusSize:end]))
+
+		// Entries are padded to a multiple of 8 bytes.
+		padded := (end + 7) &^ 7
+		if padded > len(b) {
+			padded = len(b)
+		}
+
+		b = b[padded:]
+	}
+}
+
+// Return the child's entry that fuseutil.WriteDirentPlus left in the supplied
+// READDIRPLUS entry, which must have a non-zero node ID.
+func decodeDirentPlusEntry(d *fusekernel.DirentPlus) fuseops.ChildInodeEntry {
+	return direntplus.Decode((*direntplus.Entry)(unsafe.Pointer(&d.Entry)))
+}
+
 // ConvertFileMode returns an os.FileMode with the Go mode and permission bits
 // set according to the Linux mode and permission bits.
 func ConvertFileMode(unixMode uint32) os.FileMode {
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package daemonize lets a command-line tool mount a file system in the
+// background: the tool starts a copy of itself, or some other program, as a
+// daemon that mounts and serves the file system, and waits for the daemon to
+// report whether mounting worked before exiting with the result.
+//
+// In the tool:
+//
+//	err := daemonize.Run(os.Args[0], append(os.Args[1:], "--foreground"), nil, os.Stderr)
+//	if err != nil {
+//		log.Fatalf("Mounting: %v", err)
+//	}
+//
+// In the daemon, once fuse.Mount has returned:
+//
+//	daemonize.SignalOutcome(err)
+//
+// Go programs can't fork without exec'ing, so the daemon is always a new
+// process, told how to reach its parent through an inherited pipe named in
+// its environment.
+package daemonize
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// The environment variable through which a daemon learns the descriptor of
+// the pipe to its parent.
+const envVar = "FUSE_DAEMONIZE_STATUS_FD"
+
+// A message from the daemon to its parent.
+type message struct {
+	// Output for the parent's status writer, if not empty.
+	Status []byte
+
+	// Set for the final message, which carries the outcome: the text of the
+	// daemon's error, or empty for success.
+	Done    bool
+	Outcome string
+}
+
+// ErrNoOutcome is wrapped by the error that Run and Start return when the
+// daemon exits, or closes its end of the pipe, without calling
+// SignalOutcome.
+var ErrNoOutcome = errors.New("Daemon exited without signalling an outcome")
+
+////////////////////////////////////////////////////////////////////////
+// Parent
+////////////////////////////////////////////////////////////////////////
+
+// Run starts the program at path with the given arguments as a daemon, and
+// waits for it to call SignalOutcome, returning the error it passed. The
+// daemon runs in a new session, detached from the caller's terminal, with its
+// standard input, output, and error directed to /dev/null. If env is nil,
+// the daemon inherits the caller's environment.
+//
+// Until the daemon signals its outcome, whatever it writes to StatusWriter is
+// copied to status, if not nil, so that it can report progress or explain a
+// failure.
+func Run(
+	path string,
+	args []string,
+	env []string,
+	status io.Writer) error {
+	cmd := exec.Command(path, args...)
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	err := Start(cmd, status)
+	if errors.Is(err, ErrNoOutcome) {
+		return fmt.Errorf("%w: %v", err, cmd.Wait())
+	}
+
+	// The daemon carries on without us.
+	if cmd.Process != nil {
+		cmd.Process.Release()
+	}
+
+	return err
+}
+
+// Start is like Run, but takes a command that the caller has set up, for
+// example with files to inherit or somewhere to send its standard error,
+// and doesn't detach it. The descriptor for the pipe to the daemon is added
+// after the command's ExtraFiles. The command is left running, and it is up
+// to the caller to wait for it.
+func Start(cmd *exec.Cmd, status io.Writer) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("Pipe: %w", err)
+	}
+
+	defer r.Close()
+
+	// Cf. os/exec.Cmd.ExtraFiles
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w)
+	fd := 2 + len(cmd.ExtraFiles)
+
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+
+	cmd.Env = append(env[:len(env):len(env)], envVar+"="+strconv.Itoa(fd))
+
+	// Close our copy of the write end once the daemon has its own, so that we
+	// see EOF if it exits early.
+	err = cmd.Start()
+	w.Close()
+
+	if err != nil {
+		return fmt.Errorf("Start: %w", err)
+	}
+
+	return readOutcome(r, status)
+}
+
+// Copy status messages from the daemon until it signals its outcome.
+func readOutcome(r io.Reader, status io.Writer) error {
+	dec := gob.NewDecoder(r)
+	for {
+		var m message
+		err := dec.Decode(&m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrNoOutcome
+		}
+
+		if err != nil {
+			return fmt.Errorf("Decode: %w", err)
+		}
+
+		if len(m.Status) != 0 && status != nil {
+			status.Write(m.Status)
+		}
+
+		if !m.Done {
+			continue
+		}
+
+		if m.Outcome != "" {
+			return errors.New(m.Outcome)
+		}
+
+		return nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Daemon
+////////////////////////////////////////////////////////////////////////
+
+// StatusWriter sends whatever is written to it to the status writer of the
+// parent that started this process with Run or Start, until SignalOutcome is
+// called. Writes are silently discarded if this process wasn't started that
+// way, or has already signalled its outcome.
+var StatusWriter io.Writer = statusWriter{}
+
+type statusWriter struct{}
+
+func (statusWriter) Write(p []byte) (int, error) {
+	send(message{Status: p})
+	return len(p), nil
+}
+
+var parent struct {
+	mu sync.Mutex
+
+	// Whether we have looked for the pipe to the parent, and what we found.
+	//
+	// GUARDED_BY(mu)
+	opened bool
+	f      *os.File
+	enc    *gob.Encoder
+}
+
+// Send a message to the parent, if there is one, returning an error if there
+// isn't.
+//
+// LOCKS_EXCLUDED(parent.mu)
+func send(m message) error {
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.opened {
+		parent.opened = true
+
+		// Don't let processes that we start mistake the pipe for theirs.
+		fd, err := strconv.Atoi(os.Getenv(envVar))
+		os.Unsetenv(envVar)
+
+		if err == nil {
+			parent.f = os.NewFile(uintptr(fd), "(daemonize pipe)")
+			parent.enc = gob.NewEncoder(parent.f)
+		}
+	}
+
+	if parent.f == nil {
+		return fmt.Errorf("Not started by daemonize, or outcome already signalled")
+	}
+
+	if err := parent.enc.Encode(m); err != nil {
+		return fmt.Errorf("Encode: %w", err)
+	}
+
+	if m.Done {
+		parent.f.Close()
+		parent.f = nil
+	}
+
+	return nil
+}
+
+// SignalOutcome tells the parent that started this process with Run or Start
+// that the daemon has either started successfully, if outcome is nil, or
+// failed with the supplied error, which the parent then returns. It returns
+// an error if this process wasn't started that way, or has already signalled
+// its outcome.
+func SignalOutcome(outcome error) error {
+	m := message{Done: true}
+	if outcome != nil {
+		m.Outcome = outcome.Error()
+	}
+
+	return send(m)
+}
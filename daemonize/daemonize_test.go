@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package daemonize_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/daemonize"
+)
+
+// When set, the test binary acts as a daemon instead of running tests, doing
+// what the variable's value says.
+const helperEnvVar = "DAEMONIZE_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	switch os.Getenv(helperEnvVar) {
+	case "":
+		os.Exit(m.Run())
+
+	case "succeed":
+		fmt.Fprint(daemonize.StatusWriter, "mounting\n")
+		if err := daemonize.SignalOutcome(nil); err != nil {
+			os.Exit(1)
+		}
+
+		// Signalling twice fails.
+		if err := daemonize.SignalOutcome(nil); err == nil {
+			os.Exit(1)
+		}
+
+	case "fail":
+		daemonize.SignalOutcome(errors.New("taco"))
+
+	case "exit":
+		os.Exit(17)
+	}
+
+	os.Exit(0)
+}
+
+// Start the test binary as a daemon that does the supplied thing.
+func runHelper(what string, status *bytes.Buffer) error {
+	env := append(os.Environ(), helperEnvVar+"="+what)
+	return daemonize.Run(os.Args[0], nil, env, status)
+}
+
+func TestSuccess(t *testing.T) {
+	var status bytes.Buffer
+	if err := runHelper("succeed", &status); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if got := status.String(); got != "mounting\n" {
+		t.Errorf("Got status %q", got)
+	}
+}
+
+func TestFailure(t *testing.T) {
+	err := runHelper("fail", nil)
+	if err == nil || err.Error() != "taco" {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestExitWithoutOutcome(t *testing.T) {
+	err := runHelper("exit", nil)
+	if !errors.Is(err, daemonize.ErrNoOutcome) || !strings.Contains(err.Error(), "17") {
+		t.Errorf("Run: %v", err)
+	}
+}
+
+func TestStartWithExtraFiles(t *testing.T) {
+	// The pipe comes after the caller's files, which keep their numbers.
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), helperEnvVar+"=succeed")
+	cmd.ExtraFiles = []*os.File{f}
+
+	if err := daemonize.Start(cmd, nil); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+}
+
+func TestSignalOutcomeWithoutParent(t *testing.T) {
+	if err := daemonize.SignalOutcome(nil); err == nil {
+		t.Errorf("SignalOutcome succeeded without a parent")
+	}
+}
@@ -86,6 +86,9 @@ func describeRequest(op interface{}) (s string) {
 			addComponent("mtime %v", *typed.Mtime)
 		}
 
+	case *fuseops.AccessOp:
+		addComponent("mask %#o", typed.Mask)
+
 	case *fuseops.RenameOp:
 		addComponent("old_parent %v", typed.OldParent)
 		addComponent("old_name %q", typed.OldName)
@@ -100,7 +103,25 @@ func describeRequest(op interface{}) (s string) {
 	case *fuseops.WriteFileOp:
 		addComponent("handle %d", typed.Handle)
 		addComponent("offset %d", typed.Offset)
-		addComponent("%d bytes", len(typed.Data))
+		addComponent("%d bytes", typed.Size)
+
+		if typed.Writeback {
+			addComponent("writeback")
+		}
+
+	case *fuseops.SyncFileOp:
+		addComponent("handle %d", typed.Handle)
+
+		if typed.DataSync {
+			addComponent("datasync")
+		}
+
+	case *fuseops.SyncDirOp:
+		addComponent("handle %d", typed.Handle)
+
+		if typed.DataSync {
+			addComponent("datasync")
+		}
 
 	case *fuseops.RemoveXattrOp:
 		addComponent("name %s", typed.Name)
@@ -116,8 +137,63 @@ func describeRequest(op interface{}) (s string) {
 		addComponent("length %d", typed.Length)
 		addComponent("mode %d", typed.Mode)
 
+	case *fuseops.SeekOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("offset %d", typed.Offset)
+		addComponent("whence %d", typed.Whence)
+
+	case *fuseops.GetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("lock %s", describeLock(typed.Lock))
+
+	case *fuseops.SetLockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("lock %s", describeLock(typed.Lock))
+		if typed.Wait {
+			addComponent("wait")
+		}
+
+	case *fuseops.FlockOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.Owner)
+		addComponent("type %d", typed.Type)
+		if typed.Wait {
+			addComponent("wait")
+		}
+
+	case *fuseops.IoctlOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("cmd %#x", typed.Cmd)
+		addComponent("%d bytes in", len(typed.Input))
+		addComponent("%d bytes out", typed.OutputSize)
+
+	case *fuseops.PollOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("events %#x", typed.Events)
+		if typed.ScheduleNotify {
+			addComponent("notify %#x", typed.PollHandle)
+		}
+
+	case *fuseops.CopyFileRangeOp:
+		addComponent("from inode %v", typed.SrcInode)
+		addComponent("handle %d", typed.SrcHandle)
+		addComponent("offset %d", typed.SrcOffset)
+		addComponent("to inode %v", typed.DstInode)
+		addComponent("handle %d", typed.DstHandle)
+		addComponent("offset %d", typed.DstOffset)
+		addComponent("length %d", typed.Length)
+
+	case *fuseops.FlushFileOp:
+		addComponent("handle %d", typed.Handle)
+		addComponent("owner %#x", typed.LockOwner)
+
 	case *fuseops.ReleaseFileHandleOp:
 		addComponent("handle %d", typed.Handle)
+		if typed.UnlockFlocks {
+			addComponent("unlock flocks of %#x", typed.LockOwner)
+		}
 	}
 
 	// Use just the name if there is no extra info.
@@ -147,7 +223,35 @@ func describeResponse(op interface{}) string {
 	switch typed := op.(type) {
 	case *fuseops.OpenFileOp:
 		addComponent("handle %d", typed.Handle)
+
+	case *fuseops.WriteFileOp:
+		if typed.BytesWritten != 0 {
+			addComponent("%d bytes written", typed.BytesWritten)
+		}
+
+	case *fuseops.SeekOp:
+		addComponent("offset %d", typed.ResultOffset)
+
+	case *fuseops.GetLockOp:
+		addComponent("conflict %s", describeLock(typed.Conflict))
+
+	case *fuseops.IoctlOp:
+		if typed.Retry {
+			addComponent("retry with %d+%d regions", len(typed.RetryInput), len(typed.RetryOutput))
+		} else {
+			addComponent("result %d", typed.Result)
+		}
+
+	case *fuseops.PollOp:
+		addComponent("revents %#x", typed.Revents)
+
+	case *fuseops.CopyFileRangeOp:
+		addComponent("%d bytes copied", typed.BytesCopied)
 	}
 
 	return fmt.Sprintf("%s (%s)", opName(op), strings.Join(components, ", "))
 }
+
+func describeLock(lk fuseops.FileLock) string {
+	return fmt.Sprintf("type %d [%d, %d] pid %d", lk.Type, lk.Start, lk.End, lk.Pid)
+}
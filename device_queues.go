@@ -0,0 +1,95 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// An op read from one of the connection's queues, or the error that ended
+// reading from it, waiting for ReadOp.
+type queuedOp struct {
+	ctx context.Context
+	op  interface{}
+	err error
+}
+
+// Clone the device for each queue after the first that cfg.DeviceQueues asks
+// for, and start reading from all of them. If cloning fails, carry on with
+// the queues we have.
+func (c *Connection) startQueues() {
+	for len(c.queues)+1 < c.cfg.DeviceQueues {
+		dev, err := cloneDevice(c.dev)
+		if err != nil {
+			c.logError(
+				fmt.Sprintf("Reading from %d of %d queues", len(c.queues)+1, c.cfg.DeviceQueues),
+				err)
+
+			break
+		}
+
+		c.queues = append(c.queues, dev)
+	}
+
+	if len(c.queues) == 0 {
+		return
+	}
+
+	c.readQueues()
+}
+
+// Start a reader for dev and for each of its clones in c.queues.
+func (c *Connection) readQueues() {
+	c.queuedOps = make(chan queuedOp)
+	c.stopQueues = make(chan struct{})
+
+	go c.readQueue(c.dev)
+	for _, dev := range c.queues {
+		go c.readQueue(dev)
+	}
+}
+
+// Hand the ops read from the supplied device to ReadOp, until reading fails
+// or the connection is closed.
+func (c *Connection) readQueue(dev *os.File) {
+	for {
+		ctx, op, err := c.readOp(dev)
+
+		select {
+		case c.queuedOps <- queuedOp{ctx, op, err}:
+		case <-c.stopQueues:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Stop the readers, and close the clones of the device. Readers that are
+// blocked reading give up once the kernel hangs up.
+func (c *Connection) closeQueues() {
+	if c.stopQueues == nil {
+		return
+	}
+
+	close(c.stopQueues)
+	for _, dev := range c.queues {
+		dev.Close()
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func Test_cloneDevice(t *testing.T) {
+	// Only /dev/fuse descriptors can be cloned.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+
+	defer r.Close()
+	defer w.Close()
+
+	dev, err := cloneDevice(r)
+	if err == nil {
+		dev.Close()
+		t.Fatalf("expected an error, got nil")
+	}
+}
+
+func Test_readQueues(t *testing.T) {
+	// Stand in for a device and one clone with a socket each, keeping the
+	// kernel's ends.
+	var kernel []int
+	var devs []*os.File
+	for i := 0; i < 2; i++ {
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+		if err != nil {
+			t.Fatalf("Socketpair: %v", err)
+		}
+
+		kernel = append(kernel, fds[0])
+		devs = append(devs, os.NewFile(uintptr(fds[1]), "(device)"))
+	}
+
+	c := &Connection{
+		cfg:         MountConfig{OpContext: context.Background()},
+		dev:         devs[0],
+		queues:      devs[1:],
+		protocol:    fusekernel.Protocol{Major: 7, Minor: 31},
+		cancelFuncs: make(map[uint64]opCancel),
+		stats:       newConnectionStats(),
+	}
+
+	c.readQueues()
+
+	defer func() {
+		for _, fd := range kernel {
+			syscall.Close(fd)
+		}
+
+		c.close()
+	}()
+
+	// Send a request on each queue, with the queue's index as its ID.
+	for i, fd := range kernel {
+		var msg struct {
+			h  fusekernel.InHeader
+			in fusekernel.GetattrIn
+		}
+
+		msg.h = fusekernel.InHeader{
+			Len:    uint32(unsafe.Sizeof(msg)),
+			Opcode: fusekernel.OpGetattr,
+			Unique: uint64(i),
+			Nodeid: 1,
+		}
+
+		b := unsafe.Slice((*byte)(unsafe.Pointer(&msg)), unsafe.Sizeof(msg))
+		if _, err := syscall.Write(fd, b); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// Both reach ReadOp, in either order.
+	for range kernel {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			t.Fatalf("ReadOp: %v", err)
+		}
+
+		if _, ok := op.(*fuseops.GetInodeAttributesOp); !ok {
+			t.Fatalf("ReadOp returned %T", op)
+		}
+
+		if err := c.Reply(ctx, syscall.ENOENT); err != nil {
+			t.Fatalf("Reply: %v", err)
+		}
+	}
+
+	// Each reply goes back on the queue its request came from.
+	for i, fd := range kernel {
+		var out fusekernel.OutHeader
+		b := unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out))
+		if _, err := syscall.Read(fd, b); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+
+		if out.Unique != uint64(i) {
+			t.Errorf("Reply on queue %d has ID %d", i, out.Unique)
+		}
+
+		if out.Error != -int32(syscall.ENOENT) {
+			t.Errorf("Reply on queue %d has error %d", i, out.Error)
+		}
+	}
+}
@@ -26,6 +26,12 @@
 //
 //   - Mount, a function that allows for mounting a Server as a file system.
 //
+// Mount and Unmount return errors that wrap the syscall.Errno responsible for
+// a failure where one is known, so that callers can check for conditions like
+// syscall.EBUSY with errors.Is. For failures reported by a helper such as
+// fusermount(1), the errno is recovered from the helper's output on a
+// best-effort basis.
+//
 // Make sure to see the examples in the sub-packages of samples/, which double
 // as tests for this package: http://godoc.org/github.com/jacobsa/fuse/samples
 //
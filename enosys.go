@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// KernelCachesENOSYS reports whether failing an op like the supplied one with
+// ENOSYS makes the Linux kernel stop sending ops of its kind for the rest of
+// the mount, so that a file system without support for them costs nothing
+// beyond the first. The kernel then handles them itself:
+//
+//   - AccessOp, FlushFileOp, SyncFileOp, SyncDirOp and SyncFSOp succeed.
+//   - GetXattrOp, ListXattrOp, SetXattrOp and RemoveXattrOp fail with
+//     EOPNOTSUPP, each remembered separately.
+//   - CreateFileOp falls back to MkNodeOp followed by OpenFileOp.
+//   - FallocateOp fails with EOPNOTSUPP.
+//   - SeekOp, CopyFileRangeOp and PollOp fall back to generic behaviour.
+//
+// OpenFileOp and OpenDirOp are suppressed the same way with
+// MountConfig.EnableNoOpenSupport and EnableNoOpendirSupport, if the kernel
+// supports it, and otherwise succeed with a zero handle.
+//
+// For other ops, and to fail a single op without the kernel remembering it,
+// for example an xattr op on one inode of several kinds, return ENOTSUP
+// instead, or ENOATTR for a missing xattr.
+func KernelCachesENOSYS(op interface{}) bool {
+	switch op.(type) {
+	case *fuseops.AccessOp,
+		*fuseops.FlushFileOp,
+		*fuseops.SyncFileOp,
+		*fuseops.SyncDirOp,
+		*fuseops.SyncFSOp,
+		*fuseops.GetXattrOp,
+		*fuseops.ListXattrOp,
+		*fuseops.SetXattrOp,
+		*fuseops.RemoveXattrOp,
+		*fuseops.CreateFileOp,
+		*fuseops.FallocateOp,
+		*fuseops.SeekOp,
+		*fuseops.CopyFileRangeOp,
+		*fuseops.PollOp:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An EntryInvalidationGroup keeps the kernel's cached directory entries
+// consistent across mounts of the same file system. Whenever a RenameOp,
+// UnlinkOp, or RmDirOp succeeds on any mount whose MountConfig refers to the
+// group, each mount in the group, including the one that saw the op, is told
+// to invalidate the names the op removed or replaced. Without this, the other
+// mounts keep serving the old names until their entries expire, which may be
+// a long time for file systems with long entry expiration times.
+//
+// The zero value is an empty group, ready to use.
+type EntryInvalidationGroup struct {
+	mu sync.Mutex
+
+	// The connections currently in the group.
+	//
+	// GUARDED_BY(mu)
+	conns map[*Connection]struct{}
+}
+
+// LOCKS_EXCLUDED(g.mu)
+func (g *EntryInvalidationGroup) add(c *Connection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.conns == nil {
+		g.conns = make(map[*Connection]struct{})
+	}
+
+	g.conns[c] = struct{}{}
+}
+
+// LOCKS_EXCLUDED(g.mu)
+func (g *EntryInvalidationGroup) remove(c *Connection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.conns, c)
+}
+
+// Invalidate the entries affected by the supplied op, which has succeeded and
+// been responded to on connection c, on every connection in the group.
+//
+// The notifications are sent in the background, without holding the lock, so
+// that one the kernel is slow to accept, for example while a lookup on another
+// mount holds the directory's lock, holds up neither this reply nor the
+// notifications for other mounts. Invalidations are idempotent, so their
+// order doesn't matter. Connections wait for those pending on them before
+// closing their devices.
+//
+// LOCKS_EXCLUDED(g.mu)
+func (g *EntryInvalidationGroup) opSucceeded(c *Connection, op interface{}) {
+	type entry struct {
+		parent fuseops.InodeID
+		name   string
+	}
+
+	var entries []entry
+	switch o := op.(type) {
+	case *fuseops.RenameOp:
+		entries = []entry{{o.OldParent, o.OldName}, {o.NewParent, o.NewName}}
+
+	case *fuseops.UnlinkOp:
+		entries = []entry{{o.Parent, o.Name}}
+
+	case *fuseops.RmDirOp:
+		entries = []entry{{o.Parent, o.Name}}
+
+	default:
+		return
+	}
+
+	g.mu.Lock()
+	conns := make([]*Connection, 0, len(g.conns))
+	for other := range g.conns {
+		other.groupNotifications.Add(1)
+		conns = append(conns, other)
+	}
+	g.mu.Unlock()
+
+	for _, other := range conns {
+		go func(other *Connection) {
+			defer other.groupNotifications.Done()
+
+			n := &connectionNotifier{c: other}
+			for _, e := range entries {
+				// ENOENT just means that the kernel has nothing cached.
+				err := n.InvalidateEntry(e.parent, e.name)
+				if err != nil && err != ENOENT {
+					c.logError(
+						fmt.Sprintf("InvalidateEntry(%v, %q)", e.parent, e.name),
+						err,
+						LogField{LogKeyInode, e.parent})
+				}
+			}
+		}(other)
+	}
+}
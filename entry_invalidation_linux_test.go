@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestEntryInvalidationGroup(t *testing.T) {
+	group := &fuse.EntryInvalidationGroup{}
+
+	var kernels []*fusetesting.FakeKernel
+	for i := 0; i < 2; i++ {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EntryInvalidationGroup: group},
+			&fusetesting.FakeKernelConfig{})
+		kernels = append(kernels, k)
+	}
+
+	// A failed op invalidates nothing.
+	r, err := kernels[0].Call(fusekernel.OpRmdir, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != syscall.ENOSYS {
+		t.Errorf("Unexpected error: %v", r.Error)
+	}
+
+	r, err = kernels[0].Call(fusekernel.OpUnlink, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != 0 {
+		t.Fatalf("Unexpected error: %v", r.Error)
+	}
+
+	// The notifications are sent after the reply, so may not have arrived
+	// yet.
+	out := fusekernel.NotifyInvalEntryOut{Parent: 1, Namelen: 3}
+	want := []fusetesting.FakeNotification{
+		{
+			Code: fusekernel.NotifyCodeInvalEntry,
+			Body: append(
+				structBytes(unsafe.Pointer(&out), unsafe.Sizeof(out), int(unsafe.Sizeof(out))),
+				"foo\x00"...),
+		},
+	}
+
+	for i, k := range kernels {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(k.Notifications()) < len(want) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+
+		if got := k.Notifications(); !reflect.DeepEqual(got, want) {
+			t.Errorf("Kernel %d: got notifications %v, want %v", i, got, want)
+		}
+	}
+}
@@ -14,7 +14,16 @@
 
 package fuse
 
-import "syscall"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"syscall"
+)
 
 const (
 	// Errors corresponding to kernel error numbers. These may be treated
@@ -27,4 +36,115 @@ const (
 	ENOSYS    = syscall.ENOSYS
 	ENOTDIR   = syscall.ENOTDIR
 	ENOTEMPTY = syscall.ENOTEMPTY
+
+	// Fails a single op as unsupported, where ENOSYS would make the kernel stop
+	// sending ops of its kind altogether; see KernelCachesENOSYS.
+	ENOTSUP = syscall.ENOTSUP
 )
+
+// Errors describing why serving a file system stopped or why a request to the
+// kernel failed. Use errors.Is to check for them, since they may be wrapped
+// with more detail.
+var (
+	// Returned by MountedFileSystem.Join when the kernel's connection was
+	// aborted, for example with /sys/fs/fuse/connections/*/abort, rather than
+	// the file system being unmounted. The mount point remains until it is
+	// unmounted.
+	ErrConnectionAborted = errors.New("fuse: connection aborted")
+
+	// Returned, wrapped, by Connection.ReadOp and MountedFileSystem.Join when
+	// the kernel sends a message that can't be parsed, unless
+	// MountConfig.TolerateProtocolErrors is set.
+	ErrProtocol = errors.New("fuse: protocol error")
+
+	// Returned by Notifier methods once the file system has been unmounted or
+	// its connection aborted.
+	ErrUnmounted = errors.New("fuse: file system unmounted")
+)
+
+// The errnos for well-known errors from the standard library, checked in
+// order with errors.Is by StandardErrno.
+var standardErrnos = []struct {
+	err   error
+	errno syscall.Errno
+}{
+	{fs.ErrNotExist, syscall.ENOENT},
+	{fs.ErrExist, syscall.EEXIST},
+	{fs.ErrPermission, syscall.EACCES},
+	{fs.ErrInvalid, syscall.EINVAL},
+	{fs.ErrClosed, syscall.EBADF},
+	{context.DeadlineExceeded, syscall.ETIMEDOUT},
+	{os.ErrDeadlineExceeded, syscall.ETIMEDOUT},
+}
+
+// StandardErrno returns the errno for an error that wraps a syscall.Errno,
+// such as an *os.PathError from a passthrough file system, or that matches a
+// well-known error from the standard library: fs.ErrNotExist (ENOENT),
+// fs.ErrExist (EEXIST), fs.ErrPermission (EACCES), fs.ErrInvalid (EINVAL),
+// fs.ErrClosed (EBADF), or context.DeadlineExceeded or os.ErrDeadlineExceeded
+// (ETIMEDOUT). It returns zero for other errors.
+//
+// Connection.Reply uses it for errors that MountConfig.MapError leaves
+// unmapped, and MapError functions may use it to defer to the standard
+// translation.
+func StandardErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+
+	for _, s := range standardErrnos {
+		if errors.Is(err, s.err) {
+			return s.errno
+		}
+	}
+
+	return 0
+}
+
+// The errnos that we recover from the output of helper commands, which report
+// failures only as text. This is best-effort: the errnos are recognized by
+// their English descriptions, which a localized or reworded message won't
+// contain.
+var outputErrnos = []syscall.Errno{
+	syscall.EACCES,
+	syscall.EBUSY,
+	syscall.EINVAL,
+	syscall.ENOENT,
+	syscall.ENOTCONN,
+	syscall.EPERM,
+}
+
+// An error from a helper command, along with its output and the errno that the
+// output reports.
+type outputError struct {
+	err    error
+	output []byte
+	errno  syscall.Errno
+}
+
+// Return an error for a helper command that failed with err after writing the
+// supplied output, wrapping the errno that the output reports if we can tell.
+func newOutputError(err error, output []byte) error {
+	output = bytes.TrimRight(output, "\n")
+	if len(output) == 0 {
+		return err
+	}
+
+	lower := strings.ToLower(string(output))
+	for _, errno := range outputErrnos {
+		if strings.Contains(lower, strings.ToLower(errno.Error())) {
+			return &outputError{err: err, output: output, errno: errno}
+		}
+	}
+
+	return fmt.Errorf("%w: %s", err, output)
+}
+
+func (e *outputError) Error() string {
+	return fmt.Sprintf("%v: %s", e.err, e.output)
+}
+
+func (e *outputError) Unwrap() []error {
+	return []error{e.err, e.errno}
+}
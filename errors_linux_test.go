@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose lookups fail with the given error.
+type lookUpErrorFS struct {
+	fuseutil.NotImplementedFileSystem
+	err error
+}
+
+func (fs *lookUpErrorFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.err
+}
+
+func TestMapError(t *testing.T) {
+	errNotFound := errors.New("not found in backend")
+	var mapped []error
+
+	cfg := &fuse.MountConfig{
+		MapError: func(op interface{}, err error) syscall.Errno {
+			if _, ok := op.(*fuseops.LookUpInodeOp); !ok {
+				t.Errorf("MapError called with %T", op)
+			}
+
+			mapped = append(mapped, err)
+			if errors.Is(err, errNotFound) {
+				return syscall.ENOENT
+			}
+
+			return 0
+		},
+	}
+
+	testCases := []struct {
+		err      error
+		expected syscall.Errno
+		isMapped bool
+	}{
+		{syscall.EACCES, syscall.EACCES, false},
+		{fmt.Errorf("LookUp: %w", errNotFound), syscall.ENOENT, true},
+		{errors.New("taco"), syscall.EIO, true},
+
+		// Errors left unmapped get the standard translation.
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.EROFS}, syscall.EROFS, true},
+		{fmt.Errorf("LookUp: %w", os.ErrNotExist), syscall.ENOENT, true},
+		{fmt.Errorf("LookUp: %w", context.DeadlineExceeded), syscall.ETIMEDOUT, true},
+	}
+
+	for _, tc := range testCases {
+		mapped = nil
+
+		fs := &lookUpErrorFS{err: tc.err}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			cfg,
+			&fusetesting.FakeKernelConfig{})
+
+		reply, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+		if err != nil {
+			t.Errorf("Call: %v", err)
+		} else if reply.Error != tc.expected {
+			t.Errorf("%v: got errno %v, expected %v", tc.err, reply.Error, tc.expected)
+		}
+
+		if err := k.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+
+		if tc.isMapped != (len(mapped) == 1 && mapped[0] == tc.err) {
+			t.Errorf("%v: MapError called with %v", tc.err, mapped)
+		}
+	}
+}
+
+func TestStandardErrno(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected syscall.Errno
+	}{
+		{syscall.ENOTDIR, syscall.ENOTDIR},
+		{fmt.Errorf("wrapped: %w", syscall.EROFS), syscall.EROFS},
+		{&os.PathError{Op: "open", Path: "foo", Err: syscall.ENOENT}, syscall.ENOENT},
+		{os.ErrNotExist, syscall.ENOENT},
+		{os.ErrExist, syscall.EEXIST},
+		{fmt.Errorf("backend: %w", os.ErrPermission), syscall.EACCES},
+		{os.ErrInvalid, syscall.EINVAL},
+		{os.ErrClosed, syscall.EBADF},
+		{context.DeadlineExceeded, syscall.ETIMEDOUT},
+		{os.ErrDeadlineExceeded, syscall.ETIMEDOUT},
+		{errors.New("taco"), 0},
+		{context.Canceled, 0},
+	}
+
+	for _, tc := range testCases {
+		if got := fuse.StandardErrno(tc.err); got != tc.expected {
+			t.Errorf("%v: got %v, expected %v", tc.err, got, tc.expected)
+		}
+	}
+}
+
+func TestKernelCachesENOSYS(t *testing.T) {
+	testCases := []struct {
+		op       interface{}
+		expected bool
+	}{
+		{&fuseops.GetXattrOp{}, true},
+		{&fuseops.SetXattrOp{}, true},
+		{&fuseops.FlushFileOp{}, true},
+		{&fuseops.CreateFileOp{}, true},
+		{&fuseops.FallocateOp{}, true},
+		{&fuseops.LookUpInodeOp{}, false},
+		{&fuseops.ReadFileOp{}, false},
+		{&fuseops.IoctlOp{}, false},
+	}
+
+	for _, tc := range testCases {
+		if got := fuse.KernelCachesENOSYS(tc.op); got != tc.expected {
+			t.Errorf("%T: got %v, expected %v", tc.op, got, tc.expected)
+		}
+	}
+}
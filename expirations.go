@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// The current time according to the configured clock.
+func (c *Connection) now() time.Time {
+	if c.cfg.Clock != nil {
+		return c.cfg.Clock.Now()
+	}
+
+	return time.Now()
+}
+
+// A directory entry that the kernel may have cached.
+type entryKey struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// The expiration times handed to the kernel for entries and attributes, kept
+// when MountConfig.Clock is set so that they can be enforced in terms of that
+// clock rather than the kernel's.
+type expirationTracker struct {
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	entries map[entryKey]time.Time
+
+	// GUARDED_BY(mu)
+	attrs map[fuseops.InodeID]time.Time
+}
+
+func newExpirationTracker(clock timeutil.Clock) *expirationTracker {
+	return &expirationTracker{
+		clock:   clock,
+		entries: make(map[entryKey]time.Time),
+		attrs:   make(map[fuseops.InodeID]time.Time),
+	}
+}
+
+// Record the expiration times in the successful response to the op, ignoring
+// those that have already passed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *expirationTracker) record(op interface{}) {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry := func(parent fuseops.InodeID, name string, e *fuseops.ChildInodeEntry) {
+		if e.EntryExpiration.After(now) {
+			t.entries[entryKey{parent, name}] = e.EntryExpiration
+		}
+
+		if e.Child != 0 {
+			t.recordAttrs(e.Child, e.AttributesExpiration, now)
+		}
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.MkDirOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.MkNodeOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateFileOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.CreateLinkOp:
+		entry(o.Parent, o.Name, &o.Entry)
+
+	case *fuseops.ReadDirPlusOp:
+		// The kernel ignores the entries for "." and "..".
+		forEachDirentPlus(o.Dst[:o.BytesRead], func(d *fusekernel.DirentPlus, name string) {
+			if d.Entry.Nodeid != 0 && name != "." && name != ".." {
+				e := decodeDirentPlusEntry(d)
+				entry(o.Inode, name, &e)
+			}
+		})
+
+	case *fuseops.GetInodeAttributesOp:
+		t.recordAttrs(o.Inode, o.AttributesExpiration, now)
+
+	case *fuseops.SetInodeAttributesOp:
+		t.recordAttrs(o.Inode, o.AttributesExpiration, now)
+	}
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(t.mu)
+func (t *expirationTracker) recordAttrs(
+	inode fuseops.InodeID,
+	expiration time.Time,
+	now time.Time) {
+	if expiration.After(now) {
+		t.attrs[inode] = expiration
+	}
+}
+
+// Remove and return the entries and inodes whose expiration times have
+// passed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *expirationTracker) expired() (
+	entries []entryKey,
+	inodes []fuseops.InodeID) {
+	now := t.clock.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for k, expiration := range t.entries {
+		if !expiration.After(now) {
+			entries = append(entries, k)
+			delete(t.entries, k)
+		}
+	}
+
+	for inode, expiration := range t.attrs {
+		if !expiration.After(now) {
+			inodes = append(inodes, inode)
+			delete(t.attrs, inode)
+		}
+	}
+
+	return entries, inodes
+}
+
+// ExpireCaches tells the kernel to drop every entry and set of attributes
+// that the file system handed to it with an expiration time that has passed
+// according to MountConfig.Clock, as the kernel would have done itself if
+// that clock were the real one. Tests call this after advancing the clock.
+//
+// It returns an error if the file system was mounted without a clock.
+func (mfs *MountedFileSystem) ExpireCaches() error {
+	if mfs.expirations == nil {
+		return errors.New("ExpireCaches requires MountConfig.Clock to be set")
+	}
+
+	entries, inodes := mfs.expirations.expired()
+
+	// The kernel returns ENOENT for anything it has already forgotten about,
+	// for example the entries within a directory whose own entry has just been
+	// invalidated.
+	for _, k := range entries {
+		err := mfs.notifier.InvalidateEntry(k.parent, k.name)
+		if err != nil && err != ENOENT {
+			return fmt.Errorf("InvalidateEntry: %v", err)
+		}
+	}
+
+	for _, inode := range inodes {
+		err := mfs.notifier.InvalidateInode(inode, -1, 0)
+		if err != nil && err != ENOENT {
+			return fmt.Errorf("InvalidateInode: %v", err)
+		}
+	}
+
+	return nil
+}
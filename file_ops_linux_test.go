@@ -0,0 +1,595 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system that claims to copy half of each range, and records the ops.
+type copyRangeFS struct {
+	handleDataFS
+	ops []*fuseops.CopyFileRangeOp
+}
+
+func (fs *copyRangeFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, op)
+	op.BytesCopied = op.Length / 2
+	return nil
+}
+
+func TestCopyFileRange(t *testing.T) {
+	fs := &copyRangeFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{StrictProtocolValidation: true},
+		&fusetesting.FakeKernelConfig{})
+
+	// Open both files, attaching values to their handles.
+	for _, inode := range []uint64{2, 3} {
+		in := fusekernel.OpenIn{Flags: syscall.O_RDWR}
+		r, err := k.Call(fusekernel.OpOpen, inode, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+	}
+
+	in := fusekernel.CopyFileRangeIn{
+		FhIn:      2,
+		OffIn:     1,
+		NodeidOut: 3,
+		FhOut:     3,
+		OffOut:    5,
+		Len:       100,
+	}
+
+	r, err := k.Call(fusekernel.OpCopyFileRange, 2, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	var out fusekernel.WriteOut
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+
+	if out.Size != 50 {
+		t.Errorf("Got size %d, want 50", out.Size)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.ops) != 1 {
+		t.Fatalf("Got %d ops", len(fs.ops))
+	}
+
+	op := fs.ops[0]
+	want := fuseops.CopyFileRangeOp{
+		SrcInode:      2,
+		SrcHandle:     2,
+		SrcOffset:     1,
+		SrcHandleData: "state for 2",
+		DstInode:      3,
+		DstHandle:     3,
+		DstOffset:     5,
+		DstHandleData: "state for 3",
+		Length:        100,
+		BytesCopied:   50,
+		OpContext:     op.OpContext,
+	}
+
+	if !reflect.DeepEqual(*op, want) {
+		t.Errorf("Got op %+v, want %+v", *op, want)
+	}
+}
+
+// A file system whose files have a single hole, from offset 100 to 200, and
+// end there.
+type seekFS struct {
+	handleDataFS
+	handleData interface{}
+}
+
+func (fs *seekFS) Seek(
+	ctx context.Context,
+	op *fuseops.SeekOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handleData = op.HandleData
+	switch {
+	case op.Offset >= 200:
+		return syscall.ENXIO
+
+	case op.Whence == unix.SEEK_HOLE:
+		op.ResultOffset = op.Offset
+		if op.Offset < 100 {
+			op.ResultOffset = 100
+		}
+
+	case op.Offset < 100:
+		op.ResultOffset = op.Offset
+
+	default:
+		return syscall.ENXIO
+	}
+
+	return nil
+}
+
+func TestSeek(t *testing.T) {
+	fs := &seekFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{StrictProtocolValidation: true},
+		&fusetesting.FakeKernelConfig{})
+
+	open := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+	r, err := k.Call(fusekernel.OpOpen, 2, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	testCases := []struct {
+		offset uint64
+		whence uint32
+		want   uint64
+		errno  syscall.Errno
+	}{
+		{10, unix.SEEK_DATA, 10, 0},
+		{10, unix.SEEK_HOLE, 100, 0},
+		{150, unix.SEEK_DATA, 0, syscall.ENXIO},
+		{150, unix.SEEK_HOLE, 150, 0},
+		{10, unix.SEEK_SET, 0, syscall.EIO},
+	}
+
+	for _, tc := range testCases {
+		in := fusekernel.LseekIn{Fh: 2, Offset: tc.offset, Whence: tc.whence}
+		r, err := k.Call(fusekernel.OpLseek, 2, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != tc.errno {
+			t.Errorf("Offset %d, whence %d: got errno %v, want %v", tc.offset, tc.whence, r.Error, tc.errno)
+			continue
+		}
+
+		if r.Error != 0 {
+			continue
+		}
+
+		var out fusekernel.LseekOut
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+
+		if out.Offset != tc.want {
+			t.Errorf("Offset %d, whence %d: got %d, want %d", tc.offset, tc.whence, out.Offset, tc.want)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.handleData != "state for 2" {
+		t.Errorf("Got handle data %v", fs.handleData)
+	}
+}
+
+// A file system whose files become readable only once a poll has been made,
+// and which wakes up the poller as soon as it says so.
+type pollFS struct {
+	handleDataFS
+
+	notifier fuse.Notifier
+
+	mu  sync.Mutex
+	ops []fuseops.PollOp
+}
+
+func (fs *pollFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, *op)
+	if len(fs.ops) == 1 {
+		op.Revents = unix.POLLOUT
+	} else {
+		op.Revents = unix.POLLIN | unix.POLLOUT
+	}
+
+	op.Revents &= op.Events
+	if op.ScheduleNotify && op.Revents == 0 {
+		return fs.notifier.NotifyPollWakeup(op.PollHandle)
+	}
+
+	return nil
+}
+
+func TestPoll(t *testing.T) {
+	fs := &pollFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{StrictProtocolValidation: true},
+		&fusetesting.FakeKernelConfig{})
+	fs.notifier = k.Notifier()
+
+	open := fusekernel.OpenIn{Flags: syscall.O_RDWR}
+	r, err := k.Call(fusekernel.OpOpen, 2, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	// Wait for the file to become readable, and then poll again.
+	const kh = 0x1234
+	for _, want := range []uint32{0, unix.POLLIN} {
+		in := fusekernel.PollIn{
+			Fh:     2,
+			Kh:     kh,
+			Flags:  fusekernel.PollScheduleNotify,
+			Events: unix.POLLIN,
+		}
+
+		r, err := k.Call(fusekernel.OpPoll, 2, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		var out fusekernel.PollOut
+		if len(r.Body) != int(unsafe.Sizeof(out)) {
+			t.Fatalf("Got %d bytes", len(r.Body))
+		}
+
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		if out.Revents != want {
+			t.Errorf("Got revents %#x, want %#x", out.Revents, want)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for i, op := range fs.ops {
+		if op.Inode != 2 || op.HandleData != "state for 2" || op.Events != unix.POLLIN {
+			t.Errorf("Op %d: %+v", i, op)
+		}
+
+		if !op.ScheduleNotify || op.PollHandle != kh {
+			t.Errorf("Op %d: got notify %v, handle %#x", i, op.ScheduleNotify, op.PollHandle)
+		}
+	}
+
+	// The first poll asked for a wakeup.
+	got := k.Notifications()
+	if len(got) != 1 || got[0].Code != fusekernel.NotifyCodePoll {
+		t.Fatalf("Got notifications %v", got)
+	}
+
+	var out fusekernel.NotifyPollWakeupOut
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), got[0].Body)
+	if out.Kh != kh {
+		t.Errorf("Got poll handle %#x", out.Kh)
+	}
+}
+
+// A file system with an ioctl that reverses its input, and one that reads
+// and writes the caller's memory directly.
+type ioctlFS struct {
+	handleDataFS
+
+	mu  sync.Mutex
+	ops []fuseops.IoctlOp
+}
+
+const (
+	reverseIoctl      = 1
+	unrestrictedIoctl = 2
+)
+
+func (fs *ioctlFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.Handle = fuseops.HandleID(op.Inode)
+	op.HandleData = fmt.Sprintf("dir state for %d", op.Inode)
+	return nil
+}
+
+func (fs *ioctlFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	saved := *op
+	saved.Input = append([]byte(nil), op.Input...)
+	fs.ops = append(fs.ops, saved)
+
+	switch op.Cmd {
+	case reverseIoctl:
+		for i := len(op.Input) - 1; i >= 0; i-- {
+			op.Output = append(op.Output, op.Input[i])
+		}
+
+		op.Result = 7
+
+	case unrestrictedIoctl:
+		// Ask for the four bytes at the argument on the first go.
+		if len(op.Input) == 0 {
+			op.Retry = true
+			op.RetryInput = []fuseops.IoctlIovec{{Base: op.Arg, Len: 4}}
+			op.RetryOutput = []fuseops.IoctlIovec{{Base: op.Arg, Len: 4}}
+			break
+		}
+
+		op.Output = []byte("taco")
+
+	default:
+		return syscall.ENOTTY
+	}
+
+	return nil
+}
+
+func TestIoctl(t *testing.T) {
+	fs := &ioctlFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			StrictProtocolValidation: true,
+			ValidateResponses:        true,
+		},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitHasIoctlDir)})
+
+	if flags := fusekernel.InitFlags(k.InitOut().Flags); flags&fusekernel.InitHasIoctlDir == 0 {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+
+	open := fusekernel.OpenIn{Flags: syscall.O_RDWR}
+	r, err := k.Call(fusekernel.OpOpen, 2, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	r, err = k.Call(fusekernel.OpOpendir, 3, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	ioctl := func(inode uint64, in fusekernel.IoctlIn, data string) (fusekernel.IoctlOut, []byte, syscall.Errno) {
+		in.InSize = uint32(len(data))
+		r, err := k.Call(
+			fusekernel.OpIoctl,
+			inode,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+			[]byte(data))
+
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		var out fusekernel.IoctlOut
+		if r.Error != 0 {
+			return out, nil, r.Error
+		}
+
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		return out, r.Body[unsafe.Sizeof(out):], 0
+	}
+
+	// A restricted ioctl gets its data copied in and out, the latter limited
+	// to the size the kernel allows.
+	out, data, errno := ioctl(2, fusekernel.IoctlIn{Fh: 2, Cmd: reverseIoctl, OutSize: 3}, "abcd")
+	if errno != 0 || out.Result != 7 || out.Flags != 0 || string(data) != "dcb" {
+		t.Errorf("Got %v, %+v, %q", errno, out, data)
+	}
+
+	// Likewise on a directory.
+	out, data, errno = ioctl(3, fusekernel.IoctlIn{Fh: 3, Flags: fusekernel.IoctlDir, Cmd: reverseIoctl, OutSize: 4}, "ab")
+	if errno != 0 || out.Result != 7 || string(data) != "ba" {
+		t.Errorf("Got %v, %+v, %q", errno, out, data)
+	}
+
+	// An unrestricted ioctl asks for a retry, and then gets the memory it asked
+	// for.
+	const arg = 0x7fff0000
+	in := fusekernel.IoctlIn{Fh: 2, Flags: fusekernel.IoctlUnrestricted, Cmd: unrestrictedIoctl, Arg: arg}
+	out, data, errno = ioctl(2, in, "")
+	if errno != 0 || out.Flags != fusekernel.IoctlRetry || out.InIovs != 1 || out.OutIovs != 1 {
+		t.Fatalf("Got %v, %+v", errno, out)
+	}
+
+	var iovs [2]fusekernel.IoctlIovec
+	if len(data) != int(unsafe.Sizeof(iovs)) {
+		t.Fatalf("Got %d bytes of regions", len(data))
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&iovs)), unsafe.Sizeof(iovs)), data)
+	for _, iov := range iovs {
+		if iov != (fusekernel.IoctlIovec{Base: arg, Len: 4}) {
+			t.Errorf("Got region %+v", iov)
+		}
+	}
+
+	in.OutSize = 4
+	out, data, errno = ioctl(2, in, "abcd")
+	if errno != 0 || out.Flags != 0 || string(data) != "taco" {
+		t.Errorf("Got %v, %+v, %q", errno, out, data)
+	}
+
+	// The kernel refuses to retry restricted ioctls.
+	in.Flags = 0
+	if _, _, errno = ioctl(2, in, ""); errno != syscall.EIO {
+		t.Errorf("Got %v for a retry of a restricted ioctl", errno)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	wantData := []string{"state for 2", "dir state for 3", "state for 2", "state for 2", "state for 2"}
+	if len(fs.ops) != len(wantData) {
+		t.Fatalf("Got %d ops", len(fs.ops))
+	}
+
+	for i, op := range fs.ops {
+		if op.HandleData != wantData[i] {
+			t.Errorf("Op %d: got handle data %v", i, op.HandleData)
+		}
+	}
+
+	if op := fs.ops[0]; string(op.Input) != "abcd" || op.OutputSize != 3 || op.Dir {
+		t.Errorf("Got op %+v", op)
+	}
+
+	if op := fs.ops[2]; !op.Unrestricted || op.Arg != arg {
+		t.Errorf("Got op %+v", op)
+	}
+}
+
+// A file system that records the sync ops it receives, along with the handle
+// data for each.
+type syncDirFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu    sync.Mutex
+	ops   []interface{}
+	datas []interface{}
+}
+
+func (fs *syncDirFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.Handle = 3
+	op.HandleData = "dir state"
+	return nil
+}
+
+func (fs *syncDirFS) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, op)
+	fs.datas = append(fs.datas, op.HandleData)
+	return nil
+}
+
+func (fs *syncDirFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, op)
+	return nil
+}
+
+func TestSyncDir(t *testing.T) {
+	fs := &syncDirFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{},
+		&fusetesting.FakeKernelConfig{})
+
+	call := func(opcode uint32, inode uint64, body []byte) {
+		t.Helper()
+		r, err := k.Call(opcode, inode, body)
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != 0 {
+			t.Fatalf("Opcode %d: %v", opcode, r.Error)
+		}
+	}
+
+	openIn := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+	call(
+		fusekernel.OpOpendir,
+		1,
+		structBytes(unsafe.Pointer(&openIn), unsafe.Sizeof(openIn), int(unsafe.Sizeof(openIn))))
+
+	for _, tc := range []struct {
+		opcode uint32
+		flags  fusekernel.FsyncFlags
+	}{
+		{fusekernel.OpFsyncdir, 0},
+		{fusekernel.OpFsyncdir, fusekernel.FsyncFdatasync},
+		{fusekernel.OpFsync, 0},
+		{fusekernel.OpFsync, fusekernel.FsyncFdatasync},
+	} {
+		in := fusekernel.FsyncIn{Fh: 3, FsyncFlags: tc.flags}
+		call(
+			tc.opcode,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.ops) != 4 {
+		t.Fatalf("Got %d ops", len(fs.ops))
+	}
+
+	for i, wantDataSync := range []bool{false, true} {
+		op, ok := fs.ops[i].(*fuseops.SyncDirOp)
+		if !ok {
+			t.Fatalf("Op %d: got %T", i, fs.ops[i])
+		}
+
+		if op.Inode != 1 || op.Handle != 3 || op.DataSync != wantDataSync {
+			t.Errorf("Op %d: got %+v", i, op)
+		}
+	}
+
+	if !reflect.DeepEqual(fs.datas, []interface{}{"dir state", "dir state"}) {
+		t.Errorf("Got handle data %v", fs.datas)
+	}
+
+	for i, wantDataSync := range []bool{false, true} {
+		op, ok := fs.ops[2+i].(*fuseops.SyncFileOp)
+		if !ok {
+			t.Fatalf("Op %d: got %T", 2+i, fs.ops[2+i])
+		}
+
+		if op.Inode != 1 || op.Handle != 3 || op.DataSync != wantDataSync {
+			t.Errorf("Op %d: got %+v", 2+i, op)
+		}
+	}
+}
@@ -18,20 +18,47 @@ import (
 	"unsafe"
 
 	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 ////////////////////////////////////////////////////////////////////////
 // buffer.InMessage
 ////////////////////////////////////////////////////////////////////////
 
+// The size of the buffers to read messages into. Until the limit on pages per
+// request has been negotiated, assume that the kernel accepted ours.
+func (c *Connection) inMessageSize() int {
+	pages := c.maxPages
+	if pages == 0 {
+		pages = int(c.cfg.maxPages())
+	}
+
+	return c.cfg.inMessageSize(pages)
+}
+
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) getInMessage() *buffer.InMessage {
+	if p := c.cfg.MessageProvider; p != nil {
+		return (*buffer.InMessage)(p.GetInMessage())
+	}
+
 	c.mu.Lock()
 	x := (*buffer.InMessage)(c.inMessages.Get())
 	c.mu.Unlock()
 
-	if x == nil {
-		x = buffer.NewInMessage()
+	if !c.cfg.AlignBuffers {
+		if x == nil {
+			x = buffer.NewInMessageSize(c.inMessageSize())
+		}
+
+		return x
+	}
+
+	// Align the data of write requests. Messages allocated before the protocol
+	// was negotiated may have been aligned for a different offset.
+	offset := int(unsafe.Sizeof(fusekernel.InHeader{}) + fusekernel.WriteInSize(c.protocol))
+	if x == nil || !x.AlignedFor(offset) {
+		x = buffer.NewAlignedInMessage(offset, c.inMessageSize())
 	}
 
 	return x
@@ -39,6 +66,13 @@ func (c *Connection) getInMessage() *buffer.InMessage {
 
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) putInMessage(x *buffer.InMessage) {
+	x.DiscardPayload()
+
+	if p := c.cfg.MessageProvider; p != nil {
+		p.PutInMessage((*InMessage)(x))
+		return
+	}
+
 	c.mu.Lock()
 	c.inMessages.Put(unsafe.Pointer(x))
 	c.mu.Unlock()
@@ -50,9 +84,14 @@ func (c *Connection) putInMessage(x *buffer.InMessage) {
 
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) getOutMessage() *buffer.OutMessage {
-	c.mu.Lock()
-	x := (*buffer.OutMessage)(c.outMessages.Get())
-	c.mu.Unlock()
+	var x *buffer.OutMessage
+	if p := c.cfg.MessageProvider; p != nil {
+		x = (*buffer.OutMessage)(p.GetOutMessage())
+	} else {
+		c.mu.Lock()
+		x = (*buffer.OutMessage)(c.outMessages.Get())
+		c.mu.Unlock()
+	}
 
 	if x == nil {
 		x = new(buffer.OutMessage)
@@ -64,6 +103,11 @@ func (c *Connection) getOutMessage() *buffer.OutMessage {
 
 // LOCKS_EXCLUDED(c.mu)
 func (c *Connection) putOutMessage(x *buffer.OutMessage) {
+	if p := c.cfg.MessageProvider; p != nil {
+		p.PutOutMessage((*OutMessage)(x))
+		return
+	}
+
 	c.mu.Lock()
 	c.outMessages.Put(unsafe.Pointer(x))
 	c.mu.Unlock()
@@ -15,6 +15,7 @@
 package fuseops
 
 import (
+	"io"
 	"os"
 	"time"
 
@@ -38,6 +39,30 @@ type OpContext struct {
 	// UID of the process that is invoking the operation.
 	// Not filled in case of a writepage operation.
 	Uid uint32
+
+	// GID of the process that is invoking the operation. Supplementary groups
+	// aren't sent by the kernel.
+	// Not filled in case of a writepage operation.
+	Gid uint32
+
+	// The time at which the op was read from the kernel.
+	ReadTime time.Time
+
+	// The time at which the op was handed to the file system, if it is being
+	// served by fuseutil.NewFileSystemServer. Zero otherwise.
+	DispatchTime time.Time
+}
+
+// QueueLatency returns the time the op spent within the server between being
+// read from the kernel and being handed to the file system, or zero if that
+// isn't known. A large value means the server is backlogged, rather than the
+// file system being slow to handle ops.
+func (c OpContext) QueueLatency() time.Duration {
+	if c.ReadTime.IsZero() || c.DispatchTime.IsZero() {
+		return 0
+	}
+
+	return c.DispatchTime.Sub(c.ReadTime)
 }
 
 // Return statistics about the file system's capacity and available resources.
@@ -166,6 +191,10 @@ type SetInodeAttributesOp struct {
 	// If set, this is ftruncate(2), otherwise it's truncate(2)
 	Handle *HandleID
 
+	// If Handle is set, the value the file system attached to the handle when
+	// opening it, if any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The attributes to modify, or nil for attributes that don't need a change.
 	Uid   *uint32
 	Gid   *uint32
@@ -182,6 +211,26 @@ type SetInodeAttributesOp struct {
 	OpContext            OpContext
 }
 
+// Check whether the caller may access an inode in the requested ways, for
+// file systems with their own permission model. The kernel sends this only
+// when the file system is mounted with MountConfig.DisableDefaultPermissions,
+// for access(2) and chdir(2); other permission checks are left to the ops
+// themselves. Return EACCES to deny access.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats all such checks as succeeding.
+type AccessOp struct {
+	// The inode of interest.
+	Inode InodeID
+
+	// The requested access: some combination of unix.R_OK, unix.W_OK and
+	// unix.X_OK, or zero (unix.F_OK) to check only that the inode exists. The
+	// caller is identified by OpContext.Uid and OpContext.Gid.
+	Mask uint32
+
+	OpContext OpContext
+}
+
 // Decrement the reference count for an inode ID previously issued by the file
 // system.
 //
@@ -250,7 +299,8 @@ type BatchForgetEntry struct {
 //
 // This operation is a batch of ForgetInodeOp operations. Every entry in
 // Entries is one ForgetInodeOp operation. See the docs of ForgetInodeOp
-// for further details.
+// for further details. With fuse.MountConfig.SplitBatchForgets, file systems
+// receive the individual ForgetInodeOps instead.
 type BatchForgetOp struct {
 	// Entries is a list of Forget operations. One could treat every entry in the
 	// list as a single ForgetInodeOp operation.
@@ -291,10 +341,12 @@ type MkDirOp struct {
 	OpContext OpContext
 }
 
-// Create a file inode as a child of an existing directory inode. The kernel
-// sends this in response to a mknod(2) call. It may also send it in special
-// cases such as an NFS export (https://tinyurl.com/5dwxr7c9). It is more typical
-// to see CreateFileOp, which is received for an open(2) that creates a file.
+// Create a regular file, or a special file such as a FIFO, socket or device
+// node, as a child of an existing directory inode. The kernel sends this in
+// response to a mknod(2) call, for example from mkfifo(3). It may also send it
+// in special cases such as an NFS export (https://tinyurl.com/5dwxr7c9). For
+// regular files it is more typical to see CreateFileOp, which is received for
+// an open(2) that creates a file.
 //
 // The Linux kernel appears to verify the name doesn't already exist (mknod
 // calls sys_mknodat calls user_path_create calls filename_create, which
@@ -311,7 +363,9 @@ type MkNodeOp struct {
 	Name string
 	Mode os.FileMode
 
-	// The device number (only valid if created file is a device)
+	// The device number of a character or block device, as returned by
+	// unix.Mkdev, and otherwise zero. Mode says which, if any, of the two the
+	// child is. The file system should return it in the child's attributes.
 	Rdev uint32
 
 	// Set by the file system: information about the inode that was created.
@@ -332,6 +386,9 @@ type MkNodeOp struct {
 // the kernel does anyway.
 //
 // Therefore the file system should return EEXIST if the name already exists.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// creates files with MkNodeOp followed by OpenFileOp instead.
 type CreateFileOp struct {
 	// The ID of parent directory inode within which to create the child file.
 	Parent InodeID
@@ -354,7 +411,20 @@ type CreateFileOp struct {
 	// The handle may be supplied in future ops like ReadFileOp that contain a
 	// file handle. The file system must ensure this ID remains valid until a
 	// later call to ReleaseFileHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: a value to attach to the handle, as for
+	// OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// Set by the file system: how the kernel should treat the new handle. See
+	// the fields of the same names in OpenFileOp. (The file is new, so it has
+	// no page cache for OpenFileOp.KeepPageCache to keep.)
+	UseDirectIO          bool
+	NonSeekable          bool
+	Stream               bool
+	ParallelDirectWrites bool
+
 	OpContext OpContext
 }
 
@@ -501,15 +571,25 @@ type OpenDirOp struct {
 	// The handle may be supplied in future ops like ReadDirOp that contain a
 	// directory handle. The file system must ensure this ID remains valid until
 	// a later call to ReleaseDirHandle.
-	Handle    HandleID
+	Handle HandleID
+
+	// Set by the file system: an arbitrary value to attach to the handle,
+	// which is supplied as HandleData in every later op carrying the handle,
+	// up to and including ReleaseDirHandleOp, and then dropped. This saves
+	// keeping a map from handles to their state.
+	HandleData interface{}
+
 	OpContext OpContext
 
 	// CacheDir conveys to the kernel to cache the response of next
 	// ReadDirOp as page cache. Once cached, listing on that directory will be
-	// served from the kernel until invalidated.
+	// served from the kernel until invalidated, e.g. by
+	// Notifier.InvalidateInode. Requires Linux 4.20 or later.
 	CacheDir bool
 
-	// KeepCache instructs the kernel to not invalidate the data cache on open calls.
+	// KeepCache instructs the kernel to not invalidate the data cache on open
+	// calls, so that a directory listing cached thanks to CacheDir survives
+	// the directory being opened again. Without it, each open starts afresh.
 	KeepCache bool
 }
 
@@ -520,6 +600,10 @@ type ReadDirOp struct {
 	Inode  InodeID
 	Handle HandleID
 
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenDirOp.HandleData.
+	HandleData interface{}
+
 	// The offset within the directory at which to read.
 	//
 	// Warning: this field is not necessarily a count of bytes. Its legal values
@@ -607,6 +691,88 @@ type ReadDirOp struct {
 	// FUSE_DIRENT_ALIGN (https://tinyurl.com/3m3ewu7h) is less than the read
 	// size of PAGE_SIZE used by fuse_readdir (https://tinyurl.com/mrwxsfxw).
 	BytesRead int
+
+	// Set when the kernel chooses between this op and ReadDirPlusOp for each
+	// read, as it does with fuse.MountConfig.EnableReadDirPlus on kernels that
+	// support its adaptive mode. It sends this op when it doesn't expect the
+	// entries to be looked up, so file systems that list the attributes of
+	// entries along with their names can skip fetching them.
+	Adaptive bool
+
+	OpContext OpContext
+}
+
+// Read entries from a directory previously opened with OpenDir, along with
+// the attributes of each child, as a LookUpInodeOp for it would return them.
+// This saves the kernel from following a ReadDirOp with a lookup of every
+// entry, for example when listing a directory with `ls -l`.
+//
+// The kernel sends this in place of ReadDirOp only if the file system was
+// mounted with fuse.MountConfig.EnableReadDirPlus. Most kernels then choose
+// between the two ops for each read, preferring this one when the entries of
+// the directory are being looked up after being listed; older ones send only
+// this op.
+type ReadDirPlusOp struct {
+	// The directory inode that we are reading, and the handle previously
+	// returned by OpenDir when opening that inode.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenDirOp.HandleData.
+	HandleData interface{}
+
+	// The offset within the directory at which to read. Offsets are shared
+	// with ReadDirOp; the kernel may alternate between the two ops while
+	// reading a directory. See notes on ReadDirOp.Offset.
+	Offset DirOffset
+
+	// The destination buffer, whose length gives the size of the read. Use
+	// fuseutil.WriteDirentPlus to fill it in; the children's entries are only
+	// converted into the form the kernel expects when the op is replied to.
+	//
+	// Each entry with a non-zero child inode ID counts as a lookup of that
+	// inode, as with LookUpInodeOp, except for the entries named "." and "..",
+	// which the kernel ignores. The inode's lookup count must be decremented
+	// later by a ForgetInodeOp in the usual way. An entry with a zero inode ID
+	// is listed without the kernel caching anything about it.
+	Dst []byte
+
+	// Set by the file system: the number of bytes read into Dst. As with
+	// ReadDirOp.BytesRead, zero means that the end of the directory has been
+	// reached.
+	BytesRead int
+
+	// Set when the kernel chooses between this op and ReadDirOp for each read,
+	// in which case it sent this op because it expects the entries to be
+	// looked up. Otherwise it sends this op for every read, whether or not the
+	// attributes will be used. See ReadDirOp.Adaptive.
+	Adaptive bool
+
+	OpContext OpContext
+}
+
+// Make changes to the entries of a directory durable, such as the creation,
+// removal and renaming of children, as a journaling file system would before
+// acknowledging them. The kernel sends this for fsync(2) and fdatasync(2) on a
+// directory opened with OpenDir.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats directory syncs as succeeding.
+type SyncDirOp struct {
+	// The directory being sync'd, and the handle previously returned by OpenDir
+	// when opening it.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenDirOp.HandleData.
+	HandleData interface{}
+
+	// Set for fdatasync(2), which requires only the entries themselves to be
+	// durable and not metadata such as the directory's modification time.
+	DataSync bool
+
 	OpContext OpContext
 }
 
@@ -623,7 +789,12 @@ type ReleaseDirHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
-	Handle    HandleID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenDirOp.HandleData.
+	HandleData interface{}
+
 	OpContext OpContext
 }
 
@@ -650,6 +821,12 @@ type OpenFileOp struct {
 	// later call to ReleaseFileHandle.
 	Handle HandleID
 
+	// Set by the file system: an arbitrary value to attach to the handle,
+	// which is supplied as HandleData in every later op carrying the handle,
+	// up to and including ReleaseFileHandleOp, and then dropped. This saves
+	// keeping a map from handles to their state.
+	HandleData interface{}
+
 	// By default, fuse invalidates the kernel's page cache for an inode when a
 	// new file handle is opened for that inode (https://tinyurl.com/yyb497zy).
 	// The intent appears to be to allow users to "see" content that has changed
@@ -673,8 +850,35 @@ type OpenFileOp struct {
 	// Enabling direct IO ensures that all client operations reach the fuse
 	// layer. This allows for filesystems whose file sizes are not known in
 	// advance, for example, because contents are generated on the fly.
+	//
+	// MountConfig.UseDirectIO sets this for every handle.
 	UseDirectIO bool
 
+	// Make lseek(2), pread(2) and pwrite(2) fail with ESPIPE for this handle,
+	// as for a pipe. Reads and writes still carry the offset of the handle's
+	// file position. Ignored on OS X.
+	NonSeekable bool
+
+	// Like NonSeekable, but the handle has no file position at all: reads and
+	// writes carry a zero offset, and may be issued concurrently, as for a
+	// socket. This suits files whose contents are a stream of messages, such
+	// as event feeds. Requires Linux 5.2 or later, and is ignored otherwise.
+	Stream bool
+
+	// Let the kernel send direct IO writes to this handle concurrently, rather
+	// than holding the inode lock for each one, for file systems that can
+	// cope with overlapping writes to the same file. Writes that append or
+	// extend the file are still serialized. Only affects direct IO, e.g. with
+	// UseDirectIO. Requires Linux 6.0 or later, and is ignored otherwise.
+	ParallelDirectWrites bool
+
+	// The flags passed to open(2), less those the kernel handles itself such
+	// as O_CREAT and O_EXCL. Use its methods, e.g. AccessMode and IsAppend,
+	// rather than masking it with platform-specific constants.
+	//
+	// With fuse.MountConfig.EnableAtomicTrunc, the file system must truncate
+	// the file to zero length before replying when IsTruncate is set, since
+	// the kernel then sends no SetInodeAttributesOp to do so.
 	OpenFlags fusekernel.OpenFlags
 
 	OpContext OpContext
@@ -685,12 +889,26 @@ type OpenFileOp struct {
 // Note that this op is not sent for every call to read(2) by the end user;
 // some reads may be served by the page cache. See notes on WriteFileOp for
 // more.
+//
+// Conversely, some reads are sent on the kernel's own initiative, to read
+// ahead of what the user has asked for so far. The fuse protocol doesn't say
+// which reads these are: the kernel fills the page cache through the same
+// path (fuse_readahead) whether or not a user is waiting on the pages, and
+// the request carries no flag saying which it is. So file systems can't
+// safely deprioritize or fail reads on the assumption that they are
+// speculative. The amount of readahead for a mount can instead be limited
+// through the read_ahead_kb setting of its backing device info, at
+// /sys/class/bdi/0:<minor>/read_ahead_kb.
 type ReadFileOp struct {
 	// The file inode that we are reading, and the handle previously returned by
 	// CreateFile or OpenFile when opening that inode.
 	Inode  InodeID
 	Handle HandleID
 
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The offset within the file at which to read.
 	Offset int64
 
@@ -703,6 +921,11 @@ type ReadFileOp struct {
 
 	// Set by the file system:
 	// A list of slices of data to send back to the client for vectored reads.
+	//
+	// This may also be set when Dst is not nil, to reply with data the file
+	// system already has in memory rather than copying it into Dst. Either
+	// way the slices are written to the kernel as they are, so they must not
+	// be modified until the reply has been sent; see Callback.
 	Data [][]byte
 
 	// Set by the file system: the number of bytes read.
@@ -754,6 +977,10 @@ type WriteFileOp struct {
 	Inode  InodeID
 	Handle HandleID
 
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// The offset at which to write the data below.
 	//
 	// The man page for pwrite(2) implies that aside from changing the file
@@ -781,8 +1008,53 @@ type WriteFileOp struct {
 	// The FUSE documentation requires that exactly the number of bytes supplied
 	// be written, except on error (https://tinyurl.com/yuruk5tx). This appears
 	// to be because it uses file mmapping machinery
-	// (https://tinyurl.com/avxy3dvm) to write a page at a time.
-	Data      []byte
+	// (https://tinyurl.com/avxy3dvm) to write a page at a time. File systems
+	// that can't accept all of it at once, e.g. because the backend has hard
+	// record boundaries, may instead report a short write with BytesWritten.
+	//
+	// Nil if fuse.MountConfig.StreamWrites or SpliceWrites is set; see Reader.
+	Data []byte
+
+	// The number of bytes to write.
+	Size int64
+
+	// Set instead of Data if fuse.MountConfig.StreamWrites or SpliceWrites is
+	// set: a reader over the Size bytes to write, for file systems that pass
+	// data on to a backend as a stream and so have no need to hold on to it. It
+	// also implements io.WriterTo, so io.Copy from it makes no intermediate
+	// copy, and with SpliceWrites none at all into an *os.File or socket.
+	Reader io.Reader
+
+	// Set along with Reader: a function that the file system may call once it
+	// has finished with Reader, after which Reader must not be used. This lets
+	// the buffer that Reader reads from be reused before the op is responded
+	// to, for example while the file system waits for its backend to commit
+	// the data. Responding to the op has the same effect.
+	Release func()
+
+	// Set by the file system: the number of bytes written, if fewer than all
+	// of them, in which case the kernel returns the short count from write(2)
+	// as it would for any other file. Zero means that all Size bytes were
+	// written; to write nothing, return an error instead. Values greater than
+	// Size are treated as Size.
+	BytesWritten int
+
+	// Whether the kernel is writing back dirty data from its page cache, as it
+	// does with writeback caching (see MountConfig.DisableWritebackCaching) or
+	// for files mapped with mmap(2), rather than passing on a write(2) as it
+	// happens. Writeback data may have been written by any number of calls,
+	// possibly long ago, and the kernel may send several such ops
+	// concurrently; a file system may reasonably batch it more aggressively
+	// than data the writer is waiting on.
+	Writeback bool
+
+	// For other writes, the flags of the file handle written to, along with
+	// any the write itself implies (e.g. O_DSYNC for pwritev2(2) with
+	// RWF_DSYNC). OpenFlags.IsDirect reports O_DIRECT, and OpenFlags.IsSync
+	// reports whether the writer expects the data to be durable before the op
+	// returns. Zero for writeback.
+	OpenFlags fusekernel.OpenFlags
+
 	OpContext OpContext
 
 	// If set, this function will be invoked after the operation response has been
@@ -802,15 +1074,28 @@ type WriteFileOp struct {
 //   - (https://tinyurl.com/bdhhfam5) vfs_fsync_range calls f_op->fsync.
 //
 // Note that this is also sent by fdatasync(2) (https://tinyurl.com/ja5wtszf),
-// and may be sent for msync(2) with the MS_SYNC flag (see the notes on
-// FlushFileOp).
+// with DataSync set, and may be sent for msync(2) with the MS_SYNC flag (see
+// the notes on FlushFileOp).
 //
 // See also: FlushFileOp, which may perform a similar function when closing a
 // file (but which is not used in "real" file systems).
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats file syncs as succeeding.
 type SyncFileOp struct {
 	// The file and handle being sync'd.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// Set for fdatasync(2), which requires only the file's contents and the
+	// metadata needed to read them back, such as its size, to be durable. File
+	// systems may then skip flushing metadata such as modification times.
+	DataSync bool
+
 	OpContext OpContext
 }
 
@@ -865,10 +1150,28 @@ type SyncFileOp struct {
 // data. A file system that writes to remote storage however probably wants
 // to at least schedule a real flush, and maybe do it immediately in order to
 // return any errors that occur.
+//
+// Unlike SyncFileOp, the kernel gives no indication of how much needs to be
+// flushed: close(2) has no counterpart to fdatasync(2).
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats flushes as succeeding.
 type FlushFileOp struct {
 	// The file and handle being flushed.
-	Inode     InodeID
-	Handle    HandleID
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The owner of any POSIX locks held by the process closing the descriptor;
+	// see GetLockOp.Owner. Closing any descriptor for a file releases the
+	// process's POSIX locks on it, but the kernel doesn't send a SetLockOp to
+	// say so, so file systems that implement SetLockOp should release the
+	// locks held by LockOwner here, as libfuse does.
+	LockOwner uint64
+
 	OpContext OpContext
 }
 
@@ -885,7 +1188,21 @@ type ReleaseFileHandleOp struct {
 	// The handle ID to be released. The kernel guarantees that this ID will not
 	// be used in further calls to the file system (unless it is reissued by the
 	// file system).
-	Handle    HandleID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// Set if flock(2) was used through the handle, in which case the file
+	// system should release any flock locks held by LockOwner, as closing the
+	// last descriptor for an open file releases them. See FlockOp.
+	//
+	// POSIX locks are instead released on each close; see
+	// FlushFileOp.LockOwner. LockOwner is zero unless UnlockFlocks is set.
+	UnlockFlocks bool
+	LockOwner    uint64
+
 	OpContext OpContext
 }
 
@@ -911,6 +1228,9 @@ type ReadSymlinkOp struct {
 //
 // This is sent in response to removexattr(2). Return ENOATTR if the
 // extended attribute does not exist.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails removexattr(2) with EOPNOTSUPP.
 type RemoveXattrOp struct {
 	// The inode that we are removing an extended attribute from.
 	Inode InodeID
@@ -924,6 +1244,9 @@ type RemoveXattrOp struct {
 //
 // This is sent in response to getxattr(2). Return ENOATTR if the
 // extended attribute does not exist.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails getxattr(2) with EOPNOTSUPP.
 type GetXattrOp struct {
 	// The inode whose extended attribute we are reading.
 	Inode InodeID
@@ -931,8 +1254,17 @@ type GetXattrOp struct {
 	// The name of the extended attribute.
 	Name string
 
+	// OS X only: the offset within the value at which to start reading, which
+	// is non-zero only for the resource fork (com.apple.ResourceFork). Always
+	// zero on Linux.
+	Position uint32
+
 	// The destination buffer.  If the size is too small for the
 	// value, the ERANGE error should be sent.
+	//
+	// Empty if the caller only wants to know the size of the value, e.g. to
+	// allocate a buffer for it, in which case the file system should set
+	// BytesRead to the size and succeed.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -945,6 +1277,9 @@ type GetXattrOp struct {
 // List all the extended attributes for a file.
 //
 // This is sent in response to listxattr(2).
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails listxattr(2) with EOPNOTSUPP.
 type ListXattrOp struct {
 	// The inode whose extended attributes we are listing.
 	Inode InodeID
@@ -954,6 +1289,9 @@ type ListXattrOp struct {
 	//
 	// The output data should consist of a sequence of NUL-terminated strings,
 	// one for each xattr.
+	//
+	// Empty if the caller only wants to know the size of the list, in which
+	// case the file system should set BytesRead to the size and succeed.
 	Dst []byte
 
 	// Set by the file system: the number of bytes read into Dst, or
@@ -967,6 +1305,9 @@ type ListXattrOp struct {
 //
 // This is sent in response to setxattr(2). Return ENOSPC if there is
 // insufficient space remaining to store the extended attribute.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails setxattr(2) with EOPNOTSUPP.
 type SetXattrOp struct {
 	// The inode whose extended attribute we are setting.
 	Inode InodeID
@@ -974,22 +1315,41 @@ type SetXattrOp struct {
 	// The name of the extended attribute
 	Name string
 
-	// The value to for the extened attribute.
+	// The value to for the extened attribute, which may be empty.
 	Value []byte
 
-	// If Flags is 0x1, and the attribute exists already, EEXIST should be returned.
-	// If Flags is 0x2, and the attribute does not exist, ENOATTR should be returned.
-	// If Flags is 0x0, the extended attribute will be created if need be, or will
-	// simply replace the value if the attribute exists.
-	Flags     uint32
+	// The flags passed to setxattr(2), with the values of this platform's
+	// unix.XATTR_* constants. If Flags has unix.XATTR_CREATE set and the
+	// attribute exists already, EEXIST should be returned. If it has
+	// unix.XATTR_REPLACE set and the attribute does not exist, ENOATTR should
+	// be returned. Otherwise the extended attribute will be created if need
+	// be, or will simply replace the value if the attribute exists.
+	//
+	// On Linux, that is 0x1 for XATTR_CREATE and 0x2 for XATTR_REPLACE. On OS
+	// X the values differ, and other flags such as XATTR_NOFOLLOW may be set.
+	Flags uint32
+
+	// OS X only: the offset within the value at which to write, which is
+	// non-zero only for the resource fork (com.apple.ResourceFork). Always
+	// zero on Linux.
+	Position uint32
+
 	OpContext OpContext
 }
 
+// Allocate or deallocate space within a file, in response to fallocate(2).
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// fails fallocate(2) with EOPNOTSUPP.
 type FallocateOp struct {
 	// The inode and handle we are fallocating
 	Inode  InodeID
 	Handle HandleID
 
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
 	// Start of the byte range
 	Offset uint64
 
@@ -1005,6 +1365,279 @@ type FallocateOp struct {
 	OpContext OpContext
 }
 
+// Find the next part of a file that holds data, or the next hole in it, in
+// response to lseek(2) with SEEK_DATA or SEEK_HOLE. This lets tools that
+// understand sparse files, such as cp --sparse and tar, skip over holes.
+// Return ENXIO if the offset is at or past the end of the file, or if Whence
+// is SEEK_DATA and there is no data past it.
+//
+// Return ENOSYS to have the kernel stop sending these and treat every file as
+// data throughout, with a single hole at its end.
+type SeekOp struct {
+	// The file inode, and the handle through which it is being read.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The offset from which to search, and what to search for: either
+	// unix.SEEK_DATA or unix.SEEK_HOLE.
+	Offset int64
+	Whence int
+
+	// Set by the file system: the offset of the data or hole found. As the end
+	// of the file counts as a hole, a search for one before the end always
+	// succeeds.
+	ResultOffset int64
+
+	OpContext OpContext
+}
+
+// Copy a range of data from one open file to another, possibly the same one,
+// in response to copy_file_range(2) on two files within the file system. This
+// lets the file system copy the data itself, perhaps without moving it at
+// all, rather than the kernel reading it out and writing it back.
+//
+// Return ENOSYS to have the kernel stop sending these and fall back to copying
+// the data with reads and writes.
+type CopyFileRangeOp struct {
+	// The file to copy from, the handle through which it was opened, and the
+	// offset within it at which to start.
+	SrcInode  InodeID
+	SrcHandle HandleID
+	SrcOffset uint64
+
+	// The value the file system attached to SrcHandle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	SrcHandleData interface{}
+
+	// Likewise for the file to copy to.
+	DstInode      InodeID
+	DstHandle     HandleID
+	DstOffset     uint64
+	DstHandleData interface{}
+
+	// The number of bytes to copy, which the kernel caps below 4 GiB.
+	Length uint64
+
+	// The flags passed to copy_file_range(2). None are currently defined.
+	Flags uint64
+
+	// Set by the file system: the number of bytes copied, which may be fewer
+	// than Length, e.g. because the source file ends sooner. As with
+	// copy_file_range(2), zero means that nothing was copied; values greater
+	// than Length are treated as Length.
+	BytesCopied uint64
+
+	OpContext OpContext
+}
+
+// Test for a POSIX lock that would prevent the one described from being set,
+// in response to fcntl(2) with F_GETLK or F_OFD_GETLK.
+//
+// The kernel sends these and SetLockOps only if MountConfig.EnablePosixLocks
+// is set. Otherwise it keeps track of locks itself, which is enough unless
+// they must be seen by processes on other machines, e.g. for a network file
+// system.
+type GetLockOp struct {
+	// The file inode, and the handle through which the lock is being tested.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// An opaque ID for the owner of the lock: the open file description for
+	// OFD locks, and otherwise the file table of the calling process. Locks
+	// with the same owner never conflict.
+	Owner uint64
+
+	// The lock that the caller would like to set, of type unix.F_RDLCK or
+	// unix.F_WRLCK.
+	Lock FileLock
+
+	// Set by the file system: a lock held by another owner that conflicts with
+	// Lock. Leave Type as unix.F_UNLCK, which it is initialized to, if there
+	// is none.
+	Conflict FileLock
+
+	OpContext OpContext
+}
+
+// Set, change, or release a POSIX lock, in response to fcntl(2) with F_SETLK,
+// F_SETLKW, F_OFD_SETLK or F_OFD_SETLKW. Setting a lock on a range replaces
+// any part of a lock by the same owner that it overlaps, splitting it if need
+// be, as does releasing one. See GetLockOp for when these are sent.
+//
+// Locks released because the process closed a descriptor for the file are
+// not unlocked with a SetLockOp; see FlushFileOp.LockOwner.
+type SetLockOp struct {
+	// The file inode, and the handle through which the lock is being set.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The owner of the lock. See GetLockOp.Owner.
+	Owner uint64
+
+	// The lock to set. A Type of unix.F_UNLCK releases the range.
+	Lock FileLock
+
+	// If Wait is false, return EAGAIN if a conflicting lock is held. If it is
+	// true, block until the lock can be set instead. The op's context is
+	// cancelled if the caller is interrupted while waiting, in which case the
+	// file system should return EINTR without setting the lock. It may return
+	// EDEADLK if waiting would never end because of a cycle of owners waiting
+	// on each other's locks.
+	Wait bool
+
+	OpContext OpContext
+}
+
+// Take, convert, or release a lock on a whole file, in response to flock(2).
+// Unlike POSIX locks, flock locks belong to an open file description, and so
+// are shared by descriptors duplicated from it, or inherited across fork(2),
+// and are released when the last of them is closed; see
+// ReleaseFileHandleOp.UnlockFlocks.
+//
+// The kernel sends these only if MountConfig.EnableFlockLocks is set.
+// Otherwise it keeps track of flock locks itself, and processes on other
+// machines can't see them.
+type FlockOp struct {
+	// The file inode, and the handle through which the lock is being taken.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// An opaque ID for the owner of the lock, i.e. the open file description.
+	// It is the same for every FlockOp sent through the same handle, and is
+	// supplied again as ReleaseFileHandleOp.LockOwner when the handle is
+	// released.
+	Owner uint64
+
+	// The kind of lock: unix.F_RDLCK for a shared lock (LOCK_SH), unix.F_WRLCK
+	// for an exclusive one (LOCK_EX), or unix.F_UNLCK to release the lock
+	// (LOCK_UN). Taking a lock of one kind converts a lock of the other held by
+	// the same owner.
+	Type uint32
+
+	// Clear if the caller passed LOCK_NB, in which case return EWOULDBLOCK if
+	// the lock is held by another owner. Otherwise wait as for
+	// SetLockOp.Wait.
+	Wait bool
+
+	OpContext OpContext
+}
+
+// Carry out an ioctl(2) on an open file or directory.
+//
+// The kernel only passes on ioctls whose request number encodes the size and
+// direction of the data that the argument points to, as with the _IOR, _IOW
+// and _IOWR macros, e.g. FS_IOC_GETFLAGS. It copies that much data in from
+// the caller as Input before sending the op, and copies Output back out
+// after. Other ioctls fail with ENOTTY without reaching the file system,
+// except for CUSE, which sends them with Unrestricted set, leaving the file
+// system to ask for the memory it needs with a retry.
+//
+// Return ENOTTY for request numbers that the file system doesn't recognize, as
+// ioctl(2) does.
+type IoctlOp struct {
+	// The inode, and the handle through which it is being accessed: one
+	// returned by OpenFileOp, or by OpenDirOp if Dir is set.
+	Inode  InodeID
+	Handle HandleID
+	Dir    bool
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The request number and argument passed to ioctl(2). For a restricted
+	// ioctl, Arg is an address in the caller's memory that is of no use to the
+	// file system; the data it points to is in Input.
+	Cmd uint32
+	Arg uint64
+
+	// Set if the caller is a 32-bit process on a 64-bit kernel, in which case
+	// the layout of any structs in the data may differ.
+	Compat bool
+
+	// Set if the file system may ask for a retry. See Retry.
+	Unrestricted bool
+
+	// The data copied in from the caller, and the most that may be copied back
+	// out.
+	Input      []byte
+	OutputSize int
+
+	// Set by the file system: the value for ioctl(2) to return, which must not
+	// be negative, and the data to copy back out to the caller. Output beyond
+	// OutputSize is dropped.
+	Result int32
+	Output []byte
+
+	// Set by the file system, for unrestricted ioctls only: have the kernel
+	// send the op again with the given regions of the caller's memory, usually
+	// worked out from Arg, copied in as Input, and with OutputSize covering the
+	// RetryOutput regions, which Output is then copied out to in turn. There
+	// may be at most 256 regions in all.
+	Retry       bool
+	RetryInput  []IoctlIovec
+	RetryOutput []IoctlIovec
+
+	OpContext OpContext
+}
+
+// Report which IO events are ready on an open file, in response to poll(2),
+// select(2), or epoll. This matters for files whose readiness changes over
+// time, such as FIFO-like or device-like files whose reads block until data
+// arrives.
+//
+// Return ENOSYS to have the kernel stop sending these and treat every file as
+// always ready for reading and writing, as it does for regular files.
+type PollOp struct {
+	// The file inode, and the handle through which it is being polled.
+	Inode  InodeID
+	Handle HandleID
+
+	// The value the file system attached to the handle when opening it, if
+	// any. See OpenFileOp.HandleData.
+	HandleData interface{}
+
+	// The events the caller is interested in, a combination of unix.POLLIN,
+	// unix.POLLOUT, and so on. Zero with kernels older than protocol version
+	// 7.21, in which case the file system should report all of the events that
+	// are ready.
+	Events uint32
+
+	// Set if the caller will wait should none of the events be ready. The file
+	// system must then call Notifier.NotifyPollWakeup with PollHandle once any
+	// of them become ready, or the caller may wait forever. PollHandle is the
+	// same for every PollOp on the handle, so one wakeup serves all of the
+	// waiters; they poll again to find out what happened.
+	ScheduleNotify bool
+	PollHandle     uint64
+
+	// Set by the file system: the events that are ready.
+	Revents uint32
+
+	OpContext OpContext
+}
+
+// Make the whole file system durable, in response to syncfs(2), on kernels
+// that send this.
+//
+// If the file system returns ENOSYS, the kernel stops sending this op and
+// treats syncs as succeeding.
 type SyncFSOp struct {
 	Inode     InodeID
 	OpContext OpContext
@@ -56,6 +56,16 @@ func init() {
 	}
 }
 
+// AccessMode says whether a file is being opened for reading, writing, or
+// both. See OpenFileOp.OpenFlags.AccessMode.
+type AccessMode = fusekernel.AccessMode
+
+const (
+	AccessReadOnly  = fusekernel.AccessReadOnly
+	AccessWriteOnly = fusekernel.AccessWriteOnly
+	AccessReadWrite = fusekernel.AccessReadWrite
+)
+
 // InodeAttributes contains attributes for a file or directory inode. It
 // corresponds to struct inode (https://tinyurl.com/23sr9svd).
 type InodeAttributes struct {
@@ -87,7 +97,8 @@ type InodeAttributes struct {
 	//
 	Mode os.FileMode
 
-	// The device number. Only valid if the file is a device
+	// The device number of a character or block device, as returned by
+	// unix.Mkdev. Ignored for other types of file.
 	Rdev uint32
 
 	// Time information. See `man 2 stat` for full details.
@@ -226,4 +237,39 @@ type ChildInodeEntry struct {
 	// Beware: this value is ignored on OS X, where entry caching is disabled by
 	// default. See notes on MountConfig.EnableVnodeCaching for more.
 	EntryExpiration time.Time
+
+	// An arbitrary value to attach to the child inode, replacing any value
+	// already attached, if fuse.MountConfig.TrackInodeData is set. Leave nil
+	// to keep the current value. Ops on the inode can fetch it with
+	// fuse.InodeData until the kernel forgets the inode, at which point it's
+	// dropped. This saves keeping a map from inodes to cached state and
+	// getting its cleanup on forget right. Entries returned by ReadDirPlusOp
+	// can't attach values.
+	Data interface{}
+}
+
+// FileLock describes a POSIX record lock on a range of a file, as set and
+// tested with fcntl(2). It is shared by GetLockOp and SetLockOp.
+type FileLock struct {
+	// The range of bytes covered, from Start through End inclusive. A lock that
+	// extends to the end of the file, however far it grows, has End set to
+	// math.MaxInt64.
+	Start uint64
+	End   uint64
+
+	// The kind of lock: unix.F_RDLCK for a shared lock, unix.F_WRLCK for an
+	// exclusive one, or unix.F_UNLCK for none, with this platform's values.
+	Type uint32
+
+	// The ID of the process that holds or wants the lock. The kernel translates
+	// it between PID namespaces; file systems that share locks between machines
+	// can't make it meaningful to the caller, and usually leave it zero.
+	Pid uint32
+}
+
+// IoctlIovec describes a region of the memory of the process calling ioctl(2),
+// for IoctlOp.RetryInput and IoctlOp.RetryOutput.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
 }
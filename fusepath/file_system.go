@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fusepath serves file systems whose methods are keyed by path, like
+// those written against libfuse's high-level API, for file systems simple
+// enough not to need inodes of their own. NewServer adapts a FileSystem to a
+// fuse.Server, taking care of inode numbering, lookup counts and handles:
+//
+//	server := fusepath.NewServer(&myFS{})
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+//
+// Paths are slash-separated and absolute, with "/" for the root of the file
+// system. Errors are returned as for fuseutil.FileSystem, usually as
+// syscall.Errno values.
+//
+// The kernel caches nothing, so every system call reaches the file system.
+// Renaming a directory takes time proportional to the number of inodes the
+// kernel knows about.
+package fusepath
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A FileSystem handles requests for the files and directories under its root,
+// named by path. Methods may be called concurrently. Embed
+// NotImplementedFileSystem to leave methods out.
+type FileSystem interface {
+	// Return the attributes of the named file, or ENOENT if it doesn't exist.
+	GetAttr(ctx context.Context, name string) (fuseops.InodeAttributes, error)
+
+	// Change the attributes of the named file, returning them as changed.
+	SetAttr(
+		ctx context.Context,
+		name string,
+		attrs SetAttrs) (fuseops.InodeAttributes, error)
+
+	// List the named directory, without "." and "..". The listing is taken
+	// when the directory is opened, and kept until it is closed.
+	ReadDir(ctx context.Context, name string) ([]DirEntry, error)
+
+	// Open the named file with the supplied open(2) flags, less those the
+	// kernel handles itself such as O_CREAT and O_EXCL.
+	Open(ctx context.Context, name string, flags int) (File, error)
+
+	// Create and open the named file, which doesn't exist.
+	Create(ctx context.Context, name string, mode os.FileMode) (File, error)
+
+	// Create the named directory, which doesn't exist.
+	Mkdir(ctx context.Context, name string, mode os.FileMode) error
+
+	// Remove the named file, or the named directory, which is empty.
+	Unlink(ctx context.Context, name string) error
+	Rmdir(ctx context.Context, name string) error
+
+	// Rename the file or directory oldName to newName, replacing anything
+	// that newName names already, as for rename(2).
+	Rename(ctx context.Context, oldName string, newName string) error
+
+	// Create a symlink named name, with the supplied target, or return the
+	// target of the named symlink.
+	Symlink(ctx context.Context, target string, name string) error
+	Readlink(ctx context.Context, name string) (string, error)
+
+	// Called when the file system is unmounted.
+	Destroy()
+}
+
+// An open file, as returned by FileSystem.Open and Create. Methods may be
+// called concurrently.
+type File interface {
+	// Read into dst from the supplied offset, as for io.ReaderAt, except that
+	// a short read or io.EOF means the end of the file.
+	Read(ctx context.Context, dst []byte, offset int64) (int, error)
+
+	// Write data at the supplied offset.
+	Write(ctx context.Context, data []byte, offset int64) error
+
+	// Flush the file's data, for close(2), fsync(2) and fdatasync(2).
+	Flush(ctx context.Context) error
+
+	// Close the file, once the kernel is done with it.
+	Release() error
+}
+
+// An entry of a directory, as returned by FileSystem.ReadDir.
+type DirEntry struct {
+	Name string
+	Type fuseutil.DirentType
+}
+
+// The attributes to change with FileSystem.SetAttr, or nil for attributes
+// that don't need a change. Size is set for truncate(2).
+type SetAttrs struct {
+	Uid   *uint32
+	Gid   *uint32
+	Size  *uint64
+	Mode  *os.FileMode
+	Atime *time.Time
+	Mtime *time.Time
+}
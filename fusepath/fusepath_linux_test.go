@@ -0,0 +1,255 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusepath"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system holding directories and files in a map keyed by path, which
+// records the paths it is asked for the attributes of.
+type mapFS struct {
+	fusepath.NotImplementedFileSystem
+
+	mu       sync.Mutex
+	files    map[string][]byte // nil for directories
+	getAttrs []string
+}
+
+func newMapFS() *mapFS {
+	return &mapFS{
+		files: map[string][]byte{
+			"/":        nil,
+			"/dir":     nil,
+			"/dir/foo": []byte("taco"),
+		},
+	}
+}
+
+func (fs *mapFS) GetAttr(
+	ctx context.Context,
+	name string) (fuseops.InodeAttributes, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.getAttrs = append(fs.getAttrs, name)
+	contents, ok := fs.files[name]
+	if !ok {
+		return fuseops.InodeAttributes{}, fuse.ENOENT
+	}
+
+	if contents == nil {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: os.ModeDir | 0700}, nil
+	}
+
+	return fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0600,
+		Size:  uint64(len(contents)),
+	}, nil
+}
+
+func (fs *mapFS) ReadDir(
+	ctx context.Context,
+	name string) ([]fusepath.DirEntry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var entries []fusepath.DirEntry
+	for p, contents := range fs.files {
+		if p == "/" || path.Dir(p) != name {
+			continue
+		}
+
+		e := fusepath.DirEntry{Name: path.Base(p), Type: fuseutil.DT_File}
+		if contents == nil {
+			e.Type = fuseutil.DT_Directory
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+func (fs *mapFS) Open(
+	ctx context.Context,
+	name string,
+	flags int) (fusepath.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	contents, ok := fs.files[name]
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+
+	return &mapFile{r: bytes.NewReader(contents)}, nil
+}
+
+func (fs *mapFS) Rename(
+	ctx context.Context,
+	oldName string,
+	newName string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for p, contents := range fs.files {
+		if p == oldName || path.Dir(p) == oldName {
+			delete(fs.files, p)
+			fs.files[newName+p[len(oldName):]] = contents
+		}
+	}
+
+	return nil
+}
+
+type mapFile struct {
+	r *bytes.Reader
+}
+
+func (f *mapFile) Read(ctx context.Context, dst []byte, off int64) (int, error) {
+	return f.r.ReadAt(dst, off)
+}
+
+func (f *mapFile) Write(ctx context.Context, data []byte, off int64) error {
+	return fuse.ENOSYS
+}
+
+func (f *mapFile) Flush(ctx context.Context) error {
+	return nil
+}
+
+func (f *mapFile) Release() error {
+	return nil
+}
+
+func TestServer(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fusepath.NewServer(newMapFS()),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+	defer k.Close()
+
+	attrs, err := k.Stat("dir/foo")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if attrs.Size != 4 {
+		t.Errorf("Size: %d, want 4", attrs.Size)
+	}
+
+	if _, err := k.Stat("dir/bar"); err != syscall.ENOENT {
+		t.Errorf("Stat(dir/bar): %v", err)
+	}
+
+	contents, err := k.ReadFile("dir/foo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != "taco" {
+		t.Errorf("Contents: %q, want %q", contents, "taco")
+	}
+
+	entries, err := k.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	if len(entries) != 1 || entries[0].Name != "foo" || entries[0].Type != fuseutil.DT_File {
+		t.Errorf("Entries: %+v", entries)
+	}
+}
+
+func TestRenameMovesInodes(t *testing.T) {
+	fs := newMapFS()
+	k, err := fusetesting.NewFakeKernel(
+		fusepath.NewServer(fs),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+	defer k.Close()
+
+	// Look up the directory and the file within it, keeping the inodes.
+	var ids []fuseops.InodeID
+	var parent fuseops.InodeID = fuseops.RootInodeID
+	for _, name := range []string{"dir", "foo"} {
+		r, err := k.Call(fusekernel.OpLookup, uint64(parent), []byte(name+"\x00"))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Lookup(%s): %v, %v", name, err, r.Error)
+		}
+
+		var out fusekernel.EntryOut
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		parent = fuseops.InodeID(out.Nodeid)
+		ids = append(ids, parent)
+	}
+
+	in := fusekernel.RenameIn{Newdir: uint64(fuseops.RootInodeID)}
+	r, err := k.Call(
+		fusekernel.OpRename,
+		uint64(fuseops.RootInodeID),
+		unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+		[]byte("dir\x00moved\x00"))
+
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Rename: %v, %v", err, r.Error)
+	}
+
+	fs.mu.Lock()
+	fs.getAttrs = nil
+	fs.mu.Unlock()
+
+	// The inodes now refer to the new paths.
+	for _, id := range ids {
+		if _, err := k.GetAttributes(id); err != nil {
+			t.Errorf("GetAttributes(%d): %v", id, err)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	want := []string{"/moved", "/moved/foo"}
+	if !reflect.DeepEqual(fs.getAttrs, want) {
+		t.Errorf("GetAttr calls: %q, want %q", fs.getAttrs, want)
+	}
+}
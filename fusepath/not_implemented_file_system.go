@@ -0,0 +1,107 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"os"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A FileSystem that responds to all requests with fuse.ENOSYS. Embed this in
+// your struct to inherit default implementations for the methods you don't
+// care about, ensuring your struct will continue to implement FileSystem even
+// as new methods are added.
+type NotImplementedFileSystem struct {
+}
+
+var _ FileSystem = &NotImplementedFileSystem{}
+
+func (fs *NotImplementedFileSystem) GetAttr(
+	ctx context.Context,
+	name string) (fuseops.InodeAttributes, error) {
+	return fuseops.InodeAttributes{}, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetAttr(
+	ctx context.Context,
+	name string,
+	attrs SetAttrs) (fuseops.InodeAttributes, error) {
+	return fuseops.InodeAttributes{}, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) ReadDir(
+	ctx context.Context,
+	name string) ([]DirEntry, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Open(
+	ctx context.Context,
+	name string,
+	flags int) (File, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Create(
+	ctx context.Context,
+	name string,
+	mode os.FileMode) (File, error) {
+	return nil, fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Mkdir(
+	ctx context.Context,
+	name string,
+	mode os.FileMode) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Unlink(
+	ctx context.Context,
+	name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rmdir(
+	ctx context.Context,
+	name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Rename(
+	ctx context.Context,
+	oldName string,
+	newName string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Symlink(
+	ctx context.Context,
+	target string,
+	name string) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Readlink(
+	ctx context.Context,
+	name string) (string, error) {
+	return "", fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Destroy() {
+}
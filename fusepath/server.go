@@ -0,0 +1,559 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusepath
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// The inode number listed for directory entries that the kernel hasn't looked
+// up, as libfuse does without its use_ino option. Lookups give the real one.
+const unknownInode = fuseops.InodeID(0xffffffff)
+
+// NewServer returns a server that serves fs.
+func NewServer(fs FileSystem) fuse.Server {
+	a := &adapter{
+		fs:     fs,
+		inodes: fuseutil.NewInodeTable(&node{path: "/"}),
+		ids:    map[string]fuseops.InodeID{"/": fuseops.RootInodeID},
+	}
+
+	return fuseutil.NewFileSystemServer(a)
+}
+
+// An inode that the kernel knows about.
+type node struct {
+	// The inode's path, or empty if it has been removed.
+	//
+	// GUARDED_BY(adapter.mu)
+	path string
+}
+
+// An io.ReaderAt that reads from a File on behalf of an op.
+type fileReader struct {
+	ctx context.Context
+	f   File
+}
+
+func (r fileReader) ReadAt(p []byte, off int64) (int, error) {
+	return r.f.Read(r.ctx, p, off)
+}
+
+// An open directory, with the listing taken when it was opened.
+type dirHandle struct {
+	entries []DirEntry
+}
+
+type adapter struct {
+	fuseutil.NotImplementedFileSystem
+
+	fs    FileSystem
+	files fuseutil.HandleTable[File]
+	dirs  fuseutil.HandleTable[*dirHandle]
+
+	// The inodes that the kernel knows about, each of which is freed once the
+	// kernel forgets it.
+	inodes *fuseutil.InodeTable[*node]
+
+	mu sync.Mutex
+
+	// The inode for each path that has one.
+	//
+	// INVARIANT: For each p, id in ids, inodes has id with path p.
+	//
+	// GUARDED_BY(mu)
+	ids map[string]fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the path of the supplied inode, or ENOENT if it has been removed.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) pathOf(id fuseops.InodeID) (string, error) {
+	n, ok := a.inodes.Get(id)
+	if !ok {
+		return "", fuse.ENOENT
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n.path == "" {
+		return "", fuse.ENOENT
+	}
+
+	return n.path, nil
+}
+
+// Return the path of the supplied child of the supplied directory.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) childPath(parent fuseops.InodeID, name string) (string, error) {
+	p, err := a.pathOf(parent)
+	if err != nil {
+		return "", err
+	}
+
+	return path.Join(p, name), nil
+}
+
+// Fill in entry for the supplied path, which has the supplied attributes,
+// handing its inode to the kernel.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) lookedUp(
+	p string,
+	attrs fuseops.InodeAttributes,
+	entry *fuseops.ChildInodeEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	id, ok := a.ids[p]
+	if !ok {
+		id = a.inodes.Add(&node{path: p})
+		a.ids[p] = id
+	}
+
+	a.inodes.LookedUp(id, entry)
+	entry.Attributes = attrs
+
+	// Only the kernel refers to the inode, so it is freed once forgotten.
+	if !ok {
+		a.inodes.Unlink(id)
+	}
+}
+
+// Look the supplied path up, filling in entry.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) lookUp(
+	ctx context.Context,
+	p string,
+	entry *fuseops.ChildInodeEntry) error {
+	attrs, err := a.fs.GetAttr(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	a.lookedUp(p, attrs, entry)
+	return nil
+}
+
+// Drop the mapping for a freed inode.
+//
+// LOCKS_REQUIRED(a.mu)
+func (a *adapter) freed(n *node) {
+	if n.path != "" {
+		delete(a.ids, n.path)
+	}
+}
+
+// Record that the supplied path no longer exists.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) removed(p string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.removedLocked(p)
+}
+
+// LOCKS_REQUIRED(a.mu)
+func (a *adapter) removedLocked(p string) {
+	if id, ok := a.ids[p]; ok {
+		delete(a.ids, p)
+		if n, ok := a.inodes.Get(id); ok {
+			n.path = ""
+		}
+	}
+}
+
+// Record that oldPath has been renamed to newPath, along with everything
+// under it.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) renamed(oldPath string, newPath string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Whatever newPath named has been replaced.
+	a.removedLocked(newPath)
+
+	moved := make(map[string]fuseops.InodeID)
+	prefix := oldPath + "/"
+	for p, id := range a.ids {
+		if p == oldPath || strings.HasPrefix(p, prefix) {
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = id
+			delete(a.ids, p)
+		}
+	}
+
+	for p, id := range moved {
+		a.ids[p] = id
+		if n, ok := a.inodes.Get(id); ok {
+			n.path = p
+		}
+	}
+}
+
+// Return the inode to list for the supplied path.
+//
+// LOCKS_EXCLUDED(a.mu)
+func (a *adapter) listedInode(p string) fuseops.InodeID {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if id, ok := a.ids[p]; ok {
+		return id
+	}
+
+	return unknownInode
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (a *adapter) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (a *adapter) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	return a.lookUp(ctx, p, &op.Entry)
+}
+
+func (a *adapter) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = a.fs.GetAttr(ctx, p)
+	return err
+}
+
+func (a *adapter) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes, err = a.fs.SetAttr(ctx, p, SetAttrs{
+		Uid:   op.Uid,
+		Gid:   op.Gid,
+		Size:  op.Size,
+		Mode:  op.Mode,
+		Atime: op.Atime,
+		Mtime: op.Mtime,
+	})
+
+	return err
+}
+
+func (a *adapter) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if n, freed := a.inodes.Forget(op.Inode, op.N); freed {
+		a.freed(n)
+	}
+
+	return nil
+}
+
+func (a *adapter) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, n := range a.inodes.BatchForget(op.Entries) {
+		a.freed(n)
+	}
+
+	return nil
+}
+
+func (a *adapter) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := a.fs.Mkdir(ctx, p, op.Mode); err != nil {
+		return err
+	}
+
+	return a.lookUp(ctx, p, &op.Entry)
+}
+
+func (a *adapter) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	f, err := a.fs.Create(ctx, p, op.Mode)
+	if err != nil {
+		return err
+	}
+
+	if err := a.lookUp(ctx, p, &op.Entry); err != nil {
+		f.Release()
+		return err
+	}
+
+	op.Handle = a.files.Allocate(f)
+	return nil
+}
+
+func (a *adapter) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := a.fs.Symlink(ctx, op.Target, p); err != nil {
+		return err
+	}
+
+	return a.lookUp(ctx, p, &op.Entry)
+}
+
+func (a *adapter) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	oldPath, err := a.childPath(op.OldParent, op.OldName)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := a.childPath(op.NewParent, op.NewName)
+	if err != nil {
+		return err
+	}
+
+	if err := a.fs.Rename(ctx, oldPath, newPath); err != nil {
+		return err
+	}
+
+	a.renamed(oldPath, newPath)
+	return nil
+}
+
+func (a *adapter) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := a.fs.Rmdir(ctx, p); err != nil {
+		return err
+	}
+
+	a.removed(p)
+	return nil
+}
+
+func (a *adapter) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	p, err := a.childPath(op.Parent, op.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := a.fs.Unlink(ctx, p); err != nil {
+		return err
+	}
+
+	a.removed(p)
+	return nil
+}
+
+func (a *adapter) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	entries, err := a.fs.ReadDir(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = a.dirs.Allocate(&dirHandle{entries: entries})
+	return nil
+}
+
+func (a *adapter) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	d, ok := a.dirs.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	sink := fuseutil.NewReadDirSink(op)
+	for i := sink.Skip(); i < len(d.entries); i++ {
+		e := d.entries[i]
+		ok := sink.Add(fuseutil.Dirent{
+			Inode: a.listedInode(path.Join(p, e.Name)),
+			Name:  e.Name,
+			Type:  e.Type,
+		})
+
+		if !ok {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (a *adapter) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	a.dirs.Release(op.Handle)
+	return nil
+}
+
+func (a *adapter) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := a.fs.Open(ctx, p, int(op.OpenFlags))
+	if err != nil {
+		return err
+	}
+
+	op.Handle = a.files.Allocate(f)
+	return nil
+}
+
+func (a *adapter) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, ok := a.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return fuseutil.ServeReadAt(op, fileReader{ctx, f})
+}
+
+func (a *adapter) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	f, ok := a.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return f.Write(ctx, op.Data, op.Offset)
+}
+
+func (a *adapter) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	f, ok := a.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return f.Flush(ctx)
+}
+
+func (a *adapter) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	f, ok := a.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return f.Flush(ctx)
+}
+
+func (a *adapter) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	f, ok := a.files.Release(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return f.Release()
+}
+
+func (a *adapter) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	p, err := a.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	op.Target, err = a.fs.Readlink(ctx, p)
+	return err
+}
+
+func (a *adapter) Destroy() {
+	a.fs.Destroy()
+}
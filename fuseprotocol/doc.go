@@ -0,0 +1,24 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package fuseprotocol contains the parts of the FUSE kernel protocol that are
+// useful outside of package fuse, for example to tools that decode kernel
+// messages, to test harnesses, and to handlers registered with
+// fuse.Connection.SetRawOpHandler: opcodes, init and attribute flags, and
+// protocol version numbers.
+//
+// The values are those of the kernel's fuse_kernel.h, and are the ones used
+// by package fuse itself. They won't change, and names won't be removed, in
+// later versions of this package; new ones may be added as the protocol grows.
+package fuseprotocol
@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseprotocol
+
+import "github.com/jacobsa/fuse/internal/fusekernel"
+
+////////////////////////////////////////////////////////////////////////
+// Protocol versions
+////////////////////////////////////////////////////////////////////////
+
+// Protocol is a FUSE protocol version number, as negotiated with the kernel
+// when mounting.
+type Protocol = fusekernel.Protocol
+
+// The range of protocol versions that package fuse supports.
+const (
+	MinMajor = fusekernel.ProtoVersionMinMajor
+	MinMinor = fusekernel.ProtoVersionMinMinor
+	MaxMajor = fusekernel.ProtoVersionMaxMajor
+	MaxMinor = fusekernel.ProtoVersionMaxMinor
+)
+
+// The inode ID of the root of every file system.
+const RootID = fusekernel.RootID
+
+////////////////////////////////////////////////////////////////////////
+// Opcodes
+////////////////////////////////////////////////////////////////////////
+
+// The opcodes of requests from the kernel, found in the header of each one.
+const (
+	OpLookup        = fusekernel.OpLookup
+	OpForget        = fusekernel.OpForget
+	OpGetattr       = fusekernel.OpGetattr
+	OpSetattr       = fusekernel.OpSetattr
+	OpReadlink      = fusekernel.OpReadlink
+	OpSymlink       = fusekernel.OpSymlink
+	OpMknod         = fusekernel.OpMknod
+	OpMkdir         = fusekernel.OpMkdir
+	OpUnlink        = fusekernel.OpUnlink
+	OpRmdir         = fusekernel.OpRmdir
+	OpRename        = fusekernel.OpRename
+	OpLink          = fusekernel.OpLink
+	OpOpen          = fusekernel.OpOpen
+	OpRead          = fusekernel.OpRead
+	OpWrite         = fusekernel.OpWrite
+	OpStatfs        = fusekernel.OpStatfs
+	OpRelease       = fusekernel.OpRelease
+	OpFsync         = fusekernel.OpFsync
+	OpSetxattr      = fusekernel.OpSetxattr
+	OpGetxattr      = fusekernel.OpGetxattr
+	OpListxattr     = fusekernel.OpListxattr
+	OpRemovexattr   = fusekernel.OpRemovexattr
+	OpFlush         = fusekernel.OpFlush
+	OpInit          = fusekernel.OpInit
+	OpOpendir       = fusekernel.OpOpendir
+	OpReaddir       = fusekernel.OpReaddir
+	OpReleasedir    = fusekernel.OpReleasedir
+	OpFsyncdir      = fusekernel.OpFsyncdir
+	OpGetlk         = fusekernel.OpGetlk
+	OpSetlk         = fusekernel.OpSetlk
+	OpSetlkw        = fusekernel.OpSetlkw
+	OpAccess        = fusekernel.OpAccess
+	OpCreate        = fusekernel.OpCreate
+	OpInterrupt     = fusekernel.OpInterrupt
+	OpBmap          = fusekernel.OpBmap
+	OpDestroy       = fusekernel.OpDestroy
+	OpIoctl         = fusekernel.OpIoctl
+	OpPoll          = fusekernel.OpPoll
+	OpBatchForget   = fusekernel.OpBatchForget
+	OpFallocate     = fusekernel.OpFallocate
+	OpReaddirplus   = fusekernel.OpReaddirplus
+	OpRename2       = fusekernel.OpRename2
+	OpLseek         = fusekernel.OpLseek
+	OpCopyFileRange = fusekernel.OpCopyFileRange
+	OpSetupMapping  = fusekernel.OpSetupMapping
+	OpRemoveMapping = fusekernel.OpRemoveMapping
+	OpSyncFS        = fusekernel.OpSyncFS
+
+	// OS X only.
+	OpSetvolname = fusekernel.OpSetvolname
+	OpGetxtimes  = fusekernel.OpGetxtimes
+	OpExchange   = fusekernel.OpExchange
+)
+
+////////////////////////////////////////////////////////////////////////
+// Init flags
+////////////////////////////////////////////////////////////////////////
+
+// InitFlags are the capabilities offered by the kernel and accepted by the
+// file system during init.
+type InitFlags = fusekernel.InitFlags
+
+const (
+	InitAsyncRead        = fusekernel.InitAsyncRead
+	InitPosixLocks       = fusekernel.InitPosixLocks
+	InitFileOps          = fusekernel.InitFileOps
+	InitAtomicTrunc      = fusekernel.InitAtomicTrunc
+	InitExportSupport    = fusekernel.InitExportSupport
+	InitBigWrites        = fusekernel.InitBigWrites
+	InitDontMask         = fusekernel.InitDontMask
+	InitSpliceWrite      = fusekernel.InitSpliceWrite
+	InitSpliceMove       = fusekernel.InitSpliceMove
+	InitSpliceRead       = fusekernel.InitSpliceRead
+	InitFlockLocks       = fusekernel.InitFlockLocks
+	InitHasIoctlDir      = fusekernel.InitHasIoctlDir
+	InitAutoInvalData    = fusekernel.InitAutoInvalData
+	InitDoReaddirplus    = fusekernel.InitDoReaddirplus
+	InitReaddirplusAuto  = fusekernel.InitReaddirplusAuto
+	InitAsyncDIO         = fusekernel.InitAsyncDIO
+	InitWritebackCache   = fusekernel.InitWritebackCache
+	InitNoOpenSupport    = fusekernel.InitNoOpenSupport
+	InitParallelDirOps   = fusekernel.InitParallelDirOps
+	InitMaxPages         = fusekernel.InitMaxPages
+	InitCacheSymlinks    = fusekernel.InitCacheSymlinks
+	InitNoOpendirSupport = fusekernel.InitNoOpendirSupport
+
+	// OS X only.
+	InitCaseSensitive = fusekernel.InitCaseSensitive
+	InitVolRename     = fusekernel.InitVolRename
+	InitXtimes        = fusekernel.InitXtimes
+)
+
+////////////////////////////////////////////////////////////////////////
+// Attribute flags
+////////////////////////////////////////////////////////////////////////
+
+// GetattrFlags are the flags of a getattr request.
+type GetattrFlags = fusekernel.GetattrFlags
+
+const (
+	// The request carries a file handle.
+	GetattrFh = fusekernel.GetattrFh
+)
+
+// SetattrValid are the flags of a setattr request saying which attributes it
+// changes.
+type SetattrValid = fusekernel.SetattrValid
+
+const (
+	SetattrMode      = fusekernel.SetattrMode
+	SetattrUid       = fusekernel.SetattrUid
+	SetattrGid       = fusekernel.SetattrGid
+	SetattrSize      = fusekernel.SetattrSize
+	SetattrAtime     = fusekernel.SetattrAtime
+	SetattrMtime     = fusekernel.SetattrMtime
+	SetattrHandle    = fusekernel.SetattrHandle
+	SetattrAtimeNow  = fusekernel.SetattrAtimeNow
+	SetattrMtimeNow  = fusekernel.SetattrMtimeNow
+	SetattrLockOwner = fusekernel.SetattrLockOwner
+
+	// OS X only.
+	SetattrCrtime   = fusekernel.SetattrCrtime
+	SetattrChgtime  = fusekernel.SetattrChgtime
+	SetattrBkuptime = fusekernel.SetattrBkuptime
+	SetattrFlags    = fusekernel.SetattrFlags
+)
+
+////////////////////////////////////////////////////////////////////////
+// Lock flags
+////////////////////////////////////////////////////////////////////////
+
+// ReleaseFlags are the flags of a release request.
+type ReleaseFlags = fusekernel.ReleaseFlags
+
+const (
+	ReleaseFlush = fusekernel.ReleaseFlush
+
+	// The flock locks of the request's lock owner are to be released.
+	ReleaseFlockUnlock = fusekernel.ReleaseFlockUnlock
+)
+
+// LkFlags are the flags of a lock request.
+type LkFlags = fusekernel.LkFlags
+
+const (
+	// The lock was set with flock(2) rather than fcntl(2).
+	LkFlock = fusekernel.LkFlock
+)
+
+////////////////////////////////////////////////////////////////////////
+// Sync flags
+////////////////////////////////////////////////////////////////////////
+
+// FsyncFlags are the flags of an fsync or fsyncdir request.
+type FsyncFlags = fusekernel.FsyncFlags
+
+const (
+	// The request is for fdatasync(2).
+	FsyncFdatasync = fusekernel.FsyncFdatasync
+)
@@ -0,0 +1,157 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The directory in which the fusectl file system exposes each connection.
+const fuseConnectionsDir = "/sys/fs/fuse/connections"
+
+// AbortConnection aborts the kernel's connection to the fuse file system
+// mounted at dir, as an administrator would with
+// /sys/fs/fuse/connections/*/abort. Outstanding and future requests to the
+// file system fail with ECONNABORTED or ENOTCONN, and the daemon's reads of
+// /dev/fuse fail with ENODEV, so that ReadOp returns io.EOF. The mount point
+// itself remains until unmounted.
+//
+// The connection is found through /proc/self/mountinfo rather than by
+// stat'ing dir, so this works even when the daemon is wedged. An error is
+// returned if the topmost mount at dir isn't a fuse file system.
+//
+// This requires the fusectl file system to be mounted and write access to it,
+// which usually means root. Use it mid-workload to check that a daemon cleans
+// up and that it can re-mount afterward. For tests that can't get such
+// access, see FakeKernel.Abort.
+func AbortConnection(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("Abs: %v", err)
+	}
+
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return fmt.Errorf("Open: %v", err)
+	}
+
+	minor, err := findFuseMount(f, dir)
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	// Connections are named after the minor device number of the mount.
+	abortPath := path.Join(fuseConnectionsDir, minor, "abort")
+
+	f, err = os.OpenFile(abortPath, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %v", err)
+	}
+
+	_, err = f.Write([]byte("1"))
+	closeErr := f.Close()
+
+	if err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+
+	if closeErr != nil {
+		return fmt.Errorf("Close: %v", closeErr)
+	}
+
+	return nil
+}
+
+// Find the topmost mount at the supplied absolute path in the contents of
+// /proc/self/mountinfo, returning the minor device number of the mount if it
+// is a fuse file system. See proc(5) for the format.
+func findFuseMount(r io.Reader, dir string) (minor string, err error) {
+	dir = filepath.Clean(dir)
+
+	var fsType string
+	found := false
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Fields are: mount ID, parent ID, major:minor, root, mount point,
+		// mount options, optional fields, "-", file system type, source, and
+		// super block options.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 7 || unescapeMountInfo(fields[4]) != dir {
+			continue
+		}
+
+		sep := 6
+		for sep < len(fields) && fields[sep] != "-" {
+			sep++
+		}
+
+		if sep+1 >= len(fields) {
+			return "", fmt.Errorf("Malformed mountinfo line: %q", scanner.Text())
+		}
+
+		// Later mounts at the same point hide earlier ones.
+		_, minor, _ = strings.Cut(fields[2], ":")
+		fsType = fields[sep+1]
+		found = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("Reading mountinfo: %v", err)
+	}
+
+	if !found {
+		return "", fmt.Errorf("Nothing is mounted at %q", dir)
+	}
+
+	base, _, _ := strings.Cut(fsType, ".")
+	if base != "fuse" && base != "fuseblk" {
+		return "", fmt.Errorf("%q is a %s mount, not a fuse mount", dir, fsType)
+	}
+
+	return minor, nil
+}
+
+// Undo the octal escaping of spaces, tabs, newlines, and backslashes in
+// paths in /proc/self/mountinfo.
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A server that blocks each lookup until told to proceed, and records the
+// error that ends its loop.
+type abortServer struct {
+	lookupReceived chan struct{}
+	proceed        chan struct{}
+	readErr        chan error
+}
+
+func (s *abortServer) ServeOps(c *fuse.Connection) {
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			s.readErr <- err
+			return
+		}
+
+		if _, ok := op.(*fuseops.LookUpInodeOp); ok {
+			s.lookupReceived <- struct{}{}
+			<-s.proceed
+		}
+
+		c.Reply(ctx, fuse.ENOENT)
+	}
+}
+
+func TestFakeKernelAbort(t *testing.T) {
+	s := &abortServer{
+		lookupReceived: make(chan struct{}),
+		proceed:        make(chan struct{}),
+		readErr:        make(chan error, 1),
+	}
+
+	k, err := fusetesting.NewFakeKernel(
+		s,
+		&fuse.MountConfig{ErrorLogger: log.New(ioutil.Discard, "", 0)},
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	// Abort while a lookup is in flight.
+	unique, err := k.Start(fusekernel.OpLookup, 1, []byte("foo\x00"))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	<-s.lookupReceived
+	k.Abort()
+	close(s.proceed)
+
+	// The waiter should be told about the abort.
+	_, err = k.Wait(unique)
+	if err == nil || !strings.Contains(err.Error(), fusetesting.ErrAborted.Error()) {
+		t.Errorf("Wait: %v", err)
+	}
+
+	// The server should see the end of the connection.
+	if err := <-s.readErr; err != io.EOF {
+		t.Errorf("ReadOp: %v", err)
+	}
+
+	// New requests should fail.
+	if _, err := k.Call(fusekernel.OpLookup, 1, []byte("foo\x00")); err == nil {
+		t.Error("Call succeeded after abort")
+	}
+
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// A server that handles each op in its own goroutine, blocking lookups until
+// their contexts are cancelled and recording the cause.
+type cancelServer struct {
+	lookupReceived chan struct{}
+	cause          chan error
+}
+
+func (s *cancelServer) ServeOps(c *fuse.Connection) {
+	// Don't return until every op has been replied to, since the connection
+	// is closed once we do.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		ctx, op, err := c.ReadOp()
+		if err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if _, ok := op.(*fuseops.LookUpInodeOp); ok {
+				s.lookupReceived <- struct{}{}
+				<-ctx.Done()
+				s.cause <- context.Cause(ctx)
+			}
+
+			c.Reply(ctx, fuse.ENOENT)
+		}()
+	}
+}
+
+func TestFakeKernelAbortCancelsOps(t *testing.T) {
+	s := &cancelServer{
+		lookupReceived: make(chan struct{}),
+		cause:          make(chan error, 1),
+	}
+
+	k, err := fusetesting.NewFakeKernel(
+		s,
+		&fuse.MountConfig{ErrorLogger: log.New(ioutil.Discard, "", 0)},
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	if _, err := k.Start(fusekernel.OpLookup, 1, []byte("foo\x00")); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	// The lookup's context should be cancelled by the abort alone.
+	<-s.lookupReceived
+	k.Abort()
+
+	if cause := <-s.cause; cause != syscall.ENODEV {
+		t.Errorf("Cause: %v", cause)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// A file system whose root can't be stat'ed until wedged is closed.
+type wedgedFS struct {
+	fuseutil.NotImplementedFileSystem
+	wedged chan struct{}
+}
+
+func (fs *wedgedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	<-fs.wedged
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	return nil
+}
+
+func TestAbortConnectionRejectsOtherMounts(t *testing.T) {
+	for _, dir := range []string{t.TempDir(), "/proc"} {
+		err := fusetesting.AbortConnection(dir)
+		if err == nil {
+			t.Errorf("AbortConnection(%q) succeeded", dir)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), "not a fuse mount") &&
+			!strings.Contains(err.Error(), "Nothing is mounted") {
+			t.Errorf("AbortConnection(%q): %v", dir, err)
+		}
+	}
+}
+
+func TestAbortConnectionWedgedDaemon(t *testing.T) {
+	fs := &wedgedFS{wedged: make(chan struct{})}
+	dir := t.TempDir()
+
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Skipf("Can't mount here: %v", err)
+	}
+
+	// Wedge the daemon with a stat that it doesn't answer until the end of the
+	// test. The mount is busy until the stat returns.
+	statDone := make(chan struct{})
+	go func() {
+		os.Stat(dir)
+		close(statDone)
+	}()
+
+	defer func() {
+		close(fs.wedged)
+		<-statDone
+
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		mfs.Join(context.Background())
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fusetesting.AbortConnection(dir)
+	}()
+
+	select {
+	case err := <-done:
+		// Without access to fusectl, it's enough not to have hung.
+		if err != nil && !strings.HasPrefix(err.Error(), "OpenFile") {
+			t.Errorf("AbortConnection: %v", err)
+		}
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("AbortConnection hung on a wedged daemon")
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"testing"
+)
+
+// The number of times CheckAllocBudget runs the function it is given, after
+// one warm-up run.
+const allocBudgetRuns = 500
+
+// CheckAllocBudget runs f repeatedly and fails the test if it makes more than
+// budget heap allocations per run on average. Allocations are counted for the
+// whole process, so work done by f on other goroutines (e.g. by a server
+// handling a request sent by f) is included.
+//
+// Budgets are meant to pin down the cost of hot paths such as a read or write
+// round trip, so that refactors that add allocations are noticed. Set them a
+// little above the current figure, which CheckAllocBudget logs, and lower
+// them when an improvement lands.
+func CheckAllocBudget(tb testing.TB, name string, budget float64, f func()) {
+	tb.Helper()
+
+	if testing.CoverMode() != "" {
+		tb.Skip("Allocation counts are not meaningful with coverage enabled")
+	}
+
+	got := testing.AllocsPerRun(allocBudgetRuns, f)
+	tb.Logf("%s: %v allocations per run (budget %v)", name, got, budget)
+
+	if got > budget {
+		tb.Errorf(
+			"%s: %v allocations per run, over budget of %v",
+			name,
+			got,
+			budget)
+	}
+}
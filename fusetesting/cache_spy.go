@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A kind of op whose results the kernel may cache.
+type CachedOp int
+
+const (
+	// LookUpInodeOp, which the kernel skips while a dentry is cached.
+	CachedLookUp CachedOp = iota
+
+	// GetInodeAttributesOp, which the kernel skips while attributes are
+	// cached.
+	CachedGetAttr
+
+	// ReadFileOp, which the kernel skips while data is in the page cache.
+	CachedRead
+
+	// ReadDirOp or ReadDirPlusOp, which the kernel skips while a listing is
+	// cached.
+	CachedReadDir
+
+	numCachedOps
+)
+
+func (o CachedOp) String() string {
+	switch o {
+	case CachedLookUp:
+		return "LookUpInode"
+	case CachedGetAttr:
+		return "GetInodeAttributes"
+	case CachedRead:
+		return "ReadFile"
+	case CachedReadDir:
+		return "ReadDir"
+	default:
+		return fmt.Sprintf("CachedOp(%d)", int(o))
+	}
+}
+
+// The slack to allow on top of an expiration time handed to the kernel before
+// expecting the kernel to have noticed it. The kernel measures time in
+// jiffies, which may be as coarse as 10ms.
+const cacheExpirySlack = 50 * time.Millisecond
+
+// A CacheSpy wraps a fuseutil.FileSystem, counting the ops that may be
+// answered from kernel caches and remembering the expiration times handed to
+// the kernel for entries and attributes. Tests use it to say directly whether
+// a given stat or read reached the file system, rather than inferring it from
+// the values returned and sleeping for a multiple of a cache timeout.
+//
+// Use it by handing the CacheSpy to fuseutil.NewFileSystemServer in place of
+// the file system under test.
+type CacheSpy struct {
+	fuseutil.FileSystem
+
+	mu sync.Mutex
+
+	// The number of ops of each kind that have reached the file system.
+	//
+	// GUARDED_BY(mu)
+	counts [numCachedOps]int
+
+	// The latest expiration times handed out for entries and attributes.
+	//
+	// GUARDED_BY(mu)
+	entryExpiration time.Time
+	attrExpiration  time.Time
+}
+
+// NewCacheSpy creates a CacheSpy wrapping the supplied file system.
+func NewCacheSpy(wrapped fuseutil.FileSystem) *CacheSpy {
+	return &CacheSpy{
+		FileSystem: wrapped,
+	}
+}
+
+// Count returns the number of ops of the given kind that have reached the
+// file system so far.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *CacheSpy) Count(op CachedOp) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.counts[op]
+}
+
+// ServedFromCache calls f, which should perform some file system operation
+// such as stat(2) or read(2), and reports whether it was answered without an
+// op of the given kind reaching the file system. Ops issued concurrently by
+// other goroutines confuse the count, so don't.
+func (s *CacheSpy) ServedFromCache(op CachedOp, f func() error) (bool, error) {
+	before := s.Count(op)
+	if err := f(); err != nil {
+		return false, err
+	}
+
+	return s.Count(op) == before, nil
+}
+
+// WaitForExpiry blocks until every entry or attribute cache entry (according
+// to op, which must be CachedLookUp or CachedGetAttr) that the file system
+// has handed to the kernel so far should have expired. This replaces
+// sleeping for a guessed multiple of the cache timeout.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *CacheSpy) WaitForExpiry(ctx context.Context, op CachedOp) error {
+	s.mu.Lock()
+	var expiration time.Time
+	switch op {
+	case CachedLookUp:
+		expiration = s.entryExpiration
+	case CachedGetAttr:
+		expiration = s.attrExpiration
+	default:
+		s.mu.Unlock()
+		return fmt.Errorf("%v results have no expiration time", op)
+	}
+	s.mu.Unlock()
+
+	d := time.Until(expiration.Add(cacheExpirySlack))
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EntryCacheExpires reports whether the kernel on this platform can be relied
+// upon to stop using a cached entry once it expires. This is not the case on
+// darwin; see the notes on fuse.MountConfig.EnableVnodeCaching.
+func EntryCacheExpires() bool {
+	return runtime.GOOS != "darwin"
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *CacheSpy) record(
+	op CachedOp,
+	entryExpiration time.Time,
+	attrExpiration time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.counts[op]++
+	if entryExpiration.After(s.entryExpiration) {
+		s.entryExpiration = entryExpiration
+	}
+
+	if attrExpiration.After(s.attrExpiration) {
+		s.attrExpiration = attrExpiration
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (s *CacheSpy) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := s.FileSystem.LookUpInode(ctx, op)
+	s.record(CachedLookUp, op.Entry.EntryExpiration, op.Entry.AttributesExpiration)
+	return err
+}
+
+func (s *CacheSpy) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	err := s.FileSystem.GetInodeAttributes(ctx, op)
+	s.record(CachedGetAttr, time.Time{}, op.AttributesExpiration)
+	return err
+}
+
+func (s *CacheSpy) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	err := s.FileSystem.ReadFile(ctx, op)
+	s.record(CachedRead, time.Time{}, time.Time{})
+	return err
+}
+
+func (s *CacheSpy) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	err := s.FileSystem.ReadDir(ctx, op)
+	s.record(CachedReadDir, time.Time{}, time.Time{})
+	return err
+}
+
+func (s *CacheSpy) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	err := s.FileSystem.ReadDirPlus(ctx, op)
+	s.record(CachedReadDir, time.Time{}, time.Time{})
+	return err
+}
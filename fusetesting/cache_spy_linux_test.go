@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose entries are valid for a fixed period.
+type expiringFS struct {
+	fuseutil.NotImplementedFileSystem
+	ttl time.Duration
+}
+
+func (fs *expiringFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 2
+	op.Entry.EntryExpiration = time.Now().Add(fs.ttl)
+	return nil
+}
+
+func TestCacheSpy(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	spy := fusetesting.NewCacheSpy(&expiringFS{ttl: ttl})
+
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(spy),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	// Nothing has expired yet, since nothing has been handed out.
+	start := time.Now()
+	if err := spy.WaitForExpiry(context.Background(), fusetesting.CachedLookUp); err != nil {
+		t.Fatalf("WaitForExpiry: %v", err)
+	}
+
+	if d := time.Since(start); d >= ttl {
+		t.Errorf("WaitForExpiry with nothing cached took %v", d)
+	}
+
+	// A lookup reaches the file system; our fake kernel has no cache.
+	cached, err := spy.ServedFromCache(fusetesting.CachedLookUp, func() error {
+		_, err := k.Call(fusekernel.OpLookup, 1, []byte("foo\x00"))
+		return err
+	})
+
+	if err != nil || cached {
+		t.Errorf("ServedFromCache: %v, %v", cached, err)
+	}
+
+	if got := spy.Count(fusetesting.CachedLookUp); got != 1 {
+		t.Errorf("Count: %d", got)
+	}
+
+	// Other kinds of op are counted separately.
+	cached, err = spy.ServedFromCache(fusetesting.CachedGetAttr, func() error {
+		_, err := k.Call(fusekernel.OpLookup, 1, []byte("foo\x00"))
+		return err
+	})
+
+	if err != nil || !cached {
+		t.Errorf("ServedFromCache: %v, %v", cached, err)
+	}
+
+	// Now we must wait for the entry handed out to expire.
+	start = time.Now()
+	if err := spy.WaitForExpiry(context.Background(), fusetesting.CachedLookUp); err != nil {
+		t.Fatalf("WaitForExpiry: %v", err)
+	}
+
+	if d := time.Since(start); d < ttl/2 {
+		t.Errorf("WaitForExpiry returned after only %v", d)
+	}
+
+	// Reads have no expiration time.
+	if err := spy.WaitForExpiry(context.Background(), fusetesting.CachedRead); err == nil {
+		t.Error("WaitForExpiry succeeded for reads")
+	}
+}
@@ -0,0 +1,370 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// How a file system deals with a particular op, according to
+// GenerateConformanceReport.
+type OpSupport struct {
+	// The name of the fuseutil.FileSystem method, e.g. "LookUpInode".
+	Method string
+
+	// Whether the file system has its own implementation of the method, as
+	// opposed to one promoted from an embedded fuseutil.NotImplementedFileSystem
+	// (or a nil embedded interface).
+	Implemented bool
+
+	// If the method was called during the probing run, the outcome: "ok", the
+	// error returned, or "panic: ..." if it panicked. Empty otherwise.
+	Probe string
+}
+
+// A ConformanceReport summarizes what a file system supports.
+type ConformanceReport struct {
+	// The type of the file system examined.
+	Type string
+
+	// Every method of fuseutil.FileSystem other than Destroy, sorted by name.
+	Ops []OpSupport
+
+	// The protocol version and init reply negotiated with a kernel offering
+	// every capability, given the mount config supplied.
+	Protocol     string
+	InitFlags    string
+	MaxWrite     uint32
+	MaxReadahead uint32
+	MaxPages     uint16
+}
+
+// Implemented returns the names of the methods the file system implements.
+func (r *ConformanceReport) Implemented() (methods []string) {
+	for _, op := range r.Ops {
+		if op.Implemented {
+			methods = append(methods, op.Method)
+		}
+	}
+
+	return methods
+}
+
+// String formats the report as a table for humans.
+func (r *ConformanceReport) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "File system: %s\n", r.Type)
+	fmt.Fprintf(&b, "Protocol:    %s\n", r.Protocol)
+	fmt.Fprintf(&b, "Init flags:  %s\n", r.InitFlags)
+	fmt.Fprintf(
+		&b,
+		"Limits:      max_write=%d max_readahead=%d max_pages=%d\n\n",
+		r.MaxWrite,
+		r.MaxReadahead,
+		r.MaxPages)
+
+	for _, op := range r.Ops {
+		status := "no"
+		if op.Implemented {
+			status = "yes"
+		}
+
+		if op.Probe == "" {
+			fmt.Fprintf(&b, "%-20s %s\n", op.Method, status)
+		} else {
+			fmt.Fprintf(&b, "%-20s %-4s probe: %s\n", op.Method, status, op.Probe)
+		}
+	}
+
+	return b.String()
+}
+
+// GenerateConformanceReport examines the supplied file system and reports
+// which ops it implements and which protocol features a mount with the given
+// config (which may be nil) would negotiate.
+//
+// Implementation is determined by reflection: a method counts as implemented
+// unless it is promoted from an embedded fuseutil.NotImplementedFileSystem,
+// looking through any embedded interfaces along the way. (A wrapper that
+// overrides a method to forward it, as LeakDetector does, counts as
+// implementing it.) The file system is then mounted on a FakeKernel offering every
+// capability, and a few read-only ops are sent for the root inode (StatFS,
+// GetInodeAttributes, ListXattr, GetXattr) to confirm the reflection.
+// Panics in those ops are recovered and reported. Destroy is not called, so
+// the file system remains usable afterward.
+func GenerateConformanceReport(
+	fs fuseutil.FileSystem,
+	cfg *fuse.MountConfig) (*ConformanceReport, error) {
+	r := &ConformanceReport{
+		Type: reflect.TypeOf(fs).String(),
+	}
+
+	// Examine each method.
+	fsType := reflect.TypeOf((*fuseutil.FileSystem)(nil)).Elem()
+	for i := 0; i < fsType.NumMethod(); i++ {
+		name := fsType.Method(i).Name
+		if name == "Destroy" {
+			continue
+		}
+
+		r.Ops = append(r.Ops, OpSupport{
+			Method:      name,
+			Implemented: implementsMethod(reflect.ValueOf(fs), name),
+		})
+	}
+
+	sort.Slice(r.Ops, func(i, j int) bool { return r.Ops[i].Method < r.Ops[j].Method })
+
+	// Probe.
+	probe := &probingFS{
+		FileSystem: fs,
+		results:    make(map[string]string),
+	}
+
+	k, err := NewFakeKernel(
+		fuseutil.NewFileSystemServer(probe),
+		cfg,
+		&FakeKernelConfig{InitFlags: ^uint32(0)})
+
+	if err != nil {
+		return nil, fmt.Errorf("NewFakeKernel: %v", err)
+	}
+
+	init := k.InitOut()
+	r.Protocol = fmt.Sprintf("%d.%d", init.Major, init.Minor)
+	r.InitFlags = fusekernel.InitFlags(init.Flags).String()
+	r.MaxWrite = init.MaxWrite
+	r.MaxReadahead = init.MaxReadahead
+	r.MaxPages = init.MaxPages
+
+	getattrIn := fusekernel.GetattrIn{}
+	listxattrIn := fusekernel.ListxattrIn{}
+	getxattrIn := fusekernel.GetxattrIn{}
+
+	probes := []struct {
+		opcode uint32
+		body   [][]byte
+	}{
+		{fusekernel.OpStatfs, nil},
+		{
+			fusekernel.OpGetattr,
+			[][]byte{unsafe.Slice((*byte)(unsafe.Pointer(&getattrIn)), unsafe.Sizeof(getattrIn))},
+		},
+		{
+			fusekernel.OpListxattr,
+			[][]byte{unsafe.Slice((*byte)(unsafe.Pointer(&listxattrIn)), unsafe.Sizeof(listxattrIn))},
+		},
+		{
+			fusekernel.OpGetxattr,
+			[][]byte{
+				unsafe.Slice((*byte)(unsafe.Pointer(&getxattrIn)), unsafe.Sizeof(getxattrIn)),
+				[]byte("user.fusetesting.probe\x00"),
+			},
+		},
+	}
+
+	for _, p := range probes {
+		if _, err := k.Call(p.opcode, uint64(fuseops.RootInodeID), p.body...); err != nil {
+			k.Close()
+			return nil, fmt.Errorf("Probing opcode %d: %v", p.opcode, err)
+		}
+	}
+
+	if err := k.Close(); err != nil {
+		return nil, fmt.Errorf("Close: %v", err)
+	}
+
+	probe.mu.Lock()
+	for i := range r.Ops {
+		r.Ops[i].Probe = probe.results[r.Ops[i].Method]
+	}
+	probe.mu.Unlock()
+
+	return r, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reflection
+////////////////////////////////////////////////////////////////////////
+
+var notImplementedType = reflect.TypeOf(fuseutil.NotImplementedFileSystem{})
+
+// Is the method defined in the source of a type, rather than generated by the
+// compiler to promote an embedded method or wrap a value receiver?
+func definedInSource(t reflect.Type, name string) bool {
+	m, ok := t.MethodByName(name)
+	if !ok {
+		return false
+	}
+
+	f := runtime.FuncForPC(m.Func.Pointer())
+	if f == nil {
+		return false
+	}
+
+	file, _ := f.FileLine(f.Entry())
+	return file != "<autogenerated>"
+}
+
+// Report whether the method with the given name, called on v, does something
+// other than what fuseutil.NotImplementedFileSystem does.
+func implementsMethod(v reflect.Value, name string) bool {
+	// Look through interfaces and pointers.
+	for v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return false
+		}
+
+		v = v.Elem()
+	}
+
+	t := v.Type()
+	base := t
+	if base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+
+	if base == notImplementedType {
+		return false
+	}
+
+	if definedInSource(t, name) || definedInSource(base, name) {
+		return true
+	}
+
+	if _, ok := t.MethodByName(name); !ok {
+		return false
+	}
+
+	// The method is promoted from an embedded field. Find the field that
+	// provides it, searching shallowest first as the compiler does.
+	if base.Kind() != reflect.Struct {
+		return true
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return true
+		}
+
+		v = v.Elem()
+	}
+
+	for i := 0; i < base.NumField(); i++ {
+		sf := base.Field(i)
+		if !sf.Anonymous {
+			continue
+		}
+
+		fv := v.Field(i)
+		ft := sf.Type
+		if _, ok := ft.MethodByName(name); !ok {
+			if _, ok := reflect.PtrTo(ft).MethodByName(name); !ok {
+				continue
+			}
+		}
+
+		if fv.CanAddr() && ft.Kind() != reflect.Ptr && ft.Kind() != reflect.Interface {
+			fv = fv.Addr()
+		}
+
+		return implementsMethod(fv, name)
+	}
+
+	// Promoted from deeper down than we can see without addressability; assume
+	// the best.
+	return true
+}
+
+////////////////////////////////////////////////////////////////////////
+// Probing
+////////////////////////////////////////////////////////////////////////
+
+// A wrapper that records the outcome of the ops sent while probing, recovers
+// from panics, and shields the wrapped file system from Destroy.
+type probingFS struct {
+	fuseutil.FileSystem
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	results map[string]string
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *probingFS) record(method string, f func() error) (err error) {
+	var result string
+	defer func() {
+		if r := recover(); r != nil {
+			result = fmt.Sprintf("panic: %v", r)
+			err = syscall.EIO
+		}
+
+		fs.mu.Lock()
+		fs.results[method] = result
+		fs.mu.Unlock()
+	}()
+
+	err = f()
+	result = "ok"
+	if err != nil {
+		result = err.Error()
+	}
+
+	return err
+}
+
+func (fs *probingFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return fs.record("StatFS", func() error { return fs.FileSystem.StatFS(ctx, op) })
+}
+
+func (fs *probingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	return fs.record("GetInodeAttributes", func() error {
+		return fs.FileSystem.GetInodeAttributes(ctx, op)
+	})
+}
+
+func (fs *probingFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	return fs.record("ListXattr", func() error { return fs.FileSystem.ListXattr(ctx, op) })
+}
+
+func (fs *probingFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	return fs.record("GetXattr", func() error { return fs.FileSystem.GetXattr(ctx, op) })
+}
+
+func (fs *probingFS) Destroy() {
+}
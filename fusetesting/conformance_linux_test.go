@@ -0,0 +1,99 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system implementing a few ops, one of them badly.
+type partialFS struct {
+	fuseutil.NotImplementedFileSystem
+	destroyed bool
+}
+
+func (fs *partialFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (fs *partialFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	panic("taco")
+}
+
+// A value receiver, which the compiler wraps for pointers.
+func (fs partialFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fuse.ENOENT
+}
+
+func (fs *partialFS) Destroy() {
+	fs.destroyed = true
+}
+
+func TestConformanceReport(t *testing.T) {
+	fs := &partialFS{}
+
+	// A wrapper embedding the file system as an interface should be seen
+	// through.
+	type wrapper struct {
+		fuseutil.FileSystem
+	}
+
+	for _, wrapped := range []fuseutil.FileSystem{fs, &wrapper{fs}} {
+		r, err := fusetesting.GenerateConformanceReport(
+			wrapped,
+			&fuse.MountConfig{EnableParallelDirOps: true})
+
+		if err != nil {
+			t.Fatalf("GenerateConformanceReport: %v", err)
+		}
+
+		want := []string{"GetInodeAttributes", "LookUpInode", "StatFS"}
+		if got := r.Implemented(); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Implemented() = %v, want %v", r.Type, got, want)
+		}
+
+		s := r.String()
+		for _, want := range []string{
+			"InitParallelDirOps",
+			"max_pages=256",
+			"GetInodeAttributes   yes  probe: panic: taco",
+			"StatFS               yes  probe: ok",
+			"GetXattr             no   probe: function not implemented",
+			"Rename               no\n",
+		} {
+			if !strings.Contains(s, want) {
+				t.Errorf("Report doesn't contain %q:\n%s", want, s)
+			}
+		}
+	}
+
+	if fs.destroyed {
+		t.Error("File system was destroyed")
+	}
+}
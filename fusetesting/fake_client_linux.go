@@ -0,0 +1,354 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// This file contains conveniences for driving a FakeKernel the way a program
+// using the mounted file system would, so that tests and package examples can
+// exercise a file system without mounting it. Each helper sends the requests
+// the kernel would, with no caching: paths are looked up a component at a
+// time starting from the root, and every lookup is forgotten again and every
+// handle released before the helper returns.
+//
+// Errors returned by the file system are returned as syscall.Errno values.
+
+// The size of each read and readdir request sent by the helpers.
+const fakeClientReadSize = 16 * 1024
+
+func asBytes(p unsafe.Pointer, size uintptr) []byte {
+	return unsafe.Slice((*byte)(p), size)
+}
+
+// Send a request and return the body of the successful reply.
+func (k *FakeKernel) call(
+	opcode uint32,
+	nodeID uint64,
+	body ...[]byte) ([]byte, error) {
+	r, err := k.Call(opcode, nodeID, body...)
+	if err != nil {
+		return nil, err
+	}
+
+	if r.Error != 0 {
+		return nil, r.Error
+	}
+
+	return r.Body, nil
+}
+
+func convertKernelAttr(in *fusekernel.Attr) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  in.Size,
+		Nlink: in.Nlink,
+		Mode:  fuse.ConvertFileMode(in.Mode),
+		Rdev:  in.Rdev,
+		Atime: time.Unix(int64(in.Atime), int64(in.AtimeNsec)),
+		Mtime: time.Unix(int64(in.Mtime), int64(in.MtimeNsec)),
+		Ctime: time.Unix(int64(in.Ctime), int64(in.CtimeNsec)),
+		Uid:   in.Uid,
+		Gid:   in.Gid,
+	}
+}
+
+// Look up each component of the path in turn, returning the inode IDs in
+// order. The caller must forget them.
+func (k *FakeKernel) walk(
+	path string) (ids []fuseops.InodeID, attrs fuseops.InodeAttributes, err error) {
+	var parent fuseops.InodeID = fuseops.RootInodeID
+	for _, name := range strings.Split(path, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+
+		var body []byte
+		body, err = k.call(fusekernel.OpLookup, uint64(parent), []byte(name+"\x00"))
+		if err != nil {
+			return ids, attrs, err
+		}
+
+		var out fusekernel.EntryOut
+		copy(asBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), body)
+
+		if out.Nodeid == 0 {
+			// A negative entry.
+			return ids, attrs, fuse.ENOENT
+		}
+
+		parent = fuseops.InodeID(out.Nodeid)
+		ids = append(ids, parent)
+		attrs = convertKernelAttr(&out.Attr)
+	}
+
+	if len(ids) == 0 {
+		attrs, err = k.GetAttributes(fuseops.RootInodeID)
+	}
+
+	return ids, attrs, err
+}
+
+// Forget a lookup of each of the supplied inodes.
+func (k *FakeKernel) forgetAll(ids []fuseops.InodeID) {
+	for _, id := range ids {
+		in := fusekernel.ForgetIn{Nlookup: 1}
+		k.Start(fusekernel.OpForget, uint64(id), asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+	}
+}
+
+// Return the inode the walked path refers to.
+func lastID(ids []fuseops.InodeID) fuseops.InodeID {
+	if len(ids) == 0 {
+		return fuseops.RootInodeID
+	}
+
+	return ids[len(ids)-1]
+}
+
+// Open the inode with the given opcode, OpOpen or OpOpendir, returning the
+// handle and whether it needs releasing. Like the kernel, once an open fails
+// with ENOSYS after the server agreed during init that it may, no more opens
+// of that kind are sent and the handle is zero.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) open(
+	opcode uint32,
+	inode uint64) (fh uint64, release bool, err error) {
+	k.mu.Lock()
+	skipped := k.skippedOpens[opcode]
+	k.mu.Unlock()
+
+	if skipped {
+		return 0, false, nil
+	}
+
+	in := fusekernel.OpenIn{}
+	body, err := k.call(
+		opcode,
+		inode,
+		asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	flag := fusekernel.InitNoOpenSupport
+	if opcode == fusekernel.OpOpendir {
+		flag = fusekernel.InitNoOpendirSupport
+	}
+
+	if err == fuse.ENOSYS && k.initOut.Flags&uint32(flag) != 0 {
+		k.mu.Lock()
+		k.skippedOpens[opcode] = true
+		k.mu.Unlock()
+
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	var out fusekernel.OpenOut
+	copy(asBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), body)
+
+	return out.Fh, true, nil
+}
+
+// GetAttributes sends a getattr request for the given inode.
+func (k *FakeKernel) GetAttributes(
+	inode fuseops.InodeID) (attrs fuseops.InodeAttributes, err error) {
+	in := fusekernel.GetattrIn{}
+	body, err := k.call(
+		fusekernel.OpGetattr,
+		uint64(inode),
+		asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+	if err != nil {
+		return attrs, err
+	}
+
+	var out fusekernel.AttrOut
+	copy(asBytes(unsafe.Pointer(&out), unsafe.Sizeof(out)), body)
+
+	return convertKernelAttr(&out.Attr), nil
+}
+
+// Stat looks up the slash-separated path, relative to the root of the file
+// system, and returns the attributes of the inode it refers to.
+func (k *FakeKernel) Stat(path string) (fuseops.InodeAttributes, error) {
+	ids, attrs, err := k.walk(path)
+	k.forgetAll(ids)
+	return attrs, err
+}
+
+// ReadFile opens the file with the given path, reads it until the file
+// system returns a short read, and releases it.
+func (k *FakeKernel) ReadFile(path string) (contents []byte, err error) {
+	ids, _, err := k.walk(path)
+	defer k.forgetAll(ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inode := uint64(lastID(ids))
+
+	// Open the file.
+	fh, release, err := k.open(fusekernel.OpOpen, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't forget to release it. As with close(2), an error returned by the
+	// file system is ignored.
+	defer func() {
+		if !release {
+			return
+		}
+
+		in := fusekernel.ReleaseIn{Fh: fh}
+		_, releaseErr := k.Call(
+			fusekernel.OpRelease,
+			inode,
+			asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		if err == nil && releaseErr != nil {
+			err = fmt.Errorf("Release: %v", releaseErr)
+		}
+	}()
+
+	// Read until we get a short read.
+	for {
+		in := fusekernel.ReadIn{
+			Fh:     fh,
+			Offset: uint64(len(contents)),
+			Size:   fakeClientReadSize,
+		}
+
+		var body []byte
+		body, err = k.call(
+			fusekernel.OpRead,
+			inode,
+			asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		contents = append(contents, body...)
+		if len(body) < fakeClientReadSize {
+			return contents, nil
+		}
+	}
+}
+
+// ReadDir opens the directory with the given path, reads all of its entries,
+// and releases it.
+func (k *FakeKernel) ReadDir(path string) (entries []fuseutil.Dirent, err error) {
+	ids, _, err := k.walk(path)
+	defer k.forgetAll(ids)
+
+	if err != nil {
+		return nil, err
+	}
+
+	inode := uint64(lastID(ids))
+
+	// Open the directory.
+	fh, release, err := k.open(fusekernel.OpOpendir, inode)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't forget to release it. As with close(2), an error returned by the
+	// file system is ignored.
+	defer func() {
+		if !release {
+			return
+		}
+
+		in := fusekernel.ReleaseIn{Fh: fh}
+		_, releaseErr := k.Call(
+			fusekernel.OpReleasedir,
+			inode,
+			asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		if err == nil && releaseErr != nil {
+			err = fmt.Errorf("Releasedir: %v", releaseErr)
+		}
+	}()
+
+	// Read until the file system returns nothing, continuing from the offset
+	// of the last entry each time.
+	var offset uint64
+	for {
+		in := fusekernel.ReadIn{
+			Fh:     fh,
+			Offset: offset,
+			Size:   fakeClientReadSize,
+		}
+
+		var body []byte
+		body, err = k.call(
+			fusekernel.OpReaddir,
+			inode,
+			asBytes(unsafe.Pointer(&in), unsafe.Sizeof(in)))
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(body) == 0 {
+			return entries, nil
+		}
+
+		for len(body) > 0 {
+			if len(body) < fusekernel.DirentSize {
+				return nil, fmt.Errorf("Truncated dirent: %d bytes", len(body))
+			}
+
+			var d fusekernel.Dirent
+			copy(asBytes(unsafe.Pointer(&d), fusekernel.DirentSize), body)
+
+			end := fusekernel.DirentSize + int(d.Namelen)
+			if end > len(body) {
+				return nil, fmt.Errorf("Dirent name overruns buffer")
+			}
+
+			entries = append(entries, fuseutil.Dirent{
+				Offset: fuseops.DirOffset(d.Off),
+				Inode:  fuseops.InodeID(d.Ino),
+				Name:   string(body[fusekernel.DirentSize:end]),
+				Type:   fuseutil.DirentType(d.Type),
+			})
+
+			offset = d.Off
+
+			// Records are padded to a multiple of eight bytes.
+			end = (end + 7) &^ 7
+			if end > len(body) {
+				end = len(body)
+			}
+
+			body = body[end:]
+		}
+	}
+}
@@ -0,0 +1,561 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Configuration for the kernel simulated by a FakeKernel.
+type FakeKernelConfig struct {
+	// The protocol version advertised by the simulated kernel in its init
+	// request. If Major is zero, the newest version supported by package fuse
+	// is used.
+	Major uint32
+	Minor uint32
+
+	// Init flags offered by the simulated kernel, as a bit mask of FUSE_*
+	// capability flags from fuse_kernel.h.
+	InitFlags uint32
+
+	// The max_readahead value sent in the init request.
+	MaxReadahead uint32
+
+	// The credentials stamped into the header of every request.
+	Uid uint32
+	Gid uint32
+	Pid uint32
+}
+
+// A reply received by a FakeKernel.
+type FakeReply struct {
+	// The request ID the reply was for.
+	Unique uint64
+
+	// The error returned by the server, or zero for success.
+	Error syscall.Errno
+
+	// Everything after the reply header.
+	Body []byte
+}
+
+// A notification received by a FakeKernel.
+type FakeNotification struct {
+	// The notification code, e.g. fusekernel.NotifyCodeInvalEntry.
+	Code int32
+
+	// Everything after the header.
+	Body []byte
+}
+
+// FakeKernel stands in for the fuse kernel module, speaking the wire protocol
+// to a server over a socket pair rather than /dev/fuse. Nothing is mounted,
+// so it needs no privileges and no fusermount binary, and the test controls
+// exactly which requests the server sees, including ones a real kernel would
+// only send in unusual circumstances.
+//
+// Each message is delivered as a single SOCK_SEQPACKET datagram, which
+// preserves the framing /dev/fuse provides. Messages in either direction must
+// therefore fit in a socket buffer; keep read and write sizes modest.
+//
+// Besides sending raw requests with Call and Start, tests and examples can
+// use Stat, ReadFile, and ReadDir to send the sequence of requests the kernel
+// would for the corresponding system calls.
+type FakeKernel struct {
+	mfs     *fuse.MountedFileSystem
+	fd      int
+	initOut fusekernel.InitOut
+	cfg     FakeKernelConfig
+
+	readerDone chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+
+	mu sync.Mutex
+
+	// The last request ID handed out.
+	//
+	// GUARDED_BY(mu)
+	lastUnique uint64
+
+	// Requests awaiting a reply, keyed by request ID.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]chan FakeReply
+
+	// Notifications received, in order.
+	//
+	// GUARDED_BY(mu)
+	notifications []FakeNotification
+
+	// The open opcodes (OpOpen, OpOpendir) that are no longer sent, because
+	// the server has declined them as described for
+	// fuse.MountConfig.EnableNoOpenSupport.
+	//
+	// GUARDED_BY(mu)
+	skippedOpens map[uint32]bool
+
+	// The first protocol error seen from the server, or the error that
+	// stopped the reader.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// NewFakeKernel mounts the supplied server on a simulated kernel, performing
+// the init handshake described by cfg. mountCfg is handed to fuse.Mount; it
+// may be nil. The caller must eventually call Close.
+func NewFakeKernel(
+	server fuse.Server,
+	mountCfg *fuse.MountConfig,
+	cfg *FakeKernelConfig) (*FakeKernel, error) {
+	if mountCfg == nil {
+		mountCfg = &fuse.MountConfig{}
+	}
+
+	k := &FakeKernel{
+		cfg:        *cfg,
+		readerDone: make(chan struct{}),
+		pending:    make(map[uint64]chan FakeReply),
+
+		skippedOpens: make(map[uint32]bool),
+	}
+
+	if k.cfg.Major == 0 {
+		k.cfg.Major = fusekernel.ProtoVersionMaxMajor
+		k.cfg.Minor = fusekernel.ProtoVersionMaxMinor
+	}
+
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Socketpair: %v", err)
+	}
+
+	// Give ourselves room for large reads and writes where we're allowed to.
+	// This fails without CAP_NET_ADMIN, in which case we live with the
+	// defaults.
+	for _, fd := range fds {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, 4<<20)
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, 4<<20)
+	}
+
+	k.fd = fds[0]
+
+	// Queue up the init request before mounting, since fuse.Mount doesn't
+	// return until the handshake is complete.
+	in := fusekernel.InitIn{
+		Major:        k.cfg.Major,
+		Minor:        k.cfg.Minor,
+		MaxReadahead: k.cfg.MaxReadahead,
+		Flags:        k.cfg.InitFlags,
+	}
+
+	initUnique, err := k.Start(
+		fusekernel.OpInit,
+		0,
+		unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)))
+
+	if err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, fmt.Errorf("Sending init: %v", err)
+	}
+
+	go k.readReplies()
+
+	// Mount the server on the other end of the socket, which package fuse
+	// treats as an already-open /dev/fuse.
+	k.mfs, err = fuse.MountWithFD(uintptr(fds[1]), server, mountCfg)
+	if err != nil {
+		// Package fuse has already closed its end of the socket.
+		k.shutdown()
+		syscall.Close(k.fd)
+		return nil, err
+	}
+
+	r, err := k.Wait(initUnique)
+	if err != nil {
+		k.Close()
+		return nil, fmt.Errorf("Waiting for init reply: %v", err)
+	}
+
+	if r.Error != 0 {
+		k.Close()
+		return nil, fmt.Errorf("Init failed: %v", r.Error)
+	}
+
+	if len(r.Body) < int(unsafe.Offsetof(k.initOut.MaxBackground)) {
+		k.Close()
+		return nil, fmt.Errorf("Short init reply: %d bytes", len(r.Body))
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&k.initOut)), unsafe.Sizeof(k.initOut)), r.Body)
+
+	return k, nil
+}
+
+// InitOut returns the server's reply to the init request.
+func (k *FakeKernel) InitOut() fusekernel.InitOut {
+	return k.initOut
+}
+
+// MountedFileSystem returns the file system mounted on the fake kernel.
+func (k *FakeKernel) MountedFileSystem() *fuse.MountedFileSystem {
+	return k.mfs
+}
+
+// Notifier returns the notifier for the mounted server. Notifications sent
+// with it are recorded by the fake kernel; see Notifications.
+func (k *FakeKernel) Notifier() fuse.Notifier {
+	return k.mfs.Notifier()
+}
+
+// Notifications returns the notifications the server has sent so far.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) Notifications() []FakeNotification {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return append([]FakeNotification(nil), k.notifications...)
+}
+
+// Protocol returns the protocol version agreed during the init handshake.
+func (k *FakeKernel) Protocol() (major, minor uint32) {
+	return k.initOut.Major, k.initOut.Minor
+}
+
+// Call sends a request with the given opcode and node ID, whose body is the
+// concatenation of the supplied slices, and waits for the reply.
+func (k *FakeKernel) Call(
+	opcode uint32,
+	nodeID uint64,
+	body ...[]byte) (FakeReply, error) {
+	unique, err := k.Start(opcode, nodeID, body...)
+	if err != nil {
+		return FakeReply{}, err
+	}
+
+	return k.Wait(unique)
+}
+
+// Start sends a request like Call, but doesn't wait for the reply. It returns
+// the ID of the request, which may be passed to Wait or used as the target of
+// an interrupt. Requests for which the kernel expects no reply (forget,
+// batch forget, interrupt) must not be waited for.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) Start(
+	opcode uint32,
+	nodeID uint64,
+	body ...[]byte) (unique uint64, err error) {
+	size := fusekernel.InHeaderSize
+	for _, b := range body {
+		size += len(b)
+	}
+
+	msg := make([]byte, fusekernel.InHeaderSize, size)
+	for _, b := range body {
+		msg = append(msg, b...)
+	}
+
+	k.mu.Lock()
+	if k.pending == nil {
+		err = k.err
+		k.mu.Unlock()
+		return 0, fmt.Errorf("Connection closed: %v", err)
+	}
+
+	k.lastUnique++
+	unique = k.lastUnique
+
+	switch opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+	default:
+		k.pending[unique] = make(chan FakeReply, 1)
+	}
+	k.mu.Unlock()
+
+	h := (*fusekernel.InHeader)(unsafe.Pointer(&msg[0]))
+	*h = fusekernel.InHeader{
+		Len:    uint32(size),
+		Opcode: opcode,
+		Unique: unique,
+		Nodeid: nodeID,
+		Uid:    k.cfg.Uid,
+		Gid:    k.cfg.Gid,
+		Pid:    k.cfg.Pid,
+	}
+
+	if _, err = syscall.Write(k.fd, msg); err != nil {
+		k.mu.Lock()
+		delete(k.pending, unique)
+		k.mu.Unlock()
+		return 0, fmt.Errorf("Write: %v", err)
+	}
+
+	return unique, nil
+}
+
+// Wait blocks until the server replies to the request with the given ID.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) Wait(unique uint64) (FakeReply, error) {
+	k.mu.Lock()
+	if k.pending == nil {
+		err := k.err
+		k.mu.Unlock()
+		return FakeReply{}, fmt.Errorf("Connection closed: %v", err)
+	}
+
+	c, ok := k.pending[unique]
+	k.mu.Unlock()
+
+	if !ok {
+		return FakeReply{}, fmt.Errorf("No outstanding request %d", unique)
+	}
+
+	r, ok := <-c
+
+	k.mu.Lock()
+	delete(k.pending, unique)
+	k.mu.Unlock()
+
+	if !ok {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		return FakeReply{}, fmt.Errorf("Connection closed: %v", k.err)
+	}
+
+	return r, nil
+}
+
+// Interrupt sends an interrupt request for the request with the given ID.
+func (k *FakeKernel) Interrupt(unique uint64) error {
+	in := fusekernel.InterruptIn{Unique: unique}
+	_, err := k.Start(
+		fusekernel.OpInterrupt,
+		0,
+		unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)))
+
+	return err
+}
+
+// NotifyReply answers a retrieve notification as the kernel does, with a
+// request carrying the supplied data for the inode at the given offset.
+// notifyUnique is the NotifyUnique field of the notification's
+// fusekernel.NotifyRetrieveOut. The server sends no reply.
+func (k *FakeKernel) NotifyReply(
+	notifyUnique uint64,
+	nodeID uint64,
+	offset uint64,
+	data []byte) error {
+	in := fusekernel.NotifyRetrieveIn{
+		Offset: offset,
+		Size:   uint32(len(data)),
+	}
+
+	inBytes := unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in))
+	size := fusekernel.InHeaderSize + len(inBytes) + len(data)
+
+	msg := make([]byte, fusekernel.InHeaderSize, size)
+	msg = append(msg, inBytes...)
+	msg = append(msg, data...)
+
+	h := (*fusekernel.InHeader)(unsafe.Pointer(&msg[0]))
+	*h = fusekernel.InHeader{
+		Len:    uint32(size),
+		Opcode: fusekernel.OpNotifyReply,
+		Unique: notifyUnique,
+		Nodeid: nodeID,
+	}
+
+	if _, err := syscall.Write(k.fd, msg); err != nil {
+		return fmt.Errorf("Write: %v", err)
+	}
+
+	return nil
+}
+
+// Abort severs the connection without waiting for the server, as the kernel
+// does when the connection is aborted through
+// /sys/fs/fuse/connections/*/abort or the device is otherwise lost. It may be
+// called at any point, including from within a file system method while ops
+// are in flight.
+//
+// From then on the server's ReadOp returns io.EOF, just as it does when a
+// real /dev/fuse read fails with ENODEV, and its replies fail to be written.
+// Requests awaiting a reply fail with an error mentioning ErrAborted. Close
+// must still be called to wait for the server to finish.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) Abort() {
+	k.mu.Lock()
+	if k.err == nil {
+		k.err = ErrAborted
+	}
+	k.mu.Unlock()
+
+	syscall.Shutdown(k.fd, syscall.SHUT_RDWR)
+}
+
+// Close hangs up on the server, as the kernel does when the file system is
+// unmounted, and waits for the server to finish. It returns an error if the
+// server violated the protocol at any point, or if joining failed. Calling
+// Close again has no effect beyond returning the same result.
+func (k *FakeKernel) Close() error {
+	k.closeOnce.Do(func() {
+		k.closeErr = k.close()
+	})
+
+	return k.closeErr
+}
+
+func (k *FakeKernel) close() error {
+	k.shutdown()
+
+	joinErr := k.mfs.Join(context.Background())
+	syscall.Close(k.fd)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.err != nil && k.err != errHungUp && k.err != ErrAborted {
+		return k.err
+	}
+
+	return joinErr
+}
+
+// ErrAborted is the reason given for failing requests that were outstanding
+// when FakeKernel.Abort was called.
+var ErrAborted = errors.New("connection aborted")
+
+var errHungUp = errors.New("hung up")
+
+// Hang up and wait for the reader to notice.
+func (k *FakeKernel) shutdown() {
+	syscall.Shutdown(k.fd, syscall.SHUT_RDWR)
+	<-k.readerDone
+}
+
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) readReplies() {
+	defer close(k.readerDone)
+
+	buf := make([]byte, 4<<20)
+	for {
+		n, err := syscall.Read(k.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+
+		if err == nil && n == 0 {
+			err = errHungUp
+		}
+
+		if err == nil {
+			err = k.dispatch(buf[:n])
+		}
+
+		if err != nil {
+			k.mu.Lock()
+			if k.err == nil {
+				k.err = err
+			}
+
+			for _, c := range k.pending {
+				close(c)
+			}
+
+			k.pending = nil
+			k.mu.Unlock()
+
+			return
+		}
+	}
+}
+
+// Deliver a single reply message to its waiter.
+//
+// LOCKS_EXCLUDED(k.mu)
+func (k *FakeKernel) dispatch(msg []byte) error {
+	const headerSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+	if len(msg) < headerSize {
+		return fmt.Errorf("Short reply: %d bytes", len(msg))
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&msg[0]))
+	if int(h.Len) != len(msg) {
+		return fmt.Errorf("Reply header says %d bytes, but got %d", h.Len, len(msg))
+	}
+
+	// Notifications have a zero request ID and carry their code in the error
+	// field.
+	notification := h.Unique == 0
+	if notification && h.Error <= 0 {
+		return fmt.Errorf("Notification with non-positive code %d", h.Error)
+	}
+
+	if !notification && h.Error > 0 {
+		return fmt.Errorf("Reply with positive error %d", h.Error)
+	}
+
+	if !notification && h.Error != 0 && len(msg) != headerSize {
+		return fmt.Errorf("Error reply with %d-byte body", len(msg)-headerSize)
+	}
+
+	body := make([]byte, len(msg)-headerSize)
+	copy(body, msg[headerSize:])
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if notification {
+		k.notifications = append(k.notifications, FakeNotification{
+			Code: h.Error,
+			Body: body,
+		})
+
+		return nil
+	}
+
+	c, ok := k.pending[h.Unique]
+	if !ok {
+		return fmt.Errorf("Reply for unknown request %d", h.Unique)
+	}
+
+	select {
+	case c <- FakeReply{
+		Unique: h.Unique,
+		Error:  syscall.Errno(-h.Error),
+		Body:   body,
+	}:
+	default:
+		return fmt.Errorf("Duplicate reply for request %d", h.Unique)
+	}
+
+	return nil
+}
@@ -0,0 +1,345 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/oglematchers"
+)
+
+// A call recorded by a FakeNotifier.
+type NotifierCall struct {
+	// The name of the fuse.Notifier method called: "InvalidateInode",
+	// "InvalidateEntry", "NotifyDelete", "Store", "Retrieve", or
+	// "NotifyPollWakeup".
+	Method string
+
+	// The inode argument, or the parent directory for InvalidateEntry and
+	// NotifyDelete.
+	Inode fuseops.InodeID
+
+	// The child argument to NotifyDelete.
+	Child fuseops.InodeID
+
+	// The name argument to InvalidateEntry and NotifyDelete.
+	Name string
+
+	// The offset and length arguments to InvalidateInode. For Store and
+	// Retrieve, the offset argument and the length of the data or buffer.
+	Offset int64
+	Length int64
+
+	// A copy of the data argument to Store.
+	Data []byte
+
+	// The poll handle argument to NotifyPollWakeup.
+	PollHandle uint64
+}
+
+func (c NotifierCall) String() string {
+	switch c.Method {
+	case "InvalidateInode":
+		return fmt.Sprintf("InvalidateInode(%v, %d, %d)", c.Inode, c.Offset, c.Length)
+
+	case "InvalidateEntry":
+		return fmt.Sprintf("InvalidateEntry(%v, %q)", c.Inode, c.Name)
+
+	case "NotifyDelete":
+		return fmt.Sprintf("NotifyDelete(%v, %v, %q)", c.Inode, c.Child, c.Name)
+
+	case "Store":
+		return fmt.Sprintf("Store(%v, %d, %q)", c.Inode, c.Offset, c.Data)
+
+	case "Retrieve":
+		return fmt.Sprintf("Retrieve(%v, %d, %d)", c.Inode, c.Offset, c.Length)
+
+	case "NotifyPollWakeup":
+		return fmt.Sprintf("NotifyPollWakeup(%#x)", c.PollHandle)
+	}
+
+	return fmt.Sprintf("%s(%v)", c.Method, c.Inode)
+}
+
+// FakeNotifier is a fuse.Notifier that records the calls made to it rather
+// than sending them to a kernel, so that tests can check that a file system
+// invalidates what it should. Hand it to the file system under test in place
+// of the one returned by MountedFileSystem.Notifier, and use the matchers
+// InvalidatedInode, InvalidatedEntry, NotifiedDelete, Stored, Retrieved, and
+// WokePoll to check the result of Calls:
+//
+//	ExpectThat(notifier.Calls(), Contains(InvalidatedEntry(dirID, "foo")))
+//
+// It is safe for concurrent use.
+type FakeNotifier struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	calls []NotifierCall
+
+	// The error to return from each call.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+var _ fuse.Notifier = &FakeNotifier{}
+
+// NewFakeNotifier creates a notifier with no calls recorded, whose methods
+// return nil.
+func NewFakeNotifier() *FakeNotifier {
+	return &FakeNotifier{}
+}
+
+// SetError causes subsequent calls to return the supplied error (after being
+// recorded), e.g. fuse.ENOENT to simulate a kernel that has nothing cached.
+//
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) SetError(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.err = err
+}
+
+// Calls returns the calls made so far, in order.
+//
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) Calls() []NotifierCall {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]NotifierCall(nil), n.calls...)
+}
+
+// Reset forgets the calls made so far.
+//
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.calls = nil
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) record(c NotifierCall) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.calls = append(n.calls, c)
+	return n.err
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) InvalidateInode(
+	inode fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	return n.record(NotifierCall{
+		Method: "InvalidateInode",
+		Inode:  inode,
+		Offset: offset,
+		Length: length,
+	})
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	return n.record(NotifierCall{
+		Method: "InvalidateEntry",
+		Inode:  parent,
+		Name:   name,
+	})
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) NotifyDelete(
+	parent fuseops.InodeID,
+	child fuseops.InodeID,
+	name string) error {
+	return n.record(NotifierCall{
+		Method: "NotifyDelete",
+		Inode:  parent,
+		Child:  child,
+		Name:   name,
+	})
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) Store(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	return n.record(NotifierCall{
+		Method: "Store",
+		Inode:  inode,
+		Offset: int64(offset),
+		Length: int64(len(data)),
+		Data:   append([]byte(nil), data...),
+	})
+}
+
+// Retrieve records the call and returns no data, as the kernel does when it
+// has nothing cached at the offset.
+//
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) Retrieve(
+	inode fuseops.InodeID,
+	offset uint64,
+	dst []byte) (int, error) {
+	return 0, n.record(NotifierCall{
+		Method: "Retrieve",
+		Inode:  inode,
+		Offset: int64(offset),
+		Length: int64(len(dst)),
+	})
+}
+
+// LOCKS_EXCLUDED(n.mu)
+func (n *FakeNotifier) NotifyPollWakeup(pollHandle uint64) error {
+	return n.record(NotifierCall{
+		Method:     "NotifyPollWakeup",
+		PollHandle: pollHandle,
+	})
+}
+
+////////////////////////////////////////////////////////////////////////
+// Matchers
+////////////////////////////////////////////////////////////////////////
+
+// Arguments to the matchers below may be matchers themselves, or values to be
+// compared using oglematchers.Equals.
+func argMatcher(x interface{}) oglematchers.Matcher {
+	if m, ok := x.(oglematchers.Matcher); ok {
+		return m
+	}
+
+	return oglematchers.Equals(x)
+}
+
+// A field of NotifierCall to be checked by a matcher.
+type callField struct {
+	name    string
+	matcher oglematchers.Matcher
+	value   func(c NotifierCall) interface{}
+}
+
+func newCallMatcher(method string, fields ...callField) oglematchers.Matcher {
+	desc := method + "("
+	for i, f := range fields {
+		if i > 0 {
+			desc += ", "
+		}
+
+		desc += f.matcher.Description()
+	}
+
+	desc += ")"
+
+	return oglematchers.NewMatcher(
+		func(candidate interface{}) error {
+			c, ok := candidate.(NotifierCall)
+			if !ok {
+				return fmt.Errorf("which is of type %v", reflect.TypeOf(candidate))
+			}
+
+			if c.Method != method {
+				return fmt.Errorf("which is a call to %s", c.Method)
+			}
+
+			for _, f := range fields {
+				v := f.value(c)
+				if err := f.matcher.Matches(v); err != nil {
+					if s, ok := v.(string); ok {
+						return fmt.Errorf("which has %s %q", f.name, s)
+					}
+
+					return fmt.Errorf("which has %s %v", f.name, v)
+				}
+			}
+
+			return nil
+		},
+		desc)
+}
+
+// InvalidatedInode matches NotifierCall values for a call to InvalidateInode
+// with the given arguments.
+func InvalidatedInode(inode, offset, length interface{}) oglematchers.Matcher {
+	return newCallMatcher(
+		"InvalidateInode",
+		callField{"inode", argMatcher(inode), func(c NotifierCall) interface{} { return c.Inode }},
+		callField{"offset", argMatcher(offset), func(c NotifierCall) interface{} { return c.Offset }},
+		callField{"length", argMatcher(length), func(c NotifierCall) interface{} { return c.Length }})
+}
+
+// InvalidatedEntry matches NotifierCall values for a call to InvalidateEntry
+// with the given arguments.
+func InvalidatedEntry(parent, name interface{}) oglematchers.Matcher {
+	return newCallMatcher(
+		"InvalidateEntry",
+		callField{"parent", argMatcher(parent), func(c NotifierCall) interface{} { return c.Inode }},
+		callField{"name", argMatcher(name), func(c NotifierCall) interface{} { return c.Name }})
+}
+
+// NotifiedDelete matches NotifierCall values for a call to NotifyDelete with
+// the given arguments.
+func NotifiedDelete(parent, child, name interface{}) oglematchers.Matcher {
+	return newCallMatcher(
+		"NotifyDelete",
+		callField{"parent", argMatcher(parent), func(c NotifierCall) interface{} { return c.Inode }},
+		callField{"child", argMatcher(child), func(c NotifierCall) interface{} { return c.Child }},
+		callField{"name", argMatcher(name), func(c NotifierCall) interface{} { return c.Name }})
+}
+
+// Stored matches NotifierCall values for a call to Store with the given
+// arguments. The data is compared as a string, so it may be given as a string,
+// a []byte, or a matcher for strings such as oglematchers.HasSubstr.
+func Stored(inode, offset, data interface{}) oglematchers.Matcher {
+	if b, ok := data.([]byte); ok {
+		data = string(b)
+	}
+
+	return newCallMatcher(
+		"Store",
+		callField{"inode", argMatcher(inode), func(c NotifierCall) interface{} { return c.Inode }},
+		callField{"offset", argMatcher(offset), func(c NotifierCall) interface{} { return c.Offset }},
+		callField{"data", argMatcher(data), func(c NotifierCall) interface{} { return string(c.Data) }})
+}
+
+// Retrieved matches NotifierCall values for a call to Retrieve with the given
+// inode and offset, and a buffer of the given length.
+func Retrieved(inode, offset, length interface{}) oglematchers.Matcher {
+	return newCallMatcher(
+		"Retrieve",
+		callField{"inode", argMatcher(inode), func(c NotifierCall) interface{} { return c.Inode }},
+		callField{"offset", argMatcher(offset), func(c NotifierCall) interface{} { return c.Offset }},
+		callField{"length", argMatcher(length), func(c NotifierCall) interface{} { return c.Length }})
+}
+
+// WokePoll matches NotifierCall values for a call to NotifyPollWakeup with
+// the given poll handle.
+func WokePoll(pollHandle interface{}) oglematchers.Matcher {
+	return newCallMatcher(
+		"NotifyPollWakeup",
+		callField{"poll handle", argMatcher(pollHandle), func(c NotifierCall) interface{} { return c.PollHandle }})
+}
@@ -0,0 +1,424 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/direntplus"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A LeakDetector wraps a fuseutil.FileSystem, keeping track of every inode
+// lookup count and every handle that the wrapped file system hands to the
+// kernel. After unmounting, its Check method reports any inode whose lookup
+// count the kernel never forgot and any handle that was never released, along
+// with the stack at which each was issued.
+//
+// The root inode is exempt, since the kernel holds an implicit reference to it
+// that it never forgets.
+//
+// Use it by handing the LeakDetector to fuseutil.NewFileSystemServer in place
+// of the file system under test.
+type LeakDetector struct {
+	fuseutil.FileSystem
+
+	mu sync.Mutex
+
+	// Outstanding lookup counts, by inode ID. Entries are removed when their
+	// count reaches zero.
+	//
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*leakRecord
+
+	// Handles that have been issued and not yet released. Many file systems
+	// hand out the same ID more than once (often zero), so these are counted
+	// too.
+	//
+	// GUARDED_BY(mu)
+	handles map[leakHandle]*leakRecord
+
+	// Misuse seen so far, such as forgetting more than was looked up or
+	// releasing a handle more times than it was opened.
+	//
+	// GUARDED_BY(mu)
+	violations []string
+}
+
+// File and directory handles are distinct namespaces.
+type leakHandle struct {
+	dir bool
+	id  fuseops.HandleID
+}
+
+func (h leakHandle) String() string {
+	if h.dir {
+		return fmt.Sprintf("Directory handle %d", h.id)
+	}
+
+	return fmt.Sprintf("File handle %d", h.id)
+}
+
+type leakRecord struct {
+	// The current lookup count or number of times the handle is open.
+	count uint64
+
+	// A description of the op that first issued the resource, and the stack at
+	// the time.
+	op    string
+	stack []byte
+}
+
+// NewLeakDetector creates a LeakDetector wrapping the supplied file system.
+func NewLeakDetector(wrapped fuseutil.FileSystem) *LeakDetector {
+	return &LeakDetector{
+		FileSystem: wrapped,
+		inodes:     make(map[fuseops.InodeID]*leakRecord),
+		handles:    make(map[leakHandle]*leakRecord),
+	}
+}
+
+// Check returns an error describing every leaked inode and handle, and any
+// misuse of lookup counts or handles seen along the way. It should be called
+// after the file system has been unmounted and joined.
+//
+// LOCKS_EXCLUDED(d.mu)
+func (d *LeakDetector) Check() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var problems []string
+	problems = append(problems, d.violations...)
+
+	var inodeIDs []fuseops.InodeID
+	for id := range d.inodes {
+		inodeIDs = append(inodeIDs, id)
+	}
+
+	sort.Slice(inodeIDs, func(i, j int) bool { return inodeIDs[i] < inodeIDs[j] })
+	for _, id := range inodeIDs {
+		r := d.inodes[id]
+		problems = append(
+			problems,
+			fmt.Sprintf(
+				"Inode %d leaked with lookup count %d; first issued by %s at:\n%s",
+				id,
+				r.count,
+				r.op,
+				r.stack))
+	}
+
+	var handles []leakHandle
+	for h := range d.handles {
+		handles = append(handles, h)
+	}
+
+	sort.Slice(handles, func(i, j int) bool {
+		if handles[i].dir != handles[j].dir {
+			return !handles[i].dir
+		}
+
+		return handles[i].id < handles[j].id
+	})
+
+	for _, h := range handles {
+		r := d.handles[h]
+		problems = append(
+			problems,
+			fmt.Sprintf(
+				"%v leaked with %d open reference(s); first issued by %s at:\n%s",
+				h,
+				r.count,
+				r.op,
+				r.stack))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf(
+		"%d leak(s) or misuse(s):\n\n%s",
+		len(problems),
+		strings.Join(problems, "\n\n"))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Bookkeeping
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *LeakDetector) lookedUp(op string, id fuseops.InodeID) {
+	if id == 0 || id == fuseops.RootInodeID {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r, ok := d.inodes[id]; ok {
+		r.count++
+		return
+	}
+
+	d.inodes[id] = &leakRecord{
+		count: 1,
+		op:    op,
+		stack: debug.Stack(),
+	}
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *LeakDetector) forgot(id fuseops.InodeID, n uint64) {
+	if id == fuseops.RootInodeID {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.inodes[id]
+	if !ok || r.count < n {
+		var count uint64
+		if ok {
+			count = r.count
+		}
+
+		d.violations = append(
+			d.violations,
+			fmt.Sprintf("Inode %d forgotten %d times with lookup count %d", id, n, count))
+
+		delete(d.inodes, id)
+		return
+	}
+
+	r.count -= n
+	if r.count == 0 {
+		delete(d.inodes, id)
+	}
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *LeakDetector) opened(op string, h leakHandle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if r, ok := d.handles[h]; ok {
+		r.count++
+		return
+	}
+
+	d.handles[h] = &leakRecord{
+		count: 1,
+		op:    op,
+		stack: debug.Stack(),
+	}
+}
+
+// LOCKS_EXCLUDED(d.mu)
+func (d *LeakDetector) released(h leakHandle) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	r, ok := d.handles[h]
+	if !ok {
+		d.violations = append(d.violations, fmt.Sprintf("%v released but not open", h))
+		return
+	}
+
+	r.count--
+	if r.count == 0 {
+		delete(d.handles, h)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that issue lookup counts
+////////////////////////////////////////////////////////////////////////
+
+func (d *LeakDetector) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	err := d.FileSystem.LookUpInode(ctx, op)
+	if err == nil {
+		d.lookedUp(fmt.Sprintf("LookUpInode(%d, %q)", op.Parent, op.Name), op.Entry.Child)
+	}
+
+	return err
+}
+
+func (d *LeakDetector) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	err := d.FileSystem.MkDir(ctx, op)
+	if err == nil {
+		d.lookedUp(fmt.Sprintf("MkDir(%d, %q)", op.Parent, op.Name), op.Entry.Child)
+	}
+
+	return err
+}
+
+func (d *LeakDetector) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	err := d.FileSystem.MkNode(ctx, op)
+	if err == nil {
+		d.lookedUp(fmt.Sprintf("MkNode(%d, %q)", op.Parent, op.Name), op.Entry.Child)
+	}
+
+	return err
+}
+
+func (d *LeakDetector) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := d.FileSystem.CreateFile(ctx, op)
+	if err == nil {
+		desc := fmt.Sprintf("CreateFile(%d, %q)", op.Parent, op.Name)
+		d.lookedUp(desc, op.Entry.Child)
+		d.opened(desc, leakHandle{id: op.Handle})
+	}
+
+	return err
+}
+
+func (d *LeakDetector) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	err := d.FileSystem.CreateLink(ctx, op)
+	if err == nil {
+		d.lookedUp(fmt.Sprintf("CreateLink(%d, %q)", op.Parent, op.Name), op.Entry.Child)
+	}
+
+	return err
+}
+
+func (d *LeakDetector) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	err := d.FileSystem.CreateSymlink(ctx, op)
+	if err == nil {
+		d.lookedUp(fmt.Sprintf("CreateSymlink(%d, %q)", op.Parent, op.Name), op.Entry.Child)
+	}
+
+	return err
+}
+
+func (d *LeakDetector) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	err := d.FileSystem.ReadDirPlus(ctx, op)
+	if err != nil {
+		return err
+	}
+
+	// The kernel counts a lookup of each child with a non-zero ID.
+	b := op.Dst[:op.BytesRead]
+	for len(b) >= fusekernel.DirentPlusSize {
+		de := (*fusekernel.DirentPlus)(unsafe.Pointer(&b[0]))
+		end := fusekernel.DirentPlusSize + int(de.Dirent.Namelen)
+		if end > len(b) {
+			break
+		}
+
+		e := direntplus.Decode((*direntplus.Entry)(unsafe.Pointer(&de.Entry)))
+		name := string(b[fusekernel.DirentPlusSize:end])
+		d.lookedUp(fmt.Sprintf("ReadDirPlus(%d, %q)", op.Inode, name), e.Child)
+
+		// Entries are padded to a multiple of 8 bytes.
+		if end = (end + 7) &^ 7; end > len(b) {
+			end = len(b)
+		}
+
+		b = b[end:]
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that forget lookup counts
+////////////////////////////////////////////////////////////////////////
+
+func (d *LeakDetector) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	d.forgot(op.Inode, op.N)
+	return d.FileSystem.ForgetInode(ctx, op)
+}
+
+func (d *LeakDetector) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	err := d.FileSystem.BatchForget(ctx, op)
+
+	// If the wrapped file system doesn't implement batch forgets, the server
+	// falls back to calling ForgetInode for each entry, which we'll see above.
+	if err == nil {
+		for _, e := range op.Entries {
+			d.forgot(e.Inode, e.N)
+		}
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that issue and release handles
+////////////////////////////////////////////////////////////////////////
+
+func (d *LeakDetector) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	err := d.FileSystem.OpenDir(ctx, op)
+	if err == nil {
+		d.opened(fmt.Sprintf("OpenDir(%d)", op.Inode), leakHandle{dir: true, id: op.Handle})
+	}
+
+	return err
+}
+
+func (d *LeakDetector) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	d.released(leakHandle{dir: true, id: op.Handle})
+	return d.FileSystem.ReleaseDirHandle(ctx, op)
+}
+
+func (d *LeakDetector) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	err := d.FileSystem.OpenFile(ctx, op)
+	if err == nil {
+		d.opened(fmt.Sprintf("OpenFile(%d)", op.Inode), leakHandle{id: op.Handle})
+	}
+
+	return err
+}
+
+func (d *LeakDetector) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	d.released(leakHandle{id: op.Handle})
+	return d.FileSystem.ReleaseFileHandle(ctx, op)
+}
@@ -0,0 +1,236 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system whose every name resolves to inode 2, and whose every open
+// returns handle 7.
+type leakyFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *leakyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 2
+	return nil
+}
+
+func (fs *leakyFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = 7
+	return nil
+}
+
+func (fs *leakyFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *leakyFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	return nil
+}
+
+// Look up and open inode 2 twice each through a LeakDetector wrapping a
+// leakyFS, then forget and release it the given number of times and return
+// the result of checking the detector.
+func runLeakDetector(t *testing.T, forgets uint64, releases int) error {
+	d := fusetesting.NewLeakDetector(&leakyFS{})
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(d),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	call := func(opcode uint32, nodeID uint64, body []byte) {
+		t.Helper()
+		if r, err := k.Call(opcode, nodeID, body); err != nil || r.Error != 0 {
+			t.Fatalf("Call(%d): %v, %v", opcode, err, r.Error)
+		}
+	}
+
+	// Look up the inode twice and open it twice.
+	call(fusekernel.OpLookup, 1, []byte("foo\x00"))
+	call(fusekernel.OpLookup, 1, []byte("foo\x00"))
+
+	openIn := fusekernel.OpenIn{}
+	openBytes := unsafe.Slice((*byte)(unsafe.Pointer(&openIn)), unsafe.Sizeof(openIn))
+	call(fusekernel.OpOpen, 2, openBytes)
+	call(fusekernel.OpOpen, 2, openBytes)
+
+	// Give back as much as we've been asked to.
+	if forgets > 0 {
+		forgetIn := fusekernel.ForgetIn{Nlookup: forgets}
+		_, err := k.Start(
+			fusekernel.OpForget,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&forgetIn)), unsafe.Sizeof(forgetIn)))
+
+		if err != nil {
+			t.Fatalf("Forget: %v", err)
+		}
+	}
+
+	releaseIn := fusekernel.ReleaseIn{Fh: 7}
+	for i := 0; i < releases; i++ {
+		call(
+			fusekernel.OpRelease,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&releaseIn)), unsafe.Sizeof(releaseIn)))
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	return d.Check()
+}
+
+func TestLeakDetector_NoLeaks(t *testing.T) {
+	if err := runLeakDetector(t, 2, 2); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+}
+
+func TestLeakDetector_Leaks(t *testing.T) {
+	err := runLeakDetector(t, 1, 1)
+	if err == nil {
+		t.Fatal("Check succeeded despite leaks")
+	}
+
+	msg := err.Error()
+	for _, want := range []string{
+		"Inode 2 leaked with lookup count 1",
+		`first issued by LookUpInode(1, "foo")`,
+		"File handle 7 leaked with 1 open reference(s)",
+		"first issued by OpenFile(2)",
+		"fileSystemServer).handleOp",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error doesn't contain %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestLeakDetector_OverForget(t *testing.T) {
+	err := runLeakDetector(t, 3, 2)
+	if err == nil || !strings.Contains(err.Error(), "Inode 2 forgotten 3 times with lookup count 2") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+// A file system whose directory listings hold inode 2 twice, along with an
+// entry for which no lookup is counted.
+type readDirPlusFS struct {
+	leakyFS
+}
+
+func (fs *readDirPlusFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if op.Offset != 0 {
+		return nil
+	}
+
+	for i, name := range []string{"foo", "bar", "baz"} {
+		d := fuseutil.DirentPlus{
+			Dirent: fuseutil.Dirent{
+				Offset: fuseops.DirOffset(i + 1),
+				Inode:  2,
+				Name:   name,
+			},
+		}
+
+		if name != "baz" {
+			d.Entry.Child = 2
+		}
+
+		op.BytesRead += fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], d)
+	}
+
+	return nil
+}
+
+func TestLeakDetector_ReadDirPlus(t *testing.T) {
+	d := fusetesting.NewLeakDetector(&readDirPlusFS{})
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(d),
+		&fuse.MountConfig{EnableReadDirPlus: true},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitDoReaddirplus)})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	in := fusekernel.ReadIn{Size: 4096}
+	r, err := k.Call(
+		fusekernel.OpReaddirplus,
+		1,
+		unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)))
+
+	if err != nil || r.Error != 0 {
+		t.Fatalf("ReadDirPlus: %v, %v", err, r.Error)
+	}
+
+	// Forgetting one of the two lookups leaves the other leaked.
+	forgetIn := fusekernel.ForgetIn{Nlookup: 1}
+	_, err = k.Start(
+		fusekernel.OpForget,
+		2,
+		unsafe.Slice((*byte)(unsafe.Pointer(&forgetIn)), unsafe.Sizeof(forgetIn)))
+
+	if err != nil {
+		t.Fatalf("Forget: %v", err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	err = d.Check()
+	if err == nil {
+		t.Fatal("Check succeeded despite leaks")
+	}
+
+	msg := err.Error()
+	for _, want := range []string{
+		"1 leak(s) or misuse(s)",
+		"Inode 2 leaked with lookup count 1",
+		`first issued by ReadDirPlus(1, "foo")`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("Error doesn't contain %q:\n%s", want, msg)
+		}
+	}
+}
@@ -0,0 +1,628 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// How long Release waits for the kernel to forget the inodes of a file system
+// after its entries have been invalidated, before giving up on reusing the
+// mount.
+const poolDrainTimeout = time.Second
+
+// A MountPool keeps a set of fuse mounts alive across test cases, so that
+// each test can be handed a mounted file system without paying for a mount
+// and an unmount. Mounts are created up front, in parallel, and each one is
+// bound to the file system of the test that acquires it.
+//
+// When a test releases its mount, the pool invalidates every directory entry
+// the kernel may have cached and waits for the kernel to forget every inode
+// and release every handle the file system handed out. If that happens
+// promptly, the mount is reset and returned to the pool; otherwise (for
+// example because the test left a file open) it is unmounted in the
+// background and replaced with a fresh one. A test therefore never sees
+// kernel state left behind by an earlier test.
+//
+// All mounts share the MountConfig given to NewMountPool, so tests that need
+// particular mount options should mount for themselves.
+type MountPool struct {
+	cfg fuse.MountConfig
+
+	// Background unmounting and replenishing.
+	wg sync.WaitGroup
+
+	mu sync.Mutex
+
+	// Mounts not currently acquired.
+	//
+	// GUARDED_BY(mu)
+	idle []*PooledMount
+
+	// GUARDED_BY(mu)
+	closed bool
+
+	// Errors seen in the background, to be reported by Close.
+	//
+	// GUARDED_BY(mu)
+	errs []error
+}
+
+// A PooledMount is a mount acquired from a MountPool.
+type PooledMount struct {
+	pool *MountPool
+	dir  string
+	mfs  *fuse.MountedFileSystem
+	fs   *poolFS
+
+	// The leak detector wrapping the file system the mount is bound to, or nil
+	// if the mount is idle.
+	detector *LeakDetector
+}
+
+// NewMountPool creates a pool of the given number of mounts, each with the
+// supplied config (which may be nil). The caller must eventually call Close.
+func NewMountPool(size int, cfg *fuse.MountConfig) (*MountPool, error) {
+	p := &MountPool{}
+	if cfg != nil {
+		p.cfg = *cfg
+	}
+
+	// Mount in parallel.
+	mounts := make([]*PooledMount, size)
+	errs := make([]error, size)
+
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			mounts[i], errs[i] = p.mount()
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i, m := range mounts {
+		if errs[i] == nil {
+			p.idle = append(p.idle, m)
+		}
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Acquire binds the supplied file system to an idle mount, mounting a new one
+// if none is available. The caller must call Release on the result when done
+// with it, after closing any files it opened within the mount.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *MountPool) Acquire(fs fuseutil.FileSystem) (*PooledMount, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("Pool is closed")
+	}
+
+	var m *PooledMount
+	if n := len(p.idle); n > 0 {
+		m = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.mu.Unlock()
+
+	if m == nil {
+		var err error
+		m, err = p.mount()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m.detector = NewLeakDetector(fs)
+	m.fs.bind(m.detector)
+
+	// Make sure the kernel sees the new root's attributes.
+	m.fs.invalidate(m.mfs.Notifier())
+
+	return m, nil
+}
+
+// Close unmounts every mount in the pool, after waiting for any being
+// unmounted or replaced in the background. Call it once every acquired mount
+// has been released. It returns the first error seen in the background, if
+// any.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *MountPool) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	p.wg.Wait()
+
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, m := range idle {
+		p.recordError(m.unmount())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.errs) > 0 {
+		return p.errs[0]
+	}
+
+	return nil
+}
+
+// Dir returns the directory at which the file system is mounted.
+func (m *PooledMount) Dir() string {
+	return m.dir
+}
+
+// Notifier returns the notifier for the mount.
+func (m *PooledMount) Notifier() fuse.Notifier {
+	return m.mfs.Notifier()
+}
+
+// Release unbinds the file system from the mount, calling its Destroy method,
+// and returns the mount to its pool or retires it as described for
+// MountPool. The PooledMount must not be used afterward.
+//
+// LOCKS_EXCLUDED(m.pool.mu)
+func (m *PooledMount) Release() {
+	p := m.pool
+
+	// Ask the kernel to drop everything it has cached, then wait for it to
+	// forget the inodes and release the handles it had. Only then is it safe to
+	// hand the same inode IDs out again for a different file system.
+	m.fs.invalidate(m.mfs.Notifier())
+
+	reusable := false
+	for deadline := time.Now().Add(poolDrainTimeout); ; {
+		if m.detector.Check() == nil {
+			reusable = true
+			break
+		}
+
+		if time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if !reusable {
+		// Leave the file system bound, so that the ops sent while unmounting
+		// reach it and it is destroyed by unmounting as usual.
+		p.retire(m)
+		return
+	}
+
+	m.fs.bind(&idleFS{})
+	m.detector.Destroy()
+	m.detector = nil
+
+	p.mu.Lock()
+	closed := p.closed
+	if !closed {
+		p.idle = append(p.idle, m)
+	}
+	p.mu.Unlock()
+
+	if closed {
+		p.recordError(m.unmount())
+	}
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *MountPool) recordError(err error) {
+	if err == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.errs = append(p.errs, err)
+}
+
+// Mount a fresh directory with an idle file system.
+func (p *MountPool) mount() (*PooledMount, error) {
+	dir, err := ioutil.TempDir("", "fusetesting_pool")
+	if err != nil {
+		return nil, fmt.Errorf("TempDir: %v", err)
+	}
+
+	fs := newPoolFS()
+	cfg := p.cfg
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &cfg)
+	if err != nil {
+		os.Remove(dir)
+		return nil, fmt.Errorf("Mount: %v", err)
+	}
+
+	return &PooledMount{
+		pool: p,
+		dir:  dir,
+		mfs:  mfs,
+		fs:   fs,
+	}, nil
+}
+
+// Unmount the mount in the background, and replace it unless the pool is
+// closed.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *MountPool) retire(m *PooledMount) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		p.recordError(m.unmount())
+
+		p.mu.Lock()
+		closed := p.closed
+		p.mu.Unlock()
+
+		if closed {
+			return
+		}
+
+		replacement, err := p.mount()
+		if err != nil {
+			p.recordError(err)
+			return
+		}
+
+		p.mu.Lock()
+		closed = p.closed
+		if !closed {
+			p.idle = append(p.idle, replacement)
+		}
+		p.mu.Unlock()
+
+		if closed {
+			p.recordError(replacement.unmount())
+		}
+	}()
+}
+
+// Unmount, wait for the server to finish, and remove the mount point.
+func (m *PooledMount) unmount() error {
+	delay := 10 * time.Millisecond
+	for {
+		err := fuse.Unmount(m.dir)
+		if err == nil {
+			break
+		}
+
+		// Retry on "resource busy" for a while, as samples.SampleTest does.
+		if errors.Is(err, syscall.EBUSY) && delay < time.Second {
+			time.Sleep(delay)
+			delay = time.Duration(1.3 * float64(delay))
+			continue
+		}
+
+		return fmt.Errorf("Unmount(%q): %v", m.dir, err)
+	}
+
+	if err := m.mfs.Join(context.Background()); err != nil {
+		return fmt.Errorf("Join: %v", err)
+	}
+
+	if err := os.Remove(m.dir); err != nil {
+		return fmt.Errorf("Remove: %v", err)
+	}
+
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// poolFS
+////////////////////////////////////////////////////////////////////////
+
+// A directory entry that the kernel may have cached.
+type poolEntry struct {
+	parent fuseops.InodeID
+	name   string
+}
+
+// The file system served for a pooled mount, which forwards to whatever file
+// system the mount is currently bound to and remembers which entries the
+// kernel may have cached.
+type poolFS struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	current fuseutil.FileSystem
+
+	// GUARDED_BY(mu)
+	entries map[poolEntry]struct{}
+}
+
+func newPoolFS() *poolFS {
+	return &poolFS{
+		current: &idleFS{},
+		entries: make(map[poolEntry]struct{}),
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) bind(current fuseutil.FileSystem) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.current = current
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) get() fuseutil.FileSystem {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.current
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) noteEntry(parent fuseops.InodeID, name string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.entries[poolEntry{parent, name}] = struct{}{}
+}
+
+// Invalidate the root inode and every entry noted so far. Errors are ignored;
+// most mean that the kernel has nothing cached.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *poolFS) invalidate(n fuse.Notifier) {
+	fs.mu.Lock()
+	entries := fs.entries
+	fs.entries = make(map[poolEntry]struct{})
+	fs.mu.Unlock()
+
+	for e := range entries {
+		n.InvalidateEntry(e.parent, e.name)
+	}
+
+	n.InvalidateInode(fuseops.RootInodeID, 0, 0)
+}
+
+func (fs *poolFS) StatFS(ctx context.Context, op *fuseops.StatFSOp) error {
+	return fs.get().StatFS(ctx, op)
+}
+
+func (fs *poolFS) LookUpInode(ctx context.Context, op *fuseops.LookUpInodeOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().LookUpInode(ctx, op)
+}
+
+func (fs *poolFS) GetInodeAttributes(ctx context.Context, op *fuseops.GetInodeAttributesOp) error {
+	return fs.get().GetInodeAttributes(ctx, op)
+}
+
+func (fs *poolFS) SetInodeAttributes(ctx context.Context, op *fuseops.SetInodeAttributesOp) error {
+	return fs.get().SetInodeAttributes(ctx, op)
+}
+
+func (fs *poolFS) Access(ctx context.Context, op *fuseops.AccessOp) error {
+	return fs.get().Access(ctx, op)
+}
+
+func (fs *poolFS) ForgetInode(ctx context.Context, op *fuseops.ForgetInodeOp) error {
+	return fs.get().ForgetInode(ctx, op)
+}
+
+func (fs *poolFS) BatchForget(ctx context.Context, op *fuseops.BatchForgetOp) error {
+	return fs.get().BatchForget(ctx, op)
+}
+
+func (fs *poolFS) MkDir(ctx context.Context, op *fuseops.MkDirOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().MkDir(ctx, op)
+}
+
+func (fs *poolFS) MkNode(ctx context.Context, op *fuseops.MkNodeOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().MkNode(ctx, op)
+}
+
+func (fs *poolFS) CreateFile(ctx context.Context, op *fuseops.CreateFileOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().CreateFile(ctx, op)
+}
+
+func (fs *poolFS) CreateLink(ctx context.Context, op *fuseops.CreateLinkOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().CreateLink(ctx, op)
+}
+
+func (fs *poolFS) CreateSymlink(ctx context.Context, op *fuseops.CreateSymlinkOp) error {
+	fs.noteEntry(op.Parent, op.Name)
+	return fs.get().CreateSymlink(ctx, op)
+}
+
+func (fs *poolFS) Rename(ctx context.Context, op *fuseops.RenameOp) error {
+	fs.noteEntry(op.NewParent, op.NewName)
+	return fs.get().Rename(ctx, op)
+}
+
+func (fs *poolFS) RmDir(ctx context.Context, op *fuseops.RmDirOp) error {
+	return fs.get().RmDir(ctx, op)
+}
+
+func (fs *poolFS) Unlink(ctx context.Context, op *fuseops.UnlinkOp) error {
+	return fs.get().Unlink(ctx, op)
+}
+
+func (fs *poolFS) OpenDir(ctx context.Context, op *fuseops.OpenDirOp) error {
+	return fs.get().OpenDir(ctx, op)
+}
+
+func (fs *poolFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+	return fs.get().ReadDir(ctx, op)
+}
+
+func (fs *poolFS) ReadDirPlus(ctx context.Context, op *fuseops.ReadDirPlusOp) error {
+	return fs.get().ReadDirPlus(ctx, op)
+}
+
+func (fs *poolFS) SyncDir(ctx context.Context, op *fuseops.SyncDirOp) error {
+	return fs.get().SyncDir(ctx, op)
+}
+
+func (fs *poolFS) ReleaseDirHandle(ctx context.Context, op *fuseops.ReleaseDirHandleOp) error {
+	return fs.get().ReleaseDirHandle(ctx, op)
+}
+
+func (fs *poolFS) OpenFile(ctx context.Context, op *fuseops.OpenFileOp) error {
+	return fs.get().OpenFile(ctx, op)
+}
+
+func (fs *poolFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+	return fs.get().ReadFile(ctx, op)
+}
+
+func (fs *poolFS) WriteFile(ctx context.Context, op *fuseops.WriteFileOp) error {
+	return fs.get().WriteFile(ctx, op)
+}
+
+func (fs *poolFS) SyncFile(ctx context.Context, op *fuseops.SyncFileOp) error {
+	return fs.get().SyncFile(ctx, op)
+}
+
+func (fs *poolFS) FlushFile(ctx context.Context, op *fuseops.FlushFileOp) error {
+	return fs.get().FlushFile(ctx, op)
+}
+
+func (fs *poolFS) ReleaseFileHandle(ctx context.Context, op *fuseops.ReleaseFileHandleOp) error {
+	return fs.get().ReleaseFileHandle(ctx, op)
+}
+
+func (fs *poolFS) ReadSymlink(ctx context.Context, op *fuseops.ReadSymlinkOp) error {
+	return fs.get().ReadSymlink(ctx, op)
+}
+
+func (fs *poolFS) RemoveXattr(ctx context.Context, op *fuseops.RemoveXattrOp) error {
+	return fs.get().RemoveXattr(ctx, op)
+}
+
+func (fs *poolFS) GetXattr(ctx context.Context, op *fuseops.GetXattrOp) error {
+	return fs.get().GetXattr(ctx, op)
+}
+
+func (fs *poolFS) ListXattr(ctx context.Context, op *fuseops.ListXattrOp) error {
+	return fs.get().ListXattr(ctx, op)
+}
+
+func (fs *poolFS) SetXattr(ctx context.Context, op *fuseops.SetXattrOp) error {
+	return fs.get().SetXattr(ctx, op)
+}
+
+func (fs *poolFS) Fallocate(ctx context.Context, op *fuseops.FallocateOp) error {
+	return fs.get().Fallocate(ctx, op)
+}
+
+func (fs *poolFS) Seek(ctx context.Context, op *fuseops.SeekOp) error {
+	return fs.get().Seek(ctx, op)
+}
+
+func (fs *poolFS) CopyFileRange(ctx context.Context, op *fuseops.CopyFileRangeOp) error {
+	return fs.get().CopyFileRange(ctx, op)
+}
+
+func (fs *poolFS) GetLock(ctx context.Context, op *fuseops.GetLockOp) error {
+	return fs.get().GetLock(ctx, op)
+}
+
+func (fs *poolFS) SetLock(ctx context.Context, op *fuseops.SetLockOp) error {
+	return fs.get().SetLock(ctx, op)
+}
+
+func (fs *poolFS) Flock(ctx context.Context, op *fuseops.FlockOp) error {
+	return fs.get().Flock(ctx, op)
+}
+
+func (fs *poolFS) Ioctl(ctx context.Context, op *fuseops.IoctlOp) error {
+	return fs.get().Ioctl(ctx, op)
+}
+
+func (fs *poolFS) Poll(ctx context.Context, op *fuseops.PollOp) error {
+	return fs.get().Poll(ctx, op)
+}
+
+func (fs *poolFS) SyncFS(ctx context.Context, op *fuseops.SyncFSOp) error {
+	return fs.get().SyncFS(ctx, op)
+}
+
+func (fs *poolFS) Destroy() {
+	fs.get().Destroy()
+}
+
+func (fs *poolFS) OpInterrupted(ctx context.Context, op interface{}) {
+	if o, ok := fs.get().(fuseutil.InterruptObserver); ok {
+		o.OpInterrupted(ctx, op)
+	}
+}
+
+// The file system a pooled mount serves while idle: an empty root directory.
+type idleFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *idleFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func (fs *idleFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fuse.ENOENT
+}
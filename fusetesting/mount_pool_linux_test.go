@@ -0,0 +1,124 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system containing a single entry "x" with the given mode, which the
+// kernel is told it may cache for a long time.
+type singleEntryFS struct {
+	fuseutil.NotImplementedFileSystem
+	mode os.FileMode
+}
+
+func (fs *singleEntryFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0700 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: fs.mode}
+}
+
+func (fs *singleEntryFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	op.AttributesExpiration = time.Now().Add(time.Hour)
+	return nil
+}
+
+func (fs *singleEntryFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if op.Name != "x" {
+		return fuse.ENOENT
+	}
+
+	op.Entry.Child = 2
+	op.Entry.Attributes = fs.attributes(op.Entry.Child)
+	op.Entry.EntryExpiration = time.Now().Add(time.Hour)
+	op.Entry.AttributesExpiration = op.Entry.EntryExpiration
+	return nil
+}
+
+func (fs *singleEntryFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func TestMountPoolReuse(t *testing.T) {
+	pool, err := fusetesting.NewMountPool(1, nil)
+	if err != nil {
+		t.Skipf("Can't mount here: %v", err)
+	}
+
+	defer func() {
+		if err := pool.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+
+	// Look up an entry in a file system where it's a file.
+	m, err := pool.Acquire(&singleEntryFS{mode: 0644})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	dir := m.Dir()
+	fi, err := os.Stat(path.Join(dir, "x"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		t.Errorf("Mode: %v", fi.Mode())
+	}
+
+	m.Release()
+
+	// The mount should be reused for the next file system, and the kernel
+	// should see that the entry is now a directory despite its cache.
+	m, err = pool.Acquire(&singleEntryFS{mode: 0755 | os.ModeDir})
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	defer m.Release()
+
+	if m.Dir() != dir {
+		t.Errorf("Got mount %q, want %q to be reused", m.Dir(), dir)
+	}
+
+	fi, err = os.Stat(path.Join(m.Dir(), "x"))
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if !fi.IsDir() {
+		t.Errorf("Mode: %v", fi.Mode())
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/oglematchers"
+)
+
+func TestNotifierOverFakeKernel(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer k.Close()
+
+	n := k.Notifier()
+	if err := n.InvalidateInode(17, 0, -1); err != nil {
+		t.Fatalf("InvalidateInode: %v", err)
+	}
+
+	if err := n.InvalidateEntry(1, "foo"); err != nil {
+		t.Fatalf("InvalidateEntry: %v", err)
+	}
+
+	if err := n.Store(17, 4096, []byte("taco")); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	if err := n.NotifyPollWakeup(0x1234); err != nil {
+		t.Fatalf("NotifyPollWakeup: %v", err)
+	}
+
+	if err := n.NotifyDelete(1, 17, "bar"); err != nil {
+		t.Fatalf("NotifyDelete: %v", err)
+	}
+
+	// Make sure the reader has seen everything by waiting for a reply sent
+	// after the notifications.
+	if _, err := k.Call(fusekernel.OpStatfs, 1); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	got := k.Notifications()
+	if len(got) != 5 {
+		t.Fatalf("Got %d notifications: %v", len(got), got)
+	}
+
+	codes := []int32{
+		fusekernel.NotifyCodeInvalInode,
+		fusekernel.NotifyCodeInvalEntry,
+		fusekernel.NotifyCodeStore,
+		fusekernel.NotifyCodePoll,
+		fusekernel.NotifyCodeDelete,
+	}
+
+	for i, code := range codes {
+		if got[i].Code != code {
+			t.Errorf("Notification %d: code %d, want %d", i, got[i].Code, code)
+		}
+	}
+
+	// The entry name follows the header, NUL-terminated.
+	if !bytes.HasSuffix(got[1].Body, []byte("foo\x00")) {
+		t.Errorf("Entry notification body: %q", got[1].Body)
+	}
+
+	// The data follows the store header.
+	if !bytes.HasSuffix(got[2].Body, []byte("taco")) || len(got[2].Body) != 24+4 {
+		t.Errorf("Store notification body: %q", got[2].Body)
+	}
+
+	// The poll handle is the whole body.
+	if !bytes.Equal(got[3].Body, []byte{0x34, 0x12, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("Poll notification body: %q", got[3].Body)
+	}
+
+	// The parent and child precede the name.
+	if !bytes.HasPrefix(got[4].Body, []byte{1, 0, 0, 0, 0, 0, 0, 0, 17}) ||
+		!bytes.HasSuffix(got[4].Body, []byte("bar\x00")) ||
+		len(got[4].Body) != 24+4 {
+		t.Errorf("Delete notification body: %q", got[4].Body)
+	}
+}
+
+func TestRetrieveOverFakeKernel(t *testing.T) {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(&fuseutil.NotImplementedFileSystem{}),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+
+	// Start retrieving, and wait for the notification.
+	dst := make([]byte, 8)
+	done := make(chan result, 1)
+	go func() {
+		n, err := k.Notifier().Retrieve(17, 4096, dst)
+		done <- result{n, err}
+	}()
+
+	var notifications []fusetesting.FakeNotification
+	deadline := time.Now().Add(5 * time.Second)
+	for len(notifications) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		notifications = k.Notifications()
+	}
+
+	if len(notifications) != 1 {
+		t.Fatalf("Got notifications %v", notifications)
+	}
+
+	n := notifications[0]
+	if n.Code != fusekernel.NotifyCodeRetrieve {
+		t.Fatalf("Got notification code %d", n.Code)
+	}
+
+	var out fusekernel.NotifyRetrieveOut
+	if len(n.Body) != int(unsafe.Sizeof(out)) {
+		t.Fatalf("Retrieve notification body: %q", n.Body)
+	}
+
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), n.Body)
+	if out.Nodeid != 17 || out.Offset != 4096 || out.Size != 8 {
+		t.Errorf("Retrieve notification: %+v", out)
+	}
+
+	// Reply with less data than asked for, as the kernel does when not all of
+	// it is cached.
+	err = k.NotifyReply(out.NotifyUnique, 17, 4096, []byte("taco"))
+	if err != nil {
+		t.Fatalf("NotifyReply: %v", err)
+	}
+
+	r := <-done
+	if r.err != nil || r.n != 4 || string(dst[:4]) != "taco" {
+		t.Errorf("Retrieve: %d, %v; %q", r.n, r.err, dst)
+	}
+
+	// A retrieval still waiting when the kernel hangs up fails.
+	go func() {
+		n, err := k.Notifier().Retrieve(17, 0, dst)
+		done <- result{n, err}
+	}()
+
+	deadline = time.Now().Add(5 * time.Second)
+	for len(k.Notifications()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if r := <-done; r.err != fuse.ErrUnmounted {
+		t.Errorf("Retrieve after hanging up: %d, %v", r.n, r.err)
+	}
+}
+
+func TestFakeNotifier(t *testing.T) {
+	n := fusetesting.NewFakeNotifier()
+	n.InvalidateEntry(1, "foo")
+	n.InvalidateInode(17, 0, 0)
+
+	n.SetError(fuse.ENOENT)
+	if err := n.Store(17, 4096, []byte("taco")); err != fuse.ENOENT {
+		t.Errorf("Store: %v", err)
+	}
+
+	n.NotifyPollWakeup(0x1234)
+	n.NotifyDelete(1, 17, "bar")
+	n.Retrieve(17, 0, make([]byte, 10))
+
+	calls := n.Calls()
+	matchers := []oglematchers.Matcher{
+		oglematchers.Contains(fusetesting.InvalidatedEntry(1, "foo")),
+		oglematchers.Contains(fusetesting.InvalidatedInode(17, 0, oglematchers.LessOrEqual(0))),
+		oglematchers.Contains(fusetesting.Stored(17, 4096, []byte("taco"))),
+		oglematchers.ElementsAre(
+			fusetesting.InvalidatedEntry(oglematchers.Any(), oglematchers.HasSubstr("f")),
+			oglematchers.Any(),
+			fusetesting.Stored(oglematchers.Any(), oglematchers.Any(), "taco"),
+			fusetesting.WokePoll(0x1234),
+			fusetesting.NotifiedDelete(1, 17, "bar"),
+			fusetesting.Retrieved(17, 0, 10)),
+	}
+
+	for _, m := range matchers {
+		if err := m.Matches(calls); err != nil {
+			t.Errorf("Calls %v don't match %s: %v", calls, m.Description(), err)
+		}
+	}
+
+	// Mismatches.
+	mismatches := []oglematchers.Matcher{
+		fusetesting.InvalidatedEntry(1, "bar"),
+		fusetesting.InvalidatedEntry(2, "foo"),
+		fusetesting.InvalidatedInode(1, 0, 0),
+		fusetesting.WokePoll(0x1234),
+		fusetesting.NotifiedDelete(1, 17, "foo"),
+		fusetesting.Retrieved(1, 0, 0),
+	}
+
+	for _, m := range mismatches {
+		if err := m.Matches(calls[0]); err == nil {
+			t.Errorf("%v unexpectedly matches %s", calls[0], m.Description())
+		}
+	}
+
+	n.Reset()
+	if calls := n.Calls(); len(calls) != 0 {
+		t.Errorf("Calls after Reset: %v", calls)
+	}
+}
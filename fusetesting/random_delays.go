@@ -0,0 +1,33 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// ReportSeedOnFailure arranges for the seed of the supplied scheduler to be
+// logged when the test finishes, if it failed. Pass the seed back in
+// RandomDelayConfig.Seed (or --fuseutil.random_delays_seed) to replay the
+// schedule that exposed the failure.
+func ReportSeedOnFailure(tb testing.TB, s *fuseutil.RandomDelayScheduler) {
+	tb.Cleanup(func() {
+		if tb.Failed() {
+			tb.Logf("Random delays seed: %d", s.Seed())
+		}
+	})
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A testing.TB that records what is logged and runs cleanups on demand.
+type fakeTB struct {
+	testing.TB
+	failed   bool
+	logs     []string
+	cleanups []func()
+}
+
+func (tb *fakeTB) Cleanup(f func()) { tb.cleanups = append(tb.cleanups, f) }
+func (tb *fakeTB) Failed() bool     { return tb.failed }
+func (tb *fakeTB) Logf(format string, args ...interface{}) {
+	tb.logs = append(tb.logs, fmt.Sprintf(format, args...))
+}
+
+func (tb *fakeTB) finish() {
+	for i := len(tb.cleanups) - 1; i >= 0; i-- {
+		tb.cleanups[i]()
+	}
+}
+
+func TestReportSeedOnFailure(t *testing.T) {
+	s := fuseutil.NewRandomDelayScheduler(fuseutil.RandomDelayConfig{Seed: 17})
+
+	// Nothing is logged for a passing test.
+	tb := &fakeTB{}
+	fusetesting.ReportSeedOnFailure(tb, s)
+	tb.finish()
+
+	if len(tb.logs) != 0 {
+		t.Errorf("Logged for a passing test: %q", tb.logs)
+	}
+
+	// The seed is logged for a failing one.
+	tb = &fakeTB{failed: true}
+	fusetesting.ReportSeedOnFailure(tb, s)
+	tb.finish()
+
+	if len(tb.logs) != 1 || tb.logs[0] != "Random delays seed: 17" {
+		t.Errorf("Got logs %q", tb.logs)
+	}
+}
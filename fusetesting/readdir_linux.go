@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The fixed-size prefix of struct linux_dirent64, as returned by
+// getdents64(2). The NUL-terminated name follows, padded out to d_reclen.
+type linuxDirent64 struct {
+	Ino    uint64
+	Off    int64
+	Reclen uint16
+	Type   uint8
+}
+
+const linuxDirent64NameOffset = int(unsafe.Offsetof(linuxDirent64{}.Type)) + 1
+
+// Like ReadDirPicky, but reads the directory with raw getdents64(2) calls
+// rather than going through os.File.Readdirnames, and checks each record
+// returned by the kernel before trusting it:
+//
+//   - The record must be well formed: a sane d_reclen and a NUL-terminated
+//     name that fits within it.
+//
+//   - d_off must strictly increase across the listing. This isn't required
+//     in general (ext4 hands out hashes, for example), but it holds for any
+//     file system that uses positions in a listing as offsets, as the
+//     samples in this repository do.
+//
+//   - No name may appear twice.
+//
+//   - Unless it is DT_UNKNOWN, d_type must agree with the file type reported
+//     by lstat(2) for the same name.
+//
+// This catches bugs in the dirents written by a file system (e.g. with
+// fuseutil.WriteDirent) that are papered over by higher-level interfaces.
+// The "." and ".." entries are validated but not returned.
+func ReadDirPickyRaw(dirname string) (entries []os.FileInfo, err error) {
+	// Open the directory.
+	f, err := os.Open(dirname)
+	if err != nil {
+		return nil, fmt.Errorf("Open: %v", err)
+	}
+
+	// Don't forget to close it later.
+	defer func() {
+		closeErr := f.Close()
+		if closeErr != nil && err == nil {
+			err = fmt.Errorf("Close: %v", closeErr)
+		}
+	}()
+
+	// Read all of the records from the directory.
+	types := make(map[string]uint8)
+	var names []string
+	var lastOff int64
+	var haveLastOff bool
+
+	buf := make([]byte, 8192)
+	for {
+		var n int
+		n, err = unix.Getdents(int(f.Fd()), buf)
+		if err != nil {
+			return nil, fmt.Errorf("Getdents: %v", err)
+		}
+
+		if n == 0 {
+			break
+		}
+
+		for pos := 0; pos < n; {
+			if n-pos < linuxDirent64NameOffset {
+				return nil, fmt.Errorf(
+					"Truncated dirent at offset %d of %d-byte buffer",
+					pos,
+					n)
+			}
+
+			d := (*linuxDirent64)(unsafe.Pointer(&buf[pos]))
+			reclen := int(d.Reclen)
+			if reclen <= linuxDirent64NameOffset || reclen%8 != 0 || pos+reclen > n {
+				return nil, fmt.Errorf("Bad d_reclen %d at offset %d", reclen, pos)
+			}
+
+			nameBytes := buf[pos+linuxDirent64NameOffset : pos+reclen]
+			i := bytes.IndexByte(nameBytes, 0)
+			if i <= 0 {
+				return nil, fmt.Errorf("Bad name in dirent at offset %d", pos)
+			}
+
+			name := string(nameBytes[:i])
+			pos += reclen
+
+			if haveLastOff && d.Off <= lastOff {
+				return nil, fmt.Errorf(
+					"d_off for %q is %d, not greater than previous %d",
+					name,
+					d.Off,
+					lastOff)
+			}
+
+			lastOff = d.Off
+			haveLastOff = true
+
+			if _, ok := types[name]; ok {
+				return nil, fmt.Errorf("Duplicate entry: %q", name)
+			}
+
+			types[name] = d.Type
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+		}
+	}
+
+	// Stat each one, checking its type against the one in the dirent.
+	for _, name := range names {
+		var fi os.FileInfo
+
+		fi, err = os.Lstat(path.Join(dirname, name))
+		if err != nil {
+			return nil, fmt.Errorf("Lstat(%s): %v", name, err)
+		}
+
+		if t := types[name]; t != unix.DT_UNKNOWN && t != direntType(fi.Mode()) {
+			return nil, fmt.Errorf(
+				"d_type for %q is %d, but lstat says mode %v",
+				name,
+				t,
+				fi.Mode())
+		}
+
+		entries = append(entries, fi)
+	}
+
+	// Sort the entries by name.
+	sort.Sort(sortedEntries(entries))
+
+	return entries, nil
+}
+
+// Return the d_type value that corresponds to the type bits of the supplied
+// mode.
+func direntType(m os.FileMode) uint8 {
+	switch {
+	case m&os.ModeDir != 0:
+		return unix.DT_DIR
+	case m&os.ModeSymlink != 0:
+		return unix.DT_LNK
+	case m&os.ModeNamedPipe != 0:
+		return unix.DT_FIFO
+	case m&os.ModeSocket != 0:
+		return unix.DT_SOCK
+	case m&os.ModeCharDevice != 0:
+		return unix.DT_CHR
+	case m&os.ModeDevice != 0:
+		return unix.DT_BLK
+	default:
+		return unix.DT_REG
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system whose root directory lists exactly the supplied dirents, in
+// one go. Each name looks up to an inode numbered by its position in the
+// listing, which is a directory if the name starts with "d" and a file
+// otherwise.
+type listingFS struct {
+	fuseutil.NotImplementedFileSystem
+	dirents []fuseutil.Dirent
+}
+
+func (fs *listingFS) attributes(id fuseops.InodeID) fuseops.InodeAttributes {
+	if id == fuseops.RootInodeID ||
+		strings.HasPrefix(fs.dirents[id-fuseops.RootInodeID-1].Name, "d") {
+		return fuseops.InodeAttributes{Nlink: 1, Mode: 0755 | os.ModeDir}
+	}
+
+	return fuseops.InodeAttributes{Nlink: 1, Mode: 0644}
+}
+
+func (fs *listingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fs.attributes(op.Inode)
+	return nil
+}
+
+func (fs *listingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	for i, d := range fs.dirents {
+		if d.Name == op.Name {
+			op.Entry.Child = fuseops.RootInodeID + 1 + fuseops.InodeID(i)
+			op.Entry.Attributes = fs.attributes(op.Entry.Child)
+			return nil
+		}
+	}
+
+	return fuse.ENOENT
+}
+
+func (fs *listingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (fs *listingFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	return nil
+}
+
+func (fs *listingFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if op.Offset != 0 {
+		return nil
+	}
+
+	for _, d := range fs.dirents {
+		op.BytesRead += fuseutil.WriteDirent(op.Dst[op.BytesRead:], d)
+	}
+
+	return nil
+}
+
+func (fs *listingFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	return nil
+}
+
+// Mount the supplied file system in a temporary directory for the duration
+// of the test, skipping the test if that isn't possible here.
+func mountForTest(t *testing.T, fs fuseutil.FileSystem) string {
+	dir := t.TempDir()
+	mfs, err := fuse.Mount(dir, fuseutil.NewFileSystemServer(fs), &fuse.MountConfig{})
+	if err != nil {
+		t.Skipf("Can't mount here: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if err := fuse.Unmount(dir); err != nil {
+			t.Errorf("Unmount: %v", err)
+		}
+
+		if err := mfs.Join(context.Background()); err != nil {
+			t.Errorf("Join: %v", err)
+		}
+	})
+
+	return dir
+}
+
+func TestReadDirPickyRaw(t *testing.T) {
+	testCases := []struct {
+		name    string
+		dirents []fuseutil.Dirent
+		wantErr string
+	}{
+		{
+			name: "Good",
+			dirents: []fuseutil.Dirent{
+				{Offset: 1, Inode: 2, Name: "foo", Type: fuseutil.DT_File},
+				{Offset: 2, Inode: 3, Name: "dir", Type: fuseutil.DT_Directory},
+				{Offset: 3, Inode: 4, Name: "bar", Type: fuseutil.DT_Unknown},
+			},
+		},
+		{
+			name: "NonMonotonicOffset",
+			dirents: []fuseutil.Dirent{
+				{Offset: 2, Inode: 2, Name: "foo", Type: fuseutil.DT_File},
+				{Offset: 1, Inode: 3, Name: "bar", Type: fuseutil.DT_File},
+			},
+			wantErr: `d_off for "bar" is 1, not greater than previous 2`,
+		},
+		{
+			name: "DuplicateName",
+			dirents: []fuseutil.Dirent{
+				{Offset: 1, Inode: 2, Name: "foo", Type: fuseutil.DT_File},
+				{Offset: 2, Inode: 3, Name: "foo", Type: fuseutil.DT_File},
+			},
+			wantErr: `Duplicate entry: "foo"`,
+		},
+		{
+			name: "MismatchedType",
+			dirents: []fuseutil.Dirent{
+				{Offset: 1, Inode: 2, Name: "foo", Type: fuseutil.DT_Directory},
+			},
+			wantErr: `d_type for "foo" is 4, but lstat says mode -rw-r--r--`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := mountForTest(t, &listingFS{dirents: tc.dirents})
+
+			// ReadDirPicky doesn't notice anything wrong.
+			if _, err := fusetesting.ReadDirPicky(dir); err != nil {
+				t.Fatalf("ReadDirPicky: %v", err)
+			}
+
+			entries, err := fusetesting.ReadDirPickyRaw(dir)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("ReadDirPickyRaw returned %v, want %q", err, tc.wantErr)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ReadDirPickyRaw: %v", err)
+			}
+
+			var names []string
+			for _, fi := range entries {
+				names = append(names, fi.Name())
+			}
+
+			if got, want := strings.Join(names, ","), "bar,dir,foo"; got != want {
+				t.Errorf("Got names %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusetesting
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// UserNamespaceEnv is the environment variable controlling
+// RunInUserNamespace. See its documentation for the values it may take.
+const UserNamespaceEnv = "FUSETESTING_USERNS"
+
+// The value of UserNamespaceEnv set in the re-executed test binary.
+const userNamespaceChild = "child"
+
+// InUserNamespace reports whether the current process is a test binary that
+// RunInUserNamespace re-executed in a new user namespace.
+func InUserNamespace() bool {
+	return os.Getenv(UserNamespaceEnv) == userNamespaceChild
+}
+
+// RunInUserNamespace is intended to be called from TestMain in packages whose
+// tests mount file systems:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(fusetesting.RunInUserNamespace(m))
+//	}
+//
+// Any set-up that must happen within the namespace, such as creating a
+// MountPool, can be done by passing a wrapper around m whose Run method does
+// it before calling m.Run.
+//
+// When the tests can't mount on their own, because the process is neither
+// root nor able to find fusermount(1) (as is typical in a Docker container),
+// it re-executes the test binary in a new user and mount namespace, in which
+// the binary has the CAP_SYS_ADMIN capability needed to mount and unmount
+// fuse file systems directly. The user and group IDs are mapped to
+// themselves, so files are owned by the same IDs as they would be outside the
+// namespace, and mounts are invisible outside it. It then returns the exit
+// code of the re-executed binary.
+//
+// Setting the environment variable FUSETESTING_USERNS to "1" forces the
+// re-execution, and setting it to "0" disables it. If the re-execution can't
+// be started, the tests are run in the current process instead.
+//
+// Unprivileged fuse mounts in user namespaces require Linux 4.18 or newer, a
+// kernel that permits unprivileged user namespaces, and read-write access to
+// /dev/fuse. In Docker, that usually means running with
+// --device /dev/fuse --security-opt seccomp=unconfined
+// --security-opt apparmor=unconfined, but not --privileged.
+func RunInUserNamespace(m interface{ Run() int }) int {
+	switch os.Getenv(UserNamespaceEnv) {
+	case userNamespaceChild:
+		if err := makeMountsPrivate(); err != nil {
+			fmt.Fprintf(os.Stderr, "fusetesting: %v\n", err)
+			return 1
+		}
+
+		return m.Run()
+
+	case "0":
+		return m.Run()
+
+	case "1":
+		// Re-execute regardless.
+
+	default:
+		if canMountWithoutNamespace() {
+			return m.Run()
+		}
+	}
+
+	code, err := reexecInUserNamespace()
+	if err != nil {
+		fmt.Fprintf(
+			os.Stderr,
+			"fusetesting: can't re-execute in a user namespace (%v); "+
+				"running tests in the current process\n",
+			err)
+
+		return m.Run()
+	}
+
+	return code
+}
+
+// Is the process likely able to mount fuse file systems as it stands?
+func canMountWithoutNamespace() bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if _, err := exec.LookPath(name); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run the current binary with the same arguments in a new user and mount
+// namespace, returning its exit code.
+func reexecInUserNamespace() (int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("Executable: %v", err)
+	}
+
+	uid := os.Getuid()
+	gid := os.Getgid()
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), UserNamespaceEnv+"="+userNamespaceChild)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: uid, HostID: uid, Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: gid, HostID: gid, Size: 1},
+		},
+
+		// The IDs aren't root within the namespace, so the capability the
+		// namespace grants must be kept explicitly across exec.
+		AmbientCaps: []uintptr{unix.CAP_SYS_ADMIN},
+	}
+
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	// Once the binary has started, its failures are the tests' failures.
+	err = cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode(), nil
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fusetesting: Wait: %v\n", err)
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// Stop mounts made within the namespace from propagating back to the mount
+// namespace it was copied from.
+func makeMountsPrivate() error {
+	err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, "")
+	if err != nil {
+		return fmt.Errorf("Making mounts private: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,416 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// NewAttributeCachingFileSystem wraps the supplied file system, answering
+// GetInodeAttributesOp itself with the attributes most recently returned for
+// the inode by any op, for up to ttl after they were returned. This takes the
+// most frequent metadata op off of file systems whose attributes are
+// expensive to compute or fetch, without lengthening the kernel's own
+// caching.
+//
+// It is only correct for file systems whose attributes change solely through
+// ops on the mount, since it can't know about other changes. Cached
+// attributes are dropped for the inodes an op may modify, for example on
+// WriteFileOp or an OpenFileOp that truncates, and entirely for ops that may modify inodes they don't name,
+// such as RenameOp and UnlinkOp. They are also dropped when the kernel
+// forgets an inode.
+//
+// The expiration time handed to the kernel along with cached attributes is
+// the one the file system returned with them.
+func NewAttributeCachingFileSystem(
+	wrapped FileSystem,
+	ttl time.Duration,
+	clock timeutil.Clock) FileSystem {
+	return &attributeCachingFS{
+		FileSystem: wrapped,
+		ttl:        ttl,
+		clock:      clock,
+		attrs:      make(map[fuseops.InodeID]cachedAttributes),
+	}
+}
+
+type cachedAttributes struct {
+	attributes fuseops.InodeAttributes
+
+	// The expiration time handed to the kernel.
+	kernelExpiration time.Time
+
+	// The time after which the entry must not be used.
+	expiration time.Time
+}
+
+type attributeCachingFS struct {
+	FileSystem
+
+	ttl   time.Duration
+	clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	attrs map[fuseops.InodeID]cachedAttributes
+
+	// Incremented whenever cached attributes are dropped, so that attributes
+	// fetched concurrently with a change aren't cached afterward.
+	//
+	// GUARDED_BY(mu)
+	generation uint64
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) currentGeneration() uint64 {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.generation
+}
+
+// Cache attributes returned by an op that started at the given generation,
+// unless something has been dropped since.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) store(
+	generation uint64,
+	inode fuseops.InodeID,
+	attributes *fuseops.InodeAttributes,
+	kernelExpiration time.Time) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if generation != fs.generation {
+		return
+	}
+
+	fs.attrs[inode] = cachedAttributes{
+		attributes:       *attributes,
+		kernelExpiration: kernelExpiration,
+		expiration:       fs.clock.Now().Add(fs.ttl),
+	}
+}
+
+// Like store, for an op that returns a ChildInodeEntry.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) storeEntry(
+	generation uint64,
+	e *fuseops.ChildInodeEntry) {
+	if e.Child == 0 {
+		return
+	}
+
+	fs.store(generation, e.Child, &e.Attributes, e.AttributesExpiration)
+}
+
+// Drop the cached attributes for the given inodes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) drop(inodes ...fuseops.InodeID) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.generation++
+	for _, inode := range inodes {
+		delete(fs.attrs, inode)
+	}
+}
+
+// Drop all cached attributes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) dropAll() {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.generation++
+	fs.attrs = make(map[fuseops.InodeID]cachedAttributes)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops answered from the cache
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	c, ok := fs.attrs[op.Inode]
+	generation := fs.generation
+	fs.mu.Unlock()
+
+	if ok && fs.clock.Now().Before(c.expiration) {
+		op.Attributes = c.attributes
+		op.AttributesExpiration = c.kernelExpiration
+		return nil
+	}
+
+	err := fs.FileSystem.GetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.store(generation, op.Inode, &op.Attributes, op.AttributesExpiration)
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that return attributes
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.LookUpInode(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	fs.drop(op.Inode)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	if err == nil {
+		fs.store(generation, op.Inode, &op.Attributes, op.AttributesExpiration)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.drop(op.Parent)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.MkDir(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.drop(op.Parent)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.MkNode(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.drop(op.Parent)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.CreateFile(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	fs.drop(op.Parent)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.CreateSymlink(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	fs.drop(op.Parent, op.Target)
+
+	generation := fs.currentGeneration()
+	err := fs.FileSystem.CreateLink(ctx, op)
+	if err == nil {
+		fs.storeEntry(generation, &op.Entry)
+	}
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that modify attributes
+////////////////////////////////////////////////////////////////////////
+
+// Attributes are dropped both before and after the wrapped file system
+// handles these, so that attributes fetched while the op is in progress
+// aren't cached.
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	fs.dropAll()
+	defer fs.dropAll()
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	fs.dropAll()
+	defer fs.dropAll()
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.dropAll()
+	defer fs.dropAll()
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+// With fuse.MountConfig.EnableAtomicTrunc, opening with O_TRUNC truncates the
+// file.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !op.OpenFlags.IsTruncate() {
+		return fs.FileSystem.OpenFile(ctx, op)
+	}
+
+	fs.drop(op.Inode)
+	defer fs.drop(op.Inode)
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.drop(op.Inode)
+	defer fs.drop(op.Inode)
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fs.drop(op.Inode)
+	defer fs.drop(op.Inode)
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.drop(op.DstInode)
+	defer fs.drop(op.DstInode)
+
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.drop(op.Inode)
+	defer fs.drop(op.Inode)
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	fs.drop(op.Inode)
+	defer fs.drop(op.Inode)
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Forgetting
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.drop(op.Inode)
+	return fs.FileSystem.ForgetInode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *attributeCachingFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	inodes := make([]fuseops.InodeID, len(op.Entries))
+	for i, e := range op.Entries {
+		inodes[i] = e.Inode
+	}
+
+	fs.drop(inodes...)
+	return fs.FileSystem.BatchForget(ctx, op)
+}
+
+func (fs *attributeCachingFS) OpInterrupted(ctx context.Context, op interface{}) {
+	opInterrupted(fs.FileSystem, ctx, op)
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system whose single file's size is the number of GetInodeAttributes
+// calls it has seen.
+type countingFS struct {
+	fuseutil.NotImplementedFileSystem
+	calls uint64
+}
+
+func (fs *countingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.calls++
+	op.Attributes = fuseops.InodeAttributes{Size: fs.calls}
+	return nil
+}
+
+func (fs *countingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	return nil
+}
+
+func (fs *countingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	return nil
+}
+
+func (fs *countingFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func TestAttributeCachingFileSystem(t *testing.T) {
+	ctx := context.Background()
+
+	var clock timeutil.SimulatedClock
+	clock.SetTime(time.Date(2015, 4, 5, 2, 15, 0, 0, time.Local))
+
+	wrapped := &countingFS{}
+	fs := fuseutil.NewAttributeCachingFileSystem(wrapped, time.Minute, &clock)
+
+	getSize := func() uint64 {
+		op := &fuseops.GetInodeAttributesOp{Inode: 2}
+		if err := fs.GetInodeAttributes(ctx, op); err != nil {
+			t.Fatalf("GetInodeAttributes: %v", err)
+		}
+
+		return op.Attributes.Size
+	}
+
+	check := func(desc string, want uint64) {
+		t.Helper()
+		if got := getSize(); got != want {
+			t.Errorf("%s: got size %d, want %d", desc, got, want)
+		}
+	}
+
+	check("first call", 1)
+	check("within TTL", 1)
+
+	clock.AdvanceTime(time.Minute)
+	check("after TTL", 2)
+	check("within new TTL", 2)
+
+	if err := fs.WriteFile(ctx, &fuseops.WriteFileOp{Inode: 2}); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	check("after write", 3)
+
+	if err := fs.ForgetInode(ctx, &fuseops.ForgetInodeOp{Inode: 2, N: 1}); err != nil {
+		t.Fatalf("ForgetInode: %v", err)
+	}
+
+	check("after forget", 4)
+
+	open := func(op *fuseops.OpenFileOp) {
+		t.Helper()
+		if err := fs.OpenFile(ctx, op); err != nil {
+			t.Fatalf("OpenFile: %v", err)
+		}
+	}
+
+	open(&fuseops.OpenFileOp{Inode: 2, OpenFlags: syscall.O_RDWR})
+	check("after open", 4)
+
+	open(&fuseops.OpenFileOp{Inode: 2, OpenFlags: syscall.O_RDWR | syscall.O_TRUNC})
+	check("after truncating open", 5)
+}
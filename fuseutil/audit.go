@@ -0,0 +1,303 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A record of a security-relevant op, emitted by a file system created with
+// NewAuditingFileSystem.
+type AuditRecord struct {
+	// The time at which the op finished.
+	Time time.Time
+
+	// The caller, as described by fuseops.OpContext.
+	Uid uint32
+	Pid uint32
+
+	// The name of the FileSystem method that handled the op, e.g. "Unlink".
+	Op string
+
+	// The inode the op acted on, or for ops that name a child, the parent
+	// directory and the child's name within it. Xattr ops put the name of the
+	// attribute in Name.
+	Inode fuseops.InodeID
+	Name  string
+
+	// For RenameOp, the new parent directory and name. Zero otherwise.
+	NewParent fuseops.InodeID
+	NewName   string
+
+	// A human-readable description of the op's arguments that aren't
+	// captured above, such as open flags or the attributes being set. Empty
+	// if there are none.
+	Detail string
+
+	// The error returned by the wrapped file system, or nil on success.
+	Err error
+}
+
+// A destination for audit records. Audit is called once the op has been
+// handled by the wrapped file system but before the kernel is replied to,
+// and may be called concurrently from many goroutines.
+type AuditSink interface {
+	Audit(r AuditRecord)
+}
+
+// NewJSONAuditSink returns a sink that writes each record to w as a JSON
+// object on its own line. Write errors are ignored, since there's nobody to
+// report them to; sinks that must not lose records should implement
+// AuditSink themselves.
+func NewJSONAuditSink(w io.Writer) AuditSink {
+	return &jsonAuditSink{w: w}
+}
+
+type jsonAuditSink struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	w io.Writer
+}
+
+// The encoding of an AuditRecord. Errors are encoded by their text, since
+// they rarely marshal usefully themselves.
+type jsonAuditRecord struct {
+	Time      time.Time       `json:"time"`
+	Uid       uint32          `json:"uid"`
+	Pid       uint32          `json:"pid"`
+	Op        string          `json:"op"`
+	Inode     fuseops.InodeID `json:"inode"`
+	Name      string          `json:"name,omitempty"`
+	NewParent fuseops.InodeID `json:"new_parent,omitempty"`
+	NewName   string          `json:"new_name,omitempty"`
+	Detail    string          `json:"detail,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// LOCKS_EXCLUDED(s.mu)
+func (s *jsonAuditSink) Audit(r AuditRecord) {
+	jr := jsonAuditRecord{
+		Time:      r.Time,
+		Uid:       r.Uid,
+		Pid:       r.Pid,
+		Op:        r.Op,
+		Inode:     r.Inode,
+		Name:      r.Name,
+		NewParent: r.NewParent,
+		NewName:   r.NewName,
+		Detail:    r.Detail,
+	}
+
+	if r.Err != nil {
+		jr.Error = r.Err.Error()
+	}
+
+	b, err := json.Marshal(jr)
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.w.Write(append(b, '\n'))
+}
+
+// NewAuditingFileSystem wraps the supplied file system, emitting a record to
+// the supplied sink for every security-relevant op: opening and creating
+// files, unlinking files and removing directories, renaming, setting inode
+// attributes, and setting and removing extended attributes. Records are
+// emitted whether or not the op succeeds.
+//
+// Since the wrapper only sees inode IDs and names, records don't contain
+// paths; a file system that can resolve its inodes to paths may do so in its
+// sink. Ops issued by the kernel itself rather than on behalf of a process
+// have a zero Pid.
+func NewAuditingFileSystem(wrapped FileSystem, sink AuditSink) FileSystem {
+	return &auditingFS{
+		FileSystem: wrapped,
+		sink:       sink,
+	}
+}
+
+type auditingFS struct {
+	FileSystem
+	sink AuditSink
+}
+
+// Emit a record for an op with the given context, filling in the fields that
+// all records share.
+func (fs *auditingFS) audit(oc *fuseops.OpContext, r AuditRecord, err error) {
+	r.Time = time.Now()
+	r.Uid = oc.Uid
+	r.Pid = oc.Pid
+	r.Err = err
+	fs.sink.Audit(r)
+}
+
+// Describe the attributes set by a SetInodeAttributesOp.
+func describeSetAttributes(op *fuseops.SetInodeAttributesOp) string {
+	var parts []string
+	if op.Size != nil {
+		parts = append(parts, fmt.Sprintf("size=%d", *op.Size))
+	}
+
+	if op.Mode != nil {
+		parts = append(parts, fmt.Sprintf("mode=%v", *op.Mode))
+	}
+
+	if op.Uid != nil {
+		parts = append(parts, fmt.Sprintf("uid=%d", *op.Uid))
+	}
+
+	if op.Gid != nil {
+		parts = append(parts, fmt.Sprintf("gid=%d", *op.Gid))
+	}
+
+	if op.Atime != nil {
+		parts = append(parts, "atime="+op.Atime.Format(time.RFC3339Nano))
+	}
+
+	if op.Mtime != nil {
+		parts = append(parts, "mtime="+op.Mtime.Format(time.RFC3339Nano))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Audited ops
+////////////////////////////////////////////////////////////////////////
+
+func (fs *auditingFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	err := fs.FileSystem.OpenFile(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:     "OpenFile",
+		Inode:  op.Inode,
+		Detail: fmt.Sprintf("flags=%v", op.OpenFlags),
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	err := fs.FileSystem.CreateFile(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:     "CreateFile",
+		Inode:  op.Parent,
+		Name:   op.Name,
+		Detail: fmt.Sprintf("mode=%v", op.Mode),
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	err := fs.FileSystem.Unlink(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:    "Unlink",
+		Inode: op.Parent,
+		Name:  op.Name,
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	err := fs.FileSystem.RmDir(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:    "RmDir",
+		Inode: op.Parent,
+		Name:  op.Name,
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	err := fs.FileSystem.Rename(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:        "Rename",
+		Inode:     op.OldParent,
+		Name:      op.OldName,
+		NewParent: op.NewParent,
+		NewName:   op.NewName,
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	err := fs.FileSystem.SetInodeAttributes(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:     "SetInodeAttributes",
+		Inode:  op.Inode,
+		Detail: describeSetAttributes(op),
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	err := fs.FileSystem.SetXattr(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:     "SetXattr",
+		Inode:  op.Inode,
+		Name:   op.Name,
+		Detail: fmt.Sprintf("size=%d flags=%#x", len(op.Value), op.Flags),
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	err := fs.FileSystem.RemoveXattr(ctx, op)
+	fs.audit(&op.OpContext, AuditRecord{
+		Op:    "RemoveXattr",
+		Inode: op.Inode,
+		Name:  op.Name,
+	}, err)
+
+	return err
+}
+
+func (fs *auditingFS) OpInterrupted(ctx context.Context, op interface{}) {
+	opInterrupted(fs.FileSystem, ctx, op)
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system in which renames succeed and nothing can be unlinked.
+type renameOnlyFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *renameOnlyFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return nil
+}
+
+func (fs *renameOnlyFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return fuse.ENOENT
+}
+
+func TestAuditingFileSystem(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	fs := fuseutil.NewAuditingFileSystem(
+		&renameOnlyFS{},
+		fuseutil.NewJSONAuditSink(&buf))
+
+	oc := fuseops.OpContext{Uid: 1000, Pid: 17}
+
+	// Ops that aren't security-relevant aren't audited.
+	fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{Parent: 1, Name: "foo"})
+
+	err := fs.Rename(ctx, &fuseops.RenameOp{
+		OldParent: 1,
+		OldName:   "foo",
+		NewParent: 2,
+		NewName:   "bar",
+		OpContext: oc,
+	})
+
+	if err != nil {
+		t.Fatalf("Rename: %v", err)
+	}
+
+	err = fs.Unlink(ctx, &fuseops.UnlinkOp{
+		Parent:    2,
+		Name:      "baz",
+		OpContext: oc,
+	})
+
+	if err != fuse.ENOENT {
+		t.Fatalf("Unlink: got error %v, want ENOENT", err)
+	}
+
+	// The wrapped file system doesn't implement this, but it is still audited.
+	mode := os.FileMode(0600)
+	fs.SetInodeAttributes(ctx, &fuseops.SetInodeAttributesOp{
+		Inode:     3,
+		Mode:      &mode,
+		OpContext: oc,
+	})
+
+	type record struct {
+		Uid       uint32          `json:"uid"`
+		Pid       uint32          `json:"pid"`
+		Op        string          `json:"op"`
+		Inode     fuseops.InodeID `json:"inode"`
+		Name      string          `json:"name"`
+		NewParent fuseops.InodeID `json:"new_parent"`
+		NewName   string          `json:"new_name"`
+		Detail    string          `json:"detail"`
+		Error     string          `json:"error"`
+	}
+
+	want := []record{
+		{1000, 17, "Rename", 1, "foo", 2, "bar", "", ""},
+		{1000, 17, "Unlink", 2, "baz", 0, "", "", fuse.ENOENT.Error()},
+		{1000, 17, "SetInodeAttributes", 3, "", 0, "", "mode=-rw-------", fuse.ENOSYS.Error()},
+	}
+
+	dec := json.NewDecoder(&buf)
+	for i, w := range want {
+		var got record
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("Decoding record %d: %v", i, err)
+		}
+
+		if got != w {
+			t.Errorf("Record %d: got %+v, want %+v", i, got, w)
+		}
+	}
+
+	if dec.More() {
+		t.Errorf("Unexpected trailing records")
+	}
+}
@@ -19,6 +19,8 @@ import (
 	"unsafe"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/direntplus"
+	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
 type DirentType uint32
@@ -103,3 +105,64 @@ func WriteDirent(buf []byte, d Dirent) (n int) {
 
 	return n
 }
+
+// A directory entry along with the attributes of its child, for
+// fuseops.ReadDirPlusOp. See notes on WriteDirentPlus.
+type DirentPlus struct {
+	Dirent Dirent
+
+	// The child's entry, as a LookUpInodeOp for Dirent.Name would fill it in.
+	// Leave Entry.Child zero to list the name without the kernel looking it
+	// up, in which case the rest of Entry is ignored. Entry.Data is always
+	// ignored.
+	Entry fuseops.ChildInodeEntry
+}
+
+// Write the supplied directory entry into the given buffer in the format
+// expected in fuseops.ReadDirPlusOp.Dst, returning the number of bytes
+// written. Return zero if the entry would not fit.
+//
+// The child's entry is converted for the kernel when the op is replied to, so
+// that its expiration times are measured against fuse.MountConfig.Clock. Until
+// then only its inode ID is in the layout that the kernel expects.
+func WriteDirentPlus(buf []byte, d DirentPlus) (n int) {
+	// The layout is that of fuse_direntplus: a fuse_entry_out followed by a
+	// fuse_dirent, with the same alignment as for WriteDirent.
+	const direntAlignment = 8
+
+	var padLen int
+	if len(d.Dirent.Name)%direntAlignment != 0 {
+		padLen = direntAlignment - (len(d.Dirent.Name) % direntAlignment)
+	}
+
+	totalLen := fusekernel.DirentPlusSize + len(d.Dirent.Name) + padLen
+	if totalLen > len(buf) {
+		return n
+	}
+
+	// Write the header.
+	var de fusekernel.DirentPlus
+	if d.Entry.Child != 0 {
+		*(*direntplus.Entry)(unsafe.Pointer(&de.Entry)) = direntplus.Encode(&d.Entry)
+	}
+
+	de.Dirent = fusekernel.Dirent{
+		Ino:     uint64(d.Dirent.Inode),
+		Off:     uint64(d.Dirent.Offset),
+		Namelen: uint32(len(d.Dirent.Name)),
+		Type:    uint32(d.Dirent.Type),
+	}
+
+	n += copy(buf[n:], unsafe.Slice((*byte)(unsafe.Pointer(&de)), fusekernel.DirentPlusSize))
+
+	// Write the name afterward.
+	n += copy(buf[n:], d.Dirent.Name)
+
+	// Add any necessary padding.
+	if padLen != 0 {
+		var padding [direntAlignment]byte
+		n += copy(buf[n:], padding[:padLen])
+	}
+
+	return n
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A DirentSink fills in the reply to a ReadDirOp or ReadDirPlusOp with
+// entries added one at a time, taking care of the offsets and of the size of
+// the reply, so that ReadDir implementations need neither slice Dst nor
+// compute BytesRead themselves:
+//
+//	func (fs *myFS) ReadDir(ctx context.Context, op *fuseops.ReadDirOp) error {
+//		sink := fuseutil.NewReadDirSink(op)
+//		for _, c := range fs.children(op.Inode) {
+//			if !sink.Add(fuseutil.Dirent{Inode: c.id, Name: c.name, Type: c.typ}) {
+//				break
+//			}
+//		}
+//
+//		return nil
+//	}
+//
+// The file system adds every entry of the directory, from the first, in an
+// order that is stable between calls. Each entry's offset is its position in
+// that order, so the sink discards the entries that the kernel has already
+// read (see Skip to avoid listing them), and Add returns false once the reply
+// is full, after which the rest may be skipped. The Offset fields of the entries added are ignored. File
+// systems listing from a backend cursor that can resume at an offset should
+// use ServeReadDir instead.
+type DirentSink struct {
+	dst       []byte
+	bytesRead *int
+	plus      bool
+
+	// The offset of the op, and the position of the next entry to be added.
+	start fuseops.DirOffset
+	next  fuseops.DirOffset
+
+	// Once an entry doesn't fit, no later ones may be written either, even if
+	// they are smaller.
+	full bool
+}
+
+// NewReadDirSink returns a sink that fills in the reply to op.
+func NewReadDirSink(op *fuseops.ReadDirOp) *DirentSink {
+	op.BytesRead = 0
+	return &DirentSink{
+		dst:       op.Dst,
+		bytesRead: &op.BytesRead,
+		start:     op.Offset,
+	}
+}
+
+// NewReadDirPlusSink returns a sink that fills in the reply to op.
+func NewReadDirPlusSink(op *fuseops.ReadDirPlusOp) *DirentSink {
+	op.BytesRead = 0
+	return &DirentSink{
+		dst:       op.Dst,
+		bytesRead: &op.BytesRead,
+		plus:      true,
+		start:     op.Offset,
+	}
+}
+
+// Add adds the next entry of the directory. For a ReadDirPlusOp, the kernel
+// looks the name up itself when it needs the child's attributes. It returns
+// false if the reply is full and the entry didn't make it into it.
+func (s *DirentSink) Add(d Dirent) bool {
+	return s.AddPlus(DirentPlus{Dirent: d})
+}
+
+// AddPlus is like Add, but supplies the child's entry as well, for a
+// ReadDirPlusOp. For a ReadDirOp, the entry is ignored.
+func (s *DirentSink) AddPlus(d DirentPlus) bool {
+	if s.full {
+		return false
+	}
+
+	s.next++
+	if s.next <= s.start {
+		return true
+	}
+
+	d.Dirent.Offset = s.next
+
+	var n int
+	if s.plus {
+		n = WriteDirentPlus(s.dst[*s.bytesRead:], d)
+	} else {
+		n = WriteDirent(s.dst[*s.bytesRead:], d.Dirent)
+	}
+
+	if n == 0 {
+		s.full = true
+		return false
+	}
+
+	*s.bytesRead += n
+	return true
+}
+
+// Full reports whether an entry has failed to fit, so that no more will be
+// added.
+func (s *DirentSink) Full() bool {
+	return s.full
+}
+
+// Skip returns the number of entries that the kernel has already read, and
+// counts them as added, for file systems that can start their listing after
+// them rather than adding them only for the sink to discard them. It must be
+// called before anything is added.
+func (s *DirentSink) Skip() int {
+	n := int(s.start - s.next)
+	s.next = s.start
+	return n
+}
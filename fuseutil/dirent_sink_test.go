@@ -0,0 +1,104 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestDirentSink(t *testing.T) {
+	var entries []string
+	for i := 0; i < 100; i++ {
+		entries = append(entries, strings.Repeat("x", i%13)+fmt.Sprint(i))
+	}
+
+	// Read the directory in small pieces, as the kernel would, with a listing
+	// that starts from the beginning each time, or skips what it can.
+	for _, skip := range []bool{false, true} {
+		var names []string
+		var offset fuseops.DirOffset
+		for {
+			op := &fuseops.ReadDirOp{
+				Offset: offset,
+				Dst:    make([]byte, 200),
+			}
+
+			sink := fuseutil.NewReadDirSink(op)
+			start := 0
+			if skip {
+				start = sink.Skip()
+			}
+
+			for i := start; i < len(entries); i++ {
+				d := fuseutil.Dirent{Inode: fuseops.InodeID(i + 2), Name: entries[i]}
+				if !sink.Add(d) {
+					if !sink.Full() {
+						t.Fatal("Add failed but sink not full")
+					}
+
+					break
+				}
+			}
+
+			if op.BytesRead == 0 {
+				break
+			}
+
+			got, offsets := parseDirents(op.Dst[:op.BytesRead])
+			for i, off := range offsets {
+				if want := offset + fuseops.DirOffset(i+1); off != want {
+					t.Fatalf("Offset of %q: got %d, want %d", got[i], off, want)
+				}
+			}
+
+			names = append(names, got...)
+			offset = offsets[len(offsets)-1]
+		}
+
+		if !reflect.DeepEqual(names, entries) {
+			t.Errorf("skip=%v: got %q", skip, names)
+		}
+	}
+}
+
+func TestDirentSinkPlus(t *testing.T) {
+	op := &fuseops.ReadDirPlusOp{Dst: make([]byte, 4096)}
+	sink := fuseutil.NewReadDirPlusSink(op)
+
+	sink.Add(fuseutil.Dirent{Inode: 2, Name: "foo"})
+	sink.AddPlus(fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{Inode: 3, Name: "bar"},
+		Entry:  fuseops.ChildInodeEntry{Child: 3},
+	})
+
+	want := make([]byte, 4096)
+	n := fuseutil.WriteDirentPlus(want, fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{Offset: 1, Inode: 2, Name: "foo"},
+	})
+	n += fuseutil.WriteDirentPlus(want[n:], fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{Offset: 2, Inode: 3, Name: "bar"},
+		Entry:  fuseops.ChildInodeEntry{Child: 3},
+	})
+
+	if op.BytesRead != n || !reflect.DeepEqual(op.Dst[:n], want[:n]) {
+		t.Errorf("Got %d bytes %x, want %d bytes %x", op.BytesRead, op.Dst[:op.BytesRead], n, want[:n])
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system consisting of an empty root directory, implementing only the
+// methods it needs and leaving the rest to NotImplementedFileSystem.
+type emptyFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *emptyFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if op.Inode != fuseops.RootInodeID {
+		return fuse.ENOENT
+	}
+
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0555 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func (fs *emptyFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fuse.ENOENT
+}
+
+func ExampleNewFileSystemServer() {
+	server := fuseutil.NewFileSystemServer(&emptyFS{})
+
+	// Serve the file system to a fake kernel rather than mounting it with
+	// fuse.Mount, so that this runs without privileges.
+	k, err := fusetesting.NewFakeKernel(server, nil, &fusetesting.FakeKernelConfig{})
+	if err != nil {
+		log.Fatalf("NewFakeKernel: %v", err)
+	}
+	defer k.Close()
+
+	attrs, err := k.Stat("/")
+	if err != nil {
+		log.Fatalf("Stat: %v", err)
+	}
+
+	fmt.Println(attrs.Mode)
+
+	_, err = k.Stat("foo")
+	fmt.Println(err == fuse.ENOENT)
+
+	// Output:
+	// dr-xr-xr-x
+	// true
+}
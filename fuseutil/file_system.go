@@ -16,8 +16,8 @@ package fuseutil
 
 import (
 	"context"
-	"io"
 	"sync"
+	"time"
 
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/fuse/fuseops"
@@ -38,6 +38,7 @@ type FileSystem interface {
 	LookUpInode(context.Context, *fuseops.LookUpInodeOp) error
 	GetInodeAttributes(context.Context, *fuseops.GetInodeAttributesOp) error
 	SetInodeAttributes(context.Context, *fuseops.SetInodeAttributesOp) error
+	Access(context.Context, *fuseops.AccessOp) error
 	ForgetInode(context.Context, *fuseops.ForgetInodeOp) error
 	BatchForget(context.Context, *fuseops.BatchForgetOp) error
 	MkDir(context.Context, *fuseops.MkDirOp) error
@@ -50,6 +51,8 @@ type FileSystem interface {
 	Unlink(context.Context, *fuseops.UnlinkOp) error
 	OpenDir(context.Context, *fuseops.OpenDirOp) error
 	ReadDir(context.Context, *fuseops.ReadDirOp) error
+	ReadDirPlus(context.Context, *fuseops.ReadDirPlusOp) error
+	SyncDir(context.Context, *fuseops.SyncDirOp) error
 	ReleaseDirHandle(context.Context, *fuseops.ReleaseDirHandleOp) error
 	OpenFile(context.Context, *fuseops.OpenFileOp) error
 	ReadFile(context.Context, *fuseops.ReadFileOp) error
@@ -63,6 +66,13 @@ type FileSystem interface {
 	ListXattr(context.Context, *fuseops.ListXattrOp) error
 	SetXattr(context.Context, *fuseops.SetXattrOp) error
 	Fallocate(context.Context, *fuseops.FallocateOp) error
+	Seek(context.Context, *fuseops.SeekOp) error
+	CopyFileRange(context.Context, *fuseops.CopyFileRangeOp) error
+	GetLock(context.Context, *fuseops.GetLockOp) error
+	SetLock(context.Context, *fuseops.SetLockOp) error
+	Flock(context.Context, *fuseops.FlockOp) error
+	Ioctl(context.Context, *fuseops.IoctlOp) error
+	Poll(context.Context, *fuseops.PollOp) error
 	SyncFS(context.Context, *fuseops.SyncFSOp) error
 
 	// Regard all inodes (including the root inode) as having their lookup counts
@@ -71,6 +81,26 @@ type FileSystem interface {
 	Destroy()
 }
 
+// InterruptObserver may be implemented by a FileSystem that wants to be told
+// when the kernel interrupts one of its ops, rather than only seeing the op's
+// context cancelled, for example to cancel a request to a backend that doesn't
+// take a context. The server arranges for OpInterrupted to be called as
+// described for fuse.Connection.SetInterruptHandler: on the goroutine reading
+// ops, so it must not block, and just before the op's context is cancelled.
+//
+// The wrappers in this package forward OpInterrupted to the file systems they
+// wrap.
+type InterruptObserver interface {
+	OpInterrupted(ctx context.Context, op interface{})
+}
+
+// Forward an interrupt to fs, if it wants to know.
+func opInterrupted(fs FileSystem, ctx context.Context, op interface{}) {
+	if o, ok := fs.(InterruptObserver); ok {
+		o.OpInterrupted(ctx, op)
+	}
+}
+
 // Create a fuse.Server that handles ops by calling the associated FileSystem
 // method.Respond with the resulting error. Unsupported ops are responded to
 // directly with ENOSYS.
@@ -84,15 +114,35 @@ type FileSystem interface {
 // guarantees to serialize operations that the user expects to happen in order,
 // cf. https://tinyurl.com/bddm85v5, fuse-devel thread "Fuse guarantees on
 // concurrent requests").
+//
+// If --fuseutil.random_delays is set, ops are randomly delayed and reordered
+// as described for NewFileSystemServerWithDelays.
 func NewFileSystemServer(fs FileSystem) fuse.Server {
-	return &fileSystemServer{
-		fs: fs,
+	return NewFileSystemServerWithDelays(fs, newRandomDelaySchedulerFromFlags())
+}
+
+// Like NewFileSystemServer, but each op is held back according to the
+// supplied scheduler before being dispatched to the file system. The
+// scheduler may be nil, in which case ops are dispatched immediately.
+func NewFileSystemServerWithDelays(
+	fs FileSystem,
+	delays *RandomDelayScheduler) fuse.Server {
+	s := &fileSystemServer{
+		fs:     fs,
+		delays: delays,
 	}
+
+	s.handler = s.dispatch
+	return s
 }
 
 type fileSystemServer struct {
 	fs          FileSystem
+	delays      *RandomDelayScheduler
 	opsInFlight sync.WaitGroup
+
+	// Handles each op: dispatch, possibly wrapped in interceptors.
+	handler OpHandler
 }
 
 func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
@@ -103,25 +153,38 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 		s.fs.Destroy()
 	}()
 
+	if o, ok := s.fs.(InterruptObserver); ok {
+		c.SetInterruptHandler(o.OpInterrupted)
+	}
+
 	for {
+		// Stop at the first error. Join reports anything other than the kernel
+		// hanging up.
 		ctx, op, err := c.ReadOp()
-		if err == io.EOF {
+		if err != nil {
 			break
 		}
 
-		if err != nil {
-			panic(err)
+		_, isForget := op.(*fuseops.ForgetInodeOp)
+
+		// Decide on any delay now, while ops are still in the order the kernel
+		// sent them, so that the schedule is reproducible. Forget ops are
+		// handled inline below, so holding them back for reordering would only
+		// stall the loop.
+		var ticket delayTicket
+		if s.delays != nil {
+			ticket = s.delays.schedule(!isForget)
 		}
 
 		s.opsInFlight.Add(1)
-		if _, ok := op.(*fuseops.ForgetInodeOp); ok {
+		if isForget {
 			// Special case: call in this goroutine for
 			// forget inode ops, which may come in a
 			// flurry from the kernel and are generally
 			// cheap for the file system to handle
-			s.handleOp(c, ctx, op)
+			s.handleOp(c, ctx, op, ticket)
 		} else {
-			go s.handleOp(c, ctx, op)
+			go s.handleOp(c, ctx, op, ticket)
 		}
 	}
 }
@@ -129,11 +192,25 @@ func (s *fileSystemServer) ServeOps(c *fuse.Connection) {
 func (s *fileSystemServer) handleOp(
 	c *fuse.Connection,
 	ctx context.Context,
-	op interface{}) {
+	op interface{},
+	ticket delayTicket) {
 	defer s.opsInFlight.Done()
+	defer c.DumpOpJournalOnPanic()
+
+	// Delay the op if we've been asked to.
+	ticket.wait()
 
-	// Dispatch to the appropriate method.
-	var err error
+	if oc := opContext(op); oc != nil {
+		oc.DispatchTime = time.Now()
+	}
+
+	c.Reply(ctx, s.handler(ctx, op))
+}
+
+// Dispatch the op to the appropriate method.
+func (s *fileSystemServer) dispatch(
+	ctx context.Context,
+	op interface{}) (err error) {
 	switch typed := op.(type) {
 	default:
 		err = fuse.ENOSYS
@@ -150,6 +227,9 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.SetInodeAttributesOp:
 		err = s.fs.SetInodeAttributes(ctx, typed)
 
+	case *fuseops.AccessOp:
+		err = s.fs.Access(ctx, typed)
+
 	case *fuseops.ForgetInodeOp:
 		err = s.fs.ForgetInode(ctx, typed)
 
@@ -199,6 +279,12 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.ReadDirOp:
 		err = s.fs.ReadDir(ctx, typed)
 
+	case *fuseops.ReadDirPlusOp:
+		err = s.fs.ReadDirPlus(ctx, typed)
+
+	case *fuseops.SyncDirOp:
+		err = s.fs.SyncDir(ctx, typed)
+
 	case *fuseops.ReleaseDirHandleOp:
 		err = s.fs.ReleaseDirHandle(ctx, typed)
 
@@ -238,9 +324,154 @@ func (s *fileSystemServer) handleOp(
 	case *fuseops.FallocateOp:
 		err = s.fs.Fallocate(ctx, typed)
 
+	case *fuseops.SeekOp:
+		err = s.fs.Seek(ctx, typed)
+
+	case *fuseops.CopyFileRangeOp:
+		err = s.fs.CopyFileRange(ctx, typed)
+
+	case *fuseops.GetLockOp:
+		err = s.fs.GetLock(ctx, typed)
+
+	case *fuseops.SetLockOp:
+		err = s.fs.SetLock(ctx, typed)
+
+	case *fuseops.FlockOp:
+		err = s.fs.Flock(ctx, typed)
+
+	case *fuseops.IoctlOp:
+		err = s.fs.Ioctl(ctx, typed)
+
+	case *fuseops.PollOp:
+		err = s.fs.Poll(ctx, typed)
+
 	case *fuseops.SyncFSOp:
 		err = s.fs.SyncFS(ctx, typed)
 	}
 
-	c.Reply(ctx, err)
+	return err
+}
+
+// Return a pointer to the op's OpContext field, or nil if it has none.
+func opContext(op interface{}) *fuseops.OpContext {
+	switch typed := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return &typed.OpContext
+
+	case *fuseops.GetInodeAttributesOp:
+		return &typed.OpContext
+
+	case *fuseops.SetInodeAttributesOp:
+		return &typed.OpContext
+
+	case *fuseops.AccessOp:
+		return &typed.OpContext
+
+	case *fuseops.ForgetInodeOp:
+		return &typed.OpContext
+
+	case *fuseops.BatchForgetOp:
+		return &typed.OpContext
+
+	case *fuseops.MkDirOp:
+		return &typed.OpContext
+
+	case *fuseops.MkNodeOp:
+		return &typed.OpContext
+
+	case *fuseops.CreateFileOp:
+		return &typed.OpContext
+
+	case *fuseops.CreateSymlinkOp:
+		return &typed.OpContext
+
+	case *fuseops.CreateLinkOp:
+		return &typed.OpContext
+
+	case *fuseops.RenameOp:
+		return &typed.OpContext
+
+	case *fuseops.RmDirOp:
+		return &typed.OpContext
+
+	case *fuseops.UnlinkOp:
+		return &typed.OpContext
+
+	case *fuseops.OpenDirOp:
+		return &typed.OpContext
+
+	case *fuseops.ReadDirOp:
+		return &typed.OpContext
+
+	case *fuseops.ReadDirPlusOp:
+		return &typed.OpContext
+
+	case *fuseops.SyncDirOp:
+		return &typed.OpContext
+
+	case *fuseops.ReleaseDirHandleOp:
+		return &typed.OpContext
+
+	case *fuseops.OpenFileOp:
+		return &typed.OpContext
+
+	case *fuseops.ReadFileOp:
+		return &typed.OpContext
+
+	case *fuseops.WriteFileOp:
+		return &typed.OpContext
+
+	case *fuseops.SyncFileOp:
+		return &typed.OpContext
+
+	case *fuseops.FlushFileOp:
+		return &typed.OpContext
+
+	case *fuseops.ReleaseFileHandleOp:
+		return &typed.OpContext
+
+	case *fuseops.ReadSymlinkOp:
+		return &typed.OpContext
+
+	case *fuseops.RemoveXattrOp:
+		return &typed.OpContext
+
+	case *fuseops.GetXattrOp:
+		return &typed.OpContext
+
+	case *fuseops.ListXattrOp:
+		return &typed.OpContext
+
+	case *fuseops.SetXattrOp:
+		return &typed.OpContext
+
+	case *fuseops.FallocateOp:
+		return &typed.OpContext
+
+	case *fuseops.SeekOp:
+		return &typed.OpContext
+
+	case *fuseops.CopyFileRangeOp:
+		return &typed.OpContext
+
+	case *fuseops.GetLockOp:
+		return &typed.OpContext
+
+	case *fuseops.SetLockOp:
+		return &typed.OpContext
+
+	case *fuseops.FlockOp:
+		return &typed.OpContext
+
+	case *fuseops.IoctlOp:
+		return &typed.OpContext
+
+	case *fuseops.PollOp:
+		return &typed.OpContext
+
+	case *fuseops.SyncFSOp:
+		return &typed.OpContext
+	}
+
+	return nil
 }
@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/timeutil"
+)
+
+// A HandleTable maps the handles that a file system returns from OpenFile and
+// OpenDir to its state for each, such as an open backend file or a snapshot
+// of a directory listing. It is safe for concurrent use, and the zero value
+// is an empty table.
+//
+// Handle IDs are never reused, starting from one, so that a stale handle
+// from a confused or malicious caller can't reach another file's state, and
+// zero, which the kernel uses when opens are skipped, is never minted.
+type HandleTable[T any] struct {
+	// If set, the time each handle was last used is tracked, for
+	// HandleTableStats.LeastRecentlyUsed.
+	Clock timeutil.Clock
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	handles map[fuseops.HandleID]*handleEntry[T]
+	last    fuseops.HandleID
+	peak    int
+}
+
+type handleEntry[T any] struct {
+	value T
+
+	// With Clock, when the handle was allocated or last returned by Get.
+	//
+	// GUARDED_BY(HandleTable.mu)
+	lastUsed time.Time
+}
+
+// HandleTableStats describes a HandleTable, as returned by
+// HandleTable.Stats.
+type HandleTableStats struct {
+	// The number of handles currently allocated, the most that have been
+	// allocated at once, and the number ever allocated.
+	Open      int
+	Peak      int
+	Allocated uint64
+
+	// With HandleTable.Clock, the time at which the least recently used of the
+	// open handles was last used, or zero if none are open. A time long past
+	// may point at a handle that the file system has leaked.
+	LeastRecentlyUsed time.Time
+}
+
+// Allocate stores v under a new handle, which it returns.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Allocate(v T) fuseops.HandleID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.handles == nil {
+		t.handles = make(map[fuseops.HandleID]*handleEntry[T])
+	}
+
+	t.last++
+	e := &handleEntry[T]{value: v}
+	if t.Clock != nil {
+		e.lastUsed = t.Clock.Now()
+	}
+
+	t.handles[t.last] = e
+	if len(t.handles) > t.peak {
+		t.peak = len(t.handles)
+	}
+
+	return t.last
+}
+
+// Get returns the value stored under the supplied handle, and whether there
+// is one.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Get(h fuseops.HandleID) (v T, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.handles[h]
+	if e == nil {
+		return v, false
+	}
+
+	if t.Clock != nil {
+		e.lastUsed = t.Clock.Now()
+	}
+
+	return e.value, true
+}
+
+// Release removes the supplied handle from the table, returning the value
+// that was stored under it, and whether there was one, for the file system to
+// clean up.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Release(h fuseops.HandleID) (v T, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.handles[h]
+	if e == nil {
+		return v, false
+	}
+
+	delete(t.handles, h)
+	return e.value, true
+}
+
+// Len returns the number of handles currently allocated.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.handles)
+}
+
+// Stats describes the table. Finding the least recently used handle takes
+// time proportional to the number that are open.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *HandleTable[T]) Stats() HandleTableStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := HandleTableStats{
+		Open:      len(t.handles),
+		Peak:      t.peak,
+		Allocated: uint64(t.last),
+	}
+
+	if t.Clock != nil {
+		for _, e := range t.handles {
+			if s.LeastRecentlyUsed.IsZero() || e.lastUsed.Before(s.LeastRecentlyUsed) {
+				s.LeastRecentlyUsed = e.lastUsed
+			}
+		}
+	}
+
+	return s
+}
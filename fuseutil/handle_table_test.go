@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestHandleTable(t *testing.T) {
+	var table fuseutil.HandleTable[string]
+
+	foo := table.Allocate("foo")
+	bar := table.Allocate("bar")
+	if foo == 0 || bar == 0 || foo == bar {
+		t.Fatalf("Got handles %d and %d", foo, bar)
+	}
+
+	if v, ok := table.Get(foo); !ok || v != "foo" {
+		t.Errorf("Get(foo): %q, %v", v, ok)
+	}
+
+	if v, ok := table.Release(foo); !ok || v != "foo" {
+		t.Errorf("Release(foo): %q, %v", v, ok)
+	}
+
+	if _, ok := table.Get(foo); ok {
+		t.Error("Get succeeded after Release")
+	}
+
+	if _, ok := table.Release(foo); ok {
+		t.Error("Release succeeded twice")
+	}
+
+	// Released handles aren't handed out again.
+	baz := table.Allocate("baz")
+	if baz == foo || baz == bar {
+		t.Errorf("Reused handle %d", baz)
+	}
+
+	if v, ok := table.Get(bar); !ok || v != "bar" {
+		t.Errorf("Get(bar): %q, %v", v, ok)
+	}
+
+	s := table.Stats()
+	if s.Open != 2 || s.Peak != 2 || s.Allocated != 3 || !s.LeastRecentlyUsed.IsZero() {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("Len: %d", table.Len())
+	}
+}
+
+func TestHandleTableLeastRecentlyUsed(t *testing.T) {
+	var clock timeutil.SimulatedClock
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.SetTime(start)
+
+	table := fuseutil.HandleTable[int]{Clock: &clock}
+	a := table.Allocate(1)
+	clock.AdvanceTime(time.Second)
+	b := table.Allocate(2)
+
+	if got := table.Stats().LeastRecentlyUsed; !got.Equal(start) {
+		t.Errorf("LeastRecentlyUsed: %v, want %v", got, start)
+	}
+
+	// Using the older handle makes the other the least recently used.
+	clock.AdvanceTime(time.Second)
+	table.Get(a)
+	if got, want := table.Stats().LeastRecentlyUsed, start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("LeastRecentlyUsed: %v, want %v", got, want)
+	}
+
+	table.Release(a)
+	table.Release(b)
+	if got := table.Stats().LeastRecentlyUsed; !got.IsZero() {
+		t.Errorf("LeastRecentlyUsed with nothing open: %v", got)
+	}
+}
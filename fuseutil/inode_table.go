@@ -0,0 +1,234 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An InodeTable mints inode IDs and keeps the file system's state for each,
+// along with the kernel's lookup count for it, freeing the inode only once
+// the file system has unlinked it and the kernel has forgotten it. IDs are
+// reused once freed, with a new generation number each time, as NFS export
+// requires. It is safe for concurrent use.
+//
+// Every op that hands the kernel a fuseops.ChildInodeEntry, such as
+// LookUpInodeOp, MkDirOp, CreateFileOp and ReadDirPlusOp entries with a
+// non-zero Child, must fill the entry in with LookedUp, and ForgetInodeOp and
+// BatchForgetOp must be passed to Forget and BatchForget.
+type InodeTable[T any] struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*inodeEntry[T]
+	next   fuseops.InodeID
+
+	// IDs freed for reuse, with the generation that their next incarnation is
+	// to have.
+	//
+	// GUARDED_BY(mu)
+	free []freeInode
+}
+
+type inodeEntry[T any] struct {
+	value      T
+	generation fuseops.GenerationNumber
+	lookups    uint64
+	unlinked   bool
+}
+
+type freeInode struct {
+	id         fuseops.InodeID
+	generation fuseops.GenerationNumber
+}
+
+// NewInodeTable returns a table holding the root inode, with state root. The
+// root inode is never freed.
+func NewInodeTable[T any](root T) *InodeTable[T] {
+	return &InodeTable[T]{
+		inodes: map[fuseops.InodeID]*inodeEntry[T]{
+			fuseops.RootInodeID: {value: root},
+		},
+		next: fuseops.RootInodeID + 1,
+	}
+}
+
+// Add adds an inode with state v, returning its ID. The kernel doesn't know
+// about it until it is handed out with LookedUp.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) Add(v T) fuseops.InodeID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := &inodeEntry[T]{value: v}
+
+	var id fuseops.InodeID
+	if n := len(t.free); n > 0 {
+		id = t.free[n-1].id
+		e.generation = t.free[n-1].generation
+		t.free = t.free[:n-1]
+	} else {
+		id = t.next
+		t.next++
+	}
+
+	t.inodes[id] = e
+	return id
+}
+
+// Get returns the state of the supplied inode, and whether it exists.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) Get(id fuseops.InodeID) (v T, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.inodes[id]
+	if e == nil {
+		return v, false
+	}
+
+	return e.value, true
+}
+
+// LookedUp records that the supplied inode is being handed to the kernel,
+// incrementing its lookup count, and sets entry.Child and entry.Generation.
+// It returns false, leaving entry alone, if the inode doesn't exist.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) LookedUp(
+	id fuseops.InodeID,
+	entry *fuseops.ChildInodeEntry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.inodes[id]
+	if e == nil {
+		return false
+	}
+
+	e.lookups++
+	entry.Child = id
+	entry.Generation = e.generation
+	return true
+}
+
+// Unlink records that the file system no longer refers to the supplied
+// inode, for example because its last link was removed. It is freed now if
+// the kernel doesn't know about it, in which case its state is returned for
+// the file system to clean up, and otherwise once the kernel forgets it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) Unlink(id fuseops.InodeID) (v T, freed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e := t.inodes[id]
+	if e == nil || id == fuseops.RootInodeID {
+		return v, false
+	}
+
+	e.unlinked = true
+	return t.maybeFree(id, e)
+}
+
+// Forget decrements the lookup count of the supplied inode by n, as for a
+// ForgetInodeOp. If that frees the inode, its state is returned for the file
+// system to clean up.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) Forget(id fuseops.InodeID, n uint64) (v T, freed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.forget(id, n)
+}
+
+// BatchForget is like Forget for each of the entries of a BatchForgetOp,
+// returning the states of the inodes that are freed.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) BatchForget(entries []fuseops.BatchForgetEntry) []T {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var freed []T
+	for _, entry := range entries {
+		if v, ok := t.forget(entry.Inode, entry.N); ok {
+			freed = append(freed, v)
+		}
+	}
+
+	return freed
+}
+
+// LookupCount returns the kernel's lookup count for the supplied inode.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) LookupCount(id fuseops.InodeID) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if e := t.inodes[id]; e != nil {
+		return e.lookups
+	}
+
+	return 0
+}
+
+// Len returns the number of inodes in the table, including the root.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *InodeTable[T]) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.inodes)
+}
+
+// LOCKS_REQUIRED(t.mu)
+func (t *InodeTable[T]) forget(id fuseops.InodeID, n uint64) (v T, freed bool) {
+	e := t.inodes[id]
+	if e == nil {
+		return v, false
+	}
+
+	// The kernel never forgets more than it has looked up, but don't wrap
+	// around if it does.
+	if n > e.lookups {
+		n = e.lookups
+	}
+
+	e.lookups -= n
+	return t.maybeFree(id, e)
+}
+
+// Free the inode if neither the file system nor the kernel refers to it.
+//
+// LOCKS_REQUIRED(t.mu)
+func (t *InodeTable[T]) maybeFree(
+	id fuseops.InodeID,
+	e *inodeEntry[T]) (v T, freed bool) {
+	if !e.unlinked || e.lookups > 0 {
+		return v, false
+	}
+
+	delete(t.inodes, id)
+	t.free = append(t.free, freeInode{id, e.generation + 1})
+	return e.value, true
+}
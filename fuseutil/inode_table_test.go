@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestInodeTable(t *testing.T) {
+	table := fuseutil.NewInodeTable("root")
+
+	if v, ok := table.Get(fuseops.RootInodeID); !ok || v != "root" {
+		t.Errorf("Get(root): %q, %v", v, ok)
+	}
+
+	foo := table.Add("foo")
+	if foo == fuseops.RootInodeID {
+		t.Fatal("Minted the root ID")
+	}
+
+	// Hand foo to the kernel twice.
+	var entry fuseops.ChildInodeEntry
+	for i := 0; i < 2; i++ {
+		if !table.LookedUp(foo, &entry) {
+			t.Fatal("LookedUp failed")
+		}
+	}
+
+	if entry.Child != foo || table.LookupCount(foo) != 2 {
+		t.Errorf("Entry %+v, lookup count %d", entry, table.LookupCount(foo))
+	}
+
+	gen := entry.Generation
+
+	// Unlinking it doesn't free it while the kernel knows about it.
+	if _, freed := table.Unlink(foo); freed {
+		t.Error("Freed on unlink")
+	}
+
+	if _, freed := table.Forget(foo, 1); freed {
+		t.Error("Freed with a lookup outstanding")
+	}
+
+	if v, freed := table.Forget(foo, 1); !freed || v != "foo" {
+		t.Errorf("Forget: %q, %v", v, freed)
+	}
+
+	if _, ok := table.Get(foo); ok {
+		t.Error("Get succeeded after freeing")
+	}
+
+	// The ID is reused with a new generation.
+	bar := table.Add("bar")
+	if bar != foo {
+		t.Fatalf("Got ID %d, want %d reused", bar, foo)
+	}
+
+	table.LookedUp(bar, &entry)
+	if entry.Generation == gen {
+		t.Errorf("Generation %d not bumped on reuse", gen)
+	}
+
+	// An inode the kernel never saw is freed on unlink.
+	baz := table.Add("baz")
+	if v, freed := table.Unlink(baz); !freed || v != "baz" {
+		t.Errorf("Unlink(baz): %q, %v", v, freed)
+	}
+
+	// The root is never freed.
+	table.LookedUp(fuseops.RootInodeID, &entry)
+	table.Unlink(fuseops.RootInodeID)
+	if _, freed := table.Forget(fuseops.RootInodeID, 1); freed {
+		t.Error("Freed the root")
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("Len: %d", table.Len())
+	}
+}
+
+func TestInodeTableBatchForget(t *testing.T) {
+	table := fuseutil.NewInodeTable(0)
+
+	var entries []fuseops.BatchForgetEntry
+	for i := 1; i <= 3; i++ {
+		id := table.Add(i)
+		var entry fuseops.ChildInodeEntry
+		table.LookedUp(id, &entry)
+		if i != 2 {
+			table.Unlink(id)
+		}
+
+		entries = append(entries, fuseops.BatchForgetEntry{Inode: id, N: 1})
+	}
+
+	if got := table.BatchForget(entries); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("Freed %v", got)
+	}
+
+	if table.Len() != 2 {
+		t.Errorf("Len: %d", table.Len())
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"log"
+	"runtime/debug"
+
+	"github.com/jacobsa/fuse"
+)
+
+// An OpHandler handles an op from the kernel, such as *fuseops.LookUpInodeOp,
+// returning the error to reply with.
+type OpHandler func(ctx context.Context, op interface{}) error
+
+// An Interceptor is called for every op that a server created by
+// NewFileSystemServerWithInterceptors reads, in place of the FileSystem
+// method that handles it. It calls next to carry on handling the op, which
+// runs the next interceptor in the chain or, after the last one, the
+// FileSystem method. Unknown ops reach the end of the chain too, and fail
+// with ENOSYS there.
+//
+// An interceptor may look at or modify the op before and after calling next,
+// change the context it passes on, answer the op itself by returning without
+// calling next, or call next more than once to retry it. It must pass next
+// the op it was given, and return only once it is done with it: the server
+// replies with the error it returns.
+//
+// Interceptors are called concurrently, on the goroutine that the op is
+// handled on, except that ForgetInodeOp is handled inline as described for
+// NewFileSystemServer.
+type Interceptor func(ctx context.Context, op interface{}, next OpHandler) error
+
+// Like NewFileSystemServer, but ops pass through the supplied interceptors in
+// order on their way to fs, so that the first is outermost. This suits
+// concerns that apply across ops, such as metrics, access control, rate
+// limiting and retries.
+func NewFileSystemServerWithInterceptors(
+	fs FileSystem,
+	interceptors ...Interceptor) fuse.Server {
+	s := &fileSystemServer{
+		fs:     fs,
+		delays: newRandomDelaySchedulerFromFlags(),
+	}
+
+	s.handler = chainInterceptors(s.dispatch, interceptors)
+	return s
+}
+
+// Return a handler that calls the interceptors in order, then h.
+func chainInterceptors(h OpHandler, interceptors []Interceptor) OpHandler {
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor := interceptors[i]
+		next := h
+		h = func(ctx context.Context, op interface{}) error {
+			return interceptor(ctx, op, next)
+		}
+	}
+
+	return h
+}
+
+// RecoverPanics returns an interceptor that recovers from a panic in the rest
+// of the chain, such as in a FileSystem method, and fails the op with EIO,
+// rather than letting the panic kill the process and wedge the mount point.
+// The panic is logged with its stack trace to logger, or to the standard
+// logger if logger is nil. Put it first, so that it covers the other
+// interceptors too:
+//
+//	server := fuseutil.NewFileSystemServerWithInterceptors(
+//		fs,
+//		fuseutil.RecoverPanics(nil),
+//		...)
+//
+// The file system may be left inconsistent by the code that panicked, so this
+// suits file systems whose state is mostly elsewhere, such as in a backend.
+func RecoverPanics(logger *log.Logger) Interceptor {
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	return func(ctx context.Context, op interface{}, next OpHandler) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Printf("%T: panic: %v\n%s", op, r, debug.Stack())
+				err = fuse.EIO
+			}
+		}()
+
+		return next(ctx, op)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+func TestFileSystemServerWithInterceptors(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, fmt.Sprintf(format, args...))
+	}
+
+	// One interceptor watches every op, and one within it turns away lookups
+	// of a particular name without consulting the file system.
+	outer := func(ctx context.Context, op interface{}, next fuseutil.OpHandler) error {
+		record("outer %T", op)
+		err := next(ctx, op)
+		record("outer done: %v", err)
+		return err
+	}
+
+	inner := func(ctx context.Context, op interface{}, next fuseutil.OpHandler) error {
+		if o, ok := op.(*fuseops.LookUpInodeOp); ok && o.Name == "secret" {
+			return syscall.EACCES
+		}
+
+		record("inner %T", op)
+		return next(ctx, op)
+	}
+
+	server := fuseutil.NewFileSystemServerWithInterceptors(&emptyFS{}, outer, inner)
+	k, err := fusetesting.NewFakeKernel(server, nil, &fusetesting.FakeKernelConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+	defer k.Close()
+
+	if _, err := k.Stat("foo"); err != syscall.ENOENT {
+		t.Errorf("Stat(foo): %v", err)
+	}
+
+	if _, err := k.Stat("secret"); err != syscall.EACCES {
+		t.Errorf("Stat(secret): %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"outer *fuseops.LookUpInodeOp",
+		"inner *fuseops.LookUpInodeOp",
+		"outer done: no such file or directory",
+		"outer *fuseops.LookUpInodeOp",
+		"outer done: permission denied",
+	}
+
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("Calls: %q, want %q", calls, want)
+	}
+}
+
+// A file system whose lookups panic.
+type panickingFS struct {
+	emptyFS
+}
+
+func (fs *panickingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	panic("taco")
+}
+
+func TestRecoverPanics(t *testing.T) {
+	var logged bytes.Buffer
+	server := fuseutil.NewFileSystemServerWithInterceptors(
+		&panickingFS{},
+		fuseutil.RecoverPanics(log.New(&logged, "", 0)))
+
+	k, err := fusetesting.NewFakeKernel(server, nil, &fusetesting.FakeKernelConfig{})
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	// Each panicking op fails on its own, and the server keeps going.
+	for i := 0; i < 2; i++ {
+		if _, err := k.Stat("foo"); err != syscall.EIO {
+			t.Errorf("Stat: %v", err)
+		}
+	}
+
+	if _, err := k.GetAttributes(fuseops.RootInodeID); err != nil {
+		t.Errorf("GetAttributes: %v", err)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s := logged.String()
+	if !strings.Contains(s, "*fuseops.LookUpInodeOp: panic: taco") ||
+		!strings.Contains(s, "panickingFS") {
+		t.Errorf("Unexpected log output:\n%s", s)
+	}
+}
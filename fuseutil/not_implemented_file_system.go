@@ -54,6 +54,12 @@ func (fs *NotImplementedFileSystem) SetInodeAttributes(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) error {
@@ -126,6 +132,18 @@ func (fs *NotImplementedFileSystem) ReadDir(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) error {
@@ -204,6 +222,48 @@ func (fs *NotImplementedFileSystem) Fallocate(
 	return fuse.ENOSYS
 }
 
+func (fs *NotImplementedFileSystem) Seek(
+	ctx context.Context,
+	op *fuseops.SeekOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	return fuse.ENOSYS
+}
+
+func (fs *NotImplementedFileSystem) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	return fuse.ENOSYS
+}
+
 func (fs *NotImplementedFileSystem) SyncFS(
 	ctx context.Context,
 	op *fuseops.SyncFSOp) error {
@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var fRandomDelays = flag.Bool(
+	"fuseutil.random_delays",
+	false,
+	"If set, randomly delay and reorder each op received, to help expose "+
+		"concurrency issues.")
+
+var fRandomDelaysSeed = flag.Int64(
+	"fuseutil.random_delays_seed",
+	0,
+	"The seed to use for --fuseutil.random_delays. If zero, a seed is chosen "+
+		"and logged so that a failing run can be reproduced.")
+
+// Configuration for a RandomDelayScheduler.
+type RandomDelayConfig struct {
+	// The seed for the scheduler's source of randomness. Two schedulers with
+	// the same configuration make the same decisions for the same sequence of
+	// ops.
+	Seed int64
+
+	// Each op is delayed by a duration drawn uniformly from [0, MaxJitter).
+	// Zero disables jitter.
+	MaxJitter time.Duration
+
+	// If greater than one, ops are gathered into consecutive groups of this
+	// many, in the order they are read from the kernel, and each group is
+	// released to the file system in a shuffled order.
+	ReorderWindow int
+
+	// How long to wait for a group to fill before releasing whatever has
+	// arrived, in order to avoid stalling when fewer ops than ReorderWindow
+	// are in flight. Ignored if ReorderWindow is at most one.
+	ReorderTimeout time.Duration
+}
+
+// A RandomDelayScheduler delays and reorders ops before they are dispatched
+// to a file system, in order to expose concurrency bugs that depend on
+// unlucky timing. Every random decision is drawn from a source seeded by
+// RandomDelayConfig.Seed, in the order ops are read from the kernel, so that
+// a schedule that exposed a bug can be replayed by reusing the seed.
+//
+// Use it with NewFileSystemServerWithDelays, or enable it for every server
+// created with NewFileSystemServer using --fuseutil.random_delays. Tests that
+// create a scheduler themselves can use fusetesting.ReportSeedOnFailure to
+// have its seed logged when they fail.
+type RandomDelayScheduler struct {
+	cfg RandomDelayConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	rng *rand.Rand
+
+	// The group currently being filled, and the number of ops assigned to it
+	// so far.
+	//
+	// GUARDED_BY(mu)
+	group    *delayGroup
+	assigned int
+}
+
+// NewRandomDelayScheduler creates a scheduler with the supplied
+// configuration.
+func NewRandomDelayScheduler(cfg RandomDelayConfig) *RandomDelayScheduler {
+	return &RandomDelayScheduler{
+		cfg: cfg,
+		rng: rand.New(rand.NewSource(cfg.Seed)),
+	}
+}
+
+// Create a scheduler configured by the --fuseutil.random_delays flags, or
+// return nil if they are not set. The seed is logged so that it shows up in
+// the output of a failing test.
+func newRandomDelaySchedulerFromFlags() *RandomDelayScheduler {
+	if !*fRandomDelays {
+		return nil
+	}
+
+	seed := *fRandomDelaysSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	log.Printf(
+		"fuseutil: random delays enabled; "+
+			"reproduce with --fuseutil.random_delays_seed=%d",
+		seed)
+
+	return NewRandomDelayScheduler(RandomDelayConfig{
+		Seed:           seed,
+		MaxJitter:      100 * time.Microsecond,
+		ReorderWindow:  4,
+		ReorderTimeout: 10 * time.Millisecond,
+	})
+}
+
+// Seed returns the seed with which the scheduler was configured.
+func (s *RandomDelayScheduler) Seed() int64 {
+	return s.cfg.Seed
+}
+
+// The decisions made for a single op. Obtained with schedule, in the order
+// ops are received, and then waited for on the op's own goroutine.
+type delayTicket struct {
+	jitter time.Duration
+	group  *delayGroup
+	rank   int
+}
+
+// Draw the decisions for the next op received from the kernel. Must be called
+// in the order ops are received in order for the schedule to be
+// reproducible. If reorder is false, the op is only jittered.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *RandomDelayScheduler) schedule(reorder bool) delayTicket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var t delayTicket
+	if s.cfg.MaxJitter > 0 {
+		t.jitter = time.Duration(s.rng.Int63n(int64(s.cfg.MaxJitter)))
+	}
+
+	if !reorder || s.cfg.ReorderWindow <= 1 {
+		return t
+	}
+
+	if s.group == nil || s.assigned == s.cfg.ReorderWindow {
+		s.group = newDelayGroup(
+			s.rng.Perm(s.cfg.ReorderWindow),
+			s.cfg.ReorderTimeout)
+		s.assigned = 0
+	}
+
+	t.group = s.group
+	t.rank = s.group.perm[s.assigned]
+	s.assigned++
+
+	return t
+}
+
+// Block until the op holding the ticket may proceed.
+func (t delayTicket) wait() {
+	if t.group != nil {
+		<-t.group.gates[t.rank]
+	}
+
+	if t.jitter > 0 {
+		time.Sleep(t.jitter)
+	}
+
+	// Give this op a head start on the next one in the group.
+	if t.group != nil {
+		t.group.open(t.rank + 1)
+	}
+}
+
+// A group of ops released in a shuffled order. The op with rank r is released
+// once the op with rank r-1 has served its jitter, or once the group times
+// out.
+type delayGroup struct {
+	perm  []int
+	gates []chan struct{}
+
+	mu     sync.Mutex
+	opened []bool // GUARDED_BY(mu)
+}
+
+func newDelayGroup(perm []int, timeout time.Duration) *delayGroup {
+	g := &delayGroup{
+		perm:   perm,
+		gates:  make([]chan struct{}, len(perm)),
+		opened: make([]bool, len(perm)),
+	}
+
+	for i := range g.gates {
+		g.gates[i] = make(chan struct{})
+	}
+
+	g.open(0)
+	time.AfterFunc(timeout, func() {
+		for i := range g.gates {
+			g.open(i)
+		}
+	})
+
+	return g
+}
+
+// LOCKS_EXCLUDED(g.mu)
+func (g *delayGroup) open(rank int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if rank < len(g.gates) && !g.opened[rank] {
+		g.opened[rank] = true
+		close(g.gates[rank])
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRandomDelaySchedulerIsReproducible(t *testing.T) {
+	cfg := RandomDelayConfig{
+		Seed:           17,
+		MaxJitter:      time.Millisecond,
+		ReorderWindow:  4,
+		ReorderTimeout: time.Hour,
+	}
+
+	// Draw the same sequence of decisions from two schedulers, with some ops
+	// that are only jittered mixed in.
+	draw := func(s *RandomDelayScheduler) (jitters []time.Duration, ranks []int) {
+		for i := 0; i < 20; i++ {
+			ticket := s.schedule(i%5 != 0)
+			jitters = append(jitters, ticket.jitter)
+			if ticket.group != nil {
+				ranks = append(ranks, ticket.rank)
+			}
+		}
+
+		return jitters, ranks
+	}
+
+	jitters0, ranks0 := draw(NewRandomDelayScheduler(cfg))
+	jitters1, ranks1 := draw(NewRandomDelayScheduler(cfg))
+
+	for i := range jitters0 {
+		if jitters0[i] != jitters1[i] {
+			t.Errorf("Jitter %d: %v vs. %v", i, jitters0[i], jitters1[i])
+		}
+
+		if jitters0[i] < 0 || jitters0[i] >= cfg.MaxJitter {
+			t.Errorf("Jitter %d out of range: %v", i, jitters0[i])
+		}
+	}
+
+	if len(ranks0) != 16 || len(ranks1) != len(ranks0) {
+		t.Fatalf("Got %d and %d reordered ops, want 16", len(ranks0), len(ranks1))
+	}
+
+	for i := range ranks0 {
+		if ranks0[i] != ranks1[i] {
+			t.Errorf("Rank %d: %d vs. %d", i, ranks0[i], ranks1[i])
+		}
+	}
+
+	// Each consecutive group of four is a permutation.
+	for i := 0; i < len(ranks0); i += 4 {
+		var seen [4]bool
+		for _, r := range ranks0[i : i+4] {
+			seen[r] = true
+		}
+
+		if seen != [4]bool{true, true, true, true} {
+			t.Errorf("Group at %d isn't a permutation: %v", i, ranks0[i:i+4])
+		}
+	}
+
+	// A different seed makes different decisions.
+	cfg.Seed++
+	jitters2, _ := draw(NewRandomDelayScheduler(cfg))
+
+	same := true
+	for i := range jitters0 {
+		same = same && jitters0[i] == jitters2[i]
+	}
+
+	if same {
+		t.Errorf("Seeds %d and %d gave the same jitter", cfg.Seed-1, cfg.Seed)
+	}
+}
+
+// Wait for each of the tickets on its own goroutine, returning a channel that
+// is closed once all of them have been released.
+func waitAll(tickets []delayTicket) <-chan struct{} {
+	var wg sync.WaitGroup
+	for _, ticket := range tickets {
+		wg.Add(1)
+		go func(ticket delayTicket) {
+			defer wg.Done()
+			ticket.wait()
+		}(ticket)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+func TestRandomDelaySchedulerReleasesPartialGroups(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	// Find a seed with which the first two ops in a group of four don't
+	// include the one released first, so that they can only be released by
+	// the timeout.
+	var s *RandomDelayScheduler
+	var tickets []delayTicket
+	for seed := int64(1); ; seed++ {
+		s = NewRandomDelayScheduler(RandomDelayConfig{
+			Seed:           seed,
+			ReorderWindow:  4,
+			ReorderTimeout: timeout,
+		})
+
+		tickets = []delayTicket{s.schedule(true), s.schedule(true)}
+		if tickets[0].rank != 0 && tickets[1].rank != 0 {
+			break
+		}
+	}
+
+	start := time.Now()
+	select {
+	case <-waitAll(tickets):
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Ops with seed %d not released after %v", s.Seed(), timeout)
+	}
+
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Errorf("Ops released after %v, before the timeout", elapsed)
+	}
+
+	// Ops in a full group don't wait for the timeout.
+	s = NewRandomDelayScheduler(RandomDelayConfig{
+		Seed:           s.Seed(),
+		ReorderWindow:  2,
+		ReorderTimeout: time.Hour,
+	})
+
+	select {
+	case <-waitAll([]delayTicket{s.schedule(true), s.schedule(true)}):
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Full group with seed %d not released", s.Seed())
+	}
+}
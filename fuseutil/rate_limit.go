@@ -0,0 +1,646 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"math"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// How callers are told apart by a rate-limited file system.
+type RateLimitKey int
+
+const (
+	// Processes running as the same user share limits.
+	RateLimitByUid RateLimitKey = iota
+
+	// Each process has its own limits.
+	RateLimitByPid
+)
+
+// Configuration for NewRateLimitedFileSystem. Each caller has a token bucket
+// for ops and another for bytes, which start full and refill continuously at
+// the configured rate up to the configured burst size.
+type RateLimitConfig struct {
+	// Whether limits apply per user or per process.
+	Key RateLimitKey
+
+	// The sustained rate of ops allowed for each caller, and how many may be
+	// issued at once after a quiet period. A zero rate disables the limit;
+	// otherwise the burst is raised to at least one.
+	OpsPerSecond float64
+	OpsBurst     int
+
+	// Like OpsPerSecond and OpsBurst, for the bytes requested by ReadFileOp
+	// and WriteFileOp. A single op larger than the burst is allowed once the
+	// bucket is full, after which the caller waits for the deficit to refill.
+	BytesPerSecond float64
+	BytesBurst     int64
+}
+
+// NewRateLimitedFileSystem wraps the supplied file system, holding back each
+// op until its caller has enough tokens according to the supplied
+// configuration, so that one runaway process can't starve others of a shared
+// mount. Callers are queued in the order they ask for tokens, and an op whose
+// context is cancelled while waiting fails with EINTR without reaching the
+// wrapped file system.
+//
+// Ops issued by the kernel itself rather than on behalf of a process, such as
+// writeback of dirty pages, carry no PID and are never held back, nor are ops
+// that only release resources: forgetting inodes and releasing handles.
+// StatFSOp doesn't identify its caller, so it isn't limited either.
+func NewRateLimitedFileSystem(
+	wrapped FileSystem,
+	cfg RateLimitConfig) FileSystem {
+	if cfg.OpsBurst < 1 {
+		cfg.OpsBurst = 1
+	}
+
+	if cfg.BytesBurst < 1 {
+		cfg.BytesBurst = 1
+	}
+
+	return &rateLimitedFS{
+		FileSystem: wrapped,
+		cfg:        cfg,
+		callers:    make(map[uint32]*callerBuckets),
+	}
+}
+
+// Callers whose buckets have refilled are forgotten once there are more than
+// this many, to bound memory use when many short-lived processes come and go.
+const rateLimitPruneThreshold = 1024
+
+// A token bucket that may go into debt, so that a request is never refused
+// outright, only delayed until the debt has been paid off.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Bring the bucket up to date as of now.
+func (b *tokenBucket) refill(now time.Time, rate float64, burst float64) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+}
+
+// Take n tokens, returning how long the caller must wait before using them.
+func (b *tokenBucket) take(
+	now time.Time,
+	rate float64,
+	burst float64,
+	n float64) time.Duration {
+	b.refill(now, rate, burst)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+type callerBuckets struct {
+	ops   tokenBucket
+	bytes tokenBucket
+}
+
+type rateLimitedFS struct {
+	FileSystem
+
+	cfg RateLimitConfig
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	callers map[uint32]*callerBuckets
+}
+
+// Wait until the caller of the op with the supplied context may proceed with
+// an op of the given size in bytes.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) wait(
+	ctx context.Context,
+	oc *fuseops.OpContext,
+	bytes int64) error {
+	if oc.Pid == 0 {
+		return nil
+	}
+
+	key := oc.Uid
+	if fs.cfg.Key == RateLimitByPid {
+		key = oc.Pid
+	}
+
+	delay := fs.take(key, bytes)
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+
+	case <-ctx.Done():
+		fs.refund(key, bytes)
+		return syscall.EINTR
+	}
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) take(key uint32, bytes int64) time.Duration {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	now := time.Now()
+	if len(fs.callers) > rateLimitPruneThreshold {
+		fs.prune(now)
+	}
+
+	b, ok := fs.callers[key]
+	if !ok {
+		b = &callerBuckets{
+			ops:   tokenBucket{float64(fs.cfg.OpsBurst), now},
+			bytes: tokenBucket{float64(fs.cfg.BytesBurst), now},
+		}
+
+		fs.callers[key] = b
+	}
+
+	var delay time.Duration
+	if fs.cfg.OpsPerSecond > 0 {
+		delay = b.ops.take(
+			now,
+			fs.cfg.OpsPerSecond,
+			float64(fs.cfg.OpsBurst),
+			1)
+	}
+
+	if fs.cfg.BytesPerSecond > 0 && bytes > 0 {
+		// Let an op larger than the burst through once the bucket is full,
+		// rather than making it wait forever.
+		n := math.Min(float64(bytes), float64(fs.cfg.BytesBurst))
+		d := b.bytes.take(now, fs.cfg.BytesPerSecond, float64(fs.cfg.BytesBurst), n)
+		b.bytes.tokens -= float64(bytes) - n
+		if d > delay {
+			delay = d
+		}
+	}
+
+	return delay
+}
+
+// Give back the tokens taken for an op that didn't go ahead.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) refund(key uint32, bytes int64) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, ok := fs.callers[key]
+	if !ok {
+		return
+	}
+
+	if fs.cfg.OpsPerSecond > 0 {
+		b.ops.tokens = math.Min(float64(fs.cfg.OpsBurst), b.ops.tokens+1)
+	}
+
+	if fs.cfg.BytesPerSecond > 0 && bytes > 0 {
+		b.bytes.tokens = math.Min(
+			float64(fs.cfg.BytesBurst),
+			b.bytes.tokens+float64(bytes))
+	}
+}
+
+// Forget callers whose buckets are full, since new buckets start that way.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *rateLimitedFS) prune(now time.Time) {
+	for key, b := range fs.callers {
+		b.ops.refill(now, fs.cfg.OpsPerSecond, float64(fs.cfg.OpsBurst))
+		b.bytes.refill(now, fs.cfg.BytesPerSecond, float64(fs.cfg.BytesBurst))
+
+		if b.ops.tokens >= float64(fs.cfg.OpsBurst) &&
+			b.bytes.tokens >= float64(fs.cfg.BytesBurst) {
+			delete(fs.callers, key)
+		}
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Ops that transfer data
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, op.Size); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, op.Size); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.WriteFile(ctx, op)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Other ops
+////////////////////////////////////////////////////////////////////////
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.LookUpInode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetInodeAttributes(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetInodeAttributes(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Access(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.MkNode(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateLink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CreateSymlink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Rename(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.RmDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Unlink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.OpenDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadDirPlus(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncDir(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.OpenFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.FlushFile(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ReadSymlink(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.RemoveXattr(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetXattr(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.ListXattr(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetXattr(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Fallocate(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Seek(
+	ctx context.Context,
+	op *fuseops.SeekOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Seek(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.CopyFileRange(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.GetLock(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SetLock(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Flock(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Ioctl(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) Poll(
+	ctx context.Context,
+	op *fuseops.PollOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.Poll(ctx, op)
+}
+
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *rateLimitedFS) SyncFS(
+	ctx context.Context,
+	op *fuseops.SyncFSOp) error {
+	if err := fs.wait(ctx, &op.OpContext, 0); err != nil {
+		return err
+	}
+
+	return fs.FileSystem.SyncFS(ctx, op)
+}
+
+func (fs *rateLimitedFS) OpInterrupted(ctx context.Context, op interface{}) {
+	opInterrupted(fs.FileSystem, ctx, op)
+}
@@ -0,0 +1,175 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A file system that counts the lookups and reads it sees.
+type lookUpCountingFS struct {
+	fuseutil.NotImplementedFileSystem
+	lookUps int
+	reads   int
+}
+
+func (fs *lookUpCountingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.lookUps++
+	return nil
+}
+
+func (fs *lookUpCountingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.reads++
+	return nil
+}
+
+// Ops are held back by at least this much when over the limits below, and
+// ops under the limits must finish well within it.
+const rateLimitDelay = 100 * time.Millisecond
+
+func TestRateLimitedFileSystem_Ops(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &lookUpCountingFS{}
+	fs := fuseutil.NewRateLimitedFileSystem(wrapped, fuseutil.RateLimitConfig{
+		Key:          fuseutil.RateLimitByUid,
+		OpsPerSecond: float64(time.Second / rateLimitDelay),
+		OpsBurst:     2,
+	})
+
+	lookUp := func(uid, pid uint32) time.Duration {
+		t.Helper()
+		start := time.Now()
+		op := &fuseops.LookUpInodeOp{
+			OpContext: fuseops.OpContext{Uid: uid, Pid: pid},
+		}
+
+		if err := fs.LookUpInode(ctx, op); err != nil {
+			t.Fatalf("LookUpInode: %v", err)
+		}
+
+		return time.Since(start)
+	}
+
+	// The burst goes through immediately.
+	for i := 0; i < 2; i++ {
+		if d := lookUp(1000, 1); d >= rateLimitDelay/2 {
+			t.Errorf("op %d within burst took %v", i, d)
+		}
+	}
+
+	// Other users, even in the same process, and the kernel itself
+	// aren't affected by the first user's usage.
+	if d := lookUp(1001, 1); d >= rateLimitDelay/2 {
+		t.Errorf("other user's op took %v", d)
+	}
+
+	for i := 0; i < 5; i++ {
+		if d := lookUp(1000, 0); d >= rateLimitDelay/2 {
+			t.Errorf("kernel op %d took %v", i, d)
+		}
+	}
+
+	// The next op from the first user must wait for a token.
+	if d := lookUp(1000, 2); d < rateLimitDelay/2 {
+		t.Errorf("op beyond burst took only %v", d)
+	}
+
+	if wrapped.lookUps != 9 {
+		t.Errorf("wrapped file system saw %d lookups, want 9", wrapped.lookUps)
+	}
+}
+
+func TestRateLimitedFileSystem_Bytes(t *testing.T) {
+	ctx := context.Background()
+	wrapped := &lookUpCountingFS{}
+	fs := fuseutil.NewRateLimitedFileSystem(wrapped, fuseutil.RateLimitConfig{
+		Key:            fuseutil.RateLimitByPid,
+		BytesPerSecond: 1000 * float64(time.Second/rateLimitDelay),
+		BytesBurst:     1000,
+	})
+
+	read := func(pid uint32, size int64) time.Duration {
+		t.Helper()
+		start := time.Now()
+		op := &fuseops.ReadFileOp{
+			Size:      size,
+			OpContext: fuseops.OpContext{Uid: 1000, Pid: pid},
+		}
+
+		if err := fs.ReadFile(ctx, op); err != nil {
+			t.Fatalf("ReadFile: %v", err)
+		}
+
+		return time.Since(start)
+	}
+
+	// A read larger than the burst is let through, but leaves the process in
+	// debt.
+	if d := read(1, 1500); d >= rateLimitDelay/2 {
+		t.Errorf("first read took %v", d)
+	}
+
+	// Another process of the same user isn't affected.
+	if d := read(2, 1000); d >= rateLimitDelay/2 {
+		t.Errorf("other process's read took %v", d)
+	}
+
+	// The first process must wait for the debt and its next read.
+	if d := read(1, 500); d < rateLimitDelay*3/4 {
+		t.Errorf("read in debt took only %v", d)
+	}
+
+	if wrapped.reads != 3 {
+		t.Errorf("wrapped file system saw %d reads, want 3", wrapped.reads)
+	}
+}
+
+func TestRateLimitedFileSystem_Cancellation(t *testing.T) {
+	wrapped := &lookUpCountingFS{}
+	fs := fuseutil.NewRateLimitedFileSystem(wrapped, fuseutil.RateLimitConfig{
+		Key:          fuseutil.RateLimitByPid,
+		OpsPerSecond: 0.01,
+	})
+
+	oc := fuseops.OpContext{Uid: 1000, Pid: 1}
+	if err := fs.LookUpInode(
+		context.Background(),
+		&fuseops.LookUpInodeOp{OpContext: oc}); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	// The next op would wait for a long time, but is interrupted.
+	ctx, cancel := context.WithTimeout(context.Background(), rateLimitDelay)
+	defer cancel()
+
+	err := fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{OpContext: oc})
+	if err != syscall.EINTR {
+		t.Errorf("got error %v, want EINTR", err)
+	}
+
+	if wrapped.lookUps != 1 {
+		t.Errorf("wrapped file system saw %d lookups, want 1", wrapped.lookUps)
+	}
+}
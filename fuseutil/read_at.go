@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"io"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ServeReadAt answers the supplied op with data from r, which should hold the
+// contents of the file open with op.Handle, for example an *os.File or a
+// *bytes.Reader. It is intended to be returned directly from
+// FileSystem.ReadFile:
+//
+//	func (fs *myFS) ReadFile(ctx context.Context, op *fuseops.ReadFileOp) error {
+//		return fuseutil.ServeReadAt(op, fs.handles[op.Handle])
+//	}
+//
+// Data is read directly into op.Dst. When there is no destination buffer, as
+// with fuse.MountConfig.UseVectoredRead, it is read into a new buffer that is
+// handed back in op.Data.
+//
+// Reaching the end of r isn't an error: op.BytesRead is set to the number of
+// bytes before it, which is what the kernel expects at the end of a file.
+// Other errors are returned, and the op fails.
+func ServeReadAt(op *fuseops.ReadFileOp, r io.ReaderAt) error {
+	dst := op.Dst
+	if dst == nil {
+		dst = make([]byte, op.Size)
+	}
+
+	n, err := r.ReadAt(dst, op.Offset)
+	if err == io.EOF {
+		err = nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = n
+	if op.Dst == nil {
+		op.Data = [][]byte{dst[:n]}
+	}
+
+	return nil
+}
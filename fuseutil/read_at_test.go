@@ -0,0 +1,78 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// An io.ReaderAt that always fails.
+type failingReaderAt struct{}
+
+func (failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("taco")
+}
+
+func TestServeReadAt(t *testing.T) {
+	r := strings.NewReader("burrito")
+
+	testCases := []struct {
+		offset   int64
+		size     int64
+		vectored bool
+		want     string
+	}{
+		{0, 4, false, "burr"},
+		{3, 10, false, "rito"},
+		{7, 4, false, ""},
+		{20, 4, false, ""},
+		{1, 3, true, "urr"},
+		{5, 10, true, "to"},
+	}
+
+	for _, tc := range testCases {
+		op := &fuseops.ReadFileOp{Offset: tc.offset, Size: tc.size}
+		if !tc.vectored {
+			op.Dst = make([]byte, tc.size)
+		}
+
+		if err := fuseutil.ServeReadAt(op, r); err != nil {
+			t.Errorf("%+v: ServeReadAt: %v", tc, err)
+			continue
+		}
+
+		var got []byte
+		if tc.vectored {
+			got = bytes.Join(op.Data, nil)
+		} else {
+			got = op.Dst[:op.BytesRead]
+		}
+
+		if string(got) != tc.want || op.BytesRead != len(tc.want) {
+			t.Errorf("%+v: got %q (%d bytes read), want %q", tc, got, op.BytesRead, tc.want)
+		}
+	}
+
+	op := &fuseops.ReadFileOp{Size: 4, Dst: make([]byte, 4)}
+	if err := fuseutil.ServeReadAt(op, failingReaderAt{}); err == nil {
+		t.Errorf("ServeReadAt succeeded with failing reader")
+	}
+}
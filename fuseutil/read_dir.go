@@ -0,0 +1,56 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ServeReadDir answers the supplied op with entries produced one at a time by
+// list, so that file systems can list large directories straight from a
+// backend cursor rather than materializing all of their entries. It is
+// intended to be returned directly from FileSystem.ReadDir.
+//
+// list is called once, with op.Offset. It should call emit with the entries
+// of the directory that follow that offset, in order, each with the Offset of
+// the entry after it as described on Dirent. It should stop once emit returns
+// false, which means that the entry didn't fit and should be produced again
+// by the next call, and may stop earlier. Emitting nothing means that the end
+// of the directory has been reached. If list returns an error, the op fails.
+func ServeReadDir(
+	op *fuseops.ReadDirOp,
+	list func(offset fuseops.DirOffset, emit func(Dirent) bool) error) error {
+	op.BytesRead = 0
+
+	// Once an entry doesn't fit, no later ones may be written either, even if
+	// they are smaller.
+	full := false
+	emit := func(d Dirent) bool {
+		if full {
+			return false
+		}
+
+		n := WriteDirent(op.Dst[op.BytesRead:], d)
+		if n == 0 {
+			full = true
+			return false
+		}
+
+		op.BytesRead += n
+		return true
+	}
+
+	return list(op.Offset, emit)
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// Parse the names and offsets of the entries written by WriteDirent, which
+// are in host byte order.
+func parseDirents(buf []byte) (names []string, offsets []fuseops.DirOffset) {
+	for len(buf) > 0 {
+		off := *(*uint64)(unsafe.Pointer(&buf[8]))
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		names = append(names, string(buf[24:24+namelen]))
+		offsets = append(offsets, fuseops.DirOffset(off))
+
+		size := (24 + namelen + 7) &^ 7
+		buf = buf[size:]
+	}
+
+	return
+}
+
+func TestServeReadDir(t *testing.T) {
+	// Names of varying length, so that a shorter entry might fit after one
+	// that doesn't.
+	var entries []string
+	for i := 0; i < 100; i++ {
+		entries = append(entries, strings.Repeat("x", i%13)+fmt.Sprint(i))
+	}
+
+	calls := 0
+	list := func(offset fuseops.DirOffset, emit func(fuseutil.Dirent) bool) error {
+		calls++
+		for i := int(offset); i < len(entries); i++ {
+			d := fuseutil.Dirent{
+				Offset: fuseops.DirOffset(i + 1),
+				Inode:  fuseops.InodeID(i + 2),
+				Name:   entries[i],
+			}
+
+			if !emit(d) {
+				break
+			}
+		}
+
+		return nil
+	}
+
+	// Read the whole directory in small chunks.
+	var got []string
+	op := &fuseops.ReadDirOp{}
+	for {
+		op.Dst = make([]byte, 100)
+		if err := fuseutil.ServeReadDir(op, list); err != nil {
+			t.Fatalf("ServeReadDir: %v", err)
+		}
+
+		if op.BytesRead == 0 {
+			break
+		}
+
+		names, offsets := parseDirents(op.Dst[:op.BytesRead])
+		got = append(got, names...)
+		op.Offset = offsets[len(offsets)-1]
+	}
+
+	if strings.Join(got, " ") != strings.Join(entries, " ") {
+		t.Errorf("Got entries %v", got)
+	}
+
+	if calls < 10 {
+		t.Errorf("Only %d calls to list", calls)
+	}
+}
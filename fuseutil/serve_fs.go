@@ -0,0 +1,408 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// ServeFS returns a server that serves the contents of fsys read-only, for
+// example an embed.FS, a *zip.Reader, or an fstest.MapFS:
+//
+//	server := fuseutil.ServeFS(fsys)
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{ReadOnly: true})
+//
+// Inode IDs are assigned to paths as the kernel first sees them, and kept for
+// the life of the server, so fsys must not change while it is served. Each
+// directory is listed with fs.ReadDir when it is opened. Files are read with
+// ReadAt where they support it, and otherwise by seeking or, failing that,
+// reading sequentially and reopening them to go backwards.
+//
+// Write bits are removed from the permissions fsys reports, and ops that would
+// modify the file system fail with EROFS. Symlinks aren't supported.
+func ServeFS(fsys fs.FS) fuse.Server {
+	s := &fsServer{
+		fsys:  fsys,
+		paths: []string{"."},
+		ids:   map[string]fuseops.InodeID{".": fuseops.RootInodeID},
+	}
+
+	return NewFileSystemServer(s)
+}
+
+type fsServer struct {
+	NotImplementedFileSystem
+
+	fsys  fs.FS
+	files HandleTable[*fsFile]
+	dirs  HandleTable[[]fs.DirEntry]
+
+	mu sync.Mutex
+
+	// The path of each inode, indexed by ID less fuseops.RootInodeID.
+	//
+	// GUARDED_BY(mu)
+	paths []string
+
+	// The inode for each path in paths.
+	//
+	// GUARDED_BY(mu)
+	ids map[string]fuseops.InodeID
+}
+
+// An open file.
+type fsFile struct {
+	fsys fs.FS
+	name string
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	f fs.File
+
+	// The offset that f will next be read from, if it doesn't support ReadAt.
+	//
+	// GUARDED_BY(mu)
+	off int64
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// Return the path of the supplied inode.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *fsServer) pathOf(id fuseops.InodeID) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := int(id - fuseops.RootInodeID)
+	if id < fuseops.RootInodeID || i >= len(s.paths) {
+		return "", fuse.ENOENT
+	}
+
+	return s.paths[i], nil
+}
+
+// Return the inode for the supplied path, assigning one if necessary.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *fsServer) idOf(p string) fuseops.InodeID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.ids[p]
+	if !ok {
+		id = fuseops.RootInodeID + fuseops.InodeID(len(s.paths))
+		s.paths = append(s.paths, p)
+		s.ids[p] = id
+	}
+
+	return id
+}
+
+func fsAttributes(fi fs.FileInfo) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  uint64(fi.Size()),
+		Nlink: 1,
+		Mode:  fi.Mode() &^ 0222,
+		Atime: fi.ModTime(),
+		Mtime: fi.ModTime(),
+		Ctime: fi.ModTime(),
+	}
+}
+
+func direntType(m fs.FileMode) DirentType {
+	switch {
+	case m.IsDir():
+		return DT_Directory
+	case m&fs.ModeSymlink != 0:
+		return DT_Link
+	case m&fs.ModeNamedPipe != 0:
+		return DT_FIFO
+	case m&fs.ModeSocket != 0:
+		return DT_Socket
+	case m&fs.ModeCharDevice != 0:
+		return DT_Char
+	case m&fs.ModeDevice != 0:
+		return DT_Block
+	default:
+		return DT_File
+	}
+}
+
+// ReadAt reads from the file, emulating ReadAt if the file doesn't support
+// it.
+//
+// LOCKS_EXCLUDED(f.mu)
+func (f *fsFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r, ok := f.f.(io.ReaderAt); ok {
+		return r.ReadAt(p, off)
+	}
+
+	if err := f.seek(off); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(f.f, p)
+	f.off += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// Arrange for f.f to be read from the supplied offset next.
+//
+// LOCKS_REQUIRED(f.mu)
+func (f *fsFile) seek(off int64) error {
+	if off == f.off {
+		return nil
+	}
+
+	if s, ok := f.f.(io.Seeker); ok {
+		if _, err := s.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+
+		f.off = off
+		return nil
+	}
+
+	// Start again from the beginning if we need to go backwards.
+	if off < f.off {
+		f.f.Close()
+
+		var err error
+		if f.f, err = f.fsys.Open(f.name); err != nil {
+			return err
+		}
+
+		f.off = 0
+	}
+
+	n, err := io.CopyN(io.Discard, f.f, off-f.off)
+	f.off += n
+
+	return err
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (s *fsServer) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	return nil
+}
+
+func (s *fsServer) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	parent, err := s.pathOf(op.Parent)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(parent, op.Name)
+	fi, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return err
+	}
+
+	op.Entry.Child = s.idOf(p)
+	op.Entry.Attributes = fsAttributes(fi)
+
+	return nil
+}
+
+func (s *fsServer) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	p, err := s.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	fi, err := fs.Stat(s.fsys, p)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = fsAttributes(fi)
+	return nil
+}
+
+func (s *fsServer) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	return syscall.EROFS
+}
+
+func (s *fsServer) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func (s *fsServer) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	return nil
+}
+
+func (s *fsServer) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	p, err := s.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	entries, err := fs.ReadDir(s.fsys, p)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = s.dirs.Allocate(entries)
+	return nil
+}
+
+func (s *fsServer) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	entries, ok := s.dirs.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	p, err := s.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	sink := NewReadDirSink(op)
+	for i := sink.Skip(); i < len(entries); i++ {
+		e := entries[i]
+		ok := sink.Add(Dirent{
+			Inode: s.idOf(path.Join(p, e.Name())),
+			Name:  e.Name(),
+			Type:  direntType(e.Type()),
+		})
+
+		if !ok {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *fsServer) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	s.dirs.Release(op.Handle)
+	return nil
+}
+
+func (s *fsServer) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	if !op.OpenFlags.IsReadOnly() {
+		return syscall.EROFS
+	}
+
+	p, err := s.pathOf(op.Inode)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.fsys.Open(p)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = s.files.Allocate(&fsFile{fsys: s.fsys, name: p, f: f})
+	return nil
+}
+
+func (s *fsServer) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	f, ok := s.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return ServeReadAt(op, f)
+}
+
+func (s *fsServer) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	f, ok := s.files.Release(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.f.Close()
+}
+
+func (s *fsServer) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	return syscall.EROFS
+}
+
+func (s *fsServer) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	return syscall.EROFS
+}
+
+func (s *fsServer) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return syscall.EROFS
+}
+
+func (s *fsServer) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return syscall.EROFS
+}
+
+func (s *fsServer) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return syscall.EROFS
+}
@@ -0,0 +1,177 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuseutil_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/fs"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func serveFS(t *testing.T, fsys fs.FS) *fusetesting.FakeKernel {
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.ServeFS(fsys),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	return k
+}
+
+func TestServeFS(t *testing.T) {
+	k := serveFS(t, fstest.MapFS{
+		"foo":         {Data: []byte("taco"), Mode: 0644},
+		"dir/bar":     {Data: []byte("burrito")},
+		"dir/sub/baz": {},
+	})
+	defer k.Close()
+
+	attrs, err := k.Stat("foo")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+
+	if attrs.Size != 4 || attrs.Mode != 0444 {
+		t.Errorf("Attributes: %+v", attrs)
+	}
+
+	if _, err := k.Stat("dir/qux"); err != syscall.ENOENT {
+		t.Errorf("Stat(dir/qux): %v", err)
+	}
+
+	contents, err := k.ReadFile("dir/bar")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != "burrito" {
+		t.Errorf("Contents: %q", contents)
+	}
+
+	entries, err := k.ReadDir("dir")
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	var names []string
+	var types []fuseutil.DirentType
+	for _, e := range entries {
+		names = append(names, e.Name)
+		types = append(types, e.Type)
+	}
+
+	if want := []string{"bar", "sub"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Names: %q, want %q", names, want)
+	}
+
+	wantTypes := []fuseutil.DirentType{fuseutil.DT_File, fuseutil.DT_Directory}
+	if !reflect.DeepEqual(types, wantTypes) {
+		t.Errorf("Types: %v, want %v", types, wantTypes)
+	}
+
+	// Listing again gives the same inode IDs.
+	entries2, err := k.ReadDir("dir")
+	if err != nil || !reflect.DeepEqual(entries, entries2) {
+		t.Errorf("ReadDir again: %v, %v; want %v", entries2, err, entries)
+	}
+}
+
+func TestServeFSSequentialFiles(t *testing.T) {
+	// Compressed zip files can only be read sequentially.
+	contents := strings.Repeat("taco", 10000)
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	f, err := w.Create("foo")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	f.Write([]byte(contents))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("NewReader: %v", err)
+	}
+
+	k := serveFS(t, r)
+	defer k.Close()
+
+	got, err := k.ReadFile("foo")
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(got) != contents {
+		t.Errorf("Got %d bytes, want %d", len(got), len(contents))
+	}
+
+	// Read the same handle out of order, with the inode from a listing.
+	entries, err := k.ReadDir("")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("ReadDir: %v, %v", entries, err)
+	}
+
+	inode := uint64(entries[0].Inode)
+	openIn := fusekernel.OpenIn{}
+	reply, err := k.Call(
+		fusekernel.OpOpen,
+		inode,
+		unsafe.Slice((*byte)(unsafe.Pointer(&openIn)), unsafe.Sizeof(openIn)))
+
+	if err != nil || reply.Error != 0 {
+		t.Fatalf("Open: %v, %v", err, reply.Error)
+	}
+
+	var openOut fusekernel.OpenOut
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&openOut)), unsafe.Sizeof(openOut)), reply.Body)
+
+	for _, off := range []uint64{1002, 5, 39998} {
+		in := fusekernel.ReadIn{Fh: openOut.Fh, Offset: off, Size: 4}
+		reply, err := k.Call(
+			fusekernel.OpRead,
+			inode,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)))
+
+		if err != nil || reply.Error != 0 {
+			t.Fatalf("Read(%d): %v, %v", off, err, reply.Error)
+		}
+
+		want := contents[off:]
+		if len(want) > 4 {
+			want = want[:4]
+		}
+
+		if string(reply.Body) != want {
+			t.Errorf("Read(%d): %q, want %q", off, reply.Body, want)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gofusefs serves file systems written against the RawFileSystem
+// interface of github.com/hanwen/go-fuse/v2/fuse, which includes those built
+// with its fs and pathfs packages, through this package's Connection:
+//
+//	fs := gofusefs.NewFileSystem(gofs.NewNodeFS(root, &gofs.Options{}))
+//	server := fuseutil.NewFileSystemServer(fs)
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{})
+//
+// This allows the same file system to be benchmarked under both libraries,
+// and go-fuse file systems to be migrated gradually: a fuseutil.FileSystem
+// that embeds the adapter can take over individual ops from it as they are
+// rewritten against fuseops.
+//
+// RawFileSystem mirrors the kernel protocol closely, so inode IDs and handle
+// IDs are passed through unchanged, and each op becomes a single call. Some
+// differences from go-fuse's own server remain:
+//
+//   - Init is passed a nil *fuse.Server, so file systems must not use it to
+//     send notifications or register backing files.
+//
+//   - Requests carry only the fields that fuseops exposes. In particular the
+//     caller's Gid is always zero, CreateIn.Flags is always O_RDWR|O_CREAT
+//     since CreateFileOp doesn't carry the open flags, and lock owners and
+//     file handles in GetAttrIn are never set.
+//
+//   - The kernel's node ID for a released handle isn't part of
+//     ReleaseFileHandleOp and ReleaseDirHandleOp, so the adapter recovers it
+//     from the value it attaches to handles as their HandleData. Handles must
+//     therefore be opened through the adapter.
+//
+//   - Ops that have no equivalent in fuseops, such as access(2) checks, are
+//     never delivered. Unrestricted ioctls can't be retried, as go-fuse has
+//     no way to ask for that.
+package gofusefs
@@ -0,0 +1,889 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofusefs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"syscall"
+	"time"
+	"unsafe"
+
+	gofuse "github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// NewFileSystem returns a file system that serves the supplied go-fuse file
+// system, calling its Init method first. See the package documentation for
+// details.
+func NewFileSystem(raw gofuse.RawFileSystem) fuseutil.FileSystem {
+	raw.Init(nil)
+	return &fileSystem{raw: raw}
+}
+
+type fileSystem struct {
+	fuseutil.NotImplementedFileSystem
+	raw gofuse.RawFileSystem
+}
+
+// The value attached to every handle opened through the adapter: the inode
+// it was opened on, which go-fuse expects when the handle is released.
+type openHandle struct {
+	inode fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func convertStatus(s gofuse.Status) error {
+	if s == gofuse.OK {
+		return nil
+	}
+
+	return syscall.Errno(s)
+}
+
+func header(oc *fuseops.OpContext, inode fuseops.InodeID) gofuse.InHeader {
+	return gofuse.InHeader{
+		NodeId: uint64(inode),
+		Caller: gofuse.Caller{
+			Owner: gofuse.Owner{Uid: oc.Uid, Gid: oc.Gid},
+			Pid:   oc.Pid,
+		},
+	}
+}
+
+// Find the inode that a handle was opened on, from the value attached to it.
+func handleInode(data interface{}) (fuseops.InodeID, error) {
+	h, ok := data.(openHandle)
+	if !ok {
+		return 0, syscall.ESTALE
+	}
+
+	return h.inode, nil
+}
+
+func convertAttr(a *gofuse.Attr) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  a.Size,
+		Nlink: a.Nlink,
+		Mode:  fuse.ConvertFileMode(a.Mode),
+		Rdev:  a.Rdev,
+		Atime: a.AccessTime(),
+		Mtime: a.ModTime(),
+		Ctime: a.ChangeTime(),
+		Uid:   a.Uid,
+		Gid:   a.Gid,
+	}
+}
+
+func convertEntry(out *gofuse.EntryOut, e *fuseops.ChildInodeEntry) {
+	now := time.Now()
+	e.Child = fuseops.InodeID(out.NodeId)
+	e.Generation = fuseops.GenerationNumber(out.Generation)
+	e.Attributes = convertAttr(&out.Attr)
+	e.AttributesExpiration = now.Add(out.AttrTimeout())
+	e.EntryExpiration = now.Add(out.EntryTimeout())
+}
+
+// The permission bits of a mode, without its type, as the kernel sends them
+// for mkdir(2).
+func permBits(m uint32) uint32 {
+	return m &^ syscall.S_IFMT
+}
+
+// Return the length of the directory entries that go-fuse wrote to the start
+// of buf, which must have been zeroed beforehand. go-fuse never writes an
+// entry with a zero inode number, so the first one marks the end. prefix is
+// the size of what precedes each fuse_dirent: the fuse_entry_out of a
+// READDIRPLUS entry, or nothing.
+func direntsLen(buf []byte, prefix int) int {
+	// The layout of fuse_dirent: ino, off, namelen, type, then the name padded
+	// to eight bytes.
+	const direntSize = 8 + 8 + 4 + 4
+
+	n := 0
+	for n+prefix+direntSize <= len(buf) {
+		d := n + prefix
+		if *(*uint64)(unsafe.Pointer(&buf[d])) == 0 {
+			break
+		}
+
+		nameLen := int(*(*uint32)(unsafe.Pointer(&buf[d+16])))
+		n = d + direntSize + (nameLen+7)&^7
+	}
+
+	return n
+}
+
+////////////////////////////////////////////////////////////////////////
+// File system
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	in := &gofuse.InHeader{NodeId: uint64(fuseops.RootInodeID)}
+
+	var out gofuse.StatfsOut
+	if err := convertStatus(fs.raw.StatFs(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.BlockSize = out.Frsize
+	if op.BlockSize == 0 {
+		op.BlockSize = out.Bsize
+	}
+
+	op.Blocks = out.Blocks
+	op.BlocksFree = out.Bfree
+	op.BlocksAvailable = out.Bavail
+	op.IoSize = out.Bsize
+	op.Inodes = out.Files
+	op.InodesFree = out.Ffree
+
+	return nil
+}
+
+func (fs *fileSystem) Destroy() {
+	fs.raw.OnUnmount()
+}
+
+////////////////////////////////////////////////////////////////////////
+// Inodes
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	in := header(&op.OpContext, op.Parent)
+
+	var out gofuse.EntryOut
+	s := fs.raw.Lookup(ctx.Done(), &in, op.Name, &out)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	convertEntry(&out, &op.Entry)
+	return nil
+}
+
+func (fs *fileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	in := &gofuse.GetAttrIn{InHeader: header(&op.OpContext, op.Inode)}
+
+	var out gofuse.AttrOut
+	if err := convertStatus(fs.raw.GetAttr(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.Attributes = convertAttr(&out.Attr)
+	op.AttributesExpiration = time.Now().Add(out.Timeout())
+
+	return nil
+}
+
+func (fs *fileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	in := &gofuse.SetAttrIn{}
+	in.InHeader = header(&op.OpContext, op.Inode)
+
+	if op.Handle != nil {
+		in.Valid |= gofuse.FATTR_FH
+		in.Fh = uint64(*op.Handle)
+	}
+
+	if op.Size != nil {
+		in.Valid |= gofuse.FATTR_SIZE
+		in.Size = *op.Size
+	}
+
+	if op.Mode != nil {
+		in.Valid |= gofuse.FATTR_MODE
+		in.Mode = fuse.ConvertGoMode(*op.Mode)
+	}
+
+	if op.Uid != nil {
+		in.Valid |= gofuse.FATTR_UID
+		in.Uid = *op.Uid
+	}
+
+	if op.Gid != nil {
+		in.Valid |= gofuse.FATTR_GID
+		in.Gid = *op.Gid
+	}
+
+	if op.Atime != nil {
+		in.Valid |= gofuse.FATTR_ATIME
+		in.Atime = uint64(op.Atime.Unix())
+		in.Atimensec = uint32(op.Atime.Nanosecond())
+	}
+
+	if op.Mtime != nil {
+		in.Valid |= gofuse.FATTR_MTIME
+		in.Mtime = uint64(op.Mtime.Unix())
+		in.Mtimensec = uint32(op.Mtime.Nanosecond())
+	}
+
+	var out gofuse.AttrOut
+	if err := convertStatus(fs.raw.SetAttr(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.Attributes = convertAttr(&out.Attr)
+	op.AttributesExpiration = time.Now().Add(out.Timeout())
+
+	return nil
+}
+
+func (fs *fileSystem) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	return convertStatus(fs.raw.Access(ctx.Done(), &gofuse.AccessIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Mask:     op.Mask,
+	}))
+}
+
+func (fs *fileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.raw.Forget(uint64(op.Inode), op.N)
+	return nil
+}
+
+func (fs *fileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	for _, e := range op.Entries {
+		fs.raw.Forget(uint64(e.Inode), e.N)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	in := &gofuse.MkdirIn{
+		InHeader: header(&op.OpContext, op.Parent),
+		Mode:     permBits(fuse.ConvertGoMode(op.Mode)),
+	}
+
+	var out gofuse.EntryOut
+	if err := convertStatus(fs.raw.Mkdir(ctx.Done(), in, op.Name, &out)); err != nil {
+		return err
+	}
+
+	convertEntry(&out, &op.Entry)
+	return nil
+}
+
+func (fs *fileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	in := &gofuse.MknodIn{
+		InHeader: header(&op.OpContext, op.Parent),
+		Mode:     fuse.ConvertGoMode(op.Mode),
+		Rdev:     op.Rdev,
+	}
+
+	var out gofuse.EntryOut
+	if err := convertStatus(fs.raw.Mknod(ctx.Done(), in, op.Name, &out)); err != nil {
+		return err
+	}
+
+	convertEntry(&out, &op.Entry)
+	return nil
+}
+
+func (fs *fileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	in := &gofuse.CreateIn{
+		InHeader: header(&op.OpContext, op.Parent),
+		Flags:    syscall.O_RDWR | syscall.O_CREAT,
+		Mode:     fuse.ConvertGoMode(op.Mode),
+	}
+
+	var out gofuse.CreateOut
+	if err := convertStatus(fs.raw.Create(ctx.Done(), in, op.Name, &out)); err != nil {
+		return err
+	}
+
+	convertEntry(&out.EntryOut, &op.Entry)
+	op.Handle = fuseops.HandleID(out.Fh)
+	op.HandleData = openHandle{op.Entry.Child}
+	op.UseDirectIO = out.OpenFlags&gofuse.FOPEN_DIRECT_IO != 0
+	op.NonSeekable = out.OpenFlags&gofuse.FOPEN_NONSEEKABLE != 0
+	op.Stream = out.OpenFlags&gofuse.FOPEN_STREAM != 0
+	op.ParallelDirectWrites = out.OpenFlags&gofuse.FOPEN_PARALLEL_DIRECT_WRITES != 0
+
+	return nil
+}
+
+func (fs *fileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	in := header(&op.OpContext, op.Parent)
+
+	var out gofuse.EntryOut
+	s := fs.raw.Symlink(ctx.Done(), &in, op.Target, op.Name, &out)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	convertEntry(&out, &op.Entry)
+	return nil
+}
+
+func (fs *fileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	in := &gofuse.LinkIn{
+		InHeader:  header(&op.OpContext, op.Parent),
+		Oldnodeid: uint64(op.Target),
+	}
+
+	var out gofuse.EntryOut
+	if err := convertStatus(fs.raw.Link(ctx.Done(), in, op.Name, &out)); err != nil {
+		return err
+	}
+
+	convertEntry(&out, &op.Entry)
+	return nil
+}
+
+func (fs *fileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	in := &gofuse.RenameIn{
+		InHeader: header(&op.OpContext, op.OldParent),
+		Newdir:   uint64(op.NewParent),
+	}
+
+	return convertStatus(fs.raw.Rename(ctx.Done(), in, op.OldName, op.NewName))
+}
+
+func (fs *fileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	in := header(&op.OpContext, op.Parent)
+	return convertStatus(fs.raw.Rmdir(ctx.Done(), &in, op.Name))
+}
+
+func (fs *fileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	in := header(&op.OpContext, op.Parent)
+	return convertStatus(fs.raw.Unlink(ctx.Done(), &in, op.Name))
+}
+
+func (fs *fileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	in := header(&op.OpContext, op.Inode)
+
+	target, s := fs.raw.Readlink(ctx.Done(), &in)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	op.Target = string(target)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handles
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in := &gofuse.OpenIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Flags:    syscall.O_RDONLY | syscall.O_DIRECTORY,
+	}
+
+	var out gofuse.OpenOut
+	if err := convertStatus(fs.raw.OpenDir(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.Handle = fuseops.HandleID(out.Fh)
+	op.HandleData = openHandle{op.Inode}
+	op.KeepCache = out.OpenFlags&gofuse.FOPEN_KEEP_CACHE != 0
+	op.CacheDir = out.OpenFlags&gofuse.FOPEN_CACHE_DIR != 0
+
+	return nil
+}
+
+func (fs *fileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	in := &gofuse.ReadIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   uint64(op.Offset),
+		Size:     uint32(len(op.Dst)),
+	}
+
+	// go-fuse writes the entries straight into the destination buffer, but
+	// doesn't export how much of it was used. Zero it so that the end of the
+	// entries can be found afterward.
+	for i := range op.Dst {
+		op.Dst[i] = 0
+	}
+
+	list := gofuse.NewDirEntryList(op.Dst, uint64(op.Offset))
+	if err := convertStatus(fs.raw.ReadDir(ctx.Done(), in, list)); err != nil {
+		return err
+	}
+
+	op.BytesRead = direntsLen(op.Dst, 0)
+	return nil
+}
+
+func (fs *fileSystem) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	in := &gofuse.ReadIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   uint64(op.Offset),
+		Size:     uint32(len(op.Dst)),
+	}
+
+	// As for ReadDir.
+	for i := range op.Dst {
+		op.Dst[i] = 0
+	}
+
+	list := gofuse.NewDirEntryList(op.Dst, uint64(op.Offset))
+	if err := convertStatus(fs.raw.ReadDirPlus(ctx.Done(), in, list)); err != nil {
+		return err
+	}
+
+	const prefix = int(unsafe.Sizeof(gofuse.EntryOut{}))
+	op.BytesRead = direntsLen(op.Dst, prefix)
+
+	// go-fuse converted the children's entries for the kernel itself. Leave
+	// them as fuseutil.WriteDirentPlus does instead, for the fuse package to
+	// convert when replying. The layout of each fuse_dirent is as described in
+	// direntsLen.
+	for n := 0; n < op.BytesRead; {
+		b := op.Dst[n:]
+		d := fuseutil.DirentPlus{
+			Dirent: fuseutil.Dirent{
+				Inode:  fuseops.InodeID(*(*uint64)(unsafe.Pointer(&b[prefix]))),
+				Offset: fuseops.DirOffset(*(*uint64)(unsafe.Pointer(&b[prefix+8]))),
+				Type:   fuseutil.DirentType(*(*uint32)(unsafe.Pointer(&b[prefix+20]))),
+			},
+		}
+
+		nameLen := int(*(*uint32)(unsafe.Pointer(&b[prefix+16])))
+		d.Dirent.Name = string(b[prefix+24 : prefix+24+nameLen])
+
+		if out := (*gofuse.EntryOut)(unsafe.Pointer(&b[0])); out.NodeId != 0 {
+			convertEntry(out, &d.Entry)
+		}
+
+		n += fuseutil.WriteDirentPlus(b, d)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) SyncDir(
+	ctx context.Context,
+	op *fuseops.SyncDirOp) error {
+	in := &gofuse.FsyncIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+	}
+
+	if op.DataSync {
+		in.FsyncFlags = 1
+	}
+
+	return convertStatus(fs.raw.FsyncDir(ctx.Done(), in))
+}
+
+func (fs *fileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	inode, err := handleInode(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	fs.raw.ReleaseDir(&gofuse.ReleaseIn{
+		InHeader: header(&op.OpContext, inode),
+		Fh:       uint64(op.Handle),
+	})
+
+	return nil
+}
+
+func (fs *fileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in := &gofuse.OpenIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Flags:    uint32(op.OpenFlags),
+	}
+
+	var out gofuse.OpenOut
+	if err := convertStatus(fs.raw.Open(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.Handle = fuseops.HandleID(out.Fh)
+	op.HandleData = openHandle{op.Inode}
+	op.UseDirectIO = out.OpenFlags&gofuse.FOPEN_DIRECT_IO != 0
+	op.KeepPageCache = out.OpenFlags&gofuse.FOPEN_KEEP_CACHE != 0
+	op.NonSeekable = out.OpenFlags&gofuse.FOPEN_NONSEEKABLE != 0
+	op.Stream = out.OpenFlags&gofuse.FOPEN_STREAM != 0
+	op.ParallelDirectWrites = out.OpenFlags&gofuse.FOPEN_PARALLEL_DIRECT_WRITES != 0
+
+	return nil
+}
+
+func (fs *fileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	in := &gofuse.ReadIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   uint64(op.Offset),
+		Size:     uint32(op.Size),
+	}
+
+	buf := op.Dst
+	if buf == nil {
+		buf = make([]byte, op.Size)
+	}
+
+	res, s := fs.raw.Read(ctx.Done(), in, buf)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	defer res.Done()
+
+	data, s := res.Bytes(buf)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	if op.Dst != nil {
+		op.BytesRead = copy(op.Dst, data)
+	} else {
+		op.Data = [][]byte{data}
+		op.BytesRead = len(data)
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	data := op.Data
+	if data == nil && op.Reader != nil {
+		var err error
+		if data, err = io.ReadAll(op.Reader); err != nil {
+			return fmt.Errorf("ReadAll: %w", err)
+		}
+
+		if op.Release != nil {
+			op.Release()
+		}
+	}
+
+	in := &gofuse.WriteIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   uint64(op.Offset),
+		Size:     uint32(len(data)),
+	}
+
+	written, s := fs.raw.Write(ctx.Done(), in, data)
+	if err := convertStatus(s); err != nil {
+		return err
+	}
+
+	op.BytesWritten = int(written)
+	return nil
+}
+
+func (fs *fileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	in := &gofuse.FsyncIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+	}
+
+	if op.DataSync {
+		in.FsyncFlags = 1
+	}
+
+	return convertStatus(fs.raw.Fsync(ctx.Done(), in))
+}
+
+func (fs *fileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	in := &gofuse.FlushIn{
+		InHeader:  header(&op.OpContext, op.Inode),
+		Fh:        uint64(op.Handle),
+		LockOwner: op.LockOwner,
+	}
+
+	return convertStatus(fs.raw.Flush(ctx.Done(), in))
+}
+
+func (fs *fileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	inode, err := handleInode(op.HandleData)
+	if err != nil {
+		return err
+	}
+
+	in := &gofuse.ReleaseIn{
+		InHeader:  header(&op.OpContext, inode),
+		Fh:        uint64(op.Handle),
+		LockOwner: op.LockOwner,
+	}
+
+	if op.UnlockFlocks {
+		in.ReleaseFlags |= gofuse.FUSE_RELEASE_FLOCK_UNLOCK
+	}
+
+	fs.raw.Release(ctx.Done(), in)
+
+	return nil
+}
+
+func (fs *fileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	in := &gofuse.FallocateIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   op.Offset,
+		Length:   op.Length,
+		Mode:     op.Mode,
+	}
+
+	return convertStatus(fs.raw.Fallocate(ctx.Done(), in))
+}
+
+func (fs *fileSystem) Seek(
+	ctx context.Context,
+	op *fuseops.SeekOp) error {
+	in := &gofuse.LseekIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Offset:   uint64(op.Offset),
+		Whence:   uint32(op.Whence),
+	}
+
+	var out gofuse.LseekOut
+	if err := convertStatus(fs.raw.Lseek(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.ResultOffset = int64(out.Offset)
+	return nil
+}
+
+func (fs *fileSystem) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	in := &gofuse.CopyFileRangeIn{
+		InHeader:  header(&op.OpContext, op.SrcInode),
+		FhIn:      uint64(op.SrcHandle),
+		OffIn:     op.SrcOffset,
+		NodeIdOut: uint64(op.DstInode),
+		FhOut:     uint64(op.DstHandle),
+		OffOut:    op.DstOffset,
+		Len:       op.Length,
+		Flags:     op.Flags,
+	}
+
+	n, s := fs.raw.CopyFileRange(ctx.Done(), in)
+	op.BytesCopied = uint64(n)
+	return convertStatus(s)
+}
+
+func (fs *fileSystem) Ioctl(
+	ctx context.Context,
+	op *fuseops.IoctlOp) error {
+	in := &gofuse.IoctlIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Fh:       uint64(op.Handle),
+		Cmd:      op.Cmd,
+		Arg:      op.Arg,
+		InSize:   uint32(len(op.Input)),
+		OutSize:  uint32(op.OutputSize),
+	}
+
+	var out gofuse.IoctlOut
+	outbuf := make([]byte, op.OutputSize)
+	if err := convertStatus(fs.raw.Ioctl(ctx.Done(), in, op.Input, &out, outbuf)); err != nil {
+		return err
+	}
+
+	op.Result = out.Result
+	op.Output = outbuf
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Locks
+////////////////////////////////////////////////////////////////////////
+
+func lkIn(
+	oc *fuseops.OpContext,
+	inode fuseops.InodeID,
+	handle fuseops.HandleID,
+	owner uint64,
+	lk fuseops.FileLock) *gofuse.LkIn {
+	return &gofuse.LkIn{
+		InHeader: header(oc, inode),
+		Fh:       uint64(handle),
+		Owner:    owner,
+		Lk: gofuse.FileLock{
+			Start: lk.Start,
+			End:   lk.End,
+			Typ:   lk.Type,
+			Pid:   lk.Pid,
+		},
+	}
+}
+
+func (fs *fileSystem) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	in := lkIn(&op.OpContext, op.Inode, op.Handle, op.Owner, op.Lock)
+
+	var out gofuse.LkOut
+	if err := convertStatus(fs.raw.GetLk(ctx.Done(), in, &out)); err != nil {
+		return err
+	}
+
+	op.Conflict = fuseops.FileLock{
+		Start: out.Lk.Start,
+		End:   out.Lk.End,
+		Type:  out.Lk.Typ,
+		Pid:   out.Lk.Pid,
+	}
+
+	return nil
+}
+
+func (fs *fileSystem) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	in := lkIn(&op.OpContext, op.Inode, op.Handle, op.Owner, op.Lock)
+	if op.Wait {
+		return convertStatus(fs.raw.SetLkw(ctx.Done(), in))
+	}
+
+	return convertStatus(fs.raw.SetLk(ctx.Done(), in))
+}
+
+func (fs *fileSystem) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	lk := fuseops.FileLock{
+		End:  math.MaxInt64,
+		Type: op.Type,
+	}
+
+	in := lkIn(&op.OpContext, op.Inode, op.Handle, op.Owner, lk)
+	in.LkFlags = gofuse.FUSE_LK_FLOCK
+	if op.Wait {
+		return convertStatus(fs.raw.SetLkw(ctx.Done(), in))
+	}
+
+	return convertStatus(fs.raw.SetLk(ctx.Done(), in))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Extended attributes
+////////////////////////////////////////////////////////////////////////
+
+// Report the result of GetXAttr or ListXAttr. As in go-fuse's server, ERANGE
+// isn't an error when the caller only asked for the size.
+func serveXattr(
+	dst []byte,
+	bytesRead *int,
+	n uint32,
+	s gofuse.Status) error {
+	if len(dst) == 0 && s == gofuse.ERANGE {
+		s = gofuse.OK
+	}
+
+	*bytesRead = int(n)
+	return convertStatus(s)
+}
+
+func (fs *fileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	in := header(&op.OpContext, op.Inode)
+
+	n, s := fs.raw.GetXAttr(ctx.Done(), &in, op.Name, op.Dst)
+	return serveXattr(op.Dst, &op.BytesRead, n, s)
+}
+
+func (fs *fileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	in := header(&op.OpContext, op.Inode)
+
+	n, s := fs.raw.ListXAttr(ctx.Done(), &in, op.Dst)
+	return serveXattr(op.Dst, &op.BytesRead, n, s)
+}
+
+func (fs *fileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	in := &gofuse.SetXAttrIn{
+		InHeader: header(&op.OpContext, op.Inode),
+		Size:     uint32(len(op.Value)),
+		Flags:    op.Flags,
+	}
+
+	return convertStatus(fs.raw.SetXAttr(ctx.Done(), in, op.Name, op.Value))
+}
+
+func (fs *fileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	in := header(&op.OpContext, op.Inode)
+	return convertStatus(fs.raw.RemoveXAttr(ctx.Done(), &in, op.Name))
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gofusefs_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+	gofuse "github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/gofusefs"
+)
+
+const helloContents = "Hello, world!"
+
+// A go-fuse root directory containing a single file, "hello".
+type helloRoot struct {
+	gofs.Inode
+}
+
+func (r *helloRoot) OnAdd(ctx context.Context) {
+	file := r.NewPersistentInode(ctx, &gofs.MemRegularFile{
+		Data: []byte(helloContents),
+		Attr: gofuse.Attr{Mode: 0444},
+	}, gofs.StableAttr{Ino: 2})
+
+	r.AddChild("hello", file, false)
+}
+
+// Parse the names of the entries in a ReadDirOp's output, which are in host
+// byte order.
+func parseDirentNames(buf []byte) (names []string) {
+	for len(buf) > 0 {
+		namelen := int(*(*uint32)(unsafe.Pointer(&buf[16])))
+		names = append(names, string(buf[24:24+namelen]))
+		buf = buf[(24+namelen+7)&^7:]
+	}
+
+	return
+}
+
+func TestFileSystem(t *testing.T) {
+	ctx := context.Background()
+	fs := gofusefs.NewFileSystem(gofs.NewNodeFS(&helloRoot{}, &gofs.Options{}))
+
+	lookUpOp := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "hello",
+	}
+
+	if err := fs.LookUpInode(ctx, lookUpOp); err != nil {
+		t.Fatalf("LookUpInode: %v", err)
+	}
+
+	child := lookUpOp.Entry.Child
+	if child == 0 || child == fuseops.RootInodeID {
+		t.Errorf("got inode %d", child)
+	}
+
+	if got := lookUpOp.Entry.Attributes.Size; got != uint64(len(helloContents)) {
+		t.Errorf("got size %d", got)
+	}
+
+	if got := lookUpOp.Entry.Attributes.Mode; got != 0444 {
+		t.Errorf("got mode %v", got)
+	}
+
+	// go-fuse's statuses come through as syscall.Errno.
+	err := fs.LookUpInode(ctx, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "missing",
+	})
+
+	if err != syscall.ENOENT {
+		t.Errorf("got error %v for missing name, want ENOENT", err)
+	}
+
+	// Read the file through a handle.
+	openOp := &fuseops.OpenFileOp{Inode: child}
+	if err := fs.OpenFile(ctx, openOp); err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+
+	readOp := &fuseops.ReadFileOp{
+		Inode:      child,
+		Handle:     openOp.Handle,
+		HandleData: openOp.HandleData,
+		Offset:     7,
+		Size:       100,
+		Dst:        make([]byte, 100),
+	}
+
+	if err := fs.ReadFile(ctx, readOp); err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if got := string(readOp.Dst[:readOp.BytesRead]); got != "world!" {
+		t.Errorf("read %q", got)
+	}
+
+	err = fs.ReleaseFileHandle(ctx, &fuseops.ReleaseFileHandleOp{
+		Handle:     openOp.Handle,
+		HandleData: openOp.HandleData,
+	})
+
+	if err != nil {
+		t.Errorf("ReleaseFileHandle: %v", err)
+	}
+
+	// Read the directory, which go-fuse writes straight into the buffer.
+	openDirOp := &fuseops.OpenDirOp{Inode: fuseops.RootInodeID}
+	if err := fs.OpenDir(ctx, openDirOp); err != nil {
+		t.Fatalf("OpenDir: %v", err)
+	}
+
+	readDirOp := &fuseops.ReadDirOp{
+		Inode:      fuseops.RootInodeID,
+		Handle:     openDirOp.Handle,
+		HandleData: openDirOp.HandleData,
+		Dst:        make([]byte, 1024),
+	}
+
+	// Dirty the buffer, to check that stale contents aren't mistaken for
+	// entries.
+	for i := range readDirOp.Dst {
+		readDirOp.Dst[i] = 0xff
+	}
+
+	if err := fs.ReadDir(ctx, readDirOp); err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+
+	names := parseDirentNames(readDirOp.Dst[:readDirOp.BytesRead])
+	if len(names) != 1 || names[0] != "hello" {
+		t.Errorf("got names %q, want [hello]", names)
+	}
+
+	err = fs.ReleaseDirHandle(ctx, &fuseops.ReleaseDirHandleOp{
+		Handle:     openDirOp.Handle,
+		HandleData: openDirOp.HandleData,
+	})
+
+	if err != nil {
+		t.Errorf("ReleaseDirHandle: %v", err)
+	}
+
+	// Statfs is left zeroed by go-fuse's default.
+	if err := fs.StatFS(ctx, &fuseops.StatFSOp{}); err != nil {
+		t.Errorf("StatFS: %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+module github.com/jacobsa/fuse/gofusefs
+
+go 1.20
+
+require (
+	github.com/hanwen/go-fuse/v2 v2.9.0
+	github.com/jacobsa/fuse v0.0.0
+)
+
+require (
+	github.com/jacobsa/oglematchers v0.0.0-20150720000706-141901ea67cd // indirect
+	github.com/jacobsa/timeutil v0.0.0-20170205232429-577e5acbbcf6 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
+
+replace github.com/jacobsa/fuse => ../
@@ -0,0 +1,151 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Identifies a handle to which the file system has attached a value with
+// OpenFileOp.HandleData or the like. File and directory handles are
+// distinct, since file systems may mint them independently.
+type handleDataKey struct {
+	dir    bool
+	handle fuseops.HandleID
+}
+
+// Fill in the HandleData field of an op that carries a handle, if the file
+// system attached a value to it.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) attachHandleData(op interface{}) {
+	lookUp := func(dir bool, h fuseops.HandleID) interface{} {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		return c.handleData[handleDataKey{dir, h}]
+	}
+
+	switch o := op.(type) {
+	case *fuseops.SetInodeAttributesOp:
+		if o.Handle != nil {
+			o.HandleData = lookUp(false, *o.Handle)
+		}
+
+	case *fuseops.ReadFileOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.WriteFileOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.SyncFileOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.FlushFileOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.FallocateOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.SeekOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.GetLockOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.SetLockOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.FlockOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.IoctlOp:
+		o.HandleData = lookUp(o.Dir, o.Handle)
+
+	case *fuseops.PollOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.CopyFileRangeOp:
+		o.SrcHandleData = lookUp(false, o.SrcHandle)
+		o.DstHandleData = lookUp(false, o.DstHandle)
+
+	case *fuseops.ReleaseFileHandleOp:
+		o.HandleData = lookUp(false, o.Handle)
+
+	case *fuseops.ReadDirOp:
+		o.HandleData = lookUp(true, o.Handle)
+
+	case *fuseops.ReadDirPlusOp:
+		o.HandleData = lookUp(true, o.Handle)
+
+	case *fuseops.SyncDirOp:
+		o.HandleData = lookUp(true, o.Handle)
+
+	case *fuseops.ReleaseDirHandleOp:
+		o.HandleData = lookUp(true, o.Handle)
+	}
+}
+
+// Remember the value attached to a newly opened handle, or forget the one
+// attached to a released handle, given the op and the error the file system
+// replied with. This must happen before the reply is sent, since the kernel
+// may send further ops for the handle as soon as it sees the reply.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) updateHandleData(op interface{}, opErr error) {
+	var key handleDataKey
+	var value interface{}
+	release := false
+
+	switch o := op.(type) {
+	case *fuseops.OpenFileOp:
+		key, value = handleDataKey{false, o.Handle}, o.HandleData
+
+	case *fuseops.CreateFileOp:
+		key, value = handleDataKey{false, o.Handle}, o.HandleData
+
+	case *fuseops.OpenDirOp:
+		key, value = handleDataKey{true, o.Handle}, o.HandleData
+
+	case *fuseops.ReleaseFileHandleOp:
+		key, release = handleDataKey{false, o.Handle}, true
+
+	case *fuseops.ReleaseDirHandleOp:
+		key, release = handleDataKey{true, o.Handle}, true
+
+	default:
+		return
+	}
+
+	if !release && (value == nil || opErr != nil) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Releases drop the value whether or not they succeed, since the kernel
+	// won't use the handle again either way.
+	if release {
+		delete(c.handleData, key)
+		return
+	}
+
+	if c.handleData == nil {
+		c.handleData = make(map[handleDataKey]interface{})
+	}
+
+	c.handleData[key] = value
+}
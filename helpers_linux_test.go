@@ -0,0 +1,222 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+////////////////////////////////////////////////////////////////////////
+// recordingFS
+////////////////////////////////////////////////////////////////////////
+
+// A file system that records the ops it receives and answers them with
+// canned results.
+type recordingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu  sync.Mutex
+	ops []interface{} // GUARDED_BY(mu)
+}
+
+func (fs *recordingFS) record(op interface{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.ops = append(fs.ops, op)
+}
+
+// Return the number of ops received with the same type as the supplied one.
+func (fs *recordingFS) count(example interface{}) int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n := 0
+	for _, op := range fs.ops {
+		if reflect.TypeOf(op) == reflect.TypeOf(example) {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Return the most recently received op.
+func (fs *recordingFS) last() interface{} {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.ops) == 0 {
+		return nil
+	}
+
+	return fs.ops[len(fs.ops)-1]
+}
+
+func (fs *recordingFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	fs.record(op)
+	op.Entry.Child = 17
+	return nil
+}
+
+func (fs *recordingFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.record(op)
+	return nil
+}
+
+func (fs *recordingFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	fs.record(op)
+	op.Entry.Child = 18
+	return nil
+}
+
+func (fs *recordingFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.record(op)
+	op.Entry.Child = 19
+	return nil
+}
+
+func (fs *recordingFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	fs.record(op)
+	op.Entry.Child = 20
+	op.Handle = 21
+	return nil
+}
+
+func (fs *recordingFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.record(op)
+	op.BytesRead = copy(op.Dst, "taco")
+	return nil
+}
+
+func (fs *recordingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	// The data is only valid until we return.
+	data := make([]byte, len(op.Data))
+	copy(data, op.Data)
+
+	opCopy := *op
+	opCopy.Data = data
+	fs.record(&opCopy)
+	return nil
+}
+
+// Directories are opened statelessly; see MountConfig.EnableNoOpendirSupport.
+func (fs *recordingFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.record(op)
+	return fuse.ENOSYS
+}
+
+func (fs *recordingFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	fs.record(op)
+	return nil
+}
+
+func (fs *recordingFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	fs.record(op)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// The sizes of kernel structs as sent and expected by a kernel speaking the
+// given 7.x protocol version, transcribed from the history of fuse_kernel.h
+// rather than derived from fusekernel so that the two can be checked against
+// each other.
+type kernelStructSizes struct {
+	mkdirIn  int
+	mknodIn  int
+	createIn int
+	readIn   int
+	writeIn  int
+	entryOut int
+	attrOut  int
+}
+
+func sizesForMinor(minor uint32) (s kernelStructSizes) {
+	s.mkdirIn = 8
+
+	// 7.9 added lock owners and flags to read and write, and blksize to attr.
+	s.readIn, s.writeIn = 24, 24
+	s.entryOut, s.attrOut = 120, 96
+	if minor >= 9 {
+		s.readIn, s.writeIn = 40, 40
+		s.entryOut, s.attrOut = 128, 104
+	}
+
+	// 7.12 added umask to mknod and create.
+	s.mknodIn, s.createIn = 8, 8
+	if minor >= 12 {
+		s.mknodIn, s.createIn = 16, 16
+	}
+
+	return s
+}
+
+// Encode the supplied struct, zero-padded or truncated to the given size.
+func structBytes(p unsafe.Pointer, structSize uintptr, size int) []byte {
+	b := make([]byte, size)
+	copy(b, unsafe.Slice((*byte)(p), structSize))
+	return b
+}
+
+func nameBytes(name string) []byte {
+	return append([]byte(name), 0)
+}
+
+// Mount server on a fake kernel that is closed when the test finishes,
+// failing the test if that doesn't work.
+func newFakeKernel(
+	tb testing.TB,
+	server fuse.Server,
+	mountCfg *fuse.MountConfig,
+	cfg *fusetesting.FakeKernelConfig) *fusetesting.FakeKernel {
+	k, err := fusetesting.NewFakeKernel(server, mountCfg, cfg)
+	if err != nil {
+		tb.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	tb.Cleanup(func() { k.Close() })
+	return k
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestAsyncDirectIO(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{false, fusekernel.InitAsyncDIO, false},
+		{true, 0, false},
+		{true, fusekernel.InitAsyncDIO, true},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EnableAsyncDirectIO: tc.enable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if got := flags&fusekernel.InitAsyncDIO != 0; got != tc.want {
+			t.Errorf("%+v: unexpected flags %v", tc, flags)
+		}
+
+		k.Close()
+	}
+}
+
+func TestParallelDirOps(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{false, fusekernel.InitParallelDirOps, false},
+		{true, 0, false},
+		{true, fusekernel.InitParallelDirOps, true},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EnableParallelDirOps: tc.enable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if got := flags&fusekernel.InitParallelDirOps != 0; got != tc.want {
+			t.Errorf("%+v: unexpected flags %v", tc, flags)
+		}
+
+		k.Close()
+	}
+}
+
+func TestMaxPagesInit(t *testing.T) {
+	testCases := []struct {
+		offered fusekernel.InitFlags
+		want    uint16
+	}{
+		// Older kernels don't know about the limit.
+		{0, 0},
+		{fusekernel.InitMaxPages, 256},
+	}
+
+	for _, tc := range testCases {
+		fs := &recordingFS{}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			nil,
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		out := k.InitOut()
+		flags := fusekernel.InitFlags(out.Flags)
+		if got := flags&fusekernel.InitMaxPages != 0; got != (tc.want != 0) || out.MaxPages != tc.want {
+			t.Errorf("%v: unexpected flags %v and max_pages %d", tc.offered, flags, out.MaxPages)
+		}
+
+		// The file system has room for the largest read the kernel may send.
+		in := fusekernel.ReadIn{Fh: 1, Size: 256 << 12}
+		if tc.want == 0 {
+			in.Size = 32 << 12
+		}
+
+		r, err := k.Call(
+			fusekernel.OpRead,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)))
+
+		if err != nil || r.Error != 0 || string(r.Body) != "taco" {
+			t.Errorf("%v: Read: %v, %v, %q", tc.offered, err, r.Error, r.Body)
+		}
+
+		if got := len(fs.last().(*fuseops.ReadFileOp).Dst); got != int(in.Size) {
+			t.Errorf("%v: got a %d-byte buffer", tc.offered, got)
+		}
+
+		k.Close()
+	}
+}
+
+func TestNoOpenSupport(t *testing.T) {
+	testCases := []struct {
+		offered fusekernel.InitFlags
+		want    syscall.Errno
+	}{
+		// The kernel stops sending opens once it sees ENOSYS.
+		{fusekernel.InitNoOpenSupport, syscall.ENOSYS},
+
+		// Older kernels see a successful open with a zero handle.
+		{0, 0},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EnableNoOpenSupport: true},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		negotiated := k.InitOut().Flags&uint32(fusekernel.InitNoOpenSupport) != 0
+		if negotiated != (tc.offered != 0) {
+			t.Errorf("%v: unexpected init flags %v", tc.offered, fusekernel.InitFlags(k.InitOut().Flags))
+		}
+
+		in := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+		r, err := k.Call(
+			fusekernel.OpOpen,
+			17,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != tc.want {
+			t.Errorf("%v: got error %v, want %v", tc.offered, r.Error, tc.want)
+		}
+
+		if tc.want == 0 && !bytes.Equal(r.Body, make([]byte, unsafe.Sizeof(fusekernel.OpenOut{}))) {
+			t.Errorf("%v: unexpected open reply %v", tc.offered, r.Body)
+		}
+
+		k.Close()
+	}
+}
+
+func TestNoOpendirSupport(t *testing.T) {
+	testCases := []struct {
+		offered fusekernel.InitFlags
+		opens   int
+	}{
+		// The kernel stops sending opendirs once it sees ENOSYS.
+		{fusekernel.InitNoOpendirSupport, 1},
+
+		// Older kernels keep sending them, and see successful opens.
+		{0, 2},
+	}
+
+	for _, tc := range testCases {
+		fs := &recordingFS{}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{EnableNoOpendirSupport: true},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		for i := 0; i < 2; i++ {
+			if _, err := k.ReadDir("/"); err != nil {
+				t.Errorf("%v: ReadDir: %v", tc.offered, err)
+			}
+		}
+
+		if n := fs.count(&fuseops.OpenDirOp{}); n != tc.opens {
+			t.Errorf("%v: got %d opendirs, want %d", tc.offered, n, tc.opens)
+		}
+
+		if op, ok := fs.last().(*fuseops.ReadDirOp); !ok || op.Handle != 0 {
+			t.Errorf("%v: unexpected op: %#v", tc.offered, fs.last())
+		}
+
+		k.Close()
+	}
+}
+
+func TestWritebackCacheInit(t *testing.T) {
+	testCases := []struct {
+		disable bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{true, fusekernel.InitWritebackCache, false},
+		{false, 0, false},
+		{false, fusekernel.InitWritebackCache, true},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{DisableWritebackCaching: tc.disable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if got := flags&fusekernel.InitWritebackCache != 0; got != tc.want {
+			t.Errorf("%+v: unexpected flags %v", tc, flags)
+		}
+
+		k.Close()
+	}
+}
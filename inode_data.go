@@ -0,0 +1,185 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// InodeData returns the value attached to the inode with
+// fuseops.ChildInodeEntry.Data, or nil if there is none. The context must be
+// one returned by Connection.ReadOp, or derived from one, and the file system
+// must have been mounted with MountConfig.TrackInodeData.
+//
+// Values are attached by the op that returned the entry before the kernel
+// sees the reply, and dropped once the kernel has forgotten every lookup of
+// the inode, after the file system has handled the ForgetInodeOp or
+// BatchForgetOp that brought the lookup count to zero. A file system that
+// hands out an inode again after that must attach its value again.
+func InodeData(ctx context.Context, inode fuseops.InodeID) interface{} {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return nil
+	}
+
+	return state.inodeData.get(inode)
+}
+
+// An inode that the kernel knows about, as far as inodeDataTracker is
+// concerned.
+type trackedInode struct {
+	lookups uint64
+	data    interface{}
+}
+
+// The lookup counts of the inodes handed to the kernel, and the values
+// attached to them, kept when MountConfig.TrackInodeData is set. A nil
+// tracker tracks nothing.
+type inodeDataTracker struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	inodes map[fuseops.InodeID]*trackedInode
+}
+
+func newInodeDataTracker() *inodeDataTracker {
+	return &inodeDataTracker{
+		inodes: make(map[fuseops.InodeID]*trackedInode),
+	}
+}
+
+// LOCKS_EXCLUDED(t.mu)
+func (t *inodeDataTracker) get(inode fuseops.InodeID) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if ti, ok := t.inodes[inode]; ok {
+		return ti.data
+	}
+
+	return nil
+}
+
+// Update lookup counts and attached values for the response to the op, given
+// the error the file system replied with. This must happen before the reply
+// is sent, since the kernel may forget the inode as soon as it sees it.
+//
+// LOCKS_EXCLUDED(t.mu)
+func (t *inodeDataTracker) record(op interface{}, opErr error) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// The kernel ignores errors from forgets, so they take effect regardless.
+	switch o := op.(type) {
+	case *fuseops.ForgetInodeOp:
+		t.forget(o.Inode, o.N)
+		return
+
+	case *fuseops.BatchForgetOp:
+		for _, e := range o.Entries {
+			t.forget(e.Inode, e.N)
+		}
+
+		return
+	}
+
+	if opErr != nil {
+		return
+	}
+
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.MkDirOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.MkNodeOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.CreateFileOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.CreateSymlinkOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.CreateLinkOp:
+		t.lookUp(&o.Entry)
+
+	case *fuseops.ReadDirPlusOp:
+		t.lookUpDirentsPlus(o.Dst[:o.BytesRead])
+	}
+}
+
+// Count a lookup of the entry's child, which the kernel makes for every
+// entry with a non-zero inode ID.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(t.mu)
+func (t *inodeDataTracker) lookUp(e *fuseops.ChildInodeEntry) {
+	if e.Child == 0 {
+		return
+	}
+
+	ti, ok := t.inodes[e.Child]
+	if !ok {
+		ti = &trackedInode{}
+		t.inodes[e.Child] = ti
+	}
+
+	ti.lookups++
+	if e.Data != nil {
+		ti.data = e.Data
+	}
+}
+
+// Count the lookups that the kernel makes for the entries of a READDIRPLUS
+// reply: one for each entry with a non-zero inode ID, other than "." and "..".
+// Entries carry no attached values.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(t.mu)
+func (t *inodeDataTracker) lookUpDirentsPlus(b []byte) {
+	forEachDirentPlus(b, func(d *fusekernel.DirentPlus, name string) {
+		if name != "." && name != ".." {
+			t.lookUp(&fuseops.ChildInodeEntry{Child: fuseops.InodeID(d.Entry.Nodeid)})
+		}
+	})
+}
+
+// EXCLUSIVE_LOCKS_REQUIRED(t.mu)
+func (t *inodeDataTracker) forget(inode fuseops.InodeID, n uint64) {
+	ti, ok := t.inodes[inode]
+	if !ok {
+		return
+	}
+
+	if n >= ti.lookups {
+		delete(t.inodes, inode)
+		return
+	}
+
+	ti.lookups -= n
+}
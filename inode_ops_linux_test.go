@@ -0,0 +1,293 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system that creates special files with the mode and device number
+// it is given, and records the ops it receives.
+type mkNodeFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu  sync.Mutex
+	ops []*fuseops.MkNodeOp
+}
+
+func (fs *mkNodeFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, op)
+	op.Entry.Child = fuseops.InodeID(len(fs.ops) + 1)
+	op.Entry.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  op.Mode,
+		Rdev:  op.Rdev,
+	}
+
+	return nil
+}
+
+func TestMkNode(t *testing.T) {
+	fs := &mkNodeFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{ValidateResponses: true},
+		&fusetesting.FakeKernelConfig{})
+
+	testCases := []struct {
+		name     string
+		mode     uint32
+		rdev     uint32
+		wantMode os.FileMode
+		wantRdev uint32
+	}{
+		{"fifo", syscall.S_IFIFO | 0640, 0, os.ModeNamedPipe | 0640, 0},
+		{"null", syscall.S_IFCHR | 0666, uint32(unix.Mkdev(1, 3)), os.ModeDevice | os.ModeCharDevice | 0666, uint32(unix.Mkdev(1, 3))},
+		{"sda", syscall.S_IFBLK | 0660, uint32(unix.Mkdev(8, 0)), os.ModeDevice | 0660, uint32(unix.Mkdev(8, 0))},
+
+		// Only device nodes have device numbers, whatever the file system
+		// says.
+		{"sock", syscall.S_IFSOCK | 0600, 17, os.ModeSocket | 0600, 0},
+	}
+
+	for i, tc := range testCases {
+		in := fusekernel.MknodIn{Mode: tc.mode, Rdev: tc.rdev}
+		r, err := k.Call(
+			fusekernel.OpMknod,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+			nameBytes(tc.name))
+
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != 0 {
+			t.Errorf("%s: %v", tc.name, r.Error)
+			continue
+		}
+
+		fs.mu.Lock()
+		op := fs.ops[i]
+		fs.mu.Unlock()
+
+		if op.Name != tc.name || op.Mode != tc.wantMode || op.Rdev != tc.rdev {
+			t.Errorf("%s: unexpected op: %+v", tc.name, op)
+		}
+
+		var out fusekernel.EntryOut
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		if out.Attr.Mode != tc.mode || out.Attr.Rdev != tc.wantRdev {
+			t.Errorf("%s: got mode %#o, rdev %#x", tc.name, out.Attr.Mode, out.Attr.Rdev)
+		}
+	}
+}
+
+// A file system that denies write access to everyone but the owner of its
+// root, and records the access ops it receives.
+type accessFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu  sync.Mutex
+	ops []*fuseops.AccessOp
+}
+
+func (fs *accessFS) Access(
+	ctx context.Context,
+	op *fuseops.AccessOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.ops = append(fs.ops, op)
+	if op.Mask&unix.W_OK != 0 && op.OpContext.Uid != 17 {
+		return syscall.EACCES
+	}
+
+	return nil
+}
+
+func TestAccess(t *testing.T) {
+	fs := &accessFS{}
+	for _, tc := range []struct {
+		uid     uint32
+		mask    uint32
+		wantErr syscall.Errno
+	}{
+		{17, unix.R_OK | unix.W_OK, 0},
+		{18, unix.R_OK | unix.X_OK, 0},
+		{18, unix.W_OK, syscall.EACCES},
+		{18, unix.F_OK, 0},
+	} {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{DisableDefaultPermissions: true},
+			&fusetesting.FakeKernelConfig{Uid: tc.uid, Gid: 23})
+
+		in := fusekernel.AccessIn{Mask: tc.mask}
+		r, err := k.Call(
+			fusekernel.OpAccess,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		k.Close()
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != tc.wantErr {
+			t.Errorf("Uid %d, mask %#o: got %v, want %v", tc.uid, tc.mask, r.Error, tc.wantErr)
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.ops) != 4 {
+		t.Fatalf("Got %d ops", len(fs.ops))
+	}
+
+	op := fs.ops[2]
+	if op.Inode != 1 || op.Mask != unix.W_OK || op.OpContext.Uid != 18 || op.OpContext.Gid != 23 {
+		t.Errorf("Unexpected op: %+v", op)
+	}
+}
+
+// A file system that records the forgets it receives, whether individually
+// or in batches.
+type forgetFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	forgets []fuseops.BatchForgetEntry
+	batches int
+}
+
+func (fs *forgetFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: os.ModeDir | 0755}
+	return nil
+}
+
+func (fs *forgetFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.forgets = append(fs.forgets, fuseops.BatchForgetEntry{Inode: op.Inode, N: op.N})
+	return nil
+}
+
+func (fs *forgetFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.batches++
+	fs.forgets = append(fs.forgets, op.Entries...)
+	return nil
+}
+
+func TestSplitBatchForgets(t *testing.T) {
+	entries := []fusekernel.BatchForgetEntryIn{
+		{Inode: 5, Nlookup: 1},
+		{Inode: 6, Nlookup: 3},
+		{Inode: 7, Nlookup: 2},
+	}
+
+	want := []fuseops.BatchForgetEntry{
+		{Inode: 5, N: 1},
+		{Inode: 6, N: 3},
+		{Inode: 7, N: 2},
+	}
+
+	for _, split := range []bool{false, true} {
+		fs := &forgetFS{}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{SplitBatchForgets: split},
+			&fusetesting.FakeKernelConfig{})
+
+		count := fusekernel.BatchForgetCountIn{Count: uint32(len(entries))}
+		body := [][]byte{
+			structBytes(unsafe.Pointer(&count), unsafe.Sizeof(count), int(unsafe.Sizeof(count))),
+		}
+
+		for i := range entries {
+			e := &entries[i]
+			body = append(body, structBytes(unsafe.Pointer(e), unsafe.Sizeof(*e), int(unsafe.Sizeof(*e))))
+		}
+
+		if _, err := k.Start(fusekernel.OpBatchForget, 0, body...); err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+
+		// Forgets are handled before the server reads on, so they're done once
+		// a later request has been answered, and the split ones leave nothing
+		// behind that would break it.
+		var in fusekernel.GetattrIn
+		r, err := k.Call(
+			fusekernel.OpGetattr,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		k.Close()
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != 0 {
+			t.Fatalf("Getattr: %v", r.Error)
+		}
+
+		fs.mu.Lock()
+		if !reflect.DeepEqual(fs.forgets, want) {
+			t.Errorf("Split %v: got forgets %v, want %v", split, fs.forgets, want)
+		}
+
+		wantBatches := 1
+		if split {
+			wantBatches = 0
+		}
+
+		if fs.batches != wantBatches {
+			t.Errorf("Split %v: got %d batches", split, fs.batches)
+		}
+		fs.mu.Unlock()
+	}
+}
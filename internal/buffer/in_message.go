@@ -15,6 +15,7 @@
 package buffer
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"sync"
@@ -32,6 +33,15 @@ var pageSize int
 // associated with a write request.
 var bufSize int
 
+// ErrMalformed is wrapped by the errors InMessage.Init returns for messages
+// that were read successfully but are malformed.
+var ErrMalformed = errors.New("malformed message")
+
+// ErrSpliceUnsupported is wrapped by the errors InMessage.InitSplice returns
+// when messages can't be spliced, either on this platform or because a pipe
+// large enough for them can't be made. Callers should use Init instead.
+var ErrSpliceUnsupported = errors.New("splice unsupported")
+
 func init() {
 	pageSize = syscall.Getpagesize()
 	bufSize = pageSize + MaxWriteSize
@@ -44,15 +54,60 @@ type InMessage struct {
 	remaining []byte
 	storage   []byte
 	size      int
+
+	// Set for messages created by NewAlignedInMessage.
+	aligned       bool
+	payloadOffset int
+
+	// Set for messages read by InitSplice: the pipe that they were spliced
+	// into, and the number of bytes of data left in it.
+	pipe    *splicePipe
+	payload int
 }
 
-// NewInMessage creates a new InMessage with its storage initialized.
+// NewInMessage creates a new InMessage with its storage initialized, large
+// enough for a write of MaxWriteSize bytes.
 func NewInMessage() *InMessage {
+	return NewInMessageSize(bufSize)
+}
+
+// NewInMessageSize is like NewInMessage, but with room for messages of up to
+// size bytes.
+func NewInMessageSize(size int) *InMessage {
+	return &InMessage{
+		storage: make([]byte, size),
+	}
+}
+
+// NewAlignedInMessage is like NewInMessageSize, but places its storage so
+// that the byte at payloadOffset within a message is page-aligned, and so
+// that GetFree returns page-aligned buffers. Choosing the offset at which the
+// data of a write request starts makes that data page-aligned.
+func NewAlignedInMessage(payloadOffset int, size int) *InMessage {
+	// Leave room for moving the start of the message forward by up to a page,
+	// and for aligning the start of free space.
+	size += pageSize
+	b := make([]byte, size+pageSize)
+	start := alignmentPadding(unsafe.Pointer(&b[payloadOffset]))
+
 	return &InMessage{
-		storage: make([]byte, bufSize),
+		storage:       b[start : start+size],
+		aligned:       true,
+		payloadOffset: payloadOffset,
 	}
 }
 
+// AlignedFor returns true if m was created by NewAlignedInMessage with the
+// given payload offset.
+func (m *InMessage) AlignedFor(payloadOffset int) bool {
+	return m.aligned && m.payloadOffset == payloadOffset
+}
+
+// The number of bytes from p to the next page boundary.
+func alignmentPadding(p unsafe.Pointer) int {
+	return (pageSize - int(uintptr(p)%uintptr(pageSize))) % pageSize
+}
+
 var readLock sync.Mutex
 
 func (m *InMessage) ReadSingle(r io.Reader) (int, error) {
@@ -92,7 +147,7 @@ func (m *InMessage) Init(r io.Reader) error {
 	// Make sure the message is long enough.
 	const headerSize = unsafe.Sizeof(fusekernel.InHeader{})
 	if uintptr(n) < headerSize {
-		return fmt.Errorf("Unexpectedly read only %d bytes.", n)
+		return fmt.Errorf("%w: Unexpectedly read only %d bytes.", ErrMalformed, n)
 	}
 
 	m.size = n
@@ -101,7 +156,8 @@ func (m *InMessage) Init(r io.Reader) error {
 	// Check the header's length.
 	if int(m.Header().Len) != n {
 		return fmt.Errorf(
-			"Header says %d bytes, but we read %d",
+			"%w: Header says %d bytes, but we read %d",
+			ErrMalformed,
 			m.Header().Len,
 			n)
 	}
@@ -114,11 +170,23 @@ func (m *InMessage) Header() *fusekernel.InHeader {
 	return (*fusekernel.InHeader)(unsafe.Pointer(&m.storage[0]))
 }
 
+// PayloadLen returns the number of bytes of data that InitSplice left in the
+// pipe, which are not part of the message and must instead be consumed with
+// ReadPayload or WritePayloadTo.
+func (m *InMessage) PayloadLen() int {
+	return m.payload
+}
+
 // Return the number of bytes left to consume.
 func (m *InMessage) Len() uintptr {
 	return uintptr(len(m.remaining))
 }
 
+// Return the bytes left to consume, without consuming them.
+func (m *InMessage) Remaining() []byte {
+	return m.remaining
+}
+
 // Consume the next n bytes from the message, returning a nil pointer if there
 // are fewer than n bytes available.
 func (m *InMessage) Consume(n uintptr) unsafe.Pointer {
@@ -145,10 +213,17 @@ func (m *InMessage) ConsumeBytes(n uintptr) []byte {
 	return b
 }
 
-// Get the next n bytes after the message to use them as a temporary buffer
+// Get the next n bytes after the message to use them as a temporary buffer.
+// For messages created by NewAlignedInMessage, the buffer starts at the next
+// page boundary instead.
 func (m *InMessage) GetFree(n int) []byte {
-	if n <= 0 || n > len(m.storage)-m.size {
+	start := m.size
+	if m.aligned && start < len(m.storage) {
+		start += alignmentPadding(unsafe.Pointer(&m.storage[start]))
+	}
+
+	if n <= 0 || n > len(m.storage)-start {
 		return nil
 	}
-	return m.storage[m.size : m.size+n]
+	return m.storage[start : start+n]
 }
@@ -19,3 +19,6 @@ package buffer
 // Experimentally, OS X appears to cap the size of writes to 1 MiB, regardless
 // of whether a larger size is specified in the mount options.
 const MaxWriteSize = 1 << 20
+
+// The largest write size that a file system may ask for.
+const MaxWriteSizeLimit = MaxWriteSize
@@ -18,3 +18,8 @@ package buffer
 //
 // As of kernel 4.20 Linux accepts writes up to 256 pages or 1MiB
 const MaxWriteSize = 1 << 20
+
+// The largest write size that a file system may ask for. Linux 6.13 and later
+// accept up to 65535 pages per request if /proc/sys/fs/fuse/max_pages_limit
+// is raised, and split larger writes at 256 pages otherwise.
+const MaxWriteSizeLimit = (1<<16 - 1) << 12
@@ -0,0 +1,44 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import "io"
+
+// OS X has no splice(2), so messages are never left in a pipe.
+type splicePipe struct{}
+
+// InitSplice always fails with ErrSpliceUnsupported on OS X.
+func (m *InMessage) InitSplice(fd int, maxSize int, writeInSize int) error {
+	return ErrSpliceUnsupported
+}
+
+// ReadPayload always returns io.EOF on OS X.
+func (m *InMessage) ReadPayload(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// WritePayloadTo writes nothing on OS X.
+func (m *InMessage) WritePayloadTo(w io.Writer) (int64, error) {
+	return 0, nil
+}
+
+// FillPayload does nothing on OS X.
+func (m *InMessage) FillPayload() error {
+	return nil
+}
+
+// DiscardPayload does nothing on OS X.
+func (m *InMessage) DiscardPayload() {
+}
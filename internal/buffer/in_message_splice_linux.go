@@ -0,0 +1,272 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package buffer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A pipe that messages are spliced into. The files close themselves once
+// garbage, along with the message that owns them.
+type splicePipe struct {
+	r    *os.File
+	w    *os.File
+	size int
+}
+
+// Make sure that m has an empty pipe that can hold size bytes.
+func (m *InMessage) preparePipe(size int) error {
+	if m.pipe != nil && m.pipe.size >= size {
+		m.DiscardPayload()
+		if m.pipe != nil {
+			return nil
+		}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("%w: Pipe: %v", ErrSpliceUnsupported, err)
+	}
+
+	// The kernel refuses to splice a message into a pipe that doesn't have a
+	// buffer free for each of its pages.
+	actual, err := unix.FcntlInt(w.Fd(), unix.F_SETPIPE_SZ, size)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return fmt.Errorf("%w: F_SETPIPE_SZ(%d): %v", ErrSpliceUnsupported, size, err)
+	}
+
+	if m.pipe != nil {
+		m.pipe.r.Close()
+		m.pipe.w.Close()
+	}
+
+	m.pipe = &splicePipe{r: r, w: w, size: actual}
+	m.payload = 0
+
+	return nil
+}
+
+// InitSplice is like Init, but moves the message from the file descriptor fd
+// into a pipe with splice(2), which the kernel can do without copying it, and
+// then reads from the pipe only as much as it must. For write requests that is
+// the header and the writeInSize bytes of fusekernel.WriteIn after it, and the
+// data to write is left in the pipe; see PayloadLen. Other requests are read
+// in full. maxSize is the size of the largest message that may be read.
+func (m *InMessage) InitSplice(fd int, maxSize int, writeInSize int) error {
+	if err := m.preparePipe(maxSize); err != nil {
+		return err
+	}
+
+	n, err := unix.Splice(fd, nil, int(m.pipe.w.Fd()), nil, maxSize, unix.SPLICE_F_MOVE)
+	if err != nil {
+		return &os.PathError{Op: "splice", Path: "/dev/fuse", Err: err}
+	}
+
+	m.payload = int(n)
+
+	// Make sure the message is long enough.
+	const headerSize = unsafe.Sizeof(fusekernel.InHeader{})
+	if uintptr(n) < headerSize {
+		m.DiscardPayload()
+		return fmt.Errorf("%w: Unexpectedly read only %d bytes.", ErrMalformed, n)
+	}
+
+	if err := m.readPipe(m.storage[:headerSize]); err != nil {
+		return err
+	}
+
+	// Check the header's length.
+	if int64(m.Header().Len) != n {
+		m.DiscardPayload()
+		return fmt.Errorf(
+			"%w: Header says %d bytes, but we read %d",
+			ErrMalformed,
+			m.Header().Len,
+			n)
+	}
+
+	// Leave the data of writes in the pipe.
+	keep := int(n)
+	if m.Header().Opcode == fusekernel.OpWrite && keep > int(headerSize)+writeInSize {
+		keep = int(headerSize) + writeInSize
+	}
+
+	if err := m.readPipe(m.storage[headerSize:keep]); err != nil {
+		return err
+	}
+
+	m.size = keep
+	m.remaining = m.storage[headerSize:keep]
+
+	return nil
+}
+
+// Read exactly len(b) bytes from the pipe.
+func (m *InMessage) readPipe(b []byte) error {
+	n, err := io.ReadFull(m.pipe.r, b)
+	m.payload -= n
+	if err != nil {
+		return fmt.Errorf("Reading from pipe: %w", err)
+	}
+
+	return nil
+}
+
+// ReadPayload reads up to len(b) bytes of the data that InitSplice left in the
+// pipe, returning io.EOF once there is none left.
+func (m *InMessage) ReadPayload(b []byte) (int, error) {
+	if m.payload == 0 {
+		return 0, io.EOF
+	}
+
+	if len(b) > m.payload {
+		b = b[:m.payload]
+	}
+
+	n, err := m.pipe.r.Read(b)
+	m.payload -= n
+
+	return n, err
+}
+
+// WritePayloadTo writes the data that InitSplice left in the pipe to w. If w
+// is backed by a file descriptor, for example an *os.File or a *net.TCPConn,
+// the data is spliced to it without being copied into userspace.
+func (m *InMessage) WritePayloadTo(w io.Writer) (int64, error) {
+	var written int64
+	if sc, ok := w.(syscall.Conn); ok {
+		n, fallBack, err := m.splicePayloadTo(sc)
+		written += n
+		if !fallBack {
+			return written, err
+		}
+	}
+
+	// Copy whatever is left through the free part of the message's storage.
+	buf := m.storage[m.size:]
+	for m.payload > 0 {
+		n, err := m.ReadPayload(buf)
+		if err != nil {
+			return written, err
+		}
+
+		n, err = w.Write(buf[:n])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Splice the data left in the pipe to the file descriptor behind sc. Returns
+// fallBack set if that turned out not to be possible before anything was
+// written, in which case the caller should copy the data instead.
+func (m *InMessage) splicePayloadTo(sc syscall.Conn) (written int64, fallBack bool, err error) {
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, true, nil
+	}
+
+	var spliceErr error
+	err = rc.Write(func(fd uintptr) bool {
+		for m.payload > 0 {
+			n, err := unix.Splice(
+				int(m.pipe.r.Fd()),
+				nil,
+				int(fd),
+				nil,
+				m.payload,
+				unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+
+			switch err {
+			case nil:
+			case unix.EINTR:
+				continue
+
+			// Wait for a non-blocking destination to have room.
+			case unix.EAGAIN:
+				return false
+
+			default:
+				spliceErr = err
+				return true
+			}
+
+			m.payload -= int(n)
+			written += n
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return written, false, err
+	}
+
+	// Some destinations, such as files opened with O_APPEND, can't be spliced
+	// to.
+	if spliceErr == unix.EINVAL && written == 0 {
+		return 0, true, nil
+	}
+
+	if spliceErr != nil {
+		return written, false, fmt.Errorf("splice: %w", spliceErr)
+	}
+
+	return written, false, nil
+}
+
+// FillPayload reads any data that InitSplice left in the pipe into the
+// message, so that it can be consumed like that of any other.
+func (m *InMessage) FillPayload() error {
+	n := m.payload
+	if n == 0 {
+		return nil
+	}
+
+	if err := m.readPipe(m.storage[m.size : m.size+n]); err != nil {
+		return err
+	}
+
+	m.size += n
+	m.remaining = m.remaining[:len(m.remaining)+n]
+
+	return nil
+}
+
+// DiscardPayload drops any data that InitSplice left in the pipe, and with it
+// the contents of the message.
+func (m *InMessage) DiscardPayload() {
+	for m.payload > 0 {
+		if _, err := m.ReadPayload(m.storage); err != nil {
+			// The pipe is unusable. Let it be replaced.
+			m.pipe.r.Close()
+			m.pipe.w.Close()
+			m.pipe = nil
+			m.payload = 0
+		}
+	}
+}
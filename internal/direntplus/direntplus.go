@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package direntplus defines how fuseutil.WriteDirentPlus leaves a child's
+// entry in the buffer of a fuseops.ReadDirPlusOp for the fuse package, which
+// converts it for the kernel when replying. The entry's expiration times can
+// only be converted then, against the connection's clock.
+package direntplus
+
+import (
+	"os"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The times of an entry, in the order of Entry.Secs and Entry.Nsecs.
+const (
+	atime = iota
+	mtime
+	ctime
+	crtime
+	entryExpiration
+	attributesExpiration
+	numTimes
+)
+
+// Entry is a fuseops.ChildInodeEntry without its Data, laid out within the
+// fuse_entry_out into which it will be converted. The child's ID comes first,
+// where fuse_entry_out keeps the node ID.
+type Entry struct {
+	Child      uint64
+	Generation uint64
+	Size       uint64
+	Nlink      uint32
+	Mode       uint32
+	Rdev       uint32
+	Uid        uint32
+	Gid        uint32
+	padding    uint32
+	Secs       [numTimes]int64
+	Nsecs      [numTimes]uint32
+}
+
+// Entry must fit in the space of the fuse_entry_out.
+var _ [unsafe.Sizeof(fusekernel.EntryOut{}) - unsafe.Sizeof(Entry{})]byte
+
+// Encode returns the supplied entry in the form of an Entry.
+func Encode(e *fuseops.ChildInodeEntry) Entry {
+	out := Entry{
+		Child:      uint64(e.Child),
+		Generation: uint64(e.Generation),
+		Size:       e.Attributes.Size,
+		Nlink:      e.Attributes.Nlink,
+		Mode:       uint32(e.Attributes.Mode),
+		Rdev:       e.Attributes.Rdev,
+		Uid:        e.Attributes.Uid,
+		Gid:        e.Attributes.Gid,
+	}
+
+	times := [numTimes]time.Time{
+		atime:                e.Attributes.Atime,
+		mtime:                e.Attributes.Mtime,
+		ctime:                e.Attributes.Ctime,
+		crtime:               e.Attributes.Crtime,
+		entryExpiration:      e.EntryExpiration,
+		attributesExpiration: e.AttributesExpiration,
+	}
+
+	for i, t := range times {
+		out.Secs[i] = t.Unix()
+		out.Nsecs[i] = uint32(t.Nanosecond())
+	}
+
+	return out
+}
+
+// Decode returns the entry that Encode turned into the supplied Entry.
+func Decode(e *Entry) fuseops.ChildInodeEntry {
+	var times [numTimes]time.Time
+	for i := range times {
+		times[i] = time.Unix(e.Secs[i], int64(e.Nsecs[i]))
+	}
+
+	return fuseops.ChildInodeEntry{
+		Child:      fuseops.InodeID(e.Child),
+		Generation: fuseops.GenerationNumber(e.Generation),
+		Attributes: fuseops.InodeAttributes{
+			Size:   e.Size,
+			Nlink:  e.Nlink,
+			Mode:   os.FileMode(e.Mode),
+			Rdev:   e.Rdev,
+			Atime:  times[atime],
+			Mtime:  times[mtime],
+			Ctime:  times[ctime],
+			Crtime: times[crtime],
+			Uid:    e.Uid,
+			Gid:    e.Gid,
+		},
+		EntryExpiration:      times[entryExpiration],
+		AttributesExpiration: times[attributesExpiration],
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package direntplus
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Date(2012, 8, 15, 22, 56, 0, 123456789, time.UTC)
+	in := fuseops.ChildInodeEntry{
+		Child:      17,
+		Generation: 19,
+		Attributes: fuseops.InodeAttributes{
+			Size:  23,
+			Nlink: 2,
+			Mode:  os.ModeDir | 0755,
+			Rdev:  29,
+			Atime: now,
+			Mtime: now.Add(time.Second),
+			Ctime: now.Add(time.Minute),
+			Uid:   31,
+			Gid:   37,
+		},
+		EntryExpiration:      now.Add(time.Hour),
+		AttributesExpiration: now.Add(2 * time.Hour),
+	}
+
+	e := Encode(&in)
+	out := Decode(&e)
+
+	// Times come back as the same instants in the local time zone, including
+	// the zero Crtime.
+	for _, p := range []struct{ got, want *time.Time }{
+		{&out.Attributes.Atime, &in.Attributes.Atime},
+		{&out.Attributes.Mtime, &in.Attributes.Mtime},
+		{&out.Attributes.Ctime, &in.Attributes.Ctime},
+		{&out.Attributes.Crtime, &in.Attributes.Crtime},
+		{&out.EntryExpiration, &in.EntryExpiration},
+		{&out.AttributesExpiration, &in.AttributesExpiration},
+	} {
+		if !p.got.Equal(*p.want) {
+			t.Errorf("Got time %v, want %v", *p.got, *p.want)
+		}
+
+		*p.got = *p.want
+	}
+
+	if out != in {
+		t.Errorf("Got %+v, want %+v", out, in)
+	}
+}
@@ -66,7 +66,7 @@ type Kstatfs struct {
 	Spare   [6]uint32
 }
 
-type fileLock struct {
+type FileLock struct {
 	Start uint64
 	End   uint64
 	Type  uint32
@@ -164,6 +164,8 @@ const (
 	OpenExclusive OpenFlags = syscall.O_EXCL
 	OpenSync      OpenFlags = syscall.O_SYNC
 	OpenTruncate  OpenFlags = syscall.O_TRUNC
+	OpenNonblock  OpenFlags = syscall.O_NONBLOCK
+	OpenDataSync  OpenFlags = syscall.O_DSYNC
 )
 
 // OpenAccessModeMask is a bitmask that separates the access mode
@@ -199,6 +201,72 @@ func (fl OpenFlags) IsReadWrite() bool {
 	return fl&OpenAccessModeMask == OpenReadWrite
 }
 
+// Return the access mode. An access mode of O_ACCMODE, which Linux allows
+// for opening a file for ioctl(2) alone, is reported as AccessReadWrite,
+// since the kernel requires both read and write permission for it.
+func (fl OpenFlags) AccessMode() AccessMode {
+	switch fl & OpenAccessModeMask {
+	case OpenReadOnly:
+		return AccessReadOnly
+	case OpenWriteOnly:
+		return AccessWriteOnly
+	default:
+		return AccessReadWrite
+	}
+}
+
+// Return true if OpenAppend is set.
+func (fl OpenFlags) IsAppend() bool {
+	return fl&OpenAppend != 0
+}
+
+// Return true if OpenTruncate is set. Note that on Linux the kernel only
+// passes it on when the file system has asked for it with
+// MountConfig.EnableAtomicTrunc, otherwise truncating by other means.
+func (fl OpenFlags) IsTruncate() bool {
+	return fl&OpenTruncate != 0
+}
+
+// Return true if OpenDirect is set. Always false on OS X, which has no
+// O_DIRECT.
+func (fl OpenFlags) IsDirect() bool {
+	return fl&OpenDirect != 0
+}
+
+// Return true if OpenSync or OpenDataSync is set, meaning that the data
+// written must be durable before the write returns.
+func (fl OpenFlags) IsSync() bool {
+	return fl&(OpenSync|OpenDataSync) != 0
+}
+
+// Return true if OpenNonblock is set.
+func (fl OpenFlags) IsNonblock() bool {
+	return fl&OpenNonblock != 0
+}
+
+// AccessMode is the mutually exclusive part of OpenFlags saying whether a
+// file is opened for reading, writing, or both.
+type AccessMode int
+
+const (
+	AccessReadOnly AccessMode = iota
+	AccessWriteOnly
+	AccessReadWrite
+)
+
+func (m AccessMode) String() string {
+	switch m {
+	case AccessReadOnly:
+		return "AccessReadOnly"
+	case AccessWriteOnly:
+		return "AccessWriteOnly"
+	case AccessReadWrite:
+		return "AccessReadWrite"
+	default:
+		return fmt.Sprintf("AccessMode(%d)", int(m))
+	}
+}
+
 func accModeName(flags OpenFlags) string {
 	switch flags {
 	case OpenReadOnly:
@@ -217,7 +285,10 @@ var openFlagNames = []flagName{
 	{uint32(OpenExclusive), "OpenExclusive"},
 	{uint32(OpenTruncate), "OpenTruncate"},
 	{uint32(OpenAppend), "OpenAppend"},
+	{uint32(OpenDataSync), "OpenDataSync"},
 	{uint32(OpenSync), "OpenSync"},
+	{uint32(OpenNonblock), "OpenNonblock"},
+	{uint32(OpenDirect), "OpenDirect"},
 }
 
 // The OpenResponseFlags are returned in the OpenResponse.
@@ -228,6 +299,9 @@ const (
 	OpenKeepCache   OpenResponseFlags = 1 << 1 // don't invalidate the data cache on open
 	OpenNonSeekable OpenResponseFlags = 1 << 2 // mark the file as non-seekable (not supported on OS X)
 	OpenCacheDir    OpenResponseFlags = 1 << 3 // allow caching this directory
+	OpenStream      OpenResponseFlags = 1 << 4 // the file is stream-like (no file position at all)
+
+	OpenParallelDirectWrites OpenResponseFlags = 1 << 6 // allow concurrent direct writes to the file (7.36)
 
 	OpenPurgeAttr OpenResponseFlags = 1 << 30 // OS X
 	OpenPurgeUBC  OpenResponseFlags = 1 << 31 // OS X
@@ -242,6 +316,8 @@ var openResponseFlagNames = []flagName{
 	{uint32(OpenKeepCache), "OpenKeepCache"},
 	{uint32(OpenNonSeekable), "OpenNonSeekable"},
 	{uint32(OpenCacheDir), "OpenCacheDir"},
+	{uint32(OpenStream), "OpenStream"},
+	{uint32(OpenParallelDirectWrites), "OpenParallelDirectWrites"},
 	{uint32(OpenPurgeAttr), "OpenPurgeAttr"},
 	{uint32(OpenPurgeUBC), "OpenPurgeUBC"},
 }
@@ -303,6 +379,7 @@ var initFlagNames = []flagName{
 	{uint32(InitAsyncDIO), "InitAsyncDIO"},
 	{uint32(InitWritebackCache), "InitWritebackCache"},
 	{uint32(InitNoOpenSupport), "InitNoOpenSupport"},
+	{uint32(InitParallelDirOps), "InitParallelDirOps"},
 	{uint32(InitCacheSymlinks), "InitCacheSymlinks"},
 	{uint32(InitNoOpendirSupport), "InitNoOpendirSupport"},
 
@@ -339,6 +416,9 @@ type ReleaseFlags uint32
 
 const (
 	ReleaseFlush ReleaseFlags = 1 << 0
+
+	// Release the flock locks held by the LockOwner field.
+	ReleaseFlockUnlock ReleaseFlags = 1 << 1
 )
 
 func (fl ReleaseFlags) String() string {
@@ -347,6 +427,40 @@ func (fl ReleaseFlags) String() string {
 
 var releaseFlagNames = []flagName{
 	{uint32(ReleaseFlush), "ReleaseFlush"},
+	{uint32(ReleaseFlockUnlock), "ReleaseFlockUnlock"},
+}
+
+// FsyncFlags are bit flags that can be seen in FsyncIn.
+type FsyncFlags uint32
+
+const (
+	// Only the data needed to read back what was written need be synced, as
+	// for fdatasync(2).
+	FsyncFdatasync FsyncFlags = 1 << 0
+)
+
+var fsyncFlagNames = []flagName{
+	{uint32(FsyncFdatasync), "FsyncFdatasync"},
+}
+
+func (fl FsyncFlags) String() string {
+	return flagString(uint32(fl), fsyncFlagNames)
+}
+
+// LkFlags are bit flags that can be seen in LkIn.
+type LkFlags uint32
+
+const (
+	// The lock was set with flock(2) rather than fcntl(2).
+	LkFlock LkFlags = 1 << 0
+)
+
+var lkFlagNames = []flagName{
+	{uint32(LkFlock), "LkFlock"},
+}
+
+func (fl LkFlags) String() string {
+	return flagString(uint32(fl), lkFlagNames)
 }
 
 // Opcodes
@@ -389,6 +503,7 @@ const (
 	OpDestroy     = 38
 	OpIoctl       = 39 // Linux?
 	OpPoll        = 40 // Linux?
+	OpNotifyReply = 41
 	OpBatchForget = 42
 	OpFallocate   = 43
 	OpReaddirplus = 44
@@ -566,8 +681,8 @@ func CreateInSize(p Protocol) uintptr {
 type ReleaseIn struct {
 	Fh           uint64
 	Flags        uint32
-	ReleaseFlags uint32
-	LockOwner    uint32
+	ReleaseFlags ReleaseFlags
+	LockOwner    uint64
 }
 
 type FlushIn struct {
@@ -662,7 +777,7 @@ type StatfsOut struct {
 
 type FsyncIn struct {
 	Fh         uint64
-	FsyncFlags uint32
+	FsyncFlags FsyncFlags
 	Padding    uint32
 }
 
@@ -702,11 +817,32 @@ type FallocateIn struct {
 	Padding uint32
 }
 
+type LseekIn struct {
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+type LseekOut struct {
+	Offset uint64
+}
+
+type CopyFileRangeIn struct {
+	FhIn      uint64
+	OffIn     uint64
+	NodeidOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type LkIn struct {
 	Fh      uint64
 	Owner   uint64
-	Lk      fileLock
-	LkFlags uint32
+	Lk      FileLock
+	LkFlags LkFlags
 	padding uint32
 }
 
@@ -720,7 +856,99 @@ func LkInSize(p Protocol) uintptr {
 }
 
 type LkOut struct {
-	Lk fileLock
+	Lk FileLock
+}
+
+type IoctlIn struct {
+	Fh      uint64
+	Flags   IoctlFlags
+	Cmd     uint32
+	Arg     uint64
+	InSize  uint32
+	OutSize uint32
+}
+
+type IoctlOut struct {
+	Result  int32
+	Flags   IoctlFlags
+	InIovs  uint32
+	OutIovs uint32
+}
+
+// IoctlIovec describes a region of the caller's memory, in the reply to an
+// unrestricted ioctl that asks for a retry.
+type IoctlIovec struct {
+	Base uint64
+	Len  uint64
+}
+
+// The most regions that a retry may ask for, in and out together.
+const IoctlMaxIov = 256
+
+// IoctlFlags are bit flags that can be seen in IoctlIn and IoctlOut.
+type IoctlFlags uint32
+
+const (
+	// The caller is a 32-bit process on a 64-bit kernel.
+	IoctlCompat IoctlFlags = 1 << 0
+
+	// The file system may ask for a retry with arbitrary regions of the
+	// caller's memory. Only CUSE sends these.
+	IoctlUnrestricted IoctlFlags = 1 << 1
+
+	// In IoctlOut: retry with the regions that follow.
+	IoctlRetry IoctlFlags = 1 << 2
+
+	// The kernel is 32-bit.
+	Ioctl32Bit IoctlFlags = 1 << 3
+
+	// The ioctl is on a directory.
+	IoctlDir IoctlFlags = 1 << 4
+
+	// The caller is an x32 process on a 64-bit kernel.
+	IoctlCompatX32 IoctlFlags = 1 << 5
+)
+
+var ioctlFlagNames = []flagName{
+	{uint32(IoctlCompat), "IoctlCompat"},
+	{uint32(IoctlUnrestricted), "IoctlUnrestricted"},
+	{uint32(IoctlRetry), "IoctlRetry"},
+	{uint32(Ioctl32Bit), "Ioctl32Bit"},
+	{uint32(IoctlDir), "IoctlDir"},
+	{uint32(IoctlCompatX32), "IoctlCompatX32"},
+}
+
+func (fl IoctlFlags) String() string {
+	return flagString(uint32(fl), ioctlFlagNames)
+}
+
+type PollIn struct {
+	Fh     uint64
+	Kh     uint64
+	Flags  PollFlags
+	Events uint32
+}
+
+type PollOut struct {
+	Revents uint32
+	padding uint32
+}
+
+// PollFlags are bit flags that can be seen in PollIn.
+type PollFlags uint32
+
+const (
+	// The caller will wait, and wants a NotifyCodePoll notification for the
+	// Kh field once there are events for it.
+	PollScheduleNotify PollFlags = 1 << 0
+)
+
+var pollFlagNames = []flagName{
+	{uint32(PollScheduleNotify), "PollScheduleNotify"},
+}
+
+func (fl PollFlags) String() string {
+	return flagString(uint32(fl), pollFlagNames)
 }
 
 type AccessIn struct {
@@ -794,12 +1022,29 @@ type Dirent struct {
 
 const DirentSize = 8 + 8 + 4 + 4
 
+// An entry in the reply to a READDIRPLUS: a Dirent preceded by the EntryOut
+// that a lookup of its name would have returned, and followed by the name
+// padded to eight bytes.
+type DirentPlus struct {
+	Entry  EntryOut
+	Dirent Dirent
+}
+
+const DirentPlusSize = int(unsafe.Sizeof(EntryOut{})) + DirentSize
+
 const (
 	NotifyCodePoll       int32 = 1
 	NotifyCodeInvalInode int32 = 2
 	NotifyCodeInvalEntry int32 = 3
+	NotifyCodeStore      int32 = 4
+	NotifyCodeRetrieve   int32 = 5
+	NotifyCodeDelete     int32 = 6
 )
 
+type NotifyPollWakeupOut struct {
+	Kh uint64
+}
+
 type NotifyInvalInodeOut struct {
 	Ino uint64
 	Off int64
@@ -812,6 +1057,39 @@ type NotifyInvalEntryOut struct {
 	padding uint32
 }
 
+type NotifyDeleteOut struct {
+	Parent  uint64
+	Child   uint64
+	Namelen uint32
+	padding uint32
+}
+
+type NotifyStoreOut struct {
+	Nodeid  uint64
+	Offset  uint64
+	Size    uint32
+	padding uint32
+}
+
+type NotifyRetrieveOut struct {
+	NotifyUnique uint64
+	Nodeid       uint64
+	Offset       uint64
+	Size         uint32
+	padding      uint32
+}
+
+// The body of the OpNotifyReply request with which the kernel answers a
+// NotifyCodeRetrieve notification, followed by the data.
+type NotifyRetrieveIn struct {
+	Dummy1 uint64
+	Offset uint64
+	Size   uint32
+	Dummy2 uint32
+	Dummy3 uint64
+	Dummy4 uint64
+}
+
 type SyncFSIn struct {
 	Padding uint64
 }
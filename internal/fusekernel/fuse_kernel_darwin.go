@@ -59,6 +59,9 @@ func (in *SetattrIn) Flags() uint32 {
 	return in.Flags_
 }
 
+// OS X has no O_DIRECT; F_NOCACHE is set with fcntl(2) instead.
+const OpenDirect OpenFlags = 0
+
 func openFlags(flags uint32) OpenFlags {
 	return OpenFlags(flags)
 }
@@ -1,6 +1,9 @@
 package fusekernel
 
-import "time"
+import (
+	"syscall"
+	"time"
+)
 
 type Attr struct {
 	Ino       uint64
@@ -49,6 +52,13 @@ func (in *SetattrIn) Flags() uint32 {
 	return 0
 }
 
+const OpenDirect OpenFlags = syscall.O_DIRECT
+
+// The ioctl that attaches a newly opened /dev/fuse descriptor to the
+// connection of the descriptor whose number it is passed, as
+// _IOR(229, 0, uint32_t).
+const DevIocClone = 0x8004e500
+
 func openFlags(flags uint32) OpenFlags {
 	// on amd64, the 32-bit O_LARGEFILE flag is always seen;
 	// on i386, the flag probably depends on the app
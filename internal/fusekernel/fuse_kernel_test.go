@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fusekernel
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestOpenFlags(t *testing.T) {
+	testCases := []struct {
+		flags    OpenFlags
+		mode     AccessMode
+		append   bool
+		truncate bool
+		nonblock bool
+		sync     bool
+	}{
+		{OpenFlags(syscall.O_RDONLY), AccessReadOnly, false, false, false, false},
+		{OpenFlags(syscall.O_WRONLY | syscall.O_APPEND), AccessWriteOnly, true, false, false, false},
+		{OpenFlags(syscall.O_RDWR | syscall.O_TRUNC), AccessReadWrite, false, true, false, false},
+		{OpenFlags(syscall.O_RDONLY | syscall.O_NONBLOCK), AccessReadOnly, false, false, true, false},
+		{OpenFlags(syscall.O_WRONLY | syscall.O_DSYNC), AccessWriteOnly, false, false, false, true},
+		{OpenFlags(syscall.O_WRONLY | syscall.O_SYNC), AccessWriteOnly, false, false, false, true},
+		{OpenFlags(syscall.O_ACCMODE), AccessReadWrite, false, false, false, false},
+	}
+
+	for _, tc := range testCases {
+		if got := tc.flags.AccessMode(); got != tc.mode {
+			t.Errorf("%v: AccessMode() = %v, want %v", tc.flags, got, tc.mode)
+		}
+
+		if got := tc.flags.IsAppend(); got != tc.append {
+			t.Errorf("%v: IsAppend() = %v", tc.flags, got)
+		}
+
+		if got := tc.flags.IsTruncate(); got != tc.truncate {
+			t.Errorf("%v: IsTruncate() = %v", tc.flags, got)
+		}
+
+		if got := tc.flags.IsNonblock(); got != tc.nonblock {
+			t.Errorf("%v: IsNonblock() = %v", tc.flags, got)
+		}
+
+		if got := tc.flags.IsSync(); got != tc.sync {
+			t.Errorf("%v: IsSync() = %v", tc.flags, got)
+		}
+
+		if tc.flags.IsDirect() {
+			t.Errorf("%v: IsDirect() = true", tc.flags)
+		}
+	}
+
+	if OpenDirect != 0 && !(OpenReadOnly | OpenDirect).IsDirect() {
+		t.Errorf("IsDirect() = false with OpenDirect set")
+	}
+}
@@ -0,0 +1,24 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package uring reads and writes file descriptors through a Linux io_uring,
+// with just enough of the interface for talking to /dev/fuse: blocking reads
+// and vectored writes, submitted by any number of goroutines.
+package uring
+
+import "errors"
+
+// ErrClosed is returned for reads and writes attempted once the ring has
+// been closed.
+var ErrClosed = errors.New("Ring closed")
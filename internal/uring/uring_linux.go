@@ -0,0 +1,467 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uring
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cf. include/uapi/linux/io_uring.h
+const (
+	opNop         = 0
+	opReadv       = 1
+	opWritev      = 2
+	opAsyncCancel = 14
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	enterGetEvents = 1 << 0
+)
+
+type sqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	flags       uint32
+	dropped     uint32
+	array       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type cqringOffsets struct {
+	head        uint32
+	tail        uint32
+	ringMask    uint32
+	ringEntries uint32
+	overflow    uint32
+	cqes        uint32
+	flags       uint32
+	resv1       uint32
+	userAddr    uint64
+}
+
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFD         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+// A submission queue entry.
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// A completion queue entry.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// An op waiting for its completion.
+type op struct {
+	// The buffers that the kernel reads or writes. Holding them here keeps
+	// them, and what they point to, on the heap, where they won't move.
+	iov []unix.Iovec
+
+	// Set before done is signalled if the op failed because the ring did,
+	// rather than completing.
+	err error
+
+	done chan int32
+}
+
+// The user data of entries whose completions nobody waits for: cancellations
+// and the no-op that wakes the reaper when closing. Ops are numbered from
+// one.
+const untracked = 0
+
+// Ring is an io_uring. Its methods may be called concurrently.
+type Ring struct {
+	fd int
+
+	// The rings, shared with the kernel.
+	sqRing []byte
+	cqRing []byte
+	sqeMem []byte
+
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	sqes    []sqe
+
+	cqHead *uint32
+	cqTail *uint32
+	cqMask uint32
+	cqes   []cqe
+
+	// A token for each op in flight, so that there are never more
+	// completions than the completion queue can hold.
+	slots chan struct{}
+
+	// Closed once the reaper has returned.
+	reaped chan struct{}
+
+	mu sync.Mutex
+
+	// The ops in flight, by ID, and the last ID handed out.
+	//
+	// GUARDED_BY(mu)
+	pending map[uint64]*op
+	lastID  uint64
+
+	// Set by Close, or when the ring fails.
+	//
+	// GUARDED_BY(mu)
+	closing bool
+
+	// The error with which the reaper failed, if it did.
+	//
+	// GUARDED_BY(mu)
+	err error
+}
+
+// New sets up a ring with room for the supplied number of submissions, which
+// is rounded up to a power of two. It fails with ENOSYS on kernels without
+// io_uring, and EPERM where it has been disabled.
+func New(entries uint32) (*Ring, error) {
+	var p params
+	fd, _, errno := unix.Syscall(
+		unix.SYS_IO_URING_SETUP,
+		uintptr(entries),
+		uintptr(unsafe.Pointer(&p)),
+		0)
+
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+
+	r := &Ring{
+		fd:      int(fd),
+		slots:   make(chan struct{}, p.cqEntries),
+		reaped:  make(chan struct{}),
+		pending: make(map[uint64]*op),
+	}
+
+	if err := r.mmap(&p); err != nil {
+		r.unmap()
+		return nil, err
+	}
+
+	go r.reap()
+	return r, nil
+}
+
+// Map the rings set up by io_uring_setup.
+func (r *Ring) mmap(p *params) error {
+	const prot = unix.PROT_READ | unix.PROT_WRITE
+	const flags = unix.MAP_SHARED | unix.MAP_POPULATE
+
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, int(p.sqOff.array+p.sqEntries*4), prot, flags)
+	if err != nil {
+		return fmt.Errorf("Mapping submission ring: %w", err)
+	}
+
+	r.cqRing, err = unix.Mmap(r.fd, offCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(cqe{}))), prot, flags)
+	if err != nil {
+		return fmt.Errorf("Mapping completion ring: %w", err)
+	}
+
+	r.sqeMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries*uint32(unsafe.Sizeof(sqe{}))), prot, flags)
+	if err != nil {
+		return fmt.Errorf("Mapping submission entries: %w", err)
+	}
+
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+
+	return nil
+}
+
+// Unmap the rings and close the ring's descriptor.
+func (r *Ring) unmap() {
+	for _, m := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+
+	unix.Close(r.fd)
+}
+
+func (r *Ring) enter(toSubmit, minComplete, flags uint32) error {
+	for {
+		_, _, errno := unix.Syscall6(
+			unix.SYS_IO_URING_ENTER,
+			uintptr(r.fd),
+			uintptr(toSubmit),
+			uintptr(minComplete),
+			uintptr(flags),
+			0,
+			0)
+
+		switch errno {
+		case 0:
+			return nil
+
+		// Interrupted, or short of resources for the moment.
+		case syscall.EINTR, syscall.EAGAIN, syscall.EBUSY:
+			continue
+		}
+
+		return errno
+	}
+}
+
+// Queue the supplied entry and submit it to the kernel.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(r.mu)
+func (r *Ring) push(e sqe) error {
+	// We are the only writer of the tail, and submit each entry as soon as it
+	// is queued, so the queue is never full.
+	tail := *r.sqTail
+	i := tail & r.sqMask
+	r.sqes[i] = e
+	r.sqArray[i] = i
+	atomic.StoreUint32(r.sqTail, tail+1)
+
+	if err := r.enter(1, 0, 0); err != nil {
+		return fmt.Errorf("io_uring_enter: %w", err)
+	}
+
+	return nil
+}
+
+// Submit a read or write of the supplied buffers and wait for it to
+// complete, returning its result.
+func (r *Ring) do(opcode uint8, fd int, iov []unix.Iovec) (int32, error) {
+	r.slots <- struct{}{}
+	defer func() { <-r.slots }()
+
+	o := &op{
+		iov:  iov,
+		done: make(chan int32, 1),
+	}
+
+	e := sqe{
+		opcode: opcode,
+		fd:     int32(fd),
+		off:    ^uint64(0),
+		addr:   uint64(uintptr(unsafe.Pointer(&iov[0]))),
+		len:    uint32(len(iov)),
+	}
+
+	r.mu.Lock()
+	if r.closing {
+		err := r.err
+		r.mu.Unlock()
+
+		if err == nil {
+			err = ErrClosed
+		}
+
+		return 0, err
+	}
+
+	r.lastID++
+	e.userData = r.lastID
+	r.pending[e.userData] = o
+
+	if err := r.push(e); err != nil {
+		delete(r.pending, e.userData)
+		r.mu.Unlock()
+		return 0, err
+	}
+
+	r.mu.Unlock()
+
+	res := <-o.done
+	runtime.KeepAlive(o)
+
+	if o.err != nil {
+		return 0, o.err
+	}
+
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+
+	return res, nil
+}
+
+// Deliver completions to the ops waiting for them, until the ring is closing
+// and none are left, or waiting for completions fails.
+func (r *Ring) reap() {
+	defer close(r.reaped)
+
+	for {
+		if err := r.enter(0, 1, enterGetEvents); err != nil {
+			r.fail(fmt.Errorf("io_uring_enter: %w", err))
+			return
+		}
+
+		r.mu.Lock()
+
+		head := *r.cqHead
+		tail := atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			e := r.cqes[head&r.cqMask]
+			if o, ok := r.pending[e.userData]; ok {
+				o.done <- e.res
+				delete(r.pending, e.userData)
+			}
+		}
+
+		atomic.StoreUint32(r.cqHead, head)
+		finished := r.closing && len(r.pending) == 0
+
+		r.mu.Unlock()
+
+		if finished {
+			return
+		}
+	}
+}
+
+// Fail the ops in flight, and any started later, with the supplied error.
+//
+// LOCKS_EXCLUDED(r.mu)
+func (r *Ring) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closing = true
+	r.err = err
+
+	for id, o := range r.pending {
+		o.err = err
+		o.done <- 0
+		delete(r.pending, id)
+	}
+}
+
+// Read reads into b from the supplied descriptor at its current offset,
+// blocking until the read completes. Errors are syscall.Errno values,
+// ErrClosed, or the error that the ring failed with.
+func (r *Ring) Read(fd int, b []byte) (int, error) {
+	iov := []unix.Iovec{{Base: unsafe.SliceData(b)}}
+	iov[0].SetLen(len(b))
+
+	n, err := r.do(opReadv, fd, iov)
+	return int(n), err
+}
+
+// Writev writes the concatenation of bufs to the supplied descriptor,
+// blocking until the write completes. Errors are syscall.Errno values,
+// ErrClosed, or the error that the ring failed with.
+func (r *Ring) Writev(fd int, bufs [][]byte) (int, error) {
+	iov := make([]unix.Iovec, 0, len(bufs))
+	for _, b := range bufs {
+		if len(b) == 0 {
+			continue
+		}
+
+		v := unix.Iovec{Base: &b[0]}
+		v.SetLen(len(b))
+		iov = append(iov, v)
+	}
+
+	if len(iov) == 0 {
+		return 0, nil
+	}
+
+	n, err := r.do(opWritev, fd, iov)
+	return int(n), err
+}
+
+// Close cancels the reads and writes in flight, waits for them to fail, and
+// tears down the ring. Reads and writes started afterwards fail with
+// ErrClosed, or with the error that the ring failed with.
+func (r *Ring) Close() error {
+	r.mu.Lock()
+
+	// If the reaper has failed, there is nobody left to wait for.
+	if r.err != nil {
+		r.mu.Unlock()
+		<-r.reaped
+		r.unmap()
+
+		return nil
+	}
+
+	r.closing = true
+
+	var err error
+	for id := range r.pending {
+		if err = r.push(sqe{opcode: opAsyncCancel, addr: id, userData: untracked}); err != nil {
+			break
+		}
+	}
+
+	// Wake the reaper, in case nothing was in flight.
+	if err == nil {
+		err = r.push(sqe{opcode: opNop, userData: untracked})
+	}
+
+	r.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	<-r.reaped
+	r.unmap()
+
+	return nil
+}
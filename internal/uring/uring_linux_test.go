@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package uring
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func newRing(t *testing.T) *Ring {
+	r, err := New(8)
+	if errors.Is(err, syscall.ENOSYS) || errors.Is(err, syscall.EPERM) {
+		t.Skipf("io_uring unavailable: %v", err)
+	}
+
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	return r
+}
+
+func newPipe(t *testing.T) (*os.File, *os.File) {
+	rf, wf, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %v", err)
+	}
+
+	t.Cleanup(func() {
+		rf.Close()
+		wf.Close()
+	})
+
+	return rf, wf
+}
+
+func TestReadAndWritev(t *testing.T) {
+	r := newRing(t)
+	defer r.Close()
+
+	rf, wf := newPipe(t)
+
+	n, err := r.Writev(int(wf.Fd()), [][]byte{[]byte("taco"), nil, []byte("burrito")})
+	if err != nil {
+		t.Fatalf("Writev: %v", err)
+	}
+
+	if n != 11 {
+		t.Errorf("Writev wrote %d bytes", n)
+	}
+
+	b := make([]byte, 64)
+	n, err = r.Read(int(rf.Fd()), b)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+
+	if got := string(b[:n]); got != "tacoburrito" {
+		t.Errorf("Read %q", got)
+	}
+}
+
+func TestErrno(t *testing.T) {
+	r := newRing(t)
+	defer r.Close()
+
+	_, wf := newPipe(t)
+
+	_, err := r.Read(int(wf.Fd()), make([]byte, 1))
+	if err != syscall.EBADF {
+		t.Errorf("Read from the write end: %v, want EBADF", err)
+	}
+}
+
+func TestConcurrentOps(t *testing.T) {
+	r := newRing(t)
+	defer r.Close()
+
+	// More ops than the ring has room for at once.
+	const n = 64
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		rf, wf := newPipe(t)
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			b := make([]byte, 16)
+			m, err := r.Read(int(rf.Fd()), b)
+			if err != nil {
+				t.Errorf("Read: %v", err)
+				return
+			}
+
+			if got, want := string(b[:m]), fmt.Sprint(i); got != want {
+				t.Errorf("Read %q, want %q", got, want)
+			}
+		}(i)
+
+		go func(i int) {
+			if _, err := r.Writev(int(wf.Fd()), [][]byte{[]byte(fmt.Sprint(i))}); err != nil {
+				t.Errorf("Writev: %v", err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestCloseCancelsReads(t *testing.T) {
+	r := newRing(t)
+	rf, _ := newPipe(t)
+
+	// A read that will never be satisfied.
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := r.Read(int(rf.Fd()), make([]byte, 1))
+		readErr <- err
+	}()
+
+	// Wait for it to be in flight.
+	for {
+		r.mu.Lock()
+		n := len(r.pending)
+		r.mu.Unlock()
+
+		if n != 0 {
+			break
+		}
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if err := <-readErr; err == nil {
+		t.Errorf("Read succeeded after Close")
+	}
+
+	if _, err := r.Read(int(rf.Fd()), make([]byte, 1)); err != ErrClosed {
+		t.Errorf("Read after Close: %v, want ErrClosed", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package uring
+
+import (
+	"syscall"
+)
+
+// Ring is not supported outside of Linux.
+type Ring struct{}
+
+// New always fails outside of Linux.
+func New(entries uint32) (*Ring, error) {
+	return nil, syscall.ENOTSUP
+}
+
+func (r *Ring) Read(fd int, b []byte) (int, error) {
+	return 0, ErrClosed
+}
+
+func (r *Ring) Writev(fd int, bufs [][]byte) (int, error) {
+	return 0, ErrClosed
+}
+
+func (r *Ring) Close() error {
+	return nil
+}
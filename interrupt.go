@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+)
+
+// InterruptHandler is told about an op that the kernel has interrupted, given
+// the op's context and the op. See Connection.SetInterruptHandler.
+type InterruptHandler func(ctx context.Context, op interface{})
+
+// SetInterruptHandler arranges for h to be called whenever the kernel
+// interrupts an op that has yet to be replied to, typically because the
+// process making the system call received a signal, replacing any handler
+// previously set. A nil handler removes it.
+//
+// The op's context is cancelled either way, with context.Cause returning
+// syscall.EINTR, which is enough for a file system that passes the context
+// on to whatever it blocks on. The handler is for one that needs to do more,
+// such as cancelling a request to a backend that doesn't take a context, or
+// that wants to record interrupts. It is called just before the context is
+// cancelled, so it has seen the interrupt before anything waiting on the
+// context can reply, but the op may already have been replied to for other
+// reasons. The op must still be replied to, usually with EINTR.
+//
+// The handler is called on the goroutine that reads requests, so it must not
+// block, or wait for ops to be replied to.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) SetInterruptHandler(h InterruptHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.interruptHandler = h
+}
@@ -0,0 +1,79 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"io"
+	"os"
+
+	"github.com/jacobsa/fuse/internal/uring"
+)
+
+// The number of submissions that the ring for cfg.UseIOUring has room for.
+// Twice as many ops may be in flight.
+const ringEntries = 128
+
+// Set up the ring for cfg.UseIOUring, or log why we can't.
+func (c *Connection) setUpRing() {
+	r, err := uring.New(ringEntries)
+	if err != nil {
+		c.logError("Not using io_uring", err)
+
+		return
+	}
+
+	c.ring = r
+}
+
+// Return a reader for messages from the supplied device, through the ring if
+// there is one.
+func (c *Connection) deviceReader(dev *os.File) io.Reader {
+	if c.ring == nil {
+		return dev
+	}
+
+	return ringReader{c.ring, dev}
+}
+
+// Write the supplied slices to the supplied device as a single message,
+// through the ring if there is one.
+func (c *Connection) writev(dev *os.File, packet [][]byte) (int, error) {
+	packet = limitIovecs(packet)
+	if c.ring == nil {
+		return writev(int(dev.Fd()), packet)
+	}
+
+	return c.ring.Writev(int(dev.Fd()), packet)
+}
+
+// An io.Reader that reads from a device through a ring, failing as
+// os.File.Read would.
+type ringReader struct {
+	ring *uring.Ring
+	dev  *os.File
+}
+
+func (r ringReader) Read(p []byte) (int, error) {
+	n, err := r.ring.Read(int(r.dev.Fd()), p)
+	if err != nil {
+		return n, &os.PathError{Op: "read", Path: r.dev.Name(), Err: err}
+	}
+
+	if n == 0 && len(p) != 0 {
+		return 0, io.EOF
+	}
+
+	return n, nil
+}
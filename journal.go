@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// OpJournalEntry records a request received from the kernel or a reply sent
+// to it. See MountConfig.OpJournalSize.
+type OpJournalEntry struct {
+	// When the request was received or the reply sent.
+	Time time.Time
+
+	// Whether this records a reply rather than a request.
+	Reply bool
+
+	// The request's ID, opcode, and inode, from its header. Opcodes are listed
+	// in package fuseprotocol.
+	Unique uint64
+	OpCode uint32
+	Inode  fuseops.InodeID
+
+	// For replies, the name of the op as in Stats.Ops, the error sent to the
+	// kernel or zero for success, and how long after the request the reply
+	// was sent. Ops that the kernel doesn't expect a reply to, such as
+	// forgets, are still recorded when the file system finishes them.
+	Op      string
+	Errno   syscall.Errno
+	Latency time.Duration
+}
+
+func (e OpJournalEntry) String() string {
+	ts := e.Time.Format("15:04:05.000000")
+	if !e.Reply {
+		return fmt.Sprintf(
+			"%s <- unique %d opcode %d inode %d",
+			ts,
+			e.Unique,
+			e.OpCode,
+			e.Inode)
+	}
+
+	result := "OK"
+	if e.Errno != 0 {
+		result = fmt.Sprintf("%v (errno %d)", e.Errno, int(e.Errno))
+	}
+
+	return fmt.Sprintf(
+		"%s -> unique %d %s inode %d: %s after %v",
+		ts,
+		e.Unique,
+		e.Op,
+		e.Inode,
+		result,
+		e.Latency)
+}
+
+// A fixed-size ring of the most recent journal entries. A nil journal
+// records nothing.
+type opJournal struct {
+	mu sync.Mutex
+
+	// The entries, of which next is the oldest once the ring has wrapped.
+	//
+	// GUARDED_BY(mu)
+	entries []OpJournalEntry
+	next    int
+	wrapped bool
+}
+
+func newOpJournal(size int) *opJournal {
+	if size <= 0 {
+		return nil
+	}
+
+	return &opJournal{
+		entries: make([]OpJournalEntry, size),
+	}
+}
+
+// LOCKS_EXCLUDED(j.mu)
+func (j *opJournal) add(e OpJournalEntry) {
+	if j == nil {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries[j.next] = e
+	j.next++
+	if j.next == len(j.entries) {
+		j.next = 0
+		j.wrapped = true
+	}
+}
+
+// Return a copy of the entries, oldest first.
+//
+// LOCKS_EXCLUDED(j.mu)
+func (j *opJournal) snapshot() []OpJournalEntry {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.wrapped {
+		return append([]OpJournalEntry(nil), j.entries[:j.next]...)
+	}
+
+	s := make([]OpJournalEntry, 0, len(j.entries))
+	s = append(s, j.entries[j.next:]...)
+	s = append(s, j.entries[:j.next]...)
+	return s
+}
+
+// Write the entries to w, one per line, oldest first.
+func writeOpJournal(w io.Writer, entries []OpJournalEntry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OpJournal returns the requests and replies recorded in the journal kept
+// with MountConfig.OpJournalSize, oldest first. It returns nil if no journal
+// is kept.
+func (c *Connection) OpJournal() []OpJournalEntry {
+	return c.journal.snapshot()
+}
+
+// DumpOpJournalOnPanic writes the journal kept with MountConfig.OpJournalSize
+// to stderr if the calling goroutine is panicking, and then continues the
+// panic. It must be deferred directly, as in:
+//
+//	defer c.DumpOpJournalOnPanic()
+//
+// so that post-mortem debugging of a crashed server can see what the kernel
+// was asking for. fuseutil.NewFileSystemServer does this for the goroutines
+// on which it calls the file system. It does nothing if no journal is kept.
+func (c *Connection) DumpOpJournalOnPanic() {
+	if c.journal == nil {
+		return
+	}
+
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "fuse: panic: %v\nfuse: recent ops:\n", r)
+	writeOpJournal(os.Stderr, c.journal.snapshot())
+	panic(r)
+}
+
+// OpJournal is like Connection.OpJournal, for the file system's connection.
+// It remains usable after the file system has been unmounted.
+func (mfs *MountedFileSystem) OpJournal() []OpJournalEntry {
+	return mfs.journal.snapshot()
+}
+
+// WriteOpJournal writes the entries returned by OpJournal to w, one per line.
+func (mfs *MountedFileSystem) WriteOpJournal(w io.Writer) error {
+	return writeOpJournal(w, mfs.OpJournal())
+}
@@ -0,0 +1,393 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"math"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// A file system that keeps at most one lock per inode, covering the whole
+// file.
+type lockFS struct {
+	handleDataFS
+
+	// Closed when a SetLockOp starts waiting.
+	waiting chan struct{}
+
+	mu         sync.Mutex
+	owners     map[fuseops.InodeID]uint64
+	handleData []interface{}
+}
+
+func (fs *lockFS) GetLock(
+	ctx context.Context,
+	op *fuseops.GetLockOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handleData = append(fs.handleData, op.HandleData)
+	if owner, ok := fs.owners[op.Inode]; ok && owner != op.Owner {
+		op.Conflict = fuseops.FileLock{
+			Start: 0,
+			End:   math.MaxInt64,
+			Type:  unix.F_WRLCK,
+			Pid:   1234,
+		}
+	}
+
+	return nil
+}
+
+func (fs *lockFS) SetLock(
+	ctx context.Context,
+	op *fuseops.SetLockOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handleData = append(fs.handleData, op.HandleData)
+	if owner, ok := fs.owners[op.Inode]; ok && owner != op.Owner {
+		if !op.Wait {
+			return syscall.EAGAIN
+		}
+
+		// Nothing releases locks while the test waits, so wait for the
+		// interrupt.
+		fs.mu.Unlock()
+		close(fs.waiting)
+		<-ctx.Done()
+		fs.mu.Lock()
+
+		return syscall.EINTR
+	}
+
+	if op.Lock.Type == unix.F_UNLCK {
+		delete(fs.owners, op.Inode)
+	} else {
+		fs.owners[op.Inode] = op.Owner
+	}
+
+	return nil
+}
+
+// Closing a descriptor releases the locks of the process that closed it.
+func (fs *lockFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.handleData = append(fs.handleData, op.HandleData)
+	if owner, ok := fs.owners[op.Inode]; ok && owner == op.LockOwner {
+		delete(fs.owners, op.Inode)
+	}
+
+	return nil
+}
+
+func TestPosixLocksInit(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{false, fusekernel.InitPosixLocks, false},
+		{true, 0, false},
+		{true, fusekernel.InitPosixLocks, true},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EnablePosixLocks: tc.enable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if got := flags&fusekernel.InitPosixLocks != 0; got != tc.want {
+			t.Errorf("%+v: unexpected flags %v", tc, flags)
+		}
+
+		k.Close()
+	}
+}
+
+func TestPosixLocks(t *testing.T) {
+	fs := &lockFS{
+		waiting: make(chan struct{}),
+		owners:  make(map[fuseops.InodeID]uint64),
+	}
+
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			EnablePosixLocks:         true,
+			StrictProtocolValidation: true,
+			ValidateResponses:        true,
+		},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitPosixLocks)})
+
+	open := fusekernel.OpenIn{Flags: syscall.O_RDWR}
+	r, err := k.Call(fusekernel.OpOpen, 2, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	lkIn := func(owner uint64, typ uint32) []byte {
+		in := fusekernel.LkIn{
+			Fh:    2,
+			Owner: owner,
+			Lk: fusekernel.FileLock{
+				End:  math.MaxInt64,
+				Type: typ,
+				Pid:  uint32(owner),
+			},
+		}
+
+		return structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in)))
+	}
+
+	getLk := func(owner uint64) fusekernel.FileLock {
+		r, err := k.Call(fusekernel.OpGetlk, 2, lkIn(owner, unix.F_WRLCK))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		var out fusekernel.LkOut
+		if len(r.Body) != int(unsafe.Sizeof(out)) {
+			t.Fatalf("Got %d bytes", len(r.Body))
+		}
+
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		return out.Lk
+	}
+
+	// Owner 1 takes a lock.
+	r, err = k.Call(fusekernel.OpSetlk, 2, lkIn(1, unix.F_WRLCK))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	// Owner 1 sees no conflict, but owner 2 does.
+	if lk := getLk(1); lk.Type != unix.F_UNLCK {
+		t.Errorf("Got conflict %+v for the holder", lk)
+	}
+
+	want := fusekernel.FileLock{End: math.MaxInt64, Type: unix.F_WRLCK, Pid: 1234}
+	if lk := getLk(2); lk != want {
+		t.Errorf("Got conflict %+v, want %+v", lk, want)
+	}
+
+	// Owner 2 can't take the lock without waiting.
+	r, err = k.Call(fusekernel.OpSetlk, 2, lkIn(2, unix.F_RDLCK))
+	if err != nil || r.Error != syscall.EAGAIN {
+		t.Errorf("Call: %v, %v", err, r.Error)
+	}
+
+	// If it waits, it can be interrupted.
+	unique, err := k.Start(fusekernel.OpSetlkw, 2, lkIn(2, unix.F_RDLCK))
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	<-fs.waiting
+	if err := k.Interrupt(unique); err != nil {
+		t.Fatalf("Interrupt: %v", err)
+	}
+
+	r, err = k.Wait(unique)
+	if err != nil || r.Error != syscall.EINTR {
+		t.Errorf("Wait: %v, %v", err, r.Error)
+	}
+
+	// Once owner 1 releases the lock, owner 2 can take it.
+	r, err = k.Call(fusekernel.OpSetlk, 2, lkIn(1, unix.F_UNLCK))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	r, err = k.Call(fusekernel.OpSetlk, 2, lkIn(2, unix.F_RDLCK))
+	if err != nil || r.Error != 0 {
+		t.Errorf("Call: %v, %v", err, r.Error)
+	}
+
+	// Closing a descriptor in another process leaves the lock alone, but
+	// closing one in owner 2 releases it.
+	for _, owner := range []uint64{1, 2} {
+		flush := fusekernel.FlushIn{Fh: 2, LockOwner: owner}
+		r, err = k.Call(fusekernel.OpFlush, 2, structBytes(unsafe.Pointer(&flush), unsafe.Sizeof(flush), int(unsafe.Sizeof(flush))))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		want := fusekernel.FileLock{End: math.MaxInt64, Type: unix.F_WRLCK, Pid: 1234}
+		if owner == 2 {
+			want = fusekernel.FileLock{Type: unix.F_UNLCK}
+		}
+
+		if lk := getLk(1); lk != want {
+			t.Errorf("After flush by %d: got conflict %+v, want %+v", owner, lk, want)
+		}
+	}
+
+	// Strict validation rejects lock types that fcntl(2) doesn't have.
+	r, err = k.Call(fusekernel.OpSetlk, 2, lkIn(3, 17))
+	if err != nil || r.Error != syscall.EIO {
+		t.Errorf("Call: %v, %v", err, r.Error)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, data := range fs.handleData {
+		if data != "state for 2" {
+			t.Errorf("Got handle data %v", data)
+		}
+	}
+}
+
+type flockFS struct {
+	handleDataFS
+
+	mu       sync.Mutex
+	flocks   []fuseops.FlockOp
+	releases []fuseops.ReleaseFileHandleOp
+}
+
+func (fs *flockFS) Flock(
+	ctx context.Context,
+	op *fuseops.FlockOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.flocks = append(fs.flocks, *op)
+	return nil
+}
+
+func (fs *flockFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.releases = append(fs.releases, *op)
+	return nil
+}
+
+func TestFlock(t *testing.T) {
+	// The flag is negotiated like that for POSIX locks.
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{EnableFlockLocks: true},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitFlockLocks)})
+
+	if flags := fusekernel.InitFlags(k.InitOut().Flags); flags&fusekernel.InitFlockLocks == 0 {
+		t.Errorf("Unexpected flags %v", flags)
+	}
+
+	k.Close()
+
+	fs := &flockFS{}
+	k = newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			EnableFlockLocks:         true,
+			StrictProtocolValidation: true,
+		},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitFlockLocks)})
+
+	open := fusekernel.OpenIn{Flags: syscall.O_RDWR}
+	r, err := k.Call(fusekernel.OpOpen, 2, structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	// flock(2) with LOCK_EX|LOCK_NB, then LOCK_SH, then LOCK_UN.
+	const owner = 0x1234
+	calls := []struct {
+		opcode uint32
+		typ    uint32
+	}{
+		{fusekernel.OpSetlk, unix.F_WRLCK},
+		{fusekernel.OpSetlkw, unix.F_RDLCK},
+		{fusekernel.OpSetlk, unix.F_UNLCK},
+	}
+
+	for _, c := range calls {
+		in := fusekernel.LkIn{
+			Fh:      2,
+			Owner:   owner,
+			Lk:      fusekernel.FileLock{End: math.MaxInt64, Type: c.typ},
+			LkFlags: fusekernel.LkFlock,
+		}
+
+		r, err := k.Call(c.opcode, 2, structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+	}
+
+	// Closing the file releases the handle's flock locks.
+	release := fusekernel.ReleaseIn{
+		Fh:           2,
+		ReleaseFlags: fusekernel.ReleaseFlockUnlock,
+		LockOwner:    owner,
+	}
+
+	r, err = k.Call(fusekernel.OpRelease, 2, structBytes(unsafe.Pointer(&release), unsafe.Sizeof(release), int(unsafe.Sizeof(release))))
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if len(fs.flocks) != len(calls) {
+		t.Fatalf("Got %d FlockOps, want %d", len(fs.flocks), len(calls))
+	}
+
+	for i, c := range calls {
+		op := fs.flocks[i]
+		if op.Inode != 2 || op.Handle != 2 || op.HandleData != "state for 2" || op.Owner != owner {
+			t.Errorf("Op %d: %+v", i, op)
+		}
+
+		if op.Type != c.typ || op.Wait != (c.opcode == fusekernel.OpSetlkw) {
+			t.Errorf("Op %d: got type %d, wait %v", i, op.Type, op.Wait)
+		}
+	}
+
+	if len(fs.releases) != 1 {
+		t.Fatalf("Got %d releases", len(fs.releases))
+	}
+
+	if op := fs.releases[0]; !op.UnlockFlocks || op.LockOwner != owner {
+		t.Errorf("Got release %+v", op)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// LogLevel is the severity of a record passed to a Logger.
+type LogLevel int
+
+const (
+	// Requests from the kernel and replies to them, as for
+	// MountConfig.DebugLogger.
+	LogDebug LogLevel = iota
+
+	// Failures, as for MountConfig.ErrorLogger.
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "DEBUG"
+	case LogError:
+		return "ERROR"
+	}
+
+	return "UNKNOWN"
+}
+
+// LogField is a key and value attached to a record passed to a Logger.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// The keys of the fields that records about ops carry.
+const (
+	// The kernel's ID for the op, as a uint64, which matches a request to its
+	// reply.
+	LogKeyOpID = "op_id"
+
+	// The op's name, as for OpMetrics.Op.
+	LogKeyOp = "op"
+
+	// The inode the op was sent for, as a fuseops.InodeID.
+	LogKeyInode = "inode"
+
+	// A description of the op's arguments or results, as a string.
+	LogKeyDetail = "detail"
+
+	// The time from reading the op to replying to it, as a time.Duration.
+	LogKeyDuration = "duration"
+
+	// The error the op or operation failed with, as an error.
+	LogKeyError = "error"
+)
+
+// A Logger receives structured records, as configured with
+// MountConfig.Logger, for example to emit them as JSON. NewSlogLogger adapts
+// a log/slog handler. Records about ops carry the fields named by the
+// LogKey constants.
+//
+// Methods are called concurrently, on the goroutines that read and reply to
+// ops.
+type Logger interface {
+	// Report whether records at the supplied level are wanted, so that
+	// building unwanted ones can be skipped.
+	Enabled(level LogLevel) bool
+
+	// Handle a record.
+	Log(level LogLevel, msg string, fields ...LogField)
+}
+
+// Log a record to c.cfg.Logger, if it wants records at the supplied level.
+func (c *Connection) log(level LogLevel, msg string, fields ...LogField) {
+	if c.cfg.Logger != nil && c.cfg.Logger.Enabled(level) {
+		c.cfg.Logger.Log(level, msg, fields...)
+	}
+}
+
+// Log a failure that isn't tied to an op, to ErrorLogger as msg followed by
+// err, and to Logger with err as its error field.
+func (c *Connection) logError(msg string, err error, fields ...LogField) {
+	if c.errorLogger != nil {
+		c.errorLogger.Printf("%s: %v", msg, err)
+	}
+
+	c.log(LogError, msg, append(fields, LogField{LogKeyError, err})...)
+}
+
+// Return the fields identifying the op in the supplied state.
+func opFields(state opState, fields ...LogField) []LogField {
+	header := state.header()
+	return append(
+		[]LogField{
+			{LogKeyOpID, header.Unique},
+			{LogKeyOp, opName(state.op)},
+			{LogKeyInode, fuseops.InodeID(header.Nodeid)},
+		},
+		fields...)
+}
+
+// Return the duration field for an op read at the supplied time.
+func durationField(readTime time.Time) LogField {
+	return LogField{LogKeyDuration, time.Since(readTime)}
+}
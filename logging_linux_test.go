@@ -0,0 +1,148 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+type logRecord struct {
+	level  fuse.LogLevel
+	msg    string
+	fields map[string]interface{}
+}
+
+// A fuse.Logger that records what it's given at or above a level.
+type recordingLogger struct {
+	minLevel fuse.LogLevel
+
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) Enabled(level fuse.LogLevel) bool {
+	return level >= l.minLevel
+}
+
+func (l *recordingLogger) Log(level fuse.LogLevel, msg string, fields ...fuse.LogField) {
+	r := logRecord{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		r.fields[f.Key] = f.Value
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, r)
+}
+
+func TestLogger(t *testing.T) {
+	l := &recordingLogger{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{Logger: l},
+		&fusetesting.FakeKernelConfig{})
+
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if _, err := k.Call(fusekernel.OpRmdir, 7, nameBytes("bar")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Find the records for the two ops, after those for init.
+	var got []logRecord
+	for _, r := range l.records {
+		if op := r.fields[fuse.LogKeyOp]; op == "LookUpInode" || op == "RmDir" {
+			got = append(got, r)
+		}
+	}
+
+	if len(got) != 4 {
+		t.Fatalf("Got %d records for the ops, want 4: %v", len(got), l.records)
+	}
+
+	want := []struct {
+		level fuse.LogLevel
+		msg   string
+		op    string
+		inode fuseops.InodeID
+	}{
+		{fuse.LogDebug, "Request", "LookUpInode", 1},
+		{fuse.LogDebug, "Reply", "LookUpInode", 1},
+		{fuse.LogDebug, "Request", "RmDir", 7},
+		{fuse.LogError, "Reply", "RmDir", 7},
+	}
+
+	for i, w := range want {
+		r := got[i]
+		if r.level != w.level || r.msg != w.msg || r.fields[fuse.LogKeyInode] != w.inode {
+			t.Errorf("Record %d: got %v, want %+v", i, r, w)
+		}
+
+		if _, ok := r.fields[fuse.LogKeyOpID].(uint64); !ok {
+			t.Errorf("Record %d: no op ID: %v", i, r.fields)
+		}
+	}
+
+	if got[0].fields[fuse.LogKeyOpID] != got[1].fields[fuse.LogKeyOpID] {
+		t.Errorf("Request and reply op IDs differ: %v, %v", got[0].fields, got[1].fields)
+	}
+
+	if _, ok := got[1].fields[fuse.LogKeyDuration].(time.Duration); !ok {
+		t.Errorf("No duration: %v", got[1].fields)
+	}
+
+	if err := got[3].fields[fuse.LogKeyError]; err != syscall.ENOSYS {
+		t.Errorf("Error: got %v, want ENOSYS", err)
+	}
+}
+
+func TestLoggerLevel(t *testing.T) {
+	l := &recordingLogger{minLevel: fuse.LogError}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{Logger: l},
+		&fusetesting.FakeKernelConfig{})
+
+	if _, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if _, err := k.Call(fusekernel.OpRmdir, 1, nameBytes("bar")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) != 1 || l.records[0].fields[fuse.LogKeyOp] != "RmDir" {
+		t.Errorf("Got records %v, want only the RmDir reply", l.records)
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Runs MountConfig.Maintenance on a schedule for the life of a mount.
+type maintainer struct {
+	f        func(context.Context)
+	interval time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed when the goroutine started by start returns.
+	done chan struct{}
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	started bool
+	stopped bool
+}
+
+// Return a maintainer for the supplied config, or nil if it doesn't ask for
+// maintenance.
+func newMaintainer(cfg *MountConfig) *maintainer {
+	if cfg.Maintenance == nil || cfg.MaintenanceInterval <= 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(cfg.OpContext)
+	return &maintainer{
+		f:        cfg.Maintenance,
+		interval: cfg.MaintenanceInterval,
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+}
+
+// Begin calling the function, unless stop has already been called.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *maintainer) start() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stopped {
+		return
+	}
+
+	m.started = true
+	go m.run()
+}
+
+// Stop calling the function, waiting for any call in progress to return.
+//
+// LOCKS_EXCLUDED(m.mu)
+func (m *maintainer) stop() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.stopped = true
+	started := m.started
+	m.mu.Unlock()
+
+	m.cancel()
+	if started {
+		<-m.done
+	}
+}
+
+func (m *maintainer) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+
+		case <-ticker.C:
+			m.f(m.ctx)
+		}
+	}
+}
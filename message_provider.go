@@ -0,0 +1,100 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// InMessage is a buffer into which a Connection reads a request from the
+// kernel. The ops converted from it refer to memory within it, notably
+// WriteFileOp.Data. Its contents are opaque: a MessageProvider only creates
+// messages and passes them back and forth.
+type InMessage buffer.InMessage
+
+// OutMessage is a buffer in which a Connection builds a reply to the kernel.
+// It refers to the slices of ReadFileOp.Data that a file system replies with
+// rather than copying them. Like InMessage, it is opaque.
+type OutMessage buffer.OutMessage
+
+// NewInMessage returns a new InMessage, for use by a MessageProvider. It is
+// large enough for the requests of a connection with the default
+// MountConfig.MaxWriteSize and MaxPages.
+func NewInMessage() *InMessage {
+	return (*InMessage)(buffer.NewInMessage())
+}
+
+// NewInMessageFor is like NewInMessage, but large enough for the requests of
+// a connection mounted with cfg, which may allow larger writes or reads than
+// the defaults. cfg.AlignBuffers is ignored: the message isn't aligned.
+func NewInMessageFor(cfg *MountConfig) *InMessage {
+	return (*InMessage)(
+		buffer.NewInMessageSize(cfg.inMessageSize(int(cfg.maxPages()))))
+}
+
+// NewOutMessage returns a new OutMessage, for use by a MessageProvider.
+func NewOutMessage() *OutMessage {
+	m := new(buffer.OutMessage)
+	m.Reset()
+	return (*OutMessage)(m)
+}
+
+// A MessageProvider supplies the buffers that a Connection reads requests
+// into and builds replies in, in place of the connection's own freelists; see
+// MountConfig.MessageProvider. This lets a file system control when buffers
+// are reused: by holding on to an InMessage after it is put back, it can keep
+// using WriteFileOp.Data after replying to the op, and by watching for an
+// OutMessage to be put back, it learns when the kernel has been handed the
+// ReadFileOp.Data that a read replied with.
+//
+// Methods may be called concurrently.
+type MessageProvider interface {
+	// Return a message to read a request into, created by NewInMessage (or
+	// NewInMessageFor, if MountConfig.MaxWriteSize or MaxPages is raised) and
+	// possibly used before.
+	GetInMessage() *InMessage
+
+	// Take back a message that the connection has finished with: the op read
+	// into it has been replied to, or released early with
+	// WriteFileOp.Release, or the message turned out to be malformed or could
+	// not be read at all. Until the provider hands the message out again,
+	// references into it stay valid.
+	PutInMessage(*InMessage)
+
+	// Return a message to build a reply in, created by NewOutMessage and
+	// possibly used before. The connection resets it before use.
+	GetOutMessage() *OutMessage
+
+	// Take back a message once the reply built in it has been written to the
+	// kernel, or abandoned because the request couldn't be converted or
+	// writing failed.
+	PutOutMessage(*OutMessage)
+}
+
+// RequestMessage returns the message that the op for the supplied context was
+// read into, so that a file system with a MessageProvider can tell which
+// message holds the memory that it wants to keep using, or nil if the context
+// didn't come from Connection.ReadOp or is for a forget split from a batch
+// with MountConfig.SplitBatchForgets, which refers to no message.
+func RequestMessage(ctx context.Context) *InMessage {
+	state, ok := ctx.Value(contextKey).(opState)
+	if !ok {
+		return nil
+	}
+
+	return (*InMessage)(state.inMsg)
+}
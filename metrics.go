@@ -0,0 +1,83 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A MetricsCollector is told about each op that a connection handles, as
+// configured with MountConfig.MetricsCollector, for exporting metrics to a
+// monitoring system. Package prommetrics has one for Prometheus.
+//
+// Methods are called concurrently, on the goroutines that read and reply to
+// ops, so they should be quick and must not block.
+type MetricsCollector interface {
+	// Called when an op has been read from the kernel, before the file system
+	// sees it. op is the op's name as for OpMetrics.Op.
+	OpStarted(op string)
+
+	// Called once the reply to an op started above has been built, just
+	// before it is sent to the kernel. Ops that need no reply, such as
+	// forgets, are reported too.
+	OpFinished(m OpMetrics)
+}
+
+// OpMetrics describes an op that a connection has finished handling.
+type OpMetrics struct {
+	// The op's name without the "Op" suffix, e.g. "LookUpInode", as for
+	// Stats.Ops.
+	Op string
+
+	// The time from reading the request to replying to it.
+	Latency time.Duration
+
+	// The error the op failed with, or zero if it succeeded.
+	Errno syscall.Errno
+
+	// The number of bytes returned by a successful ReadFileOp or accepted by
+	// a successful WriteFileOp, as for Stats.
+	BytesRead    int64
+	BytesWritten int64
+}
+
+// Return metrics for the supplied op, which was replied to with the supplied
+// errno. Latency is left to the caller.
+func opMetrics(op interface{}, errno syscall.Errno) OpMetrics {
+	m := OpMetrics{
+		Op:    opName(op),
+		Errno: errno,
+	}
+
+	if errno != 0 {
+		return m
+	}
+
+	switch o := op.(type) {
+	case *fuseops.ReadFileOp:
+		m.BytesRead = int64(o.BytesRead)
+
+	case *fuseops.WriteFileOp:
+		m.BytesWritten = o.Size
+		if o.BytesWritten > 0 && int64(o.BytesWritten) < o.Size {
+			m.BytesWritten = int64(o.BytesWritten)
+		}
+	}
+
+	return m
+}
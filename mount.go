@@ -15,8 +15,10 @@
 package fuse
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -29,8 +31,9 @@ import (
 // connection.
 type Server interface {
 	// Read and serve ops from the supplied connection until EOF. Do not return
-	// until all operations have been responded to. Must not be called more than
-	// once.
+	// until all operations have been responded to, including any still being
+	// served on other goroutines when ReadOp returns an error: the connection
+	// is closed as soon as ServeOps returns. Must not be called more than once.
 	ServeOps(*Connection)
 }
 
@@ -60,7 +63,7 @@ func Mount(
 	ready := make(chan error, 1)
 	dev, err := mount(dir, config, ready)
 	if err != nil {
-		return nil, fmt.Errorf("mount: %v", err)
+		return nil, fmt.Errorf("mount: %w", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Completed the mounting kickoff process")
@@ -82,16 +85,31 @@ func Mount(
 		config.ErrorLogger,
 		dev)
 	if err != nil {
-		return nil, fmt.Errorf("newConnection: %v", err)
+		return nil, fmt.Errorf("newConnection: %w", err)
 	}
 	if config.DebugLogger != nil {
 		config.DebugLogger.Println("Successfully created the connection")
 	}
 
+	mfs.connection = connection
+	mfs.notifier = &connectionNotifier{c: connection}
+	mfs.expirations = connection.expirations
+	mfs.protocolErrors = &connection.protocolErrors
+	mfs.stats = connection.stats
+	mfs.journal = connection.journal
+
+	maintainer := newMaintainer(&cfgCopy)
+
 	// Serve the connection in the background. When done, set the join status.
 	go func() {
 		server.ServeOps(connection)
+		maintainer.stop()
+
+		serveErr := connection.serveError(dir)
 		mfs.joinStatus = connection.close()
+		if serveErr != nil {
+			mfs.joinStatus = serveErr
+		}
 		close(mfs.joinStatusAvailable)
 	}()
 
@@ -101,12 +119,34 @@ func Mount(
 
 	// Wait for the mount process to complete.
 	if err := <-ready; err != nil {
-		return nil, fmt.Errorf("mount (background): %v", err)
+		return nil, fmt.Errorf("mount (background): %w", err)
 	}
 
+	maintainer.start()
+
 	return mfs, nil
 }
 
+// MountWithFD is like Mount, but serves the file system on an already-open
+// /dev/fuse descriptor rather than mounting it, for use when something else,
+// such as a privileged helper or a container runtime, has made the mount(2)
+// system call with the descriptor's fd=N option and passed the descriptor on.
+// It is equivalent to mounting on /dev/fd/N, which is what Dir reports. The
+// file system takes ownership of the descriptor, closing it once serving has
+// finished, and it is up to whoever mounted the file system to unmount it.
+//
+// Linux only. On other platforms MountWithFD fails with ENOTSUP.
+func MountWithFD(
+	fd uintptr,
+	server Server,
+	config *MountConfig) (*MountedFileSystem, error) {
+	if err := checkDeviceFD(fd); err != nil {
+		return nil, err
+	}
+
+	return Mount(fmt.Sprintf("/dev/fd/%d", fd), server, config)
+}
+
 func checkMountPoint(dir string) error {
 	if strings.HasPrefix(dir, "/dev/fd") {
 		return nil
@@ -118,10 +158,10 @@ func checkMountPoint(dir string) error {
 		return err
 
 	case err != nil:
-		return fmt.Errorf("Statting mount point: %v", err)
+		return fmt.Errorf("Statting mount point: %w", err)
 
 	case !fi.IsDir():
-		return fmt.Errorf("Mount point %s is not a directory", dir)
+		return fmt.Errorf("Mount point %s is not a directory: %w", dir, syscall.ENOTDIR)
 	}
 
 	return nil
@@ -155,8 +195,16 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
 	cmd.Env = append(cmd.Env, additionalEnv...)
 	cmd.ExtraFiles = []*os.File{writeFile}
+
 	cmd.Stderr = os.Stderr
 
+	// If we're waiting for the command, keep a copy of what it writes to
+	// stderr so that we can tell why it failed.
+	var stderr bytes.Buffer
+	if wait {
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	}
+
 	// Run the command.
 	if wait {
 		err = cmd.Run()
@@ -164,7 +212,7 @@ func fusermount(binary string, argv []string, additionalEnv []string, wait bool,
 		err = cmd.Start()
 	}
 	if err != nil {
-		return nil, fmt.Errorf("running %v: %v", binary, err)
+		return nil, fmt.Errorf("running %v: %w", binary, newOutputError(err, stderr.Bytes()))
 	}
 
 	if debugLogger != nil {
@@ -18,8 +18,15 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
+	"os"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/timeutil"
 )
 
 // Optional configuration accepted by Mount.
@@ -28,9 +35,15 @@ type MountConfig struct {
 	// should inherit. If nil, context.Background() will be used.
 	OpContext context.Context
 
-	// If non-empty, the name of the file system as displayed by e.g. `mount`.
-	// This is important because the `umount` command requires root privileges if
-	// it doesn't agree with /etc/fstab.
+	// If non-empty, the name of the file system as displayed by e.g. `mount`,
+	// and as the first field of /proc/mounts on Linux. This is important
+	// because the `umount` command requires root privileges if it doesn't agree
+	// with /etc/fstab. If empty, Subtype is used, and failing that a generic
+	// name on Linux and macFUSE's default on macOS.
+	//
+	// With fuse-t on macOS, which mounts the file system over NFS, `mount`
+	// shows the volume name instead, so this is used as VolumeName if that is
+	// empty.
 	FSName string
 
 	// Mount the file system in read-only mode. File modes will appear as normal,
@@ -43,10 +56,127 @@ type MountConfig struct {
 	// logging is performed.
 	ErrorLogger *log.Logger
 
+	// If positive, the time after which an op that the file system hasn't
+	// replied to is failed with OpTimeoutErrno on its behalf, so that a stalled
+	// backend doesn't leave system calls hanging. The op's context is cancelled
+	// with cause syscall.ETIMEDOUT; the file system must still reply to it,
+	// which then only releases its buffers.
+	//
+	// Ops whose replies hand the kernel an inode or a handle (lookups, ops that
+	// create files, opens, and READDIRPLUS) are never timed out, since the
+	// kernel would never forget or release one that the file system handed out
+	// after the op had been failed.
+	OpTimeout time.Duration
+
+	// The errno with which ops are failed by OpTimeout. If zero, EIO is used;
+	// ETIMEDOUT is another natural choice.
+	OpTimeoutErrno syscall.Errno
+
+	// A function to choose the errno with which to fail an op, given an error
+	// returned by the file system that isn't a syscall.Errno, for example one
+	// wrapping an error from a storage backend, so that backend errors are
+	// translated in one place rather than in every method. It may also be used
+	// to count such errors. Returning zero, or leaving this nil, falls back to
+	// StandardErrno, which unwraps syscall.Errno values and translates
+	// well-known errors such as fs.ErrNotExist and context.DeadlineExceeded,
+	// and then to EIO.
+	MapError func(op interface{}, err error) syscall.Errno
+
+	// A handler for requests from the kernel with opcodes that this package
+	// doesn't know about, which are otherwise passed to the server as opaque
+	// ops that it fails with ENOSYS. The handler is called on its own
+	// goroutine, concurrently with other ops, and the server never sees the
+	// requests it handles.
+	UnknownOpHandler UnknownOpHandler
+
+	// A function to replace the user and group IDs of the process responsible
+	// for each request, as seen by the file system in OpContext and
+	// MountedFileSystem.GetFuseContext. This is intended for tests of a file
+	// system's own permission checks, which can use it to act as a fixed
+	// identity regardless of who runs them. It doesn't affect the checks made
+	// by the kernel, such as those enabled by default_permissions.
+	MapCredentials func(uid, gid uint32) (uint32, uint32)
+
+	// A group of mounts whose kernel caches should be told to forget the
+	// directory entries removed or replaced by successful renames, unlinks,
+	// and rmdirs on any of them. See EntryInvalidationGroup.
+	EntryInvalidationGroup *EntryInvalidationGroup
+
+	// A function to call every MaintenanceInterval for as long as the file
+	// system is mounted, for periodic work such as expiring caches, renewing
+	// leases, or flushing metrics. Calls don't overlap; if one takes longer
+	// than the interval, the ticks it spans are skipped. The context is a
+	// child of OpContext and is cancelled when the file system is unmounted,
+	// after which Join waits for any call in progress to return. Ignored
+	// unless MaintenanceInterval is positive.
+	Maintenance         func(ctx context.Context)
+	MaintenanceInterval time.Duration
+
+	// Keep serving when the kernel sends a message that can't be parsed,
+	// rather than failing ReadOp and so stopping the server. The message is
+	// logged to ErrorLogger and, if the kernel expects a reply and the message
+	// is intact enough to tell, failed with EIO. Such messages are counted by
+	// MountedFileSystem.ProtocolErrors.
+	TolerateProtocolErrors bool
+
+	// When turned on, every request from the kernel is checked thoroughly
+	// before being converted to an op: its size must be exactly what the
+	// kernel would send, the names in it must be properly terminated, of legal
+	// length and, for directory entries, free of slashes, and the flags that
+	// can be checked must be legal. Requests that fail are logged, counted by
+	// MountedFileSystem.ProtocolErrors, and failed with EIO, and serving
+	// continues. This is intended for running against experimental kernels or
+	// other FUSE clients such as virtiofs frontends; requests with opcodes
+	// that this package doesn't know are left alone.
+	StrictProtocolValidation bool
+
+	// A development aid: when turned on, the responses that the file system
+	// fills in for ops it handles successfully are checked before being sent
+	// to the kernel. Child inode IDs must be non-zero, and for newly created
+	// children of the requested type; BytesRead must lie within the buffer and
+	// the requested size; handles must be minted for HandleData; and
+	// expiration times must not be in the past. Violations are logged to
+	// ErrorLogger and the op is failed with EIO, rather than leaving the kernel
+	// to reject or misinterpret the reply.
+	ValidateResponses bool
+
+	// Keep lookup counts for the inodes handed to the kernel, so that values
+	// attached to them with fuseops.ChildInodeEntry.Data can be fetched with
+	// InodeData until the kernel forgets them. This costs a map entry per
+	// inode known to the kernel.
+	TrackInodeData bool
+
+	// Hand each entry of a batch of forgets that the kernel sends to the file
+	// system as its own fuseops.ForgetInodeOp, rather than as a
+	// fuseops.BatchForgetOp, so that file systems that only count lookups in
+	// ForgetInode see every forget. Batches are sent by Linux whenever several
+	// forgets are queued at once, such as when evicting many inodes under
+	// memory pressure.
+	SplitBatchForgets bool
+
+	// If positive, the connection keeps a journal of the most recent requests
+	// received from the kernel and replies sent to it, of this many entries in
+	// total, for post-mortem debugging of a server that has crashed or hung.
+	// See MountedFileSystem.OpJournal and Connection.DumpOpJournalOnPanic.
+	// Recording costs a lock acquisition per request and per reply.
+	OpJournalSize int
+
+	// If set, told about each op as it is read from the kernel and replied
+	// to, with its latency, outcome and the bytes it read or wrote, for
+	// exporting metrics. See package prommetrics for a collector that exports
+	// them to Prometheus.
+	MetricsCollector MetricsCollector
+
 	// A logger to use for logging debug information. If nil, no debug logging is
 	// performed.
 	DebugLogger *log.Logger
 
+	// If set, given structured records of the requests, replies and errors
+	// that DebugLogger and ErrorLogger are told about, with the op ID, op
+	// name, inode, duration and error as separate fields, for example to emit
+	// JSON logs in production. It may be used alongside them or instead.
+	Logger Logger
+
 	// Linux only. OS X always behaves as if writeback caching is disabled.
 	//
 	// By default on Linux we allow the kernel to perform writeback caching
@@ -109,9 +239,23 @@ type MountConfig struct {
 	//     can spontaneously change for reasons the kernel doesn't observe. See
 	//     https://tinyurl.com/yyprvjvs for more discussion.
 	//
+	// *   In the same vein, the time at which a WriteFileOp arrives says
+	//     nothing about when the data was written. File systems should take
+	//     mtime from the SetInodeAttributesOp that follows, rather than
+	//     stamping files as writes arrive.
+	//
+	// *   To fill in the rest of a partially written page, the kernel may send
+	//     ReadFileOps through a handle opened with O_WRONLY, which the file
+	//     system must serve.
+	//
+	// *   The kernel handles O_APPEND itself, so WriteFileOps for such a handle
+	//     carry the offset of what it believes is the end of the file, which
+	//     the file system should write at rather than its own idea of the end.
+	//
 	// Setting DisableWritebackCaching disables this behavior. Instead the file
 	// system is called one or more times for each write(2), and the user's
-	// syscall doesn't return until the file system returns.
+	// syscall doesn't return until the file system returns. Writeback caching
+	// is also off on kernels that don't offer it (Linux < 3.15).
 	DisableWritebackCaching bool
 
 	// OS X only.
@@ -140,21 +284,39 @@ type MountConfig struct {
 	// target.
 	EnableSymlinkCaching bool
 
+	// Use direct IO for every file handle, as if each OpenFileOp handler set
+	// UseDirectIO, including handles opened by CreateFileOp. This suits file
+	// systems whose contents change out of band on every read, and
+	// benchmarking the file system rather than the page cache. Directory
+	// handles aren't affected, since the kernel doesn't cache directory
+	// listings unless OpenDirOp.CacheDir is set.
+	UseDirectIO bool
+
 	// Linux only.
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenFile as not needing
-	// OpenFile calls at all (Linux >= 3.16):
+	// OpenFile calls at all (Linux >= 3.16), nor the corresponding
+	// ReleaseFileHandle calls. This saves two round trips per file access for
+	// file systems that keep no per-handle state, such as read-mostly virtual
+	// file systems. Such a file system should leave OpenFile and
+	// ReleaseFileHandle unimplemented and ignore the handle in other ops. On
+	// kernels without support, an OpenFile failing with -ENOSYS is instead
+	// answered as a successful open with a zero handle.
 	EnableNoOpenSupport bool
 
 	// Linux only.
 	//
 	// Tell the kernel to treat returning -ENOSYS on OpenDir as not needing
-	// OpenDir calls at all (Linux >= 5.1):
+	// OpenDir calls at all (Linux >= 5.1). As with EnableNoOpenSupport, kernels
+	// without support instead see a successful open with a zero handle.
 	EnableNoOpendirSupport bool
 
 	// Disable FUSE default permissions.
 	// This is useful for situations where the backing data store (e.g., S3) doesn't
 	// actually utilise any form of qualifiable UNIX permissions.
+	//
+	// The kernel then sends fuseops.AccessOp for access(2) and chdir(2), so that
+	// the file system can apply a permission model of its own.
 	DisableDefaultPermissions bool
 
 	// Use vectored reads.
@@ -162,13 +324,104 @@ type MountConfig struct {
 	// the data is already in memory when they return it to FUSE.
 	// When turned on, ReadFileOp.Dst is always nil and the FS must return data
 	// being read from the file as a list of slices in ReadFileOp.Data.
+	// Without it, a file system may still reply with ReadFileOp.Data instead
+	// of filling in Dst.
 	UseVectoredRead bool
 
+	// When turned on, ReadFileOp.Dst and WriteFileOp.Data start on page
+	// boundaries, so that file systems can pass them to O_DIRECT files and
+	// other interfaces that require aligned buffers without copying them. This
+	// costs up to two more pages of memory per buffered request.
+	AlignBuffers bool
+
+	// When turned on, WriteFileOp.Data is nil and the data to write is read
+	// from WriteFileOp.Reader instead, which the file system may release with
+	// WriteFileOp.Release before responding. This suits file systems that
+	// stream large writes to a backend that is slow to acknowledge them.
+	StreamWrites bool
+
+	// Linux only. When turned on, messages are moved from the kernel into a
+	// pipe with splice(2) rather than copied into the connection's buffers,
+	// and the data of writes is left in the pipe for WriteFileOp.Reader to
+	// read. If the file system copies it to an *os.File or a socket with
+	// io.Copy, it is spliced there in turn and never copied through userspace.
+	// This implies StreamWrites.
+	//
+	// The pipes must hold a whole message, which takes more than the default
+	// limit of 1 MiB on the size of unprivileged processes' pipes
+	// (/proc/sys/fs/pipe-max-size) unless MaxWriteSize is lowered. If pipes
+	// that large can't be made, messages are read normally instead.
+	SpliceWrites bool
+
+	// If set, the buffers that requests are read into and replies are built
+	// in are taken from and returned to this, rather than kept on the
+	// connection's freelists. See MessageProvider. AlignBuffers doesn't apply
+	// to the messages it provides.
+	MessageProvider MessageProvider
+
+	// If positive, the largest write in bytes that the kernel may send, in
+	// place of the default of 1 MiB. The kernel splits larger writes itself
+	// rather than every file system having to. It won't go below 4 KiB.
+	//
+	// Smaller sizes suit file systems whose backends take data in smaller
+	// chunks. Larger ones are Linux only, and are capped at 65535 pages. They
+	// need Linux 6.13 or later with /proc/sys/fs/fuse/max_pages_limit raised
+	// to match, or the kernel splits writes at 256 pages anyway. The buffers
+	// that requests are read into grow to match.
+	MaxWriteSize int
+
+	// Linux only.
+	//
+	// If positive and smaller than the default, the largest number of pages
+	// that the kernel may put in a single read or write request, which can be
+	// used to work around kernel bugs that only affect large requests. This
+	// caps reads as well as writes. The default is 256, or as many as
+	// MaxWriteSize takes if that is larger. Kernels before 4.20 don't
+	// negotiate the limit, and put at most 32 pages in a request.
+	//
+	// The buffers that requests are read into are sized for the larger of
+	// this many pages and MaxWriteSize, so lowering both saves memory.
+	MaxPages int
+
+	// If positive, the most bytes that the kernel may read ahead of a file's
+	// readers, in place of the default of 1 MiB. The kernel uses the smaller
+	// of this and the limit it asked for.
+	MaxReadahead int
+
+	// Linux only.
+	//
+	// If greater than one, the number of descriptors to read requests from,
+	// each on its own goroutine. The connection's /dev/fuse descriptor is
+	// cloned with FUSE_DEV_IOC_CLONE (Linux 4.2 and later) for each one after
+	// the first, so that highly parallel workloads aren't held up by a single
+	// reader. If cloning fails, the error is logged and the descriptors that
+	// could be made are used.
+	//
+	// The clones don't divide the requests between them: the kernel keeps a
+	// single queue of pending requests for the connection, and each request
+	// goes to whichever descriptor reads next. Only the processing of
+	// requests once read, and their replies, are tracked per descriptor. So
+	// there is no isolation between descriptors, and ops reach
+	// Connection.ReadOp in no particular order.
+	DeviceQueues int
+
+	// Linux only. Experimental.
+	//
+	// Read requests from and write replies to /dev/fuse through an io_uring
+	// rather than with read(2) and writev(2), in the hope of cutting the cost
+	// of system calls under heavy load. Reads of /dev/fuse block, so the
+	// kernel serves them from its own worker threads rather than the
+	// goroutines that wait for them. If an io_uring can't be set up, for
+	// example because the kernel is too old or io_uring has been disabled,
+	// the error is logged and the descriptor is used directly. Doesn't apply
+	// to the messages read with SpliceWrites.
+	UseIOUring bool
+
 	// OS X only.
 	//
 	// The name of the mounted volume, as displayed in the Finder. If empty, a
 	// default name involving the string 'osxfuse' (the old name of macFUSE)
-	// is used.
+	// is used, or with fuse-t, FSName.
 	VolumeName string
 
 	// OS X only.
@@ -177,6 +430,17 @@ type MountConfig struct {
 	// FUSEImplMacFUSE.
 	FuseImpl FUSEImpl
 
+	// Linux only.
+	//
+	// Mount by running fusermount3, or fusermount if that isn't installed,
+	// even if the process has the privileges to mount the file system itself.
+	// fusermount is setuid root, mounts the file system on the user's behalf,
+	// and hands back the /dev/fuse descriptor over a socket. By default it is
+	// used only once mounting directly has failed for lack of privileges, as
+	// for a non-root user or in a rootless container. A mount made this way is
+	// recorded as the user's, so that they can unmount it with fusermount -u.
+	UseFusermount bool
+
 	// Additional key=value options to pass unadulterated to the underlying mount
 	// command. See `man 8 mount`, the fuse documentation, etc. for
 	// system-specific information.
@@ -188,14 +452,29 @@ type MountConfig struct {
 	// Sets the filesystem type (third field in /etc/mtab). /etc/mtab and
 	// /proc/mounts will show the filesystem type as fuse.<Subtype>.
 	// If not set, /proc/mounts will show the filesystem type as fuse/fuseblk.
+	//
+	// With macFUSE, the subtype is instead appended to the type that statfs(2)
+	// reports in f_fstypename, and so shown by `mount`. fuse-t doesn't support
+	// subtypes, and ignores this.
 	Subtype string
 
 	// Flag to enable async reads that are received from
-	// the kernel
+	// the kernel. Without it, the kernel sends reads for each file handle one
+	// at a time, which suits backends that require strictly serialized reads.
 	EnableAsyncReads bool
 
+	// Flag to let the kernel split direct IO reads and writes, including
+	// those from io_submit(2), into requests that it sends concurrently rather
+	// than one at a time. This benefits backends that handle parallel IO well.
+	// Has no effect on kernels that don't support it (protocol < 7.22).
+	EnableAsyncDirectIO bool
+
 	// Flag to enable parallel lookup and readdir operations from the
-	// kernel
+	// kernel. Without it, the kernel serializes lookups and readdirs within
+	// each directory, which limits directory-heavy workloads to one such op
+	// per directory at a time. When enabled, the file system must be prepared
+	// to handle concurrent LookUpInodeOps and ReadDirOps for the same
+	// directory. Has no effect on kernels that don't support it (Linux < 4.7).
 	// Ref: https://github.com/torvalds/linux/commit/5c672ab3f0ee0f78f7acad183f34db0f8781a200
 	EnableParallelDirOps bool
 
@@ -204,7 +483,48 @@ type MountConfig struct {
 	// op with the O_TRUNC flag set. In comparison, the default behavior is an OpenFile op
 	// without O_TRUNC, followed by a SetInodeAttributes op with the target size set to 0.
 	// Ref: https://github.com/torvalds/linux/commit/6ff958edbf39c014eb06b65ad25b736be08c4e63
+	//
+	// This saves a round trip per truncating open, and means that no other
+	// process can see the file opened but not yet truncated. The file system
+	// must then truncate the file itself when
+	// fuseops.OpenFileOp.OpenFlags.IsTruncate() is set. Has no effect on
+	// kernels that don't offer it.
 	EnableAtomicTrunc bool
+
+	// Flag to have the kernel send POSIX locks set and tested with fcntl(2) to
+	// the file system as SetLockOps and GetLockOps, rather than keeping track
+	// of them itself. Locks the kernel tracks are only seen by processes on
+	// the same machine, so file systems shared between machines that want
+	// locks to work across them must set this and implement the ops.
+	EnablePosixLocks bool
+
+	// Flag to have the kernel send locks taken with flock(2) to the file
+	// system as FlockOps, rather than keeping track of them itself. As with
+	// EnablePosixLocks, this is for file systems whose locks must be seen on
+	// other machines.
+	EnableFlockLocks bool
+
+	// Flag to have the kernel read directories with ReadDirPlusOps, which
+	// return the attributes of each entry along with its name, rather than
+	// following each ReadDirOp with a LookUpInodeOp for every entry. Kernels
+	// that can still send ReadDirOps when they judge that the attributes
+	// aren't wanted are allowed to, and the ops' Adaptive fields say whether
+	// they did. The file system must implement
+	// ReadDirPlusOp, since the kernel doesn't fall back to ReadDirOp if it
+	// fails.
+	EnableReadDirPlus bool
+
+	// The clock against which the expiration times in ops' responses (e.g.
+	// ChildInodeEntry.EntryExpiration) are measured when converting them to
+	// the relative timeouts the kernel wants. If nil, the real time is used.
+	//
+	// This is intended for tests that hand the file system a
+	// timeutil.SimulatedClock too. Because the kernel's own notion of time
+	// can't be faked, setting a clock also makes the connection remember the
+	// expiration times it has handed out, so that the test can advance the
+	// clock and then call MountedFileSystem.ExpireCaches to have the kernel
+	// drop whatever has expired, rather than sleeping until it does.
+	Clock timeutil.Clock
 }
 
 type FUSEImpl uint8
@@ -214,6 +534,99 @@ const (
 	FUSEImplMacFUSE
 )
 
+// Return the largest write to tell the kernel that we accept.
+func (c *MountConfig) maxWriteSize() uint32 {
+	const minWriteSize = 4096
+	switch {
+	case c.MaxWriteSize <= 0:
+		return buffer.MaxWriteSize
+
+	case c.MaxWriteSize < minWriteSize:
+		return minWriteSize
+
+	case c.MaxWriteSize > buffer.MaxWriteSizeLimit:
+		return buffer.MaxWriteSizeLimit
+
+	default:
+		return uint32(c.MaxWriteSize)
+	}
+}
+
+// Return the largest number of pages to tell the kernel that it may put in a
+// request.
+func (c *MountConfig) maxPages() uint16 {
+	pageSize := uint32(os.Getpagesize())
+	pages := (c.maxWriteSize() + pageSize - 1) / pageSize
+	if pages < 256 {
+		pages = 256
+	}
+
+	if pages > math.MaxUint16 {
+		pages = math.MaxUint16
+	}
+
+	if c.MaxPages > 0 && c.MaxPages < int(pages) {
+		pages = uint32(c.MaxPages)
+	}
+
+	return uint16(pages)
+}
+
+// The largest extended attribute value that the kernel sends.
+const xattrSizeMax = 1 << 16
+
+// Return the size of the largest message that the kernel may send: one with
+// the largest write that we allow, or with the largest extended attribute
+// value, whichever is bigger.
+func (c *MountConfig) maxMessageSize() int {
+	size := int(c.maxWriteSize())
+	if size < xattrSizeMax {
+		size = xattrSizeMax
+	}
+
+	return os.Getpagesize() + size
+}
+
+// Return the size of the buffers to read messages into for a kernel that puts
+// up to the given number of pages in a request: room for the largest message,
+// which the kernel insists on even if it splits writes into fewer pages, and
+// for the data of the largest read.
+func (c *MountConfig) inMessageSize(pages int) int {
+	size := c.maxMessageSize()
+	if reads := (1 + pages) * os.Getpagesize(); reads > size {
+		size = reads
+	}
+
+	return size
+}
+
+// Return the read-ahead limit to tell the kernel.
+func (c *MountConfig) maxReadahead() uint32 {
+	if c.MaxReadahead > 0 {
+		return uint32(c.MaxReadahead)
+	}
+
+	return maxReadahead
+}
+
+// Return the name of the file system to show, or empty for the default.
+func (c *MountConfig) fsName() string {
+	if c.FSName != "" {
+		return c.FSName
+	}
+
+	return c.Subtype
+}
+
+// Return the volume name to use with fuse-t, or empty for the default.
+func (c *MountConfig) fusetVolumeName() string {
+	if c.VolumeName != "" {
+		return c.VolumeName
+	}
+
+	return c.fsName()
+}
+
 // Create a map containing all of the key=value mount options to be given to
 // the mount helper.
 func (c *MountConfig) toMap() (opts map[string]string) {
@@ -235,7 +648,7 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 	//
 	// Cf. https://github.com/bazil/fuse/issues/89
 	// Cf. https://bugs.freedesktop.org/show_bug.cgi?id=90907
-	fsname := c.FSName
+	fsname := c.fsName()
 	if runtime.GOOS == "linux" && fsname == "" {
 		fsname = "some_fuse_file_system"
 	}
@@ -245,9 +658,16 @@ func (c *MountConfig) toMap() (opts map[string]string) {
 		opts["fsname"] = fsname
 	}
 
-	subtype := c.Subtype
-	if subtype != "" {
-		opts["subtype"] = subtype
+	// macFUSE calls the subtype fstypename, and rejects options it doesn't
+	// know.
+	//
+	// Cf. https://github.com/osxfuse/osxfuse/wiki/Mount-options#fstypename
+	if c.Subtype != "" {
+		if isDarwin {
+			opts["fstypename"] = c.Subtype
+		} else {
+			opts["subtype"] = c.Subtype
+		}
 	}
 
 	// Read only?
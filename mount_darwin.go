@@ -11,7 +11,6 @@ import (
 	"strings"
 	"syscall"
 
-	"github.com/jacobsa/fuse/internal/buffer"
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
@@ -139,7 +138,7 @@ func convertMountArgs(daemonVar string, libVar string,
 		//
 		// OSXFUSE seems to ignore InitResponse.MaxWrite, and uses
 		// this instead.
-		"-o", "iosize=" + strconv.FormatUint(buffer.MaxWriteSize, 10),
+		"-o", "iosize=" + strconv.FormatUint(uint64(cfg.maxWriteSize()), 10),
 	}
 
 	return argv, env, nil
@@ -182,11 +181,7 @@ func callMount(
 	go func() {
 		err := cmd.Wait()
 		if err != nil {
-			if buf.Len() > 0 {
-				output := buf.Bytes()
-				output = bytes.TrimRight(output, "\n")
-				err = fmt.Errorf("%v: %s", err, output)
-			}
+			err = newOutputError(err, buf.Bytes())
 		}
 
 		ready <- err
@@ -232,7 +227,7 @@ func mountOsxFuse(
 			ready <- nil
 			dev, err = callMountCommFD(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg)
 			if err != nil {
-				return nil, fmt.Errorf("callMount: %v", err)
+				return nil, fmt.Errorf("callMount: %w", err)
 			}
 			return
 		}
@@ -259,7 +254,7 @@ func mountOsxFuse(
 		// Call the mount binary with the device.
 		if err := callMount(loc.Mount, loc.DaemonVar, loc.LibVar, dir, cfg, dev, ready); err != nil {
 			dev.Close()
-			return nil, fmt.Errorf("callMount: %v", err)
+			return nil, fmt.Errorf("callMount: %w", err)
 		}
 
 		return dev, nil
@@ -392,12 +387,12 @@ func mountFuset(
 	fusekernel.IsPlatformFuseT = true
 	env := []string{}
 	argv := []string{
-		fmt.Sprintf("--rwsize=%d", buffer.MaxWriteSize),
+		fmt.Sprintf("--rwsize=%d", cfg.maxWriteSize()),
 	}
 
-	if cfg.VolumeName != "" {
+	if volname := cfg.fusetVolumeName(); volname != "" {
 		argv = append(argv, "--volname")
-		argv = append(argv, cfg.VolumeName)
+		argv = append(argv, volname)
 	}
 	if cfg.ReadOnly {
 		argv = append(argv, "-r")
@@ -425,3 +420,20 @@ func mount(
 	}
 	return
 }
+
+// Mounting on an already-open descriptor isn't supported on OS X.
+func checkDeviceFD(fd uintptr) error {
+	return fmt.Errorf("MountWithFD: %w", syscall.ENOTSUP)
+}
+
+// Devices can't be cloned on OS X.
+func cloneDevice(dev *os.File) (*os.File, error) {
+	return nil, fmt.Errorf("Cloning the device: %w", syscall.ENOTSUP)
+}
+
+// Whether the file system mounted on dir is still mounted but its connection
+// has been aborted. We have no way to tell on OS X, so we assume a clean
+// unmount.
+func connectionAborted(dir string) bool {
+	return false
+}
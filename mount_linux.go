@@ -9,6 +9,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/jacobsa/fuse/internal/fusekernel"
 	"golang.org/x/sys/unix"
 )
 
@@ -54,6 +55,21 @@ var mountflagopts = map[string]func(uintptr) uintptr{
 
 var errFallback = errors.New("sentinel: fallback to fusermount(1)")
 
+// Remove the fsname and subtype options from opts, returning the source and
+// file system type to pass to mount(2) in their place, as fusermount does.
+func takeFSNameAndType(opts map[string]string) (fsname, fstype string) {
+	fsname = opts["fsname"]
+	delete(opts, "fsname")
+
+	fstype = "fuse"
+	if subtype, ok := opts["subtype"]; ok {
+		fstype += "." + subtype
+	}
+	delete(opts, "subtype")
+
+	return fsname, fstype
+}
+
 func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Preparing for direct mounting")
@@ -84,13 +100,7 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 		mountflag = fn(mountflag)
 		delete(opts, k)
 	}
-	fsname := opts["fsname"]
-	delete(opts, "fsname") // handled via fstype mount(2) parameter
-	fstype := "fuse"
-	if subtype, ok := opts["subtype"]; ok {
-		fstype += "." + subtype
-	}
-	delete(opts, "subtype")
+	fsname, fstype := takeFSNameAndType(opts)
 	data += "," + mapToOptionsString(opts)
 
 	if cfg.DebugLogger != nil {
@@ -107,7 +117,7 @@ func directmount(dir string, cfg *MountConfig) (*os.File, error) {
 			return nil, errFallback
 
 		}
-		return nil, err
+		return nil, &os.PathError{Op: "mount", Path: dir, Err: err}
 	}
 	if cfg.DebugLogger != nil {
 		cfg.DebugLogger.Println("Unix mounting completed successfully")
@@ -134,16 +144,22 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 		return dev, nil
 	}
 
-	// Try mounting without fusermount(1) first: we might be running as root or
-	// have the CAP_SYS_ADMIN capability.
-	dev, err := directmount(dir, cfg)
+	// Try mounting without fusermount(1) first, unless configured not to: we
+	// might be running as root or have the CAP_SYS_ADMIN capability.
+	dev, err := (*os.File)(nil), errFallback
+	if !cfg.UseFusermount {
+		dev, err = directmount(dir, cfg)
+	}
+
 	if err == errFallback {
 		if cfg.DebugLogger != nil {
-			cfg.DebugLogger.Println("Directmount failed. Trying fallback.")
+			cfg.DebugLogger.Println("Directmount failed or skipped. Trying fusermount.")
 		}
 		fusermountPath, err := findFusermount()
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf(
+				"Mounting without privileges needs fusermount3 or fusermount: %w",
+				err)
 		}
 		argv := []string{
 			"-o", cfg.toOptionsString(),
@@ -155,6 +171,33 @@ func mount(dir string, cfg *MountConfig, ready chan<- error) (*os.File, error) {
 	return dev, err
 }
 
+// Make sure that a descriptor handed to MountWithFD is open.
+func checkDeviceFD(fd uintptr) error {
+	if _, err := unix.FcntlInt(fd, unix.F_GETFD, 0); err != nil {
+		return fmt.Errorf("Checking descriptor %d: %w", fd, err)
+	}
+
+	return nil
+}
+
+// Open a new descriptor for the connection on dev. It reads from the same
+// queue of pending requests as dev, but the kernel tracks the requests read
+// through it, and expects their replies, separately.
+func cloneDevice(dev *os.File) (*os.File, error) {
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Opening /dev/fuse: %w", err)
+	}
+
+	err = unix.IoctlSetPointerInt(fd, fusekernel.DevIocClone, int(dev.Fd()))
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("FUSE_DEV_IOC_CLONE: %w", err)
+	}
+
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
+
 func parseFuseFd(dir string) (int, error) {
 	if !strings.HasPrefix(dir, "/dev/fd/") {
 		return -1, fmt.Errorf("not a /dev/fd path")
@@ -167,3 +210,12 @@ func parseFuseFd(dir string) (int, error) {
 
 	return int(fd), nil
 }
+
+// Whether the file system mounted on dir is still mounted but its connection
+// has been aborted, in which case the kernel fails every request, including
+// the stat of the mount point, with ENOTCONN.
+func connectionAborted(dir string) bool {
+	var st syscall.Stat_t
+	err := syscall.Stat(dir, &st)
+	return err == syscall.ENOTCONN || err == syscall.ECONNABORTED
+}
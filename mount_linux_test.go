@@ -1,6 +1,9 @@
 package fuse
 
 import (
+	"errors"
+	"os/exec"
+	"syscall"
 	"testing"
 )
 
@@ -35,3 +38,64 @@ func Test_parseFuseFd(t *testing.T) {
 		}
 	})
 }
+
+func Test_mountUseFusermount(t *testing.T) {
+	// With no fusermount to be found, mounting must fail without trying to
+	// mount directly, even if we have the privileges to.
+	t.Setenv("PATH", t.TempDir())
+
+	ready := make(chan error, 1)
+	dev, err := mount(t.TempDir(), &MountConfig{UseFusermount: true}, ready)
+	if err == nil {
+		dev.Close()
+		t.Fatalf("expected an error, got nil")
+	}
+
+	if !errors.Is(err, exec.ErrNotFound) {
+		t.Errorf("expected exec.ErrNotFound, got %#v", err)
+	}
+}
+
+func Test_MountWithFD(t *testing.T) {
+	// A descriptor that isn't open is rejected up front.
+	_, err := MountWithFD(1<<20, nil, &MountConfig{})
+	if !errors.Is(err, syscall.EBADF) {
+		t.Errorf("expected EBADF, got %#v", err)
+	}
+}
+
+func Test_takeFSNameAndType(t *testing.T) {
+	testCases := []struct {
+		name       string
+		cfg        MountConfig
+		wantFSName string
+		wantFSType string
+	}{
+		{"default", MountConfig{}, "some_fuse_file_system", "fuse"},
+		{"fsname", MountConfig{FSName: "taco"}, "taco", "fuse"},
+		{"subtype", MountConfig{Subtype: "burrito"}, "burrito", "fuse.burrito"},
+		{"both", MountConfig{FSName: "taco", Subtype: "burrito"}, "taco", "fuse.burrito"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := tc.cfg.toMap()
+			fsname, fstype := takeFSNameAndType(opts)
+			if fsname != tc.wantFSName || fstype != tc.wantFSType {
+				t.Errorf(
+					"got (%q, %q), want (%q, %q)",
+					fsname,
+					fstype,
+					tc.wantFSName,
+					tc.wantFSType)
+			}
+
+			// The kernel rejects these in the data passed to mount(2).
+			for _, k := range []string{"fsname", "subtype"} {
+				if _, ok := opts[k]; ok {
+					t.Errorf("%s left in options: %v", k, opts)
+				}
+			}
+		})
+	}
+}
@@ -17,6 +17,8 @@ package fuse
 import (
 	"context"
 	"fmt"
+	"strings"
+	"sync/atomic"
 )
 
 // MountedFileSystem represents the status of a mount operation, with a method
@@ -24,6 +26,24 @@ import (
 type MountedFileSystem struct {
 	dir string
 
+	// The connection to the kernel, for Shutdown.
+	connection *Connection
+
+	// Sends notifications over the connection to the kernel.
+	notifier Notifier
+
+	// The expiration times handed to the kernel, if MountConfig.Clock is set.
+	expirations *expirationTracker
+
+	// The number of malformed messages ignored by the connection.
+	protocolErrors *atomic.Uint64
+
+	// Cumulative statistics maintained by the connection.
+	stats *connectionStats
+
+	// Recent requests and replies, if MountConfig.OpJournalSize is positive.
+	journal *opJournal
+
 	// The result to return from Join. Not valid until the channel is closed.
 	joinStatus          error
 	joinStatusAvailable chan struct{}
@@ -35,13 +55,23 @@ func (mfs *MountedFileSystem) Dir() string {
 	return mfs.dir
 }
 
+// Notifier returns a Notifier that may be used to tell the kernel about
+// changes to the file system that it can't otherwise see. It remains usable
+// until the file system is unmounted, after which its methods return errors.
+func (mfs *MountedFileSystem) Notifier() Notifier {
+	return mfs.notifier
+}
+
 // Join blocks until a mounted file system has been unmounted. It does not
 // return successfully until all ops read from the connection have been
 // responded to (i.e. the file system server has finished processing all
 // in-flight ops).
 //
-// The return value will be non-nil if anything unexpected happened while
-// serving. May be called multiple times.
+// The return value is nil if the file system was unmounted cleanly. Otherwise
+// it describes what went wrong while serving: ErrConnectionAborted if the
+// kernel's connection was aborted, an error wrapping ErrProtocol if the kernel
+// sent a malformed message, or an error wrapping the syscall.Errno with which
+// reading from or closing the device failed. May be called multiple times.
 func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	select {
 	case <-mfs.joinStatusAvailable:
@@ -51,6 +81,51 @@ func (mfs *MountedFileSystem) Join(ctx context.Context) error {
 	}
 }
 
+// Shutdown unmounts the file system gracefully, for example so that a server
+// can be restarted without failing the system calls that are in progress. It
+// stops handing new ops to the server, failing them with ENOTCONN as they
+// would fail once the file system is unmounted, waits for the ops already
+// handed to the server to be responded to, unmounts the file system, and
+// waits for the server to finish as Join does, returning its result.
+//
+// If the context is cancelled before the ops in flight have been responded
+// to, or unmounting fails, for example with EBUSY because files are still
+// open, Shutdown returns an error and the server goes back to handling new
+// ops as usual.
+//
+// A file system served on an already-open device, with MountWithFD or by
+// mounting on /dev/fd/N, was mounted by someone else, so Shutdown can't
+// unmount it. Instead, having drained the ops
+// in flight, it waits for whoever mounted it to unmount it.
+func (mfs *MountedFileSystem) Shutdown(ctx context.Context) error {
+	c := mfs.connection
+
+	select {
+	case <-c.beginDrain():
+	case <-ctx.Done():
+		c.endDrain()
+		return fmt.Errorf("Waiting for ops in flight: %w", ctx.Err())
+	}
+
+	if !strings.HasPrefix(mfs.dir, "/dev/fd") {
+		if err := Unmount(mfs.dir); err != nil {
+			c.endDrain()
+			return fmt.Errorf("Unmount: %w", err)
+		}
+
+		return mfs.Join(ctx)
+	}
+
+	select {
+	case <-mfs.joinStatusAvailable:
+		return mfs.joinStatus
+
+	case <-ctx.Done():
+		c.endDrain()
+		return fmt.Errorf("Waiting for unmount: %w", ctx.Err())
+	}
+}
+
 // GetFuseContext implements the equiv. of FUSE-C fuse_get_context() and thus
 // returns the UID / GID / PID associated with all FUSE requests send by the kernel.
 // ctx parameter must be one of the context from the fuseops handlers (e.g.: CreateFile)
@@ -60,7 +135,6 @@ func (mfs *MountedFileSystem) GetFuseContext(ctx context.Context) (uid, gid, pid
 	if !ok {
 		return 0, 0, 0, fmt.Errorf("GetFuseContext called with invalid context: %#v", ctx)
 	}
-	inMsg := state.inMsg
-	header := inMsg.Header()
+	header := state.header()
 	return header.Uid, header.Gid, header.Pid, nil
 }
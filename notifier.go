@@ -0,0 +1,235 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"math"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Notifier tells the kernel about changes to a file system that it couldn't
+// otherwise know about, for example changes made by other clients of a network
+// file system, so that it doesn't keep serving stale data from its caches.
+// Obtain one for a mounted file system from MountedFileSystem.Notifier.
+//
+// Each method returns ENOENT if the kernel has nothing cached for the inode
+// or entry in question, which is usually not worth reporting, and
+// ErrUnmounted once the file system is no longer mounted.
+//
+// Notifications may be sent concurrently with ops, but must not be sent from
+// within the handler for an op that affects the same inode or directory;
+// the kernel may hold locks that the notification needs until the op has
+// been responded to.
+type Notifier interface {
+	// InvalidateInode invalidates the kernel's cached attributes for the inode,
+	// along with any cached data in the byte range [offset, offset+length). A
+	// length of zero or less means up to the end of the file, and a negative
+	// offset means to invalidate attributes only.
+	InvalidateInode(inode fuseops.InodeID, offset int64, length int64) error
+
+	// InvalidateEntry invalidates the kernel's cached lookup of the given name
+	// within the given parent directory, so that it will be looked up afresh.
+	InvalidateEntry(parent fuseops.InodeID, name string) error
+
+	// NotifyDelete tells the kernel that the given name within the given
+	// parent directory, which referred to the given child inode, has been
+	// removed. Like InvalidateEntry, it drops the cached lookup, but it also
+	// marks the child as unlinked, so that processes that still have it open
+	// or as their working directory see it as deleted rather than as a file
+	// with a name that no longer resolves. The entry is invalidated even if
+	// the kernel has cached the name for some other inode, which returns
+	// ENOENT, or for a directory that it still thinks has entries, which
+	// returns ENOTEMPTY.
+	NotifyDelete(parent fuseops.InodeID, child fuseops.InodeID, name string) error
+
+	// Store pushes the supplied data into the kernel's page cache for the
+	// inode, starting at the given offset, and extends the cached file size if
+	// the data reaches past it.
+	Store(inode fuseops.InodeID, offset uint64, data []byte) error
+
+	// Retrieve asks the kernel for the data it has cached for the inode,
+	// starting at the given offset, and copies up to len(dst) bytes of it into
+	// dst, returning the number of bytes copied. This lets a file system
+	// recover data that the kernel holds but that it no longer has itself,
+	// for example after losing its own copy.
+	//
+	// The kernel stops at the first page it doesn't have cached, at the end
+	// of the file, and at MountConfig.MaxWriteSize bytes, so fewer bytes than
+	// requested, including none at all, doesn't mean the file is any shorter.
+	// It only looks at what is cached, so data written by processes but not
+	// yet sent to the file system comes back too when writeback caching is
+	// enabled.
+	//
+	// The kernel's reply arrives as a request, so Retrieve blocks until the
+	// connection's ReadOp loop has read it. It must not be called from the
+	// loop itself, for example from an op handler run by a server that
+	// handles ops one at a time rather than in their own goroutines.
+	Retrieve(inode fuseops.InodeID, offset uint64, dst []byte) (int, error)
+
+	// NotifyPollWakeup wakes the callers waiting in poll(2) and friends on the
+	// file with the given PollOp.PollHandle, so that they poll it again. Unlike
+	// the other methods, this may be sent from within any op's handler.
+	NotifyPollWakeup(pollHandle uint64) error
+}
+
+// A Notifier that writes notifications to a connection.
+type connectionNotifier struct {
+	c *Connection
+}
+
+func (n *connectionNotifier) InvalidateInode(
+	inode fuseops.InodeID,
+	offset int64,
+	length int64) error {
+	out := fusekernel.NotifyInvalInodeOut{
+		Ino: uint64(inode),
+		Off: offset,
+		Len: length,
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: invalidate inode %v [%d, +%d)", inode, offset, length)
+	return n.c.notify(
+		fusekernel.NotifyCodeInvalInode,
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)))
+}
+
+func (n *connectionNotifier) InvalidateEntry(
+	parent fuseops.InodeID,
+	name string) error {
+	out := fusekernel.NotifyInvalEntryOut{
+		Parent:  uint64(parent),
+		Namelen: uint32(len(name)),
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: invalidate entry %v/%q", parent, name)
+	return n.c.notify(
+		fusekernel.NotifyCodeInvalEntry,
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)),
+		[]byte(name+"\x00"))
+}
+
+func (n *connectionNotifier) NotifyDelete(
+	parent fuseops.InodeID,
+	child fuseops.InodeID,
+	name string) error {
+	out := fusekernel.NotifyDeleteOut{
+		Parent:  uint64(parent),
+		Child:   uint64(child),
+		Namelen: uint32(len(name)),
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: delete entry %v/%q (inode %v)", parent, name, child)
+	return n.c.notify(
+		fusekernel.NotifyCodeDelete,
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)),
+		[]byte(name+"\x00"))
+}
+
+func (n *connectionNotifier) Store(
+	inode fuseops.InodeID,
+	offset uint64,
+	data []byte) error {
+	out := fusekernel.NotifyStoreOut{
+		Nodeid: uint64(inode),
+		Offset: offset,
+		Size:   uint32(len(data)),
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: store %d bytes at %d in inode %v", len(data), offset, inode)
+	return n.c.notify(
+		fusekernel.NotifyCodeStore,
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)),
+		data)
+}
+
+func (n *connectionNotifier) Retrieve(
+	inode fuseops.InodeID,
+	offset uint64,
+	dst []byte) (int, error) {
+	id, r := n.c.beginRetrieve(dst)
+	defer n.c.endRetrieve(id)
+
+	size := len(dst)
+	if size > math.MaxUint32 {
+		size = math.MaxUint32
+	}
+
+	out := fusekernel.NotifyRetrieveOut{
+		NotifyUnique: id,
+		Nodeid:       uint64(inode),
+		Offset:       offset,
+		Size:         uint32(size),
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: retrieve %d bytes at %d from inode %v", size, offset, inode)
+	if r.err == nil {
+		err := n.c.notify(
+			fusekernel.NotifyCodeRetrieve,
+			unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)))
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	<-r.done
+	return r.n, r.err
+}
+
+func (n *connectionNotifier) NotifyPollWakeup(pollHandle uint64) error {
+	out := fusekernel.NotifyPollWakeupOut{
+		Kh: pollHandle,
+	}
+
+	n.c.debugLog(0, 2, "-> Notify: poll wakeup %#x", pollHandle)
+	return n.c.notify(
+		fusekernel.NotifyCodePoll,
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)))
+}
+
+// Write a notification with the given code, whose body is the concatenation
+// of the supplied slices, to the kernel.
+func (c *Connection) notify(code int32, body ...[]byte) error {
+	const headerSize = int(unsafe.Sizeof(fusekernel.OutHeader{}))
+
+	size := headerSize
+	for _, b := range body {
+		size += len(b)
+	}
+
+	msg := make([]byte, headerSize, size)
+	for _, b := range body {
+		msg = append(msg, b...)
+	}
+
+	h := (*fusekernel.OutHeader)(unsafe.Pointer(&msg[0]))
+	*h = fusekernel.OutHeader{
+		Len:   uint32(size),
+		Error: code,
+	}
+
+	// The kernel refuses writes once it has hung up, and the device is closed
+	// soon after.
+	err := c.writeMessage(c.dev, msg)
+	if err == syscall.ENODEV || err == syscall.EBADF {
+		return ErrUnmounted
+	}
+
+	return err
+}
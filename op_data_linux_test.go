@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A file system that attaches a string to each file handle it opens, and
+// records the values supplied with reads and releases.
+type handleDataFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	seen []interface{}
+}
+
+func (fs *handleDataFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	op.Handle = fuseops.HandleID(op.Inode)
+	op.HandleData = fmt.Sprintf("state for %d", op.Inode)
+	return nil
+}
+
+func (fs *handleDataFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.seen = append(fs.seen, op.HandleData)
+	return nil
+}
+
+func (fs *handleDataFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.seen = append(fs.seen, op.HandleData)
+	return nil
+}
+
+func TestHandleData(t *testing.T) {
+	fs := &handleDataFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	call := func(opcode uint32, inode uint64, p unsafe.Pointer, size uintptr) {
+		t.Helper()
+		r, err := k.Call(opcode, inode, structBytes(p, size, int(size)))
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != 0 {
+			t.Fatalf("Opcode %d: %v", opcode, r.Error)
+		}
+	}
+
+	// Handles are the same as inode IDs.
+	open := func(inode uint64) {
+		in := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+		call(fusekernel.OpOpen, inode, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	}
+
+	read := func(inode uint64) {
+		in := fusekernel.ReadIn{Fh: inode, Size: 1}
+		call(fusekernel.OpRead, inode, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	}
+
+	release := func(inode uint64) {
+		in := fusekernel.ReleaseIn{Fh: inode}
+		call(fusekernel.OpRelease, inode, unsafe.Pointer(&in), unsafe.Sizeof(in))
+	}
+
+	open(2)
+	open(3)
+	read(2)
+	read(3)
+	release(2)
+	read(2)
+	read(3)
+
+	want := []interface{}{
+		"state for 2",
+		"state for 3",
+		"state for 2",
+		nil,
+		"state for 3",
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !reflect.DeepEqual(fs.seen, want) {
+		t.Errorf("Got %v, want %v", fs.seen, want)
+	}
+}
+
+// A file system that attaches a string to inode 5, and records the values
+// attached to the inodes it is asked for the attributes of.
+type inodeDataFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu   sync.Mutex
+	seen []interface{}
+}
+
+func (fs *inodeDataFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 5
+	op.Entry.Data = "data for 5"
+	return nil
+}
+
+func (fs *inodeDataFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.seen = append(fs.seen, fuse.InodeData(ctx, op.Inode))
+	return nil
+}
+
+func (fs *inodeDataFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	return nil
+}
+
+func TestInodeData(t *testing.T) {
+	fs := &inodeDataFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{TrackInodeData: true},
+		&fusetesting.FakeKernelConfig{})
+
+	call := func(opcode uint32, inode uint64, body []byte) {
+		t.Helper()
+		if _, err := k.Call(opcode, inode, body); err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	}
+
+	getattr := func() {
+		var in fusekernel.GetattrIn
+		call(
+			fusekernel.OpGetattr,
+			5,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+	}
+
+	// The server handles forgets before reading the next request, so they
+	// take effect before the calls that follow.
+	forget := func() {
+		in := fusekernel.ForgetIn{Nlookup: 1}
+		_, err := k.Start(
+			fusekernel.OpForget,
+			5,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	}
+
+	getattr()
+	call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	call(fusekernel.OpLookup, 1, nameBytes("bar"))
+	getattr()
+	forget()
+	getattr()
+	forget()
+	getattr()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	want := []interface{}{nil, "data for 5", "data for 5", nil}
+	if !reflect.DeepEqual(fs.seen, want) {
+		t.Errorf("Got %v, want %v", fs.seen, want)
+	}
+}
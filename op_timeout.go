@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// The timer for an op with cfg.OpTimeout, and whether the op has been replied
+// to, either by the file system or by the timer.
+type opTimeout struct {
+	timer   *time.Timer
+	replied atomic.Bool
+}
+
+// Return whether ops with the supplied opcode are subject to cfg.OpTimeout.
+// Forgets aren't replied to at all. Ops whose replies hand the kernel an inode
+// or a handle are exempt too: the kernel would never hear about one that
+// succeeded after being failed on the file system's behalf, so it would never
+// forget the inode or release the handle, and the file system would leak it.
+func opCanTimeOut(opCode uint32) bool {
+	switch opCode {
+	case fusekernel.OpForget,
+		fusekernel.OpBatchForget,
+		fusekernel.OpLookup,
+		fusekernel.OpMkdir,
+		fusekernel.OpMknod,
+		fusekernel.OpSymlink,
+		fusekernel.OpLink,
+		fusekernel.OpCreate,
+		fusekernel.OpOpen,
+		fusekernel.OpOpendir,
+		fusekernel.OpReaddirplus:
+		return false
+	}
+
+	return true
+}
+
+// Start the timer for the op whose context is supplied, which has
+// state.timeout set.
+func (c *Connection) startOpTimeout(ctx context.Context, state opState) {
+	state.timeout.timer = time.AfterFunc(c.cfg.OpTimeout, func() {
+		c.timeOutOp(ctx)
+	})
+}
+
+// Reply to the op whose context is supplied on the file system's behalf,
+// because cfg.OpTimeout has passed, unless the file system has already
+// replied. Its context is cancelled with cause syscall.ETIMEDOUT.
+//
+// The file system may still be using the op and its buffers, so the reply is
+// built in a buffer of its own, and the buffers are left for the file
+// system's own Reply to release.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) timeOutOp(ctx context.Context) {
+	state := ctx.Value(contextKey).(opState)
+	if !state.timeout.replied.CompareAndSwap(false, true) {
+		return
+	}
+
+	header := *state.header()
+
+	c.mu.Lock()
+	oc, ok := c.cancelFuncs[header.Unique]
+	c.mu.Unlock()
+
+	if ok {
+		oc.cancel(syscall.ETIMEDOUT)
+	}
+
+	errno := c.cfg.OpTimeoutErrno
+	if errno == 0 {
+		errno = syscall.EIO
+	}
+
+	state.inMsg = nil
+	state.payload = nil
+	state.outMsg = c.getOutMessage()
+	state.batchHeader = &header
+	state.timedOut = true
+
+	c.reply(ctx, state, errno)
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestUseDirectIO(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{UseDirectIO: true},
+		&fusetesting.FakeKernelConfig{})
+
+	in := fusekernel.CreateIn{Flags: syscall.O_RDWR, Mode: 0644}
+	r, err := k.Call(
+		fusekernel.OpCreate,
+		1,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+		nameBytes("foo"))
+
+	if err != nil || r.Error != 0 {
+		t.Fatalf("Call: %v, %v", err, r.Error)
+	}
+
+	var out fusekernel.OpenOut
+	copy(
+		unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)),
+		r.Body[len(r.Body)-int(unsafe.Sizeof(out)):])
+
+	if fusekernel.OpenResponseFlags(out.OpenFlags)&fusekernel.OpenDirectIO == 0 {
+		t.Errorf("Unexpected open flags: %v", fusekernel.OpenResponseFlags(out.OpenFlags))
+	}
+}
+
+// A file system that sets the per-handle open flags it is given.
+type openFlagsFS struct {
+	fuseutil.NotImplementedFileSystem
+	set func(op interface{})
+}
+
+func (fs *openFlagsFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	fs.set(op)
+	return nil
+}
+
+func (fs *openFlagsFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	op.Entry.Child = 2
+	op.Entry.Attributes = fuseops.InodeAttributes{Nlink: 1, Mode: op.Mode}
+	fs.set(op)
+	return nil
+}
+
+func (fs *openFlagsFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	fs.set(op)
+	return nil
+}
+
+func TestOpenResponseFlags(t *testing.T) {
+	testCases := []struct {
+		name   string
+		opcode uint32
+		set    func(op interface{})
+		want   fusekernel.OpenResponseFlags
+	}{
+		{
+			name:   "file defaults",
+			opcode: fusekernel.OpOpen,
+			set:    func(op interface{}) {},
+			want:   0,
+		},
+		{
+			name:   "file",
+			opcode: fusekernel.OpOpen,
+			set: func(op interface{}) {
+				o := op.(*fuseops.OpenFileOp)
+				o.KeepPageCache = true
+				o.UseDirectIO = true
+				o.NonSeekable = true
+			},
+			want: fusekernel.OpenKeepCache | fusekernel.OpenDirectIO | fusekernel.OpenNonSeekable,
+		},
+		{
+			name:   "stream",
+			opcode: fusekernel.OpOpen,
+			set:    func(op interface{}) { op.(*fuseops.OpenFileOp).Stream = true },
+			want:   fusekernel.OpenStream | fusekernel.OpenNonSeekable,
+		},
+		{
+			name:   "created",
+			opcode: fusekernel.OpCreate,
+			set: func(op interface{}) {
+				o := op.(*fuseops.CreateFileOp)
+				o.UseDirectIO = true
+				o.Stream = true
+			},
+			want: fusekernel.OpenDirectIO | fusekernel.OpenStream | fusekernel.OpenNonSeekable,
+		},
+		{
+			name:   "parallel direct writes",
+			opcode: fusekernel.OpOpen,
+			set: func(op interface{}) {
+				o := op.(*fuseops.OpenFileOp)
+				o.UseDirectIO = true
+				o.ParallelDirectWrites = true
+			},
+			want: fusekernel.OpenDirectIO | fusekernel.OpenParallelDirectWrites,
+		},
+		{
+			name:   "created for parallel direct writes",
+			opcode: fusekernel.OpCreate,
+			set:    func(op interface{}) { op.(*fuseops.CreateFileOp).ParallelDirectWrites = true },
+			want:   fusekernel.OpenParallelDirectWrites,
+		},
+		{
+			name:   "dir",
+			opcode: fusekernel.OpOpendir,
+			set: func(op interface{}) {
+				o := op.(*fuseops.OpenDirOp)
+				o.CacheDir = true
+				o.KeepCache = true
+			},
+			want: fusekernel.OpenCacheDir | fusekernel.OpenKeepCache,
+		},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&openFlagsFS{set: tc.set}),
+			&fuse.MountConfig{},
+			&fusetesting.FakeKernelConfig{})
+
+		var r fusetesting.FakeReply
+		var err error
+		if tc.opcode == fusekernel.OpCreate {
+			in := fusekernel.CreateIn{Flags: syscall.O_RDWR, Mode: 0644}
+			r, err = k.Call(
+				tc.opcode,
+				1,
+				structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+				nameBytes("foo"))
+		} else {
+			in := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+			r, err = k.Call(
+				tc.opcode,
+				1,
+				structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+		}
+
+		k.Close()
+		if err != nil || r.Error != 0 {
+			t.Fatalf("%s: Call: %v, %v", tc.name, err, r.Error)
+		}
+
+		var out fusekernel.OpenOut
+		copy(
+			unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)),
+			r.Body[len(r.Body)-int(unsafe.Sizeof(out)):])
+
+		if got := fusekernel.OpenResponseFlags(out.OpenFlags); got != tc.want {
+			t.Errorf("%s: got flags %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAtomicTrunc(t *testing.T) {
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    bool
+	}{
+		{false, fusekernel.InitAtomicTrunc, false},
+		{true, 0, false},
+		{true, fusekernel.InitAtomicTrunc, true},
+	}
+
+	for _, tc := range testCases {
+		var got fusekernel.OpenFlags
+		fs := &openFlagsFS{
+			set: func(op interface{}) {
+				got = op.(*fuseops.OpenFileOp).OpenFlags
+			},
+		}
+
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{EnableAtomicTrunc: tc.enable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if (flags&fusekernel.InitAtomicTrunc != 0) != tc.want {
+			t.Errorf("%v, %v: unexpected flags %v", tc.enable, tc.offered, flags)
+		}
+
+		// The flag is passed on as the kernel sends it.
+		in := fusekernel.OpenIn{Flags: syscall.O_WRONLY | syscall.O_TRUNC}
+		r, err := k.Call(
+			fusekernel.OpOpen,
+			2,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		k.Close()
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		if !got.IsTruncate() || got.AccessMode() != fuseops.AccessWriteOnly {
+			t.Errorf("Got open flags %v", got)
+		}
+	}
+}
@@ -19,11 +19,12 @@ import (
 	"github.com/jacobsa/fuse/internal/fusekernel"
 )
 
-// A sentinel used for unknown ops. The user is expected to respond with a
-// non-nil error.
+// A sentinel used for unknown ops. Unless MountConfig.UnknownOpHandler is set,
+// the user is expected to respond with a non-nil error.
 type unknownOp struct {
-	OpCode uint32
-	Inode  fuseops.InodeID
+	OpCode  uint32
+	Inode   fuseops.InodeID
+	Payload []byte
 }
 
 // Causes us to cancel the associated context.
@@ -0,0 +1,266 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package prommetrics collects metrics about the ops that a file system
+// handles, as a fuse.MetricsCollector, and exports them in the Prometheus
+// text exposition format, for scraping over HTTP:
+//
+//	c := prommetrics.NewCollector("myfs")
+//	http.Handle("/metrics", c)
+//	mfs, err := fuse.Mount(dir, server, &fuse.MountConfig{MetricsCollector: c})
+//
+// It doesn't depend on the Prometheus client library, so that depending on
+// package fuse doesn't pull it in. The metrics exported, each prefixed by the
+// collector's namespace, are:
+//
+//   - fuse_ops_total: ops handled, by op name.
+//   - fuse_op_errors_total: ops that failed, by op name and errno name.
+//   - fuse_ops_in_flight: ops read but not yet replied to, by op name.
+//   - fuse_op_duration_seconds: a histogram of op latencies, by op name.
+//   - fuse_read_bytes_total and fuse_written_bytes_total: the bytes returned
+//     by reads and accepted by writes.
+package prommetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/jacobsa/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// The upper bounds, in seconds, of the buckets of op latency histograms,
+// from 100µs for ops answered from memory to 10s for slow backends.
+var durationBuckets = []float64{
+	0.0001, 0.00025, 0.0005,
+	0.001, 0.0025, 0.005,
+	0.01, 0.025, 0.05,
+	0.1, 0.25, 0.5,
+	1, 2.5, 5, 10,
+}
+
+// Collector is a fuse.MetricsCollector that keeps metrics for export to
+// Prometheus. It is an http.Handler that serves them. The zero value is not
+// usable; use NewCollector.
+type Collector struct {
+	namespace string
+
+	mu sync.Mutex
+
+	// Metrics for each op name.
+	//
+	// GUARDED_BY(mu)
+	ops map[string]*opMetrics
+
+	// GUARDED_BY(mu)
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// The metrics for one op name.
+type opMetrics struct {
+	total    uint64
+	inFlight int64
+	errors   map[syscall.Errno]uint64
+
+	// Counts of latencies no greater than each of durationBuckets, not
+	// cumulative, and the count and sum of all of them.
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+var _ fuse.MetricsCollector = &Collector{}
+var _ http.Handler = &Collector{}
+
+// NewCollector creates a collector whose metrics have names prefixed by
+// namespace and an underscore, unless namespace is empty.
+func NewCollector(namespace string) *Collector {
+	if namespace != "" {
+		namespace += "_"
+	}
+
+	return &Collector{
+		namespace: namespace,
+		ops:       make(map[string]*opMetrics),
+	}
+}
+
+// LOCKS_REQUIRED(c.mu)
+func (c *Collector) op(name string) *opMetrics {
+	m := c.ops[name]
+	if m == nil {
+		m = &opMetrics{
+			errors:  make(map[syscall.Errno]uint64),
+			buckets: make([]uint64, len(durationBuckets)),
+		}
+
+		c.ops[name] = m
+	}
+
+	return m
+}
+
+// OpStarted implements fuse.MetricsCollector.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Collector) OpStarted(op string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.op(op).inFlight++
+}
+
+// OpFinished implements fuse.MetricsCollector.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Collector) OpFinished(m fuse.OpMetrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	om := c.op(m.Op)
+	om.inFlight--
+	om.total++
+	if m.Errno != 0 {
+		om.errors[m.Errno]++
+	}
+
+	secs := m.Latency.Seconds()
+	i := sort.SearchFloat64s(durationBuckets, secs)
+	if i < len(durationBuckets) {
+		om.buckets[i]++
+	}
+
+	om.count++
+	om.sum += secs
+
+	c.bytesRead += m.BytesRead
+	c.bytesWritten += m.BytesWritten
+}
+
+// ServeHTTP serves the metrics in the Prometheus text exposition format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.WriteTo(w)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Collector) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	b := bufio.NewWriter(cw)
+	ns := c.namespace
+
+	names := make([]string, 0, len(c.ops))
+	for name := range c.ops {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	header(b, ns+"fuse_ops_total", "counter", "Ops handled, by op name.")
+	for _, name := range names {
+		fmt.Fprintf(b, "%sfuse_ops_total{op=%q} %d\n", ns, name, c.ops[name].total)
+	}
+
+	header(b, ns+"fuse_op_errors_total", "counter", "Ops that failed, by op name and errno.")
+	for _, name := range names {
+		m := c.ops[name]
+		errnos := make([]syscall.Errno, 0, len(m.errors))
+		for errno := range m.errors {
+			errnos = append(errnos, errno)
+		}
+		sort.Slice(errnos, func(i, j int) bool { return errnos[i] < errnos[j] })
+
+		for _, errno := range errnos {
+			fmt.Fprintf(
+				b,
+				"%sfuse_op_errors_total{op=%q,errno=%q} %d\n",
+				ns,
+				name,
+				errnoName(errno),
+				m.errors[errno])
+		}
+	}
+
+	header(b, ns+"fuse_ops_in_flight", "gauge", "Ops read from the kernel but not yet replied to, by op name.")
+	for _, name := range names {
+		fmt.Fprintf(b, "%sfuse_ops_in_flight{op=%q} %d\n", ns, name, c.ops[name].inFlight)
+	}
+
+	header(b, ns+"fuse_op_duration_seconds", "histogram", "Time from reading ops to replying to them, by op name.")
+	for _, name := range names {
+		m := c.ops[name]
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += m.buckets[i]
+			fmt.Fprintf(
+				b,
+				"%sfuse_op_duration_seconds_bucket{op=%q,le=%q} %d\n",
+				ns,
+				name,
+				strconv.FormatFloat(le, 'g', -1, 64),
+				cumulative)
+		}
+
+		fmt.Fprintf(b, "%sfuse_op_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", ns, name, m.count)
+		fmt.Fprintf(b, "%sfuse_op_duration_seconds_sum{op=%q} %s\n", ns, name, strconv.FormatFloat(m.sum, 'g', -1, 64))
+		fmt.Fprintf(b, "%sfuse_op_duration_seconds_count{op=%q} %d\n", ns, name, m.count)
+	}
+
+	header(b, ns+"fuse_read_bytes_total", "counter", "Bytes returned by successful reads.")
+	fmt.Fprintf(b, "%sfuse_read_bytes_total %d\n", ns, c.bytesRead)
+
+	header(b, ns+"fuse_written_bytes_total", "counter", "Bytes accepted by successful writes.")
+	fmt.Fprintf(b, "%sfuse_written_bytes_total %d\n", ns, c.bytesWritten)
+
+	err := b.Flush()
+	return cw.n, err
+}
+
+// Write the HELP and TYPE lines that introduce a metric.
+func header(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Return the name of the supplied errno, e.g. "ENOENT", or its number if it
+// has none.
+func errnoName(errno syscall.Errno) string {
+	if name := unix.ErrnoName(errno); name != "" {
+		return name
+	}
+
+	return strconv.Itoa(int(errno))
+}
+
+// An io.Writer that counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package prommetrics_test
+
+import (
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/prommetrics"
+)
+
+func TestCollector(t *testing.T) {
+	c := prommetrics.NewCollector("myfs")
+
+	c.OpStarted("LookUpInode")
+	c.OpFinished(fuse.OpMetrics{Op: "LookUpInode", Latency: 3 * time.Millisecond})
+	c.OpStarted("LookUpInode")
+	c.OpFinished(fuse.OpMetrics{
+		Op:      "LookUpInode",
+		Latency: 20 * time.Second,
+		Errno:   syscall.ENOENT,
+	})
+
+	c.OpStarted("ReadFile")
+	c.OpFinished(fuse.OpMetrics{Op: "ReadFile", Latency: time.Millisecond, BytesRead: 4096})
+	c.OpStarted("ReadFile")
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE myfs_fuse_ops_total counter\n",
+		`myfs_fuse_ops_total{op="LookUpInode"} 2` + "\n",
+		`myfs_fuse_ops_total{op="ReadFile"} 1` + "\n",
+		`myfs_fuse_op_errors_total{op="LookUpInode",errno="ENOENT"} 1` + "\n",
+		`myfs_fuse_ops_in_flight{op="LookUpInode"} 0` + "\n",
+		`myfs_fuse_ops_in_flight{op="ReadFile"} 1` + "\n",
+		"# TYPE myfs_fuse_op_duration_seconds histogram\n",
+		`myfs_fuse_op_duration_seconds_bucket{op="LookUpInode",le="0.001"} 0` + "\n",
+		`myfs_fuse_op_duration_seconds_bucket{op="LookUpInode",le="0.005"} 1` + "\n",
+		`myfs_fuse_op_duration_seconds_bucket{op="LookUpInode",le="10"} 1` + "\n",
+		`myfs_fuse_op_duration_seconds_bucket{op="LookUpInode",le="+Inf"} 2` + "\n",
+		`myfs_fuse_op_duration_seconds_sum{op="LookUpInode"} 20.003` + "\n",
+		`myfs_fuse_op_duration_seconds_count{op="LookUpInode"} 2` + "\n",
+		`myfs_fuse_op_duration_seconds_bucket{op="ReadFile",le="0.001"} 1` + "\n",
+		"myfs_fuse_read_bytes_total 4096\n",
+		"myfs_fuse_written_bytes_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Missing %q in:\n%s", want, got)
+		}
+	}
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Content-Type: %q", ct)
+	}
+}
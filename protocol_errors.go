@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Record a message from the kernel that we couldn't make sense of, for
+// MountConfig.TolerateProtocolErrors, or that failed
+// MountConfig.StrictProtocolValidation.
+func (c *Connection) protocolError(err error) {
+	c.protocolErrors.Add(1)
+
+	c.logError("Ignoring malformed message from the kernel", err)
+}
+
+// Fail the request in the supplied message, read from dev, which we couldn't
+// convert to an op, with EIO, unless it is one the kernel expects no reply to.
+func (c *Connection) replyMalformed(dev *os.File, inMsg *buffer.InMessage) {
+	h := inMsg.Header()
+	switch h.Opcode {
+	case fusekernel.OpForget, fusekernel.OpBatchForget, fusekernel.OpInterrupt:
+		return
+	}
+
+	out := fusekernel.OutHeader{
+		Len:    uint32(unsafe.Sizeof(fusekernel.OutHeader{})),
+		Error:  -int32(syscall.EIO),
+		Unique: h.Unique,
+	}
+
+	err := c.writeMessage(dev, unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)))
+	if err != nil && c.errorLogger != nil {
+		c.errorLogger.Printf("Replying to malformed message: %v", err)
+	}
+}
+
+// ProtocolErrors returns the number of malformed messages from the kernel
+// that have been ignored because MountConfig.TolerateProtocolErrors is set,
+// or rejected because MountConfig.StrictProtocolValidation is.
+func (mfs *MountedFileSystem) ProtocolErrors() uint64 {
+	return mfs.protocolErrors.Load()
+}
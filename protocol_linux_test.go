@@ -0,0 +1,334 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// Kernel protocol versions to simulate, chosen to cover the minimum we
+// support, the versions at which structs we care about changed size, and a
+// kernel newer than we know about.
+var protocolMatrix = []uint32{12, 17, 18, 19, 23, 28, 31, 34, 36}
+
+func TestProtocolVersionMatrix(t *testing.T) {
+	for _, minor := range protocolMatrix {
+		minor := minor
+		t.Run(fmt.Sprintf("7.%d", minor), func(t *testing.T) {
+			testProtocolVersion(t, minor)
+		})
+	}
+}
+
+func testProtocolVersion(t *testing.T, minor uint32) {
+	fs := &recordingFS{}
+	k, err := fusetesting.NewFakeKernel(
+		fuseutil.NewFileSystemServer(fs),
+		nil,
+		&fusetesting.FakeKernelConfig{Major: 7, Minor: minor})
+
+	// Kernels older than our minimum must be turned away.
+	if minor < fusekernel.ProtoVersionMinMinor {
+		if err == nil {
+			k.Close()
+			t.Fatal("NewFakeKernel succeeded for too-old kernel")
+		}
+
+		if !strings.Contains(err.Error(), "too old") {
+			t.Errorf("Unexpected error: %v", err)
+		}
+
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("NewFakeKernel: %v", err)
+	}
+
+	defer func() {
+		if err := k.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+
+	// We should have agreed on the lower of the two versions.
+	wantMinor := minor
+	if wantMinor > fusekernel.ProtoVersionMaxMinor {
+		wantMinor = fusekernel.ProtoVersionMaxMinor
+	}
+
+	if major, minor := k.Protocol(); major != 7 || minor != wantMinor {
+		t.Fatalf("Negotiated %d.%d, want 7.%d", major, minor, wantMinor)
+	}
+
+	sizes := sizesForMinor(wantMinor)
+	call := func(opcode uint32, nodeID uint64, body ...[]byte) []byte {
+		t.Helper()
+
+		r, err := k.Call(opcode, nodeID, body...)
+		if err != nil {
+			t.Fatalf("Call(%d): %v", opcode, err)
+		}
+
+		if r.Error != 0 {
+			t.Fatalf("Call(%d): %v", opcode, r.Error)
+		}
+
+		return r.Body
+	}
+
+	// Replies carrying entries and attributes must be sized for the kernel.
+	if got := len(call(fusekernel.OpLookup, 1, nameBytes("foo"))); got != sizes.entryOut {
+		t.Errorf("Lookup reply is %d bytes, want %d", got, sizes.entryOut)
+	}
+
+	getattrIn := fusekernel.GetattrIn{}
+	body := call(
+		fusekernel.OpGetattr,
+		17,
+		structBytes(unsafe.Pointer(&getattrIn), unsafe.Sizeof(getattrIn), 16))
+
+	if got := len(body); got != sizes.attrOut {
+		t.Errorf("Getattr reply is %d bytes, want %d", got, sizes.attrOut)
+	}
+
+	// Requests must be parsed using the kernel's struct sizes.
+	mkdirIn := fusekernel.MkdirIn{Mode: 0750}
+	body = call(
+		fusekernel.OpMkdir,
+		1,
+		structBytes(unsafe.Pointer(&mkdirIn), unsafe.Sizeof(mkdirIn), sizes.mkdirIn),
+		nameBytes("dir"))
+
+	if got := len(body); got != sizes.entryOut {
+		t.Errorf("Mkdir reply is %d bytes, want %d", got, sizes.entryOut)
+	}
+
+	if op, ok := fs.last().(*fuseops.MkDirOp); !ok || op.Name != "dir" || op.Mode.Perm() != 0750 {
+		t.Errorf("Unexpected mkdir op: %#v", fs.last())
+	}
+
+	mknodIn := fusekernel.MknodIn{Mode: syscall.S_IFIFO | 0640}
+	call(
+		fusekernel.OpMknod,
+		1,
+		structBytes(unsafe.Pointer(&mknodIn), unsafe.Sizeof(mknodIn), sizes.mknodIn),
+		nameBytes("fifo"))
+
+	if op, ok := fs.last().(*fuseops.MkNodeOp); !ok || op.Name != "fifo" || op.Mode.Perm() != 0640 {
+		t.Errorf("Unexpected mknod op: %#v", fs.last())
+	}
+
+	createIn := fusekernel.CreateIn{Flags: syscall.O_RDWR, Mode: syscall.S_IFREG | 0600}
+	body = call(
+		fusekernel.OpCreate,
+		1,
+		structBytes(unsafe.Pointer(&createIn), unsafe.Sizeof(createIn), sizes.createIn),
+		nameBytes("file"))
+
+	wantCreateSize := sizes.entryOut + int(unsafe.Sizeof(fusekernel.OpenOut{}))
+	if got := len(body); got != wantCreateSize {
+		t.Errorf("Create reply is %d bytes, want %d", got, wantCreateSize)
+	}
+
+	if op, ok := fs.last().(*fuseops.CreateFileOp); !ok || op.Name != "file" || op.Mode.Perm() != 0600 {
+		t.Errorf("Unexpected create op: %#v", fs.last())
+	}
+
+	readIn := fusekernel.ReadIn{Fh: 21, Offset: 11, Size: 4}
+	body = call(
+		fusekernel.OpRead,
+		20,
+		structBytes(unsafe.Pointer(&readIn), unsafe.Sizeof(readIn), sizes.readIn))
+
+	if string(body) != "taco" {
+		t.Errorf("Read returned %q", body)
+	}
+
+	if op, ok := fs.last().(*fuseops.ReadFileOp); !ok || op.Handle != 21 || op.Offset != 11 || op.Size != 4 {
+		t.Errorf("Unexpected read op: %#v", fs.last())
+	}
+
+	data := []byte("burrito")
+	writeIn := fusekernel.WriteIn{Fh: 21, Offset: 13, Size: uint32(len(data))}
+	call(
+		fusekernel.OpWrite,
+		20,
+		structBytes(unsafe.Pointer(&writeIn), unsafe.Sizeof(writeIn), sizes.writeIn),
+		data)
+
+	if op, ok := fs.last().(*fuseops.WriteFileOp); !ok || op.Offset != 13 || !bytes.Equal(op.Data, data) {
+		t.Errorf("Unexpected write op: %#v", fs.last())
+	}
+}
+
+// Make sure the fake kernel is faithful enough that a mount config reaches
+// the server.
+func TestFakeKernelPassesMountConfig(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{EnableAsyncReads: true},
+		&fusetesting.FakeKernelConfig{})
+
+	if k.InitOut().Flags&uint32(fusekernel.InitAsyncRead) == 0 {
+		t.Errorf("InitAsyncRead not set in flags %v", fusekernel.InitFlags(k.InitOut().Flags))
+	}
+}
+
+func TestTolerateProtocolErrors(t *testing.T) {
+	fs := &recordingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{TolerateProtocolErrors: true},
+		&fusetesting.FakeKernelConfig{})
+
+	// A name without its terminating NUL.
+	r, err := k.Call(fusekernel.OpLookup, 1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != syscall.EIO {
+		t.Errorf("Unexpected error: %v", r.Error)
+	}
+
+	// The server keeps going.
+	r, err = k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != 0 {
+		t.Errorf("Unexpected error: %v", r.Error)
+	}
+
+	if n := k.MountedFileSystem().ProtocolErrors(); n != 1 {
+		t.Errorf("ProtocolErrors: got %d, want 1", n)
+	}
+}
+
+func TestStrictProtocolValidation(t *testing.T) {
+	longName := strings.Repeat("x", 256)
+
+	open := fusekernel.OpenIn{Flags: syscall.O_ACCMODE}
+	write := fusekernel.WriteIn{Fh: 1, Size: 4}
+	mkdir := fusekernel.MkdirIn{Mode: 0755}
+
+	testCases := []struct {
+		name   string
+		opCode uint32
+		inode  uint64
+		body   [][]byte
+	}{
+		{"slash", fusekernel.OpLookup, 1, [][]byte{nameBytes("foo/bar")}},
+		{"trailing bytes", fusekernel.OpMkdir, 1, [][]byte{
+			structBytes(unsafe.Pointer(&mkdir), unsafe.Sizeof(mkdir), int(unsafe.Sizeof(mkdir))),
+			nameBytes("foo"),
+			[]byte("bar"),
+		}},
+		{"no inode", fusekernel.OpLookup, 0, [][]byte{nameBytes("foo")}},
+		{"long name", fusekernel.OpMkdir, 1, [][]byte{
+			structBytes(unsafe.Pointer(&mkdir), unsafe.Sizeof(mkdir), int(unsafe.Sizeof(mkdir))),
+			nameBytes(longName),
+		}},
+		{"access mode", fusekernel.OpOpen, 2, [][]byte{
+			structBytes(unsafe.Pointer(&open), unsafe.Sizeof(open), int(unsafe.Sizeof(open))),
+		}},
+		{"write size", fusekernel.OpWrite, 2, [][]byte{
+			structBytes(unsafe.Pointer(&write), unsafe.Sizeof(write), int(unsafe.Sizeof(write))),
+			[]byte("tacos"),
+		}},
+	}
+
+	for _, strict := range []bool{false, true} {
+		fs := &recordingFS{}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{StrictProtocolValidation: strict},
+			&fusetesting.FakeKernelConfig{})
+
+		// Each of these is tolerated normally, and rejected in strict mode.
+		for _, tc := range testCases {
+			r, err := k.Call(tc.opCode, tc.inode, tc.body...)
+			if err != nil {
+				t.Fatalf("%s: Call: %v", tc.name, err)
+			}
+
+			if strict != (r.Error == syscall.EIO) {
+				t.Errorf("%s, strict %v: got errno %v", tc.name, strict, r.Error)
+			}
+		}
+
+		if strict && fs.count(&fuseops.LookUpInodeOp{}) != 0 {
+			t.Errorf("File system saw rejected lookups")
+		}
+
+		// Proper requests work either way.
+		r, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+		if err != nil || r.Error != 0 {
+			t.Errorf("strict %v: Call: %v, %v", strict, err, r.Error)
+		}
+
+		want := uint64(0)
+		if strict {
+			want = uint64(len(testCases))
+		}
+
+		if n := k.MountedFileSystem().ProtocolErrors(); n != want {
+			t.Errorf("strict %v: ProtocolErrors: got %d, want %d", strict, n, want)
+		}
+
+		if err := k.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+}
+
+func TestJoinReportsProtocolErrors(t *testing.T) {
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	// A name without its terminating NUL. The server stops serving, so no
+	// reply comes.
+	if _, err := k.Start(fusekernel.OpLookup, 1, []byte("foo")); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := k.Close(); !errors.Is(err, fuse.ErrProtocol) {
+		t.Errorf("Close: got %v, want an error wrapping ErrProtocol", err)
+	}
+
+	if err := k.Notifier().InvalidateEntry(1, "foo"); err != fuse.ErrUnmounted {
+		t.Errorf("InvalidateEntry: got %v, want ErrUnmounted", err)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Limits on the lengths of names, not counting the terminating NUL, from
+// linux/limits.h.
+const (
+	nameMax      = 255  // NAME_MAX
+	xattrNameMax = 255  // XATTR_NAME_MAX
+	pathMax      = 4095 // PATH_MAX, less the NUL
+)
+
+// The kinds of NUL-terminated strings that follow the fixed-size part of some
+// requests.
+type nameKind int
+
+const (
+	// A directory entry name, which may not contain a slash.
+	entryName nameKind = iota
+
+	// An extended attribute name.
+	xattrName
+
+	// A symlink target, which is a path.
+	symlinkTarget
+)
+
+// Check the supplied message much more thoroughly than convertInMessage does,
+// for MountConfig.StrictProtocolValidation, returning an error describing the
+// first anomaly found. Requests with opcodes that convertInMessage doesn't
+// know, and init requests, whose size grows with the protocol, are accepted.
+//
+// The payload must be exactly as long as the kernel makes it, names must be
+// properly terminated and of legal length, and the flags we can check must be
+// legal.
+func validateInMessage(
+	inMsg *buffer.InMessage,
+	protocol fusekernel.Protocol) error {
+	h := inMsg.Header()
+	payload := inMsg.Remaining()
+
+	// The size of the fixed-size part of the payload, the strings after it,
+	// and the number of bytes expected after those.
+	var fixed uintptr
+	var names []nameKind
+	var trailing uint32
+
+	// Whether the request must name an inode.
+	needInode := true
+
+	switch h.Opcode {
+	case fusekernel.OpLookup, fusekernel.OpUnlink, fusekernel.OpRmdir:
+		names = []nameKind{entryName}
+
+	case fusekernel.OpGetattr:
+		if protocol.HasGetattrFlags() {
+			fixed = unsafe.Sizeof(fusekernel.GetattrIn{})
+			if uintptr(len(payload)) >= fixed {
+				in := (*fusekernel.GetattrIn)(unsafe.Pointer(&payload[0]))
+				if fusekernel.GetattrFlags(in.GetattrFlags)&^fusekernel.GetattrFh != 0 {
+					return fmt.Errorf("Unknown getattr flags: %#x", in.GetattrFlags)
+				}
+			}
+		}
+
+	case fusekernel.OpSetattr:
+		fixed = unsafe.Sizeof(fusekernel.SetattrIn{})
+
+	case fusekernel.OpForget:
+		fixed = unsafe.Sizeof(fusekernel.ForgetIn{})
+
+	case fusekernel.OpBatchForget:
+		needInode = false
+		fixed = unsafe.Sizeof(fusekernel.BatchForgetCountIn{})
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.BatchForgetCountIn)(unsafe.Pointer(&payload[0]))
+			fixed += uintptr(in.Count) * unsafe.Sizeof(fusekernel.BatchForgetEntryIn{})
+		}
+
+	case fusekernel.OpMkdir:
+		fixed = fusekernel.MkdirInSize(protocol)
+		names = []nameKind{entryName}
+
+	case fusekernel.OpMknod:
+		fixed = fusekernel.MknodInSize(protocol)
+		names = []nameKind{entryName}
+
+	case fusekernel.OpCreate:
+		fixed = fusekernel.CreateInSize(protocol)
+		names = []nameKind{entryName}
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.CreateIn)(unsafe.Pointer(&payload[0]))
+			if err := validateOpenFlags(in.Flags); err != nil {
+				return err
+			}
+		}
+
+	case fusekernel.OpSymlink:
+		names = []nameKind{entryName, symlinkTarget}
+
+	case fusekernel.OpRename:
+		fixed = unsafe.Sizeof(fusekernel.RenameIn{})
+		names = []nameKind{entryName, entryName}
+
+		// Allow for the extra flags that macFUSE sends; see convertInMessage.
+		// They can't be mistaken for a name, since names aren't empty.
+		if uintptr(len(payload)) >= fixed+8 &&
+			bytes.Equal(payload[fixed:fixed+8], make([]byte, 8)) {
+			fixed += 8
+		}
+
+	case fusekernel.OpLink:
+		fixed = unsafe.Sizeof(fusekernel.LinkIn{})
+		names = []nameKind{entryName}
+
+	case fusekernel.OpOpen:
+		fixed = unsafe.Sizeof(fusekernel.OpenIn{})
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.OpenIn)(unsafe.Pointer(&payload[0]))
+			if err := validateOpenFlags(in.Flags); err != nil {
+				return err
+			}
+		}
+
+	case fusekernel.OpOpendir:
+		fixed = unsafe.Sizeof(fusekernel.OpenIn{})
+
+	case fusekernel.OpRead, fusekernel.OpReaddir, fusekernel.OpReaddirplus:
+		fixed = fusekernel.ReadInSize(protocol)
+
+	case fusekernel.OpRelease, fusekernel.OpReleasedir:
+		fixed = unsafe.Sizeof(fusekernel.ReleaseIn{})
+
+	case fusekernel.OpWrite:
+		fixed = fusekernel.WriteInSize(protocol)
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.WriteIn)(unsafe.Pointer(&payload[0]))
+			trailing = in.Size
+		}
+
+	case fusekernel.OpFsync, fusekernel.OpFsyncdir:
+		fixed = unsafe.Sizeof(fusekernel.FsyncIn{})
+
+	case fusekernel.OpSyncFS:
+		fixed = unsafe.Sizeof(fusekernel.SyncFSIn{})
+
+	case fusekernel.OpFlush:
+		fixed = unsafe.Sizeof(fusekernel.FlushIn{})
+
+	case fusekernel.OpReadlink, fusekernel.OpStatfs:
+
+	case fusekernel.OpInterrupt:
+		needInode = false
+		fixed = unsafe.Sizeof(fusekernel.InterruptIn{})
+
+	case fusekernel.OpRemovexattr:
+		names = []nameKind{xattrName}
+
+	case fusekernel.OpGetxattr:
+		fixed = unsafe.Sizeof(fusekernel.GetxattrIn{})
+		names = []nameKind{xattrName}
+
+	case fusekernel.OpListxattr:
+		fixed = unsafe.Sizeof(fusekernel.ListxattrIn{})
+
+	case fusekernel.OpSetxattr:
+		fixed = unsafe.Sizeof(fusekernel.SetxattrIn{})
+		names = []nameKind{xattrName}
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.SetxattrIn)(unsafe.Pointer(&payload[0]))
+			trailing = in.Size
+		}
+
+	case fusekernel.OpFallocate:
+		fixed = unsafe.Sizeof(fusekernel.FallocateIn{})
+
+	case fusekernel.OpLseek:
+		fixed = unsafe.Sizeof(fusekernel.LseekIn{})
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.LseekIn)(unsafe.Pointer(&payload[0]))
+			if in.Whence != unix.SEEK_DATA && in.Whence != unix.SEEK_HOLE {
+				return fmt.Errorf("Unexpected lseek whence: %d", in.Whence)
+			}
+		}
+
+	case fusekernel.OpCopyFileRange:
+		fixed = unsafe.Sizeof(fusekernel.CopyFileRangeIn{})
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.CopyFileRangeIn)(unsafe.Pointer(&payload[0]))
+			if in.NodeidOut == 0 {
+				return fmt.Errorf("Opcode %d with no destination inode", h.Opcode)
+			}
+		}
+
+	case fusekernel.OpIoctl:
+		fixed = unsafe.Sizeof(fusekernel.IoctlIn{})
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.IoctlIn)(unsafe.Pointer(&payload[0]))
+			trailing = in.InSize
+		}
+
+	case fusekernel.OpPoll:
+		fixed = unsafe.Sizeof(fusekernel.PollIn{})
+
+	case fusekernel.OpGetlk, fusekernel.OpSetlk, fusekernel.OpSetlkw:
+		fixed = fusekernel.LkInSize(protocol)
+		if uintptr(len(payload)) >= fixed {
+			in := (*fusekernel.LkIn)(unsafe.Pointer(&payload[0]))
+			if err := validateLock(fuseops.FileLock(in.Lk)); err != nil {
+				return fmt.Errorf("Opcode %d: %v", h.Opcode, err)
+			}
+		}
+
+	default:
+		return nil
+	}
+
+	if needInode && h.Nodeid == 0 {
+		return fmt.Errorf("Opcode %d with no inode", h.Opcode)
+	}
+
+	if uintptr(len(payload)) < fixed {
+		return fmt.Errorf(
+			"Opcode %d: payload of %d bytes is too short for %d",
+			h.Opcode,
+			len(payload),
+			fixed)
+	}
+
+	rest := payload[fixed:]
+	for _, kind := range names {
+		i := bytes.IndexByte(rest, '\x00')
+		if i < 0 {
+			return fmt.Errorf("Opcode %d: unterminated string", h.Opcode)
+		}
+
+		if err := validateName(rest[:i], kind); err != nil {
+			return fmt.Errorf("Opcode %d: %v", h.Opcode, err)
+		}
+
+		rest = rest[i+1:]
+	}
+
+	// Count the data of writes left in a pipe by InMessage.InitSplice.
+	n := uint64(len(rest)) + uint64(inMsg.PayloadLen())
+	if n != uint64(trailing) {
+		return fmt.Errorf(
+			"Opcode %d: %d bytes after the expected contents, want %d",
+			h.Opcode,
+			n,
+			trailing)
+	}
+
+	return nil
+}
+
+func validateName(name []byte, kind nameKind) error {
+	if len(name) == 0 {
+		return fmt.Errorf("Empty name")
+	}
+
+	switch kind {
+	case entryName:
+		if len(name) > nameMax {
+			return fmt.Errorf("Name of %d bytes is too long", len(name))
+		}
+
+		if bytes.IndexByte(name, '/') >= 0 {
+			return fmt.Errorf("Name %q contains a slash", name)
+		}
+
+	case xattrName:
+		if len(name) > xattrNameMax {
+			return fmt.Errorf("Xattr name of %d bytes is too long", len(name))
+		}
+
+	case symlinkTarget:
+		if len(name) > pathMax {
+			return fmt.Errorf("Symlink target of %d bytes is too long", len(name))
+		}
+	}
+
+	return nil
+}
+
+func validateOpenFlags(flags uint32) error {
+	if flags&syscall.O_ACCMODE == syscall.O_ACCMODE {
+		return fmt.Errorf("Invalid access mode in open flags %#x", flags)
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// RawOpHeader holds the fields of the header of a request from the kernel,
+// for a RawOpHandler. Opcodes are listed in package fuseprotocol.
+type RawOpHeader struct {
+	OpCode uint32
+	Unique uint64
+	Inode  fuseops.InodeID
+	Uid    uint32
+	Gid    uint32
+	Pid    uint32
+}
+
+// RawOpHandler handles requests from the kernel with a particular opcode in
+// the kernel's wire format, bypassing this package's conversion to ops. See
+// Connection.SetRawOpHandler.
+//
+// The payload is everything after the request header and is valid only until
+// the handler returns. To succeed, the handler writes the body of the reply
+// (everything after the reply header) to reply and returns nil. If it returns
+// an error, whatever it wrote is discarded and the op fails as it would for
+// any other op.
+type RawOpHandler func(
+	ctx context.Context,
+	header RawOpHeader,
+	payload []byte,
+	reply io.Writer) error
+
+// SetRawOpHandler arranges for requests from the kernel with the given opcode
+// to be handed to h rather than converted to ops and returned by ReadOp,
+// replacing any handler previously set for the opcode. A nil handler restores
+// normal dispatch. This is intended for experimenting with kernel features
+// that this package doesn't yet support, including new variants of ops that
+// it does; handlers must know the wire format for the protocol version in
+// use.
+//
+// Handlers are called on their own goroutines, concurrently with other ops,
+// and their contexts are cancelled when the kernel interrupts the request.
+// Requests that are already in flight aren't affected by changes.
+//
+// Init, forget, and interrupt requests can't be handled this way, since the
+// connection depends on handling them itself.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) SetRawOpHandler(opCode uint32, h RawOpHandler) error {
+	switch opCode {
+	case fusekernel.OpInit,
+		fusekernel.OpForget,
+		fusekernel.OpBatchForget,
+		fusekernel.OpInterrupt:
+		return fmt.Errorf("Opcode %d can't have a raw handler", opCode)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if h == nil {
+		delete(c.rawOpHandlers, opCode)
+		return nil
+	}
+
+	if c.rawOpHandlers == nil {
+		c.rawOpHandlers = make(map[uint32]RawOpHandler)
+	}
+
+	c.rawOpHandlers[opCode] = h
+	return nil
+}
+
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) rawOpHandler(opCode uint32) RawOpHandler {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rawOpHandlers[opCode]
+}
+
+// Start the supplied handler for a request on its own goroutine, taking
+// ownership of inMsg.
+func (c *Connection) serveRawOp(
+	h RawOpHandler,
+	dev *os.File,
+	inMsg *buffer.InMessage,
+	readTime time.Time,
+	clockTime time.Time) {
+	hdr := inMsg.Header()
+	op := &unknownOp{
+		OpCode:  hdr.Opcode,
+		Inode:   fuseops.InodeID(hdr.Nodeid),
+		Payload: inMsg.ConsumeBytes(inMsg.Len()),
+	}
+
+	if c.debugLogger != nil {
+		c.debugLog(hdr.Unique, 1, "<- raw %s", describeRequest(op))
+	}
+
+	outMsg := c.getOutMessage()
+	ctx := c.beginOp(
+		hdr.Opcode,
+		hdr.Unique,
+		opState{
+			inMsg:     inMsg,
+			outMsg:    outMsg,
+			op:        op,
+			readTime:  readTime,
+			clockTime: clockTime,
+			inodeData: c.inodeData,
+			dev:       dev,
+		})
+
+	header := RawOpHeader{
+		OpCode: hdr.Opcode,
+		Unique: hdr.Unique,
+		Inode:  op.Inode,
+		Uid:    hdr.Uid,
+		Gid:    hdr.Gid,
+		Pid:    hdr.Pid,
+	}
+
+	c.rawOpsInFlight.Add(1)
+	go c.handleRawOp(ctx, h, header, op.Payload, outMsg)
+}
+
+// Run a handler for an op, replying with its result.
+func (c *Connection) handleRawOp(
+	ctx context.Context,
+	h RawOpHandler,
+	header RawOpHeader,
+	payload []byte,
+	outMsg *buffer.OutMessage) {
+	defer c.rawOpsInFlight.Done()
+
+	err := h(ctx, header, payload, replyWriter{outMsg})
+	c.Reply(ctx, err)
+}
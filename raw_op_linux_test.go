@@ -0,0 +1,171 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestUnknownOpHandler(t *testing.T) {
+	const opCode = 9999
+
+	cfg := &fuse.MountConfig{
+		UnknownOpHandler: func(
+			ctx context.Context,
+			code uint32,
+			inode fuseops.InodeID,
+			payload []byte,
+			reply io.Writer) error {
+			if code != opCode || inode != 17 {
+				return syscall.EINVAL
+			}
+
+			fmt.Fprintf(reply, "%s, ", payload)
+			reply.Write(payload)
+			return nil
+		},
+	}
+
+	// The op should fail without the handler, and be answered by it otherwise.
+	for _, c := range []*fuse.MountConfig{{}, cfg} {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			c,
+			&fusetesting.FakeKernelConfig{})
+
+		reply, err := k.Call(opCode, 17, []byte("taco"))
+		if err != nil {
+			t.Errorf("Call: %v", err)
+		} else if c.UnknownOpHandler == nil && reply.Error != syscall.ENOSYS {
+			t.Errorf("Unexpected errno without handler: %v", reply.Error)
+		} else if c.UnknownOpHandler != nil && (reply.Error != 0 || string(reply.Body) != "taco, taco") {
+			t.Errorf("Unexpected reply with handler: %v %q", reply.Error, reply.Body)
+		}
+
+		if err := k.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}
+}
+
+// A server that registers raw op handlers before serving ops with a wrapped
+// server.
+type rawOpServer struct {
+	wrapped  fuse.Server
+	handlers map[uint32]fuse.RawOpHandler
+	errs     map[uint32]error
+}
+
+func (s *rawOpServer) ServeOps(c *fuse.Connection) {
+	s.errs = make(map[uint32]error)
+	for opCode, h := range s.handlers {
+		s.errs[opCode] = c.SetRawOpHandler(opCode, h)
+	}
+
+	s.wrapped.ServeOps(c)
+}
+
+func TestRawOpHandler(t *testing.T) {
+	echo := func(
+		ctx context.Context,
+		header fuse.RawOpHeader,
+		payload []byte,
+		reply io.Writer) error {
+		if header.Inode != 17 || header.Uid != 123 {
+			return syscall.EINVAL
+		}
+
+		fmt.Fprintf(reply, "%d: %s", header.OpCode, payload)
+		return nil
+	}
+
+	fs := &recordingFS{}
+	server := &rawOpServer{
+		wrapped: fuseutil.NewFileSystemServer(fs),
+		handlers: map[uint32]fuse.RawOpHandler{
+			fusekernel.OpLookup: echo,
+			9999:                echo,
+			fusekernel.OpInit:   echo,
+		},
+	}
+
+	k := newFakeKernel(
+		t,
+		server,
+		nil,
+		&fusetesting.FakeKernelConfig{Uid: 123})
+
+	// Both known and unknown opcodes go to the handler, bypassing the file
+	// system.
+	for _, opCode := range []uint32{fusekernel.OpLookup, 9999} {
+		reply, err := k.Call(opCode, 17, []byte("taco"))
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		want := fmt.Sprintf("%d: taco", opCode)
+		if reply.Error != 0 || string(reply.Body) != want {
+			t.Errorf("Unexpected reply for %d: %v %q", opCode, reply.Error, reply.Body)
+		}
+	}
+
+	if n := fs.count(&fuseops.LookUpInodeOp{}); n != 0 {
+		t.Errorf("File system saw %d lookups", n)
+	}
+
+	// Errors returned by the handler fail the op.
+	reply, err := k.Call(9999, 18, nil)
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if reply.Error != syscall.EINVAL {
+		t.Errorf("Unexpected errno: %v", reply.Error)
+	}
+
+	// Other opcodes are dispatched normally.
+	reply, err = k.Call(fusekernel.OpUnlink, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if reply.Error != 0 || fs.count(&fuseops.UnlinkOp{}) != 1 {
+		t.Errorf("File system didn't see the unlink: %v", reply.Error)
+	}
+
+	if err := k.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+
+	// The connection handles init itself.
+	if server.errs[fusekernel.OpInit] == nil {
+		t.Errorf("Expected an error registering a handler for init")
+	}
+
+	if server.errs[fusekernel.OpLookup] != nil || server.errs[9999] != nil {
+		t.Errorf("Unexpected errors: %v", server.errs)
+	}
+}
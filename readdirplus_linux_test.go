@@ -0,0 +1,365 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+func TestReadDirPlusInit(t *testing.T) {
+	const plus = fusekernel.InitDoReaddirplus
+	const auto = fusekernel.InitReaddirplusAuto
+
+	testCases := []struct {
+		enable  bool
+		offered fusekernel.InitFlags
+		want    fusekernel.InitFlags
+	}{
+		{false, plus | auto, 0},
+		{true, 0, 0},
+		{true, plus, plus},
+		{true, plus | auto, plus | auto},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&fuse.MountConfig{EnableReadDirPlus: tc.enable},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(tc.offered)})
+
+		flags := fusekernel.InitFlags(k.InitOut().Flags)
+		if got := flags & (plus | auto); got != tc.want {
+			t.Errorf("%+v: unexpected flags %v", tc, flags)
+		}
+
+		k.Close()
+	}
+}
+
+func TestReadDirAdaptive(t *testing.T) {
+	const plus = fusekernel.InitDoReaddirplus
+	const auto = fusekernel.InitReaddirplusAuto
+
+	for _, offered := range []fusekernel.InitFlags{plus, plus | auto} {
+		fs := &recordingFS{}
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(fs),
+			&fuse.MountConfig{EnableReadDirPlus: true},
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(offered)})
+
+		in := fusekernel.ReadIn{Size: 4096}
+		r, err := k.Call(
+			fusekernel.OpReaddir,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		op, ok := fs.last().(*fuseops.ReadDirOp)
+		if !ok {
+			t.Fatalf("Got op %#v", fs.last())
+		}
+
+		if want := offered&auto != 0; op.Adaptive != want {
+			t.Errorf("Offered %v: got Adaptive %v", offered, op.Adaptive)
+		}
+
+		k.Close()
+	}
+}
+
+// An inodeDataFS whose root directory lists "." and inode 5, named "foo",
+// with its attributes.
+type readDirPlusFS struct {
+	inodeDataFS
+	handleData interface{}
+}
+
+func (fs *readDirPlusFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	op.Handle = 7
+	op.HandleData = "dir state"
+	return nil
+}
+
+func (fs *readDirPlusFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	fs.mu.Lock()
+	fs.handleData = op.HandleData
+	fs.mu.Unlock()
+
+	entries := []fuseutil.DirentPlus{
+		{
+			Dirent: fuseutil.Dirent{Offset: 1, Inode: 1, Name: ".", Type: fuseutil.DT_Directory},
+			Entry:  fuseops.ChildInodeEntry{Child: 1},
+		},
+		{
+			Dirent: fuseutil.Dirent{Offset: 2, Inode: 5, Name: "foo", Type: fuseutil.DT_File},
+			Entry: fuseops.ChildInodeEntry{
+				Child:      5,
+				Generation: 17,
+				Attributes: fuseops.InodeAttributes{Size: 3, Nlink: 1, Mode: 0644},
+			},
+		},
+	}
+
+	for _, e := range entries[op.Offset:] {
+		n := fuseutil.WriteDirentPlus(op.Dst[op.BytesRead:], e)
+		if n == 0 {
+			break
+		}
+
+		op.BytesRead += n
+	}
+
+	return nil
+}
+
+func TestReadDirPlus(t *testing.T) {
+	fs := &readDirPlusFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			EnableReadDirPlus: true,
+			TrackInodeData:    true,
+			ValidateResponses: true,
+		},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitDoReaddirplus)})
+
+	call := func(opcode uint32, inode uint64, body []byte) []byte {
+		t.Helper()
+		r, err := k.Call(opcode, inode, body)
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != 0 {
+			t.Fatalf("Opcode %d: %v", opcode, r.Error)
+		}
+
+		return r.Body
+	}
+
+	openIn := fusekernel.OpenIn{Flags: syscall.O_RDONLY}
+	call(
+		fusekernel.OpOpendir,
+		1,
+		structBytes(unsafe.Pointer(&openIn), unsafe.Sizeof(openIn), int(unsafe.Sizeof(openIn))))
+
+	// Read both entries, then just the second.
+	readDirPlus := func(offset uint64, size uint32) []byte {
+		in := fusekernel.ReadIn{Fh: 7, Offset: offset, Size: size}
+		return call(
+			fusekernel.OpReaddirplus,
+			1,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+	}
+
+	b := readDirPlus(0, 4096)
+
+	var names []string
+	var foo fusekernel.DirentPlus
+	for len(b) >= fusekernel.DirentPlusSize {
+		var d fusekernel.DirentPlus
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&d)), fusekernel.DirentPlusSize), b)
+
+		end := fusekernel.DirentPlusSize + int(d.Dirent.Namelen)
+		name := string(b[fusekernel.DirentPlusSize:end])
+		names = append(names, name)
+		if name == "foo" {
+			foo = d
+		}
+
+		b = b[(end+7)&^7:]
+	}
+
+	if !reflect.DeepEqual(names, []string{".", "foo"}) || len(b) != 0 {
+		t.Fatalf("Got names %q, trailing %q", names, b)
+	}
+
+	if foo.Dirent.Ino != 5 || foo.Dirent.Off != 2 || foo.Dirent.Type != syscall.DT_REG {
+		t.Errorf("Unexpected dirent: %+v", foo.Dirent)
+	}
+
+	e := foo.Entry
+	if e.Nodeid != 5 || e.Generation != 17 || e.Attr.Ino != 5 || e.Attr.Size != 3 {
+		t.Errorf("Unexpected entry: %+v", e)
+	}
+
+	if e.Attr.Mode != syscall.S_IFREG|0644 {
+		t.Errorf("Got mode %#o", e.Attr.Mode)
+	}
+
+	// An entry that doesn't fit is left for the next read.
+	if b := readDirPlus(1, uint32(fusekernel.DirentPlusSize)); len(b) != 0 {
+		t.Errorf("Got %d bytes for too small a read", len(b))
+	}
+
+	fs.mu.Lock()
+	if fs.handleData != "dir state" {
+		t.Errorf("Got handle data %v", fs.handleData)
+	}
+	fs.mu.Unlock()
+
+	// Listing foo counted as a lookup of it, so the value attached by a later
+	// lookup survives forgetting one of the two.
+	getattr := func() {
+		var in fusekernel.GetattrIn
+		call(
+			fusekernel.OpGetattr,
+			5,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+	}
+
+	forget := func() {
+		in := fusekernel.ForgetIn{Nlookup: 1}
+		_, err := k.Start(
+			fusekernel.OpForget,
+			5,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+	}
+
+	call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	forget()
+	getattr()
+	forget()
+	getattr()
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	want := []interface{}{"data for 5", nil}
+	if !reflect.DeepEqual(fs.seen, want) {
+		t.Errorf("Got %v, want %v", fs.seen, want)
+	}
+}
+
+// A file system that lists one child, with expirations set in terms of a
+// simulated clock.
+type clockDirFS struct {
+	fuseutil.NotImplementedFileSystem
+	clock timeutil.Clock
+}
+
+func (fs *clockDirFS) ReadDirPlus(
+	ctx context.Context,
+	op *fuseops.ReadDirPlusOp) error {
+	if op.Offset != 0 {
+		return nil
+	}
+
+	op.BytesRead = fuseutil.WriteDirentPlus(op.Dst, fuseutil.DirentPlus{
+		Dirent: fuseutil.Dirent{Offset: 1, Inode: 5, Name: "foo", Type: fuseutil.DT_File},
+		Entry: fuseops.ChildInodeEntry{
+			Child:                5,
+			Attributes:           fuseops.InodeAttributes{Size: 3, Nlink: 1, Mode: 0644},
+			EntryExpiration:      fs.clock.Now().Add(time.Minute),
+			AttributesExpiration: fs.clock.Now().Add(2 * time.Minute),
+		},
+	})
+
+	return nil
+}
+
+func TestReadDirPlusWithClock(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&clockDirFS{clock: clock}),
+		&fuse.MountConfig{
+			Clock:             clock,
+			EnableReadDirPlus: true,
+			ValidateResponses: true,
+		},
+		&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitDoReaddirplus)})
+
+	in := fusekernel.ReadIn{Size: 4096}
+	r, err := k.Call(
+		fusekernel.OpReaddirplus,
+		1,
+		structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))))
+
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != 0 {
+		t.Fatalf("Unexpected error: %v", r.Error)
+	}
+
+	if len(r.Body) < fusekernel.DirentPlusSize {
+		t.Fatalf("Got %d bytes", len(r.Body))
+	}
+
+	// The expirations are measured against the simulated clock.
+	var d fusekernel.DirentPlus
+	copy(unsafe.Slice((*byte)(unsafe.Pointer(&d)), fusekernel.DirentPlusSize), r.Body)
+	if d.Entry.EntryValid != 60 || d.Entry.AttrValid != 120 {
+		t.Errorf("Got validities %d and %d", d.Entry.EntryValid, d.Entry.AttrValid)
+	}
+
+	if d.Entry.Nodeid != 5 || d.Entry.Attr.Size != 3 || d.Entry.Attr.Mode != syscall.S_IFREG|0644 {
+		t.Errorf("Unexpected entry: %+v", d.Entry)
+	}
+
+	// Once they have passed, ExpireCaches invalidates the listed entry and
+	// the child's attributes.
+	clock.AdvanceTime(3 * time.Minute)
+	if err := k.MountedFileSystem().ExpireCaches(); err != nil {
+		t.Fatalf("ExpireCaches: %v", err)
+	}
+
+	want := []int32{fusekernel.NotifyCodeInvalEntry, fusekernel.NotifyCodeInvalInode}
+
+	// The notifications may not have been read yet.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(k.Notifications()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	var codes []int32
+	for _, n := range k.Notifications() {
+		codes = append(codes, n.Code)
+	}
+
+	if !reflect.DeepEqual(codes, want) {
+		t.Errorf("Got notification codes %v, want %v", codes, want)
+	}
+}
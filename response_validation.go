@@ -0,0 +1,253 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+// Check the response that the file system filled in for an op it handled
+// successfully, for MountConfig.ValidateResponses, returning an error
+// describing the first problem found. readTime is when the request was
+// received.
+func validateResponse(op interface{}, readTime time.Time) error {
+	switch o := op.(type) {
+	case *fuseops.LookUpInodeOp:
+		return validateEntry(&o.Entry, readTime, false, nil)
+
+	case *fuseops.MkDirOp:
+		return validateEntry(&o.Entry, readTime, true, &o.Mode)
+
+	case *fuseops.MkNodeOp:
+		return validateEntry(&o.Entry, readTime, true, &o.Mode)
+
+	case *fuseops.CreateFileOp:
+		if err := validateEntry(&o.Entry, readTime, true, &o.Mode); err != nil {
+			return err
+		}
+
+		return validateHandle(o.Handle, o.HandleData)
+
+	case *fuseops.CreateSymlinkOp:
+		mode := os.ModeSymlink
+		return validateEntry(&o.Entry, readTime, true, &mode)
+
+	case *fuseops.CreateLinkOp:
+		return validateEntry(&o.Entry, readTime, true, nil)
+
+	case *fuseops.GetInodeAttributesOp:
+		return validateAttributes(&o.Attributes, o.AttributesExpiration, readTime)
+
+	case *fuseops.SetInodeAttributesOp:
+		return validateAttributes(&o.Attributes, o.AttributesExpiration, readTime)
+
+	case *fuseops.OpenFileOp:
+		return validateHandle(o.Handle, o.HandleData)
+
+	case *fuseops.OpenDirOp:
+		return validateHandle(o.Handle, o.HandleData)
+
+	case *fuseops.ReadFileOp:
+		if o.BytesRead < 0 || int64(o.BytesRead) > o.Size {
+			return fmt.Errorf("BytesRead %d outside of [0, %d]", o.BytesRead, o.Size)
+		}
+
+		available := len(o.Dst)
+		if o.Data != nil {
+			available = 0
+			for _, b := range o.Data {
+				available += len(b)
+			}
+		}
+
+		if o.BytesRead > available {
+			return fmt.Errorf(
+				"BytesRead %d exceeds the %d bytes supplied",
+				o.BytesRead,
+				available)
+		}
+
+	case *fuseops.ReadDirOp:
+		if o.BytesRead < 0 || o.BytesRead > len(o.Dst) {
+			return fmt.Errorf("BytesRead %d outside of [0, %d]", o.BytesRead, len(o.Dst))
+		}
+
+	case *fuseops.ReadDirPlusOp:
+		if o.BytesRead < 0 || o.BytesRead > len(o.Dst) {
+			return fmt.Errorf("BytesRead %d outside of [0, %d]", o.BytesRead, len(o.Dst))
+		}
+
+	case *fuseops.WriteFileOp:
+		if o.BytesWritten < 0 {
+			return fmt.Errorf("Negative BytesWritten: %d", o.BytesWritten)
+		}
+
+	case *fuseops.ReadSymlinkOp:
+		if o.Target == "" {
+			return fmt.Errorf("Empty symlink target")
+		}
+
+		if strings.IndexByte(o.Target, 0) >= 0 {
+			return fmt.Errorf("Symlink target contains NUL: %q", o.Target)
+		}
+
+	case *fuseops.GetXattrOp:
+		return validateXattrSize(o.BytesRead, len(o.Dst))
+
+	case *fuseops.ListXattrOp:
+		if err := validateXattrSize(o.BytesRead, len(o.Dst)); err != nil {
+			return err
+		}
+
+		// Each name in the list must be terminated.
+		if len(o.Dst) != 0 && o.BytesRead != 0 && o.Dst[o.BytesRead-1] != 0 {
+			return fmt.Errorf("Xattr list isn't NUL-terminated")
+		}
+
+	case *fuseops.IoctlOp:
+		if o.Retry {
+			if !o.Unrestricted {
+				return fmt.Errorf("Retry of a restricted ioctl")
+			}
+
+			if n := len(o.RetryInput) + len(o.RetryOutput); n > fusekernel.IoctlMaxIov {
+				return fmt.Errorf("Retry with %d regions", n)
+			}
+
+			break
+		}
+
+		if o.Result < 0 {
+			return fmt.Errorf("Negative ioctl result: %d", o.Result)
+		}
+
+	case *fuseops.GetLockOp:
+		if err := validateLock(o.Conflict); err != nil {
+			return fmt.Errorf("Conflict: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Check an entry returned for a looked-up child, or one that was created if
+// created is set. The kernel rejects created children with the root's ID,
+// and if mode is non-nil, the child was created with that mode and the kernel
+// also rejects it unless its type matches.
+//
+// A zero child ID from a lookup tells the kernel to cache the name's absence,
+// but it is far more often a sign of an entry that was never filled in, so it
+// is rejected too; file systems should fail such lookups with ENOENT.
+func validateEntry(
+	e *fuseops.ChildInodeEntry,
+	readTime time.Time,
+	created bool,
+	mode *os.FileMode) error {
+	if e.Child == 0 {
+		return fmt.Errorf("Zero child inode ID")
+	}
+
+	if created && e.Child == fuseops.RootInodeID {
+		return fmt.Errorf("New child has the root's inode ID")
+	}
+
+	if mode != nil && (e.Attributes.Mode^*mode)&os.ModeType != 0 {
+		return fmt.Errorf(
+			"Child has mode %v, but was created with mode %v",
+			e.Attributes.Mode,
+			*mode)
+	}
+
+	err := validateAttributes(&e.Attributes, e.AttributesExpiration, readTime)
+	if err != nil {
+		return err
+	}
+
+	return validateExpiration("EntryExpiration", e.EntryExpiration, readTime)
+}
+
+// Check attributes and their expiration time. The kernel rejects sizes that
+// don't fit in a signed 64-bit offset.
+func validateAttributes(
+	attrs *fuseops.InodeAttributes,
+	expiration time.Time,
+	readTime time.Time) error {
+	if attrs.Size > math.MaxInt64 {
+		return fmt.Errorf("Size %d out of range", attrs.Size)
+	}
+
+	return validateExpiration("AttributesExpiration", expiration, readTime)
+}
+
+// Check that an expiration time is either zero, meaning no caching, or after
+// the request was received. An earlier time also means no caching, but
+// usually that the time was computed wrongly, for example from a duration
+// that was never added to the current time.
+func validateExpiration(name string, t time.Time, readTime time.Time) error {
+	if t.IsZero() || !t.Before(readTime) {
+		return nil
+	}
+
+	return fmt.Errorf("%s %v is before the request was received at %v", name, t, readTime)
+}
+
+// Check that a handle to which the file system attached a value was minted,
+// since values are looked up by handle and concurrent opens that all return
+// the zero handle would overwrite each other's.
+func validateHandle(h fuseops.HandleID, data interface{}) error {
+	if data != nil && h == 0 {
+		return fmt.Errorf("HandleData attached to the zero handle")
+	}
+
+	return nil
+}
+
+// Check the size reported for an extended attribute or list of them, which
+// may be anything when the kernel only asked for the size.
+func validateXattrSize(bytesRead int, dstLen int) error {
+	if bytesRead < 0 || (dstLen != 0 && bytesRead > dstLen) {
+		return fmt.Errorf("BytesRead %d outside of [0, %d]", bytesRead, dstLen)
+	}
+
+	return nil
+}
+
+// Check a lock's type, and the range of a lock that isn't F_UNLCK, which the
+// kernel rejects unless it is in order and within a signed 64-bit offset.
+func validateLock(lk fuseops.FileLock) error {
+	switch lk.Type {
+	case unix.F_UNLCK:
+		return nil
+
+	case unix.F_RDLCK, unix.F_WRLCK:
+
+	default:
+		return fmt.Errorf("Unexpected lock type: %d", lk.Type)
+	}
+
+	if lk.End > math.MaxInt64 || lk.Start > lk.End {
+		return fmt.Errorf("Lock range [%d, %d] out of order or range", lk.Start, lk.End)
+	}
+
+	return nil
+}
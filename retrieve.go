@@ -0,0 +1,116 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"unsafe"
+
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+// A call to Notifier.Retrieve waiting for the kernel to send the data.
+type retrieval struct {
+	// The buffer supplied by the caller.
+	dst []byte
+
+	// Filled in before done is closed: the number of bytes copied into dst,
+	// or ErrUnmounted if the kernel never replied.
+	n   int
+	err error
+
+	done chan struct{}
+}
+
+// Register a retrieval into dst, returning the ID to send to the kernel in
+// the notification and the retrieval to wait on.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) beginRetrieve(dst []byte) (uint64, *retrieval) {
+	r := &retrieval{
+		dst:  dst,
+		done: make(chan struct{}),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The kernel has hung up, so will never reply.
+	if c.readErr != nil {
+		r.err = ErrUnmounted
+		close(r.done)
+		return 0, r
+	}
+
+	if c.retrievals == nil {
+		c.retrievals = make(map[uint64]*retrieval)
+	}
+
+	c.lastRetrieval++
+	c.retrievals[c.lastRetrieval] = r
+
+	return c.lastRetrieval, r
+}
+
+// Forget about a retrieval that is no longer being waited on.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) endRetrieve(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.retrievals, id)
+}
+
+// Hand the data in a reply to a retrieve notification to the waiting caller.
+// Replies to retrievals that nobody is waiting on any more are dropped. The
+// kernel expects no reply in turn.
+//
+// LOCKS_EXCLUDED(c.mu)
+func (c *Connection) finishRetrieve(inMsg *buffer.InMessage) {
+	defer c.putInMessage(inMsg)
+
+	c.mu.Lock()
+	r, ok := c.retrievals[inMsg.Header().Unique]
+	delete(c.retrievals, inMsg.Header().Unique)
+	c.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	var data []byte
+	in := (*fusekernel.NotifyRetrieveIn)(inMsg.Consume(unsafe.Sizeof(fusekernel.NotifyRetrieveIn{})))
+	if in != nil {
+		data = inMsg.ConsumeBytes(inMsg.Len())
+		if len(data) > int(in.Size) {
+			data = data[:in.Size]
+		}
+	}
+
+	r.n = copy(r.dst, data)
+	close(r.done)
+}
+
+// Fail the retrievals still waiting for a reply, once the kernel has hung up.
+//
+// EXCLUSIVE_LOCKS_REQUIRED(c.mu)
+func (c *Connection) failRetrievals() {
+	for id, r := range c.retrievals {
+		r.err = ErrUnmounted
+		close(r.done)
+		delete(c.retrievals, id)
+	}
+}
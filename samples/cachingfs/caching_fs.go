@@ -26,6 +26,7 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
+	"github.com/jacobsa/timeutil"
 )
 
 const (
@@ -92,9 +93,12 @@ type CachingFS interface {
 //
 //   - Nothing else is marked cacheable. (In particular, the attributes
 //     returned by LookUpInode are not cacheable.)
+//
+// Expiration times are measured according to the supplied clock.
 func NewCachingFS(
 	lookupEntryTimeout time.Duration,
-	getattrTimeout time.Duration) (CachingFS, error) {
+	getattrTimeout time.Duration,
+	clock timeutil.Clock) (CachingFS, error) {
 	roundUp := func(n fuseops.InodeID) fuseops.InodeID {
 		return numInodes * ((n + numInodes - 1) / numInodes)
 	}
@@ -103,7 +107,8 @@ func NewCachingFS(
 		lookupEntryTimeout: lookupEntryTimeout,
 		getattrTimeout:     getattrTimeout,
 		baseID:             roundUp(fuseops.RootInodeID + 1),
-		mtime:              time.Now(),
+		clock:              clock,
+		mtime:              clock.Now(),
 	}
 
 	cfs.mu = syncutil.NewInvariantMutex(cfs.checkInvariants)
@@ -129,6 +134,7 @@ type cachingFS struct {
 
 	lookupEntryTimeout time.Duration
 	getattrTimeout     time.Duration
+	clock              timeutil.Clock
 
 	/////////////////////////
 	// Mutable state
@@ -354,7 +360,7 @@ func (fs *cachingFS) LookUpInode(
 	// Fill in the response.
 	op.Entry.Child = id
 	op.Entry.Attributes = attrs
-	op.Entry.EntryExpiration = time.Now().Add(fs.lookupEntryTimeout)
+	op.Entry.EntryExpiration = fs.clock.Now().Add(fs.lookupEntryTimeout)
 
 	return nil
 }
@@ -385,7 +391,7 @@ func (fs *cachingFS) GetInodeAttributes(
 
 	// Fill in the response.
 	op.Attributes = attrs
-	op.AttributesExpiration = time.Now().Add(fs.getattrTimeout)
+	op.AttributesExpiration = fs.clock.Now().Add(fs.getattrTimeout)
 
 	return nil
 }
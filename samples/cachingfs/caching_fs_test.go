@@ -24,6 +24,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jacobsa/fuse/fusetesting"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples"
 	"github.com/jacobsa/fuse/samples/cachingfs"
@@ -42,6 +43,7 @@ type cachingFSTest struct {
 	samples.SampleTest
 
 	fs           cachingfs.CachingFS
+	spy          *fusetesting.CacheSpy
 	initialMtime time.Time
 }
 
@@ -57,11 +59,19 @@ func (t *cachingFSTest) setUp(
 	// caching causes them to always be cached. Turn it off.
 	t.MountConfig.DisableWritebackCaching = true
 
+	// Measure expiration times with the simulated clock, so that tests can
+	// advance it rather than waiting for caches to expire.
+	t.MountConfig.Clock = &t.Clock
+
 	// Create the file system.
-	t.fs, err = cachingfs.NewCachingFS(lookupEntryTimeout, getattrTimeout)
+	t.fs, err = cachingfs.NewCachingFS(
+		lookupEntryTimeout,
+		getattrTimeout,
+		&t.Clock)
 	AssertEq(nil, err)
 
-	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.spy = fusetesting.NewCacheSpy(t.fs)
+	t.Server = fuseutil.NewFileSystemServer(t.spy)
 
 	// Mount it.
 	t.SampleTest.SetUp(ti)
@@ -71,6 +81,13 @@ func (t *cachingFSTest) setUp(
 	t.fs.SetMtime(t.initialMtime)
 }
 
+// Advance the clock by the given duration, dropping whatever has expired from
+// the kernel's caches.
+func (t *cachingFSTest) advanceClock(d time.Duration) {
+	t.Clock.AdvanceTime(d)
+	AssertEq(nil, t.MountedFileSystem.ExpireCaches())
+}
+
 func (t *cachingFSTest) statAll() (foo, dir, bar os.FileInfo) {
 	var err error
 
@@ -291,7 +308,7 @@ var _ SetUpInterface = &EntryCachingTest{}
 func init() { RegisterTestSuite(&EntryCachingTest{}) }
 
 func (t *EntryCachingTest) SetUp(ti *TestInfo) {
-	t.lookupEntryTimeout = 250 * time.Millisecond
+	t.lookupEntryTimeout = time.Minute
 	t.SampleTest.MountConfig.EnableVnodeCaching = true
 
 	t.cachingFSTest.setUp(ti, t.lookupEntryTimeout, 0)
@@ -299,7 +316,15 @@ func (t *EntryCachingTest) SetUp(ti *TestInfo) {
 
 func (t *EntryCachingTest) StatStat() {
 	fooBefore, dirBefore, barBefore := t.statAll()
-	fooAfter, dirAfter, barAfter := t.statAll()
+
+	var fooAfter, dirAfter, barAfter os.FileInfo
+	cached, err := t.spy.ServedFromCache(fusetesting.CachedLookUp, func() error {
+		fooAfter, dirAfter, barAfter = t.statAll()
+		return nil
+	})
+
+	AssertEq(nil, err)
+	ExpectTrue(cached)
 
 	// Make sure everything matches.
 	ExpectThat(fooAfter.ModTime(), timeutil.TimeEq(fooBefore.ModTime()))
@@ -322,13 +347,12 @@ func (t *EntryCachingTest) StatRenumberStat() {
 	ExpectEq(getInodeID(dirBefore), getInodeID(dirAfter))
 	ExpectEq(getInodeID(barBefore), getInodeID(barAfter))
 
-	// But after waiting for the entry cache to expire, we should see the new
-	// IDs.
+	// But after the entry cache expires, we should see the new IDs.
 	//
 	// Note that the cache is not guaranteed to expire on darwin. See notes on
 	// fuse.MountConfig.EnableVnodeCaching.
-	if runtime.GOOS != "darwin" {
-		time.Sleep(2 * t.lookupEntryTimeout)
+	if fusetesting.EntryCacheExpires() {
+		t.advanceClock(t.lookupEntryTimeout)
 		fooAfter, dirAfter, barAfter = t.statAll()
 
 		ExpectEq(t.fs.FooID(), getInodeID(fooAfter))
@@ -369,13 +393,12 @@ func (t *EntryCachingTest) StatRenumberMtimeStat() {
 	ExpectThat(dirAfter.ModTime(), timeutil.TimeEq(newMtime))
 	ExpectThat(barAfter.ModTime(), timeutil.TimeEq(newMtime))
 
-	// After waiting for the entry cache to expire, we should see fresh
-	// everything.
+	// After the entry cache expires, we should see fresh everything.
 	//
 	// Note that the cache is not guaranteed to expire on darwin. See notes on
 	// fuse.MountConfig.EnableVnodeCaching.
-	if runtime.GOOS != "darwin" {
-		time.Sleep(2 * t.lookupEntryTimeout)
+	if fusetesting.EntryCacheExpires() {
+		t.advanceClock(t.lookupEntryTimeout)
 		fooAfter, dirAfter, barAfter = t.statAll()
 
 		ExpectEq(t.fs.FooID(), getInodeID(fooAfter))
@@ -402,7 +425,7 @@ var _ SetUpInterface = &AttributeCachingTest{}
 func init() { RegisterTestSuite(&AttributeCachingTest{}) }
 
 func (t *AttributeCachingTest) SetUp(ti *TestInfo) {
-	t.getattrTimeout = 250 * time.Millisecond
+	t.getattrTimeout = time.Minute
 	t.cachingFSTest.setUp(ti, 0, t.getattrTimeout)
 }
 
@@ -469,9 +492,8 @@ func (t *AttributeCachingTest) StatMtimeStat_ViaFileDescriptor() {
 	ExpectThat(dirAfter.ModTime(), timeutil.TimeEq(dirBefore.ModTime()))
 	ExpectThat(barAfter.ModTime(), timeutil.TimeEq(barBefore.ModTime()))
 
-	// After waiting for the attribute cache to expire, we should see the fresh
-	// mtime.
-	time.Sleep(2 * t.getattrTimeout)
+	// After the attribute cache expires, we should see the fresh mtime.
+	t.advanceClock(t.getattrTimeout)
 	fooAfter, dirAfter, barAfter = t.statFiles(foo, dir, bar)
 
 	ExpectThat(fooAfter.ModTime(), timeutil.TimeEq(newMtime))
@@ -524,9 +546,9 @@ func (t *AttributeCachingTest) StatRenumberMtimeStat_ViaFileDescriptor() {
 	ExpectThat(dirAfter.ModTime(), timeutil.TimeEq(dirBefore.ModTime()))
 	ExpectThat(barAfter.ModTime(), timeutil.TimeEq(barBefore.ModTime()))
 
-	// After waiting for the attribute cache to expire, we should see the fresh
-	// mtime, still with the old inode ID.
-	time.Sleep(2 * t.getattrTimeout)
+	// After the attribute cache expires, we should see the fresh mtime, still
+	// with the old inode ID.
+	t.advanceClock(t.getattrTimeout)
 	fooAfter, dirAfter, barAfter = t.statFiles(foo, dir, bar)
 
 	ExpectEq(getInodeID(fooBefore), getInodeID(fooAfter))
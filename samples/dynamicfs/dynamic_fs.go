@@ -7,7 +7,6 @@ import (
 	"log"
 	"os"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/jacobsa/fuse"
@@ -36,20 +35,17 @@ import (
 func NewDynamicFS(clock timeutil.Clock) (fuse.Server, error) {
 	createTime := clock.Now()
 	fs := &dynamicFS{
-		clock:       clock,
-		createTime:  createTime,
-		fileHandles: make(map[fuseops.HandleID]string),
+		clock:      clock,
+		createTime: createTime,
 	}
 	return fuseutil.NewFileSystemServer(fs), nil
 }
 
 type dynamicFS struct {
 	fuseutil.NotImplementedFileSystem
-	mu          sync.Mutex
 	clock       timeutil.Clock
 	createTime  time.Time
-	nextHandle  fuseops.HandleID
-	fileHandles map[fuseops.HandleID]string
+	fileHandles fuseutil.HandleTable[string]
 }
 
 const (
@@ -123,16 +119,6 @@ func findChildInode(
 	return 0, fuse.ENOENT
 }
 
-func (fs *dynamicFS) findUnusedHandle() fuseops.HandleID {
-	// TODO: Mutex annotation?
-	handle := fs.nextHandle
-	for _, exists := fs.fileHandles[handle]; exists; _, exists = fs.fileHandles[handle] {
-		handle++
-	}
-	fs.nextHandle = handle + 1
-	return handle
-}
-
 func (fs *dynamicFS) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) error {
@@ -213,8 +199,6 @@ func (fs *dynamicFS) ReadDir(
 func (fs *dynamicFS) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
 	var contents string
 	// Update file contents on (and only on) open.
 	switch op.Inode {
@@ -227,19 +211,15 @@ func (fs *dynamicFS) OpenFile(
 	default:
 		return fuse.EINVAL
 	}
-	handle := fs.findUnusedHandle()
-	fs.fileHandles[handle] = contents
 	op.UseDirectIO = true
-	op.Handle = handle
+	op.Handle = fs.fileHandles.Allocate(contents)
 	return nil
 }
 
 func (fs *dynamicFS) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	contents, ok := fs.fileHandles[op.Handle]
+	contents, ok := fs.fileHandles.Get(op.Handle)
 	if !ok {
 		log.Printf("ReadFile: no open file handle: %d", op.Handle)
 		return fuse.EIO
@@ -256,14 +236,10 @@ func (fs *dynamicFS) ReadFile(
 func (fs *dynamicFS) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) error {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	_, ok := fs.fileHandles[op.Handle]
-	if !ok {
+	if _, ok := fs.fileHandles.Release(op.Handle); !ok {
 		log.Printf("ReleaseFileHandle: bad handle: %d", op.Handle)
 		return fuse.EIO
 	}
-	delete(fs.fileHandles, op.Handle)
 	return nil
 }
 
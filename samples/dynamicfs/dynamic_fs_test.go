@@ -3,7 +3,6 @@ package dynamicfs_test
 import (
 	"testing"
 
-	"github.com/jacobsa/fuse/fusetesting"
 	"github.com/jacobsa/fuse/samples"
 	"github.com/jacobsa/fuse/samples/dynamicfs"
 
@@ -40,7 +39,7 @@ func (t *DynamicFSTest) SetUp(ti *TestInfo) {
 }
 
 func (t *DynamicFSTest) ReadDir_Root() {
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(2, len(entries))
 
@@ -59,7 +58,7 @@ func (t *DynamicFSTest) ReadDir_Root() {
 }
 
 func (t *DynamicFSTest) ReadDir_NonExistent() {
-	_, err := fusetesting.ReadDirPicky(path.Join(t.Dir, "nosuchfile"))
+	_, err := readDirPicky(path.Join(t.Dir, "nosuchfile"))
 
 	AssertNe(nil, err)
 	ExpectThat(err, Error(HasSubstr("no such file")))
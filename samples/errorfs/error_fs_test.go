@@ -23,6 +23,7 @@ import (
 	"testing"
 
 	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples"
 	"github.com/jacobsa/fuse/samples/errorfs"
@@ -32,6 +33,9 @@ import (
 
 func TestErrorFS(t *testing.T) { RunTests(t) }
 
+// Mounts shared by the tests, if TestMain set them up for this platform.
+var mountPool *fusetesting.MountPool
+
 ////////////////////////////////////////////////////////////////////////
 // Boilerplate
 ////////////////////////////////////////////////////////////////////////
@@ -54,6 +58,8 @@ func (t *ErrorFSTest) SetUp(ti *TestInfo) {
 	AssertEq(nil, err)
 
 	t.Server = fuseutil.NewFileSystemServer(t.fs)
+	t.FileSystem = t.fs
+	t.Pool = mountPool
 
 	// Mount it.
 	t.SampleTest.SetUp(ti)
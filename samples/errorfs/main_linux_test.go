@@ -0,0 +1,48 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package errorfs_test
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/jacobsa/fuse/fusetesting"
+)
+
+// Runs the tests with mountPool set up.
+type pooledTests struct {
+	m *testing.M
+}
+
+func (p pooledTests) Run() int {
+	var err error
+	mountPool, err = fusetesting.NewMountPool(2, nil)
+	if err != nil {
+		log.Fatalf("NewMountPool: %v", err)
+	}
+
+	code := p.m.Run()
+	if err := mountPool.Close(); err != nil {
+		log.Printf("Closing mount pool: %v", err)
+		code = 1
+	}
+
+	return code
+}
+
+func TestMain(m *testing.M) {
+	os.Exit(fusetesting.RunInUserNamespace(pooledTests{m}))
+}
@@ -0,0 +1,60 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hellofs_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples/hellofs"
+	"github.com/jacobsa/timeutil"
+)
+
+// The file system can be exercised without mounting it by serving it to a
+// fake kernel. To mount it for real, pass the server to fuse.Mount instead.
+func ExampleNewHelloFS() {
+	server, err := hellofs.NewHelloFS(timeutil.RealClock())
+	if err != nil {
+		log.Fatalf("NewHelloFS: %v", err)
+	}
+
+	k, err := fusetesting.NewFakeKernel(server, nil, &fusetesting.FakeKernelConfig{})
+	if err != nil {
+		log.Fatalf("NewFakeKernel: %v", err)
+	}
+	defer k.Close()
+
+	entries, err := k.ReadDir("/")
+	if err != nil {
+		log.Fatalf("ReadDir: %v", err)
+	}
+
+	for _, e := range entries {
+		fmt.Println(e.Name)
+	}
+
+	contents, err := k.ReadFile("dir/world")
+	if err != nil {
+		log.Fatalf("ReadFile: %v", err)
+	}
+
+	fmt.Printf("%s\n", contents)
+
+	// Output:
+	// hello
+	// dir
+	// Hello, world!
+}
@@ -24,6 +24,8 @@ import (
 	"time"
 
 	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/ogletest"
 	"github.com/jacobsa/timeutil"
 )
@@ -38,27 +40,39 @@ type SampleTest struct {
 	Server      fuse.Server
 	MountConfig fuse.MountConfig
 
+	// Alternatively, a file system to be served from a mount acquired from
+	// Pool, which saves mounting and unmounting for each test. If Pool is set,
+	// Server and MountConfig are ignored.
+	Pool       *fusetesting.MountPool
+	FileSystem fuseutil.FileSystem
+
 	// A context object that can be used for long-running operations.
 	Ctx context.Context
 
 	// A clock with a fixed initial time. The test's set up method may use this
-	// to wire the server with a clock, if desired.
+	// to wire the server with a clock, if desired. If it also sets
+	// MountConfig.Clock to &t.Clock, then after advancing the clock the test
+	// may call MountedFileSystem.ExpireCaches to have the kernel drop cache
+	// entries that have expired.
 	Clock timeutil.SimulatedClock
 
 	// The directory at which the file system is mounted.
 	Dir string
 
+	// The mounted file system, or nil if Pool is set.
+	MountedFileSystem *fuse.MountedFileSystem
+
 	// Anothing non-nil in this slice will be closed by TearDown. The test will
 	// fail if closing fails.
 	ToClose []io.Closer
 
-	mfs *fuse.MountedFileSystem
+	pooled *fusetesting.PooledMount
 }
 
 // Mount t.Server and initialize the other exported fields of the struct.
 // Panics on error.
 //
-// REQUIRES: t.Server has been set.
+// REQUIRES: t.Server, or t.Pool and t.FileSystem, have been set.
 func (t *SampleTest) SetUp(ti *ogletest.TestInfo) {
 	cfg := t.MountConfig
 	if *fDebug {
@@ -88,15 +102,26 @@ func (t *SampleTest) initialize(
 	// Initialize the clock.
 	t.Clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
 
-	// Set up a temporary directory.
+	// Use a pooled mount if we can.
 	var err error
+	if t.Pool != nil {
+		t.pooled, err = t.Pool.Acquire(t.FileSystem)
+		if err != nil {
+			return fmt.Errorf("Acquire: %v", err)
+		}
+
+		t.Dir = t.pooled.Dir()
+		return nil
+	}
+
+	// Set up a temporary directory.
 	t.Dir, err = ioutil.TempDir("", "sample_test")
 	if err != nil {
 		return fmt.Errorf("TempDir: %v", err)
 	}
 
 	// Mount the file system.
-	t.mfs, err = fuse.Mount(t.Dir, server, config)
+	t.MountedFileSystem, err = fuse.Mount(t.Dir, server, config)
 	if err != nil {
 		return fmt.Errorf("Mount: %v", err)
 	}
@@ -123,8 +148,14 @@ func (t *SampleTest) destroy() (err error) {
 		ogletest.ExpectEq(nil, c.Close())
 	}
 
+	// Return a pooled mount.
+	if t.pooled != nil {
+		t.pooled.Release()
+		return nil
+	}
+
 	// Was the file system mounted?
-	if t.mfs == nil {
+	if t.MountedFileSystem == nil {
 		return nil
 	}
 
@@ -139,7 +170,7 @@ func (t *SampleTest) destroy() (err error) {
 	}
 
 	// Join the file system.
-	if err := t.mfs.Join(t.Ctx); err != nil {
+	if err := t.MountedFileSystem.Join(t.Ctx); err != nil {
 		return fmt.Errorf("mfs.Join: %v", err)
 	}
 
@@ -40,7 +40,8 @@ var fooAttrs = fuseops.InodeAttributes{
 
 // A file system containing exactly one file, named "foo". ReadFile and
 // FlushFile ops can be made to hang until interrupted. Exposes a method for
-// synchronizing with the arrival of a read or a flush.
+// synchronizing with the arrival of a read or a flush, and one for finding out
+// which ops were interrupted.
 //
 // Must be created with New.
 type InterruptFS struct {
@@ -51,6 +52,11 @@ type InterruptFS struct {
 	blockForReads   bool // GUARDED_BY(mu)
 	blockForFlushes bool // GUARDED_BY(mu)
 
+	// The ops that the kernel has interrupted, in order.
+	//
+	// GUARDED_BY(mu)
+	interrupted []interface{}
+
 	// Must hold the mutex when closing these.
 	readReceived  chan struct{}
 	flushReceived chan struct{}
@@ -93,6 +99,14 @@ func (fs *InterruptFS) EnableFlushBlocking() {
 	fs.blockForFlushes = true
 }
 
+// Return the ops that the kernel has interrupted so far.
+func (fs *InterruptFS) Interrupted() []interface{} {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return append([]interface{}(nil), fs.interrupted...)
+}
+
 ////////////////////////////////////////////////////////////////////////
 // FileSystem methods
 ////////////////////////////////////////////////////////////////////////
@@ -201,3 +215,12 @@ func (fs *InterruptFS) FlushFile(
 
 	return nil
 }
+
+func (fs *InterruptFS) OpInterrupted(
+	ctx context.Context,
+	op interface{}) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.interrupted = append(fs.interrupted, op)
+}
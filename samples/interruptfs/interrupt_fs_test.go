@@ -22,6 +22,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/fuse/samples"
 	"github.com/jacobsa/fuse/samples/interruptfs"
@@ -111,6 +112,11 @@ func (t *InterruptFSTest) InterruptedDuringRead() {
 	err = <-cmdErr
 	ExpectThat(err, Error(HasSubstr("signal")))
 	ExpectThat(err, Error(HasSubstr("interrupt")))
+
+	// The file system should have been told which op was interrupted.
+	interrupted := t.fs.Interrupted()
+	AssertEq(1, len(interrupted))
+	ExpectThat(interrupted[0], HasSameTypeAs(&fuseops.ReadFileOp{}))
 }
 
 func (t *InterruptFSTest) InterruptedDuringFlush() {
@@ -0,0 +1,29 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loopbackfs provides a file system that mirrors an existing
+// directory, passing every op through to it. It supports the full set of ops
+// that a local file system would (reads and writes, renames, hard and
+// symbolic links, device nodes, extended attributes), which makes it useful
+// both for checking the behaviour of package fuse against the kernel's and as
+// a starting point for file systems that wrap another.
+//
+// Each inode the kernel knows about holds an O_PATH file descriptor for the
+// file it mirrors, and ops are served with the *at family of system calls
+// relative to those descriptors, so that files keep working when they or
+// their parents are renamed by someone else. Inodes are identified by device
+// and inode number, so hard links share an inode as they would locally.
+//
+// The package only builds on Linux.
+package loopbackfs
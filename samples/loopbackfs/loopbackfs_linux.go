@@ -0,0 +1,759 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/sys/unix"
+)
+
+// NewLoopbackFS returns a server for a file system that mirrors the directory
+// at the supplied path.
+//
+// Every op is performed with the credentials of the process serving the file
+// system, whichever process sent it, so MountConfig.DisableDefaultPermissions
+// must not be set: the kernel is left to check permissions.
+func NewLoopbackFS(dir string) (fuse.Server, error) {
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		unix.Close(fd)
+		return nil, &os.PathError{Op: "stat", Path: dir, Err: err}
+	}
+
+	root := &inode{fd: fd, key: keyOf(&st)}
+	fs := &loopbackFS{
+		inodes: fuseutil.NewInodeTable(root),
+		ids:    map[inodeKey]fuseops.InodeID{root.key: fuseops.RootInodeID},
+	}
+
+	return fuseutil.NewFileSystemServer(fs), nil
+}
+
+// The identity of a file in the mirrored directory.
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+func keyOf(st *unix.Stat_t) inodeKey {
+	return inodeKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
+
+// An inode that the kernel knows about.
+type inode struct {
+	// An O_PATH file descriptor for the file, closed once the kernel forgets
+	// the inode.
+	fd int
+
+	key     inodeKey
+	symlink bool
+}
+
+// An open directory.
+type dirHandle struct {
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	fd int
+}
+
+type loopbackFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	// The inodes that the kernel knows about, each of which is freed once the
+	// kernel forgets it.
+	inodes *fuseutil.InodeTable[*inode]
+
+	// File descriptors for open files and directories.
+	files fuseutil.HandleTable[int]
+	dirs  fuseutil.HandleTable[*dirHandle]
+
+	mu sync.Mutex
+
+	// The inode for each file that has one, so that looking up a file under
+	// another name, as with hard links, gives the same inode.
+	//
+	// INVARIANT: For each k, id in ids, inodes has id with key k.
+	//
+	// GUARDED_BY(mu)
+	ids map[inodeKey]fuseops.InodeID
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+// A path that refers to the file that the supplied descriptor refers to, for
+// the system calls that can't be made on O_PATH descriptors.
+func procPath(fd int) string {
+	return fmt.Sprintf("/proc/self/fd/%d", fd)
+}
+
+func attributes(st *unix.Stat_t) fuseops.InodeAttributes {
+	return fuseops.InodeAttributes{
+		Size:  uint64(st.Size),
+		Nlink: uint32(st.Nlink),
+		Mode:  fuse.ConvertFileMode(st.Mode),
+		Rdev:  uint32(st.Rdev),
+		Atime: time.Unix(st.Atim.Unix()),
+		Mtime: time.Unix(st.Mtim.Unix()),
+		Ctime: time.Unix(st.Ctim.Unix()),
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+	}
+}
+
+// Return the inode with the supplied ID, which the kernel knows about.
+func (fs *loopbackFS) getInodeOrDie(id fuseops.InodeID) *inode {
+	in, ok := fs.inodes.Get(id)
+	if !ok {
+		panic(fmt.Sprintf("Unknown inode: %v", id))
+	}
+
+	return in
+}
+
+// Stat the file that the supplied descriptor refers to, without following
+// symlinks.
+func stat(fd int) (st unix.Stat_t, err error) {
+	err = unix.Fstatat(fd, "", &st, unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW)
+	return st, err
+}
+
+// Look up the named child of the supplied directory, filling in entry and
+// handing its inode to the kernel.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *loopbackFS) lookUp(
+	parent *inode,
+	name string,
+	entry *fuseops.ChildInodeEntry) error {
+	fd, err := unix.Openat(
+		parent.fd,
+		name,
+		unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC,
+		0)
+
+	if err != nil {
+		return err
+	}
+
+	st, err := stat(fd)
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	key := keyOf(&st)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	id, ok := fs.ids[key]
+	if ok {
+		unix.Close(fd)
+	} else {
+		id = fs.inodes.Add(&inode{
+			fd:      fd,
+			key:     key,
+			symlink: st.Mode&unix.S_IFMT == unix.S_IFLNK,
+		})
+
+		fs.ids[key] = id
+	}
+
+	fs.inodes.LookedUp(id, entry)
+	entry.Attributes = attributes(&st)
+
+	// Only the kernel refers to the inode, so it is freed once forgotten.
+	if !ok {
+		fs.inodes.Unlink(id)
+	}
+
+	return nil
+}
+
+// Clean up after an inode that the kernel has forgotten.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *loopbackFS) freed(in *inode) {
+	delete(fs.ids, in.key)
+	unix.Close(in.fd)
+}
+
+// An io.ReaderAt for an open file.
+type fdReader int
+
+func (fd fdReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := unix.Pread(int(fd), p, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (fs *loopbackFS) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) error {
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fs.getInodeOrDie(fuseops.RootInodeID).fd, &st); err != nil {
+		return err
+	}
+
+	op.BlockSize = uint32(st.Bsize)
+	op.Blocks = st.Blocks
+	op.BlocksFree = st.Bfree
+	op.BlocksAvailable = st.Bavail
+	op.IoSize = uint32(st.Bsize)
+	op.Inodes = st.Files
+	op.InodesFree = st.Ffree
+
+	return nil
+}
+
+func (fs *loopbackFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	return fs.lookUp(fs.getInodeOrDie(op.Parent), op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	st, err := stat(fs.getInodeOrDie(op.Inode).fd)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = attributes(&st)
+	return nil
+}
+
+func (fs *loopbackFS) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+
+	if op.Mode != nil {
+		mode := fuse.ConvertGoMode(*op.Mode) &^ unix.S_IFMT
+		if err := unix.Fchmodat(unix.AT_FDCWD, procPath(in.fd), mode, 0); err != nil {
+			return err
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		uid, gid := -1, -1
+		if op.Uid != nil {
+			uid = int(*op.Uid)
+		}
+
+		if op.Gid != nil {
+			gid = int(*op.Gid)
+		}
+
+		err := unix.Fchownat(
+			in.fd,
+			"",
+			uid,
+			gid,
+			unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Size != nil {
+		var err error
+		if fd, ok := fs.handleFD(op.Handle); ok {
+			err = unix.Ftruncate(fd, int64(*op.Size))
+		} else {
+			err = unix.Truncate(procPath(in.fd), int64(*op.Size))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	if op.Atime != nil || op.Mtime != nil {
+		ts := []unix.Timespec{
+			{Nsec: unix.UTIME_OMIT},
+			{Nsec: unix.UTIME_OMIT},
+		}
+
+		if op.Atime != nil {
+			ts[0] = unix.NsecToTimespec(op.Atime.UnixNano())
+		}
+
+		if op.Mtime != nil {
+			ts[1] = unix.NsecToTimespec(op.Mtime.UnixNano())
+		}
+
+		if err := unix.UtimesNanoAt(unix.AT_FDCWD, procPath(in.fd), ts, 0); err != nil {
+			return err
+		}
+	}
+
+	st, err := stat(in.fd)
+	if err != nil {
+		return err
+	}
+
+	op.Attributes = attributes(&st)
+	return nil
+}
+
+// Return the descriptor for the supplied handle, if any.
+func (fs *loopbackFS) handleFD(h *fuseops.HandleID) (int, bool) {
+	if h == nil {
+		return 0, false
+	}
+
+	return fs.files.Get(*h)
+}
+
+func (fs *loopbackFS) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if in, freed := fs.inodes.Forget(op.Inode, op.N); freed {
+		fs.freed(in)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, in := range fs.inodes.BatchForget(op.Entries) {
+		fs.freed(in)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	mode := fuse.ConvertGoMode(op.Mode) &^ unix.S_IFMT
+	if err := unix.Mkdirat(parent.fd, op.Name, mode); err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	err := unix.Mknodat(
+		parent.fd,
+		op.Name,
+		fuse.ConvertGoMode(op.Mode),
+		int(op.Rdev))
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	fd, err := unix.Openat(
+		parent.fd,
+		op.Name,
+		unix.O_CREAT|unix.O_EXCL|unix.O_RDWR|unix.O_CLOEXEC,
+		fuse.ConvertGoMode(op.Mode)&^unix.S_IFMT)
+
+	if err != nil {
+		return err
+	}
+
+	if err := fs.lookUp(parent, op.Name, &op.Entry); err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	op.Handle = fs.files.Allocate(fd)
+	return nil
+}
+
+func (fs *loopbackFS) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	if err := unix.Symlinkat(op.Target, parent.fd, op.Name); err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) error {
+	parent := fs.getInodeOrDie(op.Parent)
+	target := fs.getInodeOrDie(op.Target)
+
+	// Linking from an O_PATH descriptor with AT_EMPTY_PATH needs
+	// CAP_DAC_READ_SEARCH, so go through /proc instead.
+	err := unix.Linkat(
+		unix.AT_FDCWD,
+		procPath(target.fd),
+		parent.fd,
+		op.Name,
+		unix.AT_SYMLINK_FOLLOW)
+
+	if err != nil {
+		return err
+	}
+
+	return fs.lookUp(parent, op.Name, &op.Entry)
+}
+
+func (fs *loopbackFS) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) error {
+	return unix.Renameat(
+		fs.getInodeOrDie(op.OldParent).fd,
+		op.OldName,
+		fs.getInodeOrDie(op.NewParent).fd,
+		op.NewName)
+}
+
+func (fs *loopbackFS) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) error {
+	return unix.Unlinkat(fs.getInodeOrDie(op.Parent).fd, op.Name, unix.AT_REMOVEDIR)
+}
+
+func (fs *loopbackFS) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) error {
+	return unix.Unlinkat(fs.getInodeOrDie(op.Parent).fd, op.Name, 0)
+}
+
+func (fs *loopbackFS) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	fd, err := unix.Openat(
+		in.fd,
+		".",
+		unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC,
+		0)
+
+	if err != nil {
+		return err
+	}
+
+	op.Handle = fs.dirs.Allocate(&dirHandle{fd: fd})
+	return nil
+}
+
+func (fs *loopbackFS) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) error {
+	d, ok := fs.dirs.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Directory offsets are those of the mirrored directory, which we can seek
+	// back to.
+	list := func(offset fuseops.DirOffset, emit func(fuseutil.Dirent) bool) error {
+		if _, err := unix.Seek(d.fd, int64(offset), io.SeekStart); err != nil {
+			return err
+		}
+
+		buf := make([]byte, 8192)
+		for {
+			n, err := unix.Getdents(d.fd, buf)
+			if err != nil {
+				return err
+			}
+
+			if n == 0 {
+				return nil
+			}
+
+			for b := buf[:n]; len(b) > 0; {
+				e := (*unix.Dirent)(unsafe.Pointer(&b[0]))
+				name := b[unsafe.Offsetof(e.Name):e.Reclen]
+				b = b[e.Reclen:]
+
+				for i, c := range name {
+					if c == 0 {
+						name = name[:i]
+						break
+					}
+				}
+
+				if string(name) == "." || string(name) == ".." {
+					continue
+				}
+
+				ok := emit(fuseutil.Dirent{
+					Offset: fuseops.DirOffset(e.Off),
+					Inode:  fuseops.InodeID(e.Ino),
+					Name:   string(name),
+					Type:   fuseutil.DirentType(e.Type),
+				})
+
+				if !ok {
+					return nil
+				}
+			}
+		}
+	}
+
+	return fuseutil.ServeReadDir(op, list)
+}
+
+func (fs *loopbackFS) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) error {
+	d, ok := fs.dirs.Release(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return unix.Close(d.fd)
+}
+
+func (fs *loopbackFS) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+
+	// The kernel has already resolved the path, and opening through /proc
+	// follows a link to the file itself, which O_NOFOLLOW would refuse.
+	flags := int(op.OpenFlags)&^(unix.O_CREAT|unix.O_EXCL|unix.O_NOCTTY|unix.O_NOFOLLOW) |
+		unix.O_CLOEXEC
+
+	fd, err := unix.Open(procPath(in.fd), flags, 0)
+	if err != nil {
+		return err
+	}
+
+	op.Handle = fs.files.Allocate(fd)
+	return nil
+}
+
+func (fs *loopbackFS) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) error {
+	fd, ok := fs.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return fuseutil.ServeReadAt(op, fdReader(fd))
+}
+
+func (fs *loopbackFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fd, ok := fs.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	for data, off := op.Data, op.Offset; len(data) > 0; {
+		n, err := unix.Pwrite(fd, data, off)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+
+		data = data[n:]
+		off += int64(n)
+	}
+
+	return nil
+}
+
+func (fs *loopbackFS) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) error {
+	fd, ok := fs.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return unix.Fsync(fd)
+}
+
+func (fs *loopbackFS) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) error {
+	fd, ok := fs.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	// Report any error that closing the file would, as close(2) does, without
+	// closing the descriptor that other duplicates may still be using.
+	dup, err := unix.Dup(fd)
+	if err != nil {
+		return err
+	}
+
+	return unix.Close(dup)
+}
+
+func (fs *loopbackFS) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) error {
+	fd, ok := fs.files.Release(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return unix.Close(fd)
+}
+
+func (fs *loopbackFS) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	buf := make([]byte, unix.PathMax)
+	n, err := unix.Readlinkat(in.fd, "", buf)
+	if err != nil {
+		return err
+	}
+
+	op.Target = string(buf[:n])
+	return nil
+}
+
+func (fs *loopbackFS) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) error {
+	fd, ok := fs.files.Get(op.Handle)
+	if !ok {
+		return fuse.EINVAL
+	}
+
+	return unix.Fallocate(fd, op.Mode, int64(op.Offset), int64(op.Length))
+}
+
+// Extended attributes are accessed through /proc, since the xattr system
+// calls don't accept O_PATH descriptors. There is no way to do that for a
+// symlink without following it, so symlinks have none, as with libfuse's
+// passthrough example.
+
+func (fs *loopbackFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	if in.symlink {
+		return fuse.ENOATTR
+	}
+
+	n, err := unix.Getxattr(procPath(in.fd), op.Name, op.Dst)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = n
+	return nil
+}
+
+func (fs *loopbackFS) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	if in.symlink {
+		return nil
+	}
+
+	n, err := unix.Listxattr(procPath(in.fd), op.Dst)
+	if err != nil {
+		return err
+	}
+
+	op.BytesRead = n
+	return nil
+}
+
+func (fs *loopbackFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	if in.symlink {
+		return syscall.EPERM
+	}
+
+	return unix.Setxattr(procPath(in.fd), op.Name, op.Value, int(op.Flags))
+}
+
+func (fs *loopbackFS) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) error {
+	in := fs.getInodeOrDie(op.Inode)
+	if in.symlink {
+		return fuse.ENOATTR
+	}
+
+	return unix.Removexattr(procPath(in.fd), op.Name)
+}
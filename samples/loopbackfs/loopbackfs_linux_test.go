@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loopbackfs_test
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/samples"
+	"github.com/jacobsa/fuse/samples/loopbackfs"
+	. "github.com/jacobsa/ogletest"
+	"golang.org/x/sys/unix"
+)
+
+func TestLoopbackFS(t *testing.T) { RunTests(t) }
+
+////////////////////////////////////////////////////////////////////////
+// Boilerplate
+////////////////////////////////////////////////////////////////////////
+
+type LoopbackFSTest struct {
+	samples.SampleTest
+
+	// The directory being mirrored.
+	backing string
+}
+
+func init() { RegisterTestSuite(&LoopbackFSTest{}) }
+
+func (t *LoopbackFSTest) SetUp(ti *TestInfo) {
+	var err error
+
+	t.backing, err = os.MkdirTemp("", "loopbackfs_test")
+	AssertEq(nil, err)
+
+	t.Server, err = loopbackfs.NewLoopbackFS(t.backing)
+	AssertEq(nil, err)
+
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *LoopbackFSTest) TearDown() {
+	t.SampleTest.TearDown()
+
+	err := os.RemoveAll(t.backing)
+	AssertEq(nil, err)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Tests
+////////////////////////////////////////////////////////////////////////
+
+func (t *LoopbackFSTest) ReadFile() {
+	err := os.WriteFile(path.Join(t.backing, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	contents, err := os.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *LoopbackFSTest) WriteFile() {
+	f, err := os.Create(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	_, err = f.WriteAt([]byte("taco"), 4)
+	AssertEq(nil, err)
+
+	AssertEq(nil, f.Close())
+
+	contents, err := os.ReadFile(path.Join(t.backing, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("burrtaco", string(contents))
+}
+
+func (t *LoopbackFSTest) Truncate() {
+	err := os.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Truncate(path.Join(t.Dir, "foo"), 2)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.backing, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(2, fi.Size())
+}
+
+func (t *LoopbackFSTest) Chmod() {
+	err := os.WriteFile(path.Join(t.Dir, "foo"), nil, 0600)
+	AssertEq(nil, err)
+
+	err = os.Chmod(path.Join(t.Dir, "foo"), 0754)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.backing, "foo"))
+	AssertEq(nil, err)
+	ExpectEq(os.FileMode(0754), fi.Mode())
+}
+
+func (t *LoopbackFSTest) Mkdir() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(path.Join(t.backing, "dir"))
+	AssertEq(nil, err)
+	ExpectTrue(fi.IsDir())
+
+	err = os.Remove(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+
+	_, err = os.Stat(path.Join(t.backing, "dir"))
+	ExpectTrue(os.IsNotExist(err), "err: %v", err)
+}
+
+func (t *LoopbackFSTest) ReadDir_Large() {
+	const n = 1000
+	for i := 0; i < n; i++ {
+		err := os.WriteFile(path.Join(t.backing, fmt.Sprintf("%04d", i)), nil, 0600)
+		AssertEq(nil, err)
+	}
+
+	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(n, len(entries))
+
+	for i, fi := range entries {
+		ExpectEq(fmt.Sprintf("%04d", i), fi.Name())
+	}
+}
+
+func (t *LoopbackFSTest) RenameDirectoryWithOpenFile() {
+	err := os.Mkdir(path.Join(t.Dir, "dir"), 0700)
+	AssertEq(nil, err)
+
+	err = os.WriteFile(path.Join(t.Dir, "dir/foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	f, err := os.Open(path.Join(t.Dir, "dir/foo"))
+	AssertEq(nil, err)
+	defer f.Close()
+
+	err = os.Rename(path.Join(t.Dir, "dir"), path.Join(t.Dir, "moved"))
+	AssertEq(nil, err)
+
+	// The open file and the renamed directory are still usable.
+	contents, err := io.ReadAll(f)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	contents, err = os.ReadFile(path.Join(t.Dir, "moved/foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+
+	_, err = os.Stat(path.Join(t.backing, "moved/foo"))
+	ExpectEq(nil, err)
+}
+
+func (t *LoopbackFSTest) RenameBehindOurBack() {
+	err := os.Mkdir(path.Join(t.backing, "dir"), 0700)
+	AssertEq(nil, err)
+
+	// Keep the directory open so that its inode isn't forgotten.
+	d, err := os.Open(path.Join(t.Dir, "dir"))
+	AssertEq(nil, err)
+	defer d.Close()
+
+	err = os.Rename(path.Join(t.backing, "dir"), path.Join(t.backing, "moved"))
+	AssertEq(nil, err)
+
+	// Creating a file in the open directory puts it in the renamed one.
+	fd, err := unix.Openat(int(d.Fd()), "foo", unix.O_CREAT|unix.O_WRONLY, 0600)
+	AssertEq(nil, err)
+	unix.Close(fd)
+
+	_, err = os.Stat(path.Join(t.backing, "moved/foo"))
+	ExpectEq(nil, err)
+}
+
+func (t *LoopbackFSTest) Symlink() {
+	err := os.Symlink("some/target", path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+
+	target, err := os.Readlink(path.Join(t.backing, "link"))
+	AssertEq(nil, err)
+	ExpectEq("some/target", target)
+
+	fi, err := os.Lstat(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq(os.ModeSymlink, fi.Mode()&os.ModeType)
+
+	target, err = os.Readlink(path.Join(t.Dir, "link"))
+	AssertEq(nil, err)
+	ExpectEq("some/target", target)
+}
+
+func (t *LoopbackFSTest) HardLink() {
+	err := os.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = os.Link(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	// Both names refer to the same inode.
+	var st1, st2 syscall.Stat_t
+	AssertEq(nil, syscall.Stat(path.Join(t.Dir, "foo"), &st1))
+	AssertEq(nil, syscall.Stat(path.Join(t.Dir, "bar"), &st2))
+
+	ExpectEq(st1.Ino, st2.Ino)
+	ExpectEq(2, st2.Nlink)
+}
+
+func (t *LoopbackFSTest) Xattrs() {
+	err := os.WriteFile(path.Join(t.Dir, "foo"), nil, 0600)
+	AssertEq(nil, err)
+
+	err = unix.Setxattr(path.Join(t.Dir, "foo"), "user.taco", []byte("burrito"), 0)
+	AssertEq(nil, err)
+
+	buf := make([]byte, 64)
+	n, err := unix.Getxattr(path.Join(t.backing, "foo"), "user.taco", buf)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(buf[:n]))
+
+	n, err = unix.Getxattr(path.Join(t.Dir, "foo"), "user.taco", buf)
+	AssertEq(nil, err)
+	ExpectEq("burrito", string(buf[:n]))
+
+	n, err = unix.Listxattr(path.Join(t.Dir, "foo"), buf)
+	AssertEq(nil, err)
+	ExpectEq("user.taco\x00", string(buf[:n]))
+
+	err = unix.Removexattr(path.Join(t.Dir, "foo"), "user.taco")
+	AssertEq(nil, err)
+
+	_, err = unix.Getxattr(path.Join(t.backing, "foo"), "user.taco", buf)
+	ExpectEq(unix.ENODATA, err)
+}
@@ -40,9 +40,10 @@ type inode struct {
 
 	// The current attributes of this inode.
 	//
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeType) == 0
 	// INVARIANT: !(isDir() && isSymlink())
 	// INVARIANT: attrs.Size == len(contents)
+	// INVARIANT: If attrs.Mode&os.ModeDevice == 0, attrs.Rdev == 0
 	attrs fuseops.InodeAttributes
 
 	// For directories, entries describing the children of the directory. Unused
@@ -58,7 +59,8 @@ type inode struct {
 	// INVARIANT: Contains no duplicate names in used entries.
 	entries []fuseutil.Dirent
 
-	// For files, the current contents of the file.
+	// For files, the current contents of the file. Special files such as FIFOs
+	// count as files, but the kernel never reads or writes them through us.
 	//
 	// INVARIANT: If !isFile(), len(contents) == 0
 	contents []byte
@@ -93,8 +95,8 @@ func newInode(attrs fuseops.InodeAttributes, name string) *inode {
 }
 
 func (in *inode) CheckInvariants() {
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
-	if !(in.attrs.Mode&^(os.ModePerm|os.ModeDir|os.ModeSymlink) == 0) {
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeType) == 0
+	if !(in.attrs.Mode&^(os.ModePerm|os.ModeType) == 0) {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
@@ -111,6 +113,11 @@ func (in *inode) CheckInvariants() {
 			len(in.contents)))
 	}
 
+	// INVARIANT: If attrs.Mode&os.ModeDevice == 0, attrs.Rdev == 0
+	if in.attrs.Mode&os.ModeDevice == 0 && in.attrs.Rdev != 0 {
+		panic(fmt.Sprintf("Unexpected device number for mode %v", in.attrs.Mode))
+	}
+
 	// INVARIANT: If !isDir(), len(entries) == 0
 	if !in.isDir() && len(in.entries) != 0 {
 		panic(fmt.Sprintf("Unexpected entries length: %d", len(in.entries)))
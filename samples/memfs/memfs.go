@@ -337,15 +337,39 @@ func (fs *memFS) MkNode(
 	defer fs.mu.Unlock()
 
 	var err error
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, op.Rdev)
 	return err
 }
 
+// Return the directory entry type for a child with the supplied mode.
+func direntType(mode os.FileMode) fuseutil.DirentType {
+	switch {
+	case mode&os.ModeDir != 0:
+		return fuseutil.DT_Directory
+	case mode&os.ModeSymlink != 0:
+		return fuseutil.DT_Link
+	case mode&os.ModeNamedPipe != 0:
+		return fuseutil.DT_FIFO
+	case mode&os.ModeSocket != 0:
+		return fuseutil.DT_Socket
+	case mode&os.ModeCharDevice != 0:
+		return fuseutil.DT_Char
+	case mode&os.ModeDevice != 0:
+		return fuseutil.DT_Block
+	default:
+		return fuseutil.DT_File
+	}
+}
+
+// Create a regular or special file. rdev is the device number of a device
+// node, and otherwise ignored.
+//
 // LOCKS_REQUIRED(fs.mu)
 func (fs *memFS) createFile(
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (fuseops.ChildInodeEntry, error) {
+	mode os.FileMode,
+	rdev uint32) (fuseops.ChildInodeEntry, error) {
 	// Grab the parent, which we will update shortly.
 	parent := fs.getInodeOrDie(parentID)
 
@@ -369,11 +393,15 @@ func (fs *memFS) createFile(
 		Gid:    fs.gid,
 	}
 
+	if mode&os.ModeDevice != 0 {
+		childAttrs.Rdev = rdev
+	}
+
 	// Allocate a child.
 	childID, child := fs.allocateInode(childAttrs, name)
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	parent.AddChild(childID, name, direntType(mode))
 
 	// Fill in the response entry.
 	var entry fuseops.ChildInodeEntry
@@ -394,7 +422,7 @@ func (fs *memFS) CreateFile(
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode, 0)
 	return err
 }
 
@@ -473,7 +501,7 @@ func (fs *memFS) CreateLink(
 	target.attrs.Ctime = now
 
 	// Add an entry in the parent.
-	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
+	parent.AddChild(op.Target, op.Name, direntType(target.attrs.Mode))
 
 	// Return the response.
 	op.Entry.Child = op.Target
@@ -514,6 +542,10 @@ func (fs *memFS) Rename(
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// The replaced inode loses the link, though it may have others.
+		existing.attrs.Nlink--
+		existing.attrs.Ctime = time.Now()
 	}
 
 	// Link the new name.
@@ -581,8 +613,10 @@ func (fs *memFS) Unlink(
 	// Remove the entry within the parent.
 	parent.RemoveChild(op.Name)
 
-	// Mark the child as unlinked.
+	// Mark the child as unlinked. If it has other hard links, they see the
+	// change too.
 	child.attrs.Nlink--
+	child.attrs.Ctime = time.Now()
 
 	return nil
 }
@@ -635,6 +669,12 @@ func (fs *memFS) OpenFile(
 		panic("Found non-file.")
 	}
 
+	// With atomic O_TRUNC, it's up to us to truncate.
+	if op.OpenFlags.IsTruncate() {
+		var size uint64
+		inode.SetAttributes(&size, nil, nil)
+	}
+
 	if inode.name == CheckFileOpenFlagsFileName {
 		// For testing purpose only.
 		// Set attribute (name=fileOpenFlagsXattr, value=OpenFlags) to test whether
@@ -720,17 +760,24 @@ func (fs *memFS) GetXattr(ctx context.Context,
 	defer fs.mu.Unlock()
 
 	inode := fs.getInodeOrDie(op.Inode)
-	if value, ok := inode.xattrs[op.Name]; ok {
-		op.BytesRead = len(value)
-		if len(op.Dst) >= len(value) {
-			copy(op.Dst, value)
-		} else if len(op.Dst) != 0 {
-			return syscall.ERANGE
-		}
-	} else {
+	value, ok := inode.xattrs[op.Name]
+	if !ok {
 		return fuse.ENOATTR
 	}
 
+	// OS X reads resource forks in pieces.
+	if int(op.Position) > len(value) {
+		return syscall.EINVAL
+	}
+
+	value = value[op.Position:]
+	op.BytesRead = len(value)
+	if len(op.Dst) >= len(value) {
+		copy(op.Dst, value)
+	} else if len(op.Dst) != 0 {
+		return syscall.ERANGE
+	}
+
 	return nil
 }
 
@@ -782,21 +829,30 @@ func (fs *memFS) SetXattr(ctx context.Context,
 
 // Required to hold fs.mu
 func (fs *memFS) setXattrHelper(inode *inode, op *fuseops.SetXattrOp) error {
-	_, ok := inode.xattrs[op.Name]
+	old, ok := inode.xattrs[op.Name]
 
-	switch op.Flags {
-	case unix.XATTR_CREATE:
-		if ok {
-			return fuse.EEXIST
-		}
-	case unix.XATTR_REPLACE:
-		if !ok {
-			return fuse.ENOATTR
-		}
+	// Other flags, such as XATTR_NOFOLLOW on OS X, don't concern us.
+	create := op.Flags&unix.XATTR_CREATE != 0
+	replace := op.Flags&unix.XATTR_REPLACE != 0
+	switch {
+	case create && replace:
+		return syscall.EINVAL
+
+	case create && ok:
+		return fuse.EEXIST
+
+	case replace && !ok:
+		return fuse.ENOATTR
+	}
+
+	// OS X writes resource forks in pieces, each at the end of the last.
+	if int(op.Position) > len(old) {
+		return syscall.EINVAL
 	}
 
-	value := make([]byte, len(op.Value))
-	copy(value, op.Value)
+	value := make([]byte, int(op.Position)+len(op.Value))
+	copy(value, old[:op.Position])
+	copy(value[op.Position:], op.Value)
 	inode.xattrs[op.Name] = value
 	return nil
 }
@@ -809,3 +865,66 @@ func (fs *memFS) Fallocate(ctx context.Context,
 	inode.Fallocate(op.Mode, op.Offset, op.Length)
 	return nil
 }
+
+func (fs *memFS) Seek(
+	ctx context.Context,
+	op *fuseops.SeekOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	inode := fs.getInodeOrDie(op.Inode)
+
+	// Files are stored densely, so are data up to their end, where there is a
+	// hole.
+	size := int64(inode.attrs.Size)
+	if op.Offset < 0 || op.Offset >= size {
+		return syscall.ENXIO
+	}
+
+	switch op.Whence {
+	case unix.SEEK_DATA:
+		op.ResultOffset = op.Offset
+
+	case unix.SEEK_HOLE:
+		op.ResultOffset = size
+
+	default:
+		return syscall.EINVAL
+	}
+
+	return nil
+}
+
+func (fs *memFS) CopyFileRange(
+	ctx context.Context,
+	op *fuseops.CopyFileRangeOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	src := fs.getInodeOrDie(op.SrcInode)
+	dst := fs.getInodeOrDie(op.DstInode)
+
+	// Copy as much as the source has, through a buffer in case the ranges
+	// overlap.
+	size := src.attrs.Size
+	if op.SrcOffset >= size {
+		return nil
+	}
+
+	n := size - op.SrcOffset
+	if n > op.Length {
+		n = op.Length
+	}
+
+	buf := make([]byte, n)
+	if _, err := src.ReadAt(buf, int64(op.SrcOffset)); err != nil && err != io.EOF {
+		return err
+	}
+
+	if _, err := dst.WriteAt(buf, int64(op.DstOffset)); err != nil {
+		return err
+	}
+
+	op.BytesCopied = n
+	return nil
+}
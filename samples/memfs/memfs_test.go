@@ -20,6 +20,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path"
 	"reflect"
@@ -142,7 +143,7 @@ type MemFSTest struct {
 func init() { RegisterTestSuite(&MemFSTest{}) }
 
 func (t *MemFSTest) ContentsOfEmptyFileSystem() {
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
@@ -186,13 +187,13 @@ func (t *MemFSTest) Mkdir_OneLevel() {
 	ExpectThat(fi, fusetesting.MtimeIsWithin(createTime, timeSlop))
 
 	// Read the directory.
-	entries, err = fusetesting.ReadDirPicky(dirName)
+	entries, err = readDirPicky(dirName)
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
 
 	// Read the root.
-	entries, err = fusetesting.ReadDirPicky(t.Dir)
+	entries, err = readDirPicky(t.Dir)
 
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
@@ -241,13 +242,13 @@ func (t *MemFSTest) Mkdir_TwoLevels() {
 	ExpectThat(fi, fusetesting.MtimeIsWithin(createTime, timeSlop))
 
 	// Read the directory.
-	entries, err = fusetesting.ReadDirPicky(path.Join(t.Dir, "parent/dir"))
+	entries, err = readDirPicky(path.Join(t.Dir, "parent/dir"))
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
 
 	// Read the parent.
-	entries, err = fusetesting.ReadDirPicky(path.Join(t.Dir, "parent"))
+	entries, err = readDirPicky(path.Join(t.Dir, "parent"))
 
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
@@ -513,7 +514,7 @@ func (t *MemFSTest) UnlinkFile_Exists() {
 	ExpectThat(err, Error(HasSubstr("no such file")))
 
 	// Nothing should be in the directory.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
 }
@@ -543,7 +544,7 @@ func (t *MemFSTest) UnlinkFile_StillOpen() {
 	AssertEq(nil, err)
 
 	// The directory should no longer contain it.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
 
@@ -597,7 +598,7 @@ func (t *MemFSTest) Rmdir_Empty() {
 	AssertEq(nil, err)
 
 	// There should be nothing left in the parent.
-	entries, err = fusetesting.ReadDirPicky(path.Join(t.Dir, "foo"))
+	entries, err = readDirPicky(path.Join(t.Dir, "foo"))
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
@@ -612,7 +613,7 @@ func (t *MemFSTest) Rmdir_Empty() {
 	AssertEq(nil, err)
 
 	// Now the root directory should be empty, too.
-	entries, err = fusetesting.ReadDirPicky(t.Dir)
+	entries, err = readDirPicky(t.Dir)
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
@@ -1141,7 +1142,7 @@ func (t *MemFSTest) CreateSymlink() {
 	ExpectEq(target, actual)
 
 	// Read the parent directory.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 
@@ -1228,7 +1229,7 @@ func (t *MemFSTest) DeleteSymlink() {
 	ExpectTrue(os.IsNotExist(err), "err: %v", err)
 
 	// Read the parent directory.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 
 	AssertEq(nil, err)
 	ExpectThat(entries, ElementsAre())
@@ -1270,7 +1271,7 @@ func (t *MemFSTest) CreateHardlink() {
 	ExpectEq(0444, fi.Mode())
 
 	// Read the parent directory.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(2, len(entries))
 
@@ -1348,7 +1349,7 @@ func (t *MemFSTest) DeleteHardlink() {
 	ExpectThat(err, Error(HasSubstr("no such file")))
 
 	// Read the parent directory.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 
@@ -1380,7 +1381,7 @@ func (t *MemFSTest) DeleteHardlink() {
 	ExpectThat(err, Error(HasSubstr("no such file")))
 
 	// Read the parent directory.
-	entries, err = fusetesting.ReadDirPicky(t.Dir)
+	entries, err = readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 
@@ -1430,6 +1431,48 @@ func (t *MemFSTest) ReadHardlink() {
 	AssertEq(true, reflect.DeepEqual(original, linked))
 }
 
+func (t *MemFSTest) HardlinkCounts() {
+	var err error
+
+	nlink := func(name string) uint64 {
+		fi, err := os.Lstat(path.Join(t.Dir, name))
+		AssertEq(nil, err)
+		return uint64(fi.Sys().(*syscall.Stat_t).Nlink)
+	}
+
+	// Create a file and two more links to it.
+	err = ioutil.WriteFile(path.Join(t.Dir, "foo"), []byte("taco"), 0400)
+	AssertEq(nil, err)
+	ExpectEq(1, nlink("foo"))
+
+	err = os.Link(path.Join(t.Dir, "foo"), path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+
+	err = os.Link(path.Join(t.Dir, "foo"), path.Join(t.Dir, "baz"))
+	AssertEq(nil, err)
+
+	ExpectEq(3, nlink("foo"))
+	ExpectEq(3, nlink("bar"))
+
+	// Unlink one of them.
+	err = os.Remove(path.Join(t.Dir, "bar"))
+	AssertEq(nil, err)
+	ExpectEq(2, nlink("foo"))
+
+	// Replace another with a different file.
+	err = ioutil.WriteFile(path.Join(t.Dir, "qux"), []byte("burrito"), 0400)
+	AssertEq(nil, err)
+
+	err = os.Rename(path.Join(t.Dir, "qux"), path.Join(t.Dir, "baz"))
+	AssertEq(nil, err)
+	ExpectEq(1, nlink("foo"))
+	ExpectEq(1, nlink("baz"))
+
+	contents, err := ioutil.ReadFile(path.Join(t.Dir, "foo"))
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
 func (t *MemFSTest) CreateInParallel_NoTruncate() {
 	fusetesting.RunCreateInParallelTest_NoTruncate(t.Ctx, t.Dir)
 }
@@ -1493,7 +1536,7 @@ func (t *MemFSTest) RenameWithinDir_File() {
 	ExpectEq("taco", string(contents))
 
 	// There should only be the new entry in the directory.
-	entries, err := fusetesting.ReadDirPicky(parentPath)
+	entries, err := readDirPicky(parentPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1533,7 +1576,7 @@ func (t *MemFSTest) RenameWithinDir_Directory() {
 	ExpectEq(os.FileMode(0700)|os.ModeDir, fi.Mode())
 
 	// There should only be the new entry in the parent.
-	entries, err := fusetesting.ReadDirPicky(parentPath)
+	entries, err := readDirPicky(parentPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1542,7 +1585,7 @@ func (t *MemFSTest) RenameWithinDir_Directory() {
 	ExpectEq(os.FileMode(0700)|os.ModeDir, fi.Mode())
 
 	// And the child should still be present.
-	entries, err = fusetesting.ReadDirPicky(newPath)
+	entries, err = readDirPicky(newPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1576,7 +1619,7 @@ func (t *MemFSTest) RenameWithinDir_SameName() {
 	ExpectEq("taco", string(contents))
 
 	// There should only be the one entry in the directory.
-	entries, err := fusetesting.ReadDirPicky(parentPath)
+	entries, err := readDirPicky(parentPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi := entries[0]
@@ -1628,12 +1671,12 @@ func (t *MemFSTest) RenameAcrossDirs_File() {
 	ExpectEq("taco", string(contents))
 
 	// Check the old parent.
-	entries, err := fusetesting.ReadDirPicky(oldParentPath)
+	entries, err := readDirPicky(oldParentPath)
 	AssertEq(nil, err)
 	AssertEq(0, len(entries))
 
 	// And the new one.
-	entries, err = fusetesting.ReadDirPicky(newParentPath)
+	entries, err = readDirPicky(newParentPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1677,7 +1720,7 @@ func (t *MemFSTest) RenameAcrossDirs_Directory() {
 	ExpectEq(os.FileMode(0700)|os.ModeDir, fi.Mode())
 
 	// And the child should still be present.
-	entries, err := fusetesting.ReadDirPicky(newPath)
+	entries, err := readDirPicky(newPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1686,12 +1729,12 @@ func (t *MemFSTest) RenameAcrossDirs_Directory() {
 	ExpectEq(os.FileMode(0700)|os.ModeDir, fi.Mode())
 
 	// Check the old parent.
-	entries, err = fusetesting.ReadDirPicky(oldParentPath)
+	entries, err = readDirPicky(oldParentPath)
 	AssertEq(nil, err)
 	AssertEq(0, len(entries))
 
 	// And the new one.
-	entries, err = fusetesting.ReadDirPicky(newParentPath)
+	entries, err = readDirPicky(newParentPath)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi = entries[0]
@@ -1756,7 +1799,7 @@ func (t *MemFSTest) RenameOverExistingFile() {
 	ExpectEq("taco", string(contents))
 
 	// And the parent listing.
-	entries, err := fusetesting.ReadDirPicky(t.Dir)
+	entries, err := readDirPicky(t.Dir)
 	AssertEq(nil, err)
 	AssertEq(1, len(entries))
 	fi := entries[0]
@@ -1789,7 +1832,7 @@ func (t *MemFSTest) RenameOverExistingDirectory() {
 		ExpectThat(err, Error(HasSubstr("file exists")))
 
 		// Both should still be present in the parent listing.
-		entries, err := fusetesting.ReadDirPicky(t.Dir)
+		entries, err := readDirPicky(t.Dir)
 		AssertEq(nil, err)
 		ExpectEq(2, len(entries))
 	}
@@ -1898,6 +1941,57 @@ func (t *MemFSTest) SetXAttr() {
 	AssertEq("bar", string(buf[:sz]))
 }
 
+func (t *MemFSTest) SetXAttr_EmptyValue() {
+	var err error
+	var sz int
+	var buf [1024]byte
+
+	// Create a file.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = unix.Setxattr(filePath, "user.foo", []byte("bar"), 0)
+	AssertEq(nil, err)
+
+	// Replace the value with an empty one.
+	err = unix.Setxattr(filePath, "user.foo", []byte{}, unix.XATTR_REPLACE)
+	AssertEq(nil, err)
+
+	sz, err = unix.Getxattr(filePath, "user.foo", nil)
+	AssertEq(nil, err)
+	ExpectEq(0, sz)
+
+	sz, err = unix.Getxattr(filePath, "user.foo", buf[:])
+	AssertEq(nil, err)
+	ExpectEq(0, sz)
+
+	// The attribute is still listed.
+	sz, err = unix.Listxattr(filePath, buf[:])
+	AssertEq(nil, err)
+	ExpectEq("user.foo\000", string(buf[:sz]))
+}
+
+func (t *MemFSTest) SetXAttr_ConflictingFlags() {
+	var err error
+
+	// Create a file.
+	filePath := path.Join(t.Dir, "foo")
+	err = ioutil.WriteFile(filePath, []byte("taco"), 0600)
+	AssertEq(nil, err)
+
+	err = unix.Setxattr(
+		filePath,
+		"user.foo",
+		[]byte("bar"),
+		unix.XATTR_CREATE|unix.XATTR_REPLACE)
+
+	ExpectEq(unix.EINVAL, err)
+
+	_, err = unix.Getxattr(filePath, "user.foo", nil)
+	ExpectEq(fuse.ENOATTR, err)
+}
+
 func (t *MemFSTest) RemoveXAttr() {
 	var err error
 
@@ -2007,6 +2101,75 @@ func (t *MknodTest) NonExistentParent() {
 	ExpectEq(syscall.ENOENT, err)
 }
 
+func (t *MknodTest) FIFO() {
+	// mknod(2) only works for root on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	// Create
+	out, err := exec.Command("mkfifo", "-m", "0640", p).CombinedOutput()
+	AssertEq(nil, err, "mkfifo: %s", out)
+
+	// Stat
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeNamedPipe|0640, fi.Mode())
+
+	// ReadDir, which reports the type from the directory entry.
+	entries, err := os.ReadDir(t.Dir)
+	AssertEq(nil, err)
+	AssertEq(1, len(entries))
+	ExpectEq(os.ModeNamedPipe, entries[0].Type())
+
+	// The kernel carries data through the pipe without involving us.
+	go func() {
+		ioutil.WriteFile(p, []byte("taco"), 0)
+	}()
+
+	contents, err := ioutil.ReadFile(p)
+	AssertEq(nil, err)
+	ExpectEq("taco", string(contents))
+}
+
+func (t *MknodTest) Socket() {
+	// mknod(2) only works for root on OS X.
+	if runtime.GOOS == "darwin" {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Mknod(p, syscall.S_IFSOCK|0600, 0)
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeSocket|0600, fi.Mode())
+}
+
+func (t *MknodTest) CharDevice() {
+	// Creating device nodes takes privileges.
+	if runtime.GOOS == "darwin" || os.Geteuid() != 0 {
+		return
+	}
+
+	var err error
+	p := path.Join(t.Dir, "foo")
+
+	err = syscall.Mknod(p, syscall.S_IFCHR|0600, int(unix.Mkdev(1, 3)))
+	AssertEq(nil, err)
+
+	fi, err := os.Stat(p)
+	AssertEq(nil, err)
+	ExpectEq(os.ModeDevice|os.ModeCharDevice|0600, fi.Mode())
+	ExpectEq(unix.Mkdev(1, 3), fi.Sys().(*syscall.Stat_t).Rdev)
+}
+
 func (t *MknodTest) Fallocate_Larger() {
 	var err error
 	fileName := path.Join(t.Dir, "foo")
@@ -2035,6 +2198,58 @@ func (t *MknodTest) Fallocate_Larger() {
 	ExpectEq("taco\x00\x00", string(contents))
 }
 
+////////////////////////////////////////////////////////////////////////
+// Writeback caching
+////////////////////////////////////////////////////////////////////////
+
+type WritebackCachingTest struct {
+	samples.SampleTest
+}
+
+func init() { RegisterTestSuite(&WritebackCachingTest{}) }
+
+func (t *WritebackCachingTest) SetUp(ti *TestInfo) {
+	t.Server = memfs.NewMemFS(currentUid(), currentGid())
+	t.SampleTest.SetUp(ti)
+}
+
+func (t *WritebackCachingTest) SmallWritesAreCoalesced() {
+	const writeSize = 512
+	const numWrites = 1024
+
+	// Make many small writes, which land in the page cache.
+	fileName := path.Join(t.Dir, "foo")
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, 0600)
+	AssertEq(nil, err)
+	defer f.Close()
+
+	before := t.MountedFileSystem.Stats()
+
+	var want []byte
+	for i := 0; i < numWrites; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i%26)}, writeSize)
+		_, err = f.Write(b)
+		AssertEq(nil, err)
+		want = append(want, b...)
+	}
+
+	// Syncing writes the dirty pages back, in page-sized or larger ops rather
+	// than one per write(2).
+	err = f.Sync()
+	AssertEq(nil, err)
+
+	after := t.MountedFileSystem.Stats()
+	writes := after.Ops["WriteFile"] - before.Ops["WriteFile"]
+	ExpectGt(writes, 0)
+	ExpectLe(writes, numWrites*writeSize/4096)
+	ExpectEq(numWrites*writeSize, after.BytesWritten-before.BytesWritten)
+
+	// Reading it back gives what was written.
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectTrue(bytes.Equal(want, contents))
+}
+
 ////////////////////////////////////////////////////////////////////////
 // atomic_o_trunc
 ////////////////////////////////////////////////////////////////////////
@@ -2071,6 +2286,15 @@ func (t *atomicOTruncTest) OpenFileWithOTrunc() {
 	} else {
 		t.checkOpenFlagsNotContainsFlag(fileName, fusekernel.OpenTruncate)
 	}
+
+	// Either way, the file was truncated.
+	fi, err := f.Stat()
+	AssertEq(nil, err)
+	ExpectEq(0, fi.Size())
+
+	contents, err := ioutil.ReadFile(fileName)
+	AssertEq(nil, err)
+	ExpectEq("", string(contents))
 }
 
 type AtmoicOTruncEnabledTest struct {
@@ -18,7 +18,6 @@ package main
 
 import (
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -27,12 +26,12 @@ import (
 	"syscall"
 
 	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/daemonize"
 	"github.com/jacobsa/fuse/samples/flushfs"
 )
 
 var fType = flag.String("type", "", "The name of the samples/ sub-dir.")
 var fMountPoint = flag.String("mount_point", "", "Path to mount point.")
-var fReadyFile = flag.Uint64("ready_file", 0, "FD to signal when ready.")
 
 var fFlushesFile = flag.Uint64("flushfs.flushes_file", 0, "")
 var fFsyncsFile = flag.Uint64("flushfs.fsyncs_file", 0, "")
@@ -95,14 +94,6 @@ func makeFS() (fuse.Server, error) {
 	}
 }
 
-func getReadyFile() (*os.File, error) {
-	if *fReadyFile == 0 {
-		return nil, errors.New("You must set --ready_file.")
-	}
-
-	return os.NewFile(uintptr(*fReadyFile), "(ready file)"), nil
-}
-
 func main() {
 	flag.Parse()
 
@@ -110,15 +101,10 @@ func main() {
 	// bugs like https://github.com/jacobsa/fuse/issues/4.
 	runtime.GOMAXPROCS(2)
 
-	// Grab the file to signal when ready.
-	readyFile, err := getReadyFile()
-	if err != nil {
-		log.Fatalf("getReadyFile: %v", err)
-	}
-
 	// Create an appropriate file system.
 	server, err := makeFS()
 	if err != nil {
+		daemonize.SignalOutcome(fmt.Errorf("makeFS: %v", err))
 		log.Fatalf("makeFS: %v", err)
 	}
 
@@ -137,13 +123,13 @@ func main() {
 
 	mfs, err := fuse.Mount(*fMountPoint, server, cfg)
 	if err != nil {
+		daemonize.SignalOutcome(fmt.Errorf("Mount: %v", err))
 		log.Fatalf("Mount: %v", err)
 	}
 
 	// Signal that it is ready.
-	_, err = readyFile.Write([]byte("x"))
-	if err != nil {
-		log.Fatalf("readyFile.Write: %v", err)
+	if err := daemonize.SignalOutcome(nil); err != nil {
+		log.Fatalf("SignalOutcome: %v", err)
 	}
 
 	// Wait for it to be unmounted.
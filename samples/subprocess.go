@@ -17,6 +17,7 @@ package samples
 import (
 	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -27,6 +28,7 @@ import (
 	"path"
 	"sync"
 
+	"github.com/jacobsa/fuse/daemonize"
 	"github.com/jacobsa/ogletest"
 )
 
@@ -167,16 +169,6 @@ func waitForMountSample(
 	err = fmt.Errorf("Waiting for mount_sample: %v", err)
 }
 
-func waitForReady(readyReader *os.File, c chan<- struct{}) {
-	_, err := readyReader.Read(make([]byte, 1))
-	if err != nil {
-		log.Printf("Readying from ready pipe: %v", err)
-		return
-	}
-
-	c <- struct{}{}
-}
-
 // Like SetUp, but doens't panic.
 func (t *SubprocessTest) initialize(ctx context.Context) error {
 	// Initialize the context.
@@ -233,17 +225,6 @@ func (t *SubprocessTest) initialize(ctx context.Context) error {
 
 	args = append(args, t.MountFlags...)
 
-	// Set up a pipe for the "ready" status.
-	readyReader, readyWriter, err := os.Pipe()
-	if err != nil {
-		return fmt.Errorf("Pipe: %v", err)
-	}
-
-	defer readyReader.Close()
-	defer readyWriter.Close()
-
-	t.MountFiles["ready_file"] = readyWriter
-
 	// Set up inherited files and appropriate flags.
 	var extraFiles []*os.File
 	for flag, file := range t.MountFiles {
@@ -267,24 +248,25 @@ func (t *SubprocessTest) initialize(ctx context.Context) error {
 		mountCmd.Args = append(mountCmd.Args, "--debug")
 	}
 
-	// Start the command.
-	if err := mountCmd.Start(); err != nil {
-		return fmt.Errorf("mountCmd.Start: %v", err)
+	// Start the command, and wait for the tool to say whether the file system
+	// mounted.
+	err = daemonize.Start(mountCmd, nil)
+	if mountCmd.Process == nil {
+		return fmt.Errorf("daemonize.Start: %v", err)
 	}
 
 	// Launch a goroutine that waits for it and returns its status.
 	mountSampleErr := make(chan error, 1)
 	go waitForMountSample(mountCmd, mountSampleErr, &stderr)
 
-	// Wait for the tool to say the file system is ready. In parallel, watch for
-	// the tool to fail.
-	readyChan := make(chan struct{}, 1)
-	go waitForReady(readyReader, readyChan)
+	// If the tool exited without saying, its exit status and stderr are the
+	// best explanation.
+	if errors.Is(err, daemonize.ErrNoOutcome) {
+		return <-mountSampleErr
+	}
 
-	select {
-	case <-readyChan:
-	case err := <-mountSampleErr:
-		return err
+	if err != nil {
+		return fmt.Errorf("mount_sample: %v", err)
 	}
 
 	// TearDown is no responsible for joining.
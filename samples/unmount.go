@@ -15,16 +15,17 @@
 package samples
 
 import (
+	"errors"
 	"fmt"
 	"log"
-	"strings"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse"
 )
 
 // Unmount the file system mounted at the supplied directory. Try again on
-// "resource busy" errors, which happen from time to time on OS X (due to weird
+// EBUSY errors, which happen from time to time on OS X (due to weird
 // requests from the Finder) and when tests don't or can't synchronize all
 // events.
 func unmount(dir string) error {
@@ -35,13 +36,13 @@ func unmount(dir string) error {
 			return err
 		}
 
-		if strings.Contains(err.Error(), "resource busy") {
+		if errors.Is(err, syscall.EBUSY) {
 			log.Println("Resource busy error while unmounting; trying again")
 			time.Sleep(delay)
 			delay = time.Duration(1.3 * float64(delay))
 			continue
 		}
 
-		return fmt.Errorf("Unmount: %v", err)
+		return fmt.Errorf("Unmount: %w", err)
 	}
 }
@@ -0,0 +1,61 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package fuse
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// NewSlogLogger returns a Logger that passes records to the supplied handler,
+// for example one made by slog.NewJSONHandler. LogDebug and LogError map to
+// slog.LevelDebug and slog.LevelError.
+func NewSlogLogger(h slog.Handler) Logger {
+	return slogLogger{h}
+}
+
+type slogLogger struct {
+	h slog.Handler
+}
+
+func slogLevel(level LogLevel) slog.Level {
+	if level >= LogError {
+		return slog.LevelError
+	}
+
+	return slog.LevelDebug
+}
+
+func (l slogLogger) Enabled(level LogLevel) bool {
+	return l.h.Enabled(context.Background(), slogLevel(level))
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, fields ...LogField) {
+	// Attribute the record to the code that called Connection.log, as
+	// slog.Logger would.
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:])
+
+	r := slog.NewRecord(time.Now(), slogLevel(level), msg, pcs[0])
+	for _, f := range fields {
+		r.AddAttrs(slog.Any(f.Key, f.Value))
+	}
+
+	l.h.Handle(context.Background(), r)
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.21
+
+package fuse_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	h := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelError})
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&recordingFS{}),
+		&fuse.MountConfig{Logger: fuse.NewSlogLogger(h)},
+		&fusetesting.FakeKernelConfig{})
+
+	if _, err := k.Call(fusekernel.OpRmdir, 3, nameBytes("bar")); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", buf.String(), err)
+	}
+
+	if record["level"] != "ERROR" ||
+		record["msg"] != "Reply" ||
+		record[fuse.LogKeyOp] != "RmDir" ||
+		record[fuse.LogKeyInode] != 3.0 ||
+		record[fuse.LogKeyError] != syscall.ENOSYS.Error() {
+		t.Errorf("Unexpected record: %s", buf.String())
+	}
+}
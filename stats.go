@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"sync"
+	"time"
+)
+
+// Stats holds cumulative statistics for a mounted file system, as returned by
+// MountedFileSystem.Stats.
+type Stats struct {
+	// When the file system was mounted, and how long ago that was.
+	MountTime time.Time
+	Uptime    time.Duration
+
+	// The number of ops responded to, keyed by op name without the "Op"
+	// suffix, e.g. "LookUpInode", and the number of those that failed. Requests
+	// handled by package fuse itself appear under lowercase names, e.g.
+	// "init".
+	Ops    map[string]uint64
+	Errors map[string]uint64
+
+	// The number of bytes returned by successful ReadFileOps and accepted by
+	// successful WriteFileOps.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// The number of malformed messages from the kernel that were ignored or
+	// rejected. See MountConfig.TolerateProtocolErrors and
+	// MountConfig.StrictProtocolValidation.
+	ProtocolErrors uint64
+}
+
+// The statistics maintained by a connection.
+type connectionStats struct {
+	mountTime time.Time
+
+	mu sync.Mutex
+
+	// GUARDED_BY(mu)
+	ops          map[string]uint64
+	errors       map[string]uint64
+	bytesRead    uint64
+	bytesWritten uint64
+}
+
+func newConnectionStats() *connectionStats {
+	return &connectionStats{
+		mountTime: time.Now(),
+		ops:       make(map[string]uint64),
+		errors:    make(map[string]uint64),
+	}
+}
+
+// Record the response to an op.
+//
+// LOCKS_EXCLUDED(s.mu)
+func (s *connectionStats) record(op interface{}, opErr error) {
+	name := opName(op)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ops[name]++
+	if opErr != nil {
+		s.errors[name]++
+		return
+	}
+
+	m := opMetrics(op, 0)
+	s.bytesRead += uint64(m.BytesRead)
+	s.bytesWritten += uint64(m.BytesWritten)
+}
+
+// Stats returns cumulative statistics for the file system, which are
+// maintained for as long as it is mounted.
+func (mfs *MountedFileSystem) Stats() Stats {
+	s := mfs.stats
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Stats{
+		MountTime:      s.mountTime,
+		Uptime:         time.Since(s.mountTime),
+		Ops:            make(map[string]uint64, len(s.ops)),
+		Errors:         make(map[string]uint64, len(s.errors)),
+		BytesRead:      s.bytesRead,
+		BytesWritten:   s.bytesWritten,
+		ProtocolErrors: mfs.protocolErrors.Load(),
+	}
+
+	for name, n := range s.ops {
+		st.Ops[name] = n
+	}
+
+	for name, n := range s.errors {
+		st.Errors[name] = n
+	}
+
+	return st
+}
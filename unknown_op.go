@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"context"
+	"io"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+)
+
+// UnknownOpHandler handles a request from the kernel with an opcode that this
+// package doesn't know about, allowing ops added to newer kernels to be
+// supported before the package grows types for them. See
+// MountConfig.UnknownOpHandler.
+//
+// The payload is everything after the request header, in the kernel's wire
+// format, and is valid only until the handler returns. To succeed, the
+// handler writes the body of the reply (everything after the reply header)
+// to reply and returns nil. If it returns an error, whatever it wrote is
+// discarded and the op fails as it would for any other op.
+type UnknownOpHandler func(
+	ctx context.Context,
+	opCode uint32,
+	inode fuseops.InodeID,
+	payload []byte,
+	reply io.Writer) error
+
+// An io.Writer that appends to the body of a reply.
+type replyWriter struct {
+	m *buffer.OutMessage
+}
+
+func (w replyWriter) Write(p []byte) (int, error) {
+	// The message keeps a reference to what is appended, and the caller may
+	// reuse p.
+	w.m.Append(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// Run the configured handler for an unknown op, replying with its result.
+func (c *Connection) handleUnknownOp(
+	ctx context.Context,
+	op *unknownOp,
+	outMsg *buffer.OutMessage) {
+	defer c.rawOpsInFlight.Done()
+
+	err := c.cfg.UnknownOpHandler(
+		ctx,
+		op.OpCode,
+		op.Inode,
+		op.Payload,
+		replyWriter{outMsg})
+
+	c.Reply(ctx, err)
+}
@@ -14,8 +14,32 @@
 
 package fuse
 
+import "fmt"
+
 // Unmount attempts to unmount the file system whose mount point is the
-// supplied directory.
+// supplied directory. If the file system is in use, the error wraps
+// syscall.EBUSY; callers that expect this to be transient, for example
+// because of a process that is still closing files, may retry.
 func Unmount(dir string) error {
 	return unmount(dir)
 }
+
+// UnmountStale checks whether dir is the mount point of a file system whose
+// connection is dead, e.g. because its daemon crashed, and if so unmounts it
+// lazily and returns true. Such a mount fails every access with ENOTCONN,
+// including mounting on top of it, so a daemon restarted after a crash should
+// call this before mounting on the same directory again. If dir is
+// accessible, UnmountStale does nothing and returns false.
+//
+// Linux only. On other platforms UnmountStale always returns false.
+func UnmountStale(dir string) (bool, error) {
+	if !connectionAborted(dir) {
+		return false, nil
+	}
+
+	if err := lazyUnmount(dir); err != nil {
+		return false, fmt.Errorf("lazyUnmount: %w", err)
+	}
+
+	return true, nil
+}
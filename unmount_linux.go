@@ -1,25 +1,49 @@
 package fuse
 
 import (
-	"bytes"
-	"fmt"
+	"os"
 	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 func unmount(dir string) error {
+	return unmountWithFlags(dir, 0)
+}
+
+func lazyUnmount(dir string) error {
+	return unmountWithFlags(dir, unix.MNT_DETACH)
+}
+
+// Unmount with umount2(2), supporting flags 0 and MNT_DETACH.
+func unmountWithFlags(dir string, flags int) error {
+	// Try unmounting without fusermount(1) first: we might be running as root
+	// or have the CAP_SYS_ADMIN capability, e.g. in a user namespace where
+	// fusermount(1) can't help.
+	err := unix.Unmount(dir, flags)
+	if err != syscall.EPERM {
+		if err != nil {
+			return &os.PathError{Op: "unmount", Path: dir, Err: err}
+		}
+
+		return nil
+	}
+
 	fusermount, err := findFusermount()
 	if err != nil {
 		return err
 	}
-	cmd := exec.Command(fusermount, "-u", dir)
+
+	args := []string{"-u"}
+	if flags&unix.MNT_DETACH != 0 {
+		args = append(args, "-z")
+	}
+
+	cmd := exec.Command(fusermount, append(args, dir)...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		if len(output) > 0 {
-			output = bytes.TrimRight(output, "\n")
-			return fmt.Errorf("%v: %s", err, output)
-		}
-
-		return err
+		return newOutputError(err, output)
 	}
 	return nil
 }
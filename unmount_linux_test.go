@@ -0,0 +1,140 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A minimalFS whose root directory can be statted.
+type rootFS struct {
+	minimalFS
+}
+
+func (fs *rootFS) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) error {
+	op.Attributes = fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  0755 | os.ModeDir,
+	}
+
+	return nil
+}
+
+func TestUnmountStale(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "unmount_test")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Nothing is mounted yet.
+	if unmounted, err := fuse.UnmountStale(dir); unmounted || err != nil {
+		t.Fatalf("UnmountStale: %v, %v", unmounted, err)
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&rootFS{}),
+		&fuse.MountConfig{})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Kill the connection, as if the daemon had crashed.
+	if err := fusetesting.AbortConnection(dir); err != nil {
+		fuse.Unmount(dir)
+		mfs.Join(ctx)
+		t.Skipf("AbortConnection: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != fuse.ErrConnectionAborted {
+		t.Errorf("Join: got %v, want ErrConnectionAborted", err)
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		t.Errorf("Stat of aborted mount succeeded")
+	}
+
+	unmounted, err := fuse.UnmountStale(dir)
+	if !unmounted || err != nil {
+		t.Fatalf("UnmountStale: %v, %v", unmounted, err)
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		t.Errorf("Stat after UnmountStale: %v", err)
+	}
+}
+
+func TestUnmountErrors(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := os.MkdirTemp("", "unmount_test")
+	if err != nil {
+		t.Fatalf("MkdirTemp: %v", err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// Unmounting a directory that isn't a mount point fails, in a way that
+	// depends on whether fusermount(1) was needed, but never with EBUSY.
+	if err := fuse.Unmount(dir); err == nil || errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Unmount of plain directory: %v", err)
+	}
+
+	mfs, err := fuse.Mount(
+		dir,
+		fuseutil.NewFileSystemServer(&rootFS{}),
+		&fuse.MountConfig{EnableNoOpendirSupport: true})
+
+	if err != nil {
+		t.Fatalf("fuse.Mount: %v", err)
+	}
+
+	// Keep the file system busy.
+	f, err := os.Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	err = fuse.Unmount(dir)
+	if !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Unmount of busy file system: got %v, want EBUSY", err)
+	}
+
+	f.Close()
+
+	if err := fuse.Unmount(dir); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+
+	if err := mfs.Join(ctx); err != nil {
+		t.Errorf("Join: %v", err)
+	}
+}
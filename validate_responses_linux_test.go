@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"github.com/jacobsa/timeutil"
+)
+
+// A file system that fills in responses wrongly, depending on the name
+// looked up or created.
+type badResponseFS struct {
+	fuseutil.NotImplementedFileSystem
+}
+
+func (fs *badResponseFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	switch op.Name {
+	case "zero":
+	case "stale":
+		op.Entry.Child = 17
+		op.Entry.EntryExpiration = time.Now().Add(-time.Hour)
+	default:
+		op.Entry.Child = 17
+	}
+
+	return nil
+}
+
+func (fs *badResponseFS) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) error {
+	// Forget to set the type.
+	op.Entry.Child = 17
+	op.Entry.Attributes.Mode = 0755
+	return nil
+}
+
+func TestValidateResponses(t *testing.T) {
+	mkdir := fusekernel.MkdirIn{Mode: 0755}
+	testCases := []struct {
+		name   string
+		opCode uint32
+		body   [][]byte
+	}{
+		{"zero child", fusekernel.OpLookup, [][]byte{nameBytes("zero")}},
+		{"stale entry", fusekernel.OpLookup, [][]byte{nameBytes("stale")}},
+		{"mkdir type", fusekernel.OpMkdir, [][]byte{
+			structBytes(unsafe.Pointer(&mkdir), unsafe.Sizeof(mkdir), int(unsafe.Sizeof(mkdir))),
+			nameBytes("foo"),
+		}},
+	}
+
+	for _, validate := range []bool{false, true} {
+		var logged bytes.Buffer
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&badResponseFS{}),
+			&fuse.MountConfig{
+				ValidateResponses: validate,
+				ErrorLogger:       log.New(&logged, "", 0),
+			},
+			&fusetesting.FakeKernelConfig{})
+
+		// Each of these is sent to the kernel as is normally, and failed when
+		// validating.
+		for _, tc := range testCases {
+			r, err := k.Call(tc.opCode, 1, tc.body...)
+			if err != nil {
+				t.Fatalf("%s: Call: %v", tc.name, err)
+			}
+
+			if validate != (r.Error == syscall.EIO) {
+				t.Errorf("%s, validate %v: got errno %v", tc.name, validate, r.Error)
+			}
+		}
+
+		if got := strings.Count(logged.String(), "invalid response"); validate && got != len(testCases) {
+			t.Errorf("Logged %d invalid responses, want %d:\n%s", got, len(testCases), logged.String())
+		}
+
+		// Proper responses get through either way.
+		r, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+		if err != nil || r.Error != 0 {
+			t.Errorf("validate %v: Call: %v, %v", validate, err, r.Error)
+		}
+
+		k.Close()
+	}
+}
+
+// A file system that sets expirations in terms of a simulated clock.
+type clockFS struct {
+	fuseutil.NotImplementedFileSystem
+	clock timeutil.Clock
+}
+
+func (fs *clockFS) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) error {
+	op.Entry.Child = 17
+	op.Entry.EntryExpiration = fs.clock.Now().Add(time.Hour)
+	op.Entry.AttributesExpiration = fs.clock.Now().Add(time.Hour)
+	return nil
+}
+
+func TestValidateResponsesWithClock(t *testing.T) {
+	clock := &timeutil.SimulatedClock{}
+	clock.SetTime(time.Date(2012, 8, 15, 22, 56, 0, 0, time.Local))
+
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(&clockFS{clock: clock}),
+		&fuse.MountConfig{
+			Clock:             clock,
+			ValidateResponses: true,
+		},
+		&fusetesting.FakeKernelConfig{})
+
+	// Expirations in the future of the simulated clock are fine, though long
+	// past in real time.
+	r, err := k.Call(fusekernel.OpLookup, 1, nameBytes("foo"))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+
+	if r.Error != 0 {
+		t.Errorf("Unexpected error: %v", r.Error)
+	}
+}
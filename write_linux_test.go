@@ -0,0 +1,373 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+func TestWriteFileOpSource(t *testing.T) {
+	fs := &recordingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		nil,
+		&fusetesting.FakeKernelConfig{})
+
+	testCases := []struct {
+		writeFlags fusekernel.WriteFlags
+		flags      uint32
+		writeback  bool
+		direct     bool
+		sync       bool
+	}{
+		{fusekernel.WriteCache, 0, true, false, false},
+		{0, syscall.O_WRONLY, false, false, false},
+		{0, syscall.O_WRONLY | syscall.O_DIRECT, false, true, false},
+		{0, syscall.O_RDWR | syscall.O_DSYNC, false, false, true},
+	}
+
+	data := []byte("taco")
+	for _, tc := range testCases {
+		in := fusekernel.WriteIn{
+			Fh:         1,
+			Size:       uint32(len(data)),
+			WriteFlags: uint32(tc.writeFlags),
+			Flags:      tc.flags,
+		}
+
+		r, err := k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			data)
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		op, ok := fs.last().(*fuseops.WriteFileOp)
+		if !ok {
+			t.Fatalf("Unexpected op: %#v", fs.last())
+		}
+
+		if op.Writeback != tc.writeback || op.OpenFlags.IsDirect() != tc.direct || op.OpenFlags.IsSync() != tc.sync {
+			t.Errorf("%v, %#x: unexpected op: %#v", tc.writeFlags, tc.flags, op)
+		}
+	}
+}
+
+func TestMaxWriteSize(t *testing.T) {
+	// Larger writes take more pages.
+	pages := func(size int) uint16 { return uint16(size / os.Getpagesize()) }
+	testCases := []struct {
+		cfg          fuse.MountConfig
+		wantMaxWrite uint32
+		wantMaxPages uint16
+	}{
+		{fuse.MountConfig{}, 1 << 20, 256},
+		{fuse.MountConfig{MaxWriteSize: 64 << 10}, 64 << 10, 256},
+		{fuse.MountConfig{MaxWriteSize: 100}, 4096, 256},
+		{fuse.MountConfig{MaxWriteSize: 4 << 20}, 4 << 20, pages(4 << 20)},
+		{fuse.MountConfig{MaxWriteSize: 1 << 30}, 65535 << 12, pages(65535 << 12)},
+		{fuse.MountConfig{MaxPages: 16}, 1 << 20, 16},
+		{fuse.MountConfig{MaxPages: 1024}, 1 << 20, 256},
+		{fuse.MountConfig{MaxWriteSize: 4 << 20, MaxPages: 512}, 4 << 20, 512},
+	}
+
+	for i, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&tc.cfg,
+			&fusetesting.FakeKernelConfig{InitFlags: uint32(fusekernel.InitMaxPages)})
+
+		out := k.InitOut()
+		k.Close()
+
+		if out.MaxWrite != tc.wantMaxWrite || out.MaxPages != tc.wantMaxPages {
+			t.Errorf(
+				"Case %d: got max_write %d and max_pages %d, want %d and %d",
+				i,
+				out.MaxWrite,
+				out.MaxPages,
+				tc.wantMaxWrite,
+				tc.wantMaxPages)
+		}
+	}
+}
+
+func TestMaxReadahead(t *testing.T) {
+	testCases := []struct {
+		cfg  fuse.MountConfig
+		want uint32
+	}{
+		{fuse.MountConfig{}, 1 << 20},
+		{fuse.MountConfig{MaxReadahead: 128 << 10}, 128 << 10},
+		{fuse.MountConfig{MaxReadahead: 8 << 20}, 8 << 20},
+	}
+
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&recordingFS{}),
+			&tc.cfg,
+			&fusetesting.FakeKernelConfig{MaxReadahead: 1 << 20})
+
+		if got := k.InitOut().MaxReadahead; got != tc.want {
+			t.Errorf("MaxReadahead %d: got %d, want %d", tc.cfg.MaxReadahead, got, tc.want)
+		}
+	}
+}
+
+// A file system that accepts at most n bytes of each write.
+type shortWriteFS struct {
+	fuseutil.NotImplementedFileSystem
+	n int
+}
+
+func (fs *shortWriteFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	op.BytesWritten = fs.n
+	return nil
+}
+
+func TestShortWrites(t *testing.T) {
+	testCases := []struct {
+		n    int
+		want uint32
+	}{
+		{0, 4},
+		{2, 2},
+		{17, 4},
+	}
+
+	data := []byte("taco")
+	for _, tc := range testCases {
+		k := newFakeKernel(
+			t,
+			fuseutil.NewFileSystemServer(&shortWriteFS{n: tc.n}),
+			nil,
+			&fusetesting.FakeKernelConfig{})
+
+		in := fusekernel.WriteIn{Fh: 1, Size: uint32(len(data))}
+		r, err := k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			data)
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		var out fusekernel.WriteOut
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+
+		if out.Size != tc.want {
+			t.Errorf("BytesWritten %d: got size %d, want %d", tc.n, out.Size, tc.want)
+		}
+
+		k.Close()
+	}
+}
+
+// A file system that copies the data of streamed writes, then releases them.
+type streamingFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu            sync.Mutex
+	written       bytes.Buffer
+	hadData       bool
+	readAfterFree error
+}
+
+func (fs *streamingFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.hadData = fs.hadData || op.Data != nil
+	if _, err := io.Copy(&fs.written, op.Reader); err != nil {
+		return err
+	}
+
+	op.Release()
+	_, fs.readAfterFree = op.Reader.Read(make([]byte, 1))
+	return nil
+}
+
+func TestStreamWrites(t *testing.T) {
+	fs := &streamingFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{StreamWrites: true},
+		&fusetesting.FakeKernelConfig{})
+
+	for _, data := range []string{"taco", "burrito"} {
+		in := fusekernel.WriteIn{Fh: 1, Size: uint32(len(data))}
+		r, err := k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			[]byte(data))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		var out fusekernel.WriteOut
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+
+		if out.Size != uint32(len(data)) {
+			t.Errorf("Got size %d, want %d", out.Size, len(data))
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if got := fs.written.String(); got != "tacoburrito" {
+		t.Errorf("Wrote %q", got)
+	}
+
+	if fs.hadData {
+		t.Errorf("Data was set")
+	}
+
+	if fs.readAfterFree == nil {
+		t.Errorf("Read after Release succeeded")
+	}
+}
+
+// A file system that writes the first byte of each write to a buffer, and
+// copies the rest to a file.
+type spliceFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu      sync.Mutex
+	first   bytes.Buffer
+	f       *os.File
+	hadData bool
+}
+
+func (fs *spliceFS) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.hadData = fs.hadData || op.Data != nil
+	if _, err := io.CopyN(&fs.first, op.Reader, 1); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(fs.f, op.Reader); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func TestSpliceWrites(t *testing.T) {
+	f, err := os.CreateTemp("", "splice")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Keep the pipes small enough for unprivileged processes.
+	var logged bytes.Buffer
+	fs := &spliceFS{f: f}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{
+			SpliceWrites:             true,
+			MaxWriteSize:             1 << 16,
+			StrictProtocolValidation: true,
+			ErrorLogger:              log.New(&logged, "", 0),
+		},
+		&fusetesting.FakeKernelConfig{})
+
+	large := strings.Repeat("0123456789abcdef", 1<<12)
+	var want string
+	for _, data := range []string{"taco", large, "burrito"} {
+		in := fusekernel.WriteIn{Fh: 1, Size: uint32(len(data))}
+		r, err := k.Call(
+			fusekernel.OpWrite,
+			2,
+			unsafe.Slice((*byte)(unsafe.Pointer(&in)), unsafe.Sizeof(in)),
+			[]byte(data))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+
+		want += data[1:]
+	}
+
+	// Other messages are read in full.
+	r, err := k.Call(fusekernel.OpStatfs, 1)
+	if err != nil || r.Error != syscall.ENOSYS {
+		t.Errorf("Call: %v, %v", err, r.Error)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if got := fs.first.String(); got != "t0b" {
+		t.Errorf("Read first bytes %q", got)
+	}
+
+	contents, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+
+	if string(contents) != want {
+		t.Errorf("Wrote %d bytes, want %d", len(contents), len(want))
+	}
+
+	if fs.hadData {
+		t.Errorf("Data was set")
+	}
+
+	// The server may still be logging about the last request until it's done.
+	k.Close()
+	if strings.Contains(logged.String(), "without splice") {
+		t.Errorf("Fell back:\n%s", logged.String())
+	}
+}
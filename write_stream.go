@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/internal/buffer"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+)
+
+var errWritePayloadReleased = errors.New("WriteFileOp.Reader used after Release")
+
+// The payload of a write op for cfg.StreamWrites or cfg.SpliceWrites, which
+// owns the message it arrived in until released. With cfg.SpliceWrites the
+// data may still be in the message's pipe rather than in op.Data.
+type writePayload struct {
+	c *Connection
+
+	// A copy of the message's header, for replying after the message has been
+	// released.
+	header fusekernel.InHeader
+
+	mu sync.Mutex
+
+	// The message, or nil once released.
+	//
+	// GUARDED_BY(mu)
+	inMsg *buffer.InMessage
+
+	// GUARDED_BY(mu)
+	r bytes.Reader
+}
+
+// Replace the supplied op's Data with a Reader, taking ownership of the
+// message that it arrived in.
+func (c *Connection) streamWrite(
+	inMsg *buffer.InMessage,
+	op *fuseops.WriteFileOp) *writePayload {
+	p := &writePayload{
+		c:      c,
+		header: *inMsg.Header(),
+		inMsg:  inMsg,
+	}
+
+	p.r.Reset(op.Data)
+
+	op.Data = nil
+	op.Reader = p
+	op.Release = p.release
+
+	return p
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *writePayload) Read(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inMsg == nil {
+		return 0, errWritePayloadReleased
+	}
+
+	if p.inMsg.PayloadLen() > 0 {
+		return p.inMsg.ReadPayload(b)
+	}
+
+	return p.r.Read(b)
+}
+
+// LOCKS_EXCLUDED(p.mu)
+func (p *writePayload) WriteTo(w io.Writer) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inMsg == nil {
+		return 0, errWritePayloadReleased
+	}
+
+	if p.inMsg.PayloadLen() > 0 {
+		return p.inMsg.WritePayloadTo(w)
+	}
+
+	return p.r.WriteTo(w)
+}
+
+// Return the message to the connection, if that hasn't been done already.
+//
+// LOCKS_EXCLUDED(p.mu)
+func (p *writePayload) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.inMsg == nil {
+		return
+	}
+
+	p.r.Reset(nil)
+	p.c.putInMessage(p.inMsg)
+	p.inMsg = nil
+}
@@ -27,3 +27,40 @@ func writev(fd int, packet [][]byte) (n int, err error) {
 	}
 	return
 }
+
+// The most slices that writev accepts in one call, IOV_MAX on both Linux and
+// macOS.
+const maxIovecs = 1024
+
+// Return a packet with the same contents as the supplied one that writev can
+// send in a single call, copying the slices beyond maxIovecs into one buffer
+// if there are too many. A message must be written to the device in one
+// call, so it can't be split across several.
+func limitIovecs(packet [][]byte) [][]byte {
+	var n, last int
+	for i, v := range packet {
+		if len(v) == 0 {
+			continue
+		}
+
+		// Merge the last slice that fit with everything after it.
+		if n++; n > maxIovecs {
+			rest := packet[last:]
+			var size int
+			for _, v := range rest {
+				size += len(v)
+			}
+
+			tail := make([]byte, 0, size)
+			for _, v := range rest {
+				tail = append(tail, v...)
+			}
+
+			return append(packet[:last:last], tail)
+		}
+
+		last = i
+	}
+
+	return packet
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fuse_test
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fusetesting"
+	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/fuse/internal/fusekernel"
+	"golang.org/x/sys/unix"
+)
+
+type xattrFS struct {
+	fuseutil.NotImplementedFileSystem
+
+	mu  sync.Mutex
+	ops []fuseops.SetXattrOp
+}
+
+func (fs *xattrFS) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// The value refers to the request's memory.
+	saved := *op
+	saved.Value = append([]byte(nil), op.Value...)
+	fs.ops = append(fs.ops, saved)
+
+	return nil
+}
+
+func (fs *xattrFS) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) error {
+	const value = "taco"
+
+	op.BytesRead = len(value)
+	if len(op.Dst) >= len(value) {
+		copy(op.Dst, value)
+	} else if len(op.Dst) != 0 {
+		return syscall.ERANGE
+	}
+
+	return nil
+}
+
+func TestXattrs(t *testing.T) {
+	fs := &xattrFS{}
+	k := newFakeKernel(
+		t,
+		fuseutil.NewFileSystemServer(fs),
+		&fuse.MountConfig{StrictProtocolValidation: true},
+		&fusetesting.FakeKernelConfig{})
+
+	// Set a value, then replace it with an empty one.
+	setCases := []struct {
+		value string
+		flags uint32
+	}{
+		{"bar", unix.XATTR_CREATE},
+		{"", unix.XATTR_REPLACE},
+	}
+
+	for _, tc := range setCases {
+		var in fusekernel.SetxattrIn
+		in.Size = uint32(len(tc.value))
+		in.Flags = tc.flags
+
+		r, err := k.Call(
+			fusekernel.OpSetxattr,
+			2,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+			nameBytes("user.foo"),
+			[]byte(tc.value))
+
+		if err != nil || r.Error != 0 {
+			t.Fatalf("Call: %v, %v", err, r.Error)
+		}
+	}
+
+	fs.mu.Lock()
+	ops := fs.ops
+	fs.mu.Unlock()
+
+	if len(ops) != len(setCases) {
+		t.Fatalf("Got %d ops, want %d", len(ops), len(setCases))
+	}
+
+	for i, tc := range setCases {
+		op := ops[i]
+		if op.Inode != 2 || op.Name != "user.foo" {
+			t.Errorf("Op %d: got inode %d, name %q", i, op.Inode, op.Name)
+		}
+
+		if string(op.Value) != tc.value {
+			t.Errorf("Op %d: got value %q, want %q", i, op.Value, tc.value)
+		}
+
+		if op.Flags != tc.flags {
+			t.Errorf("Op %d: got flags %#x, want %#x", i, op.Flags, tc.flags)
+		}
+	}
+
+	// A size probe gets the size back in a GetxattrOut, and a big enough read
+	// gets the value.
+	getCases := []struct {
+		size  uint32
+		errno syscall.Errno
+		want  string
+	}{
+		{0, 0, ""},
+		{2, syscall.ERANGE, ""},
+		{100, 0, "taco"},
+	}
+
+	for _, tc := range getCases {
+		var in fusekernel.GetxattrIn
+		in.Size = tc.size
+
+		r, err := k.Call(
+			fusekernel.OpGetxattr,
+			2,
+			structBytes(unsafe.Pointer(&in), unsafe.Sizeof(in), int(unsafe.Sizeof(in))),
+			nameBytes("user.foo"))
+
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+
+		if r.Error != tc.errno {
+			t.Errorf("Size %d: got errno %v, want %v", tc.size, r.Error, tc.errno)
+			continue
+		}
+
+		if r.Error != 0 {
+			continue
+		}
+
+		if tc.size != 0 {
+			if string(r.Body) != tc.want {
+				t.Errorf("Size %d: got %q, want %q", tc.size, r.Body, tc.want)
+			}
+
+			continue
+		}
+
+		var out fusekernel.GetxattrOut
+		if len(r.Body) != int(unsafe.Sizeof(out)) {
+			t.Fatalf("Size %d: got %d bytes", tc.size, len(r.Body))
+		}
+
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(&out)), unsafe.Sizeof(out)), r.Body)
+		if out.Size != 4 {
+			t.Errorf("Size probe: got %d, want 4", out.Size)
+		}
+	}
+}